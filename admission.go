@@ -0,0 +1,91 @@
+package spdy
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// StreamDecision is a server's decision on whether to
+// serve a newly opened stream. See SetStreamAdmission.
+type StreamDecision struct {
+	Refuse bool // refuse the stream with REFUSED_STREAM, so the client may retry it.
+	Status int  // if non-zero, reply with this HTTP status, without running the handler.
+}
+
+// AcceptStream serves the stream as normal.
+var AcceptStream = StreamDecision{}
+
+// RefuseStream refuses the stream with REFUSED_STREAM,
+// telling the client that the request was not processed.
+var RefuseStream = StreamDecision{Refuse: true}
+
+// RejectStream replies to the stream with the given HTTP
+// status code and no body, without running the handler.
+func RejectStream(status int) StreamDecision {
+	return StreamDecision{Status: status}
+}
+
+func (d StreamDecision) String() string {
+	switch {
+	case d.Refuse:
+		return "Refuse"
+	case d.Status != 0:
+		return fmt.Sprintf("Reject(%d)", d.Status)
+	default:
+		return "Accept"
+	}
+}
+
+// admissionFunc decides whether a stream is served,
+// given its headers, priority, and the client's address.
+type admissionFunc func(header http.Header, priority Priority, remoteAddr string) StreamDecision
+
+// SetStreamAdmission registers a function which decides whether
+// each stream opened on the SPDY connections served by srv is
+// served. admit is called with the stream's request headers, as
+// received, once they have been decompressed, and before the
+// stream uses any other resources, such as a handler goroutine,
+// so it can be used for cheap authentication and rate limiting.
+//
+// admit is called from the connection's frame processing, so
+// must be fast, and must not block. Streams which are not
+// accepted are reported to the connection's OnStreamRefused
+// hook, and to its OnRequestComplete hook, with the decision
+// in the RequestInfo. This must be called before srv begins
+// serving.
+func SetStreamAdmission(srv *http.Server, admit func(header http.Header, priority Priority, remoteAddr string) StreamDecision) {
+	servers.Lock()
+	servers.config(srv).admission = admit
+	servers.Unlock()
+}
+
+// serverAdmission returns the stream
+// admission function registered for srv.
+func serverAdmission(srv *http.Server) admissionFunc {
+	return servers.lookup(srv).admission
+}
+
+// refusedRequestInfo describes a stream which was not
+// accepted, for the OnRequestComplete hook, taking its
+// method and URL from the request headers.
+func refusedRequestInfo(sid StreamID, header http.Header, version uint16, decision StreamDecision) RequestInfo {
+	info := RequestInfo{StreamID: sid, Decision: decision}
+	if version == 2 {
+		info.Method = header.Get("method")
+		info.URL = header.Get("scheme") + "://" + header.Get("host") + header.Get("url")
+	} else {
+		info.Method = header.Get(":method")
+		info.URL = header.Get(":scheme") + "://" + header.Get(":host") + header.Get(":path")
+	}
+	return info
+}
+
+// rejectedStatus returns the status code sent in
+// reply to a rejected stream, which must be valid.
+func rejectedStatus(status int) int {
+	if status < 100 || status > 999 {
+		log.Printf("Warning: Invalid status %d given to reject stream. Using 500.\n", status)
+		return http.StatusInternalServerError
+	}
+	return status
+}
@@ -0,0 +1,162 @@
+package spdy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// admissionLog records the streams given to the stream
+// admission function and the hooks it is reported to.
+type admissionLog struct {
+	sync.Mutex
+	admitted []string
+	refused  map[StreamID]StreamDecision
+	complete map[StreamID]RequestInfo
+}
+
+func (l *admissionLog) hooks() *ConnHooks {
+	return &ConnHooks{
+		OnStreamRefused: func(conn Conn, sid StreamID, decision StreamDecision) {
+			l.Lock()
+			defer l.Unlock()
+			l.refused[sid] = decision
+		},
+		OnRequestComplete: func(conn Conn, info RequestInfo) {
+			l.Lock()
+			defer l.Unlock()
+			l.complete[info.StreamID] = info
+		},
+	}
+}
+
+// completed waits for the OnRequestComplete hook to be
+// called for the stream, returning its RequestInfo and
+// the decision given to OnStreamRefused, if any.
+func (l *admissionLog) completed(t *testing.T, sid StreamID) (info RequestInfo, decision StreamDecision, refused bool) {
+	t.Helper()
+	within(t, 5*time.Second, "OnRequestComplete", func() {
+		for {
+			var ok bool
+			l.Lock()
+			info, ok = l.complete[sid]
+			decision, refused = l.refused[sid]
+			l.Unlock()
+			if ok {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+	info.Duration = 0
+	info.Tags = nil
+	return info, decision, refused
+}
+
+// The function given to SetStreamAdmission decides whether
+// each stream is served, refused with REFUSED_STREAM or
+// rejected with a status, without running the handler. Its
+// decision is given to OnStreamRefused, for streams which
+// are not accepted, and to OnRequestComplete.
+func TestStreamAdmission(t *testing.T) {
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			var handled []string
+			var handledLock sync.Mutex
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handledLock.Lock()
+				handled = append(handled, r.URL.Path)
+				handledLock.Unlock()
+				w.Write([]byte("ok"))
+			})}
+			admissions := &admissionLog{refused: make(map[StreamID]StreamDecision), complete: make(map[StreamID]RequestInfo)}
+			SetConnHooks(srv, admissions.hooks())
+			SetStreamAdmission(srv, func(header http.Header, priority Priority, remoteAddr string) StreamDecision {
+				path := header.Get(":path")
+				if version == 2 {
+					path = header.Get("url")
+				}
+				admissions.Lock()
+				admissions.admitted = append(admissions.admitted, path)
+				admissions.Unlock()
+				switch path {
+				case "/refuse":
+					return RefuseStream
+				case "/reject":
+					return RejectStream(http.StatusForbidden)
+				case "/invalid":
+					return RejectStream(7)
+				}
+				return AcceptStream
+			})
+			_, client := pipeConns(t, srv, version)
+
+			get := func(path string) (*response, error) {
+				req, _ := http.NewRequest("GET", "https://example.com"+path, nil)
+				return request(client, req)
+			}
+
+			// Accepted streams are served, and reported
+			// with the decision to accept them.
+			res, err := get("/accept")
+			if err != nil || res.StatusCode != http.StatusOK || res.Data.String() != "ok" {
+				t.Fatalf("got %v, %v, want the handler's response", res, err)
+			}
+			info, _, refused := admissions.completed(t, 1)
+			want := RequestInfo{StreamID: 1, Method: "GET", URL: "https://example.com/accept", Status: http.StatusOK, Decision: AcceptStream}
+			if !reflect.DeepEqual(info, want) || refused {
+				t.Errorf("got %+v, refused %v, want %+v", info, refused, want)
+			}
+
+			// Refused streams are reset with REFUSED_STREAM.
+			_, err = get("/refuse")
+			var streamErr *StreamError
+			if !errors.As(err, &streamErr) || streamErr.Status != RST_STREAM_REFUSED_STREAM {
+				t.Fatalf("got %v, want REFUSED_STREAM", err)
+			}
+			info, decision, refused := admissions.completed(t, 3)
+			want = RequestInfo{StreamID: 3, Method: "GET", URL: "https://example.com/refuse", Decision: RefuseStream}
+			if !reflect.DeepEqual(info, want) || !refused || decision != RefuseStream {
+				t.Errorf("got %+v, refused %v with %v, want %+v", info, refused, decision, want)
+			}
+
+			// Rejected streams are given the status, or 500
+			// if the status is not valid.
+			for i, test := range []struct {
+				path     string
+				decision StreamDecision
+				status   int
+			}{
+				{"/reject", RejectStream(http.StatusForbidden), http.StatusForbidden},
+				{"/invalid", RejectStream(7), http.StatusInternalServerError},
+			} {
+				sid := StreamID(5 + 2*i)
+				res, err = get(test.path)
+				if err != nil || res.StatusCode != test.status || res.Data.Len() != 0 {
+					t.Fatalf("%s: got %v, %v, want an empty %d response", test.path, res, err, test.status)
+				}
+				info, decision, refused = admissions.completed(t, sid)
+				want = RequestInfo{StreamID: sid, Method: "GET", URL: "https://example.com" + test.path, Status: test.status, Decision: test.decision}
+				if !reflect.DeepEqual(info, want) || !refused || decision != test.decision {
+					t.Errorf("%s: got %+v, refused %v with %v, want %+v", test.path, info, refused, decision, want)
+				}
+			}
+
+			admissions.Lock()
+			if want := []string{"/accept", "/refuse", "/reject", "/invalid"}; !reflect.DeepEqual(admissions.admitted, want) {
+				t.Errorf("admitted %v, want %v", admissions.admitted, want)
+			}
+			admissions.Unlock()
+			handledLock.Lock()
+			if want := []string{"/accept"}; !reflect.DeepEqual(handled, want) {
+				t.Errorf("handled %v, want only %v", handled, want)
+			}
+			handledLock.Unlock()
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package spdy_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	logging "log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/SlyMarbo/spdy"
+)
+
+// The package's exported API, grouped as in the package
+// documentation. Removing any of these, or changing its
+// signature, breaks code which imports the package, and
+// fails to build here.
+
+// Wire format.
+var (
+	_ func([]byte, uint16) (spdy.Frame, error)  = spdy.ParseFrame
+	_ func(spdy.Frame) ([]byte, error)          = spdy.MarshalFrame
+	_ func(uint16) spdy.Compressor              = spdy.NewCompressor
+	_ func(uint16) spdy.Decompressor            = spdy.NewDecompressor
+	_ func(uint16, spdy.Priority) (byte, error) = spdy.EncodePriority
+	_ func(uint16, byte) spdy.Priority          = spdy.DecodePriority
+
+	_ spdy.Flags
+	_ spdy.StreamID
+	_ spdy.StatusCode
+	_ spdy.Priority
+	_ spdy.Setting
+	_ spdy.Settings
+)
+
+// Connections and streams.
+var (
+	_ func(net.Conn, spdy.Receiver, uint16) (spdy.Conn, error)                                           = spdy.NewClientConn
+	_ func(*tls.Conn, spdy.Receiver) (spdy.Conn, error)                                                  = spdy.NewClientTLSConn
+	_ func(net.Conn, *http.Server, uint16) (spdy.Conn, error)                                            = spdy.NewServerConn
+	_ func(string, string, *tls.Config, spdy.Receiver) (spdy.Conn, error)                                = spdy.DialTLS
+	_ func(context.Context, spdy.Conn, *http.Request, spdy.Receiver, spdy.Priority) (spdy.Stream, error) = spdy.RequestCtx
+	_ func(spdy.Conn) error                                                                              = spdy.ConnError
+	_ func(spdy.Conn) (map[uint32]spdy.Setting, error)                                                   = spdy.ReceivedSettings
+	_ func(spdy.Conn) *tls.ConnectionState                                                               = spdy.TLSState
+	_ func(spdy.Conn, time.Duration) error                                                               = spdy.PingWithTimeout
+	_ func(spdy.Conn, int) error                                                                         = spdy.SetInteractiveRecordSize
+	_ func(spdy.Conn, bool) error                                                                        = spdy.SetLenientHeaders
+	_ func(spdy.Conn, int) error                                                                         = spdy.SetMaxHeaders
+	_ func(spdy.Conn, int) error                                                                         = spdy.SetResetFloodLimit
+	_ func() spdy.SettingsStore                                                                          = spdy.NewSettingsStore
+	_ func(uint16) (spdy.VersionCapabilities, bool)                                                      = spdy.Capabilities
+	_ func(uint16) bool                                                                                  = spdy.SupportedVersion
+	_ func() []int                                                                                       = spdy.SupportedVersions
+	_ func(uint16) error                                                                                 = spdy.EnableSpdyVersion
+	_ func(uint16) error                                                                                 = spdy.DisableSpdyVersion
+	_ func() []string                                                                                    = spdy.NPNStrings
+
+	_ spdy.Stream
+	_ spdy.StreamState
+	_ spdy.Receiver
+	_ spdy.TrailerReceiver
+	_ spdy.Canceler
+	_ spdy.Ping
+	_ spdy.ConnClosedError
+	_ spdy.GoAwayError
+	_ spdy.ProtocolError
+	_ spdy.StreamError
+)
+
+// Clients.
+var (
+	_ func(*tls.Config) *spdy.Transport                                         = spdy.NewTransport
+	_ func(context.Context, *http.Request, *tls.Config) (*http.Response, error) = spdy.RoundTripOnce
+	_ func(http.Client, string) (<-chan spdy.Ping, error)                       = spdy.PingServer
+	_ func(*url.URL) spdy.Priority                                              = spdy.DefaultPriority
+
+	_ spdy.Client
+	_ spdy.RangeOptions
+	_ spdy.PushInfo
+	_ spdy.WarmupError
+)
+
+// Servers.
+var (
+	_ func(string, string, string, http.Handler) error                                 = spdy.ListenAndServeTLS
+	_ func(*http.Server)                                                               = spdy.AddSPDY
+	_ func(*http.Server)                                                               = spdy.EnableHeaderElision
+	_ func(*http.Server)                                                               = spdy.EnableSessionFlowControl
+	_ func(*http.Server, uint32)                                                       = spdy.SetMaxConcurrentStreams
+	_ func(*http.Server, *spdy.ConnHooks)                                              = spdy.SetConnHooks
+	_ func(*http.Server, func(http.Header, spdy.Priority, string) spdy.StreamDecision) = spdy.SetStreamAdmission
+	_ func(int) spdy.StreamDecision                                                    = spdy.RejectStream
+	_ func(context.Context, *http.Server) (int, error)                                 = spdy.Drain
+	_ func(*http.Server) (int, int)                                                    = spdy.DrainProgress
+	_ func(net.Listener, bool, func(net.Conn) error) net.Listener                      = spdy.TuneListener
+	_ func(http.ResponseWriter, string) (http.ResponseWriter, error)                   = spdy.Push
+	_ func(context.Context) (spdy.Pusher, bool)                                        = spdy.PusherFromContext
+	_ func(context.Context, string) context.Context                                    = spdy.WithPushLabel
+	_ func(http.ResponseWriter) (<-chan spdy.Ping, error)                              = spdy.PingClient
+	_ func(http.ResponseWriter) error                                                  = spdy.SetInteractive
+	_ func(context.Context) context.Context                                            = spdy.WithInteractive
+	_ func(http.ResponseWriter) bool                                                   = spdy.UsingSPDY
+	_ func(http.ResponseWriter) uint16                                                 = spdy.SPDYversion
+	_ func(context.Context, string, string) error                                      = spdy.SetStreamTag
+	_ func(context.Context, map[string]string) context.Context                         = spdy.WithStreamTags
+
+	_ spdy.RequestInfo
+	_ spdy.ConnMigration
+)
+
+// Diagnostics.
+var (
+	_ func(*http.Server) []*spdy.ConnSnapshot = spdy.Snapshot
+	_ func(*http.Server) *spdy.ConnStats      = spdy.Stats
+	_ func(string, interface{})               = spdy.PublishStats
+	_ func(*http.Server) http.Handler         = spdy.ServerDebugHandler
+	_ func(*spdy.Transport) http.Handler      = spdy.TransportDebugHandler
+	_ func(context.Context) context.Context   = spdy.ProfileLabels
+	_ func(bool)                              = spdy.SetFlowControlAudit
+	_ func()                                  = spdy.EnableDebugOutput
+	_ func(io.Writer)                         = spdy.SetDebugOutput
+	_ func(*logging.Logger)                   = spdy.SetDebugLogger
+	_ func(io.Writer)                         = spdy.SetLogOutput
+	_ func(*logging.Logger)                   = spdy.SetLogger
+
+	_ spdy.StreamSnapshot
+	_ spdy.ConnEvent
+	_ spdy.Histogram
+)
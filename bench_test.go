@@ -0,0 +1,203 @@
+package spdy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+// The DATA benchmarks move 1 GiB in 16 KiB frames.
+const (
+	benchTransfer  = 1 << 30
+	benchFrameSize = 16 << 10
+)
+
+// repeatReader reads data over and over.
+type repeatReader struct {
+	data []byte
+	off  int
+}
+
+func (r *repeatReader) Read(b []byte) (int, error) {
+	n := copy(b, r.data[r.off:])
+	r.off = (r.off + n) % len(r.data)
+	return n, nil
+}
+
+// DATA frames are parsed, their data consumed, and
+// their payload buffers released, as by the read loop.
+func BenchmarkReadData(b *testing.B) {
+	frames := new(bytes.Buffer)
+	frame := &dataFrameV3{StreamID: 1, Data: make([]byte, benchFrameSize)}
+	for i := 0; i < 64; i++ {
+		frame.WriteTo(frames)
+	}
+	sink := make([]byte, benchFrameSize)
+
+	b.ReportAllocs()
+	b.SetBytes(benchTransfer)
+	for i := 0; i < b.N; i++ {
+		r := bufio.NewReader(&repeatReader{data: frames.Bytes()})
+		pool := new(framePoolV3)
+		for n := 0; n < benchTransfer/benchFrameSize; n++ {
+			frame, err := readFrameV3(r, pool, MAX_FRAME_SIZE)
+			if err != nil {
+				b.Fatal(err)
+			}
+			data := frame.(*dataFrameV3)
+			copy(sink, data.Data)
+			data.release()
+		}
+	}
+}
+
+// DATA frames are written, as by the send loop.
+func BenchmarkWriteData(b *testing.B) {
+	frame := &dataFrameV3{StreamID: 1, Data: make([]byte, benchFrameSize)}
+	w := bufio.NewWriter(ioutil.Discard)
+
+	b.ReportAllocs()
+	b.SetBytes(benchTransfer)
+	for i := 0; i < b.N; i++ {
+		for n := 0; n < benchTransfer/benchFrameSize; n++ {
+			if _, err := frame.WriteTo(w); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// A handler writes a response in 16 KiB writes,
+// which the client reads over a net.Pipe.
+func BenchmarkTransfer(b *testing.B) {
+	chunk := make([]byte, benchFrameSize)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for n := 0; n < benchTransfer/benchFrameSize; n++ {
+			w.Write(chunk)
+		}
+	})}
+
+	b.ReportAllocs()
+	b.SetBytes(benchTransfer)
+	for i := 0; i < b.N; i++ {
+		_, client := pipeConns(b, srv, 3)
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		stream, err := client.Request(req, nil, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		go stream.Run()
+		if n, err := io.Copy(ioutil.Discard, stream); n != benchTransfer || err != nil {
+			b.Fatalf("read %d bytes, error %v", n, err)
+		}
+	}
+}
+
+// controlFrames are the PING and WINDOW_UPDATE frames
+// of each version, which are read and written often
+// enough that they must not allocate.
+var controlFrames = []struct {
+	name  string
+	frame Frame
+}{
+	{"SPDY/3 PING", &pingFrameV3{PingID: 1}},
+	{"SPDY/3 WINDOW_UPDATE", &windowUpdateFrameV3{StreamID: 1, DeltaWindowSize: 1 << 16}},
+	{"SPDY/2 PING", &pingFrameV2{PingID: 1}},
+	{"SPDY/2 WINDOW_UPDATE", &windowUpdateFrameV2{StreamID: 1, DeltaWindowSize: 1 << 16}},
+}
+
+func TestControlFrameAllocs(t *testing.T) {
+	for _, test := range controlFrames {
+		data, err := MarshalFrame(test.frame)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		r := bytes.NewReader(data)
+		w := bufio.NewWriter(ioutil.Discard)
+
+		allocs := testing.AllocsPerRun(100, func() {
+			r.Reset(data)
+			if _, err := test.frame.ReadFrom(r); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if allocs != 0 {
+			t.Errorf("%s: reading allocated %v times", test.name, allocs)
+		}
+
+		allocs = testing.AllocsPerRun(100, func() {
+			if _, err := test.frame.WriteTo(w); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if allocs != 0 {
+			t.Errorf("%s: writing allocated %v times", test.name, allocs)
+		}
+	}
+}
+
+// PING and WINDOW_UPDATE frames are parsed and released,
+// as by the read loop.
+func BenchmarkReadControl(b *testing.B) {
+	for _, test := range controlFrames[:2] {
+		data, err := MarshalFrame(test.frame)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(test.name, func(b *testing.B) {
+			r := bufio.NewReader(&repeatReader{data: data})
+			pool := new(framePoolV3)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				frame, err := readFrameV3(r, pool, MAX_FRAME_SIZE)
+				if err != nil {
+					b.Fatal(err)
+				}
+				pool.recycle(frame)
+			}
+		})
+	}
+}
+
+// A handler writes a response in 256 KiB writes, which
+// are split into DATA frames of various sizes, or sent
+// whole, as the client reads it over a net.Pipe.
+func BenchmarkDataFrameSize(b *testing.B) {
+	const transfer = 64 << 20
+	chunk := make([]byte, 256<<10)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for n := 0; n < transfer/len(chunk); n++ {
+			w.Write(chunk)
+		}
+	})}
+
+	for _, size := range []struct {
+		name string
+		size int
+	}{
+		{"16KiB", 16 << 10},
+		{"64KiB", 64 << 10},
+		{"unbounded", MAX_DATA_SIZE},
+	} {
+		b.Run(size.name, func(b *testing.B) {
+			setMaxDataFrameSize(b, size.size)
+			b.ReportAllocs()
+			b.SetBytes(transfer)
+			for i := 0; i < b.N; i++ {
+				_, client := pipeConns(b, srv, 3)
+				req, _ := http.NewRequest("GET", "http://example.com/", nil)
+				stream, err := client.Request(req, nil, 0)
+				if err != nil {
+					b.Fatal(err)
+				}
+				go stream.Run()
+				if n, err := io.Copy(ioutil.Discard, stream); n != transfer || err != nil {
+					b.Fatalf("read %d bytes, error %v", n, err)
+				}
+			}
+		})
+	}
+}
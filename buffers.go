@@ -0,0 +1,74 @@
+package spdy
+
+import (
+	"sync"
+)
+
+// payloadClasses are the capacities of the pooled buffers
+// used to hold the payloads of DATA frames received. Each
+// payload is read into the smallest buffer which can hold
+// it, and payloads larger than the largest class are
+// allocated as usual.
+var payloadClasses = [...]int{1 << 10, 4 << 10, 16 << 10, 64 << 10}
+
+// payloadPools hold the free buffers of each class
+// in payloadClasses. Pointers to the buffers are
+// pooled, so that returning them does not allocate.
+var payloadPools [len(payloadClasses)]sync.Pool
+
+// getPayload returns a buffer from the pools to hold n
+// bytes, or nil if n is larger than the largest class.
+// The buffer should be returned with putPayload once its
+// contents are no longer needed.
+func getPayload(n int) *[]byte {
+	for i, size := range payloadClasses {
+		if n > size {
+			continue
+		}
+		if buf, ok := payloadPools[i].Get().(*[]byte); ok {
+			return buf
+		}
+		buf := make([]byte, size)
+		return &buf
+	}
+	return nil
+}
+
+// putPayload returns a buffer taken with getPayload
+// to its pool. The buffer must not be used by the
+// caller, or anyone else, afterwards.
+func putPayload(buf *[]byte) {
+	for i, size := range payloadClasses {
+		if cap(*buf) == size {
+			*buf = (*buf)[:size]
+			payloadPools[i].Put(buf)
+			return
+		}
+	}
+}
+
+// dataCopier is implemented by Receivers which may copy
+// the data given to ReceiveData before it returns, rather
+// than keeping it. If copiesData returns true, they are
+// given DATA frames' payloads directly, even if they are
+// held in pooled buffers, which are reused once the frames
+// have been handled.
+type dataCopier interface {
+	copiesData() bool
+}
+
+// receivedData returns the payload of a DATA frame to
+// be given to receiver. A pooled payload is copied, as
+// the receiver may keep it after ReceiveData returns,
+// unless the receiver is known to copy it itself.
+func receivedData(receiver Receiver, data []byte, pooled bool) []byte {
+	if !pooled {
+		return data
+	}
+	if c, ok := receiver.(dataCopier); ok && c.copiesData() {
+		return data
+	}
+	owned := make([]byte, len(data))
+	copy(owned, data)
+	return owned
+}
@@ -0,0 +1,53 @@
+package spdy
+
+import (
+	"context"
+	"net/http"
+)
+
+// Canceler is implemented by the Streams returned by a
+// Conn's Request method, allowing a request to be abandoned
+// before the server has finished its response.
+//
+//	stream, err := conn.Request(req, receiver, spdy.DefaultPriority(req.URL))
+//	if err != nil {
+//		return err
+//	}
+//	// ...
+//	stream.(spdy.Canceler).Cancel()
+type Canceler interface {
+	Cancel() error
+}
+
+// RequestCtx makes a request on conn, as with its Request
+// method, which is cancelled if ctx is done before the
+// response has been received in full. A cancelled request's
+// stream is reset with CANCEL, its Run method returns
+// ErrStreamCancelled, and reads of its response body return
+// ErrStreamCancelled once any data already received has been
+// read. A timeout or deadline for the request can be given
+// with context.WithTimeout or context.WithDeadline.
+//
+// The request's own context is replaced by ctx. Requests made
+// with a Transport are cancelled in the same way when their
+// contexts are done.
+func RequestCtx(ctx context.Context, conn Conn, request *http.Request, receiver Receiver, priority Priority) (Stream, error) {
+	return conn.Request(request.WithContext(ctx), receiver, priority)
+}
+
+// cancelOnDone cancels the request on stream s if done is
+// closed before the stream has finished, or its connection
+// has closed.
+func cancelOnDone(done <-chan struct{}, s Canceler, finished, stop <-chan struct{}) {
+	if done == nil {
+		return
+	}
+	go func() {
+		select {
+		case <-done:
+			s.Cancel()
+		case <-finished:
+		case <-stop:
+		}
+	}()
+}
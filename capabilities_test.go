@@ -0,0 +1,115 @@
+package spdy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// onlyVersion enables v alone for the rest of the test.
+func onlyVersion(t *testing.T, v uint16) {
+	t.Helper()
+	enabled := SupportedVersions()
+	t.Cleanup(func() {
+		for w := range versionCapabilities {
+			DisableSpdyVersion(w)
+		}
+		for _, w := range enabled {
+			EnableSpdyVersion(uint16(w))
+		}
+	})
+	for w := range versionCapabilities {
+		if err := DisableSpdyVersion(w); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := EnableSpdyVersion(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	for _, v := range versions {
+		c, ok := Capabilities(v)
+		if !ok || c.Version != v || c.NPN != fmt.Sprintf("spdy/%d", v) {
+			t.Errorf("SPDY/%d has capabilities %+v, implemented %v", v, c, ok)
+		}
+		if c.FlowControl != (v == 3) {
+			t.Errorf("SPDY/%d flow control is %v", v, c.FlowControl)
+		}
+	}
+	if c, ok := Capabilities(1); ok {
+		t.Errorf("SPDY/1 has capabilities %+v", c)
+	}
+	if err := EnableSpdyVersion(4); err == nil {
+		t.Error("enabled SPDY/4")
+	}
+
+	// NPNStrings follows the enabled versions.
+	if s := NPNStrings(); !reflect.DeepEqual(s, []string{"spdy/3", "spdy/2", "http/1.1"}) {
+		t.Errorf("NPNStrings gave %v", s)
+	}
+	onlyVersion(t, 2)
+	if s := NPNStrings(); !reflect.DeepEqual(s, []string{"spdy/2", "http/1.1"}) {
+		t.Errorf("with only SPDY/2 enabled, NPNStrings gave %v", s)
+	}
+	if _, ok := Capabilities(3); !ok {
+		t.Error("disabling SPDY/3 removed its capabilities")
+	}
+}
+
+// Enabling a version in the table is enough for a
+// Transport and a server to negotiate and use it.
+func TestEnabledVersionServes(t *testing.T) {
+	for v := range versionCapabilities {
+		v := v
+		t.Run(fmt.Sprintf("SPDY/%d", v), func(t *testing.T) {
+			onlyVersion(t, v)
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				fmt.Fprintf(w, "SPDY/%d %s %s", SPDYversion(w), r.Method, body)
+			}))
+			AddSPDY(server.Config)
+			server.TLS = &tls.Config{NextProtos: NPNStrings()}
+			server.StartTLS()
+			defer server.Close()
+			tr := NewTransport(server.Client().Transport.(*http.Transport).TLSClientConfig)
+			defer tr.CloseIdleConnections()
+			client := &http.Client{Transport: tr}
+
+			within(t, 5*time.Second, "the requests", func() {
+				for _, method := range []string{"GET", "POST"} {
+					var reqBody io.Reader
+					if method == "POST" {
+						reqBody = strings.NewReader("body")
+					}
+					req, _ := http.NewRequest(method, server.URL+"/", reqBody)
+					res, err := client.Do(req)
+					if err != nil {
+						t.Errorf("%s failed: %v", method, err)
+						return
+					}
+					body, err := ioutil.ReadAll(res.Body)
+					res.Body.Close()
+					want := fmt.Sprintf("SPDY/%d %s ", v, method)
+					if method == "POST" {
+						want += "body"
+					}
+					if err != nil || string(body) != want {
+						t.Errorf("%s gave %q, error %v, want %q", method, body, err, want)
+					}
+				}
+			})
+			if n := Stats(server.Config).Conns; n != 1 {
+				t.Errorf("server has %d SPDY connections, want 1", n)
+			}
+		})
+	}
+}
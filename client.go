@@ -0,0 +1,193 @@
+package spdy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A Client is an HTTP client which makes requests over SPDY
+// where the server supports it, and HTTP/1.1 otherwise. It
+// combines an http.Client with a Transport configured from
+// the Client's fields.
+//
+// The zero Client is ready for use, with the defaults given
+// for each field. A Client is safe for concurrent use by
+// multiple goroutines, and should be reused, rather than
+// created for each request, so that its connections are
+// reused. Connections are pooled by host and port, with
+// requests to a host sharing a SPDY connection until it
+// is busy. Its fields should not be changed once it has
+// made a request.
+//
+// Once a Client is no longer needed, Close or Shutdown
+// should be called to close its connections. Requests
+// made afterwards fail with ErrClientClosed.
+//
+//	client := new(spdy.Client)
+//	defer client.Close()
+//	res, err := client.Get("https://example.com/")
+type Client struct {
+	// TLSConfig is the TLS configuration used for new
+	// connections. If nil, the default configuration is
+	// used. In either case, the supported SPDY versions
+	// are advertised with NPN.
+	TLSConfig *tls.Config
+
+	// Timeout, if non-zero, limits the time taken by each
+	// request, including reading the response body, as with
+	// the http.Client's Timeout.
+	Timeout time.Duration
+
+	// ReadTimeout and WriteTimeout, if non-zero, limit the
+	// time each SPDY connection may go without receiving a
+	// frame, and the time allowed for each write. See the
+	// Transport's fields of the same names.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// InitialWindowSize, if non-zero, is the initial transfer
+	// window advertised to servers for each SPDY/3 stream. The
+	// default is DEFAULT_INITIAL_CLIENT_WINDOW_SIZE.
+	InitialWindowSize uint32
+
+	// MaxStreamsPerConn, if non-zero, limits the number of
+	// requests in progress on each SPDY connection, after
+	// which another connection to the host is dialled. See
+	// the Transport's field of the same name.
+	MaxStreamsPerConn uint32
+
+	// IdleTimeout, if non-zero, is how long a SPDY connection
+	// may go without any requests in progress before it is
+	// closed.
+	IdleTimeout time.Duration
+
+	// MaxConcurrentStreams, if non-zero, limits the number
+	// of concurrent server pushes on each SPDY connection.
+	// The default is DEFAULT_STREAM_LIMIT.
+	MaxConcurrentStreams uint32
+
+	// Hooks, if non-nil, are informed of events
+	// on each SPDY connection made by the Client.
+	Hooks *ConnHooks
+
+	mu        sync.Mutex
+	transport *Transport   // created on first use.
+	client    *http.Client // created on first use.
+	closed    bool
+}
+
+// init returns the http.Client used to make requests,
+// creating it on first use.
+func (c *Client) init() (*http.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, ErrClientClosed
+	}
+	if c.client == nil {
+		t := NewTransport(c.TLSConfig)
+		t.ReadTimeout = c.ReadTimeout
+		t.WriteTimeout = c.WriteTimeout
+		t.InitialWindowSize = c.InitialWindowSize
+		t.MaxStreamsPerConn = c.MaxStreamsPerConn
+		t.IdleConnTimeout = c.IdleTimeout
+		t.MaxConcurrentStreams = c.MaxConcurrentStreams
+		t.Hooks = c.Hooks
+		c.transport = t
+		c.client = &http.Client{Transport: t, Timeout: c.Timeout}
+	}
+	return c.client, nil
+}
+
+// Do sends an HTTP request and returns an HTTP response,
+// as with the http.Client's Do method.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	client, err := c.init()
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req)
+}
+
+// Get issues a GET to the specified URL.
+func (c *Client) Get(url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// Head issues a HEAD to the specified URL.
+func (c *Client) Head(url string) (*http.Response, error) {
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// Post issues a POST to the specified URL,
+// with the given body and Content-Type.
+func (c *Client) Post(url, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return c.Do(req)
+}
+
+// CloseIdleConnections closes any connections which are
+// not in use, as with the Transport's CloseIdleConnections.
+// The Client remains usable, dialling new connections as
+// they are needed.
+func (c *Client) CloseIdleConnections() {
+	c.mu.Lock()
+	t := c.transport
+	c.mu.Unlock()
+
+	if t != nil {
+		t.CloseIdleConnections()
+	}
+}
+
+// Shutdown gracefully closes the Client. New requests fail
+// with ErrClientClosed, and each SPDY connection sends a
+// GOAWAY, then is closed once its requests in progress have
+// finished. If ctx is done first, the remaining connections
+// are closed immediately, failing their requests, and ctx's
+// error is returned. Responses read over HTTP/1.1 keep their
+// connections until their bodies are closed.
+//
+// Shutdown may be called more than once, and concurrently
+// with requests.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	c.closed = true
+	t := c.transport
+	c.mu.Unlock()
+
+	if t == nil {
+		return nil
+	}
+	return t.close(ctx)
+}
+
+// Close closes the Client immediately, failing any requests
+// in progress over SPDY. New requests fail with
+// ErrClientClosed. Use Shutdown to let requests in progress
+// finish first.
+func (c *Client) Close() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.Shutdown(ctx); err != nil && err != context.Canceled {
+		return err
+	}
+	return nil
+}
@@ -3,9 +3,12 @@ package spdy
 import (
 	"bufio"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
+	"sync/atomic"
 )
 
 // init modifies http.DefaultClient to use a spdy.Transport, enabling
@@ -16,7 +19,9 @@ func init() {
 
 // NewClientConn is used to create a SPDY connection, using the given
 // net.Conn for the underlying connection, and the given Receiver to
-// receive server pushes.
+// receive server pushes. The connection need not use TLS, such as
+// with net.Pipe or an established tunnel, in which case streams'
+// requests have no TLS state and CREDENTIAL frames are unavailable.
 func NewClientConn(conn net.Conn, push Receiver, version uint16) (spdyConn Conn, err error) {
 	if conn == nil {
 		return nil, errors.New("Error: Connection initialised with nil net.conn.")
@@ -28,7 +33,8 @@ func NewClientConn(conn net.Conn, push Receiver, version uint16) (spdyConn Conn,
 		out.remoteAddr = conn.RemoteAddr().String()
 		out.server = nil
 		out.conn = conn
-		out.buf = bufio.NewReader(conn)
+		out.stats = new(connStats)
+		out.buf = bufio.NewReader(countingReader{conn, &out.stats.bytesReceived})
 		if tlsConn, ok := conn.(*tls.Conn); ok {
 			out.tlsState = new(tls.ConnectionState)
 			*out.tlsState = tlsConn.ConnectionState()
@@ -43,25 +49,55 @@ func NewClientConn(conn net.Conn, push Receiver, version uint16) (spdyConn Conn,
 		out.output[5] = make(chan Frame)
 		out.output[6] = make(chan Frame)
 		out.output[7] = make(chan Frame)
+		out.control = newControlQueue()
 		out.pings = make(map[uint32]chan<- Ping)
-		out.nextPingID = 2
+		out.nextPingID = 1
 		out.compressor = NewCompressor(3)
 		out.decompressor = NewDecompressor(3)
+		out.frames = new(framePoolV3)
 		out.receivedSettings = make(Settings)
 		out.lastPushStreamID = 0
 		out.lastRequestStreamID = 0
 		out.oddity = 1
 		out.initialWindowSize = DEFAULT_INITIAL_CLIENT_WINDOW_SIZE
+		out.receiveWindowSize = DEFAULT_INITIAL_CLIENT_WINDOW_SIZE
 		out.requestStreamLimit = newStreamLimit(NO_STREAM_LIMIT)
 		out.pushStreamLimit = newStreamLimit(DEFAULT_STREAM_LIMIT)
+		out.vectorIndex = DEFAULT_CLIENT_CERTIFICATE_VECTOR_SIZE
+		out.certificates = make(map[uint16][]*x509.Certificate)
 		out.pushReceiver = push
 		out.pushRequests = make(map[StreamID]*http.Request)
+		out.pushOrigins = make(map[StreamID]StreamID)
+		out.refused = make(refusedStreams)
+		out.resets.limit = DEFAULT_RESET_FLOOD_LIMIT
+		out.maxHeaders = DEFAULT_MAX_HEADERS
+		out.headerCounts = make(map[StreamID]int)
+		out.id = nextConnID()
 		out.stop = make(chan struct{})
-		out.init = func() {
+		out.sendStopped = make(chan struct{})
+		out.closing = make(chan struct{})
+		out.clock = defaultClock
+		out.started = out.clock.Now()
+		out.init = func() []Frame {
 			// Initialise the connection by sending the connection settings.
 			settings := new(settingsFrameV3)
-			settings.Settings = defaultSPDYClientSettings(3, DEFAULT_STREAM_LIMIT)
-			out.output[0] <- settings
+			settings.Settings = defaultSPDYClientSettings(3, out.pushStreamLimit.Limit())
+			settings.Settings[SETTINGS_INITIAL_WINDOW_SIZE].Value = atomic.LoadUint32(&out.receiveWindowSize)
+			if out.session != nil {
+				settings.Settings[SETTINGS_EXPERIMENTAL_SESSION_FLOW_CONTROL] = sessionFlowControlSetting()
+				settings.Experimental = true
+			}
+			frames := []Frame{settings}
+
+			// Settings persisted from a previous connection to the
+			// server are returned to it in a separate frame, as they
+			// may share IDs with our own.
+			if len(out.persistedSettings) > 0 {
+				persisted := new(settingsFrameV3)
+				persisted.Settings = out.persistedSettings
+				frames = append(frames, persisted)
+			}
+			return frames
 		}
 
 		return out, nil
@@ -71,7 +107,8 @@ func NewClientConn(conn net.Conn, push Receiver, version uint16) (spdyConn Conn,
 		out.remoteAddr = conn.RemoteAddr().String()
 		out.server = nil
 		out.conn = conn
-		out.buf = bufio.NewReader(conn)
+		out.stats = new(connStats)
+		out.buf = bufio.NewReader(countingReader{conn, &out.stats.bytesReceived})
 		if tlsConn, ok := conn.(*tls.Conn); ok {
 			out.tlsState = new(tls.ConnectionState)
 			*out.tlsState = tlsConn.ConnectionState()
@@ -86,10 +123,12 @@ func NewClientConn(conn net.Conn, push Receiver, version uint16) (spdyConn Conn,
 		out.output[5] = make(chan Frame)
 		out.output[6] = make(chan Frame)
 		out.output[7] = make(chan Frame)
+		out.control = newControlQueue()
 		out.pings = make(map[uint32]chan<- Ping)
-		out.nextPingID = 2
+		out.nextPingID = 1
 		out.compressor = NewCompressor(2)
 		out.decompressor = NewDecompressor(2)
+		out.frames = new(framePoolV2)
 		out.receivedSettings = make(Settings)
 		out.lastPushStreamID = 0
 		out.lastRequestStreamID = 0
@@ -99,17 +138,91 @@ func NewClientConn(conn net.Conn, push Receiver, version uint16) (spdyConn Conn,
 		out.pushStreamLimit = newStreamLimit(DEFAULT_STREAM_LIMIT)
 		out.pushReceiver = push
 		out.pushRequests = make(map[StreamID]*http.Request)
+		out.pushOrigins = make(map[StreamID]StreamID)
+		out.refused = make(refusedStreams)
+		out.resets.limit = DEFAULT_RESET_FLOOD_LIMIT
+		out.maxHeaders = DEFAULT_MAX_HEADERS
+		out.headerCounts = make(map[StreamID]int)
+		out.id = nextConnID()
 		out.stop = make(chan struct{})
-		out.init = func() {
+		out.sendStopped = make(chan struct{})
+		out.closing = make(chan struct{})
+		out.clock = defaultClock
+		out.started = out.clock.Now()
+		out.init = func() []Frame {
 			// Initialise the connection by sending the connection settings.
 			settings := new(settingsFrameV2)
-			settings.Settings = defaultSPDYClientSettings(2, DEFAULT_STREAM_LIMIT)
-			out.output[0] <- settings
+			settings.Settings = defaultSPDYClientSettings(2, out.pushStreamLimit.Limit())
+			frames := []Frame{settings}
+
+			// Settings persisted from a previous connection to the
+			// server are returned to it in a separate frame, as they
+			// may share IDs with our own.
+			if len(out.persistedSettings) > 0 {
+				persisted := new(settingsFrameV2)
+				persisted.Settings = out.persistedSettings
+				frames = append(frames, persisted)
+			}
+			return frames
 		}
 
 		return out, nil
 
 	default:
-		return nil, errors.New("Error: Unrecognised SPDY version.")
+		return nil, ErrUnsupportedVersion
+	}
+}
+
+// NewClientTLSConn is used to create a SPDY connection over
+// the given TLS connection, using the SPDY version negotiated
+// with NPN. The handshake is completed first, if necessary.
+// The TLS configuration should advertise NPNStrings. If the
+// server did not choose SPDY, ErrNotSPDY is returned and
+// conn can be used for HTTP/1.1 instead.
+func NewClientTLSConn(conn *tls.Conn, push Receiver) (Conn, error) {
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+
+	proto := conn.ConnectionState().NegotiatedProtocol
+	version, ok := npnVersion(proto)
+	if !ok {
+		if proto == "" || proto == "http/1.1" {
+			return nil, ErrNotSPDY
+		}
+		return nil, errors.New(fmt.Sprintf("Error: Unsupported negotiated protocol %q.", proto))
+	}
+
+	return NewClientConn(conn, push, version)
+}
+
+// DialTLS connects to the given network address with TLS,
+// advertising the supported SPDY versions with NPN, and
+// creates a SPDY connection using the version negotiated.
+// config may be nil, and is copied before the versions
+// are added. If the server did not choose SPDY, the
+// connection is closed and ErrNotSPDY is returned.
+// The connection must be started with Run.
+func DialTLS(network, addr string, config *tls.Config, push Receiver) (Conn, error) {
+	if config == nil {
+		config = new(tls.Config)
+	} else {
+		config = config.Clone()
 	}
+	if config.NextProtos == nil {
+		config.NextProtos = NPNStrings()
+	}
+
+	tlsConn, err := tls.Dial(network, addr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := NewClientTLSConn(tlsConn, push)
+	if err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+
+	return conn, nil
 }
@@ -0,0 +1,109 @@
+package spdy_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SlyMarbo/spdy"
+	"github.com/SlyMarbo/spdy/spdytest"
+)
+
+func hello(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("hello"))
+}
+
+// getConcurrently makes n requests for url at once from
+// separate goroutines, each of which makes 10 in turn.
+func getConcurrently(t *testing.T, c *spdy.Client, url string, n int) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				res, err := c.Get(url)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				body, err := ioutil.ReadAll(res.Body)
+				res.Body.Close()
+				if err != nil || string(body) != "hello" {
+					t.Errorf("got body %q, error %v", body, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// checkGoroutines fails the test if more goroutines than
+// before are still running once they have had time to exit.
+func checkGoroutines(t *testing.T, before int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine() - before; n > 0 {
+		buf := make([]byte, 1<<20)
+		t.Fatalf("%d goroutines leaked:\n%s", n, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+func TestZeroClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(hello))
+	defer server.Close()
+	before := runtime.NumGoroutine()
+
+	var c spdy.Client
+	getConcurrently(t, &c, server.URL+"/", 10)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+	if _, err := c.Get(server.URL + "/"); !errors.Is(err, spdy.ErrClientClosed) {
+		t.Fatalf("Get after Close returned %v, want ErrClientClosed", err)
+	}
+
+	server.CloseClientConnections()
+	checkGoroutines(t, before)
+}
+
+func TestClientShutdown(t *testing.T) {
+	server := spdytest.NewServer(http.HandlerFunc(hello))
+	defer server.Close()
+	config := server.Client().Transport.(*spdy.Transport).TLSClientConfig
+	before := runtime.NumGoroutine()
+
+	c := &spdy.Client{
+		TLSConfig:         config,
+		ReadTimeout:       time.Minute,
+		WriteTimeout:      time.Minute,
+		InitialWindowSize: 1 << 16,
+	}
+	getConcurrently(t, c, server.URL+"/", 30)
+	c.CloseIdleConnections()
+	getConcurrently(t, c, server.URL+"/", 30)
+	if n := spdy.Stats(server.Config).Conns; n == 0 {
+		t.Fatal("SPDY was not negotiated")
+	}
+
+	if err := c.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(server.URL + "/"); !errors.Is(err, spdy.ErrClientClosed) {
+		t.Fatalf("Get after Shutdown returned %v, want ErrClientClosed", err)
+	}
+	checkGoroutines(t, before)
+}
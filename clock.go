@@ -0,0 +1,52 @@
+package spdy
+
+import (
+	"time"
+)
+
+// clock is used to access the current time and to
+// create timers. All time-dependent behaviour in
+// connections and the Transport goes through a
+// clock, so that tests can substitute a fake whose
+// time is advanced manually.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) timer
+}
+
+// timer is the subset of *time.Timer's behaviour
+// which is provided by clocks.
+type timer interface {
+	C() <-chan time.Time
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+// realClock is a clock using the system time.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTimer(d time.Duration) timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+// realTimer wraps a *time.Timer to satisfy timer.
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// defaultClock is the clock given to new connections
+// and Transports.
+var defaultClock clock = realClock{}
@@ -0,0 +1,368 @@
+package spdy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock whose time only moves when
+// Advance is called, firing any timers which are due.
+type fakeClock struct {
+	sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now()}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) timer {
+	c.Lock()
+	defer c.Unlock()
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1)}
+	c.start(t, d)
+	return t
+}
+
+// start sets t to fire once d has passed. start must
+// be called with the clock's lock held.
+func (c *fakeClock) start(t *fakeTimer, d time.Duration) {
+	t.when = c.now.Add(d)
+	if d <= 0 {
+		t.c <- c.now
+		return
+	}
+	c.timers = append(c.timers, t)
+}
+
+// stop stops t, returning whether it was waiting to
+// fire. stop must be called with the clock's lock held.
+func (c *fakeClock) stop(t *fakeTimer) bool {
+	for i, pending := range c.timers {
+		if pending == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Advance moves the time forward by d, firing the
+// timers which are due, in order.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+	sort.Slice(c.timers, func(i, j int) bool { return c.timers[i].when.Before(c.timers[j].when) })
+	for len(c.timers) > 0 && !c.timers[0].when.After(c.now) {
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		t.c <- t.when
+	}
+}
+
+// Pending returns the number of timers waiting to fire.
+func (c *fakeClock) Pending() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.timers)
+}
+
+// Next returns the time until the next timer fires,
+// or false if none is waiting to.
+func (c *fakeClock) Next() (time.Duration, bool) {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.timers) == 0 {
+		return 0, false
+	}
+	next := c.timers[0].when
+	for _, t := range c.timers[1:] {
+		if t.when.Before(next) {
+			next = t.when
+		}
+	}
+	return next.Sub(c.now), true
+}
+
+// waitPending waits until at least n timers are
+// waiting to fire, so that the time can be advanced
+// once the code being tested has started to wait.
+func (c *fakeClock) waitPending(t testing.TB, n int) {
+	t.Helper()
+	within(t, 5*time.Second, fmt.Sprintf("waiting for %d timers", n), func() {
+		for c.Pending() < n {
+			time.Sleep(time.Millisecond)
+		}
+	})
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	when  time.Time
+	c     chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	active := t.clock.stop(t)
+	t.clock.start(t, d)
+	return active
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	return t.clock.stop(t)
+}
+
+// setClock sets the clock used by a connection,
+// before the connection is run.
+func setClock(conn Conn, c clock) {
+	switch conn := conn.(type) {
+	case *connV3:
+		conn.clock = c
+		conn.started = c.Now()
+	case *connV2:
+		conn.clock = c
+		conn.started = c.Now()
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	c := newFakeClock()
+	start := c.Now()
+
+	a := c.NewTimer(2 * time.Second)
+	b := c.After(time.Second)
+	stopped := c.NewTimer(time.Second)
+	if !stopped.Stop() {
+		t.Error("Stop on a pending timer returned false")
+	}
+
+	c.Advance(999 * time.Millisecond)
+	select {
+	case <-b:
+		t.Fatal("a timer fired early")
+	default:
+	}
+
+	c.Advance(time.Millisecond)
+	if got := <-b; !got.Equal(start.Add(time.Second)) {
+		t.Errorf("timer fired at %v, want %v", got, start.Add(time.Second))
+	}
+	select {
+	case <-stopped.C():
+		t.Fatal("a stopped timer fired")
+	case <-a.C():
+		t.Fatal("a timer fired early")
+	default:
+	}
+
+	// Resetting a timer moves it relative to the
+	// current time.
+	if !a.Reset(5 * time.Second) {
+		t.Error("Reset on a pending timer returned false")
+	}
+	c.Advance(4 * time.Second)
+	if c.Pending() != 1 {
+		t.Fatalf("%d timers pending, want 1", c.Pending())
+	}
+	c.Advance(time.Second)
+	<-a.C()
+	if a.Stop() {
+		t.Error("Stop on a fired timer returned true")
+	}
+}
+
+// A draining connection checks for its streams to finish
+// in intervals of its clock, and closes once they have,
+// but not while a stream is still in progress, however
+// much time passes.
+func TestDrainFakeClock(t *testing.T) {
+	for _, version := range versions {
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			clock := newFakeClock()
+			release := make(chan struct{})
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				<-release
+				w.Write([]byte("done"))
+			})}
+			server, client := pipeConnsWith(t, srv, version, func(server, client Conn) {
+				setClock(server, clock)
+			})
+
+			responses := make(chan error, 1)
+			go func() {
+				req, _ := http.NewRequest("GET", "http://example.com/", nil)
+				res, err := request(client, req)
+				if err == nil && res.Data.String() != "done" {
+					err = fmt.Errorf("read %q", res.Data)
+				}
+				responses <- err
+			}()
+			within(t, 5*time.Second, "the request", func() {
+				for server.(drainer).activeStreams() == 0 {
+					time.Sleep(time.Millisecond)
+				}
+			})
+
+			go server.(drainer).drain()
+			for i := 0; i < 10; i++ {
+				clock.waitPending(t, 1)
+				clock.Advance(time.Minute)
+			}
+			if err := ConnError(server); err != nil {
+				t.Fatalf("the connection closed with a stream in progress: %v", err)
+			}
+
+			close(release)
+			if err := <-responses; err != nil {
+				t.Fatal(err)
+			}
+			within(t, 5*time.Second, "closing the connection", func() {
+				for ConnError(server) == nil {
+					if clock.Pending() > 0 {
+						clock.Advance(100 * time.Millisecond)
+					}
+					time.Sleep(time.Millisecond)
+				}
+			})
+		})
+	}
+}
+
+// An idle connection sends a keep-alive PING once the
+// interval has passed on its clock, and closes itself
+// if the reply does not arrive before the timeout.
+func TestKeepAliveFakeClock(t *testing.T) {
+	const interval = time.Minute
+	const timeout = 10 * time.Second
+	for _, version := range versions {
+		for _, reply := range []bool{true, false} {
+			version, reply := version, reply
+			t.Run(fmt.Sprintf("SPDY/%d/reply=%v", version, reply), func(t *testing.T) {
+				clock := newFakeClock()
+				local, remote := net.Pipe()
+				client, err := NewClientConn(local, nil, version)
+				if err != nil {
+					t.Fatal(err)
+				}
+				setClock(client, clock)
+				dead := make(chan struct{})
+				client.(keepAliver).setKeepAlive(interval, timeout, func() { close(dead) })
+
+				running := make(chan struct{})
+				go func() { defer close(running); client.Run() }()
+				t.Cleanup(func() {
+					within(t, 10*time.Second, "closing the connection", func() {
+						remote.Close()
+						client.Close()
+						<-running
+					})
+				})
+
+				// The server answers PINGs only if reply is set.
+				pings := make(chan uint32, 1)
+				go func() {
+					for {
+						frame, err := readRawFrame(remote, version)
+						if err != nil {
+							return
+						}
+						var pid uint32
+						switch frame := frame.(type) {
+						case *pingFrameV3:
+							pid = frame.PingID
+						case *pingFrameV2:
+							pid = frame.PingID
+						default:
+							continue
+						}
+						if reply {
+							remote.Write([]byte{0x80, byte(version), 0, 6, 0, 0, 0, 4, byte(pid >> 24), byte(pid >> 16), byte(pid >> 8), byte(pid)})
+						}
+						pings <- pid
+					}
+				}()
+
+				// Nothing is sent until the interval has passed.
+				clock.waitPending(t, 1)
+				clock.Advance(interval - time.Second)
+				select {
+				case <-pings:
+					t.Fatal("a PING was sent early")
+				case <-time.After(50 * time.Millisecond):
+				}
+				clock.Advance(time.Second)
+				select {
+				case <-pings:
+				case <-time.After(5 * time.Second):
+					t.Fatal("no PING was sent")
+				}
+
+				if reply {
+					// Once the reply arrives, the connection
+					// waits for the next interval, and pings
+					// again.
+					within(t, 5*time.Second, "the next interval", func() {
+						for {
+							if next, ok := clock.Next(); ok && next == interval {
+								return
+							}
+							time.Sleep(time.Millisecond)
+						}
+					})
+					clock.Advance(timeout)
+					if err := ConnError(client); err != nil {
+						t.Fatalf("the connection closed: %v", err)
+					}
+					clock.Advance(interval - timeout)
+					select {
+					case <-pings:
+					case <-time.After(5 * time.Second):
+						t.Fatal("no second PING was sent")
+					}
+					return
+				}
+
+				clock.waitPending(t, 1)
+				clock.Advance(timeout)
+				select {
+				case <-dead:
+				case <-time.After(5 * time.Second):
+					t.Fatal("the connection was not closed")
+				}
+				within(t, 5*time.Second, "closing the connection", func() {
+					for ConnError(client) == nil {
+						time.Sleep(time.Millisecond)
+					}
+				})
+				if err := ConnError(client); err != ErrPingTimeout {
+					t.Fatalf("the connection closed with %v, want ErrPingTimeout", err)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package spdy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingConn records the bytes read from a net.Conn.
+type recordingConn struct {
+	net.Conn
+	m    sync.Mutex
+	read bytes.Buffer
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.m.Lock()
+	c.read.Write(b[:n])
+	c.m.Unlock()
+	return n, err
+}
+
+// lastRecordType returns the content type of the
+// last TLS record read from the connection.
+func (c *recordingConn) lastRecordType(t *testing.T) byte {
+	t.Helper()
+	c.m.Lock()
+	defer c.m.Unlock()
+	data := c.read.Bytes()
+	var last byte
+	for len(data) > 0 {
+		if len(data) < 5 {
+			t.Fatalf("%d bytes of a TLS record header left over", len(data))
+		}
+		n := 5 + (int(data[3])<<8 | int(data[4]))
+		if len(data) < n {
+			t.Fatalf("TLS record truncated")
+		}
+		last = data[0]
+		data = data[n:]
+	}
+	return last
+}
+
+const alertRecord = 21 // TLS content type of alerts.
+
+// finWithin reports whether the client closes its end of
+// the TCP connection within d.
+func (c *recordingConn) finWithin(t *testing.T, d time.Duration) bool {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(d))
+	defer c.SetReadDeadline(time.Time{})
+	n, err := c.Conn.Read(make([]byte, 1))
+	if n > 0 {
+		t.Fatal("the client sent data after its close_notify")
+	}
+	if err == io.EOF {
+		return true
+	}
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Fatalf("reading the TCP connection: %v", err)
+	}
+	return false
+}
+
+// tlsOverTCP returns a client connection over TLS on TCP,
+// with the server's end of the TLS connection and the TCP
+// connection beneath it, which records what the client
+// sends. TLS 1.2 is used, so that record types are visible.
+func tlsOverTCP(t *testing.T, version uint16) (client Conn, server *tls.Conn, raw *recordingConn) {
+	t.Helper()
+	ts := httptest.NewUnstartedServer(nil)
+	ts.StartTLS()
+	certs := ts.TLS.Certificates
+	ts.Close()
+
+	local, remote := tcpPair(t)
+	raw = &recordingConn{Conn: remote}
+	proto := fmt.Sprintf("spdy/%d", version)
+	server = tls.Server(raw, &tls.Config{Certificates: certs, NextProtos: []string{proto}, MaxVersion: tls.VersionTLS12})
+	clientTLS := tls.Client(local, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{proto}, MaxVersion: tls.VersionTLS12})
+	errs := make(chan error, 1)
+	go func() { errs <- server.Handshake() }()
+	if err := clientTLS.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClientConn(clientTLS, nil, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	running := make(chan struct{})
+	go func() { defer close(running); client.Run() }()
+	t.Cleanup(func() {
+		within(t, 10*time.Second, "closing the connection", func() {
+			server.Close()
+			client.Close()
+			<-running
+		})
+	})
+	return client, server, raw
+}
+
+// Each close ends with a TLS close_notify, but a graceful
+// close then waits for the peer to close its side before
+// sending a FIN, while an abrupt close after a protocol
+// error sends the FIN at once.
+func TestCloseNotify(t *testing.T) {
+	linger := CloseLinger
+	CloseLinger = 10 * time.Second
+	defer func() { CloseLinger = linger }()
+
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d graceful", version), func(t *testing.T) {
+			client, server, raw := tlsOverTCP(t, version)
+			closeNotify := make(chan error, 1)
+			go func() {
+				_, err := io.Copy(ioutil.Discard, server)
+				closeNotify <- err
+			}()
+
+			closed := make(chan struct{})
+			go func() { defer close(closed); client.Close() }()
+			select {
+			case err := <-closeNotify:
+				if err != nil {
+					t.Fatalf("the connection ended with %v, want a close_notify", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no close_notify was received")
+			}
+			if typ := raw.lastRecordType(t); typ != alertRecord {
+				t.Errorf("the last TLS record had type %d, want an alert", typ)
+			}
+
+			// The client lingers for our side to close.
+			if raw.finWithin(t, 100*time.Millisecond) {
+				t.Fatal("the client sent a FIN without waiting for the peer")
+			}
+			select {
+			case <-closed:
+				t.Fatal("Close returned without waiting for the peer")
+			default:
+			}
+			server.Close()
+			select {
+			case <-closed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Close did not return once the peer closed")
+			}
+		})
+
+		t.Run(fmt.Sprintf("SPDY/%d abrupt", version), func(t *testing.T) {
+			_, server, raw := tlsOverTCP(t, version)
+			closeNotify := make(chan error, 1)
+			go func() {
+				_, err := io.Copy(ioutil.Discard, server)
+				closeNotify <- err
+			}()
+
+			// An unknown RST_STREAM status is fatal.
+			server.Write([]byte{0x80, byte(version), 0, 3, 0, 0, 0, 8, 0, 0, 0, 1, 0, 0, 0, 0xff})
+			select {
+			case <-closeNotify:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the connection did not end after a protocol error")
+			}
+			if !raw.finWithin(t, 5*time.Second) {
+				t.Fatal("the client lingered after a protocol error")
+			}
+		})
+	}
+}
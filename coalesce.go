@@ -0,0 +1,210 @@
+package spdy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// The default maximum size of a response body which
+// is shared between coalesced requests.
+const DefaultCoalesceBufferSize = 1 << 20
+
+// coalescer tracks the requests in flight which
+// later identical requests may share.
+type coalescer struct {
+	sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is a request being made on behalf
+// of one or more identical requests.
+type flight struct {
+	done    chan struct{}      // closed once the response is ready.
+	cancel  context.CancelFunc // cancels the shared request.
+	waiters int                // number of callers still waiting.
+	res     *http.Response     // the shared response.
+	body    []byte             // the buffered response body.
+	full    bool               // whether the whole body was buffered.
+	taken   bool               // whether an unbuffered response has been claimed.
+	err     error              // error from the shared request.
+}
+
+// coalescable indicates whether the request can
+// share a response with identical requests.
+func coalescable(req *http.Request) bool {
+	if req.Close {
+		return false
+	}
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody
+}
+
+// coalesceKey identifies requests which are
+// identical, and so can share a response.
+func coalesceKey(req *http.Request) string {
+	buf := new(bytes.Buffer)
+	buf.WriteString(req.Method + " " + req.URL.String() + " " + req.Host + "\n")
+	req.Header.Write(buf)
+	return buf.String()
+}
+
+// coalesce makes the request, sharing the response with any
+// identical requests in flight. Each caller receives its own
+// copy of the response. A caller whose request is cancelled
+// stops waiting, but the shared request is only cancelled
+// once every caller has stopped waiting.
+//
+// If the response body is larger than the Transport's
+// CoalesceBufferSize, only one caller receives it, and
+// the others make their own requests. The shared request
+// then lasts until that caller closes the body, or its
+// own request is cancelled.
+func (t *Transport) coalesce(req *http.Request) (*http.Response, error) {
+	key := coalesceKey(req)
+
+	t.coalesced.Lock()
+	if t.coalesced.flights == nil {
+		t.coalesced.flights = make(map[string]*flight)
+	}
+	f, ok := t.coalesced.flights[key]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		t.coalesced.flights[key] = f
+		go t.fly(key, f, req.WithContext(ctx))
+	} else {
+		debug.Printf("Coalescing request for %q.\n", req.URL)
+	}
+	f.waiters++
+	t.coalesced.Unlock()
+
+	select {
+	case <-f.done:
+	case <-req.Context().Done():
+		t.coalesced.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			f.cancel()
+			if t.coalesced.flights[key] == f {
+				delete(t.coalesced.flights, key)
+			}
+		}
+		t.coalesced.Unlock()
+		return nil, req.Context().Err()
+	}
+
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	// Only one caller can have an unbuffered body.
+	if !f.full {
+		t.coalesced.Lock()
+		taken := f.taken
+		f.taken = true
+		t.coalesced.Unlock()
+		if taken {
+			return t.roundTrip(req)
+		}
+
+		res := new(http.Response)
+		*res = *f.res
+		res.Body = newFlightBody(f.res.Body, f.cancel, req.Context())
+		res.Request = req
+		return res, nil
+	}
+
+	res := new(http.Response)
+	*res = *f.res
+	res.Header = cloneHeader(f.res.Header)
+	res.Trailer = cloneHeader(f.res.Trailer)
+	res.Body = &readCloser{bytes.NewReader(f.body)}
+	res.Request = req
+	return res, nil
+}
+
+// fly makes the shared request for the flight,
+// buffering the response body for its callers.
+func (t *Transport) fly(key string, f *flight, req *http.Request) {
+	limit := t.CoalesceBufferSize
+	if limit <= 0 {
+		limit = DefaultCoalesceBufferSize
+	}
+
+	res, err := t.roundTrip(req)
+	if err == nil {
+		f.body, err = ioutil.ReadAll(io.LimitReader(res.Body, limit+1))
+		if err != nil {
+			res.Body.Close()
+			res = nil
+		} else if int64(len(f.body)) <= limit {
+			res.Body.Close()
+			f.full = true
+		} else {
+			res.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(f.body), res.Body), res.Body}
+			f.body = nil
+		}
+	}
+	f.res = res
+	f.err = err
+
+	// New requests must now start a new flight.
+	t.coalesced.Lock()
+	if t.coalesced.flights[key] == f {
+		delete(t.coalesced.flights, key)
+	}
+	abandoned := f.waiters == 0
+	t.coalesced.Unlock()
+
+	if res == nil || f.full {
+		f.cancel()
+	} else if abandoned {
+		res.Body.Close()
+		f.cancel()
+	}
+
+	close(f.done)
+}
+
+// flightBody is the unbuffered body of a flight's
+// response, claimed by one caller. The shared request
+// is cancelled once the body is closed, or once the
+// caller's own request is cancelled, so reading the
+// body follows the caller's context, rather than the
+// flight's.
+type flightBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newFlightBody(body io.ReadCloser, cancel context.CancelFunc, ctx context.Context) *flightBody {
+	b := &flightBody{ReadCloser: body, cancel: cancel, closed: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-b.closed:
+		}
+	}()
+	return b
+}
+
+func (b *flightBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		close(b.closed)
+		b.cancel()
+	})
+	return err
+}
@@ -0,0 +1,290 @@
+package spdy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitForWaiters waits until n callers are
+// waiting on the flight for req.
+func waitForWaiters(t *testing.T, tr *Transport, req *http.Request, n int) {
+	t.Helper()
+	key := coalesceKey(req)
+	within(t, 5*time.Second, "the requests to coalesce", func() {
+		for {
+			tr.coalesced.Lock()
+			f := tr.coalesced.flights[key]
+			waiting := f != nil && f.waiters == n
+			tr.coalesced.Unlock()
+			if waiting {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+}
+
+// coalesceRequest returns a GET request for path, with the
+// same headers each time, so that the requests coalesce.
+func coalesceRequest(ctx context.Context, path string) *http.Request {
+	req, _ := http.NewRequest("GET", "https://example.com"+path, nil)
+	req.Header.Set("Accept", "text/plain")
+	return req.WithContext(ctx)
+}
+
+// Identical GETs in flight at the same time share a single
+// stream, and each caller is given the whole body. If the
+// body is too large to share, later callers make their own
+// requests.
+func TestCoalesceIdenticalGets(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int64
+		requests int32 // requests the handler should see.
+	}{
+		{"shared", 0, 1},
+		{"too large to share", 4, 3},
+	}
+
+	for _, version := range versions {
+		for _, test := range tests {
+			version, test := version, test
+			t.Run(fmt.Sprintf("SPDY/%d/%s", version, test.name), func(t *testing.T) {
+				var requests int32
+				release := make(chan struct{})
+				srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if atomic.AddInt32(&requests, 1) == 1 {
+						<-release
+					}
+					w.Write([]byte("hello, world"))
+				})}
+				tr := pipeTransport(t, srv, version)
+				tr.CoalesceIdenticalGets = true
+				tr.CoalesceBufferSize = test.size
+
+				var wg sync.WaitGroup
+				bodies := make(chan string, 3)
+				for i := 0; i < 3; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						res, err := tr.RoundTrip(coalesceRequest(context.Background(), "/"))
+						if err != nil {
+							t.Errorf("RoundTrip gave %v", err)
+							return
+						}
+						body, err := ioutil.ReadAll(res.Body)
+						res.Body.Close()
+						if err != nil {
+							t.Errorf("reading the body gave %v", err)
+						}
+						bodies <- string(body)
+					}()
+				}
+				waitForWaiters(t, tr, coalesceRequest(context.Background(), "/"), 3)
+				close(release)
+				within(t, 5*time.Second, "the responses", wg.Wait)
+
+				close(bodies)
+				for body := range bodies {
+					if body != "hello, world" {
+						t.Errorf("got body %q", body)
+					}
+				}
+				if n := atomic.LoadInt32(&requests); n != test.requests {
+					t.Errorf("handler saw %d requests, want %d", n, test.requests)
+				}
+			})
+		}
+	}
+}
+
+// A caller which stops waiting for a coalesced request
+// leaves it running for the others. Once every caller
+// has stopped waiting, the shared stream is cancelled.
+func TestCoalesceCancellation(t *testing.T) {
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			release := make(chan struct{})
+			stopped := make(chan error, 1)
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/once" {
+					<-release
+					w.Write([]byte("ok"))
+					return
+				}
+
+				chunk := make([]byte, 4<<10)
+				for {
+					if _, err := w.Write(chunk); err != nil {
+						stopped <- err
+						return
+					}
+				}
+			})}
+			tr := pipeTransport(t, srv, version)
+			tr.CoalesceIdenticalGets = true
+			tr.CoalesceBufferSize = 1 << 30
+
+			// One of two callers stops waiting.
+			ctx, cancel := context.WithCancel(context.Background())
+			cancelled := make(chan error, 1)
+			go func() {
+				_, err := tr.RoundTrip(coalesceRequest(ctx, "/once"))
+				cancelled <- err
+			}()
+			waitForWaiters(t, tr, coalesceRequest(ctx, "/once"), 1)
+			done := make(chan string, 1)
+			go func() {
+				res, err := tr.RoundTrip(coalesceRequest(context.Background(), "/once"))
+				if err != nil {
+					t.Errorf("RoundTrip gave %v", err)
+					done <- ""
+					return
+				}
+				body, _ := ioutil.ReadAll(res.Body)
+				done <- string(body)
+			}()
+			waitForWaiters(t, tr, coalesceRequest(ctx, "/once"), 2)
+			cancel()
+			within(t, 5*time.Second, "the cancelled request", func() {
+				if err := <-cancelled; err != context.Canceled {
+					t.Errorf("the cancelled request gave %v", err)
+				}
+			})
+			close(release)
+			within(t, 5*time.Second, "the remaining request", func() {
+				if body := <-done; body != "ok" {
+					t.Errorf("the remaining request gave %q", body)
+				}
+			})
+
+			// Both callers stop waiting for an endless response.
+			ctx, cancel = context.WithCancel(context.Background())
+			var wg sync.WaitGroup
+			for i := 0; i < 2; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					tr.RoundTrip(coalesceRequest(ctx, "/endless"))
+				}()
+			}
+			waitForWaiters(t, tr, coalesceRequest(ctx, "/endless"), 2)
+			cancel()
+			within(t, 5*time.Second, "the shared stream to be cancelled", func() {
+				wg.Wait()
+				if err := <-stopped; err == nil {
+					t.Error("the handler's writes did not fail")
+				}
+			})
+		})
+	}
+}
+
+// contextRecorder is a Receiver which records the
+// context of each request whose headers it receives.
+type contextRecorder struct {
+	sync.Mutex
+	contexts []context.Context
+}
+
+func (r *contextRecorder) ReceiveData(*http.Request, []byte, bool) {}
+func (r *contextRecorder) ReceiveRequest(*http.Request) bool       { return false }
+
+func (r *contextRecorder) ReceiveHeader(req *http.Request, header http.Header) {
+	r.Lock()
+	defer r.Unlock()
+	r.contexts = append(r.contexts, req.Context())
+}
+
+func (r *contextRecorder) last(t *testing.T) context.Context {
+	t.Helper()
+	r.Lock()
+	defer r.Unlock()
+	if len(r.contexts) == 0 {
+		t.Fatal("no headers were received")
+	}
+	return r.contexts[len(r.contexts)-1]
+}
+
+// The shared request whose body is too large to share
+// lasts until the caller given the body closes it, or
+// until the caller's own request is cancelled.
+func TestCoalesceUnbufferedBody(t *testing.T) {
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello, world"))
+	})}
+
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			contexts := new(contextRecorder)
+			tr := pipeTransport(t, srv, version)
+			tr.CoalesceIdenticalGets = true
+			tr.CoalesceBufferSize = 4
+			tr.Receiver = contexts
+
+			// Closing the body ends the shared request.
+			res, err := tr.RoundTrip(coalesceRequest(context.Background(), "/"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			shared := contexts.last(t)
+			body, err := ioutil.ReadAll(res.Body)
+			if err != nil || string(body) != "hello, world" {
+				t.Fatalf("got body %q, error %v", body, err)
+			}
+			if shared.Err() != nil {
+				t.Fatal("the shared request ended before the body was closed")
+			}
+			res.Body.Close()
+			if shared.Err() != context.Canceled {
+				t.Fatal("closing the body did not end the shared request")
+			}
+
+			// So does cancelling the caller's request.
+			ctx, cancel := context.WithCancel(context.Background())
+			res, err = tr.RoundTrip(coalesceRequest(ctx, "/"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			shared = contexts.last(t)
+			if shared.Err() != nil {
+				t.Fatal("the shared request ended before the caller's was cancelled")
+			}
+			cancel()
+			within(t, 5*time.Second, "the shared request to end", func() { <-shared.Done() })
+		})
+	}
+}
+
+// A flightBody cancels the shared request once, when it
+// is closed or its caller's context is done.
+func TestFlightBody(t *testing.T) {
+	var cancels int32
+	cancel := func() { atomic.AddInt32(&cancels, 1) }
+
+	body := newFlightBody(ioutil.NopCloser(nil), cancel, context.Background())
+	body.Close()
+	body.Close()
+	if n := atomic.LoadInt32(&cancels); n != 1 {
+		t.Fatalf("closing the body twice cancelled %d times, want once", n)
+	}
+
+	ctx, done := context.WithCancel(context.Background())
+	body = newFlightBody(ioutil.NopCloser(nil), cancel, ctx)
+	done()
+	within(t, 5*time.Second, "the cancellation", func() {
+		for atomic.LoadInt32(&cancels) != 2 {
+			time.Sleep(time.Millisecond)
+		}
+	})
+}
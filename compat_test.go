@@ -0,0 +1,99 @@
+package spdy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// The TLSNextProto entry points installed by AddSPDY serve
+// requests, pushes and pings end to end, using the handler
+// given by net/http, or the server's handler if it is nil.
+func TestTLSNextProtoEntryPoints(t *testing.T) {
+	for _, version := range versions {
+		version := version
+		for _, given := range []bool{true, false} {
+			given := given
+			t.Run(fmt.Sprintf("SPDY/%d handler given %v", version, given), func(t *testing.T) {
+				handler := func(name string) http.Handler {
+					return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						push, err := Push(w, "https://example.com/pushed")
+						if err != nil {
+							t.Errorf("pushing: %v", err)
+						} else {
+							push.Write([]byte("pushed"))
+							if c, ok := push.(io.Closer); ok {
+								c.Close()
+							}
+						}
+						w.Write([]byte(name))
+					})
+				}
+				srv := &http.Server{Handler: handler("server")}
+				AddSPDY(srv)
+				serve := srv.TLSNextProto[fmt.Sprintf("spdy/%d", version)]
+				if serve == nil {
+					t.Fatalf("AddSPDY did not register spdy/%d", version)
+				}
+
+				var connHandler http.Handler
+				want := "server"
+				if given {
+					connHandler = handler("conn")
+					want = "conn"
+				}
+
+				serverTLS, clientTLS := tlsPipe(t, version)
+				served := make(chan struct{})
+				go func() {
+					defer close(served)
+					serve(srv, serverTLS, connHandler)
+				}()
+
+				collector := &pushCollector{data: make(chan struct{}, 1)}
+				client, err := NewClientConn(clientTLS, collector, version)
+				if err != nil {
+					t.Fatal(err)
+				}
+				running := make(chan struct{})
+				go func() { defer close(running); client.Run() }()
+				defer within(t, 10*time.Second, "closing the connection", func() {
+					client.Close()
+					clientTLS.Close()
+					serverTLS.Close()
+					<-running
+					<-served
+				})
+
+				within(t, 5*time.Second, "the PING", func() {
+					c, err := client.Ping()
+					if err != nil {
+						t.Errorf("Ping: %v", err)
+						return
+					}
+					if ping := <-c; ping.Err != nil {
+						t.Errorf("the PING failed: %v", ping.Err)
+					}
+				})
+
+				within(t, 5*time.Second, "the request", func() {
+					req, _ := http.NewRequest("GET", "https://example.com/", nil)
+					res, err := request(client, req)
+					if err != nil {
+						t.Errorf("the request failed: %v", err)
+					} else if body := res.Data.String(); body != want {
+						t.Errorf("got %q, want %q", body, want)
+					}
+				})
+
+				select {
+				case <-collector.data:
+				case <-time.After(5 * time.Second):
+					t.Error("no pushed data was received")
+				}
+			})
+		}
+	}
+}
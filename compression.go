@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"compress/zlib"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
 )
@@ -20,6 +22,7 @@ type decompressor struct {
 	in      *bytes.Buffer
 	out     io.ReadCloser
 	version uint16
+	lenient bool // whether invalid headers are normalised, rather than rejected.
 }
 
 // NewDecompressor is used to create a new decompressor.
@@ -36,10 +39,12 @@ func (d *decompressor) Decompress(data []byte) (headers http.Header, err error)
 	d.m.Lock()
 	defer d.m.Unlock()
 
+	// The block is appended to any input which has not yet
+	// been consumed, such as the end of the previous block's
+	// flush, as discarding it would corrupt the zlib stream.
 	if d.in == nil {
 		d.in = bytes.NewBuffer(data)
 	} else {
-		d.in.Reset()
 		d.in.Write(data)
 	}
 
@@ -79,66 +84,145 @@ func (d *decompressor) Decompress(data []byte) (headers http.Header, err error)
 		return nil, versionError
 	}
 
+	// Data is only inflated as it is read, so the
+	// size of the block is bounded by checking each
+	// length before it is read.
+	bounds := MaxHeaderBlockSize - len(chunk)
+
 	// Read in the number of name/value pairs.
-	if _, err = d.out.Read(chunk); err != nil {
-		panic(err)
+	if _, err = io.ReadFull(d.out, chunk); err != nil {
 		return nil, err
 	}
 	numNameValuePairs := dechunk(chunk)
 
+	if numNameValuePairs > MaxHeaderCount || numNameValuePairs*2*len(chunk) > bounds {
+		return nil, ErrHeaderBlockTooLarge
+	}
+
 	headers = make(http.Header)
 	length := 0
-	bounds := MAX_FRAME_SIZE - 12 // Maximum frame size minus maximum non-headers data (SYN_STREAM)
+	var invalid error
 	for i := 0; i < numNameValuePairs; i++ {
 		var nameLength, valueLength int
 
 		// Get the name.
-		if _, err = d.out.Read(chunk); err != nil {
+		if _, err = io.ReadFull(d.out, chunk); err != nil {
 			return nil, err
 		}
 		nameLength = dechunk(chunk)
+		bounds -= len(chunk)
 
-		if nameLength > bounds {
-			return nil, errors.New("Error: Incorrect header name length.")
+		if nameLength < 0 || nameLength > bounds {
+			return nil, ErrHeaderBlockTooLarge
 		}
 		bounds -= nameLength
 
 		name := make([]byte, nameLength)
-		if _, err = d.out.Read(name); err != nil {
-			panic(err)
+		if _, err = io.ReadFull(d.out, name); err != nil {
 			return nil, err
 		}
 
 		// Get the value.
-		if _, err = d.out.Read(chunk); err != nil {
-			panic(err)
+		if _, err = io.ReadFull(d.out, chunk); err != nil {
 			return nil, err
 		}
 		valueLength = dechunk(chunk)
+		bounds -= len(chunk)
 
-		if valueLength > bounds {
-			return nil, errors.New("Error: Incorrect header values length.")
+		if valueLength < 0 || valueLength > bounds {
+			return nil, ErrHeaderBlockTooLarge
 		}
 		bounds -= valueLength
 
 		values := make([]byte, valueLength)
-		if _, err = d.out.Read(values); err != nil {
+		if _, err = io.ReadFull(d.out, values); err != nil {
 			return nil, err
 		}
 
 		// Count name and ': '.
 		length += nameLength + 2
 
-		// Split the value on null boundaries.
-		for _, value := range bytes.Split(values, []byte{'\x00'}) {
+		// Split the value on null boundaries. The rest
+		// of the block is read after an invalid header,
+		// to keep the compression state intact.
+		split, skip, err := parseHeader(name, values, d.lenient)
+		if err != nil && invalid == nil {
+			invalid = err
+		}
+		if skip || err != nil {
+			continue
+		}
+		for _, value := range split {
 			headers.Add(string(name), string(value))
 			length += len(value) + 2 // count value and ', ' or '\n\r'.
 		}
 	}
 
+	// The whole block has been read, so the compression
+	// state is intact, even if the headers are rejected.
+	if invalid != nil {
+		return nil, invalid
+	}
+	if err = d.checkDuplicates(headers); err != nil {
+		return nil, err
+	}
+
 	return headers, nil
 }
 
+// setLenient sets whether headers which break the
+// specification's rules are normalised, rather than
+// rejected. See SetLenientHeaders.
+func (d *decompressor) setLenient(lenient bool) {
+	d.m.Lock()
+	d.lenient = lenient
+	d.m.Unlock()
+}
+
+// checkDuplicates ensures that headers which may only
+// be given once, such as the pseudo-headers, have not
+// been duplicated, either by being repeated in the
+// header block or by being joined with null bytes.
+// Duplicated Content-Length headers are permitted
+// only if their values are identical.
+func (d *decompressor) checkDuplicates(headers http.Header) error {
+	for name, values := range headers {
+		if len(values) < 2 {
+			continue
+		}
+
+		if d.singular(name) {
+			return duplicateHeader(name)
+		}
+
+		if name == "Content-Length" {
+			for _, value := range values[1:] {
+				if value != values[0] {
+					return duplicateHeader(name)
+				}
+			}
+			headers.Set(name, values[0])
+		}
+	}
+
+	return nil
+}
+
+// singular indicates whether the named header may
+// appear only once in a header block.
+func (d *decompressor) singular(name string) bool {
+	switch d.version {
+	case 3:
+		return strings.HasPrefix(name, ":")
+	case 2:
+		switch name {
+		case "Method", "Url", "Version", "Host", "Scheme", "Status":
+			return true
+		}
+	}
+	return false
+}
+
 // Compressor is used to compress name/value header blocks.
 // Compressors retain their state, so a single Compressor
 // should be used for each direction of a particular
@@ -186,87 +270,43 @@ func (c *compressor) Compress(h http.Header) ([]byte, error) {
 		c.buf.Reset()
 	}
 
-	h.Del("Connection")
-	h.Del("Keep-Alive")
-	h.Del("Proxy-Connection")
-	h.Del("Transfer-Encoding")
-
-	length := 4
-	num := len(h)
-	lens := make(map[string]int)
-	for name, values := range h {
-		length += len(name) + 8
-		lens[name] = len(values) - 1
-		for _, value := range values {
-			length += len(value)
-			lens[name] += len(value)
-		}
-	}
-
-	out := make([]byte, length)
-	switch c.version {
-	case 3:
-		out[0] = byte(num >> 24)
-		out[1] = byte(num >> 16)
-		out[2] = byte(num >> 8)
-		out[3] = byte(num)
-	case 2:
-		out[0] = byte(num >> 8)
-		out[1] = byte(num)
+	headers, err := normaliseHeaders(h)
+	if err != nil {
+		return nil, err
 	}
+	names := headerOrder(headers, c.version)
 
-	offset := 4
+	// SPDY/2 uses 16-bit length fields, where SPDY/3 uses 32-bit fields.
 	if c.version == 2 {
-		offset = 2
-	}
-	for name, values := range h {
-		nLen := len(name)
-		switch c.version {
-		case 3:
-			out[offset+0] = byte(nLen >> 24)
-			out[offset+1] = byte(nLen >> 16)
-			out[offset+2] = byte(nLen >> 8)
-			out[offset+3] = byte(nLen)
-			offset += 4
-		case 2:
-			out[offset+0] = byte(nLen >> 8)
-			out[offset+1] = byte(nLen)
-			offset += 2
+		if len(names) > 0xffff {
+			return nil, errors.New("Error: Too many headers for SPDY/2.")
 		}
-
-		for i, b := range []byte(strings.ToLower(name)) {
-			out[offset+i] = b
+		for _, name := range names {
+			if len(name) > 0xffff || len(strings.Join(headers[name], "\x00")) > 0xffff {
+				return nil, errors.New(fmt.Sprintf("Error: Header %q is too long for SPDY/2.", name))
+			}
 		}
+	}
 
-		offset += nLen
-
-		vLen := lens[name]
-		switch c.version {
-		case 3:
-			out[offset+0] = byte(vLen >> 24)
-			out[offset+1] = byte(vLen >> 16)
-			out[offset+2] = byte(vLen >> 8)
-			out[offset+3] = byte(vLen)
-			offset += 4
-		case 2:
-			out[offset+0] = byte(vLen >> 8)
-			out[offset+1] = byte(vLen)
-			offset += 2
+	out := new(bytes.Buffer)
+	writeLength := func(n int) {
+		if c.version == 2 {
+			out.Write([]byte{byte(n >> 8), byte(n)})
+		} else {
+			out.Write([]byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)})
 		}
+	}
 
-		for n, value := range values {
-			for i, b := range []byte(value) {
-				out[offset+i] = b
-			}
-			offset += len(value)
-			if n < len(values)-1 {
-				out[offset] = '\x00'
-				offset += 1
-			}
-		}
+	writeLength(len(names))
+	for _, name := range names {
+		value := strings.Join(headers[name], "\x00")
+		writeLength(len(name))
+		out.WriteString(name)
+		writeLength(len(value))
+		out.WriteString(value)
 	}
 
-	_, err = c.w.Write(out)
+	_, err = c.w.Write(out.Bytes())
 	if err != nil {
 		return nil, err
 	}
@@ -275,6 +315,48 @@ func (c *compressor) Compress(h http.Header) ([]byte, error) {
 	return c.buf.Bytes(), nil
 }
 
+// pseudoHeaderOrder gives the order in which the
+// headers forming the request or status line are
+// sent, for each SPDY version.
+var pseudoHeaderOrder = map[uint16][]string{
+	2: {"method", "url", "version", "host", "scheme", "status"},
+	3: {":method", ":path", ":version", ":host", ":scheme", ":status"},
+}
+
+// headerOrder returns the names of the lowercased headers in
+// the order in which they are sent: the request or status
+// line headers first, in a fixed order, then any other
+// pseudo-headers, then the remaining headers, sorted. Some
+// peers reject header blocks in any other order, and a fixed
+// order makes the output deterministic.
+func headerOrder(headers map[string][]string, version uint16) []string {
+	names := make([]string, 0, len(headers))
+	fixed := make(map[string]bool)
+	for _, name := range pseudoHeaderOrder[version] {
+		fixed[name] = true
+		if _, ok := headers[name]; ok {
+			names = append(names, name)
+		}
+	}
+
+	pseudo := make([]string, 0, len(headers))
+	regular := make([]string, 0, len(headers))
+	for name := range headers {
+		switch {
+		case fixed[name]:
+		case strings.HasPrefix(name, ":"):
+			pseudo = append(pseudo, name)
+		default:
+			regular = append(regular, name)
+		}
+	}
+	sort.Strings(pseudo)
+	sort.Strings(regular)
+
+	names = append(names, pseudo...)
+	return append(names, regular...)
+}
+
 func (c *compressor) Close() error {
 	if c.w == nil {
 		return nil
@@ -0,0 +1,265 @@
+package spdy
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// headerBlockNames inflates a header block and returns
+// the names in it, in the order in which they were sent.
+func headerBlockNames(t *testing.T, version uint16, block []byte) []string {
+	t.Helper()
+	dict := headerDictionaryV3
+	size := 4
+	if version == 2 {
+		dict = headerDictionaryV2
+		size = 2
+	}
+
+	r, err := zlib.NewReaderDict(bytes.NewReader(block), dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The compressor flushes without ending the
+	// stream, so the reader ends with an error.
+	data, _ := ioutil.ReadAll(r)
+
+	length := func() int {
+		if len(data) < size {
+			t.Fatalf("header block is truncated")
+		}
+		n := 0
+		for _, b := range data[:size] {
+			n = n<<8 | int(b)
+		}
+		data = data[size:]
+		return n
+	}
+
+	var names []string
+	for num := length(); num > 0; num-- {
+		n := length()
+		names = append(names, string(data[:n]))
+		data = data[n:]
+		data = data[length():]
+	}
+	if len(data) != 0 {
+		t.Errorf("header block has %d bytes left over", len(data))
+	}
+	return names
+}
+
+// Header blocks give the request or status line first, in
+// a fixed order, then any other pseudo-headers, then the
+// remaining headers, sorted, with lowercased names.
+func TestHeaderOrder(t *testing.T) {
+	tests := []struct {
+		version uint16
+		header  http.Header
+		want    []string
+	}{
+		{
+			3,
+			http.Header{
+				"X-Zebra": {"1"}, "Accept": {"*/*"}, ":scheme": {"https"}, ":host": {"example.com"},
+				":version": {"HTTP/1.1"}, ":path": {"/"}, ":method": {"GET"}, ":extra": {"1"}, "Cookie": {"a=1", "b=2"},
+			},
+			[]string{":method", ":path", ":version", ":host", ":scheme", ":extra", "accept", "cookie", "x-zebra"},
+		},
+		{
+			3,
+			http.Header{"Content-Type": {"text/plain"}, ":version": {"HTTP/1.1"}, ":status": {"200 OK"}},
+			[]string{":version", ":status", "content-type"},
+		},
+		{
+			2,
+			http.Header{
+				"X-Zebra": {"1"}, "Accept": {"*/*"}, "Scheme": {"https"}, "Host": {"example.com"},
+				"Version": {"HTTP/1.1"}, "Url": {"/"}, "Method": {"GET"},
+			},
+			[]string{"method", "url", "version", "host", "scheme", "accept", "x-zebra"},
+		},
+	}
+
+	for _, test := range tests {
+		block, err := NewCompressor(test.version).Compress(test.header)
+		if err != nil {
+			t.Fatalf("SPDY/%d: %v", test.version, err)
+		}
+		if names := headerBlockNames(t, test.version, block); !reflect.DeepEqual(names, test.want) {
+			t.Errorf("SPDY/%d: sent %v, want %v", test.version, names, test.want)
+		}
+
+		// The output does not depend on map order.
+		for i := 0; i < 10; i++ {
+			again, err := NewCompressor(test.version).Compress(test.header)
+			if err != nil || !bytes.Equal(again, block) {
+				t.Fatalf("SPDY/%d: compressed to %x, then %x", test.version, block, again)
+			}
+		}
+	}
+}
+
+// Names which differ only in case are sent once, and
+// must have the same values.
+func TestHeaderCaseCollision(t *testing.T) {
+	for _, version := range versions {
+		same := http.Header{"X-Foo": {"a", "b"}, "x-foo": {"a", "b"}}
+		block, err := NewCompressor(version).Compress(same)
+		if err != nil {
+			t.Errorf("SPDY/%d: matching headers gave %v", version, err)
+		} else if names := headerBlockNames(t, version, block); !reflect.DeepEqual(names, []string{"x-foo"}) {
+			t.Errorf("SPDY/%d: sent %v, want [x-foo]", version, names)
+		}
+
+		conflicting := http.Header{"X-Foo": {"a"}, "x-foo": {"b"}}
+		if _, err := NewCompressor(version).Compress(conflicting); err == nil {
+			t.Errorf("SPDY/%d: conflicting headers were compressed", version)
+		}
+	}
+}
+
+// failingCompressor fails to compress header blocks with
+// an X-Fail header, as a Compressor might when given
+// headers which were not checked before being sent.
+type failingCompressor struct {
+	Compressor
+}
+
+var errCompressFailed = errors.New("Error: Failed to compress.")
+
+func (c failingCompressor) Compress(h http.Header) ([]byte, error) {
+	if _, ok := h["X-Fail"]; ok {
+		return nil, errCompressFailed
+	}
+	return c.Compressor.Compress(h)
+}
+
+// failCompression gives conn a failingCompressor.
+func failCompression(conn Conn) {
+	switch conn := conn.(type) {
+	case *connV3:
+		conn.compressor = failingCompressor{conn.compressor}
+	case *connV2:
+		conn.compressor = failingCompressor{conn.compressor}
+	}
+}
+
+// A response whose SYN_REPLY cannot be compressed is reset
+// with INTERNAL_ERROR, and none of its data is sent. Later
+// responses are unaffected.
+func TestCompressFailureResets(t *testing.T) {
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/fail" {
+					w.Header().Set("X-Fail", "1")
+				}
+				w.Write([]byte("body"))
+			})}
+			conn := rawServerConnWith(t, srv, version, failCompression)
+			remote := newRawPeer(conn, version)
+			c := newRawCompressor(version)
+
+			remote.write(rawSynStream(version, 1, c.block(rawRequest(version, "/fail")...)))
+			remote.await(t, "the RST_STREAM", func(frame Frame) bool {
+				if sid, ok := rawStreamID(frame, version); !ok || sid != 1 {
+					return false
+				}
+				switch frame := frame.(type) {
+				case *rstStreamFrameV3:
+					if frame.Status != RST_STREAM_INTERNAL_ERROR {
+						t.Errorf("the stream was reset with %s", frame.Status)
+					}
+					return true
+				case *rstStreamFrameV2:
+					if frame.Status != RST_STREAM_INTERNAL_ERROR {
+						t.Errorf("the stream was reset with %s", frame.Status)
+					}
+					return true
+				}
+				t.Errorf("sent %s on the failed stream", frameName(frame))
+				return false
+			})
+
+			// The response to the next request follows
+			// with nothing more sent for the first.
+			remote.write(rawSynStream(version, 3, c.block(rawRequest(version, "/ok")...)))
+			remote.await(t, "the next response", func(frame Frame) bool {
+				sid, _ := rawStreamID(frame, version)
+				if sid == 1 {
+					t.Errorf("sent %s on the failed stream", frameName(frame))
+				}
+				switch frame.(type) {
+				case *synReplyFrameV3, *synReplyFrameV2:
+					return sid == 3
+				}
+				return false
+			})
+		})
+	}
+}
+
+// rawStreamID returns the stream ID of a stream's frame.
+func rawStreamID(frame Frame, version uint16) (StreamID, bool) {
+	if version == 2 {
+		return streamIDV2(frame)
+	}
+	return streamIDV3(frame)
+}
+
+// A request whose SYN_STREAM cannot be compressed fails,
+// without the other endpoint hearing of it, and the
+// connection can still be used for other requests.
+func TestCompressFailureFailsRequest(t *testing.T) {
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			client, conn := rawClientConnWith(t, version, failCompression)
+			remote := newRawPeer(conn, version)
+
+			within(t, 5*time.Second, "the failed request", func() {
+				req, _ := http.NewRequest("GET", "https://example.com/fail", nil)
+				req.Header.Set("X-Fail", "1")
+				if _, err := request(client, req); err != errCompressFailed {
+					t.Errorf("the request failed with %v, want %v", err, errCompressFailed)
+				}
+			})
+
+			errs := make(chan error, 1)
+			go func() {
+				req, _ := http.NewRequest("GET", "https://example.com/ok", nil)
+				_, err := request(client, req)
+				errs <- err
+			}()
+			remote.await(t, "the next request", func(frame Frame) bool {
+				switch frame := frame.(type) {
+				case *synStreamFrameV3:
+					return frame.StreamID == 3
+				case *synStreamFrameV2:
+					return frame.StreamID == 3
+				case *rstStreamFrameV3, *rstStreamFrameV2:
+					t.Errorf("sent %s", frame)
+				}
+				return false
+			})
+			remote.write(rawSynReply(version, 3, newRawCompressor(version)))
+			select {
+			case err := <-errs:
+				if err != nil {
+					t.Errorf("the next request failed with %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the next request did not finish")
+			}
+		})
+	}
+}
@@ -0,0 +1,371 @@
+package spdy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Both endpoints send large bodies at once, so each read loop
+// must keep reading, and granting window, while its send loop
+// waits for the other endpoint to read.
+func TestConcurrentLargeRequests(t *testing.T) {
+	const size = 300 << 10
+	for _, version := range versions {
+		for _, session := range []bool{false, true} {
+			if session && version < 3 {
+				continue
+			}
+			t.Run(fmt.Sprintf("SPDY/%d/session=%v", version, session), func(t *testing.T) {
+				srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					body, err := ioutil.ReadAll(r.Body)
+					if err != nil || len(body) != size {
+						t.Errorf("server got %d bytes, error %v", len(body), err)
+					}
+					w.Write(body)
+				})}
+				_, client := pipeConnsWith(t, srv, version, func(server, client Conn) {
+					if session {
+						server.(sessionFlowController).enableSessionFlowControl()
+						client.(sessionFlowController).enableSessionFlowControl()
+					}
+				})
+
+				within(t, 30*time.Second, "the requests", func() {
+					var wg sync.WaitGroup
+					for i := 0; i < 20; i++ {
+						wg.Add(1)
+						go func() {
+							defer wg.Done()
+							req, _ := http.NewRequest("POST", "http://example.com/", bytes.NewReader(make([]byte, size)))
+							res, err := request(client, req)
+							if err != nil {
+								t.Error(err)
+								return
+							}
+							if res.Data.Len() != size {
+								t.Errorf("client got %d bytes", res.Data.Len())
+							}
+						}()
+					}
+					wg.Wait()
+				})
+			})
+		}
+	}
+}
+
+// Streams are opened, reset and closed by several goroutines
+// while the server is sending them data. This is most useful
+// with the race detector.
+func TestStreamsRace(t *testing.T) {
+	chunk := make([]byte, 16<<10)
+	for _, version := range versions {
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/done" {
+					w.Write([]byte("done"))
+					return
+				}
+				for i := 0; i < 64; i++ {
+					if _, err := w.Write(chunk); err != nil {
+						return
+					}
+				}
+			})}
+			_, client := pipeConns(t, srv, version)
+
+			within(t, 30*time.Second, "the streams", func() {
+				var wg sync.WaitGroup
+				for i := 0; i < 8; i++ {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						buf := make([]byte, 4096)
+						for j := 0; j < 10; j++ {
+							req, _ := http.NewRequest("GET", "http://example.com/", nil)
+							stream, err := client.Request(req, nil, Priority(j%4))
+							if err != nil {
+								t.Error(err)
+								return
+							}
+							go stream.Run()
+							for k := 0; k < (i+j)%4; k++ {
+								if _, err := io.ReadFull(stream, buf); err != nil {
+									break
+								}
+							}
+							if (i+j)%2 == 0 {
+								stream.Reset(RST_STREAM_CANCEL)
+							}
+							stream.Close()
+						}
+					}(i)
+				}
+				wg.Wait()
+			})
+
+			// The connection is still usable.
+			req, _ := http.NewRequest("GET", "http://example.com/done", nil)
+			res, err := request(client, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Data.String() != "done" {
+				t.Fatalf("got body %q", res.Data)
+			}
+		})
+	}
+}
+
+// A handler writing to a stream which the client resets
+// sees why the stream was closed.
+func TestWriteAfterReset(t *testing.T) {
+	for _, version := range versions {
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			errs := make(chan error, 1)
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				chunk := make([]byte, 1024)
+				for {
+					if _, err := w.Write(chunk); err != nil {
+						errs <- err
+						return
+					}
+					w.(http.Flusher).Flush()
+				}
+			})}
+			_, client := pipeConns(t, srv, version)
+
+			req, _ := http.NewRequest("GET", "http://example.com/", nil)
+			stream, err := client.Request(req, nil, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go stream.Run()
+			if _, err := io.ReadFull(stream, make([]byte, 4096)); err != nil {
+				t.Fatal(err)
+			}
+			if err := stream.Reset(RST_STREAM_CANCEL); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case err := <-errs:
+				serr, ok := err.(*StreamError)
+				if !ok || !serr.Remote || serr.Status != RST_STREAM_CANCEL {
+					t.Fatalf("Write returned %v, want the client's reset", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Write did not fail")
+			}
+		})
+	}
+}
+
+// meteredWriter counts the bytes written through it.
+type meteredWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (m *meteredWriter) Write(b []byte) (int, error) {
+	n, err := m.w.Write(b)
+	atomic.AddInt64(&m.n, int64(n))
+	return n, err
+}
+
+func (m *meteredWriter) count() int64 {
+	return atomic.LoadInt64(&m.n)
+}
+
+// Receive windows are regrown as data is read, rather than
+// as it arrives, so a handler's writes stop while the client
+// is not reading the response, and a large request body is
+// only sent as fast as the handler reads it. In both cases
+// the transfer makes progress until it is complete.
+func TestFlowControlProgress(t *testing.T) {
+	// Larger than the client's receive window.
+	const size = 32 << 20
+	for _, session := range []bool{false, true} {
+		setup := func(server, client Conn) {
+			if session {
+				server.(sessionFlowController).enableSessionFlowControl()
+				client.(sessionFlowController).enableSessionFlowControl()
+			}
+		}
+
+		t.Run(fmt.Sprintf("response/session=%v", session), func(t *testing.T) {
+			written := make(chan *meteredWriter, 1)
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				m := &meteredWriter{w: w}
+				written <- m
+				io.Copy(m, io.LimitReader(zeroReader{}, size))
+			})}
+			_, client := pipeConnsWith(t, srv, 3, setup)
+
+			req, _ := http.NewRequest("GET", "http://example.com/", nil)
+			stream, err := client.Request(req, nil, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go stream.Run()
+			defer stream.Close()
+			m := <-written
+
+			// The handler stops once the window is used up.
+			stalled := int64(-1)
+			within(t, 20*time.Second, "filling the window", func() {
+				for n := m.count(); n != stalled; n = m.count() {
+					stalled = n
+					time.Sleep(100 * time.Millisecond)
+				}
+			})
+			if stalled >= size/2 {
+				t.Fatalf("handler wrote %d bytes before the client read any", stalled)
+			}
+
+			within(t, 30*time.Second, "reading the response", func() {
+				n, err := io.Copy(ioutil.Discard, stream)
+				if err != nil || n != size {
+					t.Errorf("client read %d bytes, error %v", n, err)
+				}
+			})
+		})
+
+		t.Run(fmt.Sprintf("request/session=%v", session), func(t *testing.T) {
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Read slowly, so that the window is
+				// regrown many times in small steps.
+				buf := make([]byte, 1000)
+				var n int64
+				for {
+					m, err := r.Body.Read(buf)
+					n += int64(m)
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+				fmt.Fprint(w, n)
+			})}
+			_, client := pipeConnsWith(t, srv, 3, setup)
+
+			req, _ := http.NewRequest("POST", "http://example.com/", io.LimitReader(zeroReader{}, size))
+			within(t, 30*time.Second, "the request", func() {
+				res, err := request(client, req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if got := res.Data.String(); got != fmt.Sprint(size) {
+					t.Errorf("handler read %s bytes, want %d", got, size)
+				}
+			})
+		})
+	}
+}
+
+// zeroReader is an endless source of zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// panicStream is a Stream which panics when first closed.
+type panicStream struct {
+	Stream
+	state    StreamState
+	panicked bool
+}
+
+func (s *panicStream) State() *StreamState { return &s.state }
+
+func (s *panicStream) Close() error {
+	if !s.panicked {
+		s.panicked = true
+		panic("closed")
+	}
+	return nil
+}
+
+// A panic while a frame is handled ends the connection
+// without leaving the connection's lock held, so that
+// the connection can still be closed.
+func TestHandlerPanicReleasesLock(t *testing.T) {
+	for _, version := range versions {
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			reasons := make(chan error, 1)
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+			_, client := pipeConnsWith(t, srv, version, func(server, client Conn) {
+				client.(hooker).setHooks(&ConnHooks{OnClose: func(conn Conn, reason error) { reasons <- reason }})
+			})
+
+			// The GOAWAY closes the unprocessed stream
+			// with the connection's lock held.
+			var goaway Frame
+			switch conn := client.(type) {
+			case *connV3:
+				conn.Lock()
+				conn.streams[101] = new(panicStream)
+				conn.Unlock()
+				goaway = &goawayFrameV3{LastGoodStreamID: 1}
+			case *connV2:
+				conn.Lock()
+				conn.streams[101] = new(panicStream)
+				conn.Unlock()
+				goaway = &goawayFrameV2{LastGoodStreamID: 1}
+			}
+			within(t, 5*time.Second, "handling the GOAWAY", func() {
+				client.(interface{ handleFrame(Frame) }).handleFrame(goaway)
+			})
+
+			within(t, 5*time.Second, "Close", func() { client.Close() })
+			select {
+			case reason := <-reasons:
+				if reason != ErrInternal {
+					t.Fatalf("connection closed with %v, want %v", reason, ErrInternal)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("OnClose was not called")
+			}
+		})
+	}
+}
+
+// The query is sent with the path, and reaches the handler.
+func TestRequestQuery(t *testing.T) {
+	const uri = "/search?q=a%20b&page=2"
+	for _, version := range versions {
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if q := r.URL.Query().Get("q"); q != "a b" {
+					t.Errorf("got q=%q, want %q", q, "a b")
+				}
+				w.Write([]byte(r.URL.RequestURI()))
+			})}
+			_, client := pipeConns(t, srv, version)
+
+			req, _ := http.NewRequest("GET", "http://example.com"+uri, nil)
+			res, err := request(client, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := res.Data.String(); got != uri {
+				t.Fatalf("handler saw %q, want %q", got, uri)
+			}
+		})
+	}
+}
@@ -5,11 +5,13 @@ import (
 	"io"
 	"io/ioutil"
 	logging "log"
+	"net/http"
 	"net/url"
 	"os"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 // SPDY version of this implementation.
@@ -21,6 +23,49 @@ const DEFAULT_SPDY_VERSION = 3
 // ending the session.
 var MaxBenignErrors = 10
 
+// MaxVersionErrors is the maximum
+// number of connection-scoped frames
+// with the wrong SPDY version each
+// connection will allow without
+// ending the session. Stream-scoped
+// frames with the wrong version only
+// reset their stream.
+var MaxVersionErrors = 3
+
+// CloseLinger is the maximum time
+// a connection closed gracefully
+// waits for the other endpoint to
+// close its side, after a TLS
+// close_notify has been sent. A
+// value of zero closes at once.
+var CloseLinger = 250 * time.Millisecond
+
+// MaxHeaderBlockSize is the maximum
+// size in bytes to which a received
+// header block may decompress. Larger
+// blocks end the session, as the
+// compression state is lost.
+var MaxHeaderBlockSize = 256 << 10
+
+// MaxHeaderCount is the maximum number
+// of name/value pairs a received header
+// block may contain.
+var MaxHeaderCount = 1024
+
+// HTTPProbeTimeout is the time a new
+// server connection waits for its
+// first bytes before sending any
+// frames, so that HTTP/1.x requests,
+// such as Upgrade probes, can be
+// answered with an HTTP error. A
+// value of zero disables the check.
+var HTTPProbeTimeout = 100 * time.Millisecond
+
+// HTTPProbeDocs is a URL included in
+// the HTTP error sent in reply to an
+// HTTP/1.x request on a SPDY session.
+var HTTPProbeDocs = "http://www.chromium.org/spdy/spdy-protocol"
+
 // Frame types in SPDY/2
 const (
 	SYN_STREAMv2    = 1
@@ -89,6 +134,13 @@ const (
 	RST_STREAM_FRAME_TOO_LARGE       = 11
 )
 
+// GOAWAY status codes
+const (
+	GOAWAY_OK             = 0
+	GOAWAY_PROTOCOL_ERROR = 1
+	GOAWAY_INTERNAL_ERROR = 11
+)
+
 // Settings IDs
 const (
 	SETTINGS_UPLOAD_BANDWIDTH               = 1
@@ -114,6 +166,56 @@ const MAX_FRAME_SIZE = 0xffffff
 
 const MAX_DATA_SIZE = 0xffffff
 
+// Default maximum size of the DATA frames
+// sent by this implementation.
+const DEFAULT_MAX_DATA_FRAME_SIZE = 64 << 10
+
+// MaxDataFrameSize is the maximum amount
+// of data sent in each DATA frame. Larger
+// writes are split into several frames,
+// so that one stream's data does not
+// hold up the others on the connection.
+var MaxDataFrameSize = DEFAULT_MAX_DATA_FRAME_SIZE
+
+// dataFrameSize returns the maximum
+// size of the DATA frames to send.
+func dataFrameSize() int {
+	switch {
+	case MaxDataFrameSize <= 0:
+		return DEFAULT_MAX_DATA_FRAME_SIZE
+	case MaxDataFrameSize > MAX_DATA_SIZE:
+		return MAX_DATA_SIZE
+	}
+	return MaxDataFrameSize
+}
+
+// Default maximum size of the frames
+// received by this implementation.
+const DEFAULT_MAX_FRAME_SIZE = 1 << 20
+
+// MaxFrameSize is the maximum size in
+// bytes of each frame received, including
+// its 8-byte header. Larger frames end
+// the session with a PROTOCOL_ERROR
+// before their contents are read. This
+// should allow for the DATA frames sent
+// by the other endpoint, which for this
+// implementation are limited by
+// MaxDataFrameSize.
+var MaxFrameSize = DEFAULT_MAX_FRAME_SIZE
+
+// frameSizeLimit returns the maximum
+// size of the frames to receive.
+func frameSizeLimit() int {
+	switch {
+	case MaxFrameSize <= 0:
+		return DEFAULT_MAX_FRAME_SIZE
+	case MaxFrameSize > MAX_FRAME_SIZE:
+		return MAX_FRAME_SIZE
+	}
+	return MaxFrameSize
+}
+
 // Maximum stream ID (2 ** 31 -1).
 const MAX_STREAM_ID = 0x7fffffff
 
@@ -126,9 +228,21 @@ const DEFAULT_INITIAL_WINDOW_SIZE = 65536
 // The default initial transfer window sent by the client.
 const DEFAULT_INITIAL_CLIENT_WINDOW_SIZE = 10485760
 
+// The initial session transfer window, as defined in the
+// SPDY/3.1 spec. See EnableSessionFlowControl.
+const DEFAULT_INITIAL_SESSION_WINDOW_SIZE = 65536
+
 // Maximum delta window size field for WINDOW_UPDATE.
 const MAX_DELTA_WINDOW_SIZE = 0x7fffffff
 
+// The default size of the server's client certificate
+// vector, used until SETTINGS_CLIENT_CERTIFICATE_VECTOR_SIZE
+// is received.
+const DEFAULT_CLIENT_CERTIFICATE_VECTOR_SIZE = 8
+
+// Maximum credential slot which a SYN_STREAM can refer to.
+const MAX_CREDENTIAL_SLOT = 0xff
+
 // Header sent by the client to initiate the connection.
 const SPDY4_CLIENT_CONNECTION_HEADER = "FOO * HTTP/2.0\r\n\r\nBA\r\n\r\n"
 
@@ -146,6 +260,12 @@ var statusCodeText = map[StatusCode]string{
 	RST_STREAM_FRAME_TOO_LARGE:       "FRAME_TOO_LARGE",
 }
 
+var goawayStatusText = map[StatusCode]string{
+	GOAWAY_OK:             "OK",
+	GOAWAY_PROTOCOL_ERROR: "PROTOCOL_ERROR",
+	GOAWAY_INTERNAL_ERROR: "INTERNAL_ERROR",
+}
+
 var settingText = map[uint32]string{
 	SETTINGS_UPLOAD_BANDWIDTH:               "UPLOAD_BANDWIDTH",
 	SETTINGS_DOWNLOAD_BANDWIDTH:             "DOWNLOAD_BANDWIDTH",
@@ -157,6 +277,13 @@ var settingText = map[uint32]string{
 	SETTINGS_CLIENT_CERTIFICATE_VECTOR_SIZE: "CLIENT_CERTIFICATE_VECTOR_SIZE",
 }
 
+// settingRecognised indicates whether the
+// given setting ID is defined by SPDY.
+func settingRecognised(id uint32) bool {
+	_, ok := settingText[id]
+	return ok
+}
+
 // streamLimit is used to add and enforce
 // a limit on the number of concurrently
 // active streams.
@@ -213,6 +340,220 @@ func (s *streamLimit) Close() {
 	s.Unlock()
 }
 
+// Available returns the number of further
+// streams which can currently be opened.
+func (s *streamLimit) Available() uint32 {
+	s.Lock()
+	defer s.Unlock()
+	if s.current >= s.limit {
+		return 0
+	}
+	return s.limit - s.current
+}
+
+// concurrencyLimiter is implemented by connections which
+// advertise a limit on the streams the peer may open.
+type concurrencyLimiter interface {
+	setMaxConcurrentStreams(uint32)
+}
+
+// SetMaxConcurrentStreams sets the maximum number of concurrent
+// streams which the SPDY connections served by srv allow each
+// client to open, which is advertised to the clients. Requests
+// beyond the limit are refused. The default is
+// DEFAULT_STREAM_LIMIT. This must be called before srv begins
+// serving.
+func SetMaxConcurrentStreams(srv *http.Server, n uint32) {
+	servers.Lock()
+	servers.config(srv).streamLimit = n
+	servers.Unlock()
+}
+
+// serverStreamLimit returns the maximum number of
+// concurrent streams for connections served by srv.
+func serverStreamLimit(srv *http.Server) uint32 {
+	return servers.lookup(srv).streamLimit
+}
+
+// RESPONSE_BUFFER_SIZE is the amount of a response which
+// is buffered if the handler writes before calling
+// WriteHeader. Responses which fit in the buffer are
+// given a Content-Length, and responses without a
+// Content-Type are given one with http.DetectContentType.
+const RESPONSE_BUFFER_SIZE = 2048
+
+// DEFAULT_MAX_HEADERS is the default maximum number of
+// HEADERS frames accepted on each stream. This allows
+// for trailers and interim headers.
+const DEFAULT_MAX_HEADERS = 8
+
+// MAX_STREAM_TAGS is the maximum number of tags which
+// can be set on each stream with Stream.SetTag.
+const MAX_STREAM_TAGS = 16
+
+// MAX_STREAM_TAG_SIZE is the maximum combined length of
+// the key and value of each tag set with Stream.SetTag.
+const MAX_STREAM_TAG_SIZE = 256
+
+// headerLimiter is implemented by connections which
+// limit the number of HEADERS frames per stream.
+type headerLimiter interface {
+	setMaxHeaders(int)
+}
+
+// SetMaxHeaders sets the maximum number of HEADERS frames
+// which conn will accept on each stream, after which the
+// stream is reset with a PROTOCOL_ERROR. The default is
+// DEFAULT_MAX_HEADERS.
+func SetMaxHeaders(conn Conn, n int) error {
+	limiter, ok := conn.(headerLimiter)
+	if !ok {
+		return ErrNotSPDY
+	}
+	if n < 0 {
+		return errors.New("Error: Maximum number of HEADERS frames cannot be negative.")
+	}
+	limiter.setMaxHeaders(n)
+	return nil
+}
+
+// FATAL_ERROR_FLUSH_TIMEOUT is the time allowed for the
+// frames explaining a fatal error to be sent before the
+// connection is closed.
+const FATAL_ERROR_FLUSH_TIMEOUT = 100 * time.Millisecond
+
+// WRITE_BUFFER_SIZE is the size of the buffer in which
+// outgoing frames are collected, so that frames sent
+// back-to-back share a write to the connection.
+const WRITE_BUFFER_SIZE = 16 << 10
+
+// DEFAULT_INTERACTIVE_RECORD_SIZE is the default maximum
+// number of bytes written to the connection at once for
+// streams marked with SetInteractive, so that each TLS
+// record they are sent in fits in a single TCP segment.
+const DEFAULT_INTERACTIVE_RECORD_SIZE = 1400
+
+// REFUSED_STREAM_GRACE is the period for which DATA
+// received on a refused stream is silently discarded.
+const REFUSED_STREAM_GRACE = 10 * time.Second
+
+// refusedStreams records the streams which have recently
+// been refused or reset with RST_STREAM, so that any DATA the peer
+// sent before receiving the RST_STREAM can be discarded
+// without being treated as an error. The connection lock
+// must be held when it is used.
+type refusedStreams map[StreamID]*refusedStream
+
+type refusedStream struct {
+	expiry time.Time
+	bytes  uint64
+}
+
+// Add records that the stream has been refused.
+func (r refusedStreams) Add(sid StreamID, now time.Time) {
+	r.expire(now)
+	r[sid] = &refusedStream{expiry: now.Add(REFUSED_STREAM_GRACE)}
+}
+
+// Discard is called when DATA is received on a stream
+// which is closed or unopened. Discard returns a bool
+// indicating whether the stream was recently refused,
+// in which case the data should be ignored.
+func (r refusedStreams) Discard(sid StreamID, n int, now time.Time) bool {
+	r.expire(now)
+	refused, ok := r[sid]
+	if !ok {
+		return false
+	}
+	refused.bytes += uint64(n)
+	return true
+}
+
+// expire removes any streams whose grace
+// period has ended.
+func (r refusedStreams) expire(now time.Time) {
+	for sid, refused := range r {
+		if now.After(refused.expiry) {
+			if refused.bytes > 0 {
+				debug.Printf("Discarded %d bytes sent on refused stream %d.\n", refused.bytes, sid)
+			}
+			delete(r, sid)
+		}
+	}
+}
+
+// DEFAULT_RESET_FLOOD_LIMIT is the default number of
+// RST_STREAM frames for unknown streams which are
+// processed in each RESET_FLOOD_INTERVAL. Any more
+// are dropped.
+const DEFAULT_RESET_FLOOD_LIMIT = 100
+
+// RESET_FLOOD_INTERVAL is the period over which RST_STREAM
+// frames for unknown streams are counted.
+const RESET_FLOOD_INTERVAL = time.Second
+
+// resetFlood rate-limits the RST_STREAM frames received
+// for streams which were never opened, so that a peer
+// sending them in bulk cannot exhaust the connection's
+// benign error budget. The connection lock must be held
+// when it is used.
+type resetFlood struct {
+	limit   int       // RST_STREAMs processed per interval, or 0 for no limit.
+	start   time.Time // start of the current interval.
+	count   int       // RST_STREAMs received in the current interval.
+	dropped uint64    // total RST_STREAMs dropped.
+}
+
+// Allow is called when an RST_STREAM is received for an
+// unknown stream, and indicates whether it should be
+// processed. flooding is true only for the first frame
+// dropped in an interval, so that a flood can be counted
+// as a single benign error.
+func (f *resetFlood) Allow(now time.Time) (allow, flooding bool) {
+	if f.limit <= 0 {
+		return true, false
+	}
+
+	if now.Sub(f.start) >= RESET_FLOOD_INTERVAL {
+		if f.count > f.limit {
+			log.Printf("Warning: Dropped %d RST_STREAM frames for unknown streams.\n", f.count-f.limit)
+		}
+		f.start = now
+		f.count = 0
+	}
+
+	f.count++
+	if f.count <= f.limit {
+		return true, false
+	}
+
+	f.dropped++
+	return false, f.count == f.limit+1
+}
+
+// resetLimiter is implemented by connections which
+// rate-limit RST_STREAM frames for unknown streams.
+type resetLimiter interface {
+	setResetFloodLimit(int)
+}
+
+// SetResetFloodLimit sets the maximum number of RST_STREAM
+// frames for unknown streams which conn will process in each
+// RESET_FLOOD_INTERVAL. Any more are dropped, and counted as
+// a single benign error. A limit of zero disables the limit.
+// The default is DEFAULT_RESET_FLOOD_LIMIT.
+func SetResetFloodLimit(conn Conn, n int) error {
+	limiter, ok := conn.(resetLimiter)
+	if !ok {
+		return ErrNotSPDY
+	}
+	if n < 0 {
+		return errors.New("Error: RST_STREAM flood limit cannot be negative.")
+	}
+	limiter.setResetFloodLimit(n)
+	return nil
+}
+
 // statusCodeIsFatal returns a bool
 // indicating whether receiving the
 // given status code would end the
@@ -281,25 +622,69 @@ func SupportedVersions() []int {
 	return s
 }
 
-var npnStrings = map[uint16]string{
-	2: "spdy/2",
-	3: "spdy/3",
+// VersionCapabilities describes the features of
+// a SPDY version, as implemented by this package.
+type VersionCapabilities struct {
+	Version            uint16 // SPDY version.
+	NPN                string // protocol string used in NPN and ALPN.
+	FlowControl        bool   // whether streams are flow controlled.
+	SessionFlowControl bool   // whether the whole session is flow controlled.
+	Credential         bool   // whether CREDENTIAL frames are processed.
+	ServerPush         bool   // whether servers can push streams.
+}
+
+// versionCapabilities lists each SPDY version
+// which the connection engine can speak.
+var versionCapabilities = map[uint16]VersionCapabilities{
+	2: VersionCapabilities{
+		Version:    2,
+		NPN:        "spdy/2",
+		ServerPush: true,
+	},
+	3: VersionCapabilities{
+		Version:     3,
+		NPN:         "spdy/3",
+		FlowControl: true,
+		Credential:  true,
+		ServerPush:  true,
+	},
+}
+
+// Capabilities returns the features of the given SPDY version,
+// and whether this package implements it. A version which
+// has been disabled with DisableSpdyVersion is still
+// implemented, so its capabilities are still returned.
+func Capabilities(v uint16) (VersionCapabilities, bool) {
+	c, ok := versionCapabilities[v]
+	return c, ok
 }
 
-// npn returns the NPN version strings for the SPDY versions
-// currently enabled, plus HTTP/1.1.
-func npn() []string {
+// NPNStrings returns the protocol strings for the SPDY versions
+// currently enabled, most recent first, followed by HTTP/1.1.
+// These are used in NPN and ALPN negotiation.
+func NPNStrings() []string {
 	v := SupportedVersions()
 	s := make([]string, 0, len(v)+1)
 	for _, v := range v {
-		if str := npnStrings[uint16(v)]; str != "" {
-			s = append(s, str)
+		if c, ok := versionCapabilities[uint16(v)]; ok {
+			s = append(s, c.NPN)
 		}
 	}
 	s = append(s, "http/1.1")
 	return s
 }
 
+// npnVersion returns the SPDY version negotiated with the
+// given protocol string, if it is enabled.
+func npnVersion(proto string) (uint16, bool) {
+	for v, c := range versionCapabilities {
+		if c.NPN == proto {
+			return v, SupportedVersion(v)
+		}
+	}
+	return 0, false
+}
+
 // SupportedVersion determines if the provided SPDY version is
 // supported by this instance of the library. This can be modified
 // with EnableSpdyVersion and DisableSpdyVersion.
@@ -320,6 +705,9 @@ func EnableSpdyVersion(v uint16) error {
 	if v > maxVersion {
 		return errors.New("Error: SPDY version too new.")
 	}
+	if _, ok := versionCapabilities[v]; !ok {
+		return errors.New("Error: SPDY version not implemented.")
+	}
 	supportedVersions[v] = struct{}{}
 	return nil
 }
@@ -399,6 +787,11 @@ func defaultSPDYClientSettings(v uint16, m uint32) Settings {
 var log = logging.New(os.Stderr, "(spdy) ", logging.LstdFlags|logging.Lshortfile)
 var debug = logging.New(ioutil.Discard, "(spdy debug) ", logging.LstdFlags)
 
+// debugging indicates whether debug output is enabled,
+// so that frames are only formatted when they will be
+// logged.
+var debugging = false
+
 // SetLogger sets the package's error logger.
 func SetLogger(l *logging.Logger) {
 	log = l
@@ -412,11 +805,13 @@ func SetLogOutput(w io.Writer) {
 // SetDebugLogger sets the package's debug info logger.
 func SetDebugLogger(l *logging.Logger) {
 	debug = l
+	debugging = true
 }
 
 // SetDebugOutput sets the output for the package's debug info logger.
 func SetDebugOutput(w io.Writer) {
 	debug = logging.New(w, "(spdy debug) ", logging.LstdFlags)
+	debugging = w != ioutil.Discard
 }
 
 // EnableDebugOutput sets the output for the package's debug info logger to os.Stdout.
@@ -0,0 +1,83 @@
+package spdy
+
+import (
+	"errors"
+	"sync"
+)
+
+// maxQueuedControlFrames is the number of control frames
+// which may wait to be sent on a connection. Most control
+// frames, such as PING replies, are sent in response to the
+// other endpoint, so an endpoint which keeps sending frames
+// without reading the replies is cut off once this many are
+// waiting.
+const maxQueuedControlFrames = 10000
+
+// errControlFlood is the reason given for closing a
+// connection whose control frames could not be sent.
+var errControlFlood = errors.New("Error: Too many control frames are waiting to be sent.")
+
+// controlQueue holds a connection's control frames until the
+// send loop takes them. Adding a frame never waits for the
+// send loop, which may itself be waiting for the other
+// endpoint to read, so frames can be queued by the read loop,
+// and with locks held, without stalling the connection.
+type controlQueue struct {
+	mu     sync.Mutex
+	frames []Frame
+	ready  chan struct{} // holds a value while frames is non-empty.
+}
+
+func newControlQueue() *controlQueue {
+	q := new(controlQueue)
+	q.ready = make(chan struct{}, 1)
+	return q
+}
+
+// push adds a frame to the queue, and reports
+// false if the queue is full.
+func (q *controlQueue) push(frame Frame) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.frames) >= maxQueuedControlFrames {
+		return false
+	}
+	q.frames = append(q.frames, frame)
+	q.signal()
+	return true
+}
+
+// pop removes and returns the first frame in the
+// queue, or nil if the queue is empty. Only the
+// send loop may call pop.
+func (q *controlQueue) pop() Frame {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.frames) == 0 {
+		return nil
+	}
+	frame := q.frames[0]
+	q.frames[0] = nil
+	q.frames = q.frames[1:]
+	q.signal()
+	return frame
+}
+
+// signal leaves a value in ready if and only if
+// frames are queued. signal must be called with
+// the queue's lock held.
+func (q *controlQueue) signal() {
+	if len(q.frames) > 0 {
+		select {
+		case q.ready <- struct{}{}:
+		default:
+		}
+	} else {
+		select {
+		case <-q.ready:
+		default:
+		}
+	}
+}
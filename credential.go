@@ -0,0 +1,218 @@
+package spdy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// credentialProofLabel is the TLS exporter label used to
+// derive the value signed in a CREDENTIAL frame's proof.
+const credentialProofLabel = "EXPORTER SPDY certificate proof"
+
+// The hash and signature algorithms used in CREDENTIAL
+// proofs, which are TLS digitally-signed elements.
+const (
+	proofHashSHA1       = 2
+	proofHashSHA256     = 4
+	proofHashSHA384     = 5
+	proofHashSHA512     = 6
+	proofSignatureRSA   = 1
+	proofSignatureECDSA = 3
+)
+
+var proofHashes = map[byte]crypto.Hash{
+	proofHashSHA1:   crypto.SHA1,
+	proofHashSHA256: crypto.SHA256,
+	proofHashSHA384: crypto.SHA384,
+	proofHashSHA512: crypto.SHA512,
+}
+
+// credentialSlotKey is the request context key for
+// the credential slot used by a request's stream.
+type credentialSlotKey struct{}
+
+// credentialKeyingMaterial returns the value signed
+// in CREDENTIAL proofs on the given TLS session.
+func credentialKeyingMaterial(state *tls.ConnectionState) ([]byte, error) {
+	if state == nil {
+		return nil, errors.New("Error: CREDENTIAL frames can only be used over TLS.")
+	}
+	return state.ExportKeyingMaterial(credentialProofLabel, []byte{}, 32)
+}
+
+// signCredentialProof proves possession of the certificate's
+// private key on the given TLS session, for a CREDENTIAL frame.
+func signCredentialProof(state *tls.ConnectionState, cert tls.Certificate) ([]byte, error) {
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("Error: Credential private key cannot sign.")
+	}
+
+	var algorithm byte
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		algorithm = proofSignatureRSA
+	case *ecdsa.PublicKey:
+		algorithm = proofSignatureECDSA
+	default:
+		return nil, errors.New(fmt.Sprintf("Error: Unsupported credential key type %T.", signer.Public()))
+	}
+
+	ekm, err := credentialKeyingMaterial(state)
+	if err != nil {
+		return nil, err
+	}
+
+	h := crypto.SHA256.New()
+	h.Write(ekm)
+	sig, err := signer.Sign(rand.Reader, h.Sum(nil), crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	proof := make([]byte, 4, 4+len(sig))
+	proof[0] = proofHashSHA256
+	proof[1] = algorithm
+	proof[2] = byte(len(sig) >> 8)
+	proof[3] = byte(len(sig))
+	return append(proof, sig...), nil
+}
+
+// verifyCredential checks that a received CREDENTIAL's
+// proof was signed with the key of the leaf certificate
+// on the given TLS session, and that its certificate chain
+// is verified by config's ClientCAs, returning the verified
+// chains. CREDENTIALs are rejected by servers without
+// ClientCAs, as there is nothing to verify them against.
+func verifyCredential(state *tls.ConnectionState, config *tls.Config, proof []byte, certs []*x509.Certificate) ([][]*x509.Certificate, error) {
+	if len(certs) == 0 {
+		return nil, errors.New("Error: CREDENTIAL contains no certificates.")
+	}
+	if config == nil || config.ClientCAs == nil {
+		return nil, errors.New("Error: CREDENTIAL received without ClientCAs to verify it.")
+	}
+	if len(proof) < 4 || len(proof) != 4+int(bytesToUint16(proof[2:4])) {
+		return nil, errors.New("Error: CREDENTIAL has a malformed proof.")
+	}
+
+	hash, ok := proofHashes[proof[0]]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Error: CREDENTIAL proof uses unsupported hash %d.", proof[0]))
+	}
+
+	ekm, err := credentialKeyingMaterial(state)
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write(ekm)
+	digest := h.Sum(nil)
+
+	sig := proof[4:]
+	valid := false
+	switch pub := certs[0].PublicKey.(type) {
+	case *rsa.PublicKey:
+		valid = proof[1] == proofSignatureRSA && rsa.VerifyPKCS1v15(pub, hash, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		valid = proof[1] == proofSignatureECDSA && ecdsa.VerifyASN1(pub, digest, sig)
+	}
+	if !valid {
+		return nil, errors.New("Error: CREDENTIAL proof is invalid.")
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         config.ClientCAs,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	return certs[0].Verify(opts)
+}
+
+// credentialOrigin checks that a certificate received in
+// a CREDENTIAL is valid for the origin of a request, given
+// as the request's host, or host:port.
+func credentialOrigin(cert *x509.Certificate, host string) error {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return cert.VerifyHostname(host)
+}
+
+// AddCredential stores a client certificate in the given
+// slot of the SPDY/3 server's certificate vector. Requests
+// to hosts for which the certificate is valid send it in a
+// CREDENTIAL frame, once per connection, and then use the
+// slot, so the server sees the certificate as that of the
+// request. This allows client certificates to be presented
+// for domains other than the one in the TLS handshake.
+// Servers using this package only accept certificates
+// verified by their TLSConfig's ClientCAs, and only for
+// hosts for which the certificate is valid.
+//
+// Slots start at 1, and must be no larger than the size of
+// the server's certificate vector, which is 8 unless the
+// server sets SETTINGS_CLIENT_CERTIFICATE_VECTOR_SIZE.
+// Requests needing a slot beyond the vector fail. If more
+// than one certificate is valid for a host, the lowest slot
+// is used. SPDY/2 has no CREDENTIAL frames, so requests made
+// over SPDY/2 connections do not use credentials.
+func (t *Transport) AddCredential(slot uint16, cert tls.Certificate) error {
+	if slot == 0 || slot > MAX_CREDENTIAL_SLOT {
+		return errors.New(fmt.Sprintf("Error: Invalid credential slot %d.", slot))
+	}
+	if len(cert.Certificate) == 0 {
+		return errors.New("Error: Credential contains no certificates.")
+	}
+	if cert.Leaf == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+		cert.Leaf = leaf
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if t.credentials == nil {
+		t.credentials = make(map[uint16]tls.Certificate)
+	}
+	t.credentials[slot] = cert
+	return nil
+}
+
+// credentialFor returns the credential slot and
+// certificate to be used for requests to the given
+// host:port, if any.
+func (t *Transport) credentialFor(host string) (uint16, tls.Certificate, bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	slots := make([]int, 0, len(t.credentials))
+	for slot := range t.credentials {
+		slots = append(slots, int(slot))
+	}
+	sort.Ints(slots)
+
+	for _, slot := range slots {
+		cert := t.credentials[uint16(slot)]
+		if credentialOrigin(cert.Leaf, host) == nil {
+			return uint16(slot), cert, true
+		}
+	}
+	return 0, tls.Certificate{}, false
+}
@@ -0,0 +1,286 @@
+package spdy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority issuing client
+// certificates for the CREDENTIAL tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert, key}
+}
+
+// pool returns a pool holding the CA's certificate.
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// issue returns a client certificate for the given host.
+func (ca *testCA) issue(t *testing.T, host string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// credentialConns returns a SPDY/3 client connected over
+// TLS to a server with the given ClientCAs, and the TLS
+// state seen by the server's handler for each request.
+func credentialConns(t *testing.T, roots *x509.CertPool) (Conn, <-chan *tls.ConnectionState) {
+	t.Helper()
+	serverTLS, clientTLS := tlsPipeWith(t, 3, &tls.Config{ClientCAs: roots})
+	states := make(chan *tls.ConnectionState, 10)
+	srv := &http.Server{
+		TLSConfig: &tls.Config{ClientCAs: roots},
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			states <- r.TLS
+		}),
+	}
+
+	server, err := NewServerConn(serverTLS, srv, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClientConn(clientTLS, nil, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, conn := range []Conn{server, client} {
+		conn := conn
+		running := make(chan struct{})
+		go func() { defer close(running); conn.Run() }()
+		t.Cleanup(func() {
+			within(t, 10*time.Second, "closing the connection", func() {
+				serverTLS.Close()
+				clientTLS.Close()
+				conn.Close()
+				<-running
+			})
+		})
+	}
+	return client, states
+}
+
+// credentialRequest makes a request to the host using
+// the transport's credentials, or else the given slot,
+// returning the TLS state seen by the handler.
+func credentialRequest(t *testing.T, tr *Transport, client Conn, states <-chan *tls.ConnectionState, host string, slot uint16) (*tls.ConnectionState, error) {
+	t.Helper()
+	var state *tls.ConnectionState
+	var err error
+	within(t, 5*time.Second, "the request", func() {
+		req, _ := http.NewRequest("GET", "https://"+host+"/", nil)
+		if slot != 0 {
+			req = req.WithContext(context.WithValue(req.Context(), credentialSlotKey{}, slot))
+		}
+		if _, _, err = tr.requestSPDY(client, req); err == nil {
+			state = <-states
+		}
+	})
+	return state, err
+}
+
+// invalidCredentials checks that a request failed with
+// the stream reset as INVALID_CREDENTIALS.
+func invalidCredentials(t *testing.T, err error) {
+	t.Helper()
+	var serr *StreamError
+	if !errors.As(err, &serr) || serr.Status != RST_STREAM_INVALID_CREDENTIALS {
+		t.Errorf("the request failed with %v, want INVALID_CREDENTIALS", err)
+	}
+}
+
+// sendCredential sends a CREDENTIAL frame with the given
+// proof, bypassing the client's own signing.
+func sendCredential(t *testing.T, client Conn, slot uint16, cert tls.Certificate, proof []byte) {
+	t.Helper()
+	conn := client.(*connV3)
+	frame := &credentialFrameV3{Slot: slot, Proof: proof, Certificates: []*x509.Certificate{cert.Leaf}}
+	conn.Lock()
+	defer conn.Unlock()
+	if err := conn.queue(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A certificate sent in a CREDENTIAL with a valid proof,
+// and verified by the server's ClientCAs, is the client
+// certificate of requests using its slot.
+func TestCredential(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	cert := ca.issue(t, "example.com")
+	client, states := credentialConns(t, ca.pool())
+
+	tr := new(Transport)
+	if err := tr.AddCredential(1, cert); err != nil {
+		t.Fatal(err)
+	}
+	state, err := credentialRequest(t, tr, client, states, "example.com", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.PeerCertificates) != 1 || !state.PeerCertificates[0].Equal(cert.Leaf) {
+		t.Errorf("the handler saw certificates %v", state.PeerCertificates)
+	}
+	if len(state.VerifiedChains) != 1 || !state.VerifiedChains[0][len(state.VerifiedChains[0])-1].Equal(ca.cert) {
+		t.Errorf("the handler saw verified chains %v", state.VerifiedChains)
+	}
+
+	// Requests without credentials use slot 0, and see
+	// the handshake's state, without a certificate.
+	state, err = credentialRequest(t, new(Transport), client, states, "example.com", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.PeerCertificates) != 0 {
+		t.Errorf("a request without credentials saw certificates %v", state.PeerCertificates)
+	}
+}
+
+// Streams using a slot whose CREDENTIAL was rejected, or
+// for a host the slot's certificate is not valid for, are
+// reset with INVALID_CREDENTIALS.
+func TestCredentialRejected(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	cert := ca.issue(t, "example.com")
+
+	tests := []struct {
+		name  string
+		roots *x509.CertPool
+		send  func(t *testing.T, client Conn)
+		host  string
+	}{
+		{"bad proof", ca.pool(), func(t *testing.T, client Conn) {
+			proof, err := signCredentialProof(TLSState(client), cert)
+			if err != nil {
+				t.Fatal(err)
+			}
+			proof[len(proof)-1] ^= 0xff
+			sendCredential(t, client, 1, cert, proof)
+		}, "example.com"},
+		{"proof from another key", ca.pool(), func(t *testing.T, client Conn) {
+			proof, err := signCredentialProof(TLSState(client), ca.issue(t, "example.com"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sendCredential(t, client, 1, cert, proof)
+		}, "example.com"},
+		{"unverified chain", ca.pool(), func(t *testing.T, client Conn) {
+			other := newTestCA(t, "Other CA").issue(t, "example.com")
+			if err := client.(credentialSender).sendCredential(1, other); err != nil {
+				t.Fatal(err)
+			}
+		}, "example.com"},
+		{"no ClientCAs", nil, func(t *testing.T, client Conn) {
+			if err := client.(credentialSender).sendCredential(1, cert); err != nil {
+				t.Fatal(err)
+			}
+		}, "example.com"},
+		{"other origin", ca.pool(), func(t *testing.T, client Conn) {
+			if err := client.(credentialSender).sendCredential(1, cert); err != nil {
+				t.Fatal(err)
+			}
+		}, "example.org"},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			client, states := credentialConns(t, test.roots)
+			test.send(t, client)
+			_, err := credentialRequest(t, new(Transport), client, states, test.host, 1)
+			invalidCredentials(t, err)
+		})
+	}
+}
+
+// A CREDENTIAL replaces the certificate in its slot, and
+// one which is rejected leaves the slot empty.
+func TestCredentialReplaced(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	first := ca.issue(t, "example.com")
+	second := ca.issue(t, "example.com")
+	client, states := credentialConns(t, ca.pool())
+
+	for _, cert := range []tls.Certificate{first, second} {
+		tr := new(Transport)
+		if err := tr.AddCredential(1, cert); err != nil {
+			t.Fatal(err)
+		}
+		state, err := credentialRequest(t, tr, client, states, "example.com", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(state.PeerCertificates) == 0 || !state.PeerCertificates[0].Equal(cert.Leaf) {
+			t.Errorf("the handler saw certificates %v", state.PeerCertificates)
+		}
+	}
+
+	proof, err := signCredentialProof(TLSState(client), first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof[len(proof)-1] ^= 0xff
+	sendCredential(t, client, 1, second, proof)
+	_, err = credentialRequest(t, new(Transport), client, states, "example.com", 1)
+	invalidCredentials(t, err)
+}
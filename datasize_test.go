@@ -0,0 +1,145 @@
+package spdy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// setMaxDataFrameSize sets MaxDataFrameSize for the rest
+// of the test. It must be called before any connections
+// are made, so that it is restored after they close.
+func setMaxDataFrameSize(t testing.TB, n int) {
+	old := MaxDataFrameSize
+	MaxDataFrameSize = n
+	t.Cleanup(func() { MaxDataFrameSize = old })
+}
+
+// readData reads the DATA frames sent on the stream, until
+// want bytes have been received or the stream is finished,
+// returning the size of each frame, and whether the last
+// had FIN set.
+func readData(t *testing.T, conn net.Conn, version uint16, sid StreamID, want int) (sizes []int, fin bool) {
+	t.Helper()
+	received := 0
+	within(t, 5*time.Second, "the data", func() {
+		for !fin && (received < want || want == 0) {
+			frame, err := readRawFrame(conn, version)
+			if err != nil {
+				t.Errorf("reading the data: %v", err)
+				return
+			}
+			var data []byte
+			var last bool
+			switch frame := frame.(type) {
+			case *dataFrameV3:
+				if frame.StreamID != sid {
+					continue
+				}
+				data, last = frame.Data, frame.Flags.FIN()
+			case *dataFrameV2:
+				if frame.StreamID != sid {
+					continue
+				}
+				data, last = frame.Data, frame.Flags.FIN()
+			default:
+				continue
+			}
+			if fin {
+				t.Errorf("received %d bytes after FIN", len(data))
+			}
+			sizes = append(sizes, len(data))
+			received += len(data)
+			fin = last
+		}
+	})
+	return sizes, fin
+}
+
+// checkFrames checks that each frame is within the
+// size limit, and that there are total bytes in all.
+func checkFrames(t *testing.T, sizes []int, limit, total int) {
+	t.Helper()
+	sum := 0
+	for _, n := range sizes {
+		if n > limit {
+			t.Errorf("sent a DATA frame of %d bytes, over the limit of %d", n, limit)
+		}
+		sum += n
+	}
+	if sum != total {
+		t.Errorf("sent %d bytes in %v, want %d", sum, sizes, total)
+	}
+}
+
+// A large write, whether of a response or a request body,
+// is sent in DATA frames of at most MaxDataFrameSize, with
+// FIN only set on the last.
+func TestMaxDataFrameSize(t *testing.T) {
+	const limit, size = 1000, 5500
+	body := bytes.Repeat([]byte("a"), size)
+
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d response", version), func(t *testing.T) {
+			setMaxDataFrameSize(t, limit)
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(body)
+			})}
+			conn := rawServerConn(t, srv, version)
+			go conn.Write(rawSynStream(version, 1, newRawCompressor(version).block(rawRequest(version, "/")...)))
+
+			sizes, fin := readData(t, conn, version, 1, 0)
+			if !fin {
+				t.Error("the response did not finish")
+			}
+			checkFrames(t, sizes, limit, size)
+		})
+
+		t.Run(fmt.Sprintf("SPDY/%d request", version), func(t *testing.T) {
+			setMaxDataFrameSize(t, limit)
+			client, conn := rawClientConn(t, version)
+			go func() {
+				req, _ := http.NewRequest("POST", "https://example.com/", bytes.NewReader(body))
+				request(client, req)
+			}()
+
+			sizes, fin := readData(t, conn, version, 1, 0)
+			if !fin {
+				t.Error("the request did not finish")
+			}
+			checkFrames(t, sizes, limit, size)
+		})
+	}
+}
+
+// Frames are split to fit the flow control window as
+// well as the size limit.
+func TestMaxDataFrameSizeWindow(t *testing.T) {
+	const limit, window, size = 1000, 2500, 5500
+	setMaxDataFrameSize(t, limit)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("a"), size))
+	})}
+	conn := rawServerConn(t, srv, 3)
+	go func() {
+		conn.Write(rawInitialWindow(window))
+		conn.Write(rawSynStream(3, 1, newRawCompressor(3).block(rawRequest(3, "/")...)))
+	}()
+
+	sizes, fin := readData(t, conn, 3, 1, window)
+	if fin {
+		t.Fatal("the response finished before the window was updated")
+	}
+	checkFrames(t, sizes, limit, window)
+
+	go conn.Write(rawWindowUpdate(1, size))
+	sizes, fin = readData(t, conn, 3, 1, 0)
+	if !fin {
+		t.Error("the response did not finish")
+	}
+	checkFrames(t, sizes, limit, size-window)
+}
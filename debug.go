@@ -0,0 +1,282 @@
+package spdy
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConnSnapshot is a copy of the state of a SPDY
+// connection at a point in time. Snapshots can be
+// taken with Snapshot and Transport.Snapshot.
+type ConnSnapshot struct {
+	ID                uint64           // connection ID, as used in profiler labels.
+	Version           uint16           // SPDY version in use.
+	RemoteAddr        string           // address of the peer.
+	RemoteIP          net.IP           // IP address of the peer, if connected over IP.
+	Server            bool             // whether this is the server end.
+	Uptime            time.Duration    // time since the connection was created.
+	InitialWindowSize uint32           // initial transport window. (SPDY/3 only)
+	GoawaySent        bool             // whether a GOAWAY has been sent.
+	GoawayReceived    bool             // whether a GOAWAY has been received.
+	BenignErrors      int              // number of non-serious errors encountered.
+	DroppedResets     uint64           // number of RST_STREAMs dropped by flood protection.
+	VersionErrors     int              // number of connection-scoped frames with the wrong SPDY version.
+	PeerVersion       uint16           // SPDY version of the last frame with the wrong version, if any.
+	Settings          []Setting        // settings received from the peer.
+	SentSettings      []Setting        // settings sent to the peer.
+	Streams           []StreamSnapshot // streams which have not yet closed.
+	Events            []ConnEvent      // recent events, oldest first.
+	Stats             *ConnStats       // the connection's counters.
+}
+
+// StreamSnapshot is a copy of the state of
+// a SPDY stream at a point in time.
+type StreamSnapshot struct {
+	ID            StreamID
+	State         string
+	Tags          map[string]string // tags set with Stream.SetTag.
+	SendWindow    int64             // data which may be sent before a WINDOW_UPDATE. (SPDY/3 only)
+	ReceiveWindow int64             // data the peer may send before a WINDOW_UPDATE. (SPDY/3 only)
+}
+
+// ConnEvent is a notable event in the life of
+// a SPDY connection, such as a RST_STREAM or
+// GOAWAY being sent or received.
+type ConnEvent struct {
+	Time        time.Time
+	Description string
+}
+
+// streamSnapshots is used to sort streams by ID.
+type streamSnapshots []StreamSnapshot
+
+func (s streamSnapshots) Len() int           { return len(s) }
+func (s streamSnapshots) Less(i, j int) bool { return s[i].ID < s[j].ID }
+func (s streamSnapshots) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Snapshot returns a snapshot of each of the SPDY
+// connections currently being served by srv.
+func Snapshot(srv *http.Server) []*ConnSnapshot {
+	return snapshots(servers.list(srv))
+}
+
+// Snapshot returns a snapshot of each of the SPDY
+// connections in the Transport's pool.
+func (t *Transport) Snapshot() []*ConnSnapshot {
+	t.m.Lock()
+	conns := t.pooledConns()
+	t.m.Unlock()
+
+	return snapshots(conns)
+}
+
+func snapshots(conns []Conn) []*ConnSnapshot {
+	out := make([]*ConnSnapshot, 0, len(conns))
+	for _, conn := range conns {
+		if s, ok := conn.(snapshotter); ok {
+			snap := s.snapshot()
+			if a, ok := conn.(netAddrer); ok {
+				_, remote := a.netAddrs()
+				if addr, ok := remote.(*net.TCPAddr); ok {
+					snap.RemoteIP = addr.IP
+				}
+			}
+			out = append(out, snap)
+		}
+	}
+	return out
+}
+
+// ServerDebugHandler returns an http.Handler which
+// describes the live SPDY connections being served by
+// srv. The description is given in HTML, or in JSON if
+// the request's "format" parameter is "json" or it
+// accepts "application/json".
+//
+// ServerDebugHandler only reads snapshots of each
+// connection, so serving it does not hold up the
+// connections. It should not be exposed publicly.
+//
+//	func main() {
+//		srv := &http.Server{Addr: ":443"}
+//		spdy.AddSPDY(srv)
+//		go http.ListenAndServe("localhost:6060", spdy.ServerDebugHandler(srv))
+//		srv.ListenAndServeTLS("cert.pem", "key.pem")
+//	}
+func ServerDebugHandler(srv *http.Server) http.Handler {
+	return debugHandler(func() []*ConnSnapshot { return Snapshot(srv) })
+}
+
+// TransportDebugHandler is the counterpart of
+// ServerDebugHandler, which describes the SPDY
+// connections in the Transport's pool.
+func TransportDebugHandler(t *Transport) http.Handler {
+	return debugHandler(t.Snapshot)
+}
+
+func debugHandler(snapshot func() []*ConnSnapshot) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conns := snapshot()
+
+		if r.FormValue("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(conns); err != nil {
+				log.Println(err)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := debugTemplate.Execute(w, conns); err != nil {
+			log.Println(err)
+		}
+	})
+}
+
+// numConnEvents is the number of recent
+// events kept by each connection.
+const numConnEvents = 32
+
+// connEvents records the recent events of a
+// connection, and the settings it has sent,
+// for its snapshots. It has its own lock, so
+// the send and read loops can update it
+// without taking the connection's lock.
+type connEvents struct {
+	sync.Mutex
+	ring     [numConnEvents]ConnEvent
+	recorded int      // number of events recorded.
+	sent     Settings // settings sent to the peer.
+}
+
+func (e *connEvents) add(now time.Time, format string, v ...interface{}) {
+	e.Lock()
+	defer e.Unlock()
+	e.ring[e.recorded%numConnEvents] = ConnEvent{Time: now, Description: fmt.Sprintf(format, v...)}
+	e.recorded++
+}
+
+// frameSent records the frame as an event if it
+// is a SETTINGS, RST_STREAM or GOAWAY frame, and
+// keeps the settings of any SETTINGS frame.
+func (e *connEvents) frameSent(now time.Time, frame Frame) {
+	var settings Settings
+	switch frame := frame.(type) {
+	case *settingsFrameV3:
+		settings = frame.Settings
+	case *settingsFrameV2:
+		settings = frame.Settings
+	}
+	if settings != nil {
+		e.Lock()
+		if e.sent == nil {
+			e.sent = make(Settings)
+		}
+		for id, setting := range settings {
+			s := *setting
+			e.sent[id] = &s
+		}
+		e.Unlock()
+	}
+	e.frame(now, "Sent", frame)
+}
+
+// frameReceived records the frame as an event if
+// it is a SETTINGS, RST_STREAM or GOAWAY frame.
+func (e *connEvents) frameReceived(now time.Time, frame Frame) {
+	e.frame(now, "Received", frame)
+}
+
+func (e *connEvents) frame(now time.Time, direction string, frame Frame) {
+	switch frame := frame.(type) {
+	case *settingsFrameV3:
+		e.add(now, "%s SETTINGS with %d settings", direction, len(frame.Settings))
+	case *settingsFrameV2:
+		e.add(now, "%s SETTINGS with %d settings", direction, len(frame.Settings))
+	case *rstStreamFrameV3:
+		e.add(now, "%s RST_STREAM for stream %d: %s", direction, frame.StreamID, frame.Status)
+	case *rstStreamFrameV2:
+		e.add(now, "%s RST_STREAM for stream %d: %s", direction, frame.StreamID, frame.Status)
+	case *goawayFrameV3:
+		e.add(now, "%s GOAWAY with last good stream %d: %s", direction, frame.LastGoodStreamID, frame.Status.goawayString())
+	case *goawayFrameV2:
+		e.add(now, "%s GOAWAY with last good stream %d", direction, frame.LastGoodStreamID)
+	}
+}
+
+// snapshot returns copies of the recent events,
+// oldest first, and of the settings sent.
+func (e *connEvents) snapshot() (events []ConnEvent, sent []Setting) {
+	e.Lock()
+	defer e.Unlock()
+
+	n := e.recorded
+	if n > numConnEvents {
+		n = numConnEvents
+	}
+	events = make([]ConnEvent, 0, n)
+	for i := e.recorded - n; i < e.recorded; i++ {
+		events = append(events, e.ring[i%numConnEvents])
+	}
+	sent = make([]Setting, 0, len(e.sent))
+	for _, setting := range e.sent.Settings() {
+		sent = append(sent, *setting)
+	}
+	return events, sent
+}
+
+var debugTemplate = template.Must(template.New("debug").Parse(`<!DOCTYPE html>
+<html>
+<head><title>SPDY connections</title></head>
+<body>
+<h1>SPDY connections ({{len .}})</h1>
+{{range .}}
+<h2>{{.RemoteAddr}}</h2>
+<table>
+<tr><td>ID</td><td>{{.ID}}</td></tr>
+{{if .RemoteIP}}<tr><td>Remote IP</td><td>{{.RemoteIP}}</td></tr>{{end}}
+<tr><td>Version</td><td>SPDY/{{.Version}}</td></tr>
+<tr><td>Server</td><td>{{.Server}}</td></tr>
+<tr><td>Uptime</td><td>{{.Uptime}}</td></tr>
+<tr><td>Initial window size</td><td>{{.InitialWindowSize}}</td></tr>
+<tr><td>GOAWAY sent</td><td>{{.GoawaySent}}</td></tr>
+<tr><td>GOAWAY received</td><td>{{.GoawayReceived}}</td></tr>
+<tr><td>Benign errors</td><td>{{.BenignErrors}}</td></tr>
+<tr><td>Dropped RST_STREAMs</td><td>{{.DroppedResets}}</td></tr>
+{{if .PeerVersion}}<tr><td>Wrong version frames</td><td>{{.VersionErrors}} (SPDY/{{.PeerVersion}})</td></tr>{{end}}
+</table>
+{{with .Stats}}<h3>Counters</h3>
+<table>
+<tr><td>Streams opened</td><td>{{.TotalStreamsOpened}}</td></tr>
+<tr><td>Bytes sent</td><td>{{.BytesSent}}</td></tr>
+<tr><td>Bytes received</td><td>{{.BytesReceived}}</td></tr>
+<tr><td>Frames sent</td><td>{{range $name, $n := .FramesSent}}{{$name}}={{$n}} {{end}}</td></tr>
+<tr><td>Frames received</td><td>{{range $name, $n := .FramesReceived}}{{$name}}={{$n}} {{end}}</td></tr>
+<tr><td>Pings outstanding</td><td>{{.PingsOutstanding}}</td></tr>
+<tr><td>Responses too large</td><td>{{.ResponsesTooLarge}}</td></tr>
+</table>
+{{end}}<h3>Sent settings</h3>
+<pre>{{range .SentSettings}}{{.String}}
+{{end}}</pre>
+<h3>Received settings</h3>
+<pre>{{range .Settings}}{{.String}}
+{{end}}</pre>
+<h3>Streams ({{len .Streams}})</h3>
+<table>
+<tr><th>ID</th><th>State</th>{{if eq .Version 3}}<th>Send window</th><th>Receive window</th>{{end}}<th>Tags</th></tr>
+{{$version := .Version}}{{range .Streams}}<tr><td>{{.ID}}</td><td>{{.State}}</td>{{if eq $version 3}}<td>{{.SendWindow}}</td><td>{{.ReceiveWindow}}</td>{{end}}<td>{{range $key, $value := .Tags}}{{$key}}={{$value}} {{end}}</td></tr>
+{{end}}</table>
+<h3>Recent events</h3>
+<table>
+{{range .Events}}<tr><td>{{.Time.Format "15:04:05.000"}}</td><td>{{.Description}}</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,182 @@
+package spdy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// debugSnapshots fetches the JSON description given
+// by the debug handler h.
+func debugSnapshots(t *testing.T, h http.Handler, req *http.Request) []*ConnSnapshot {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("got Content-Type %q, want application/json", ct)
+	}
+	var snaps []*ConnSnapshot
+	if err := json.NewDecoder(w.Body).Decode(&snaps); err != nil {
+		t.Fatal(err)
+	}
+	return snaps
+}
+
+// awaitEvent fetches the JSON description given by the
+// debug handler h, which must describe one connection,
+// until the connection has an event beginning with prefix.
+func awaitEvent(t *testing.T, h http.Handler, req *http.Request, prefix string) *ConnSnapshot {
+	t.Helper()
+	var snap *ConnSnapshot
+	within(t, 5*time.Second, prefix, func() {
+		for {
+			snaps := debugSnapshots(t, h, req)
+			if len(snaps) != 1 {
+				t.Errorf("described %d connections, want 1", len(snaps))
+				return
+			}
+			snap = snaps[0]
+			for _, event := range snap.Events {
+				if strings.HasPrefix(event.Description, prefix) {
+					return
+				}
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+	return snap
+}
+
+// Connections keep their most recent events, oldest
+// first, and the latest value of each setting sent.
+func TestConnEvents(t *testing.T) {
+	var events connEvents
+	now := time.Unix(0, 0)
+	for i := 1; i <= numConnEvents+2; i++ {
+		events.frameSent(now, &rstStreamFrameV3{StreamID: StreamID(i), Status: RST_STREAM_CANCEL})
+	}
+	events.frameSent(now, &dataFrameV3{StreamID: 1})
+	settings := Settings{SETTINGS_MAX_CONCURRENT_STREAMS: {ID: SETTINGS_MAX_CONCURRENT_STREAMS, Value: 10}}
+	events.frameSent(now, &settingsFrameV3{Settings: settings})
+	settings[SETTINGS_MAX_CONCURRENT_STREAMS].Value = 20
+	events.frameReceived(now, &goawayFrameV3{LastGoodStreamID: 5})
+
+	recent, sent := events.snapshot()
+	if len(recent) != numConnEvents {
+		t.Fatalf("kept %d events, want %d", len(recent), numConnEvents)
+	}
+	if want := "Sent RST_STREAM for stream 5: CANCEL"; recent[0].Description != want {
+		t.Errorf("the oldest event is %q, want %q", recent[0].Description, want)
+	}
+	if want := "Sent SETTINGS with 1 settings"; recent[numConnEvents-2].Description != want {
+		t.Errorf("got event %q, want %q", recent[numConnEvents-2].Description, want)
+	}
+	if want := "Received GOAWAY with last good stream 5: OK"; recent[numConnEvents-1].Description != want {
+		t.Errorf("the newest event is %q, want %q", recent[numConnEvents-1].Description, want)
+	}
+	if len(sent) != 1 || sent[0].Value != 10 {
+		t.Errorf("got sent settings %v, want MAX_CONCURRENT_STREAMS of 10", sent)
+	}
+}
+
+// ServerDebugHandler describes each connection being
+// served, with its open streams and their windows, the
+// settings sent and received, its recent events and its
+// counters, in JSON or HTML.
+func TestServerDebugHandler(t *testing.T) {
+	server, started, release := drainServer(t, nil)
+	errs := slowRequest(t, server, started)
+	defer func() {
+		close(release)
+		within(t, 5*time.Second, "the request", func() { <-errs })
+	}()
+	h := ServerDebugHandler(server.Config)
+
+	snap := awaitEvent(t, h, httptest.NewRequest("GET", "/?format=json", nil), "Sent SETTINGS")
+	if snap.Version != 3 || !snap.Server {
+		t.Errorf("got version %d and server %v, want a SPDY/3 server", snap.Version, snap.Server)
+	}
+	if len(snap.Streams) != 1 {
+		t.Fatalf("got streams %v, want the request in progress", snap.Streams)
+	}
+	if stream := snap.Streams[0]; stream.ID != 1 || stream.SendWindow <= 0 || stream.ReceiveWindow <= 0 {
+		t.Errorf("got stream %+v, want stream 1 with its windows", stream)
+	}
+	sentLimit := false
+	for _, setting := range snap.SentSettings {
+		if setting.ID == SETTINGS_MAX_CONCURRENT_STREAMS {
+			sentLimit = true
+		}
+	}
+	if !sentLimit {
+		t.Errorf("got sent settings %v, want MAX_CONCURRENT_STREAMS", snap.SentSettings)
+	}
+	if len(snap.Settings) == 0 {
+		t.Error("got no received settings")
+	}
+	if snap.Stats == nil || snap.Stats.TotalStreamsOpened != 1 || snap.Stats.FramesReceived["SYN_STREAM"] != 1 {
+		t.Errorf("got counters %+v, want one stream opened", snap.Stats)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Fatalf("got Content-Type %q, want HTML", ct)
+	}
+	body := w.Body.String()
+	for _, want := range []string{"SPDY connections (1)", "SPDY/3", "Sent settings", "Streams (1)", "Send window", "Sent SETTINGS", "SYN_STREAM=1"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("the HTML does not contain %q:\n%s", want, body)
+		}
+	}
+}
+
+// TransportDebugHandler describes the connections in
+// the pool, including the RST_STREAMs they have sent.
+func TestTransportDebugHandler(t *testing.T) {
+	started := make(chan struct{}, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-r.Context().Done()
+	})}
+
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			tr := pipeTransport(t, srv, version)
+			h := TransportDebugHandler(tr)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			errs := make(chan error, 1)
+			go func() {
+				_, err := tr.RoundTrip(httptest.NewRequest("GET", "https://example.com/", nil).WithContext(ctx))
+				errs <- err
+			}()
+			within(t, 5*time.Second, "the request starting", func() { <-started })
+			cancel()
+			within(t, 5*time.Second, "the request", func() {
+				if err := <-errs; err != context.Canceled {
+					t.Errorf("the request gave %v, want context.Canceled", err)
+				}
+			})
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Accept", "application/json")
+			snap := awaitEvent(t, h, req, "Sent RST_STREAM for stream 1: CANCEL")
+			if snap.Version != version || snap.Server {
+				t.Errorf("got version %d and server %v, want a SPDY/%d client", snap.Version, snap.Server, version)
+			}
+			if len(snap.SentSettings) == 0 || len(snap.Settings) == 0 {
+				t.Errorf("got sent settings %v and received settings %v", snap.SentSettings, snap.Settings)
+			}
+			if snap.Stats == nil || snap.Stats.TotalStreamsOpened != 1 || snap.Stats.FramesSent["RST_STREAM"] != 1 {
+				t.Errorf("got counters %+v, want a stream opened and a RST_STREAM sent", snap.Stats)
+			}
+		})
+	}
+}
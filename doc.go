@@ -3,6 +3,30 @@ Package spdy is a full-featured SPDY library for the Go language (still under ve
 
 Note that this implementation currently supports SPDY drafts 2 and 3, and support for SPDY/4, and HTTP/2.0 is upcoming.
 
+-------------------------------
+
+		Package layout
+
+The library is a single package, whose import path and exported identifiers are kept
+stable. The API falls into a few groups:
+
+Wire format: Frame, ParseFrame, MarshalFrame, Compressor, Decompressor, and the frame
+constants, flags, status codes and settings.
+
+Connections and streams: Conn, Stream, NewClientConn, NewServerConn, DialTLS and
+RequestCtx, with Receiver for the responses and pushes a client receives.
+
+Clients: Client and Transport, which use SPDY where the server supports it, and
+RoundTripOnce.
+
+Servers: ListenAndServeTLS and AddSPDY, and the functions which take a handler's
+http.ResponseWriter, such as Push, PingClient and SetInteractive.
+
+Diagnostics: Snapshot, Stats, ServerDebugHandler, TransportDebugHandler and the
+debug and error loggers.
+
+Helpers for testing handlers over SPDY are in github.com/SlyMarbo/spdy/spdytest.
+
 -------------------------------
 
 		Servers
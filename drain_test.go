@@ -0,0 +1,174 @@
+package spdy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// drainServer returns a SPDY server whose requests to
+// /slow wait until release is closed, and whose Drain
+// uses the given clock.
+func drainServer(t *testing.T, clock clock) (server *httptest.Server, started chan struct{}, release chan struct{}) {
+	started = make(chan struct{}, 1)
+	release = make(chan struct{})
+	server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	AddSPDY(server.Config)
+	server.TLS = &tls.Config{NextProtos: NPNStrings()}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	servers.Lock()
+	servers.config(server.Config).clock = clock
+	servers.Unlock()
+	return server, started, release
+}
+
+// slowRequest starts a request to /slow, returning once
+// the handler has started, and the request's error once
+// it has finished.
+func slowRequest(t *testing.T, server *httptest.Server, started <-chan struct{}) <-chan error {
+	tr := NewTransport(server.Client().Transport.(*http.Transport).TLSClientConfig)
+	t.Cleanup(tr.CloseIdleConnections)
+	errs := make(chan error, 1)
+	go func() {
+		res, err := tr.RoundTrip(mustRequest(t, server.URL+"/slow"))
+		if err == nil {
+			res.Body.Close()
+		}
+		errs <- err
+	}()
+	within(t, 5*time.Second, "the request starting", func() { <-started })
+	return errs
+}
+
+func mustRequest(t *testing.T, url string) *http.Request {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+// Drain waits for the streams in progress to finish,
+// checking DrainProgress periodically, then closes the
+// connections.
+func TestDrain(t *testing.T) {
+	clock := newFakeClock()
+	server, started, release := drainServer(t, clock)
+	errs := slowRequest(t, server, started)
+
+	if conns, streams := DrainProgress(server.Config); conns != 1 || streams != 1 {
+		t.Fatalf("DrainProgress gave %d connections and %d streams, want 1 and 1", conns, streams)
+	}
+
+	type result struct {
+		streams int
+		err     error
+	}
+	drained := make(chan result, 1)
+	go func() {
+		streams, err := Drain(context.Background(), server.Config)
+		drained <- result{streams, err}
+	}()
+
+	// Drain waits while the stream is in progress.
+	for i := 0; i < 3; i++ {
+		clock.waitPending(t, 1)
+		clock.Advance(100 * time.Millisecond)
+	}
+	select {
+	case res := <-drained:
+		t.Fatalf("Drain returned %d, %v with a stream in progress", res.streams, res.err)
+	default:
+	}
+
+	close(release)
+	within(t, 5*time.Second, "the request", func() {
+		if err := <-errs; err != nil {
+			t.Errorf("the request failed: %v", err)
+		}
+	})
+	within(t, 5*time.Second, "the drain", func() {
+		for {
+			select {
+			case res := <-drained:
+				if res.streams != 0 || res.err != nil {
+					t.Errorf("Drain returned %d, %v, want 0, nil", res.streams, res.err)
+				}
+				return
+			default:
+			}
+			if _, ok := clock.Next(); ok {
+				clock.Advance(100 * time.Millisecond)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+	within(t, 5*time.Second, "closing the connection", func() {
+		for {
+			if conns, _ := DrainProgress(server.Config); conns == 0 {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+}
+
+// If Drain's context is cancelled, the streams still in
+// progress are cut off, and new connections are served as
+// normal.
+func TestDrainCancelled(t *testing.T) {
+	clock := newFakeClock()
+	server, started, release := drainServer(t, clock)
+	defer close(release)
+	errs := slowRequest(t, server, started)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	type result struct {
+		streams int
+		err     error
+	}
+	drained := make(chan result, 1)
+	go func() {
+		streams, err := Drain(ctx, server.Config)
+		drained <- result{streams, err}
+	}()
+	clock.waitPending(t, 1)
+	cancel()
+
+	within(t, 5*time.Second, "the drain", func() {
+		if res := <-drained; res.streams != 1 || res.err != context.Canceled {
+			t.Errorf("Drain returned %d, %v, want 1, context.Canceled", res.streams, res.err)
+		}
+	})
+	within(t, 5*time.Second, "the request", func() {
+		if err := <-errs; err == nil {
+			t.Error("the request in progress succeeded")
+		}
+	})
+
+	if servers.lookup(server.Config).draining {
+		t.Fatal("the server is still draining")
+	}
+	tr := NewTransport(server.Client().Transport.(*http.Transport).TLSClientConfig)
+	defer tr.CloseIdleConnections()
+	within(t, 5*time.Second, "a new request", func() {
+		res, err := tr.RoundTrip(mustRequest(t, server.URL))
+		if err != nil {
+			t.Errorf("a new request failed: %v", err)
+			return
+		}
+		res.Body.Close()
+	})
+}
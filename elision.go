@@ -0,0 +1,127 @@
+package spdy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// SETTINGS_EXPERIMENTAL_HEADER_ELISION is an experimental
+// setting, sent by servers which can reconstruct request
+// headers elided by the client. See EnableHeaderElision.
+const SETTINGS_EXPERIMENTAL_HEADER_ELISION = 0xe1d0
+
+// ELIDED_HEADER lists the headers which have been elided
+// from a request, because they were identical in the
+// previous request on the same connection.
+const ELIDED_HEADER = "X-Spdy-Elided"
+
+// headerElider is implemented by client connections
+// which can elide repeated request headers.
+type headerElider interface {
+	enableHeaderElision()
+}
+
+// EnableHeaderElision allows clients of srv to elide request
+// headers which are identical to those in their previous request
+// on the same connection. srv's SPDY connections advertise this
+// with the experimental SETTINGS_EXPERIMENTAL_HEADER_ELISION
+// setting, and restore the elided headers before requests are
+// given to the Handler. This must be called before srv begins
+// serving.
+//
+// Header elision is experimental, and is only used by clients
+// whose Transport has ElideRepeatedHeaders set.
+func EnableHeaderElision(srv *http.Server) {
+	servers.Lock()
+	servers.config(srv).elision = true
+	servers.Unlock()
+}
+
+// headerElisionEnabled indicates whether header
+// elision has been enabled for srv.
+func headerElisionEnabled(srv *http.Server) bool {
+	return servers.lookup(srv).elision
+}
+
+// headerElisionSetting returns the setting used to
+// advertise support for header elision.
+func headerElisionSetting() *Setting {
+	return &Setting{
+		ID:    SETTINGS_EXPERIMENTAL_HEADER_ELISION,
+		Value: 1,
+	}
+}
+
+// pseudoHeader indicates whether the named header
+// is part of the request line, rather than a normal
+// header. Pseudo-headers are never elided.
+func pseudoHeader(name string, version uint16) bool {
+	if version == 2 {
+		switch name {
+		case "Method", "Url", "Version", "Host", "Scheme":
+			return true
+		}
+		return false
+	}
+	return strings.HasPrefix(name, ":")
+}
+
+// elideHeaders removes from header any headers whose
+// values are identical in previous, listing their names
+// in the ELIDED_HEADER header.
+func elideHeaders(header, previous http.Header, version uint16) {
+	elided := make([]string, 0, len(header))
+	for name, values := range header {
+		if pseudoHeader(name, version) || name == ELIDED_HEADER {
+			continue
+		}
+		if sameValues(values, previous[name]) {
+			elided = append(elided, name)
+		}
+	}
+
+	if len(elided) == 0 {
+		return
+	}
+
+	sort.Strings(elided)
+	for _, name := range elided {
+		header.Del(name)
+	}
+	header.Set(ELIDED_HEADER, strings.Join(elided, ","))
+}
+
+// restoreHeaders replaces any headers listed in the
+// ELIDED_HEADER header with their values in previous.
+func restoreHeaders(header, previous http.Header) error {
+	list := header.Get(ELIDED_HEADER)
+	if list == "" {
+		return nil
+	}
+	header.Del(ELIDED_HEADER)
+
+	for _, name := range strings.Split(list, ",") {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		values, ok := previous[name]
+		if !ok {
+			return errors.New(fmt.Sprintf("Error: Elided header %q was not in the previous request.", name))
+		}
+		header[name] = append([]string(nil), values...)
+	}
+	return nil
+}
+
+func sameValues(a, b []string) bool {
+	if len(a) == 0 || len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
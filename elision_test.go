@@ -0,0 +1,180 @@
+package spdy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestElideHeaders(t *testing.T) {
+	previous := http.Header{
+		"Accept":        {"text/html"},
+		"Authorization": {"token"},
+		"Cookie":        {"a=1", "b=2"},
+		":path":         {"/"},
+		"Url":           {"/"},
+	}
+	tests := []struct {
+		name    string
+		version uint16
+		header  http.Header
+		elided  string
+	}{
+		{"repeated", 3, http.Header{"Accept": {"text/html"}, "Authorization": {"token"}}, "Accept,Authorization"},
+		{"changed", 3, http.Header{"Accept": {"text/plain"}, "Authorization": {"token"}}, "Authorization"},
+		{"reordered values", 3, http.Header{"Cookie": {"b=2", "a=1"}}, ""},
+		{"SPDY/3 request line", 3, http.Header{":path": {"/"}, "Url": {"/"}}, "Url"},
+		{"SPDY/2 request line", 2, http.Header{":path": {"/"}, "Url": {"/"}}, ":path"},
+		{"nothing repeated", 3, http.Header{"X-New": {"1"}}, ""},
+	}
+
+	for _, test := range tests {
+		full := cloneHeader(test.header)
+		elideHeaders(test.header, previous, test.version)
+		if got := test.header.Get(ELIDED_HEADER); got != test.elided {
+			t.Errorf("%s: elided %q, want %q", test.name, got, test.elided)
+			continue
+		}
+
+		// The elided headers can be restored exactly.
+		if err := restoreHeaders(test.header, previous); err != nil {
+			t.Errorf("%s: restoring gave %v", test.name, err)
+		} else if !reflect.DeepEqual(test.header, full) {
+			t.Errorf("%s: restored %v, want %v", test.name, test.header, full)
+		}
+	}
+
+	// A header can only be restored if it was sent before.
+	header := http.Header{ELIDED_HEADER: {"X-Unknown"}}
+	if err := restoreHeaders(header, previous); err == nil {
+		t.Error("restored a header which was not in the previous request")
+	}
+}
+
+// rawElisionServer acts as a server which advertises header
+// elision, and returns the headers of each request sent by
+// client, as they appear on the wire.
+func rawElisionServer(t *testing.T, client Conn, remote net.Conn, version uint16) func(path string) http.Header {
+	go func() {
+		remote.Write(rawSettings(version, SETTINGS_EXPERIMENTAL_HEADER_ELISION))
+		remote.Write([]byte{0x80, byte(version), 0, 6, 0, 0, 0, 4, 0, 0, 0, 2})
+	}()
+	within(t, 5*time.Second, "the PING reply", func() {
+		for {
+			frame, err := readRawFrame(remote, version)
+			if err != nil {
+				t.Errorf("reading the PING reply: %v", err)
+				return
+			}
+			switch frame.(type) {
+			case *pingFrameV3, *pingFrameV2:
+				return
+			}
+		}
+	})
+
+	d := NewDecompressor(version)
+	c := newRawCompressor(version)
+	return func(path string) http.Header {
+		t.Helper()
+		done := make(chan error, 1)
+		go func() {
+			req, _ := http.NewRequest("GET", "https://example.com"+path, nil)
+			req.Header.Set("Authorization", "token")
+			_, err := request(client, req)
+			done <- err
+		}()
+
+		var header http.Header
+		within(t, 5*time.Second, "the request", func() {
+			for header == nil {
+				frame, err := readRawFrame(remote, version)
+				if err != nil {
+					t.Errorf("reading the request: %v", err)
+					return
+				}
+				var sid StreamID
+				switch frame := frame.(type) {
+				case *synStreamFrameV3:
+					err, sid, header = frame.Decompress(d), frame.StreamID, frame.Header
+				case *synStreamFrameV2:
+					err, sid, header = frame.Decompress(d), frame.StreamID, frame.Header
+				default:
+					continue
+				}
+				if err != nil {
+					t.Errorf("decompressing the request: %v", err)
+					return
+				}
+				remote.Write(rawSynReply(version, sid, c))
+			}
+			if err := <-done; err != nil {
+				t.Errorf("the request failed: %v", err)
+			}
+		})
+		return header
+	}
+}
+
+// Once the server has advertised support, a client with
+// header elision enabled sends headers repeated from its
+// previous request only by name. A new connection, such
+// as one replacing a connection which has closed, starts
+// afresh, so its first request is sent in full.
+func TestHeaderElisionSent(t *testing.T) {
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			enable := func(client Conn) { client.(headerElider).enableHeaderElision() }
+			for i := 0; i < 2; i++ {
+				client, remote := rawClientConnWith(t, version, enable)
+				send := rawElisionServer(t, client, remote, version)
+
+				first := send("/first")
+				if first.Get("Authorization") != "token" || first.Get(ELIDED_HEADER) != "" {
+					t.Fatalf("connection %d: first request sent with %v", i, first)
+				}
+				second := send("/second")
+				if second.Get("Authorization") != "" || second.Get(ELIDED_HEADER) != "Authorization" {
+					t.Fatalf("connection %d: second request sent with %v", i, second)
+				}
+			}
+		})
+	}
+}
+
+// A server with header elision enabled restores elided
+// headers, so that handlers see each request in full.
+func TestHeaderElisionRestored(t *testing.T) {
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			headers := make(chan http.Header, 3)
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				headers <- r.Header
+			})}
+			EnableHeaderElision(srv)
+			_, client := pipeConnsWith(t, srv, version, func(server, client Conn) {
+				client.(headerElider).enableHeaderElision()
+			})
+
+			for _, token := range []string{"a", "a", "b"} {
+				within(t, 5*time.Second, "the request", func() {
+					req, _ := http.NewRequest("GET", "https://example.com/", nil)
+					req.Header.Set("Authorization", token)
+					req.Header.Set("Accept", "text/html")
+					if _, err := request(client, req); err != nil {
+						t.Errorf("the request failed: %v", err)
+					}
+				})
+				header := <-headers
+				if header.Get("Authorization") != token || header.Get("Accept") != "text/html" || header.Get(ELIDED_HEADER) != "" {
+					t.Errorf("handler saw %v", header)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package spdy
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// A protocol error ends the connection as soon as the frames
+// explaining it have been sent, without the read loop first
+// stalling for FATAL_ERROR_FLUSH_TIMEOUT. No frame sent after
+// the error is processed.
+func TestProtocolErrorNoStall(t *testing.T) {
+	// unrequestedPings returns enough unrequested PINGs to
+	// use up the benign error budget.
+	unrequestedPings := func(version uint16) []byte {
+		var out []byte
+		for i := 0; i <= MaxBenignErrors; i++ {
+			out = append(out, 0x80, byte(version), 0, 6, 0, 0, 0, 4, 0, 0, 0, 2)
+		}
+		return out
+	}
+
+	tests := []struct {
+		name     string
+		versions []uint16
+		frames   func(version uint16) []byte
+	}{
+		{"too many benign errors", versions, unrequestedPings},
+		{"invalid window delta", []uint16{3}, func(version uint16) []byte {
+			return hexFrame("8003 0009 00 000008 00000001 00000000")
+		}},
+		{"unknown RST_STREAM status", versions, func(version uint16) []byte {
+			return []byte{0x80, byte(version), 0, 3, 0, 0, 0, 8, 0, 0, 0, 1, 0, 0, 0, 0xff}
+		}},
+	}
+
+	for _, test := range tests {
+		for _, version := range test.versions {
+			version, test := version, test
+			t.Run(fmt.Sprintf("SPDY/%d/%s", version, test.name), func(t *testing.T) {
+				// Stream 1 stays open until the test ends.
+				release := make(chan struct{})
+				t.Cleanup(func() { close(release) })
+				started := make(chan struct{})
+				srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					close(started)
+					<-release
+				})}
+				conn := rawServerConn(t, srv, version)
+				go conn.Write(rawSynStream(version, 1, newRawCompressor(version).block(rawRequest(version, "/")...)))
+				within(t, 5*time.Second, "the request", func() { <-started })
+
+				// The PING after the error must not be answered.
+				sent := make(chan time.Time, 1)
+				go func() {
+					conn.Write(test.frames(version))
+					sent <- time.Now()
+					conn.Write([]byte{0x80, byte(version), 0, 6, 0, 0, 0, 4, 0, 0, 0, 1})
+				}()
+
+				var ended bool
+				within(t, 5*time.Second, "the connection closing", func() {
+					for {
+						frame, err := readRawFrame(conn, version)
+						if err != nil {
+							return
+						}
+						switch frame := frame.(type) {
+						case *goawayFrameV3, *goawayFrameV2:
+							ended = true
+						case *rstStreamFrameV3:
+							ended = ended || frame.StreamID == 1 && frame.Status == RST_STREAM_PROTOCOL_ERROR
+						case *rstStreamFrameV2:
+							ended = ended || frame.StreamID == 1 && frame.Status == RST_STREAM_PROTOCOL_ERROR
+						case *pingFrameV3, *pingFrameV2:
+							t.Errorf("answered %v after the error", frame)
+						}
+					}
+				})
+				if !ended {
+					t.Error("no GOAWAY or RST_STREAM was sent")
+				}
+				if d := time.Since(<-sent); d >= FATAL_ERROR_FLUSH_TIMEOUT {
+					t.Errorf("the connection took %v to close, want under %v", d, FATAL_ERROR_FLUSH_TIMEOUT)
+				}
+			})
+		}
+	}
+}
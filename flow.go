@@ -1,17 +1,23 @@
 package spdy
 
 import (
-	"errors"
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 // flowControl is used by Streams to ensure that
 // they abide by SPDY's flow control rules. For
 // versions of SPDY before 3, this has no effect.
 type flowControl struct {
+	sync.Mutex
+	sending             sync.Mutex // held while DATA frames are sent, so that they are sent in order.
 	stream              Stream
 	streamID            StreamID
 	output              chan<- Frame
+	queue               func(Frame) error // queues control frames ahead of stream frames, if non-nil.
+	stop                <-chan struct{}
 	initialWindow       uint32
 	transferWindow      int64
 	sent                uint32
@@ -19,8 +25,40 @@ type flowControl struct {
 	constrained         bool
 	initialWindowThere  uint32
 	transferWindowThere int64
+	updateThreshold     uint32
+	consumed            int64          // data consumed since the receive window was last regrown.
+	finThere            bool           // the other endpoint has finished sending.
+	session             *sessionWindow // connection-wide window, if any.
+	fin                 bool           // send a FIN once the buffer is empty.
+	drained             *sync.Cond     // signalled when buffered data is sent, or the windows grow.
+	flushers            int            // goroutines waiting to send buffered data.
+	interactive         bool           // data is sent in small TLS records.
+	deadline            *writeDeadline // writes waiting for the windows fail once this passes.
+	stopping            bool           // writes waiting for the windows fail, as the stream is closing.
+	ledger              *flowLedger    // shadow accounts, if auditing.
 }
 
+// windowUpdater is implemented by connections which
+// regrow their streams' receive windows, allowing the
+// point at which WINDOW_UPDATE frames are sent to be
+// tuned. SPDY/2 has no flow control, so does not
+// implement windowUpdater.
+type windowUpdater interface {
+	setWindowUpdateThreshold(uint32)
+	windowUpdateThreshold() uint32
+}
+
+// flowControlled is implemented by streams whose
+// transfer window must follow changes to the
+// INITIAL_WINDOW_SIZE setting.
+type flowControlled interface {
+	flowControl() *flowControl
+}
+
+func (s *serverStreamV3) flowControl() *flowControl { return s.flow }
+func (p *pushStreamV3) flowControl() *flowControl   { return p.flow }
+func (r *clientStreamV3) flowControl() *flowControl { return r.flow }
+
 // AddFlowControl initialises flow control for
 // the Stream. If the Stream is running at an
 // older SPDY version than SPDY/3, the flow
@@ -32,6 +70,7 @@ func (s *serverStreamV3) AddFlowControl() {
 	}
 
 	s.flow = new(flowControl)
+	s.flow.drained = sync.NewCond(s.flow)
 	initialWindow, err := s.conn.InitialWindowSize()
 	if err != nil {
 		log.Println(err)
@@ -39,12 +78,25 @@ func (s *serverStreamV3) AddFlowControl() {
 	}
 	s.flow.streamID = s.streamID
 	s.flow.output = s.output
+	s.flow.stop = s.stop
 	s.flow.buffer = make([][]byte, 0, 10)
 	s.flow.initialWindow = initialWindow
 	s.flow.transferWindow = int64(initialWindow)
 	s.flow.stream = s
-	s.flow.initialWindowThere = DEFAULT_INITIAL_CLIENT_WINDOW_SIZE
-	s.flow.transferWindowThere = DEFAULT_INITIAL_CLIENT_WINDOW_SIZE
+	s.flow.deadline = &s.deadline
+	s.deadline.notify(s.flow.expire)
+	s.flow.initialWindowThere = DEFAULT_INITIAL_WINDOW_SIZE // as advertised in the server's SETTINGS.
+	s.flow.transferWindowThere = DEFAULT_INITIAL_WINDOW_SIZE
+	if u, ok := s.conn.(windowUpdater); ok {
+		s.flow.updateThreshold = u.windowUpdateThreshold()
+	}
+	if c, ok := s.conn.(*connV3); ok {
+		s.flow.queue = c.queue
+		s.flow.session = c.session
+	}
+	if auditFlowControl {
+		s.flow.ledger = newFlowLedger(s.flow)
+	}
 }
 
 // AddFlowControl initialises flow control for
@@ -58,6 +110,7 @@ func (p *pushStreamV3) AddFlowControl() {
 	}
 
 	p.flow = new(flowControl)
+	p.flow.drained = sync.NewCond(p.flow)
 	initialWindow, err := p.conn.InitialWindowSize()
 	if err != nil {
 		log.Println(err)
@@ -65,12 +118,25 @@ func (p *pushStreamV3) AddFlowControl() {
 	}
 	p.flow.streamID = p.streamID
 	p.flow.output = p.output
+	p.flow.stop = p.stop
 	p.flow.buffer = make([][]byte, 0, 10)
 	p.flow.initialWindow = initialWindow
 	p.flow.transferWindow = int64(initialWindow)
 	p.flow.stream = p
-	p.flow.initialWindowThere = DEFAULT_INITIAL_CLIENT_WINDOW_SIZE
-	p.flow.transferWindowThere = DEFAULT_INITIAL_CLIENT_WINDOW_SIZE
+	p.flow.deadline = &p.deadline
+	p.deadline.notify(p.flow.expire)
+	p.flow.initialWindowThere = DEFAULT_INITIAL_WINDOW_SIZE // as advertised in the server's SETTINGS.
+	p.flow.transferWindowThere = DEFAULT_INITIAL_WINDOW_SIZE
+	if u, ok := p.conn.(windowUpdater); ok {
+		p.flow.updateThreshold = u.windowUpdateThreshold()
+	}
+	if c, ok := p.conn.(*connV3); ok {
+		p.flow.queue = c.queue
+		p.flow.session = c.session
+	}
+	if auditFlowControl {
+		p.flow.ledger = newFlowLedger(p.flow)
+	}
 }
 
 // AddFlowControl initialises flow control for
@@ -84,6 +150,7 @@ func (r *clientStreamV3) AddFlowControl() {
 	}
 
 	r.flow = new(flowControl)
+	r.flow.drained = sync.NewCond(r.flow)
 	initialWindow, err := r.conn.InitialWindowSize()
 	if err != nil {
 		log.Println(err)
@@ -91,12 +158,28 @@ func (r *clientStreamV3) AddFlowControl() {
 	}
 	r.flow.streamID = r.streamID
 	r.flow.output = r.output
+	r.flow.stop = r.stop
 	r.flow.buffer = make([][]byte, 0, 10)
 	r.flow.initialWindow = initialWindow
 	r.flow.transferWindow = int64(initialWindow)
 	r.flow.stream = r
+	r.flow.deadline = &r.deadline
+	r.deadline.notify(r.flow.expire)
 	r.flow.initialWindowThere = DEFAULT_INITIAL_CLIENT_WINDOW_SIZE
-	r.flow.transferWindowThere = DEFAULT_INITIAL_CLIENT_WINDOW_SIZE
+	if c, ok := r.conn.(*connV3); ok {
+		r.flow.initialWindowThere = atomic.LoadUint32(&c.receiveWindowSize) // as advertised in the client's SETTINGS.
+	}
+	r.flow.transferWindowThere = int64(r.flow.initialWindowThere)
+	if u, ok := r.conn.(windowUpdater); ok {
+		r.flow.updateThreshold = u.windowUpdateThreshold()
+	}
+	if c, ok := r.conn.(*connV3); ok {
+		r.flow.queue = c.queue
+		r.flow.session = c.session
+	}
+	if auditFlowControl {
+		r.flow.ledger = newFlowLedger(r.flow)
+	}
 }
 
 // CheckInitialWindow is used to handle the race
@@ -105,8 +188,15 @@ func (r *clientStreamV3) AddFlowControl() {
 // the initial tranfer window sent by the client.
 //
 // The transfer window is updated retroactively,
-// if necessary.
+// if necessary, by the difference between the old
+// and new initial windows. This may leave the window
+// at zero or below, in which case writes wait for a
+// WINDOW_UPDATE.
 func (f *flowControl) CheckInitialWindow() {
+	if f.stream == nil {
+		return
+	}
+
 	newWindow, err := f.stream.Conn().InitialWindowSize()
 	if err != nil {
 		log.Println(err)
@@ -114,11 +204,8 @@ func (f *flowControl) CheckInitialWindow() {
 	}
 
 	if f.initialWindow != newWindow {
-		if f.initialWindow > newWindow {
-			f.transferWindow = int64(newWindow - f.sent)
-		} else if f.initialWindow < newWindow {
-			f.transferWindow += int64(newWindow - f.initialWindow)
-		}
+		f.ledger.resize(int64(newWindow) - int64(f.initialWindow))
+		f.transferWindow += int64(newWindow) - int64(f.initialWindow)
 		if f.transferWindow <= 0 {
 			f.constrained = true
 		}
@@ -128,8 +215,12 @@ func (f *flowControl) CheckInitialWindow() {
 
 // Close nils any references held by the flowControl.
 func (f *flowControl) Close() {
+	f.Lock()
+	defer f.Unlock()
 	f.buffer = nil
 	f.stream = nil
+	f.ledger = nil
+	f.drained.Broadcast()
 }
 
 // Flush is used to send buffered data to
@@ -138,41 +229,233 @@ func (f *flowControl) Close() {
 // that any or all buffered data will be
 // sent with a single flush.
 func (f *flowControl) Flush() {
+	f.sending.Lock()
+	defer f.sending.Unlock()
+
+	f.Lock()
+	out, fin := f.flush()
+	f.ledger.check(f, "Flush")
+	f.Unlock()
+
+	f.send(out, fin)
+}
+
+// flush takes the buffered data which the transfer windows
+// allow to be sent, and reports whether the FIN requested
+// with Finish should be sent after it. flush must be called
+// with the flowControl's lock held, and the data must then
+// be given to send, after the lock has been released, with
+// the sending lock held throughout.
+func (f *flowControl) flush() (out []byte, fin bool) {
 	f.CheckInitialWindow()
-	if !f.constrained || f.transferWindow == 0 {
-		return
+	if !f.constrained || f.transferWindow <= 0 {
+		return nil, false
+	}
+
+	// The window may have shrunk with nothing buffered.
+	if len(f.buffer) == 0 {
+		f.constrained = false
+		f.drained.Broadcast()
+		return nil, f.finish()
 	}
 
-	out := make([]byte, 0, f.transferWindow)
-	left := f.transferWindow
-	for i := 0; i < len(f.buffer); i++ {
-		if l := int64(len(f.buffer[i])); l <= left {
-			out = append(out, f.buffer[i]...)
+	buffered := int64(0)
+	for _, data := range f.buffer {
+		buffered += int64(len(data))
+	}
+	if buffered > f.transferWindow {
+		buffered = f.transferWindow
+	}
+
+	// Data must also fit the session window.
+	buffered = f.session.take(buffered)
+	if buffered == 0 {
+		return nil, false
+	}
+
+	out = make([]byte, 0, buffered)
+	left := buffered
+	for len(f.buffer) > 0 && left > 0 {
+		if l := int64(len(f.buffer[0])); l <= left {
+			out = append(out, f.buffer[0]...)
 			left -= l
 			f.buffer = f.buffer[1:]
 		} else {
-			out = append(out, f.buffer[i][:left]...)
-			f.buffer[i] = f.buffer[i][left:]
+			out = append(out, f.buffer[0][:left]...)
+			f.buffer[0] = f.buffer[0][left:]
 			left = 0
 		}
-
-		if left == 0 {
-			break
-		}
 	}
 
 	f.transferWindow -= int64(len(out))
+	f.sent += uint32(len(out))
+	f.ledger.debit(int64(len(out)))
 
-	if f.transferWindow > 0 {
+	if len(f.buffer) == 0 {
 		f.constrained = false
-		fmt.Printf("Stream %d is no longer constrained.\n", f.streamID)
+		f.drained.Broadcast()
+		debug.Printf("Stream %d is no longer constrained.\n", f.streamID)
 	}
 
-	dataFrame := new(dataFrameV3)
-	dataFrame.StreamID = f.streamID
-	dataFrame.Data = out
+	return out, f.finish()
+}
+
+// send sends data taken by flush, in frames of at most
+// MaxDataFrameSize, followed by an empty DATA frame with
+// FLAG_FIN if fin is set. send must be called with the
+// sending lock held, but not the flowControl's lock, as
+// it waits for the send loop. send reports false if the
+// stream has stopped.
+func (f *flowControl) send(out []byte, fin bool) bool {
+	size := dataFrameSize()
+	for len(out) > 0 {
+		n := len(out)
+		if n > size {
+			n = size
+		}
+
+		dataFrame := newDataFrameV3()
+		dataFrame.StreamID = f.streamID
+		dataFrame.interactive = f.interactive
+		dataFrame.Data = out[:n]
+		if !sendFrame(f.output, f.stop, dataFrame) {
+			return false
+		}
+
+		out = out[n:]
+	}
+
+	if fin {
+		dataFrame := newDataFrameV3()
+		dataFrame.StreamID = f.streamID
+		dataFrame.interactive = f.interactive
+		dataFrame.Flags = FLAG_FIN
+		dataFrame.Data = []byte{}
+		return sendFrame(f.output, f.stop, dataFrame)
+	}
+
+	return true
+}
+
+// Finish closes the stream with an empty DATA frame
+// once any buffered data has been sent, or at once if
+// nothing is buffered.
+func (f *flowControl) Finish() {
+	f.sending.Lock()
+	defer f.sending.Unlock()
+
+	f.Lock()
+	f.fin = true
+	out, fin := f.flush()
+	if !fin {
+		fin = f.finish()
+	}
+	f.Unlock()
+
+	f.send(out, fin)
+}
+
+// finish reports whether the FIN requested with Finish
+// should be sent now, which is once the buffer is empty,
+// and if so, clears the request. finish must be called
+// with the flowControl's lock held.
+func (f *flowControl) finish() bool {
+	if !f.fin || f.constrained {
+		return false
+	}
+
+	f.fin = false
+	return true
+}
+
+// drain sends the buffered data as the windows allow,
+// waiting for them to grow as necessary, until nothing
+// is buffered, or the stream has closed. drain must be
+// called with the sending lock and the flowControl's
+// lock held, and returns errConnClosed if the stream
+// stopped while data was being sent, or the write
+// deadline's error if it passed first. If writing is
+// set, drain is making room for a Write, which fails
+// with ErrStreamClosed once Stop has been called.
+func (f *flowControl) drain(writing bool) error {
+	f.flushers++
+	defer func() { f.flushers-- }()
+
+	for f.constrained && f.stream != nil {
+		if writing && f.stopping {
+			return ErrStreamClosed
+		}
+		if f.deadline != nil {
+			if err := f.deadline.err(); err != nil {
+				return err
+			}
+		}
 
-	f.output <- dataFrame
+		out, fin := f.flush()
+		if len(out) == 0 && !fin {
+			// flush may have found nothing buffered.
+			if f.constrained {
+				f.drained.Wait()
+			}
+			continue
+		}
+
+		f.Unlock()
+		ok := f.send(out, fin)
+		f.Lock()
+		if !ok {
+			return errConnClosed
+		}
+	}
+
+	return nil
+}
+
+// Stop is called as the stream is closed, so that writes
+// waiting for the windows to grow fail, and stop holding
+// the sending lock. Data already buffered is still sent.
+func (f *flowControl) Stop() {
+	f.Lock()
+	f.stopping = true
+	f.drained.Broadcast()
+	f.Unlock()
+}
+
+// expire wakes any writers waiting for the windows
+// to grow, once the write deadline has passed.
+func (f *flowControl) expire() {
+	f.Lock()
+	f.drained.Broadcast()
+	f.Unlock()
+}
+
+// wake is called when the transfer windows may have grown.
+// A goroutine waiting to send buffered data is woken, or if
+// there is none, the data is sent from a new goroutine, as
+// the caller may be the read loop, which must not wait for
+// the send loop. wake must be called with the flowControl's
+// lock held.
+func (f *flowControl) wake() {
+	f.CheckInitialWindow()
+	if !f.constrained || f.transferWindow <= 0 {
+		return
+	}
+
+	if f.flushers > 0 {
+		f.drained.Broadcast()
+	} else {
+		go f.Flush()
+	}
+}
+
+// Resume is called when the session window, or the
+// INITIAL_WINDOW_SIZE setting, has changed, and sends
+// any buffered data which the windows now allow. Resume
+// does not wait for the data to be sent.
+func (f *flowControl) Resume() {
+	f.Lock()
+	defer f.Unlock()
+	f.wake()
 }
 
 // Paused indicates whether there is data buffered.
@@ -180,66 +463,208 @@ func (f *flowControl) Flush() {
 // last data has been sent and then Paused returns
 // false.
 func (f *flowControl) Paused() bool {
+	f.Lock()
+	defer f.Unlock()
 	f.CheckInitialWindow()
 	return f.constrained
 }
 
-// Receive is called when data is received from
-// the other endpoint. This ensures that they
-// conform to the transfer window, regrows the
-// window, and sends errors if necessary.
-func (f *flowControl) Receive(data []byte) {
-	// The transfer window shouldn't already be negative.
+// Wait blocks until any buffered data has been
+// sent, the stream has been closed, or the write
+// deadline has passed.
+func (f *flowControl) Wait() {
+	f.sending.Lock()
+	defer f.sending.Unlock()
+
+	f.Lock()
+	defer f.Unlock()
+	f.drain(false)
+}
+
+// Receive is called when data has been received from
+// the other endpoint. This ensures that it conforms to
+// the transfer window, and sends errors if necessary.
+// The window is regrown once the data has been consumed,
+// as reported to Consumed. fin indicates that no more
+// data will be received, so the window need not be
+// regrown.
+func (f *flowControl) Receive(data []byte, fin bool) {
+	f.Lock()
+	defer f.Unlock()
+	defer f.ledger.check(f, "Receive")
+
+	// Update the window, which must not go negative.
+	f.ledger.receive(int64(len(data)))
+	f.transferWindowThere -= int64(len(data))
+	if fin {
+		f.finThere = true
+	}
 	if f.transferWindowThere < 0 {
 		rst := new(rstStreamFrameV3)
 		rst.StreamID = f.streamID
 		rst.Status = RST_STREAM_FLOW_CONTROL_ERROR
-		f.output <- rst
+		f.sendControl(rst)
+	}
+}
+
+// Consumed is called when n bytes of received data have
+// been read by the application, or discarded, and regrows
+// the stream and session windows once enough has been
+// consumed. The other endpoint can therefore send no more
+// than the application has room for.
+func (f *flowControl) Consumed(n int) {
+	if n <= 0 {
 		return
 	}
 
-	// Update the window.
-	f.transferWindowThere -= int64(len(data))
+	f.Lock()
+	defer f.Unlock()
+	defer f.ledger.check(f, "Consumed")
+
+	if update := f.session.consume(n); update > 0 {
+		grow := new(windowUpdateFrameV3)
+		grow.DeltaWindowSize = update
+		f.sendControl(grow)
+		debug.Printf("Flow: Regrowing session receive window by %d bytes.\n", update)
+	}
+
+	// Closed streams receive no more data.
+	if f.finThere || f.stream == nil {
+		return
+	}
+
+	// Regrow the window once enough has been consumed,
+	// which defaults to half the window.
+	threshold := int64(f.updateThreshold)
+	if threshold <= 0 || threshold > int64(f.initialWindowThere) {
+		threshold = int64(f.initialWindowThere / 2)
+	}
 
-	// Regrow the window if it's half-empty.
-	if f.transferWindowThere <= int64(f.initialWindowThere/2) {
+	f.consumed += int64(n)
+	if f.consumed >= threshold {
 		grow := new(windowUpdateFrameV3)
 		grow.StreamID = f.streamID
-		grow.DeltaWindowSize = uint32(int64(f.initialWindowThere) - f.transferWindowThere)
-		f.output <- grow
+		grow.DeltaWindowSize = uint32(f.consumed)
+		f.sendControl(grow)
+		f.ledger.regrow(f.consumed)
+		f.transferWindowThere += f.consumed
+		debug.Printf("Flow: Regrowing receive window in stream %d by %d bytes.\n", f.streamID, f.consumed)
+		f.consumed = 0
 	}
 }
 
+// sendControl sends a control frame generated by flow
+// control, such as a WINDOW_UPDATE, ahead of any data
+// waiting to be sent. The frame is queued without waiting
+// for the send loop, so sendControl may be called from the
+// read loop.
+func (f *flowControl) sendControl(frame Frame) {
+	if f.queue != nil {
+		f.queue(frame)
+	} else {
+		sendFrame(f.output, f.stop, frame)
+	}
+}
+
+// windows returns the stream's transfer window, and
+// the receive window of the other endpoint.
+func (f *flowControl) windows() (send, receive int64) {
+	f.Lock()
+	defer f.Unlock()
+	return f.transferWindow, f.transferWindowThere
+}
+
 // UpdateWindow is called when an UPDATE_WINDOW frame is received,
-// and performs the growing of the transfer window.
+// and performs the growing of the transfer window. An update which
+// would take the window beyond 2^31 - 1 gives a FLOW_CONTROL_ERROR,
+// for which the connection resets and ends the stream.
 func (f *flowControl) UpdateWindow(deltaWindowSize uint32) error {
-	if int64(deltaWindowSize)+f.transferWindow > MAX_TRANSFER_WINDOW_SIZE {
-		return errors.New("Error: WINDOW_UPDATE delta window size overflows transfer window size.")
+	f.Lock()
+	defer f.Unlock()
+	defer f.ledger.check(f, "UpdateWindow")
+
+	// The window may not exceed 2^31 - 1.
+	if int64(deltaWindowSize)+f.transferWindow > MAX_DELTA_WINDOW_SIZE {
+		return &ProtocolError{
+			StreamID: f.streamID,
+			Err:      ErrFlowControl,
+			Msg:      "Error: WINDOW_UPDATE delta window size overflows transfer window size.",
+		}
 	}
 
-	// Grow window and flush queue.
+	// Grow window and send any buffered data.
 	debug.Printf("Flow: Growing window in stream %d by %d bytes.\n", f.streamID, deltaWindowSize)
+	f.ledger.credit(int64(deltaWindowSize))
 	f.transferWindow += int64(deltaWindowSize)
 
-	f.Flush()
+	f.wake()
 	return nil
 }
 
+// WriteFinal sends data in a single DATA frame which
+// closes the stream, if the transfer window allows.
+// WriteFinal reports whether the data was sent.
+func (f *flowControl) WriteFinal(data []byte) bool {
+	f.sending.Lock()
+	defer f.sending.Unlock()
+
+	f.Lock()
+	f.CheckInitialWindow()
+	if f.constrained || len(data) > dataFrameSize() || int64(len(data)) > f.transferWindow {
+		f.Unlock()
+		return false
+	}
+	if !f.session.reserve(int64(len(data))) {
+		f.Unlock()
+		return false
+	}
+
+	f.ledger.write(int64(len(data)))
+	f.ledger.debit(int64(len(data)))
+	f.sent += uint32(len(data))
+	f.transferWindow -= int64(len(data))
+	f.ledger.check(f, "WriteFinal")
+	f.Unlock()
+
+	dataFrame := newDataFrameV3()
+	dataFrame.StreamID = f.streamID
+	dataFrame.interactive = f.interactive
+	dataFrame.Flags = FLAG_FIN
+	dataFrame.Data = data
+
+	return sendFrame(f.output, f.stop, dataFrame)
+}
+
 // Write is used to send data to the connection. This
-// takes care of the windowing. Although data may be
-// buffered, rather than actually sent, this is not
-// visible to the caller.
+// takes care of the windowing. Data which does not fit
+// the stream's transfer window, or the session window,
+// is buffered, and later writes wait until it has been
+// sent, so writers are held to the smaller window.
 func (f *flowControl) Write(data []byte) (int, error) {
 	l := len(data)
 	if l == 0 {
 		return 0, nil
 	}
 
-	// Transfer window processing.
+	f.sending.Lock()
+	defer f.sending.Unlock()
+
+	f.Lock()
+
+	// Data must not overtake data which is still
+	// buffered, so the writer first sends that, as
+	// the stream and session windows allow.
 	f.CheckInitialWindow()
+	if err := f.drain(true); err != nil {
+		f.Unlock()
+		return 0, err
+	}
 	if f.constrained {
-		f.Flush()
+		f.Unlock()
+		return 0, ErrStreamClosed
 	}
+	f.ledger.write(int64(l))
+
 	var window uint32
 	if f.transferWindow < 0 {
 		window = 0
@@ -247,23 +672,178 @@ func (f *flowControl) Write(data []byte) (int, error) {
 		window = uint32(f.transferWindow)
 	}
 
+	// Data must also fit the session window.
+	if uint32(len(data)) < window {
+		window = uint32(len(data))
+	}
+	window = uint32(f.session.take(int64(window)))
+
 	if uint32(len(data)) > window {
-		f.buffer = append(f.buffer, data[window:])
+		// The caller may reuse data once Write returns.
+		f.buffer = append(f.buffer, append([]byte(nil), data[window:]...))
 		data = data[:window]
+		f.ledger.debit(int64(window))
 		f.sent += window
 		f.transferWindow -= int64(window)
 		f.constrained = true
-		fmt.Printf("Stream %d is now constrained.\n", f.streamID)
+		debug.Printf("Stream %d is now constrained.\n", f.streamID)
+	} else {
+		f.ledger.debit(int64(len(data)))
+		f.sent += uint32(len(data))
+		f.transferWindow -= int64(len(data))
 	}
+	f.ledger.check(f, "Write")
+	f.Unlock()
 
 	if len(data) == 0 {
 		return l, nil
 	}
 
-	dataFrame := new(dataFrameV3)
+	dataFrame := newDataFrameV3()
 	dataFrame.StreamID = f.streamID
+	dataFrame.interactive = f.interactive
 	dataFrame.Data = data
 
-	f.output <- dataFrame
+	if !sendFrame(f.output, f.stop, dataFrame) {
+		return 0, errConnClosed
+	}
 	return l, nil
 }
+
+// auditFlowControl indicates whether new streams
+// audit their flow control. See SetFlowControlAudit.
+var auditFlowControl = false
+
+// SetFlowControlAudit enables or disables auditing of the
+// SPDY/3 flow control of streams created afterwards. Each
+// audited stream keeps a ledger of every change made to its
+// transfer windows, and checks the windows against it after
+// each operation, panicking with the ledger if they differ.
+// This is intended for tests and debugging, as it adds work
+// to every DATA frame.
+func SetFlowControlAudit(enabled bool) {
+	auditFlowControl = enabled
+}
+
+// flowLedgerEntries is the number of recent
+// ledger entries kept for the audit report.
+const flowLedgerEntries = 32
+
+// flowLedger is a shadow record of a stream's flow control,
+// kept independently of the windows themselves. The methods
+// of a nil *flowLedger do nothing, so that auditing costs
+// little when disabled.
+type flowLedger struct {
+	streamID     StreamID
+	initial      int64    // initial transfer window.
+	resized      int64    // net change from INITIAL_WINDOW_SIZE settings.
+	credited     int64    // total of the WINDOW_UPDATEs received.
+	written      int64    // data written to the stream.
+	debited      int64    // data sent.
+	initialThere int64    // initial receive window.
+	received     int64    // data received.
+	regrown      int64    // total of the WINDOW_UPDATEs sent.
+	entries      []string // recent entries, oldest first.
+}
+
+func newFlowLedger(f *flowControl) *flowLedger {
+	l := new(flowLedger)
+	l.streamID = f.streamID
+	l.initial = f.transferWindow
+	l.initialThere = f.transferWindowThere
+	l.record("opened with transfer window %d and receive window %d", l.initial, l.initialThere)
+	return l
+}
+
+func (l *flowLedger) record(format string, v ...interface{}) {
+	if len(l.entries) == flowLedgerEntries {
+		copy(l.entries, l.entries[1:])
+		l.entries = l.entries[:flowLedgerEntries-1]
+	}
+	l.entries = append(l.entries, fmt.Sprintf(format, v...))
+}
+
+func (l *flowLedger) resize(delta int64) {
+	if l != nil {
+		l.resized += delta
+		l.record("initial window changed by %d", delta)
+	}
+}
+
+func (l *flowLedger) credit(n int64) {
+	if l != nil {
+		l.credited += n
+		l.record("credited %d by WINDOW_UPDATE", n)
+	}
+}
+
+func (l *flowLedger) write(n int64) {
+	if l != nil {
+		l.written += n
+		l.record("wrote %d", n)
+	}
+}
+
+func (l *flowLedger) debit(n int64) {
+	if l != nil {
+		l.debited += n
+		l.record("sent %d", n)
+	}
+}
+
+func (l *flowLedger) receive(n int64) {
+	if l != nil {
+		l.received += n
+		l.record("received %d", n)
+	}
+}
+
+func (l *flowLedger) regrow(n int64) {
+	if l != nil {
+		l.regrown += n
+		l.record("regrew receive window by %d", n)
+	}
+}
+
+// check compares the flowControl's state with the
+// ledger, after the named operation, and panics
+// with a description of any differences. check
+// must be called with the flowControl's lock held.
+func (l *flowLedger) check(f *flowControl, op string) {
+	if l == nil || f.ledger != l {
+		return
+	}
+
+	var problems []string
+	if want := l.initial + l.resized + l.credited - l.debited; f.transferWindow != want {
+		problems = append(problems, fmt.Sprintf("transfer window is %d, ledger gives %d", f.transferWindow, want))
+	}
+	if want := uint32(l.debited); f.sent != want {
+		problems = append(problems, fmt.Sprintf("%d bytes counted as sent, ledger gives %d", f.sent, want))
+	}
+	if f.transferWindow > MAX_DELTA_WINDOW_SIZE {
+		problems = append(problems, fmt.Sprintf("transfer window %d exceeds the maximum", f.transferWindow))
+	}
+
+	buffered := int64(0)
+	for _, data := range f.buffer {
+		buffered += int64(len(data))
+	}
+	if want := l.written - l.debited; buffered != want {
+		problems = append(problems, fmt.Sprintf("%d bytes buffered, ledger gives %d", buffered, want))
+	}
+	if buffered > 0 && !f.constrained {
+		problems = append(problems, fmt.Sprintf("%d bytes buffered, but stream is not constrained", buffered))
+	}
+
+	if want := l.initialThere - l.received + l.regrown; f.transferWindowThere != want {
+		problems = append(problems, fmt.Sprintf("receive window is %d, ledger gives %d", f.transferWindowThere, want))
+	}
+
+	if len(problems) == 0 {
+		return
+	}
+
+	panic(fmt.Sprintf("spdy: flow control audit of stream %d failed after %s:\n\t%s\nLedger:\n\t%s",
+		l.streamID, op, strings.Join(problems, "\n\t"), strings.Join(l.entries, "\n\t")))
+}
@@ -0,0 +1,111 @@
+package spdy
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// flowControlReset waits for the RST_STREAM resetting
+// stream 1 with FLOW_CONTROL_ERROR.
+func flowControlReset(t *testing.T, remote *rawPeer) {
+	t.Helper()
+	remote.await(t, "the RST_STREAM", func(frame Frame) bool {
+		rst, ok := frame.(*rstStreamFrameV3)
+		if ok && (rst.StreamID != 1 || rst.Status != RST_STREAM_FLOW_CONTROL_ERROR) {
+			t.Fatalf("got %v, want FLOW_CONTROL_ERROR for stream 1", rst)
+		}
+		return ok
+	})
+}
+
+// noMoreFrames checks that no frames are sent on stream
+// 1 for a short while.
+func noMoreFrames(t *testing.T, remote *rawPeer) {
+	t.Helper()
+	quiet := time.After(200 * time.Millisecond)
+	for {
+		select {
+		case frame, ok := <-remote.frames:
+			if !ok {
+				return
+			}
+			if sid, ok := rawStreamID(frame, 3); ok && sid == 1 {
+				t.Fatalf("sent %s on stream 1 after the RST_STREAM", frameName(frame))
+			}
+		case <-quiet:
+			return
+		}
+	}
+}
+
+// A WINDOW_UPDATE which grows a response's window beyond
+// 2^31 - 1 resets the stream with FLOW_CONTROL_ERROR, and
+// ends it, so that the handler's writes fail, rather than
+// sending DATA after the RST_STREAM.
+func TestWindowOverflowResponse(t *testing.T) {
+	release := make(chan struct{})
+	errs := make(chan error, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		<-release
+		buf := bytes.Repeat([]byte("d"), 4096)
+		for {
+			if _, err := w.Write(buf); err != nil {
+				errs <- err
+				return
+			}
+		}
+	})}
+	remote := newRawPeer(rawServerConn(t, srv, 3), 3)
+
+	remote.write(rawSynStream(3, 1, newRawCompressor(3).block(rawRequest(3, "/")...)))
+	remote.await(t, "the first DATA", func(frame Frame) bool {
+		_, ok := frame.(*dataFrameV3)
+		return ok
+	})
+
+	remote.write(rawWindowUpdate(1, MAX_DELTA_WINDOW_SIZE))
+	flowControlReset(t, remote)
+	close(release)
+	noMoreFrames(t, remote)
+
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler's writes did not fail")
+	}
+}
+
+// The same is true of a request's upload.
+func TestWindowOverflowUpload(t *testing.T) {
+	client, conn := rawClientConn(t, 3)
+	remote := newRawPeer(conn, 3)
+
+	req, _ := http.NewRequest("POST", "https://example.com/upload", nil)
+	stream, err := client.Request(req, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go stream.Run()
+	defer stream.Close()
+
+	if _, err := stream.Write([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	remote.await(t, "the first DATA", func(frame Frame) bool {
+		_, ok := frame.(*dataFrameV3)
+		return ok
+	})
+
+	remote.write(rawWindowUpdate(1, MAX_DELTA_WINDOW_SIZE))
+	flowControlReset(t, remote)
+	within(t, 5*time.Second, "the write", func() {
+		if _, err := stream.Write(bytes.Repeat([]byte("u"), 100000)); err == nil {
+			t.Error("wrote to the stream after it was reset")
+		}
+	})
+	noMoreFrames(t, remote)
+}
@@ -0,0 +1,57 @@
+package spdy
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// The whole suite runs with flow control audited, so that
+// any accounting error panics in the test which causes it.
+func TestMain(m *testing.M) {
+	SetFlowControlAudit(true)
+	os.Exit(m.Run())
+}
+
+func TestFlowLedger(t *testing.T) {
+	f := &flowControl{streamID: 1, transferWindow: 100, transferWindowThere: 200}
+	f.ledger = newFlowLedger(f)
+
+	// check panics with the description of any
+	// difference, or returns the empty string.
+	check := func() (msg string) {
+		defer func() {
+			if r := recover(); r != nil {
+				msg, _ = r.(string)
+			}
+		}()
+		f.ledger.check(f, "test")
+		return ""
+	}
+
+	if msg := check(); msg != "" {
+		t.Fatalf("a fresh ledger failed:\n%s", msg)
+	}
+
+	// Matching changes pass.
+	f.transferWindow -= 10
+	f.sent += 10
+	f.ledger.write(10)
+	f.ledger.debit(10)
+	f.transferWindowThere -= 20
+	f.ledger.receive(20)
+	if msg := check(); msg != "" {
+		t.Fatalf("matching changes failed:\n%s", msg)
+	}
+
+	// A double credit does not.
+	f.transferWindow += 30
+	f.ledger.credit(15)
+	msg := check()
+	if !strings.Contains(msg, "transfer window is 120, ledger gives 105") {
+		t.Errorf("a double credit gave %q", msg)
+	}
+	if !strings.Contains(msg, "credited 15 by WINDOW_UPDATE") {
+		t.Errorf("the report did not include the ledger: %q", msg)
+	}
+}
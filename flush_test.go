@@ -0,0 +1,78 @@
+package spdy
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Flush sends the reply and the data written so far at once,
+// so that a client sees each flushed write in its own DATA
+// frame, before the handler writes more. Flushing with
+// nothing written sends no empty DATA frame.
+func TestFlush(t *testing.T) {
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			proceed := make(chan struct{})
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				f := w.(http.Flusher)
+				f.Flush()
+				f.Flush()
+				<-proceed
+				w.Write([]byte("first"))
+				f.Flush()
+				f.Flush()
+				<-proceed
+				w.Write([]byte("second"))
+				f.Flush()
+			})}
+			conn := rawServerConn(t, srv, version)
+			go conn.Write(rawSynStream(version, 1, newRawCompressor(version).block(rawRequest(version, "/")...)))
+
+			// next returns the next SYN_REPLY or DATA frame,
+			// with any data it carries.
+			next := func() (string, []byte, bool) {
+				var kind string
+				var data []byte
+				var fin bool
+				within(t, 5*time.Second, "the next frame", func() {
+					for kind == "" {
+						frame, err := readRawFrame(conn, version)
+						if err != nil {
+							t.Errorf("reading the response: %v", err)
+							return
+						}
+						switch frame := frame.(type) {
+						case *synReplyFrameV3:
+							kind, fin = "SYN_REPLY", frame.Flags.FIN()
+						case *synReplyFrameV2:
+							kind, fin = "SYN_REPLY", frame.Flags.FIN()
+						case *dataFrameV3:
+							kind, data, fin = "DATA", frame.Data, frame.Flags.FIN()
+						case *dataFrameV2:
+							kind, data, fin = "DATA", frame.Data, frame.Flags.FIN()
+						}
+					}
+				})
+				return kind, data, fin
+			}
+
+			if kind, _, fin := next(); kind != "SYN_REPLY" || fin {
+				t.Fatalf("received %s (FIN %v) before writing, want a SYN_REPLY", kind, fin)
+			}
+			for _, want := range []string{"first", "second"} {
+				proceed <- struct{}{}
+				if kind, data, fin := next(); kind != "DATA" || string(data) != want || fin {
+					t.Fatalf("received %s %q (FIN %v), want DATA %q", kind, data, fin, want)
+				}
+			}
+
+			// The stream ends with an empty DATA frame.
+			if kind, data, fin := next(); kind != "DATA" || len(data) != 0 || !fin {
+				t.Fatalf("received %s %q (FIN %v), want an empty DATA frame with FIN", kind, data, fin)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package spdy_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/SlyMarbo/spdy"
+)
+
+// FuzzParseFrame checks that ParseFrame does not panic,
+// and that any frame it accepts marshals to bytes which
+// parse to the same frame. The corpus is seeded with
+// valid and invalid frames of both versions.
+func FuzzParseFrame(f *testing.F) {
+	for _, test := range goldenFrames {
+		f.Add(wire(test.wire), test.version == 3)
+	}
+	for _, test := range rejectedFrames {
+		f.Add(wire(test.wire), test.version == 3)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, v3 bool) {
+		version := uint16(2)
+		if v3 {
+			version = 3
+		}
+
+		frame, err := spdy.ParseFrame(data, version)
+		if err != nil {
+			return
+		}
+		_ = frame.String()
+
+		out, err := spdy.MarshalFrame(frame)
+		if err != nil {
+			t.Fatalf("parsed %x, but could not marshal it: %v", data, err)
+		}
+		again, err := spdy.ParseFrame(out, version)
+		if err != nil {
+			t.Fatalf("%x marshalled to %x, which does not parse: %v", data, out, err)
+		}
+		if out2, err := spdy.MarshalFrame(again); err != nil || !bytes.Equal(out, out2) {
+			t.Fatalf("%x marshalled to %x, then to %x, error %v", data, out, out2, err)
+		}
+
+		// Header blocks may be garbage, but must not
+		// cause a panic when decompressed.
+		again.Decompress(spdy.NewDecompressor(version))
+	})
+}
@@ -0,0 +1,136 @@
+package spdy
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// pushErrorCollector is a PushErrorReceiver which accepts
+// every push, and reports each push accepted and failed.
+type pushErrorCollector struct {
+	accepted chan string
+	failed   chan error
+}
+
+func (p *pushErrorCollector) ReceiveData(request *http.Request, data []byte, final bool) {}
+func (p *pushErrorCollector) ReceiveHeader(request *http.Request, header http.Header)    {}
+
+func (p *pushErrorCollector) ReceiveRequest(request *http.Request) bool {
+	p.accepted <- request.URL.Path
+	return true
+}
+
+func (p *pushErrorCollector) ReceivePushError(request *http.Request, err error) {
+	p.failed <- err
+}
+
+// A GOAWAY which leaves a request unprocessed fails the
+// request with ErrNotProcessed, resets the pushes it had
+// caused, telling the push Receiver with ErrDraining, and
+// resolves outstanding pings with ErrDraining. Later pings
+// fail at once.
+func TestGoawayResolvesPingsAndPushes(t *testing.T) {
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			collector := &pushErrorCollector{accepted: make(chan string, 1), failed: make(chan error, 1)}
+			client, remote := rawClientConnWith(t, version, func(client Conn) {
+				setPushReceiver(client, collector)
+			})
+
+			frames := make(chan Frame, 100)
+			go func() {
+				defer close(frames)
+				for {
+					frame, err := readRawFrame(remote, version)
+					if err != nil {
+						return
+					}
+					frames <- frame
+				}
+			}()
+			// await returns the first frame for which match is true.
+			await := func(what string, match func(Frame) bool) {
+				t.Helper()
+				for {
+					select {
+					case frame, ok := <-frames:
+						if !ok {
+							t.Fatalf("the connection closed before %s", what)
+						}
+						if match(frame) {
+							return
+						}
+					case <-time.After(5 * time.Second):
+						t.Fatalf("timed out waiting for %s", what)
+					}
+				}
+			}
+
+			done := make(chan error, 1)
+			go func() {
+				req, _ := http.NewRequest("GET", "https://example.com/", nil)
+				_, err := request(client, req)
+				done <- err
+			}()
+			await("the request", func(frame Frame) bool {
+				switch frame.(type) {
+				case *synStreamFrameV3, *synStreamFrameV2:
+					return true
+				}
+				return false
+			})
+
+			pings, err := client.Ping()
+			if err != nil {
+				t.Fatal(err)
+			}
+			await("the PING", func(frame Frame) bool {
+				switch frame.(type) {
+				case *pingFrameV3, *pingFrameV2:
+					return true
+				}
+				return false
+			})
+
+			// Push stream 2, associated with stream 1.
+			push := rawSynStream(version, 2, newRawCompressor(version).block(rawRequest(version, "/style.css")...))
+			push[4] = byte(FLAG_UNIDIRECTIONAL)
+			push[15] = 1
+			go remote.Write(push)
+			select {
+			case <-collector.accepted:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the push was not accepted")
+			}
+
+			go remote.Write(rawGoaway(version, 0, 0))
+			await("the push's RST_STREAM", func(frame Frame) bool {
+				switch frame := frame.(type) {
+				case *rstStreamFrameV3:
+					return frame.StreamID == 2 && frame.Status == RST_STREAM_CANCEL
+				case *rstStreamFrameV2:
+					return frame.StreamID == 2 && frame.Status == RST_STREAM_CANCEL
+				}
+				return false
+			})
+			within(t, time.Second, "the ping, push, and request to resolve", func() {
+				if ping := <-pings; ping.Err != ErrDraining {
+					t.Errorf("the ping resolved with %v, want ErrDraining", ping.Err)
+				}
+				if err := <-collector.failed; err != ErrDraining {
+					t.Errorf("the push failed with %v, want ErrDraining", err)
+				}
+				if err := <-done; err != ErrNotProcessed {
+					t.Errorf("the request failed with %v, want ErrNotProcessed", err)
+				}
+			})
+
+			if _, err := client.Ping(); err != ErrDraining {
+				t.Errorf("a later Ping returned %v, want ErrDraining", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package spdy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// GOAWAY frames carry a status on SPDY/3, and none on SPDY/2,
+// and print it by the name it has in a GOAWAY.
+func TestGoawayFrames(t *testing.T) {
+	tests := []struct {
+		frame Frame
+		wire  []byte
+		text  string
+	}{
+		{
+			&goawayFrameV3{LastGoodStreamID: 7, Status: GOAWAY_OK},
+			[]byte{0x80, 3, 0, 7, 0, 0, 0, 8, 0, 0, 0, 7, 0, 0, 0, 0},
+			"OK (0)",
+		},
+		{
+			&goawayFrameV3{LastGoodStreamID: 7, Status: GOAWAY_PROTOCOL_ERROR},
+			[]byte{0x80, 3, 0, 7, 0, 0, 0, 8, 0, 0, 0, 7, 0, 0, 0, 1},
+			"PROTOCOL_ERROR (1)",
+		},
+		{
+			&goawayFrameV3{LastGoodStreamID: 7, Status: GOAWAY_INTERNAL_ERROR},
+			[]byte{0x80, 3, 0, 7, 0, 0, 0, 8, 0, 0, 0, 7, 0, 0, 0, 11},
+			"INTERNAL_ERROR (11)",
+		},
+		{
+			&goawayFrameV3{LastGoodStreamID: 7, Status: 5},
+			[]byte{0x80, 3, 0, 7, 0, 0, 0, 8, 0, 0, 0, 7, 0, 0, 0, 5},
+			"UNKNOWN (5) (5)",
+		},
+		{
+			&goawayFrameV2{LastGoodStreamID: 7},
+			[]byte{0x80, 2, 0, 7, 0, 0, 0, 4, 0, 0, 0, 7},
+			"Last good stream ID:  7",
+		},
+	}
+
+	for _, test := range tests {
+		version := uint16(test.wire[1])
+		out, err := MarshalFrame(test.frame)
+		if err != nil || !bytes.Equal(out, test.wire) {
+			t.Errorf("%v marshalled to %x, error %v, want %x", test.frame, out, err, test.wire)
+		}
+		frame, err := ParseFrame(test.wire, version)
+		if err != nil || !reflect.DeepEqual(frame, test.frame) {
+			t.Errorf("%x parsed to %v, error %v, want %v", test.wire, frame, err, test.frame)
+		}
+		if s := test.frame.String(); !strings.Contains(s, test.text) {
+			t.Errorf("got %q, want %q", s, test.text)
+		}
+	}
+}
+
+// The GOAWAY sent when a connection ends gives the reason:
+// OK when closing normally, PROTOCOL_ERROR when the other
+// endpoint has broken the protocol, and INTERNAL_ERROR after
+// a panic. SPDY/2 cannot say why.
+func TestGoawayStatusSent(t *testing.T) {
+	tests := []struct {
+		name   string
+		status StatusCode
+		end    func(t *testing.T, version uint16, server Conn, remote *rawPeer)
+	}{
+		{"closed", GOAWAY_OK, func(t *testing.T, version uint16, server Conn, remote *rawPeer) {
+			go server.Close()
+		}},
+		{"protocol error", GOAWAY_PROTOCOL_ERROR, func(t *testing.T, version uint16, server Conn, remote *rawPeer) {
+			remote.write(rawSynStream(version, 1, deflateBlocks(t, version, [][]byte{manyHeaders(version)})[0]))
+		}},
+		{"panic", GOAWAY_INTERNAL_ERROR, func(t *testing.T, version uint16, server Conn, remote *rawPeer) {
+			// The server's stream 2, which panics when
+			// closed, is ended by the client's GOAWAY.
+			switch conn := server.(type) {
+			case *connV3:
+				conn.Lock()
+				conn.streams[2] = new(panicStream)
+				conn.Unlock()
+			case *connV2:
+				conn.Lock()
+				conn.streams[2] = new(panicStream)
+				conn.Unlock()
+			}
+			remote.write(rawGoaway(version, 0, GOAWAY_OK))
+		}},
+	}
+
+	for _, test := range tests {
+		for _, version := range versions {
+			test, version := test, version
+			t.Run(fmt.Sprintf("SPDY/%d %s", version, test.name), func(t *testing.T) {
+				var server Conn
+				conn := rawServerConnWith(t, &http.Server{}, version, func(s Conn) { server = s })
+				remote := newRawPeer(conn, version)
+
+				// The server's SETTINGS show that it is
+				// handling frames.
+				remote.write(rawSettings(version))
+				remote.await(t, "the SETTINGS", func(frame Frame) bool {
+					switch frame.(type) {
+					case *settingsFrameV3, *settingsFrameV2:
+						return true
+					}
+					return false
+				})
+
+				test.end(t, version, server, remote)
+				remote.await(t, "the GOAWAY", func(frame Frame) bool {
+					switch frame := frame.(type) {
+					case *goawayFrameV3:
+						if frame.Status != test.status {
+							t.Errorf("got GOAWAY %s, want %s", frame.Status.goawayString(), test.status.goawayString())
+						}
+						return true
+					case *goawayFrameV2:
+						return true
+					}
+					return false
+				})
+			})
+		}
+	}
+}
+
+// A GOAWAY with an error status is the reason given for
+// requests which can no longer be made. After one with OK,
+// requests are simply not processed.
+func TestGoawayStatusReceived(t *testing.T) {
+	tests := []struct {
+		version uint16
+		status  StatusCode
+		check   func(err error) bool
+	}{
+		{3, GOAWAY_OK, func(err error) bool { return err == ErrNotProcessed }},
+		{3, GOAWAY_PROTOCOL_ERROR, func(err error) bool {
+			var goaway *GoAwayError
+			return errors.As(err, &goaway) && goaway.Status == GOAWAY_PROTOCOL_ERROR && errors.Is(err, ErrGoAway)
+		}},
+		{3, GOAWAY_INTERNAL_ERROR, func(err error) bool {
+			var goaway *GoAwayError
+			return errors.As(err, &goaway) && goaway.Status == GOAWAY_INTERNAL_ERROR
+		}},
+		{2, 0, func(err error) bool { return err == ErrNotProcessed }},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(fmt.Sprintf("SPDY/%d %s", test.version, test.status.goawayString()), func(t *testing.T) {
+			client, conn := rawClientConn(t, test.version)
+			newRawPeer(conn, test.version).write(rawGoaway(test.version, 0, test.status))
+			within(t, 5*time.Second, "the GOAWAY", func() {
+				for !client.(snapshotter).snapshot().GoawayReceived {
+					time.Sleep(time.Millisecond)
+				}
+			})
+
+			req, _ := http.NewRequest("GET", "https://example.com/", nil)
+			if _, err := client.Request(req, nil, 0); !test.check(err) {
+				t.Errorf("the request failed with %v", err)
+			}
+		})
+	}
+}
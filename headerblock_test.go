@@ -0,0 +1,192 @@
+package spdy
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// chromeBlocks are uncompressed header blocks modelled on
+// Chrome's page requests over each SPDY version, with the
+// headers in the order in which Compressor sends them.
+var chromeBlocks = map[uint16]string{
+	3: "0000000a000000073a6d6574686f6400000003474554000000053a7061746800" +
+		"00000b2f696e6465782e68746d6c000000083a76657273696f6e000000084854" +
+		"54502f312e31000000053a686f73740000000f7777772e6578616d706c652e63" +
+		"6f6d000000073a736368656d6500000005687474707300000006616363657074" +
+		"0000003f746578742f68746d6c2c6170706c69636174696f6e2f7868746d6c2b" +
+		"786d6c2c6170706c69636174696f6e2f786d6c3b713d302e392c2a2f2a3b713d" +
+		"302e380000000f6163636570742d656e636f64696e6700000011677a69702c64" +
+		"65666c6174652c736463680000000f6163636570742d6c616e67756167650000" +
+		"000e656e2d55532c656e3b713d302e3800000006636f6f6b696500000007613d" +
+		"3100623d320000000a757365722d6167656e74000000684d6f7a696c6c612f35" +
+		"2e3020285831313b204c696e7578207838365f363429204170706c655765624b" +
+		"69742f3533372e333620284b48544d4c2c206c696b65204765636b6f29204368" +
+		"726f6d652f32382e302e313530302e3731205361666172692f3533372e3336",
+	2: "000900066d6574686f640003474554000375726c000b2f696e6465782e68746d" +
+		"6c000776657273696f6e0008485454502f312e310004686f7374000f7777772e" +
+		"6578616d706c652e636f6d0006736368656d6500056874747073000661636365" +
+		"7074003f746578742f68746d6c2c6170706c69636174696f6e2f7868746d6c2b" +
+		"786d6c2c6170706c69636174696f6e2f786d6c3b713d302e392c2a2f2a3b713d" +
+		"302e38000f6163636570742d656e636f64696e670011677a69702c6465666c61" +
+		"74652c73646368000f6163636570742d6c616e6775616765000e656e2d55532c" +
+		"656e3b713d302e38000a757365722d6167656e7400684d6f7a696c6c612f352e" +
+		"3020285831313b204c696e7578207838365f363429204170706c655765624b69" +
+		"742f3533372e323220284b48544d4c2c206c696b65204765636b6f2920436872" +
+		"6f6d652f32352e302e313336342e3937205361666172692f3533372e3232",
+}
+
+// chromeHeaders gives the headers in chromeBlocks.
+func chromeHeaders(version uint16) http.Header {
+	h := http.Header{
+		"Accept":          {"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"},
+		"Accept-Encoding": {"gzip,deflate,sdch"},
+		"Accept-Language": {"en-US,en;q=0.8"},
+	}
+	if version == 2 {
+		h.Set("Method", "GET")
+		h.Set("Url", "/index.html")
+		h.Set("Version", "HTTP/1.1")
+		h.Set("Host", "www.example.com")
+		h.Set("Scheme", "https")
+		h.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.22 (KHTML, like Gecko) Chrome/25.0.1364.97 Safari/537.22")
+		return h
+	}
+	h[":method"] = []string{"GET"}
+	h[":path"] = []string{"/index.html"}
+	h[":version"] = []string{"HTTP/1.1"}
+	h[":host"] = []string{"www.example.com"}
+	h[":scheme"] = []string{"https"}
+	h["Cookie"] = []string{"a=1", "b=2"}
+	h.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/28.0.1500.71 Safari/537.36")
+	return h
+}
+
+// deflateBlocks compresses each block with the dictionary
+// of the given version, continuing one zlib stream, as a
+// peer does. Each block is split into parts, with a flush
+// after each part.
+func deflateBlocks(t *testing.T, version uint16, parts ...[][]byte) [][]byte {
+	t.Helper()
+	dict := headerDictionaryV3
+	if version == 2 {
+		dict = headerDictionaryV2
+	}
+	var buf bytes.Buffer
+	w, err := zlib.NewWriterLevelDict(&buf, zlib.BestCompression, dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out [][]byte
+	for _, block := range parts {
+		buf.Reset()
+		for _, part := range block {
+			w.Write(part)
+			w.Flush()
+		}
+		out = append(out, append([]byte(nil), buf.Bytes()...))
+	}
+	return out
+}
+
+// Compressor produces exactly the known header blocks,
+// with the field width and dictionary of each version. A
+// second block continues the first's zlib stream.
+func TestCompressKnownBlocks(t *testing.T) {
+	for _, version := range versions {
+		block, _ := hex.DecodeString(chromeBlocks[version])
+		dict := headerDictionaryV3
+		if version == 2 {
+			dict = headerDictionaryV2
+		}
+
+		c := NewCompressor(version)
+		var stream []byte
+		for i := 0; i < 2; i++ {
+			compressed, err := c.Compress(chromeHeaders(version))
+			if err != nil {
+				t.Fatalf("SPDY/%d: %v", version, err)
+			}
+			stream = append(stream, compressed...)
+		}
+
+		r, err := zlib.NewReaderDict(bytes.NewReader(stream), dict)
+		if err != nil {
+			t.Fatalf("SPDY/%d: %v", version, err)
+		}
+		// The stream is flushed but not ended,
+		// so the reader ends with an error.
+		got, _ := ioutil.ReadAll(r)
+		if want := append(append([]byte(nil), block...), block...); !bytes.Equal(got, want) {
+			t.Errorf("SPDY/%d: compressed\n%x\nwant\n%x", version, got, want)
+		}
+	}
+}
+
+// Decompressor reads the known header blocks, compressed
+// by another zlib writer, including a second block which
+// continues the first's compression context, and blocks
+// flushed part-way through a field, which inflate in short
+// reads.
+func TestDecompressKnownBlocks(t *testing.T) {
+	for _, version := range versions {
+		block, _ := hex.DecodeString(chromeBlocks[version])
+		blocks := deflateBlocks(t, version,
+			[][]byte{block},
+			[][]byte{block},
+			[][]byte{block[:3], block[3:20], block[20:]},
+		)
+
+		d := NewDecompressor(version)
+		for i, compressed := range blocks {
+			header, err := d.Decompress(compressed)
+			if err != nil {
+				t.Fatalf("SPDY/%d: block %d: %v", version, i, err)
+			}
+			if want := chromeHeaders(version); !reflect.DeepEqual(header, want) {
+				t.Errorf("SPDY/%d: block %d gave\n%v\nwant\n%v", version, i, header, want)
+			}
+		}
+
+		// The blocks are specific to the version.
+		other := uint16(5 - version)
+		if header, err := NewDecompressor(other).Decompress(blocks[0]); err == nil {
+			t.Errorf("SPDY/%d: a SPDY/%d decompressor read a SPDY/%d block as %v", version, other, version, header)
+		}
+	}
+}
+
+// SPDY/2 counts and lengths which do not fit in 16 bits
+// are rejected, leaving the compression state intact.
+func TestCompressSPDY2Limits(t *testing.T) {
+	c := NewCompressor(2)
+	d := NewDecompressor(2)
+	tests := []http.Header{
+		{"X-Long": {strings.Repeat("x", 0x10000)}},
+		{"X-Joined": {strings.Repeat("x", 0x8000), strings.Repeat("y", 0x8000)}},
+		{strings.Repeat("X", 0x10000): {"1"}},
+	}
+	for _, header := range tests {
+		if _, err := c.Compress(header); err == nil {
+			t.Errorf("a header block with a field over 16 bits was compressed")
+		}
+
+		block, err := c.Compress(chromeHeaders(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header, err := d.Decompress(block); err != nil || !reflect.DeepEqual(header, chromeHeaders(2)) {
+			t.Fatalf("the following block gave %v, %v", header, err)
+		}
+	}
+
+	// SPDY/3 has room.
+	if _, err := NewCompressor(3).Compress(tests[0]); err != nil {
+		t.Errorf("SPDY/3: %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+package spdy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rawFields encodes counts and lengths with the
+// field width of the given version.
+func rawFields(version uint16, fields ...int) []byte {
+	var out []byte
+	for _, n := range fields {
+		if version == 2 {
+			out = append(out, byte(n>>8), byte(n))
+		} else {
+			out = append(out, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+		}
+	}
+	return out
+}
+
+// manyHeaders returns an uncompressed header block
+// of 200 headers, each with a 2KB value, which is over
+// the default MaxHeaderBlockSize, though each header
+// fits in a SPDY/2 length field.
+func manyHeaders(version uint16) []byte {
+	out := rawFields(version, 200)
+	value := strings.Repeat("v", 2000)
+	for i := 0; i < 200; i++ {
+		name := fmt.Sprintf("x-%d", i)
+		out = append(out, rawFields(version, len(name))...)
+		out = append(out, name...)
+		out = append(out, rawFields(version, len(value))...)
+		out = append(out, value...)
+	}
+	return out
+}
+
+// Header blocks which would inflate beyond the limits are
+// rejected without being inflated in full. A single SPDY/2
+// field cannot exceed the default MaxHeaderBlockSize.
+func TestDecompressBomb(t *testing.T) {
+	tests := []struct {
+		name     string
+		versions []uint16
+		block    func(version uint16) []byte // uncompressed.
+	}{
+		{"too many headers", versions, func(version uint16) []byte {
+			return rawFields(version, MaxHeaderCount+1)
+		}},
+		{"long name", []uint16{3}, func(version uint16) []byte {
+			return rawFields(version, 1, MaxHeaderBlockSize)
+		}},
+		{"long value", []uint16{3}, func(version uint16) []byte {
+			return append(append(rawFields(version, 1, 1), 'x'), rawFields(version, MaxHeaderBlockSize)...)
+		}},
+		{"negative length", []uint16{3}, func(version uint16) []byte {
+			return rawFields(version, 1, -1)
+		}},
+		{"many headers", versions, manyHeaders},
+	}
+
+	for _, test := range tests {
+		for _, version := range test.versions {
+			block := deflateBlocks(t, version, [][]byte{test.block(version)})[0]
+			if _, err := NewDecompressor(version).Decompress(block); err != ErrHeaderBlockTooLarge {
+				t.Errorf("SPDY/%d: %s gave %v, want ErrHeaderBlockTooLarge", version, test.name, err)
+			}
+		}
+	}
+
+	// A few kilobytes claiming a 100MB header, with its
+	// first megabyte, are rejected before much is inflated.
+	block := append(append(rawFields(3, 1, 1), 'x'), rawFields(3, 100<<20)...)
+	bomb := deflateBlocks(t, 3, [][]byte{block, make([]byte, 1<<20)})[0]
+	if len(bomb) > 8<<10 {
+		t.Fatalf("the bomb is %d bytes", len(bomb))
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := NewDecompressor(3).Decompress(bomb); err != ErrHeaderBlockTooLarge {
+		t.Errorf("the bomb gave %v, want ErrHeaderBlockTooLarge", err)
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 4<<20 {
+		t.Errorf("decompressing the bomb allocated %d bytes", n)
+	}
+}
+
+// MaxHeaderBlockSize and MaxHeaderCount can be changed.
+func TestHeaderBlockLimits(t *testing.T) {
+	size, count := MaxHeaderBlockSize, MaxHeaderCount
+	defer func() { MaxHeaderBlockSize, MaxHeaderCount = size, count }()
+
+	header := http.Header{"X-A": {strings.Repeat("a", 1000)}, "X-B": {"b"}, "X-C": {"c"}}
+	for _, version := range versions {
+		block, err := NewCompressor(version).Compress(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		MaxHeaderBlockSize, MaxHeaderCount = size, count
+		if _, err := NewDecompressor(version).Decompress(block); err != nil {
+			t.Errorf("SPDY/%d: the defaults gave %v", version, err)
+		}
+		MaxHeaderBlockSize = 1000
+		if _, err := NewDecompressor(version).Decompress(block); err != ErrHeaderBlockTooLarge {
+			t.Errorf("SPDY/%d: a block over MaxHeaderBlockSize gave %v", version, err)
+		}
+		MaxHeaderBlockSize, MaxHeaderCount = size, 2
+		if _, err := NewDecompressor(version).Decompress(block); err != ErrHeaderBlockTooLarge {
+			t.Errorf("SPDY/%d: a block over MaxHeaderCount gave %v", version, err)
+		}
+	}
+}
+
+// A header block over the limit ends the session with
+// a PROTOCOL_ERROR, as the compression state is lost,
+// and is given as the reason for closing.
+func TestHeaderBombEndsSession(t *testing.T) {
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				t.Errorf("the request was served")
+			})}
+			reasons := make(chan error, 1)
+			conn := rawServerConnWith(t, srv, version, func(server Conn) {
+				server.(hooker).setHooks(&ConnHooks{OnClose: func(conn Conn, reason error) { reasons <- reason }})
+			})
+			go conn.Write(rawSynStream(version, 1, deflateBlocks(t, version, [][]byte{manyHeaders(version)})[0]))
+
+			var goaway bool
+			within(t, 5*time.Second, "the connection closing", func() {
+				for {
+					frame, err := readRawFrame(conn, version)
+					if err != nil {
+						return
+					}
+					switch frame := frame.(type) {
+					case *goawayFrameV3:
+						goaway = true
+						if frame.Status != GOAWAY_PROTOCOL_ERROR {
+							t.Errorf("got GOAWAY %v, want PROTOCOL_ERROR", frame.Status)
+						}
+					case *goawayFrameV2:
+						goaway = true
+					case *synReplyFrameV3, *synReplyFrameV2:
+						t.Errorf("the request was answered with %v", frame)
+					}
+				}
+			})
+			if !goaway {
+				t.Error("no GOAWAY was sent")
+			}
+
+			select {
+			case reason := <-reasons:
+				if !errors.Is(reason, ErrHeaderBlockTooLarge) {
+					t.Errorf("the connection closed with %v, want ErrHeaderBlockTooLarge", reason)
+				}
+			case <-time.After(5 * time.Second):
+				t.Error("OnClose was not called")
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package spdy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// hopByHopHeaders are the connection-specific headers,
+// which are not valid in SPDY. They are removed from
+// header blocks before they are sent, and ignored in
+// header blocks received.
+var hopByHopHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+}
+
+// invalidHeader indicates that a header in a received
+// header block broke the SPDY specification's rules,
+// such as by having an uppercase name.
+type invalidHeader struct {
+	name   string
+	reason string
+}
+
+func (i *invalidHeader) Error() string {
+	return fmt.Sprintf("Error: Header %q is invalid: %s.", i.name, i.reason)
+}
+
+// headerLenience is implemented by connections which
+// can relax the validation of received header blocks.
+type headerLenience interface {
+	setLenientHeaders(bool)
+}
+
+// SetLenientHeaders sets whether conn accepts received
+// header blocks which break the SPDY specification's rules
+// for header names and values, as some deployed endpoints
+// send. By default, a stream whose header block has an
+// empty or uppercase header name, a NUL byte in a header
+// name, or an empty value joined with others by NUL bytes,
+// is reset with a PROTOCOL_ERROR. If lenient is true, these
+// headers are normalised instead, lowercasing their names
+// and dropping empty names and values. Hop-by-hop headers,
+// such as Connection, are always ignored.
+//
+// This should be called before conn's Run method.
+func SetLenientHeaders(conn Conn, lenient bool) error {
+	l, ok := conn.(headerLenience)
+	if !ok {
+		return ErrNotSPDY
+	}
+	l.setLenientHeaders(lenient)
+	return nil
+}
+
+// normaliseHeaders prepares the headers to be sent in a
+// header block, returning them with lowercase names, and
+// without the hop-by-hop headers. Empty values are dropped
+// from headers with more than one value, as they cannot be
+// joined with NUL bytes. An error is returned if a header
+// has an empty name, or a NUL byte in its name or values,
+// or if two headers' names differ only in case and their
+// values disagree.
+func normaliseHeaders(h http.Header) (map[string][]string, error) {
+	headers := make(map[string][]string, len(h))
+	for name, values := range h {
+		lower := strings.ToLower(name)
+		if hopByHopHeaders[lower] {
+			continue
+		}
+		if lower == "" {
+			return nil, errors.New("Error: Header names cannot be empty.")
+		}
+		if strings.IndexByte(lower, 0) >= 0 {
+			return nil, errors.New(fmt.Sprintf("Error: Header %q has a NUL byte in its name.", name))
+		}
+		for _, value := range values {
+			if strings.IndexByte(value, 0) >= 0 {
+				return nil, errors.New(fmt.Sprintf("Error: Header %q has a NUL byte in its value.", name))
+			}
+		}
+		if len(values) > 1 {
+			values = nonEmpty(values)
+		}
+
+		// Header names are sent in lowercase, so names
+		// which differ only in case must agree.
+		if prev, ok := headers[lower]; ok && !sameValues(prev, values) {
+			return nil, errors.New(fmt.Sprintf("Error: Header %q conflicts with another header of the same name.", name))
+		}
+		headers[lower] = values
+	}
+	return headers, nil
+}
+
+// checkHeaders returns the error, if any, which would
+// prevent the headers being sent in a header block, so
+// that it can be given to the caller sending them.
+func checkHeaders(h http.Header) error {
+	_, err := normaliseHeaders(h)
+	return err
+}
+
+// nonEmpty returns values without any empty values, or
+// a single empty value if all of them are empty.
+func nonEmpty(values []string) []string {
+	out := make([]string, 0, len(values))
+	for _, value := range values {
+		if value != "" {
+			out = append(out, value)
+		}
+	}
+	if len(out) == 0 {
+		return []string{""}
+	}
+	return out
+}
+
+// parseHeader checks a header received in a header block,
+// returning its values, split on NUL bytes. skip indicates
+// that the header should be ignored, as it is a hop-by-hop
+// header, or is invalid and lenient is true. Otherwise, an
+// invalid header gives an *invalidHeader error.
+func parseHeader(name, value []byte, lenient bool) (values [][]byte, skip bool, err error) {
+	switch {
+	case len(name) == 0:
+		err = &invalidHeader{"", "empty name"}
+	case bytes.IndexByte(name, 0) >= 0:
+		err = &invalidHeader{string(name), "NUL byte in name"}
+	case !lenient && hasUpper(name):
+		err = &invalidHeader{string(name), "uppercase name"}
+	}
+	if err != nil {
+		if lenient {
+			return nil, true, nil
+		}
+		return nil, false, err
+	}
+	if hopByHopHeaders[strings.ToLower(string(name))] {
+		return nil, true, nil
+	}
+
+	// A single value may be empty, but values
+	// joined with NUL bytes may not.
+	values = bytes.Split(value, []byte{'\x00'})
+	if len(values) == 1 {
+		return values, false, nil
+	}
+	out := make([][]byte, 0, len(values))
+	for _, v := range values {
+		if len(v) > 0 {
+			out = append(out, v)
+		}
+	}
+	if len(out) == len(values) {
+		return values, false, nil
+	}
+	if !lenient {
+		return nil, false, &invalidHeader{string(name), "empty value"}
+	}
+	if len(out) == 0 {
+		out = append(out, []byte{})
+	}
+	return out, false, nil
+}
+
+// hasUpper indicates whether name has
+// any uppercase ASCII letters.
+func hasUpper(name []byte) bool {
+	for _, b := range name {
+		if 'A' <= b && b <= 'Z' {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,574 @@
+package spdy
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rawCompressor compresses header blocks written name by
+// name, so that blocks can be crafted which a Compressor
+// would never send, such as those repeating a name.
+type rawCompressor struct {
+	version uint16
+	buf     bytes.Buffer
+	w       *zlib.Writer
+}
+
+func newRawCompressor(version uint16) *rawCompressor {
+	c := &rawCompressor{version: version}
+	dict := headerDictionaryV3
+	if version == 2 {
+		dict = headerDictionaryV2
+	}
+	c.w, _ = zlib.NewWriterLevelDict(&c.buf, zlib.BestCompression, dict)
+	return c
+}
+
+// block compresses the given names and values, in order,
+// continuing the compression context of earlier blocks.
+func (c *rawCompressor) block(pairs ...string) []byte {
+	var out bytes.Buffer
+	writeLength := func(n int) {
+		if c.version == 2 {
+			out.Write([]byte{byte(n >> 8), byte(n)})
+		} else {
+			out.Write([]byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)})
+		}
+	}
+
+	writeLength(len(pairs) / 2)
+	for _, s := range pairs {
+		writeLength(len(s))
+		out.WriteString(s)
+	}
+
+	c.buf.Reset()
+	c.w.Write(out.Bytes())
+	c.w.Flush()
+	return append([]byte(nil), c.buf.Bytes()...)
+}
+
+// Crafted header blocks which repeat a header that may only
+// be given once are rejected, whether the header is repeated
+// or its values are joined with a null byte, and even if the
+// values agree. Other repeated headers are joined into one.
+func TestDuplicateHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		version uint16
+		pairs   []string
+		want    http.Header // nil if the block is rejected.
+	}{
+		{"duplicate :path", 3, []string{":path", "/public", ":path", "/admin"}, nil},
+		{"duplicate :path, same value", 3, []string{":path", "/", ":path", "/"}, nil},
+		{"joined :path", 3, []string{":path", "/public\x00/admin"}, nil},
+		{"duplicate :host", 3, []string{":host", "example.com", ":host", "internal.example.com"}, nil},
+		{"joined :host", 3, []string{":host", "example.com\x00internal.example.com"}, nil},
+		{"duplicate url", 2, []string{"url", "/public", "url", "/admin"}, nil},
+		{"duplicate host", 2, []string{"host", "example.com", "host", "internal.example.com"}, nil},
+		{"joined host", 2, []string{"host", "example.com\x00internal.example.com"}, nil},
+
+		{"differing content-length", 3, []string{"content-length", "5", "content-length", "500"}, nil},
+		{"joined differing content-length", 3, []string{"content-length", "5\x00500"}, nil},
+		{"differing content-length", 2, []string{"content-length", "5", "content-length", "500"}, nil},
+		{"matching content-length", 3, []string{"content-length", "5", "content-length", "5"},
+			http.Header{"Content-Length": {"5"}}},
+		{"joined matching content-length", 2, []string{"content-length", "5\x005"},
+			http.Header{"Content-Length": {"5"}}},
+
+		{"duplicate and joined header", 3, []string{"x-foo", "a\x00b", "x-foo", "c"},
+			http.Header{"X-Foo": {"a", "b", "c"}}},
+		{"duplicate and joined header", 2, []string{"x-foo", "a", "x-foo", "b\x00c"},
+			http.Header{"X-Foo": {"a", "b", "c"}}},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("SPDY/%d/%s", test.version, test.name), func(t *testing.T) {
+			d := NewDecompressor(test.version)
+			c := newRawCompressor(test.version)
+			headers, err := d.Decompress(c.block(test.pairs...))
+			if test.want == nil {
+				if _, ok := err.(duplicateHeader); !ok {
+					t.Fatalf("got %v, error %v, want the block rejected", headers, err)
+				}
+			} else if err != nil || !reflect.DeepEqual(headers, test.want) {
+				t.Fatalf("got %v, error %v, want %v", headers, err, test.want)
+			}
+
+			// The compression context is intact, so the
+			// next block can still be read.
+			headers, err = d.Decompress(c.block("x-next", "ok"))
+			if err != nil || headers.Get("X-Next") != "ok" {
+				t.Fatalf("next block gave %v, error %v", headers, err)
+			}
+		})
+	}
+}
+
+// readRawFrame reads a single frame from r.
+func readRawFrame(r io.Reader, version uint16) (Frame, error) {
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	n := int(head[5])<<16 | int(head[6])<<8 | int(head[7])
+	data := append(head, make([]byte, n)...)
+	if _, err := io.ReadFull(r, data[8:]); err != nil {
+		return nil, err
+	}
+	return ParseFrame(data, version)
+}
+
+// rawRequest returns the names and values of the
+// request line headers for a GET of path.
+func rawRequest(version uint16, path string) []string {
+	if version == 2 {
+		return []string{"method", "GET", "scheme", "https", "host", "example.com", "url", path, "version", "HTTP/1.1"}
+	}
+	return []string{":method", "GET", ":scheme", "https", ":host", "example.com", ":path", path, ":version", "HTTP/1.1"}
+}
+
+// rawSynStream returns a SYN_STREAM frame, as sent on the
+// wire, with the given compressed header block, and with
+// FLAG_FIN set, as for a request without a body.
+func rawSynStream(version uint16, sid StreamID, block []byte) []byte {
+	n := 10 + len(block)
+	data := []byte{0x80, byte(version), 0, 1, byte(FLAG_FIN), byte(n >> 16), byte(n >> 8), byte(n)}
+	data = append(data, byte(sid>>24), byte(sid>>16), byte(sid>>8), byte(sid), 0, 0, 0, 0, 0, 0)
+	return append(data, block...)
+}
+
+// rawSynReply returns a SYN_REPLY frame, as sent on the
+// wire, with FLAG_FIN set and a 200 status.
+func rawSynReply(version uint16, sid StreamID, c *rawCompressor) []byte {
+	var block []byte
+	data := []byte{byte(sid >> 24), byte(sid >> 16), byte(sid >> 8), byte(sid)}
+	if version == 2 {
+		block = c.block("status", "200 OK", "version", "HTTP/1.1")
+		data = append(data, 0, 0)
+	} else {
+		block = c.block(":status", "200 OK", ":version", "HTTP/1.1")
+	}
+	data = append(data, block...)
+	n := len(data)
+	return append([]byte{0x80, byte(version), 0, 2, byte(FLAG_FIN), byte(n >> 16), byte(n >> 8), byte(n)}, data...)
+}
+
+// A request whose header block repeats :path is reset with
+// a PROTOCOL_ERROR before the handler sees it, leaving the
+// connection, and its compression context, usable for the
+// next request.
+func TestDuplicatePathRejected(t *testing.T) {
+	for _, version := range versions {
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			paths := make(chan string, 2)
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				paths <- r.URL.Path
+			})}
+			conn := rawServerConn(t, srv, version)
+
+			c := newRawCompressor(version)
+			path := ":path"
+			if version == 2 {
+				path = "url"
+			}
+			duplicated := append(rawRequest(version, "/public"), path, "/admin")
+
+			// The frames are written in turn, as a net.Pipe
+			// has no buffering.
+			go func() {
+				conn.Write(rawSynStream(version, 1, c.block(duplicated...)))
+				conn.Write(rawSynStream(version, 3, c.block(rawRequest(version, "/public")...)))
+			}()
+
+			var reset, replied bool
+			within(t, 5*time.Second, "the replies", func() {
+				for !reset || !replied {
+					frame, err := readRawFrame(conn, version)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					switch frame := frame.(type) {
+					case *rstStreamFrameV3:
+						reset = frame.StreamID == 1 && frame.Status == RST_STREAM_PROTOCOL_ERROR
+					case *rstStreamFrameV2:
+						reset = frame.StreamID == 1 && frame.Status == RST_STREAM_PROTOCOL_ERROR
+					case *synReplyFrameV3:
+						replied = frame.StreamID == 3
+					case *synReplyFrameV2:
+						replied = frame.StreamID == 3
+					}
+				}
+			})
+
+			if path := <-paths; path != "/public" {
+				t.Fatalf("handler saw %q", path)
+			}
+			select {
+			case path := <-paths:
+				t.Fatalf("handler also saw %q", path)
+			default:
+			}
+		})
+	}
+}
+
+// Headers are sent with lowercase names, without the
+// hop-by-hop headers, and with any empty values dropped
+// from those with several. Headers which cannot be sent
+// are rejected.
+func TestNormaliseHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		in   http.Header
+		want map[string][]string // nil if the headers are rejected.
+	}{
+		{"lowercase", http.Header{"X-Foo": {"a"}}, map[string][]string{"x-foo": {"a"}}},
+		{"hop-by-hop", http.Header{
+			"Connection":        {"close"},
+			"Keep-Alive":        {"timeout=5"},
+			"Proxy-Connection":  {"keep-alive"},
+			"Transfer-Encoding": {"chunked"},
+			"X-Foo":             {"a"},
+		}, map[string][]string{"x-foo": {"a"}}},
+		{"empty value", http.Header{"X-Foo": {""}}, map[string][]string{"x-foo": {""}}},
+		{"empty values joined", http.Header{"X-Foo": {"a", "", "b"}}, map[string][]string{"x-foo": {"a", "b"}}},
+		{"only empty values joined", http.Header{"X-Foo": {"", ""}}, map[string][]string{"x-foo": {""}}},
+
+		{"empty name", http.Header{"": {"a"}}, nil},
+		{"NUL in name", http.Header{"X-B\x00ad": {"a"}}, nil},
+		{"NUL in value", http.Header{"X-Bad": {"a\x00b"}}, nil},
+		{"conflicting case", http.Header{"X-Foo": {"a"}, "x-foo": {"b"}}, nil},
+	}
+
+	for _, test := range tests {
+		got, err := normaliseHeaders(test.in)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: got %v, want an error", test.name, got)
+			}
+		} else if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, error %v, want %v", test.name, got, err, test.want)
+		}
+	}
+
+	// Values are joined with NUL bytes, and split again.
+	for _, version := range versions {
+		block, err := NewCompressor(version).Compress(http.Header{"X-Foo": {"a", "", "b"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := NewDecompressor(version).Decompress(block)
+		if want := []string{"a", "b"}; err != nil || !reflect.DeepEqual(got["X-Foo"], want) {
+			t.Errorf("SPDY/%d: got %v, error %v, want X-Foo %v", version, got, err, want)
+		}
+	}
+}
+
+// Received header blocks with empty or uppercase names, NUL
+// bytes in names, or empty values joined by NUL bytes, are
+// rejected, unless the decompressor is lenient, when the
+// headers are normalised instead. Hop-by-hop headers are
+// always ignored.
+func TestReceivedHeaders(t *testing.T) {
+	joined := http.Header{"X-Foo": {"a", "b"}}
+	tests := []struct {
+		name    string
+		pairs   []string
+		strict  http.Header // nil if the block is rejected.
+		lenient http.Header
+	}{
+		{"joined values", []string{"x-foo", "a\x00b"}, joined, joined},
+		{"empty value", []string{"x-foo", ""}, http.Header{"X-Foo": {""}}, http.Header{"X-Foo": {""}}},
+		{"hop-by-hop", []string{
+			"connection", "close",
+			"keep-alive", "timeout=5",
+			"proxy-connection", "keep-alive",
+			"transfer-encoding", "chunked",
+			"x-foo", "a",
+		}, http.Header{"X-Foo": {"a"}}, http.Header{"X-Foo": {"a"}}},
+
+		{"uppercase name", []string{"X-Foo", "a"}, nil, http.Header{"X-Foo": {"a"}}},
+		{"empty name", []string{"", "a", "x-foo", "b"}, nil, http.Header{"X-Foo": {"b"}}},
+		{"NUL in name", []string{"x-b\x00ad", "a", "x-foo", "b"}, nil, http.Header{"X-Foo": {"b"}}},
+		{"empty value joined", []string{"x-foo", "a\x00\x00b"}, nil, joined},
+		{"only empty values joined", []string{"x-foo", "\x00"}, nil, http.Header{"X-Foo": {""}}},
+	}
+
+	for _, test := range tests {
+		for _, version := range versions {
+			for _, lenient := range []bool{false, true} {
+				want := test.strict
+				if lenient {
+					want = test.lenient
+				}
+
+				d := NewDecompressor(version).(*decompressor)
+				d.setLenient(lenient)
+				c := newRawCompressor(version)
+				got, err := d.Decompress(c.block(test.pairs...))
+				if want == nil {
+					if _, ok := err.(*invalidHeader); !ok {
+						t.Errorf("SPDY/%d %s: got %v, error %v, want the block rejected", version, test.name, got, err)
+					}
+				} else if err != nil || !reflect.DeepEqual(got, want) {
+					t.Errorf("SPDY/%d %s, lenient %v: got %v, error %v, want %v", version, test.name, lenient, got, err, want)
+				}
+
+				// The compression context is intact.
+				got, err = d.Decompress(c.block("x-next", "ok"))
+				if err != nil || got.Get("X-Next") != "ok" {
+					t.Errorf("SPDY/%d %s: next block gave %v, error %v", version, test.name, got, err)
+				}
+			}
+		}
+	}
+}
+
+// A request with an uppercase header name is reset with a
+// PROTOCOL_ERROR, unless the server has lenient headers, and
+// hop-by-hop headers are not given to the handler.
+func TestLenientHeaders(t *testing.T) {
+	for _, version := range versions {
+		for _, lenient := range []bool{false, true} {
+			version, lenient := version, lenient
+			t.Run(fmt.Sprintf("SPDY/%d lenient %v", version, lenient), func(t *testing.T) {
+				headers := make(chan http.Header, 1)
+				srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					headers <- r.Header
+				})}
+				conn := rawServerConnWith(t, srv, version, func(server Conn) {
+					if err := SetLenientHeaders(server, lenient); err != nil {
+						t.Fatal(err)
+					}
+				})
+				remote := newRawPeer(conn, version)
+
+				c := newRawCompressor(version)
+				pairs := append(rawRequest(version, "/"), "X-Foo", "a", "connection", "close")
+				remote.write(rawSynStream(version, 1, c.block(pairs...)))
+				remote.await(t, "the response", func(frame Frame) bool {
+					switch frame := frame.(type) {
+					case *rstStreamFrameV3:
+						if lenient || frame.Status != RST_STREAM_PROTOCOL_ERROR {
+							t.Errorf("the request was reset with %s", frame.Status)
+						}
+						return true
+					case *rstStreamFrameV2:
+						if lenient || frame.Status != RST_STREAM_PROTOCOL_ERROR {
+							t.Errorf("the request was reset with %s", frame.Status)
+						}
+						return true
+					case *synReplyFrameV3, *synReplyFrameV2:
+						if !lenient {
+							t.Error("the request was served")
+						}
+						return true
+					}
+					return false
+				})
+
+				if !lenient {
+					return
+				}
+				header := <-headers
+				if header.Get("X-Foo") != "a" {
+					t.Errorf("the handler saw X-Foo %q", header.Get("X-Foo"))
+				}
+				if _, ok := header["Connection"]; ok {
+					t.Error("the handler saw the Connection header")
+				}
+			})
+		}
+	}
+
+	if err := SetLenientHeaders(nil, true); err != ErrNotSPDY {
+		t.Errorf("SetLenientHeaders on nil gave %v, want ErrNotSPDY", err)
+	}
+}
+
+// Hop-by-hop headers are not sent, in either direction.
+func TestHopByHopHeaders(t *testing.T) {
+	for _, version := range versions {
+		received := make(chan http.Header, 1)
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received <- r.Header
+			w.Header().Set("Connection", "close")
+			w.Header().Set("Keep-Alive", "timeout=5")
+			w.Header().Set("X-Ok", "1")
+			w.Write([]byte("hi"))
+		})}
+		tr := pipeTransport(t, srv, version)
+
+		within(t, 5*time.Second, "the request", func() {
+			req, _ := http.NewRequest("GET", "https://example.com/", nil)
+			req.Header.Set("Connection", "keep-alive")
+			req.Header.Set("Proxy-Connection", "keep-alive")
+			req.Header.Set("X-Ok", "1")
+			res, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Errorf("SPDY/%d: %v", version, err)
+				return
+			}
+			res.Body.Close()
+
+			for name, header := range map[string]http.Header{"request": <-received, "response": res.Header} {
+				if header.Get("X-Ok") != "1" {
+					t.Errorf("SPDY/%d: the %s lost X-Ok: %v", version, name, header)
+				}
+				for hop := range hopByHopHeaders {
+					if _, ok := header[http.CanonicalHeaderKey(hop)]; ok {
+						t.Errorf("SPDY/%d: the %s has %s: %v", version, name, hop, header)
+					}
+				}
+			}
+		})
+	}
+}
+
+// A request with headers which cannot be sent fails at once,
+// without being sent, and the connection is still usable.
+func TestInvalidRequestHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+	}{
+		{"NUL in value", http.Header{"X-Bad": {"a\x00b"}}},
+		{"NUL in name", http.Header{"X-B\x00ad": {"a"}}},
+		{"conflicting case", http.Header{"X-Foo": {"a"}, "x-foo": {"b"}}},
+	}
+
+	for _, version := range versions {
+		paths := make(chan string, 10)
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			paths <- r.URL.Path
+		})}
+		_, client := pipeConns(t, srv, version)
+
+		within(t, 5*time.Second, "the requests", func() {
+			for _, test := range tests {
+				req, _ := http.NewRequest("GET", "https://example.com/bad", nil)
+				for name, values := range test.header {
+					req.Header[name] = values
+				}
+				if _, err := client.Request(req, nil, 0); err == nil {
+					t.Errorf("SPDY/%d %s: the request was made", version, test.name)
+				}
+			}
+
+			req, _ := http.NewRequest("GET", "https://example.com/good", nil)
+			if _, err := request(client, req); err != nil {
+				t.Errorf("SPDY/%d: the next request failed: %v", version, err)
+			}
+		})
+		if path := <-paths; path != "/good" {
+			t.Errorf("SPDY/%d: the handler saw %s", version, path)
+		}
+	}
+
+	// The Transport returns the error, rather than waiting
+	// for a response.
+	tr := pipeTransport(t, &http.Server{}, 3)
+	within(t, 5*time.Second, "the RoundTrip", func() {
+		req, _ := http.NewRequest("GET", "https://example.com/", nil)
+		req.Header.Set("X-Bad", "a\x00b")
+		if res, err := tr.RoundTrip(req); err == nil {
+			res.Body.Close()
+			t.Error("RoundTrip made the request")
+		}
+	})
+}
+
+// A response with headers which cannot be sent is reset with
+// an INTERNAL_ERROR, rather than being sent without them, and
+// the handler's write fails, if it is the write which sends
+// the reply.
+func TestInvalidResponseHeaders(t *testing.T) {
+	for _, version := range versions {
+		for _, size := range []int{2, RESPONSE_BUFFER_SIZE + 1} {
+			writes := make(chan error, 1)
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header()["X-Foo"] = []string{"a"}
+				w.Header()["x-foo"] = []string{"b"}
+				_, err := w.Write(bytes.Repeat([]byte("h"), size))
+				writes <- err
+			})}
+			tr := pipeTransport(t, srv, version)
+
+			within(t, 5*time.Second, "the request", func() {
+				req, _ := http.NewRequest("GET", "https://example.com/", nil)
+				// An INTERNAL_ERROR is fatal to the client's
+				// connection, so the request fails with it.
+				res, err := tr.RoundTrip(req)
+				if err == nil {
+					res.Body.Close()
+				}
+				if err == nil || !strings.Contains(err.Error(), "INTERNAL_ERROR") {
+					t.Errorf("SPDY/%d, %d bytes: got %v, error %v, want an INTERNAL_ERROR", version, size, res, err)
+				}
+			})
+
+			err := <-writes
+			if buffered := size <= RESPONSE_BUFFER_SIZE; buffered && err != nil {
+				t.Errorf("SPDY/%d: the buffered write gave %v", version, err)
+			} else if !buffered && (err == nil || !strings.Contains(err.Error(), "conflicts")) {
+				t.Errorf("SPDY/%d: the write gave %v, want the header's error", version, err)
+			}
+		}
+	}
+}
+
+// Response data received before the SYN_REPLY is a
+// protocol error, which resets the stream.
+func TestDataBeforeReply(t *testing.T) {
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			client, conn := rawClientConn(t, version)
+			remote := newRawPeer(conn, version)
+
+			errs := make(chan error, 1)
+			go func() {
+				req, _ := http.NewRequest("GET", "https://example.com/", nil)
+				_, err := request(client, req)
+				errs <- err
+			}()
+			remote.await(t, "the request", func(frame Frame) bool {
+				switch frame.(type) {
+				case *synStreamFrameV3, *synStreamFrameV2:
+					return true
+				}
+				return false
+			})
+
+			remote.write(rawData(1, true, []byte("hi")))
+			remote.await(t, "the RST_STREAM", func(frame Frame) bool {
+				switch frame := frame.(type) {
+				case *rstStreamFrameV3:
+					return frame.StreamID == 1 && frame.Status == RST_STREAM_PROTOCOL_ERROR
+				case *rstStreamFrameV2:
+					return frame.StreamID == 1 && frame.Status == RST_STREAM_PROTOCOL_ERROR
+				}
+				return false
+			})
+			select {
+			case err := <-errs:
+				var stream *StreamError
+				if !errors.As(err, &stream) || stream.Status != RST_STREAM_PROTOCOL_ERROR {
+					t.Errorf("the request ended with %v, want a PROTOCOL_ERROR", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the request did not end")
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package spdy
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	var h histogram
+	for _, v := range []uint64{0, 1, 2, 3, 4, 7, 8, 1000, 1 << 40} {
+		h.observe(v)
+	}
+	h.observeDuration(-time.Second)
+	h.observeDuration(1500 * time.Microsecond)
+
+	got := h.snapshot()
+	want := Histogram{Count: 11, Sum: 1<<40 + 1000 + 25 + 1500}
+	want.Buckets[0] = 2  // 0, and the negative duration.
+	want.Buckets[1] = 1  // 1
+	want.Buckets[2] = 2  // 2, 3
+	want.Buckets[3] = 2  // 4, 7
+	want.Buckets[4] = 1  // 8
+	want.Buckets[10] = 1 // 1000
+	want.Buckets[11] = 1 // 1500µs
+	want.Buckets[HistogramBuckets-1] = 1
+	if got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	if m := got.Mean(); m != float64(want.Sum)/11 {
+		t.Errorf("got mean %v", m)
+	}
+	quantiles := []struct {
+		q    float64
+		want uint64
+	}{
+		{0, 0},
+		{0.1, 0},
+		{0.5, 7},
+		{0.9, 2047},
+		{1, math.MaxUint64},
+	}
+	for _, test := range quantiles {
+		if q := got.Quantile(test.q); q != test.want {
+			t.Errorf("Quantile(%v) = %d, want %d", test.q, q, test.want)
+		}
+	}
+	var empty Histogram
+	if empty.Mean() != 0 || empty.Quantile(0.5) != 0 {
+		t.Error("an empty histogram gave a non-zero mean or quantile")
+	}
+
+	if n := testing.AllocsPerRun(100, func() { h.observe(12345) }); n != 0 {
+		t.Errorf("observing a value made %v allocations", n)
+	}
+}
+
+// Each connection records the sizes of the DATA frames and
+// header blocks it sends and receives, the time its DATA
+// frames wait to be written, and the time its handlers
+// take.
+func TestConnHistograms(t *testing.T) {
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			clock := newFakeClock()
+			sizes := []int{10, 100, 1000}
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for _, n := range sizes {
+					w.Write([]byte(strings.Repeat("x", n)))
+					w.(http.Flusher).Flush()
+				}
+				clock.Advance(3 * time.Millisecond)
+			})}
+			server, client := pipeConnsWith(t, srv, version, func(server, client Conn) {
+				setClock(server, clock)
+			})
+
+			within(t, 5*time.Second, "the request", func() {
+				req, _ := http.NewRequest("GET", "https://example.com/", nil)
+				if _, err := request(client, req); err != nil {
+					t.Error(err)
+				}
+			})
+
+			// checkData checks the DATA frames seen, which are
+			// those written, and the empty frame ending the
+			// response.
+			checkData := func(who string, h Histogram) {
+				t.Helper()
+				var want [HistogramBuckets]uint64
+				want[0] = 1
+				want[4] = 1  // 10
+				want[7] = 1  // 100
+				want[10] = 1 // 1000
+				if h.Count != 4 || h.Sum != 1110 || h.Buckets != want {
+					t.Errorf("the %s saw DATA frames %+v", who, h)
+				}
+			}
+
+			// The server's DATA frames are counted once written,
+			// and its handler once it has returned.
+			var stats *ConnStats
+			within(t, 5*time.Second, "the stream finishing", func() {
+				for {
+					stats = server.Stats()
+					if stats.QueueTimes.Count == 4 && stats.HandlerLatency.Count == 1 {
+						return
+					}
+					time.Sleep(time.Millisecond)
+				}
+			})
+			checkData("server", stats.DataFrameSizes)
+			checkData("client", client.Stats().DataFrameSizes)
+
+			// Each sent a header block, and received the other's.
+			for _, s := range []*ConnStats{stats, client.Stats()} {
+				if h := s.HeaderBlockSizes; h.Count != 2 || h.Sum == 0 {
+					t.Errorf("saw header blocks %+v, want 2", h)
+				}
+			}
+
+			// The handler took 3ms.
+			var latency Histogram
+			latency.Count, latency.Sum, latency.Buckets[12] = 1, 3000, 1
+			if stats.HandlerLatency != latency {
+				t.Errorf("got handler latency %+v, want 3ms", stats.HandlerLatency)
+			}
+			if n := client.Stats().HandlerLatency.Count; n != 0 {
+				t.Errorf("the client counted %d handlers", n)
+			}
+		})
+	}
+}
+
+// The histograms are totalled across connections in Stats,
+// and published with expvar.
+func TestPublishHistograms(t *testing.T) {
+	server := newSPDYServer(t, "histograms")
+	name := fmt.Sprintf("spdy-histograms-%d", time.Now().UnixNano())
+	PublishStats(name, server.Config)
+
+	tr := NewTransport(server.Client().Transport.(*http.Transport).TLSClientConfig)
+	defer tr.CloseIdleConnections()
+	for i := 0; i < 3; i++ {
+		res, err := (&http.Client{Transport: tr}).Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	// Handlers are counted once they have returned.
+	var published ConnStats
+	within(t, 5*time.Second, "the handlers finishing", func() {
+		for {
+			published = ConnStats{}
+			if err := json.Unmarshal([]byte(expvar.Get(name).String()), &published); err != nil {
+				t.Error(err)
+				return
+			}
+			if published.HandlerLatency.Count == 3 {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+	if n := published.HeaderBlockSizes.Count; n != 6 {
+		t.Errorf("published %d header block sizes, want 6", n)
+	}
+	if n := published.DataFrameSizes.Count; n == 0 {
+		t.Error("published no DATA frame sizes")
+	}
+	if client := tr.Stats(); client.HeaderBlockSizes.Count != 6 {
+		t.Errorf("the Transport counted %d header blocks, want 6", client.HeaderBlockSizes.Count)
+	}
+}
@@ -0,0 +1,227 @@
+package spdy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ConnHooks are callbacks informed of events on a SPDY
+// connection. Any of the hooks may be nil.
+//
+// Hooks are called sequentially, in the order in which
+// the events occurred, from a single goroutine dedicated
+// to the connection, so they never run concurrently with
+// one another for the same connection, and a slow hook
+// delays only later hooks on that connection. Hooks must
+// not call Close on the connection, but may use it
+// otherwise.
+//
+// Every OnError and OnGoaway is called before OnClose.
+// OnClose is called exactly once, after every stream on
+// the connection has finished, and no hook is called
+// after OnClose returns.
+type ConnHooks struct {
+	// OnError is called when the connection encounters
+	// an error which will cause it to close, such as a
+	// protocol error or a failed read or write.
+	OnError func(conn Conn, err error)
+
+	// OnGoaway is called when a GOAWAY is received,
+	// with the ID of the last stream the peer processed.
+	OnGoaway func(conn Conn, lastGoodStreamID StreamID)
+
+	// OnPush is called when a server push is started,
+	// describing the push and the stream it accompanies.
+	OnPush func(conn Conn, push PushInfo)
+
+	// OnStreamRefused is called when a server does not
+	// serve a stream, with the decision made for it by
+	// the function given to SetStreamAdmission.
+	OnStreamRefused func(conn Conn, streamID StreamID, decision StreamDecision)
+
+	// OnSettings is called when a SETTINGS frame is received,
+	// once the settings it carries have been applied, with a
+	// copy of them, mapped to their IDs. ReceivedSettings
+	// gives all of the settings received so far.
+	OnSettings func(conn Conn, settings map[uint32]Setting)
+
+	// OnRequestComplete is called once the handler for a
+	// request has returned and its response has been sent,
+	// unless the connection has already closed. It is also
+	// called for streams which the function given to
+	// SetStreamAdmission does not accept, after
+	// OnStreamRefused.
+	OnRequestComplete func(conn Conn, info RequestInfo)
+
+	// OnClose is called once the connection has closed,
+	// with the reason for its closing, if known.
+	OnClose func(conn Conn, reason error)
+}
+
+// RequestInfo describes a request which has been served,
+// or which was not accepted for service.
+// It is given to ConnHooks.OnRequestComplete.
+type RequestInfo struct {
+	StreamID StreamID          // stream which carried the request.
+	Method   string            // method of the request.
+	URL      string            // URL of the request.
+	Status   int               // status code of the response, or zero if none was sent.
+	Duration time.Duration     // time taken by the handler.
+	Tags     map[string]string // tags set with Stream.SetTag.
+	Decision StreamDecision    // decision made by the function given to SetStreamAdmission.
+	Pushes   []PushInfo        // pushes made while serving the request, with their labels.
+}
+
+// hooker is implemented by connections
+// which can report events to ConnHooks.
+type hooker interface {
+	setHooks(*ConnHooks)
+}
+
+// SetConnHooks registers hooks to be informed of events
+// on the SPDY connections served by srv. This must be
+// called before srv begins serving.
+func SetConnHooks(srv *http.Server, hooks *ConnHooks) {
+	servers.Lock()
+	servers.config(srv).hooks = hooks
+	servers.Unlock()
+}
+
+// serverHooks returns the hooks registered for srv.
+func serverHooks(srv *http.Server) *ConnHooks {
+	return servers.lookup(srv).hooks
+}
+
+// dispatcher calls a connection's hooks in order from
+// a single goroutine, which is started with the first
+// event. Events are queued without blocking, so the
+// connection is never held up by its hooks. A nil
+// dispatcher discards all events.
+type dispatcher struct {
+	sync.Mutex
+	conn    Conn
+	hooks   *ConnHooks
+	queue   []func()
+	wake    chan struct{}
+	running bool
+	closed  bool
+}
+
+// newDispatcher returns a dispatcher for the hooks,
+// or nil if there are no hooks.
+func newDispatcher(conn Conn, hooks *ConnHooks) *dispatcher {
+	if hooks == nil {
+		return nil
+	}
+	return &dispatcher{
+		conn:  conn,
+		hooks: hooks,
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// error queues an OnError event.
+func (d *dispatcher) error(err error) {
+	if d == nil || d.hooks.OnError == nil || err == nil {
+		return
+	}
+	d.dispatch(false, func() { d.hooks.OnError(d.conn, err) })
+}
+
+// goaway queues an OnGoaway event.
+func (d *dispatcher) goaway(lastGoodStreamID StreamID) {
+	if d == nil || d.hooks.OnGoaway == nil {
+		return
+	}
+	d.dispatch(false, func() { d.hooks.OnGoaway(d.conn, lastGoodStreamID) })
+}
+
+// push queues an OnPush event.
+func (d *dispatcher) push(info PushInfo) {
+	if d == nil || d.hooks.OnPush == nil {
+		return
+	}
+	d.dispatch(false, func() { d.hooks.OnPush(d.conn, info) })
+}
+
+// refused queues an OnStreamRefused event.
+func (d *dispatcher) refused(streamID StreamID, decision StreamDecision) {
+	if d == nil || d.hooks.OnStreamRefused == nil {
+		return
+	}
+	d.dispatch(false, func() { d.hooks.OnStreamRefused(d.conn, streamID, decision) })
+}
+
+// settings queues an OnSettings event.
+func (d *dispatcher) settings(settings map[uint32]Setting) {
+	if d == nil || d.hooks.OnSettings == nil || len(settings) == 0 {
+		return
+	}
+	d.dispatch(false, func() { d.hooks.OnSettings(d.conn, settings) })
+}
+
+// requestComplete queues an OnRequestComplete event.
+func (d *dispatcher) requestComplete(info RequestInfo) {
+	if d == nil || d.hooks.OnRequestComplete == nil {
+		return
+	}
+	d.dispatch(false, func() { d.hooks.OnRequestComplete(d.conn, info) })
+}
+
+// close queues the OnClose event, after which
+// any further events are discarded.
+func (d *dispatcher) close(reason error) {
+	if d == nil {
+		return
+	}
+	d.dispatch(true, func() {
+		if d.hooks.OnClose != nil {
+			d.hooks.OnClose(d.conn, reason)
+		}
+	})
+}
+
+func (d *dispatcher) dispatch(last bool, event func()) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.closed {
+		return
+	}
+	d.closed = last
+	d.queue = append(d.queue, event)
+
+	if !d.running {
+		d.running = true
+		go d.run()
+	}
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run calls each queued event in turn, returning
+// once the OnClose event has been called.
+func (d *dispatcher) run() {
+	for range d.wake {
+		for {
+			d.Lock()
+			if len(d.queue) == 0 {
+				d.Unlock()
+				break
+			}
+			event := d.queue[0]
+			d.queue = d.queue[1:]
+			done := d.closed && len(d.queue) == 0
+			d.Unlock()
+
+			event()
+			if done {
+				return
+			}
+		}
+	}
+}
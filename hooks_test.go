@@ -0,0 +1,174 @@
+package spdy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hookLog records the hooks called on a connection,
+// noting any called concurrently or after OnClose.
+type hookLog struct {
+	sync.Mutex
+	events  []string
+	running bool
+	closed  bool
+	errs    []string
+}
+
+func (l *hookLog) record(event string) func() {
+	l.Lock()
+	defer l.Unlock()
+	if l.running {
+		l.errs = append(l.errs, event+" called while another hook was running")
+	}
+	if l.closed {
+		l.errs = append(l.errs, event+" called after OnClose")
+	}
+	l.running = true
+	l.events = append(l.events, event)
+	return func() {
+		l.Lock()
+		l.running = false
+		l.closed = l.closed || event == "close"
+		l.Unlock()
+	}
+}
+
+func (l *hookLog) hooks() *ConnHooks {
+	return &ConnHooks{
+		OnError: func(conn Conn, err error) {
+			defer l.record("error")()
+			time.Sleep(time.Millisecond)
+		},
+		OnGoaway: func(conn Conn, lastGoodStreamID StreamID) {
+			defer l.record("goaway")()
+			time.Sleep(time.Millisecond)
+		},
+		OnRequestComplete: func(conn Conn, info RequestInfo) {
+			defer l.record("request")()
+		},
+		OnClose: func(conn Conn, reason error) {
+			defer l.record("close")()
+			time.Sleep(time.Millisecond)
+		},
+	}
+}
+
+// check reports any hooks called out of order, and
+// returns the events recorded.
+func (l *hookLog) check(t *testing.T) []string {
+	t.Helper()
+	l.Lock()
+	defer l.Unlock()
+	for _, err := range l.errs {
+		t.Error(err)
+	}
+	closes := 0
+	for _, event := range l.events {
+		if event == "close" {
+			closes++
+		}
+	}
+	if closes != 1 || len(l.events) == 0 || l.events[len(l.events)-1] != "close" {
+		t.Errorf("hooks called in the order %v, want OnClose once, at the end", l.events)
+	}
+	return append([]string(nil), l.events...)
+}
+
+// Events queued from many goroutines are given to the hooks
+// one at a time, and none after the OnClose event.
+func TestDispatcherOrder(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		log := new(hookLog)
+		d := newDispatcher(nil, log.hooks())
+
+		var wg sync.WaitGroup
+		for j := 0; j < 10; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				d.error(errors.New("error"))
+				d.goaway(1)
+			}()
+		}
+		wg.Wait()
+		d.close(nil)
+		d.close(nil)
+		d.error(errors.New("late error"))
+		d.goaway(3)
+
+		within(t, 5*time.Second, "OnClose", func() {
+			for {
+				log.Lock()
+				closed := log.closed
+				log.Unlock()
+				if closed {
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		})
+		time.Sleep(10 * time.Millisecond)
+		if events := log.check(t); len(events) != 21 {
+			t.Fatalf("hooks called %d times, want 21: %v", len(events), events)
+		}
+	}
+
+	// A nil dispatcher discards events.
+	var d *dispatcher
+	d.error(errors.New("error"))
+	d.close(nil)
+}
+
+// A messy teardown, with a GOAWAY, a protocol error, and a
+// local Close racing each other, calls OnGoaway and OnError
+// before OnClose, which is called exactly once, last.
+func TestHooksOrderOnTeardown(t *testing.T) {
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			for i := 0; i < 10; i++ {
+				log := new(hookLog)
+				var server Conn
+				srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+				conn := rawServerConnWith(t, srv, version, func(s Conn) {
+					server = s
+					s.(hooker).setHooks(log.hooks())
+				})
+				go func() {
+					for {
+						if _, err := readRawFrame(conn, version); err != nil {
+							return
+						}
+					}
+				}()
+
+				go func() {
+					conn.Write(rawSynStream(version, 1, newRawCompressor(version).block(rawRequest(version, "/")...)))
+					conn.Write(rawGoaway(version, 0, 0))
+					conn.Write([]byte{0x80, byte(version), 0, 3, 0, 0, 0, 8, 0, 0, 0, 1, 0, 0, 0, 0xff})
+				}()
+				time.Sleep(time.Duration(i) * time.Millisecond)
+				go server.Close()
+
+				within(t, 5*time.Second, "OnClose", func() {
+					for {
+						log.Lock()
+						closed := log.closed
+						log.Unlock()
+						if closed {
+							return
+						}
+						time.Sleep(time.Millisecond)
+					}
+				})
+				time.Sleep(10 * time.Millisecond)
+				log.check(t)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package spdy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// firstFrame returns the first frame sent on conn.
+func firstFrame(t *testing.T, conn net.Conn, version uint16) Frame {
+	t.Helper()
+	var frame Frame
+	within(t, 5*time.Second, "the first frame", func() {
+		var err error
+		if frame, err = readRawFrame(conn, version); err != nil {
+			t.Errorf("reading the first frame: %v", err)
+		}
+	})
+	if t.Failed() {
+		t.FailNow()
+	}
+	return frame
+}
+
+// checkInitialSettings checks that frame is a SETTINGS
+// frame advertising the stream limit and, for SPDY/3,
+// the initial window size.
+func checkInitialSettings(t *testing.T, version uint16, frame Frame) {
+	t.Helper()
+	var settings Settings
+	switch frame := frame.(type) {
+	case *settingsFrameV3:
+		settings = frame.Settings
+	case *settingsFrameV2:
+		settings = frame.Settings
+	default:
+		t.Fatalf("the first frame was %T, want SETTINGS", frame)
+	}
+	if settings[SETTINGS_MAX_CONCURRENT_STREAMS] == nil {
+		t.Error("the SETTINGS did not include MAX_CONCURRENT_STREAMS")
+	}
+	if version == 3 && settings[SETTINGS_INITIAL_WINDOW_SIZE] == nil {
+		t.Error("the SETTINGS did not include INITIAL_WINDOW_SIZE")
+	}
+}
+
+// Each end's SETTINGS are the first frame it sends, even if
+// the peer's SETTINGS and streams arrive first, or frames
+// are queued as soon as the connection starts.
+func TestInitialSettingsFirst(t *testing.T) {
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d server", version), func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+				conn := rawServerConnWith(t, srv, version, func(server Conn) {
+					go server.Ping()
+				})
+				go func() {
+					conn.Write(rawSettings(version, SETTINGS_ROUND_TRIP_TIME))
+					conn.Write(rawSynStream(version, 1, newRawCompressor(version).block(rawRequest(version, "/")...)))
+					conn.Write([]byte{0x80, byte(version), 0, 6, 0, 0, 0, 4, 0, 0, 0, 1})
+				}()
+				checkInitialSettings(t, version, firstFrame(t, conn, version))
+			}
+		})
+
+		t.Run(fmt.Sprintf("SPDY/%d client", version), func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				_, conn := rawClientConnWith(t, version, func(client Conn) {
+					go client.Ping()
+					go func() {
+						req, _ := http.NewRequest("GET", "https://example.com/", nil)
+						request(client, req)
+					}()
+				})
+				go func() {
+					conn.Write(rawSettings(version, SETTINGS_ROUND_TRIP_TIME))
+					conn.Write([]byte{0x80, byte(version), 0, 6, 0, 0, 0, 4, 0, 0, 0, 2})
+				}()
+				checkInitialSettings(t, version, firstFrame(t, conn, version))
+			}
+		})
+	}
+}
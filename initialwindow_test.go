@@ -0,0 +1,137 @@
+package spdy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rawInitialWindow returns a SPDY/3 SETTINGS frame, as sent
+// on the wire, setting INITIAL_WINDOW_SIZE to size.
+func rawInitialWindow(size uint32) []byte {
+	return []byte{
+		0x80, 3, 0, 4, 0, 0, 0, 12, 0, 0, 0, 1,
+		0, 0, 0, byte(SETTINGS_INITIAL_WINDOW_SIZE),
+		byte(size >> 24), byte(size >> 16), byte(size >> 8), byte(size),
+	}
+}
+
+// rawWindowUpdate returns a SPDY/3 WINDOW_UPDATE
+// frame, as sent on the wire.
+func rawWindowUpdate(sid StreamID, delta uint32) []byte {
+	return []byte{
+		0x80, 3, 0, 9, 0, 0, 0, 8,
+		byte(sid >> 24), byte(sid >> 16), byte(sid >> 8), byte(sid),
+		byte(delta >> 24), byte(delta >> 16), byte(delta >> 8), byte(delta),
+	}
+}
+
+// A server sends no more of a response than the client's
+// INITIAL_WINDOW_SIZE allows, even when it is zero, and
+// sends the rest as the window is updated. A window over
+// 2^31 - 1 is a protocol error.
+func TestInitialWindowSize(t *testing.T) {
+	const size = 10000
+	tests := []struct {
+		name   string
+		window uint32
+		sent   int // bytes sent before the window is updated.
+	}{
+		{"zero", 0, 0},
+		{"one", 1, 1},
+		{"max", MAX_DELTA_WINDOW_SIZE, size},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(strings.Repeat("a", size)))
+			})}
+			conn := rawServerConn(t, srv, 3)
+			frames := make(chan Frame, 100)
+			go func() {
+				defer close(frames)
+				for {
+					frame, err := readRawFrame(conn, 3)
+					if err != nil {
+						return
+					}
+					frames <- frame
+				}
+			}()
+
+			go func() {
+				conn.Write(rawInitialWindow(test.window))
+				conn.Write(rawSynStream(3, 1, newRawCompressor(3).block(rawRequest(3, "/")...)))
+			}()
+
+			// read receives the response until want bytes
+			// have arrived, then waits a little longer, to
+			// catch any data sent beyond the window.
+			var received int
+			var replied, fin bool
+			read := func(want int) {
+				quiet := time.After(5 * time.Second)
+				for {
+					select {
+					case frame, ok := <-frames:
+						if !ok {
+							t.Fatal("the connection closed")
+						}
+						switch frame := frame.(type) {
+						case *synReplyFrameV3:
+							replied = true
+						case *dataFrameV3:
+							received += len(frame.Data)
+							fin = frame.Flags.FIN()
+						}
+					case <-quiet:
+						return
+					}
+					if replied && received >= want {
+						quiet = time.After(50 * time.Millisecond)
+					}
+				}
+			}
+
+			read(test.sent)
+			if !replied {
+				t.Fatal("no SYN_REPLY was sent")
+			}
+			if received != test.sent {
+				t.Fatalf("received %d bytes, want %d", received, test.sent)
+			}
+
+			// The rest follows a WINDOW_UPDATE.
+			if received < size {
+				go conn.Write(rawWindowUpdate(1, size))
+				read(size)
+			}
+			if received != size || !fin {
+				t.Fatalf("received %d bytes, FIN %v, want %d bytes and FIN", received, fin, size)
+			}
+		})
+	}
+
+	t.Run("illegal", func(t *testing.T) {
+		conn := rawServerConn(t, &http.Server{}, 3)
+		go conn.Write(rawInitialWindow(MAX_DELTA_WINDOW_SIZE + 1))
+		var status StatusCode = 0xff
+		within(t, 5*time.Second, "the GOAWAY", func() {
+			for {
+				frame, err := readRawFrame(conn, 3)
+				if err != nil {
+					return
+				}
+				if goaway, ok := frame.(*goawayFrameV3); ok {
+					status = goaway.Status
+				}
+			}
+		})
+		if status != GOAWAY_PROTOCOL_ERROR {
+			t.Errorf("GOAWAY status %d, want PROTOCOL_ERROR", status)
+		}
+	})
+}
@@ -0,0 +1,118 @@
+package spdy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// interactiveRecorder is implemented by connections
+// which can send interactive streams in small records.
+type interactiveRecorder interface {
+	setInteractiveRecordSize(int)
+}
+
+// SetInteractiveRecordSize sets the maximum number of bytes
+// which conn writes to the underlying connection at once for
+// streams marked with SetInteractive. Over TLS, this limits
+// the size of the records carrying their data. The default
+// is DEFAULT_INTERACTIVE_RECORD_SIZE. Other streams are
+// unaffected, and keep using large records for efficiency.
+func SetInteractiveRecordSize(conn Conn, n int) error {
+	recorder, ok := conn.(interactiveRecorder)
+	if !ok {
+		return ErrNotSPDY
+	}
+	if n < 1 {
+		return errors.New("Error: Interactive record size must be positive.")
+	}
+	recorder.setInteractiveRecordSize(n)
+	return nil
+}
+
+// SetInteractive marks the SPDY/3 stream underlying w, such
+// as a handler's ResponseWriter or a Stream, as interactive.
+// Data written to an interactive stream is sent immediately,
+// in small TLS records, rather than being collected with
+// other frames into large records, which the other endpoint
+// cannot decrypt until they have arrived in full. This suits
+// streams carrying small, latency-sensitive messages, such
+// as WebSocket-style traffic, rather than bulk transfers.
+// See SetInteractiveRecordSize.
+func SetInteractive(w http.ResponseWriter) error {
+	s, ok := w.(flowControlled)
+	if !ok || s.flowControl() == nil {
+		return ErrNotSPDY
+	}
+	s.flowControl().setInteractive()
+	return nil
+}
+
+// interactiveKey is the context key used to mark
+// requests with WithInteractive.
+type interactiveKey struct{}
+
+// WithInteractive returns a copy of ctx in which requests
+// made over SPDY/3 are sent on interactive streams, as with
+// SetInteractive.
+func WithInteractive(ctx context.Context) context.Context {
+	return context.WithValue(ctx, interactiveKey{}, true)
+}
+
+// interactiveRequest returns whether the request was
+// marked with WithInteractive.
+func interactiveRequest(request *http.Request) bool {
+	interactive, _ := request.Context().Value(interactiveKey{}).(bool)
+	return interactive
+}
+
+// setInteractive causes data sent afterwards
+// to be sent in small TLS records.
+func (f *flowControl) setInteractive() {
+	f.Lock()
+	f.interactive = true
+	f.Unlock()
+}
+
+// recordWriter splits the data written to it into writes
+// of a fixed size, so that over TLS, each is sent in a
+// record of its own. Data is held until a full write is
+// ready, or Flush is called.
+type recordWriter struct {
+	w    io.Writer
+	size int
+	buf  []byte
+}
+
+func newRecordWriter(w io.Writer, size int) *recordWriter {
+	return &recordWriter{w: w, size: size, buf: make([]byte, 0, size)}
+}
+
+func (r *recordWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		l := r.size - len(r.buf)
+		if l > len(p) {
+			l = len(p)
+		}
+		r.buf = append(r.buf, p[:l]...)
+		p = p[l:]
+		if len(r.buf) == r.size {
+			if err := r.Flush(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Flush writes any data being held.
+func (r *recordWriter) Flush() error {
+	if len(r.buf) == 0 {
+		return nil
+	}
+	_, err := r.w.Write(r.buf)
+	r.buf = r.buf[:0]
+	return err
+}
@@ -0,0 +1,237 @@
+package spdy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRecordWriter(t *testing.T) {
+	var got []string
+	w := newRecordWriter(writerFunc(func(b []byte) (int, error) {
+		got = append(got, string(b))
+		return len(b), nil
+	}), 4)
+
+	w.Write([]byte("abcdefghij"))
+	w.Write([]byte("k"))
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+
+	if want := []string{"abcd", "efgh", "ijk"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got writes %q, want %q", got, want)
+	}
+}
+
+// writerFunc is an io.Writer which calls itself.
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
+
+// Data on an interactive stream is written to the connection
+// in writes of at most the interactive record size, so that
+// over TLS, each is sent in a small record. Other streams'
+// data is collected into larger writes.
+func TestInteractiveRecords(t *testing.T) {
+	const size = 5000
+	const record = 1000
+	body := bytes.Repeat([]byte("i"), size)
+
+	tests := []struct {
+		name        string
+		interactive bool
+		upload      bool // whether the client sends the data.
+	}{
+		{"response", false, false},
+		{"interactive response", true, false},
+		{"upload", false, true},
+		{"interactive upload", true, true},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			received := make(chan int, 1)
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				buf := new(bytes.Buffer)
+				buf.ReadFrom(r.Body)
+				received <- buf.Len()
+				if test.interactive && !test.upload {
+					if err := SetInteractive(w); err != nil {
+						t.Error(err)
+					}
+				}
+				if !test.upload {
+					w.Write(body)
+				}
+			})}
+			client, clientWrites, serverWrites := countedPipeConns(t, srv, 3, func(server, client Conn) {
+				for _, conn := range []Conn{server, client} {
+					if err := SetInteractiveRecordSize(conn, record); err != nil {
+						t.Fatal(err)
+					}
+				}
+			})
+
+			ctx := context.Background()
+			if test.interactive && test.upload {
+				ctx = WithInteractive(ctx)
+			}
+			req, _ := http.NewRequest("GET", "https://example.com/", nil)
+			if test.upload {
+				req, _ = http.NewRequest("POST", "https://example.com/", bytes.NewReader(body))
+			}
+			within(t, 5*time.Second, "the request", func() {
+				res, err := request(client, req.WithContext(ctx))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if n := <-received; test.upload && n != size {
+					t.Errorf("the server received %d bytes, want %d", n, size)
+				}
+				if !test.upload && res.Data.Len() != size {
+					t.Errorf("the client received %d bytes, want %d", res.Data.Len(), size)
+				}
+			})
+
+			// The frames carrying the headers and settings are
+			// far smaller than the record size, so only the data
+			// can make a larger write.
+			sender := serverWrites
+			if test.upload {
+				sender = clientWrites
+			}
+			var largest int
+			sender.m.Lock()
+			for _, write := range sender.writes {
+				if len(write) > largest {
+					largest = len(write)
+				}
+			}
+			sender.m.Unlock()
+			if test.interactive && largest > record {
+				t.Errorf("made a write of %d bytes, want at most %d", largest, record)
+			}
+			if !test.interactive && largest <= record {
+				t.Errorf("the largest write was %d bytes, want larger writes", largest)
+			}
+		})
+	}
+}
+
+func TestSetInteractiveErrors(t *testing.T) {
+	if err := SetInteractive(httptest.NewRecorder()); err != ErrNotSPDY {
+		t.Errorf("SetInteractive on an HTTP ResponseWriter gave %v, want ErrNotSPDY", err)
+	}
+	_, client := pipeConns(t, &http.Server{}, 3)
+	if err := SetInteractiveRecordSize(client, 0); err == nil {
+		t.Error("SetInteractiveRecordSize accepted a size of 0")
+	}
+}
+
+// interactiveMessage is the body of each message
+// sent by BenchmarkInteractiveLatency.
+var interactiveMessage = bytes.Repeat([]byte("m"), 64)
+
+// The mean time taken for a 64-byte message to arrive
+// behind an 8MB transfer, over TLS on localhost, on an
+// ordinary stream and on an interactive one. For each
+// message, a bulk response is started, and once it is
+// arriving, the message is requested on an ordinary
+// stream, then on an interactive one. Each message is
+// timed from the request until its response is read.
+func BenchmarkInteractiveLatency(b *testing.B) {
+	const bulk = 8 << 20
+	server := startSPDYServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bulk" {
+			buf := make([]byte, 32<<10)
+			for left := bulk; left > 0; left -= len(buf) {
+				if left < len(buf) {
+					buf = buf[:left]
+				}
+				if _, err := w.Write(buf); err != nil {
+					return
+				}
+			}
+			return
+		}
+
+		if interactive, _ := strconv.ParseBool(r.URL.Query().Get("interactive")); interactive {
+			if err := SetInteractive(w); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Write(interactiveMessage)
+	}))
+	defer server.Close()
+	tr := spdyClient(server)
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr}
+
+	var ordinary, interactive time.Duration
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d, err := latencyRun(client, server.URL, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ordinary += d
+
+		d, err = latencyRun(client, server.URL, true)
+		if err != nil {
+			b.Fatal(err)
+		}
+		interactive += d
+	}
+	b.ReportMetric(float64((ordinary / time.Duration(b.N)).Microseconds()), "ordinary-µs")
+	b.ReportMetric(float64((interactive / time.Duration(b.N)).Microseconds()), "interactive-µs")
+}
+
+// latencyRun times a single message behind a bulk
+// transfer for BenchmarkInteractiveLatency.
+func latencyRun(client *http.Client, base string, interactive bool) (time.Duration, error) {
+	res, err := client.Get(base + "/bulk")
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	// Wait for the bulk transfer to be under way.
+	if _, err := io.ReadFull(res.Body, make([]byte, 1)); err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	msg, err := client.Get(base + "/?interactive=" + strconv.FormatBool(interactive))
+	if err != nil {
+		return 0, err
+	}
+	body, err := ioutil.ReadAll(msg.Body)
+	msg.Body.Close()
+	d := time.Since(start)
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(body, interactiveMessage) {
+		return 0, fmt.Errorf("got message %q, want %q", body, interactiveMessage)
+	}
+
+	// Finish the bulk transfer, so that it
+	// does not affect the next run.
+	_, err = io.Copy(ioutil.Discard, res.Body)
+	return d, err
+}
@@ -1,22 +1,49 @@
 package spdy
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"os"
 	"sort"
 	"sync"
+	"syscall"
+	"time"
 )
 
 /**************
  * Interfaces *
  **************/
 
+// Pusher is implemented by the http.ResponseWriters given to
+// handlers serving SPDY requests, allowing them to push
+// resources to the client.
+//
+//	func handler(w http.ResponseWriter, r *http.Request) {
+//		if pusher, ok := w.(spdy.Pusher); ok {
+//			push, err := pusher.Push("/style.css", http.Header{"Content-Type": {"text/css"}})
+//			if err == nil {
+//				push.Write(css)
+//				push.Close()
+//			}
+//		}
+//		// ...
+//	}
+type Pusher interface {
+	Push(path string, header http.Header) (io.WriteCloser, error)
+}
+
 // Connection represents a SPDY connection. The connection should
 // be started with a call to Run, which will return once the
-// connection has been terminated. The connection can be ended
-// early by using Close.
+// connection has been terminated, with the error which ended it
+// if it was fatal, such as a protocol error by the other endpoint.
+// The connection can be ended early by using Close.
 type Conn interface {
 	io.Closer
 	InitialWindowSize() (uint32, error)
@@ -24,17 +51,50 @@ type Conn interface {
 	Push(url string, origin Stream) (http.ResponseWriter, error)
 	Request(request *http.Request, receiver Receiver, priority Priority) (Stream, error)
 	Run() error
+	Stats() *ConnStats
 }
 
-// Stream contains a single SPDY stream.
+// Stream contains a single SPDY stream. Streams also
+// implement net.Conn, so that other protocols can be
+// carried over a SPDY stream, with Read returning the
+// data received, and Write sending DATA frames, subject
+// to flow control. Close sends a FIN if the stream is
+// still open locally.
+//
+// A Stream behaves as a net.Conn, with two additions.
+// CloseWrite half-closes the stream, sending a FIN after
+// any data written, while data can still be read. Reset
+// ends the stream at once, with a RST_STREAM.
+//
+//   - Data written before a FIN is read before io.EOF.
+//   - A Read or Write blocked when the stream is reset,
+//     by either endpoint, returns a *StreamError.
+//   - Deadlines unblock reads and writes, including
+//     writes waiting for the flow control window, which
+//     fail with os.ErrDeadlineExceeded. Data already
+//     accepted by Write is still sent.
+//   - Close unblocks any Read or Write on the stream.
+//
+// A server's reply is delayed while the start of the
+// response is buffered, so a handler using its stream
+// as a net.Conn should call Flush first.
+//
+// Tags set with SetTag, such as tenant or request IDs,
+// are included in the stream's log lines and snapshots,
+// and in the RequestInfo given to OnRequestComplete.
 type Stream interface {
 	http.ResponseWriter
-	io.ReadCloser
+	net.Conn
+	CloseWrite() error
 	Conn() Conn
+	Priority() Priority
 	ReceiveFrame(Frame) error
+	Reset(StatusCode) error
 	Run() error
+	SetTag(key, value string) error
 	State() *StreamState
 	StreamID() StreamID
+	Tags() map[string]string
 }
 
 // Frame represents a single SPDY frame.
@@ -47,6 +107,9 @@ type Frame interface {
 }
 
 // Compressor is used to compress the text header of a SPDY frame.
+// A frame whose header cannot be compressed is not sent, and its
+// stream is ended, so Compress should check the header before
+// changing its compression state.
 type Compressor interface {
 	io.Closer
 	Compress(http.Header) ([]byte, error)
@@ -78,12 +141,77 @@ type Receiver interface {
 	ReceiveRequest(request *http.Request) bool
 }
 
+// aborter is implemented by Receivers which may
+// reject a response part-way through, in which
+// case the request is cancelled.
+type aborter interface {
+	aborted() error
+}
+
+// closeErrorer is implemented by connections which can
+// explain to streams why the connection has closed.
+type closeErrorer interface {
+	closeError(StreamID) error
+}
+
+// drainer is implemented by connections which
+// can be gracefully drained, finishing any
+// active streams before closing.
+type drainer interface {
+	activeStreams() int
+	drain()
+	goAway()
+}
+
+// keepAliver is implemented by connections which can
+// send PINGs while idle, closing themselves if a reply
+// is not received in time. dead is called before the
+// connection is closed by a missed PING.
+type keepAliver interface {
+	setKeepAlive(interval, timeout time.Duration, dead func())
+}
+
+// timeoutSetter is implemented by client connections
+// which can time out reads and writes, as servers do
+// with the http.Server's ReadTimeout and WriteTimeout.
+type timeoutSetter interface {
+	setTimeouts(read, write time.Duration)
+}
+
+// receiveWindowSetter is implemented by client connections
+// which advertise the initial transfer window of their
+// streams to the server.
+type receiveWindowSetter interface {
+	setReceiveWindowSize(uint32)
+}
+
+// netAddrer is implemented by connections which can
+// report the addresses of their underlying connection.
+type netAddrer interface {
+	netAddrs() (local, remote net.Addr)
+}
+
+// credentialSender is implemented by connections which
+// can send client certificates in CREDENTIAL frames.
+type credentialSender interface {
+	sendCredential(slot uint16, cert tls.Certificate) error
+}
+
+// snapshotter is implemented by connections which
+// can describe their current state.
+type snapshotter interface {
+	snapshot() *ConnSnapshot
+}
+
 /********
  * Ping *
  ********/
 
 // Ping is used in indicating the response from a ping request.
-type Ping struct{}
+// If the ping could not be completed, Err gives the reason.
+type Ping struct {
+	Err error
+}
 
 /************
  * StreamID *
@@ -184,6 +312,31 @@ func (p Priority) Byte(version uint16) byte {
 	}
 }
 
+// EncodePriority returns the priority in the binary form
+// used in SYN_STREAM frames of the given SPDY version, with
+// the unused bits cleared. An error is returned if the
+// priority is out of range for the version.
+func EncodePriority(version uint16, p Priority) (byte, error) {
+	if !p.Valid(version) {
+		return 0, errors.New(fmt.Sprintf("Error: Priority %d is invalid for SPDY/%d.", p, version))
+	}
+	return p.Byte(version), nil
+}
+
+// DecodePriority returns the priority held in the binary
+// form used in SYN_STREAM frames of the given SPDY version.
+// Any unused bits are ignored.
+func DecodePriority(version uint16, b byte) Priority {
+	switch version {
+	case 3:
+		return Priority(b >> 5)
+	case 2:
+		return Priority(b >> 6)
+	default:
+		return 0
+	}
+}
+
 // Valid indicates whether the priority is in the valid
 // range for the given SPDY version.
 func (p Priority) Valid(version uint16) bool {
@@ -227,6 +380,15 @@ func (r StatusCode) String() string {
 	return statusCodeText[r]
 }
 
+// goawayString gives the StatusCode in text form, as
+// sent in a GOAWAY, whose codes differ from RST_STREAM's.
+func (r StatusCode) goawayString() string {
+	if text, ok := goawayStatusText[r]; ok {
+		return text
+	}
+	return fmt.Sprintf("UNKNOWN (%d)", uint32(r))
+}
+
 /************
  * Settings *
  ************/
@@ -242,6 +404,9 @@ type Setting struct {
 // String gives the textual representation of a Setting.
 func (s *Setting) String() string {
 	id := settingText[s.ID] + ":"
+	if !s.Recognised() {
+		id = fmt.Sprintf("UNRECOGNISED(%d):", s.ID)
+	}
 	Flags := ""
 	if s.Flags.PERSIST_VALUE() {
 		Flags += " FLAG_SETTINGS_PERSIST_VALUE"
@@ -258,6 +423,14 @@ func (s *Setting) String() string {
 	return fmt.Sprintf("%-31s %-10d %s", id, s.Value, Flags)
 }
 
+// Recognised indicates whether the setting's ID
+// is defined by SPDY. Unrecognised settings are
+// kept for forward compatibility, but have no
+// effect on the connection.
+func (s *Setting) Recognised() bool {
+	return settingRecognised(s.ID)
+}
+
 // Settings represents a series of settings, stored in a map
 // by setting ID. This ensures that duplicate settings are
 // not sent, since the new value will replace the old.
@@ -354,6 +527,22 @@ func (s *StreamState) CloseHere() {
 	s.Unlock()
 }
 
+// String returns a description of the stream's state.
+func (s *StreamState) String() string {
+	s.RLock()
+	defer s.RUnlock()
+	switch s.s {
+	case stateOpen:
+		return "open"
+	case stateHalfClosedHere:
+		return "half-closed (local)"
+	case stateHalfClosedThere:
+		return "half-closed (remote)"
+	default:
+		return "closed"
+	}
+}
+
 // Half-close the stream at the other endpoint.
 func (s *StreamState) CloseThere() {
 	s.Lock()
@@ -380,6 +569,62 @@ func cloneHeader(h http.Header) http.Header {
 	return h2
 }
 
+// shutdown gracefully closes conn. A GOAWAY is sent, so that
+// no new streams are started, then conn is closed once its
+// active streams have finished. If ctx is done first, conn
+// is closed immediately and ctx's error is returned.
+func shutdown(ctx context.Context, conn Conn) error {
+	d, ok := conn.(drainer)
+	if !ok {
+		conn.Close()
+		return nil
+	}
+
+	d.goAway()
+	for d.activeStreams() > 0 {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			return ctx.Err()
+		case <-defaultClock.After(100 * time.Millisecond):
+		}
+	}
+
+	conn.Close()
+	return nil
+}
+
+// closedThere indicates whether the stream is closed at
+// the other endpoint, or has already been cleaned up.
+func closedThere(stream Stream) bool {
+	if stream == nil {
+		return true
+	}
+	state := stream.State()
+	return state == nil || state.ClosedThere()
+}
+
+// closeState marks the stream's state as closed,
+// if the stream has not already been cleaned up.
+func closeState(stream Stream) {
+	if state := stream.State(); state != nil {
+		state.Close()
+	}
+}
+
+// sendFrame queues frame on output, unless stop is closed
+// first, which happens once the connection has closed and
+// nothing reads output. sendFrame reports whether the frame
+// was queued.
+func sendFrame(output chan<- Frame, stop <-chan struct{}, frame Frame) bool {
+	select {
+	case output <- frame:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
 // updateHeader adds and new name/value pairs and replaces
 // those already existing in the older header.
 func updateHeader(older, newer http.Header) {
@@ -462,18 +707,25 @@ func bytesToUint32(b []byte) uint32 {
 // are required.
 func read(r io.Reader, i int) ([]byte, error) {
 	out := make([]byte, i)
-	in := out[:]
-	for i > 0 {
-		if n, err := r.Read(in); err != nil {
-			return nil, err
-		} else {
-			in = in[n:]
-			i -= n
-		}
+	if err := readInto(r, out); err != nil {
+		return nil, err
 	}
 	return out, nil
 }
 
+// readInto is used to fill buf from r, so that frames
+// of a fixed size can be read without allocating.
+func readInto(r io.Reader, buf []byte) error {
+	for len(buf) > 0 {
+		n, err := r.Read(buf)
+		if err != nil {
+			return err
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
+
 // write is used to ensure that the given data is written
 // if possible, even if multiple calls to Write are
 // required.
@@ -501,6 +753,157 @@ func (r *readCloser) Close() error {
 	return nil
 }
 
+// requestBody holds the body of a request received by a
+// server stream, as it arrives. As with net/http, reads
+// block until data is available or the body has ended.
+type requestBody struct {
+	sync.Mutex
+	ready    *sync.Cond
+	buf      bytes.Buffer
+	err      error       // returned once buf is empty, if the body has ended.
+	deadline time.Time   // after which reads fail, if non-zero.
+	timer    *time.Timer // wakes reads blocked at the deadline.
+	consumed func(int)   // called as data is read or discarded, if non-nil.
+}
+
+func newRequestBody() *requestBody {
+	body := new(requestBody)
+	body.ready = sync.NewCond(&body.Mutex)
+	return body
+}
+
+// receive adds data to the body. Data received once
+// the body has ended is discarded.
+func (b *requestBody) receive(data []byte) {
+	b.Lock()
+	discarded := 0
+	if b.err == nil {
+		b.buf.Write(data)
+	} else {
+		discarded = len(data)
+	}
+	b.Unlock()
+	b.ready.Broadcast()
+	b.consume(discarded)
+}
+
+// finish ends the body. Once any data received has been
+// read, reads return err, or io.EOF if err is nil. Later
+// calls to finish have no effect.
+func (b *requestBody) finish(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+	b.Lock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.Unlock()
+	b.ready.Broadcast()
+}
+
+// discard ends the body, as with finish, and discards
+// any data which has not been read.
+func (b *requestBody) discard(err error) {
+	b.finish(err)
+	b.Lock()
+	discarded := b.buf.Len()
+	b.buf.Reset()
+	b.Unlock()
+	b.consume(discarded)
+}
+
+// consume reports n bytes as read or discarded, so
+// that flow control can make room for more. It must
+// be called without the body's lock held.
+func (b *requestBody) consume(n int) {
+	if n > 0 && b.consumed != nil {
+		b.consumed(n)
+	}
+}
+
+// setDeadline sets the time after which reads fail
+// with os.ErrDeadlineExceeded. A zero time means reads
+// do not time out.
+func (b *requestBody) setDeadline(t time.Time) {
+	b.Lock()
+	defer b.Unlock()
+	b.deadline = t
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if !t.IsZero() {
+		b.timer = time.AfterFunc(time.Until(t), b.ready.Broadcast)
+	}
+	b.ready.Broadcast()
+}
+
+// expired indicates whether the deadline has passed. It
+// must be called with the body's lock held.
+func (b *requestBody) expired() bool {
+	return !b.deadline.IsZero() && !time.Now().Before(b.deadline)
+}
+
+func (b *requestBody) Read(out []byte) (int, error) {
+	n, err := b.read(out)
+	b.consume(n)
+	return n, err
+}
+
+func (b *requestBody) read(out []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	for b.buf.Len() == 0 && b.err == nil {
+		if b.expired() {
+			return 0, os.ErrDeadlineExceeded
+		}
+		b.ready.Wait()
+	}
+	if b.expired() {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if b.buf.Len() > 0 {
+		return b.buf.Read(out)
+	}
+	return 0, b.err
+}
+
+// Close discards the rest of the body.
+func (b *requestBody) Close() error {
+	b.discard(errBodyClosed)
+	return nil
+}
+
+var errBodyClosed = errors.New("Error: Read on closed request body.")
+
+// bodyAllowed indicates whether a response with
+// the given status code may have a body.
+func bodyAllowed(code int) bool {
+	return code != 204 && code != 304 && code/100 != 1
+}
+
+// pushWriter is the io.WriteCloser returned by
+// Pusher.Push. Closing it finishes the push.
+type pushWriter struct {
+	io.Writer
+	finish func() error
+}
+
+func (p *pushWriter) Close() error {
+	return p.finish()
+}
+
+// errReader is an io.Reader which
+// always returns the given error.
+type errReader struct {
+	err error
+}
+
+func (e errReader) Read([]byte) (int, error) {
+	return 0, e.err
+}
+
 /**********
  * Errors *
  **********/
@@ -522,6 +925,100 @@ func (u unsupportedVersion) Error() string {
 	return fmt.Sprintf("Error: Unsupported SPDY version: %d.\n", u)
 }
 
+func (u unsupportedVersion) Unwrap() error {
+	return ErrUnsupportedVersion
+}
+
+// versionMismatch is returned when a control frame
+// with the wrong SPDY version has been skipped.
+type versionMismatch struct {
+	Version  uint16
+	StreamID StreamID // zero if the frame was connection-scoped.
+}
+
+func (v *versionMismatch) Error() string {
+	return fmt.Sprintf("Error: Received frame with unsupported SPDY version %d.", v.Version)
+}
+
+func (v *versionMismatch) Unwrap() error {
+	return ErrUnsupportedVersion
+}
+
+// skipFrame discards a control frame whose version is not
+// that of the connection, so that the connection can carry
+// on. The returned *versionMismatch gives the frame's
+// version and, if the frame is scoped to a stream, its
+// stream ID.
+func skipFrame(reader *bufio.Reader) error {
+	header, err := reader.Peek(8)
+	if err != nil {
+		return err
+	}
+
+	mismatch := new(versionMismatch)
+	mismatch.Version = (uint16(header[0]&0x7f) << 8) + uint16(header[1])
+	length := int(bytesToUint24(header[5:8]))
+
+	// The types of stream-scoped frames are the
+	// same in each version.
+	switch bytesToUint16(header[2:4]) {
+	case SYN_STREAMv3, SYN_REPLYv3, RST_STREAMv3, HEADERSv3, WINDOW_UPDATEv3:
+		if length >= 4 {
+			header, err = reader.Peek(12)
+			if err != nil {
+				return err
+			}
+			mismatch.StreamID = StreamID(bytesToUint32(header[8:12]) & 0x7fffffff)
+		}
+	}
+
+	if _, err := reader.Discard(8 + length); err != nil {
+		return err
+	}
+
+	return mismatch
+}
+
+// skipUnknownFrame discards a control frame whose type is
+// not recognised, as the SPDY specification requires, so
+// that the connection can carry on. The returned
+// *unknownFrame gives the frame's type.
+func skipUnknownFrame(reader *bufio.Reader) error {
+	header, err := reader.Peek(8)
+	if err != nil {
+		return err
+	}
+
+	frameType := bytesToUint16(header[2:4])
+	length := int(bytesToUint24(header[5:8]))
+	if _, err := reader.Discard(8 + length); err != nil {
+		return err
+	}
+
+	return &unknownFrame{frameType}
+}
+
+// frameLength gives the name of a type of control
+// frame, and the shortest and longest lengths which
+// are valid for it, so that a frame's length can be
+// checked before it is read.
+type frameLength struct {
+	name     string
+	min, max int
+}
+
+// check returns a *malformedFrame error if
+// length is not valid for the frame type.
+func (f frameLength) check(length int) error {
+	if length < f.min {
+		return &malformedFrame{f.name, length, f.min}
+	}
+	if length > f.max {
+		return &malformedFrame{f.name, length, f.max}
+	}
+	return nil
+}
+
 type incorrectDataLength struct {
 	got, expected int
 }
@@ -530,6 +1027,45 @@ func (i *incorrectDataLength) Error() string {
 	return fmt.Sprintf("Error: Incorrect amount of data for frame: got %d bytes, expected %d.", i.got, i.expected)
 }
 
+// malformedFrame is returned when a frame, or one of its
+// fields, has a length which is invalid for its type.
+type malformedFrame struct {
+	frame         string
+	got, expected int
+}
+
+func (m *malformedFrame) Error() string {
+	return fmt.Sprintf("Error: Malformed %s frame: got %d bytes, expected %d.", m.frame, m.got, m.expected)
+}
+
+func (m *malformedFrame) Unwrap() error {
+	return ErrMalformedFrame
+}
+
+// oversizedFrame is returned when a frame is larger than
+// the limit on received frames. Its contents are not read.
+type oversizedFrame struct {
+	size, limit int
+}
+
+func (o *oversizedFrame) Error() string {
+	return fmt.Sprintf("Error: Received frame of %d bytes, larger than the limit of %d bytes.", o.size, o.limit)
+}
+
+func (o *oversizedFrame) Unwrap() error {
+	return ErrFrameTooLarge
+}
+
+// unknownFrame is returned when a control frame of an
+// unrecognised type has been skipped.
+type unknownFrame struct {
+	Type uint16
+}
+
+func (u *unknownFrame) Error() string {
+	return fmt.Sprintf("Error: Skipped control frame with unknown type %d.", u.Type)
+}
+
 var frameTooLarge = errors.New("Error: Frame too large.")
 
 type invalidField struct {
@@ -544,3 +1080,172 @@ func (i *invalidField) Error() string {
 var streamIdTooLarge = errors.New("Error: Stream ID is too large.")
 
 var streamIdIsZero = errors.New("Error: Stream ID is zero.")
+
+var settingIdIsZero = errors.New("Error: Setting ID is zero.")
+
+// duplicateHeader indicates that a header which may
+// only be given once was duplicated in a header block.
+type duplicateHeader string
+
+func (d duplicateHeader) Error() string {
+	return fmt.Sprintf("Error: Header %q was duplicated.", string(d))
+}
+
+var errConnClosed = errors.New("Error: Connection closed.")
+
+// errNoReply is given by a client stream for response
+// data received before the response's SYN_REPLY.
+var errNoReply = errors.New("Error: Received DATA before SYN_REPLY.")
+
+// teardownError indicates whether an error from reading or
+// writing the underlying connection is part of its normal
+// teardown, such as the other endpoint disconnecting, the
+// connection being closed locally, or a timeout. If so, the
+// error is normalised, as the errors given vary between
+// platforms, and between sockets and in-memory connections
+// such as net.Pipe, which give io.ErrClosedPipe.
+func teardownError(err error) (error, bool) {
+	if err == io.EOF {
+		return io.EOF, true
+	}
+	if errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
+		return errConnClosed, true
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return io.EOF, true
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return ErrTimeout, true
+	}
+	return err, false
+}
+
+// ProtocolError describes a protocol error by the other
+// endpoint, which ended the connection. Err gives the kind
+// of error, such as ErrInvalidStreamID, so that the cause
+// can be tested with errors.Is.
+type ProtocolError struct {
+	StreamID StreamID // stream on which the error occurred, or zero.
+	Err      error    // kind of error.
+	Msg      string   // description of the error.
+}
+
+func (p *ProtocolError) Error() string {
+	return p.Msg
+}
+
+func (p *ProtocolError) Unwrap() error {
+	return p.Err
+}
+
+// GoAwayError is recorded as the reason for a connection
+// closing when the other endpoint sends a GOAWAY with an
+// error status, such as PROTOCOL_ERROR or INTERNAL_ERROR.
+// Requests made once it has been received fail with the
+// GoAwayError, and streams still in progress when the
+// connection closes fail with a ConnClosedError whose
+// Reason is the GoAwayError. It wraps ErrGoAway, so can
+// be tested with errors.Is.
+type GoAwayError struct {
+	LastGoodStreamID StreamID
+	Status           StatusCode
+}
+
+func (g *GoAwayError) Error() string {
+	return fmt.Sprintf("Error: Connection going away with %s.", g.Status.goawayString())
+}
+
+func (g *GoAwayError) Unwrap() error {
+	return ErrGoAway
+}
+
+// ConnClosedError is returned when a stream is used
+// after its connection has closed. Reason gives the
+// reason for the connection closing, and Acknowledged
+// indicates whether the other endpoint's GOAWAY
+// confirmed that it had processed the stream, in
+// which case it may have received a partial response.
+type ConnClosedError struct {
+	StreamID     StreamID
+	Reason       error
+	Acknowledged bool
+}
+
+func (c *ConnClosedError) Error() string {
+	return fmt.Sprintf("Error: Stream %d's connection closed: %v", c.StreamID, c.Reason)
+}
+
+func (c *ConnClosedError) Unwrap() error {
+	return c.Reason
+}
+
+// ConnError returns the reason the connection closed,
+// such as a read error or a protocol error by the other
+// endpoint. If conn has not closed, ConnError returns nil.
+func ConnError(conn Conn) error {
+	if c, ok := conn.(closeErrorer); ok {
+		if err, ok := c.closeError(0).(*ConnClosedError); ok {
+			return err.Reason
+		}
+	}
+	return nil
+}
+
+// settingsReceiver is implemented by connections
+// which record the SETTINGS sent by the peer.
+type settingsReceiver interface {
+	peerSettings() map[uint32]Setting
+}
+
+// ReceivedSettings returns a copy of the settings which
+// the other endpoint of conn has sent, mapped to their IDs,
+// with the latest value of each. Clients can use this to
+// respect a server's limits, and handlers, given the
+// connection by their ResponseWriter's Conn method, to
+// adapt to those advertised by the client. See also
+// ConnHooks.OnSettings.
+//
+//	func handler(w http.ResponseWriter, r *http.Request) {
+//		if s, ok := w.(spdy.Stream); ok {
+//			settings, _ := spdy.ReceivedSettings(s.Conn())
+//			if bw, ok := settings[spdy.SETTINGS_DOWNLOAD_BANDWIDTH]; ok {
+//				// ...
+//			}
+//		}
+//	}
+func ReceivedSettings(conn Conn) (map[uint32]Setting, error) {
+	r, ok := conn.(settingsReceiver)
+	if !ok {
+		return nil, ErrNotSPDY
+	}
+	return r.peerSettings(), nil
+}
+
+// TLSState returns the state of conn's TLS session, or
+// nil if conn is not using TLS. The same state is given
+// to handlers in each request's TLS field.
+func TLSState(conn Conn) *tls.ConnectionState {
+	if c, ok := conn.(interface {
+		TLSState() *tls.ConnectionState
+	}); ok {
+		return c.TLSState()
+	}
+	return nil
+}
+
+// StreamError indicates that a stream was ended
+// with a RST_STREAM, giving the status code sent.
+// Remote indicates whether the stream was reset
+// by the other endpoint.
+type StreamError struct {
+	StreamID StreamID
+	Status   StatusCode
+	Remote   bool
+}
+
+func (s *StreamError) Error() string {
+	if s.Remote {
+		return fmt.Sprintf("Error: Stream %d was reset by the other endpoint with status %s.", s.StreamID, s.Status)
+	}
+	return fmt.Sprintf("Error: Stream %d was reset with status %s.", s.StreamID, s.Status)
+}
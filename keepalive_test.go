@@ -0,0 +1,205 @@
+package spdy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Any frame received resets a connection's idle time, so
+// a busy connection is not pinged. When a keep-alive PING
+// is missed, requests in flight fail with ErrPingTimeout.
+func TestKeepAliveIdleTime(t *testing.T) {
+	const interval = time.Minute
+	const timeout = 10 * time.Second
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			clock := newFakeClock()
+			dead := make(chan struct{})
+			client, conn := rawClientConnWith(t, version, func(c Conn) {
+				setClock(c, clock)
+				c.(keepAliver).setKeepAlive(interval, timeout, func() { close(dead) })
+			})
+
+			// The peer never answers, passing on the IDs
+			// of the PINGs it is sent.
+			pings := make(chan uint32, 10)
+			go func() {
+				for {
+					frame, err := readRawFrame(conn, version)
+					if err != nil {
+						return
+					}
+					switch frame := frame.(type) {
+					case *pingFrameV3:
+						pings <- frame.PingID
+					case *pingFrameV2:
+						pings <- frame.PingID
+					}
+				}
+			}()
+			next := func() uint32 {
+				select {
+				case id := <-pings:
+					return id
+				case <-time.After(5 * time.Second):
+					t.Fatal("no PING was sent")
+					return 0
+				}
+			}
+
+			// A request is left in flight.
+			errs := make(chan error, 1)
+			go func() {
+				req, _ := http.NewRequest("GET", "https://example.com/", nil)
+				_, err := request(client, req)
+				errs <- err
+			}()
+
+			// Just before the interval, the peer sends a
+			// PING, which the client answers.
+			clock.waitPending(t, 1)
+			clock.Advance(interval - time.Second)
+			conn.Write([]byte{0x80, byte(version), 0, 6, 0, 0, 0, 4, 0, 0, 0, 2})
+			if id := next(); id != 2 {
+				t.Fatalf("sent PING %d, want the reply to PING 2", id)
+			}
+
+			// So the keep-alive PING waits a full interval
+			// from the peer's.
+			clock.Advance(time.Second)
+			within(t, 5*time.Second, "the keep-alive timer", func() {
+				for {
+					if d, ok := clock.Next(); ok && d == interval-time.Second {
+						return
+					}
+					time.Sleep(time.Millisecond)
+				}
+			})
+			select {
+			case id := <-pings:
+				t.Fatalf("sent PING %d while the connection was busy", id)
+			default:
+			}
+			clock.Advance(interval - time.Second)
+			if id := next(); id&1 != 1 {
+				t.Fatalf("sent PING %d, want an odd ID", id)
+			}
+
+			// The reply is missed.
+			clock.waitPending(t, 1)
+			clock.Advance(timeout)
+			select {
+			case <-dead:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the connection was not closed")
+			}
+			select {
+			case err := <-errs:
+				var closed *ConnClosedError
+				if !errors.As(err, &closed) || closed.Reason != ErrPingTimeout {
+					t.Errorf("the request failed with %v, want a ConnClosedError with ErrPingTimeout", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the request was left in flight")
+			}
+		})
+	}
+}
+
+// stallConn discards everything received once stalled,
+// as though the network had silently dropped the path.
+type stallConn struct {
+	net.Conn
+	stalled int32
+}
+
+func (c *stallConn) Read(b []byte) (int, error) {
+	for {
+		n, err := c.Conn.Read(b)
+		if err != nil || atomic.LoadInt32(&c.stalled) == 0 {
+			return n, err
+		}
+	}
+}
+
+// A Transport with PingInterval set detects a stalled
+// connection within PingInterval and PingTimeout, and
+// removes it from its pool, so the next request dials.
+func TestTransportKeepAlive(t *testing.T) {
+	const interval = 50 * time.Millisecond
+	const timeout = 100 * time.Millisecond
+	server := newSPDYServer(t, "alive")
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	var m sync.Mutex
+	var conns []*stallConn
+	tr := NewTransport(server.Client().Transport.(*http.Transport).TLSClientConfig)
+	defer tr.CloseIdleConnections()
+	tr.PingInterval = interval
+	tr.PingTimeout = timeout
+	tr.Dial = func(network, addr string) (net.Conn, error) {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		m.Lock()
+		defer m.Unlock()
+		c := &stallConn{Conn: conn}
+		conns = append(conns, c)
+		return c, nil
+	}
+	client := &http.Client{Transport: tr}
+
+	get := func() {
+		t.Helper()
+		res, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	pooled := func() bool {
+		tr.m.Lock()
+		defer tr.m.Unlock()
+		return tr.spdyConns[host] != nil
+	}
+
+	get()
+	if !pooled() {
+		t.Fatal("the connection was not pooled")
+	}
+
+	// The connection stays while PINGs are answered.
+	time.Sleep(3 * interval)
+	if !pooled() {
+		t.Fatal("a live connection was removed from the pool")
+	}
+
+	m.Lock()
+	atomic.StoreInt32(&conns[0].stalled, 1)
+	m.Unlock()
+	stalled := time.Now()
+	within(t, 5*time.Second, "detecting the stall", func() {
+		for pooled() {
+			time.Sleep(time.Millisecond)
+		}
+	})
+	if d := time.Since(stalled); d > interval+timeout+time.Second {
+		t.Errorf("the stall took %v to detect, want about %v", d, interval+timeout)
+	}
+
+	get()
+	m.Lock()
+	defer m.Unlock()
+	if len(conns) != 2 {
+		t.Errorf("made %d connections, want 2", len(conns))
+	}
+}
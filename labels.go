@@ -0,0 +1,58 @@
+package spdy
+
+import (
+	"context"
+	"runtime/pprof"
+	"strconv"
+	"sync/atomic"
+)
+
+// lastConnID is the ID most recently given
+// to a new connection.
+var lastConnID uint64
+
+// nextConnID returns a new connection ID, which
+// is unique within the process.
+func nextConnID() uint64 {
+	return atomic.AddUint64(&lastConnID, 1)
+}
+
+// labelsKey is the context key for the profiler
+// labels of the stream serving a request.
+type labelsKey struct{}
+
+// connLabels returns the profiler labels for a
+// connection's goroutine with the given role.
+func connLabels(id uint64, remoteAddr, role string) pprof.LabelSet {
+	return pprof.Labels("spdy.conn", strconv.FormatUint(id, 10), "spdy.peer", remoteAddr, "spdy.role", role)
+}
+
+// streamLabels returns the profiler labels for the
+// goroutine serving the given stream.
+func streamLabels(id uint64, remoteAddr string, sid StreamID) pprof.LabelSet {
+	return pprof.Labels("spdy.conn", strconv.FormatUint(id, 10), "spdy.peer", remoteAddr, "spdy.role", "stream",
+		"spdy.stream", strconv.FormatUint(uint64(sid), 10))
+}
+
+// labelGoroutine applies the labels to the current
+// goroutine, and any goroutines it later starts.
+func labelGoroutine(labels pprof.LabelSet) {
+	pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(), labels))
+}
+
+// ProfileLabels returns a copy of ctx carrying the profiler
+// labels of the SPDY connection and stream serving the request
+// whose context is ctx. The goroutine running a Handler is
+// already labelled, but goroutines started with a different
+// context can be attributed to the connection with:
+//
+//	pprof.SetGoroutineLabels(spdy.ProfileLabels(ctx))
+//
+// If ctx did not come from a SPDY request, it is returned
+// unchanged.
+func ProfileLabels(ctx context.Context) context.Context {
+	if labels, ok := ctx.Value(labelsKey{}).(pprof.LabelSet); ok {
+		return pprof.WithLabels(ctx, labels)
+	}
+	return ctx
+}
@@ -0,0 +1,122 @@
+package spdy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// goroutineLabels returns the profiler labels of each
+// running goroutine which has any, as they appear in
+// the goroutine profile.
+func goroutineLabels() []string {
+	var buf bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&buf, 1)
+	var out []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, "# labels: ") {
+			out = append(out, strings.TrimPrefix(line, "# labels: "))
+		}
+	}
+	return out
+}
+
+// hasLabels reports whether a goroutine of the connection
+// with the given ID is running with the role.
+func hasLabels(labels []string, id uint64, role string) bool {
+	conn := fmt.Sprintf("%q:%q", "spdy.conn", strconv.FormatUint(id, 10))
+	role = fmt.Sprintf("%q:%q", "spdy.role", role)
+	for _, l := range labels {
+		if strings.Contains(l, conn) && strings.Contains(l, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// Each connection's long-lived goroutines, and the
+// goroutine serving each stream, carry profiler labels
+// naming the connection and their role. ProfileLabels
+// gives the stream's labels to other goroutines.
+func TestProfileLabels(t *testing.T) {
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			release := make(chan struct{})
+			labels := make(chan map[string]string, 1)
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got := make(map[string]string)
+				pprof.ForLabels(ProfileLabels(r.Context()), func(key, value string) bool {
+					got[key] = value
+					return true
+				})
+				labels <- got
+				<-release
+			})}
+			server, client := pipeConns(t, srv, version)
+			serverID := server.(snapshotter).snapshot().ID
+			clientID := client.(snapshotter).snapshot().ID
+			if serverID == clientID {
+				t.Fatalf("both connections have ID %d", serverID)
+			}
+
+			done := make(chan error, 1)
+			go func() {
+				req, _ := http.NewRequest("GET", "http://example.com/", nil)
+				_, err := request(client, req)
+				done <- err
+			}()
+
+			var got map[string]string
+			within(t, 5*time.Second, "the request", func() { got = <-labels })
+			want := map[string]string{
+				"spdy.conn":   strconv.FormatUint(serverID, 10),
+				"spdy.role":   "stream",
+				"spdy.stream": "1",
+			}
+			for key, value := range want {
+				if got[key] != value {
+					t.Errorf("label %s is %q, want %q", key, got[key], value)
+				}
+			}
+
+			// Newly started goroutines may not have run,
+			// and labelled themselves, yet.
+			roles := map[uint64][]string{
+				serverID: {"read", "send", "headers", "stream"},
+				clientID: {"read", "send", "headers"},
+			}
+			within(t, 5*time.Second, "labelling the goroutines", func() {
+				for {
+					running := goroutineLabels()
+					missing := false
+					for id, want := range roles {
+						for _, role := range want {
+							missing = missing || !hasLabels(running, id, role)
+						}
+					}
+					if !missing {
+						return
+					}
+					time.Sleep(time.Millisecond)
+				}
+			})
+
+			close(release)
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	ctx := context.Background()
+	if ProfileLabels(ctx) != ctx {
+		t.Error("ProfileLabels changed a context from outside SPDY")
+	}
+}
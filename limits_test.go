@@ -0,0 +1,97 @@
+package spdy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A response whose headers exceed MaxResponseHeaderBytes is
+// cancelled, and RoundTrip returns ErrResponseTooLarge. The
+// headers were still decompressed, so the connection can be
+// used for the next request.
+func TestMaxResponseHeaderBytes(t *testing.T) {
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/huge" {
+					for i := 0; i < 64; i++ {
+						w.Header().Set(fmt.Sprintf("X-Huge-%d", i), strings.Repeat("a", 1<<10))
+					}
+				}
+				w.Write([]byte("ok"))
+			})}
+			tr := pipeTransport(t, srv, version)
+			tr.MaxResponseHeaderBytes = 1 << 10
+
+			within(t, 5*time.Second, "the requests", func() {
+				req, _ := http.NewRequest("GET", "https://example.com/huge", nil)
+				if res, err := tr.RoundTrip(req); err != ErrResponseTooLarge {
+					t.Errorf("got %v, error %v, want ErrResponseTooLarge", res, err)
+				}
+
+				req, _ = http.NewRequest("GET", "https://example.com/small", nil)
+				res, err := tr.RoundTrip(req)
+				if err != nil {
+					t.Errorf("the next request failed: %v", err)
+					return
+				}
+				body, err := ioutil.ReadAll(res.Body)
+				if err != nil || string(body) != "ok" {
+					t.Errorf("the next request gave %q, error %v", body, err)
+				}
+			})
+			if n := tr.Stats().ResponsesTooLarge; n != 1 {
+				t.Errorf("%d responses counted as too large, want 1", n)
+			}
+		})
+	}
+}
+
+// An endless response body is cut off at MaxResponseBodyBytes.
+// The stream is cancelled, so the handler's writes fail, and
+// reading the body gives the data within the limit followed
+// by ErrResponseTooLarge.
+func TestMaxResponseBodyBytes(t *testing.T) {
+	const limit = 100000
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			stopped := make(chan error, 1)
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				chunk := make([]byte, 4<<10)
+				for {
+					if _, err := w.Write(chunk); err != nil {
+						stopped <- err
+						return
+					}
+				}
+			})}
+			tr := pipeTransport(t, srv, version)
+			tr.MaxResponseBodyBytes = limit
+
+			within(t, 10*time.Second, "the response", func() {
+				req, _ := http.NewRequest("GET", "https://example.com/", nil)
+				res, err := tr.RoundTrip(req)
+				if err != nil {
+					t.Errorf("RoundTrip gave %v", err)
+					return
+				}
+				body, err := ioutil.ReadAll(res.Body)
+				if len(body) != limit || err != ErrResponseTooLarge {
+					t.Errorf("read %d bytes, error %v, want %d bytes and ErrResponseTooLarge", len(body), err, limit)
+				}
+				if err := <-stopped; err == nil {
+					t.Error("the handler's writes did not fail")
+				}
+			})
+			if n := tr.Stats().ResponsesTooLarge; n != 1 {
+				t.Errorf("%d responses counted as too large, want 1", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package spdy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ParseFrame parses data, which must hold exactly one frame
+// of the given SPDY version, as sent on the wire. This is
+// intended for tools, such as frame inspectors and proxies,
+// which handle frames outside of a connection.
+//
+// The header blocks of SYN_STREAM, SYN_REPLY and HEADERS
+// frames are left compressed, as their compression depends
+// on the header blocks sent before them on the connection.
+// They can be read by calling the frame's Decompress method
+// with a Decompressor used for each header block in turn,
+// such as one from NewDecompressor.
+//
+// A control frame of another version gives an error which
+// wraps ErrUnsupportedVersion, and a frame whose length, or
+// the length of one of its fields, is invalid for its type
+// gives an error which wraps ErrMalformedFrame. Frames with
+// flags which are undefined for their type keep those
+// flags, except for frames with no flags at all, such as
+// PING, which are rejected.
+func ParseFrame(data []byte, version uint16) (Frame, error) {
+	// Check the frame's length against the data, so that
+	// no more space is allocated than the data could fill.
+	if len(data) >= 8 {
+		size := 8 + int(bytesToUint24(data[5:8]))
+		if size > len(data) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if size < len(data) {
+			return nil, errors.New(fmt.Sprintf("Error: Found %d bytes of data after the frame.", len(data)-size))
+		}
+	}
+
+	src := bytes.NewReader(data)
+	reader := bufio.NewReaderSize(src, 16)
+
+	var frame Frame
+	var err error
+	switch version {
+	case 3:
+		frame, err = readFrameV3(reader, nil, MAX_FRAME_SIZE)
+	case 2:
+		frame, err = readFrameV2(reader, nil, MAX_FRAME_SIZE)
+	default:
+		return nil, unsupportedVersion(version)
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if n := src.Len() + reader.Buffered(); n > 0 {
+		return nil, errors.New(fmt.Sprintf("Error: Found %d bytes of data after the frame.", n))
+	}
+
+	return frame, nil
+}
+
+// MarshalFrame returns the wire encoding of frame, such as
+// one returned by ParseFrame. The header block of a frame
+// which has one must be compressed first, with the frame's
+// Compress method, unless the frame came from ParseFrame
+// and has not been decompressed since, in which case its
+// original header block is used.
+func MarshalFrame(frame Frame) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if _, err := frame.WriteTo(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,268 @@
+package spdy_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/SlyMarbo/spdy"
+)
+
+// wire decodes a frame written in hex, ignoring spaces.
+func wire(s string) []byte {
+	b, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// goldenFrames are frames of every type, as sent on the wire,
+// which must parse and marshal back to the same bytes.
+var goldenFrames = []struct {
+	name    string
+	version uint16
+	wire    string
+}{
+	// SPDY/3.
+	{"SYN_STREAM", 3, "8003 0001 01 00000e 00000001 00000000 6000 aabbcc dd"},
+	{"SYN_STREAM undefined flags", 3, "8003 0001 fe 00000a 00000003 00000001 e005"},
+	{"SYN_REPLY", 3, "8003 0002 01 000006 00000001 aabb"},
+	{"SYN_REPLY undefined flags", 3, "8003 0002 f0 000004 00000001"},
+	{"RST_STREAM", 3, "8003 0003 00 000008 00000001 00000005"},
+	{"SETTINGS", 3, "8003 0004 01 000014 00000002 01000004 00000064 02000007 00010000"},
+	{"SETTINGS no entries", 3, "8003 0004 00 000004 00000000"},
+	{"SETTINGS undefined flags", 3, "8003 0004 fe 000004 00000000"},
+	{"SETTINGS unrecognised ID", 3, "8003 0004 00 00000c 00000001 00303030 00000001"},
+	{"PING", 3, "8003 0006 00 000004 0000002a"},
+	{"GOAWAY", 3, "8003 0007 00 000008 00000007 00000001"},
+	{"HEADERS", 3, "8003 0008 01 000007 00000003 aabbcc"},
+	{"HEADERS undefined flags", 3, "8003 0008 fe 000004 00000003"},
+	{"WINDOW_UPDATE", 3, "8003 0009 00 000008 00000001 00010000"},
+	{"WINDOW_UPDATE session", 3, "8003 0009 00 000008 00000000 7fffffff"},
+	{"CREDENTIAL", 3, "8003 000a 00 00000a 0001 00000004 aabbccdd"},
+	{"DATA", 3, "00000001 00 000003 616263"},
+	{"DATA empty FIN", 3, "00000001 01 000000"},
+	{"DATA undefined flags", 3, "00000001 fe 000001 00"},
+
+	// SPDY/2.
+	{"SYN_STREAM", 2, "8002 0001 01 00000e 00000001 00000000 c000 aabbcc dd"},
+	{"SYN_STREAM undefined flags", 2, "8002 0001 fc 00000c 00000003 00000001 4000 0000"},
+	{"SYN_REPLY", 2, "8002 0002 01 000008 00000001 0000 aabb"},
+	{"RST_STREAM", 2, "8002 0003 00 000008 00000001 00000005"},
+	{"SETTINGS", 2, "8002 0004 01 00000c 00000001 04000001 00000064"},
+	{"SETTINGS no entries", 2, "8002 0004 00 000004 00000000"},
+	{"SETTINGS undefined flags", 2, "8002 0004 fe 000004 00000000"},
+	{"SETTINGS unrecognised ID", 2, "8002 0004 00 00000c 00000001 30303000 00000001"},
+	{"NOOP", 2, "8002 0005 00 000000"},
+	{"PING", 2, "8002 0006 00 000004 0000002a"},
+	{"GOAWAY", 2, "8002 0007 00 000004 00000007"},
+	{"HEADERS", 2, "8002 0008 00 000008 00000003 0000 aabb"},
+	{"HEADERS FIN", 2, "8002 0008 01 00000a 00000003 0000 aabbccdd"},
+	{"WINDOW_UPDATE", 2, "8002 0009 00 000008 00000001 00010000"},
+	{"DATA", 2, "00000001 00 000003 616263"},
+	{"DATA empty FIN", 2, "00000001 01 000000"},
+	{"DATA empty", 2, "00000001 00 000000"},
+}
+
+func TestGoldenFrames(t *testing.T) {
+	for _, test := range goldenFrames {
+		data := wire(test.wire)
+		frame, err := spdy.ParseFrame(data, test.version)
+		if err != nil {
+			t.Errorf("SPDY/%d %s: ParseFrame: %v", test.version, test.name, err)
+			continue
+		}
+		out, err := spdy.MarshalFrame(frame)
+		if err != nil {
+			t.Errorf("SPDY/%d %s: MarshalFrame: %v", test.version, test.name, err)
+			continue
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("SPDY/%d %s: marshalled to\n\t%x\nwant\n\t%x", test.version, test.name, out, data)
+		}
+
+		// Truncated frames and trailing data are rejected.
+		for i := 0; i < len(data); i++ {
+			if _, err := spdy.ParseFrame(data[:i], test.version); err == nil {
+				t.Errorf("SPDY/%d %s: accepted frame truncated to %d bytes", test.version, test.name, i)
+			}
+		}
+		if _, err := spdy.ParseFrame(append(data, 0), test.version); err == nil {
+			t.Errorf("SPDY/%d %s: accepted trailing data", test.version, test.name)
+		}
+	}
+}
+
+// rejectedFrames are frames which must not parse.
+var rejectedFrames = []struct {
+	name    string
+	version uint16
+	wire    string
+}{
+	{"RST_STREAM with flags", 3, "8003 0003 01 000008 00000001 00000005"},
+	{"PING with flags", 3, "8003 0006 01 000004 0000002a"},
+	{"GOAWAY with flags", 3, "8003 0007 01 000008 00000007 00000001"},
+	{"WINDOW_UPDATE with flags", 3, "8003 0009 01 000008 00000001 00010000"},
+	{"CREDENTIAL with flags", 3, "8003 000a 01 00000a 0001 00000004 aabbccdd"},
+	{"CREDENTIAL with long proof", 3, "8003 000a 00 00000a 0001 00000005 aabbccdd"},
+	{"DATA empty without FIN", 3, "00000001 00 000000"},
+	{"DATA empty with undefined flags", 3, "00000001 30 000000"},
+	{"PING too short", 3, "8003 0006 00 000003 000000"},
+	{"SYN_REPLY on stream 0", 3, "8003 0002 00 000004 00000000"},
+	{"SETTINGS with ID 0", 3, "8003 0004 00 00000c 00000001 00000000 00000001"},
+	{"RST_STREAM with flags", 2, "8002 0003 01 000008 00000001 00000005"},
+	{"NOOP with flags", 2, "8002 0005 01 000000"},
+	{"PING with flags", 2, "8002 0006 01 000004 0000002a"},
+	{"GOAWAY with flags", 2, "8002 0007 01 000004 00000007"},
+	{"SYN_REPLY on stream 0", 2, "8002 0002 00 000006 00000000 0000"},
+	{"SETTINGS with ID 0", 2, "8002 0004 00 00000c 00000001 00000000 00000001"},
+	{"SPDY/3 frame", 2, "8003 0006 00 000004 0000002a"},
+}
+
+func TestRejectedFrames(t *testing.T) {
+	for _, test := range rejectedFrames {
+		if frame, err := spdy.ParseFrame(wire(test.wire), test.version); err == nil {
+			t.Errorf("SPDY/%d %s: accepted as %v", test.version, test.name, frame)
+		}
+	}
+
+	_, err := spdy.ParseFrame(wire("8003 0006 00 000004 0000002a"), 2)
+	if !errors.Is(err, spdy.ErrUnsupportedVersion) {
+		t.Errorf("SPDY/3 frame parsed as SPDY/2 gave %v, want ErrUnsupportedVersion", err)
+	}
+	if _, err := spdy.ParseFrame(wire("00000001 01 000000"), 4); !errors.Is(err, spdy.ErrUnsupportedVersion) {
+		t.Errorf("SPDY/4 gave %v, want ErrUnsupportedVersion", err)
+	}
+}
+
+// A SPDY/3 GOAWAY without a status is parsed as
+// GOAWAY_OK, and marshalled with the status.
+func TestGoawayWithoutStatus(t *testing.T) {
+	frame, err := spdy.ParseFrame(wire("8003 0007 00 000004 00000007"), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := spdy.MarshalFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := wire("8003 0007 00 000008 00000007 00000000"); !bytes.Equal(out, want) {
+		t.Fatalf("marshalled to %x, want %x", out, want)
+	}
+}
+
+// Header blocks survive decompression and
+// compression with a fresh compressor.
+func TestHeaderBlockRoundTrip(t *testing.T) {
+	for _, version := range []uint16{3, 2} {
+		block, err := spdy.NewCompressor(version).Compress(http.Header{"Foo": {"bar"}, ":status": {"200"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var data []byte
+		if version == 3 {
+			n := 4 + len(block)
+			data = append(wire("8003 0002 00"), byte(n>>16), byte(n>>8), byte(n))
+			data = append(data, wire("00000001")...)
+		} else {
+			n := 6 + len(block)
+			data = append(wire("8002 0002 00"), byte(n>>16), byte(n>>8), byte(n))
+			data = append(data, wire("00000001 0000")...)
+		}
+		data = append(data, block...)
+
+		frame, err := spdy.ParseFrame(data, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := frame.Decompress(spdy.NewDecompressor(version)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := spdy.MarshalFrame(frame); err == nil {
+			t.Errorf("SPDY/%d: marshalled a decompressed frame without compressing it", version)
+		}
+		if err := frame.Compress(spdy.NewCompressor(version)); err != nil {
+			t.Fatal(err)
+		}
+		out, err := spdy.MarshalFrame(frame)
+		if err != nil || !bytes.Equal(out, data) {
+			t.Errorf("SPDY/%d: marshalled to %x, error %v, want %x", version, out, err, data)
+		}
+	}
+}
+
+// A SPDY/2 HEADERS frame's length counts the stream ID,
+// the 2 unused bytes which follow it, and the header block.
+func TestHeadersV2Length(t *testing.T) {
+	block, err := spdy.NewCompressor(2).Compress(http.Header{"X-Checksum": {"abc"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 6 + len(block)
+	data := append(wire("8002 0008 01"), byte(n>>16), byte(n>>8), byte(n))
+	data = append(data, wire("00000001 0000")...)
+	data = append(data, block...)
+
+	frame, err := spdy.ParseFrame(data, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := spdy.MarshalFrame(frame)
+	if err != nil || !bytes.Equal(out, data) {
+		t.Fatalf("marshalled to %x, error %v, want %x", out, err, data)
+	}
+	if err := frame.Decompress(spdy.NewDecompressor(2)); err != nil {
+		t.Fatal(err)
+	}
+	if s := frame.String(); !strings.Contains(s, "X-Checksum") {
+		t.Errorf("the header block was not read whole: %s", s)
+	}
+
+	// Neither less nor more is read.
+	if _, err := spdy.ParseFrame(data[:len(data)-1], 2); err == nil {
+		t.Error("parsed a frame without the end of its header block")
+	}
+	if _, err := spdy.ParseFrame(append(data, 0), 2); err == nil {
+		t.Error("parsed a frame with data beyond its length")
+	}
+}
+
+// Header blocks may fill the 24-bit length
+// field, and no more.
+func TestMaxHeaderBlock(t *testing.T) {
+	const max = 0xffffff - 8
+	for _, version := range []uint16{3, 2} {
+		fixed := 4
+		if version == 2 {
+			fixed = 6
+		}
+		for _, n := range []int{max, max + 1} {
+			data := []byte{0x80, byte(version), 0x00, 0x08, 0x00, byte(n >> 16), byte(n >> 8), byte(n)}
+			data = append(data, 0, 0, 0, 1)
+			if version == 2 {
+				data = append(data, 0, 0)
+			}
+			data = append(data, make([]byte, n-fixed)...)
+
+			frame, err := spdy.ParseFrame(data, version)
+			if n > max {
+				if err == nil {
+					t.Errorf("SPDY/%d: accepted a HEADERS frame of %d bytes", version, n)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("SPDY/%d: ParseFrame: %v", version, err)
+			}
+			out, err := spdy.MarshalFrame(frame)
+			if err != nil || !bytes.Equal(out, data) {
+				t.Errorf("SPDY/%d: maximum HEADERS frame did not round-trip: %v", version, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package spdy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// rawHeaders returns a HEADERS frame, as sent on the
+// wire, with the given compressed header block.
+func rawHeaders(version uint16, sid StreamID, block []byte) []byte {
+	data := []byte{byte(sid >> 24), byte(sid >> 16), byte(sid >> 8), byte(sid)}
+	if version == 2 {
+		data = append(data, 0, 0)
+	}
+	data = append(data, block...)
+	n := len(data)
+	return append([]byte{0x80, byte(version), 0, 8, 0, byte(n >> 16), byte(n >> 8), byte(n)}, data...)
+}
+
+// A stream may carry up to the limit of HEADERS frames,
+// after which it is reset with a PROTOCOL_ERROR. The
+// frames are still decompressed, so the next request
+// on the connection is read correctly.
+func TestMaxHeaders(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int // negative for the default.
+		want  int
+	}{
+		{"default", -1, DEFAULT_MAX_HEADERS},
+		{"one", 1, 1},
+		{"none", 0, 0},
+	}
+
+	for _, version := range versions {
+		for _, test := range tests {
+			version, test := version, test
+			t.Run(fmt.Sprintf("SPDY/%d/%s", version, test.name), func(t *testing.T) {
+				paths := make(chan string, 2)
+				srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					paths <- r.URL.Path
+					ioutil.ReadAll(r.Body)
+				})}
+				conn := rawServerConnWith(t, srv, version, func(server Conn) {
+					if test.limit >= 0 {
+						if err := SetMaxHeaders(server, test.limit); err != nil {
+							t.Fatal(err)
+						}
+					}
+				})
+
+				frames := make(chan Frame, 100)
+				go func() {
+					defer close(frames)
+					for {
+						frame, err := readRawFrame(conn, version)
+						if err != nil {
+							return
+						}
+						frames <- frame
+					}
+				}()
+
+				// next returns the next PING, RST_STREAM,
+				// SYN_REPLY, or GOAWAY.
+				next := func() Frame {
+					for {
+						select {
+						case frame, ok := <-frames:
+							if !ok {
+								t.Fatal("the connection closed")
+							}
+							switch frame.(type) {
+							case *pingFrameV3, *pingFrameV2, *rstStreamFrameV3, *rstStreamFrameV2,
+								*synReplyFrameV3, *synReplyFrameV2, *goawayFrameV3, *goawayFrameV2:
+								return frame
+							}
+						case <-time.After(5 * time.Second):
+							t.Fatal("no frame was received")
+						}
+					}
+				}
+
+				// The request has a body to come, so the
+				// stream stays open for HEADERS.
+				c := newRawCompressor(version)
+				syn := rawSynStream(version, 1, c.block(rawRequest(version, "/first")...))
+				syn[4] = 0
+				headers := make([][]byte, test.want+1)
+				for i := range headers {
+					headers[i] = rawHeaders(version, 1, c.block("x-count", fmt.Sprint(i)))
+				}
+				ping := []byte{0x80, byte(version), 0, 6, 0, 0, 0, 4, 0, 0, 0, 1}
+
+				go func() {
+					conn.Write(syn)
+					for _, h := range headers[:test.want] {
+						conn.Write(h)
+					}
+					conn.Write(ping)
+				}()
+				switch frame := next().(type) {
+				case *pingFrameV3, *pingFrameV2:
+				default:
+					t.Fatalf("received %v within the limit", frame)
+				}
+
+				go func() {
+					conn.Write(headers[test.want])
+					conn.Write(rawSynStream(version, 3, c.block(rawRequest(version, "/second")...)))
+				}()
+				var reset, replied bool
+				for !reset || !replied {
+					switch frame := next().(type) {
+					case *rstStreamFrameV3:
+						reset = frame.StreamID == 1 && frame.Status == RST_STREAM_PROTOCOL_ERROR
+					case *rstStreamFrameV2:
+						reset = frame.StreamID == 1 && frame.Status == RST_STREAM_PROTOCOL_ERROR
+					case *synReplyFrameV3:
+						replied = frame.StreamID == 3
+					case *synReplyFrameV2:
+						replied = frame.StreamID == 3
+					default:
+						t.Fatalf("received %v", frame)
+					}
+				}
+
+				for _, want := range []string{"/first", "/second"} {
+					if path := <-paths; path != want {
+						t.Errorf("handler saw %q, want %q", path, want)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package spdy
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// ConnMigration describes the replacement of a pooled SPDY
+// connection which died while requests were in progress.
+// See Transport.MigrateConnections.
+type ConnMigration struct {
+	Host         string   // host:port of the connection.
+	OldLocalAddr net.Addr // local address of the connection which died.
+	NewLocalAddr net.Addr // local address of its replacement, or nil if it could not be made.
+	Replayed     int      // requests replayed on the new connection.
+	Failed       int      // requests failed with ErrConnectionMigrated.
+}
+
+// migration tracks the requests which were in
+// progress on a connection when it died.
+type migration struct {
+	ConnMigration
+	pending int           // requests yet to finish.
+	ready   chan struct{} // closed once the replacement has been dialled.
+}
+
+// replayedKey marks the context of a
+// request which has been replayed.
+type replayedKey struct{}
+
+// replayable indicates whether the request can safely
+// be sent again after its connection died. Requests
+// whose method is idempotent, or which carry an
+// Idempotency-Key header, are replayable, as are those
+// accepted by the replay function, if it is not nil.
+// Requests whose body cannot be recreated are never
+// replayable, nor are requests which have already been
+// replayed.
+func replayable(req *http.Request, replay func(*http.Request) bool) bool {
+	if req.Context().Value(replayedKey{}) != nil {
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+
+	switch req.Method {
+	case "", "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	if _, ok := req.Header["Idempotency-Key"]; ok {
+		return true
+	}
+	if _, ok := req.Header["X-Idempotency-Key"]; ok {
+		return true
+	}
+
+	return replay != nil && replay(req)
+}
+
+// retryUnprocessed indicates whether a request which the server
+// did not process can be sent again on a new connection.
+// Requests which were never sent are always retryable;
+// those which were sent must also be replayable. As with
+// replays, each request is only retried once.
+func retryUnprocessed(req *http.Request, unsent bool, replay func(*http.Request) bool) bool {
+	if unsent {
+		return req.Context().Value(replayedKey{}) == nil
+	}
+	return replayable(req, replay)
+}
+
+// migrate is called when a request made on a pooled SPDY
+// connection finishes, with the error it finished with, if
+// any. unsent indicates that the request could not be sent.
+// If the connection has died, it is removed from the pool
+// and a replacement is dialled, and migrate indicates
+// whether the request should be replayed on the new
+// connection, having waited for it to be dialled. Requests
+// which were in progress but cannot be replayed fail with
+// ErrConnectionMigrated. Otherwise, err is returned.
+func (t *Transport) migrate(host string, conn Conn, req *http.Request, unsent bool, err error) (bool, error) {
+	t.m.Lock()
+
+	remaining := t.release(conn)
+
+	_, closed := err.(*ConnClosedError)
+	m := t.migrations[conn]
+	if m == nil {
+		if !(closed || unsent) || ConnError(conn) == nil {
+			t.m.Unlock()
+			return false, err
+		}
+
+		debug.Printf("SPDY connection to %q died. Migrating requests.\n", host)
+		m = &migration{pending: remaining + 1, ready: make(chan struct{})}
+		m.Host = host
+		if t.spdyConns[host] == conn {
+			m.OldLocalAddr = t.connAddrs[host]
+		}
+
+		// The connection's slot can be used by its replacement.
+		t.unpool(host, conn)
+		if t.migrations == nil {
+			t.migrations = make(map[Conn]*migration)
+		}
+		t.migrations[conn] = m
+		go t.redial(m)
+	}
+
+	// Requests which could not be sent are always
+	// retried, but were not in progress, so are
+	// not counted as replayed.
+	replay := false
+	switch {
+	case unsent && err != nil:
+		replay = true
+	case closed && replayable(req, t.ReplayRequest):
+		replay = true
+		m.Replayed++
+	case closed:
+		m.Failed++
+		err = ErrConnectionMigrated
+	}
+
+	m.pending--
+	done := m.pending <= 0
+	if done {
+		delete(t.migrations, conn)
+	}
+	t.m.Unlock()
+
+	if done {
+		go t.reportMigration(m)
+	}
+
+	if !replay {
+		return false, err
+	}
+
+	<-m.ready
+	return true, nil
+}
+
+// redial dials the replacement for a dead connection.
+// If this fails, requests being replayed dial their own.
+func (t *Transport) redial(m *migration) {
+	defer close(m.ready)
+
+	if err := t.warm(context.Background(), m.Host); err != nil {
+		debug.Printf("Failed to replace SPDY connection to %q: %v\n", m.Host, err)
+		return
+	}
+
+	t.m.Lock()
+	m.NewLocalAddr = t.connAddrs[m.Host]
+	t.m.Unlock()
+}
+
+// reportMigration informs OnReconnect of a finished
+// migration, once the replacement has been dialled.
+func (t *Transport) reportMigration(m *migration) {
+	<-m.ready
+	debug.Printf("Migrated SPDY connection to %q: %d requests replayed, %d failed.\n", m.Host, m.Replayed, m.Failed)
+	if t.OnReconnect != nil {
+		migrated := m.ConnMigration
+		t.OnReconnect(&migrated)
+	}
+}
+
+// replayRequest prepares the request to be sent again
+// after its connection died.
+func replayRequest(req *http.Request) (*http.Request, error) {
+	out := req.WithContext(context.WithValue(req.Context(), replayedKey{}, true))
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		out.Body = body
+	}
+	return out, nil
+}
@@ -0,0 +1,184 @@
+package spdy
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReplayable(t *testing.T) {
+	accept := func(req *http.Request) bool { return req.Header.Get("X-Replay") != "" }
+	tests := []struct {
+		name   string
+		method string
+		header string
+		body   bool
+		replay func(*http.Request) bool
+		want   bool
+	}{
+		{"GET", "GET", "", false, nil, true},
+		{"PUT", "PUT", "", true, nil, true},
+		{"DELETE", "DELETE", "", false, nil, true},
+		{"POST", "POST", "", true, nil, false},
+		{"POST with Idempotency-Key", "POST", "Idempotency-Key", true, nil, true},
+		{"POST with X-Idempotency-Key", "POST", "X-Idempotency-Key", true, nil, true},
+		{"POST accepted", "POST", "X-Replay", true, accept, true},
+		{"POST rejected", "POST", "", true, accept, false},
+		{"PATCH", "PATCH", "", true, nil, false},
+	}
+
+	for _, test := range tests {
+		var body io.Reader
+		if test.body {
+			body = strings.NewReader("body")
+		}
+		req, _ := http.NewRequest(test.method, "https://example.com/", body)
+		if test.header != "" {
+			req.Header.Set(test.header, "1")
+		}
+		if got := replayable(req, test.replay); got != test.want {
+			t.Errorf("%s: replayable is %v, want %v", test.name, got, test.want)
+		}
+
+		// A body which cannot be recreated cannot be replayed.
+		if test.body {
+			req.GetBody = nil
+			if replayable(req, test.replay) {
+				t.Errorf("%s: replayable without GetBody", test.name)
+			}
+		}
+	}
+
+	// Requests are only replayed once.
+	req, _ := http.NewRequest("GET", "https://example.com/", nil)
+	replayed, _ := replayRequest(req)
+	if replayable(replayed, nil) {
+		t.Error("a replayed request is replayable")
+	}
+}
+
+// When the connection dies with requests in progress, the
+// replayable requests are sent again on a new connection,
+// and the rest fail with ErrConnectionMigrated.
+func TestMigrateConnections(t *testing.T) {
+	killed := make(chan struct{})
+	arrived := make(chan struct{}, 10)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-killed:
+		default:
+			// Hold the first requests until the connection dies.
+			arrived <- struct{}{}
+			<-killed
+			return
+		}
+		ioutil.ReadAll(r.Body)
+		w.Write([]byte("ok"))
+	}))
+	AddSPDY(server.Config)
+	server.TLS = &tls.Config{NextProtos: NPNStrings()}
+	server.StartTLS()
+	defer server.Close()
+
+	var m sync.Mutex
+	var dialled []net.Conn
+	tr := NewTransport(server.Client().Transport.(*http.Transport).TLSClientConfig)
+	defer tr.CloseIdleConnections()
+	tr.Dial = func(network, addr string) (net.Conn, error) {
+		conn, err := net.Dial(network, addr)
+		if err == nil {
+			m.Lock()
+			dialled = append(dialled, conn)
+			m.Unlock()
+		}
+		return conn, err
+	}
+	tr.MigrateConnections = true
+	tr.ReplayRequest = func(req *http.Request) bool { return req.Header.Get("X-Replay") != "" }
+	migrations := make(chan *ConnMigration, 1)
+	tr.OnReconnect = func(m *ConnMigration) { migrations <- m }
+
+	tests := []struct {
+		method string
+		header string
+		err    error
+	}{
+		{"GET", "", nil},
+		{"POST", "", ErrConnectionMigrated},
+		{"POST", "Idempotency-Key", nil},
+		{"POST", "X-Replay", nil},
+	}
+
+	errs := make([]chan error, len(tests))
+	for i, test := range tests {
+		var body io.Reader
+		if test.method == "POST" {
+			body = strings.NewReader("body")
+		}
+		req, _ := http.NewRequest(test.method, server.URL+"/", body)
+		if test.header != "" {
+			req.Header.Set(test.header, "1")
+		}
+		errs[i] = make(chan error, 1)
+		go func(c chan error) {
+			res, err := tr.RoundTrip(req)
+			if err == nil {
+				data, _ := ioutil.ReadAll(res.Body)
+				res.Body.Close()
+				if string(data) != "ok" {
+					err = errors.New("got body " + string(data))
+				}
+			}
+			c <- err
+		}(errs[i])
+	}
+
+	// Kill the connection once each request is in progress.
+	within(t, 5*time.Second, "the requests", func() {
+		for range tests {
+			<-arrived
+		}
+	})
+	m.Lock()
+	old := dialled[0]
+	m.Unlock()
+	close(killed)
+	old.Close()
+
+	for i, test := range tests {
+		select {
+		case err := <-errs[i]:
+			if err != test.err {
+				t.Errorf("%s %s: got %v, want %v", test.method, test.header, err, test.err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s %s did not finish", test.method, test.header)
+		}
+	}
+
+	select {
+	case migrated := <-migrations:
+		if migrated.Replayed != 3 || migrated.Failed != 1 {
+			t.Errorf("replayed %d and failed %d requests, want 3 and 1", migrated.Replayed, migrated.Failed)
+		}
+		m.Lock()
+		if len(dialled) != 2 {
+			t.Errorf("dialled %d times, want twice", len(dialled))
+		} else if migrated.OldLocalAddr.String() != old.LocalAddr().String() ||
+			migrated.NewLocalAddr == nil || migrated.NewLocalAddr.String() != dialled[1].LocalAddr().String() {
+			t.Errorf("migrated from %v to %v, want %v to %v", migrated.OldLocalAddr, migrated.NewLocalAddr,
+				old.LocalAddr(), dialled[1].LocalAddr())
+		}
+		m.Unlock()
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnReconnect was not called")
+	}
+}
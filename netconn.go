@@ -0,0 +1,118 @@
+package spdy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// streamAddr is the address of one end of a stream,
+// which is the address of that end of the underlying
+// connection, annotated with the stream's ID.
+type streamAddr struct {
+	addr     net.Addr
+	streamID StreamID
+}
+
+func (a *streamAddr) Network() string {
+	if a.addr == nil {
+		return "spdy"
+	}
+	return a.addr.Network()
+}
+
+func (a *streamAddr) String() string {
+	return fmt.Sprintf("%v#%d", a.addr, a.streamID)
+}
+
+// localStreamAddr returns the local address of the
+// given stream on conn.
+func localStreamAddr(conn Conn, sid StreamID) net.Addr {
+	var addr net.Addr
+	if c, ok := conn.(netAddrer); ok {
+		addr, _ = c.netAddrs()
+	}
+	return &streamAddr{addr, sid}
+}
+
+// remoteStreamAddr returns the remote address of the
+// given stream on conn.
+func remoteStreamAddr(conn Conn, sid StreamID) net.Addr {
+	var addr net.Addr
+	if c, ok := conn.(netAddrer); ok {
+		_, addr = c.netAddrs()
+	}
+	return &streamAddr{addr, sid}
+}
+
+// writeDeadline is the time after which writes to a
+// stream fail. The zero value means writes never time
+// out.
+type writeDeadline struct {
+	sync.Mutex
+	t      time.Time
+	timer  *time.Timer
+	expire func() // called once the deadline passes, if non-nil.
+}
+
+func (d *writeDeadline) set(t time.Time) {
+	d.Lock()
+	defer d.Unlock()
+	d.t = t
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if !t.IsZero() && d.expire != nil {
+		d.timer = time.AfterFunc(time.Until(t), d.expire)
+	}
+}
+
+// notify sets the function called once the deadline
+// passes, such as to wake writes waiting for flow
+// control.
+func (d *writeDeadline) notify(expire func()) {
+	d.Lock()
+	d.expire = expire
+	d.Unlock()
+}
+
+// err returns os.ErrDeadlineExceeded if the
+// deadline has passed.
+func (d *writeDeadline) err() error {
+	d.Lock()
+	defer d.Unlock()
+	if !d.t.IsZero() && !time.Now().Before(d.t) {
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// bodyReceiver is the Receiver used by streams requested
+// without one, which holds the response body to be read
+// from the stream.
+type bodyReceiver struct {
+	body *requestBody
+}
+
+func (r bodyReceiver) ReceiveData(request *http.Request, data []byte, final bool) {
+	r.body.receive(data)
+	if final {
+		r.body.finish(nil)
+	}
+}
+
+func (r bodyReceiver) ReceiveHeader(request *http.Request, header http.Header) {}
+
+// copiesData indicates that the body is copied,
+// so can be given pooled buffers.
+func (r bodyReceiver) copiesData() bool {
+	return true
+}
+
+func (r bodyReceiver) ReceiveRequest(request *http.Request) bool {
+	return false
+}
@@ -0,0 +1,373 @@
+package spdy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// streamPair opens a stream over a pair of connections using
+// the given version, returning the client's end and the
+// handler's. The handler keeps its end until the test ends.
+func streamPair(t *testing.T, version uint16) (client, server Stream) {
+	t.Helper()
+	accepted := make(chan Stream, 1)
+	done := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Send the reply, rather than buffering
+		// the start of the response.
+		w.(http.Flusher).Flush()
+		accepted <- w.(Stream)
+		<-done
+	})}
+	_, conn := pipeConns(t, srv, version)
+
+	// The handler returns before the connections close.
+	t.Cleanup(func() { close(done) })
+
+	req, _ := http.NewRequest("POST", "http://example.com/", nil)
+	client, err := conn.Request(req, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Run()
+	select {
+	case server = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler was not called")
+	}
+	return client, server
+}
+
+// forEachEnd runs f with each end of a stream as a, and
+// the other as b, for each version.
+func forEachEnd(t *testing.T, f func(t *testing.T, version uint16, a, b Stream)) {
+	for _, version := range versions {
+		t.Run(fmt.Sprintf("SPDY/%d/client", version), func(t *testing.T) {
+			client, server := streamPair(t, version)
+			f(t, version, client, server)
+		})
+		t.Run(fmt.Sprintf("SPDY/%d/server", version), func(t *testing.T) {
+			client, server := streamPair(t, version)
+			f(t, version, server, client)
+		})
+	}
+}
+
+// isTimeout reports whether err is the error
+// returned once a deadline has passed.
+func isTimeout(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout() && errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// Streams satisfy net.Conn.
+var _ net.Conn = Stream(nil)
+
+// Data written by each end, in writes of varying sizes, is
+// read intact by the other. Each end echoes what it reads,
+// then half-closes once it reads the other's FIN, so all
+// the data is seen before io.EOF.
+func TestStreamBasicIO(t *testing.T) {
+	forEachEnd(t, func(t *testing.T, version uint16, a, b Stream) {
+		want := make([]byte, 1<<20)
+		rand.New(rand.NewSource(1)).Read(want)
+
+		// b echoes.
+		go func() {
+			io.Copy(b, b)
+			b.CloseWrite()
+		}()
+
+		within(t, 30*time.Second, "the echo", func() {
+			errs := make(chan error, 1)
+			go func() {
+				r := rand.New(rand.NewSource(2))
+				data := want
+				for len(data) > 0 {
+					n := r.Intn(64 << 10)
+					if n > len(data) {
+						n = len(data)
+					}
+					if _, err := a.Write(data[:n]); err != nil {
+						errs <- err
+						return
+					}
+					data = data[n:]
+				}
+				errs <- a.CloseWrite()
+			}()
+
+			got, err := ioutil.ReadAll(a)
+			if err != nil {
+				t.Errorf("ReadAll: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("read %d bytes, which do not match the %d written", len(got), len(want))
+			}
+			if err := <-errs; err != nil {
+				t.Errorf("writing: %v", err)
+			}
+		})
+	})
+}
+
+// Small writes and reads alternate, as in a
+// request-response protocol.
+func TestStreamPingPong(t *testing.T) {
+	forEachEnd(t, func(t *testing.T, version uint16, a, b Stream) {
+		within(t, 10*time.Second, "the exchange", func() {
+			go func() {
+				buf := make([]byte, 8)
+				for {
+					n, err := b.Read(buf)
+					if err != nil {
+						return
+					}
+					if _, err := b.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+			}()
+
+			buf := make([]byte, 8)
+			for i := 0; i < 100; i++ {
+				msg := []byte(fmt.Sprint(i))
+				if _, err := a.Write(msg); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := io.ReadFull(a, buf[:len(msg)]); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(buf[:len(msg)], msg) {
+					t.Fatalf("read %q, want %q", buf[:len(msg)], msg)
+				}
+			}
+		})
+	})
+}
+
+// Once an end half-closes, the other reads its data then
+// io.EOF, and can still write, while the half-closed end
+// cannot.
+func TestStreamCloseWrite(t *testing.T) {
+	forEachEnd(t, func(t *testing.T, version uint16, a, b Stream) {
+		within(t, 10*time.Second, "the half-close", func() {
+			a.Write([]byte("a"))
+			a.Write([]byte("b"))
+			if err := a.CloseWrite(); err != nil {
+				t.Fatalf("CloseWrite: %v", err)
+			}
+			if _, err := a.Write([]byte("c")); err == nil {
+				t.Error("Write succeeded after CloseWrite")
+			}
+			if err := a.CloseWrite(); err == nil {
+				t.Error("CloseWrite succeeded twice")
+			}
+
+			got, err := ioutil.ReadAll(b)
+			if err != nil || string(got) != "ab" {
+				t.Fatalf("read %q, error %v, want %q", got, err, "ab")
+			}
+			if n, err := b.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+				t.Fatalf("read after EOF gave %d bytes, error %v", n, err)
+			}
+
+			b.Write([]byte("reply"))
+			b.CloseWrite()
+			got, err = ioutil.ReadAll(a)
+			if err != nil || string(got) != "reply" {
+				t.Fatalf("read %q, error %v, want %q", got, err, "reply")
+			}
+		})
+	})
+}
+
+// Data held back by flow control when an end half-closes
+// is still sent, before the FIN, once the other end reads,
+// even if the other end has already half-closed.
+func TestStreamCloseWriteBuffered(t *testing.T) {
+	forEachEnd(t, func(t *testing.T, version uint16, a, b Stream) {
+		// SPDY/2 has no flow control, so nothing is held back.
+		if version < 3 {
+			return
+		}
+
+		within(t, 10*time.Second, "the half-close", func() {
+			if err := b.CloseWrite(); err != nil {
+				t.Fatalf("CloseWrite: %v", err)
+			}
+			if got, err := ioutil.ReadAll(a); err != nil || len(got) != 0 {
+				t.Fatalf("read %q, error %v, want io.EOF", got, err)
+			}
+
+			// b does not read, so the window is used up,
+			// and the last data written is held back.
+			var want []byte
+			a.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+			for i := 0; ; i++ {
+				chunk := bytes.Repeat([]byte{byte(i)}, 10000)
+				if _, err := a.Write(chunk); err != nil {
+					break
+				}
+				want = append(want, chunk...)
+			}
+			a.SetWriteDeadline(time.Time{})
+
+			// b reads nothing until a has half-closed.
+			errs := make(chan error, 1)
+			go func() { errs <- a.CloseWrite() }()
+			time.Sleep(100 * time.Millisecond)
+			got, err := ioutil.ReadAll(b)
+			if err != nil || !bytes.Equal(got, want) {
+				t.Errorf("read %d bytes, error %v, want the %d written", len(got), err, len(want))
+			}
+			if err := <-errs; err != nil {
+				t.Errorf("CloseWrite: %v", err)
+			}
+		})
+	})
+}
+
+// A Read blocked when the other end resets the stream
+// returns the reset.
+func TestStreamResetRead(t *testing.T) {
+	forEachEnd(t, func(t *testing.T, version uint16, a, b Stream) {
+		errs := make(chan error, 1)
+		go func() {
+			_, err := a.Read(make([]byte, 1))
+			errs <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		// Only the client may cancel the stream.
+		var code StatusCode = RST_STREAM_REFUSED_STREAM
+		switch b.(type) {
+		case *clientStreamV3, *clientStreamV2:
+			code = RST_STREAM_CANCEL
+		}
+		if err := b.Reset(code); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-errs:
+			serr, ok := err.(*StreamError)
+			if !ok || !serr.Remote || serr.Status != code {
+				t.Fatalf("Read returned %v, want the reset", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Read did not return")
+		}
+	})
+}
+
+// Reads and writes fail once their deadlines have passed,
+// including reads blocked waiting for data, and writes
+// blocked waiting for the flow control window. Extending
+// a deadline allows them to succeed.
+func TestStreamDeadlines(t *testing.T) {
+	forEachEnd(t, func(t *testing.T, version uint16, a, b Stream) {
+		// A past deadline fails at once.
+		a.SetDeadline(time.Now().Add(-time.Second))
+		if _, err := a.Read(make([]byte, 1)); !isTimeout(err) {
+			t.Fatalf("Read with a past deadline returned %v", err)
+		}
+		if _, err := a.Write([]byte("x")); !isTimeout(err) {
+			t.Fatalf("Write with a past deadline returned %v", err)
+		}
+
+		// A blocked Read fails once the deadline passes.
+		a.SetDeadline(time.Now().Add(100 * time.Millisecond))
+		within(t, 5*time.Second, "the blocked Read", func() {
+			if _, err := a.Read(make([]byte, 1)); !isTimeout(err) {
+				t.Errorf("blocked Read returned %v", err)
+			}
+		})
+
+		// Extending the deadline allows both to succeed.
+		a.SetDeadline(time.Time{})
+		b.Write([]byte("y"))
+		buf := make([]byte, 1)
+		if _, err := io.ReadFull(a, buf); err != nil || buf[0] != 'y' {
+			t.Fatalf("Read after extending the deadline returned %q, %v", buf, err)
+		}
+		if _, err := a.Write([]byte("z")); err != nil {
+			t.Fatalf("Write after extending the deadline returned %v", err)
+		}
+
+		// SPDY/2 has no flow control, so writes never wait.
+		if version < 3 {
+			return
+		}
+
+		// b does not read, so the window is used up. The
+		// first blocked Write fails once the deadline passes.
+		a.SetWriteDeadline(time.Now().Add(500 * time.Millisecond))
+		within(t, 10*time.Second, "the blocked Write", func() {
+			chunk := make([]byte, 16<<10)
+			for i := 0; ; i++ {
+				if _, err := a.Write(chunk); err != nil {
+					if !isTimeout(err) {
+						t.Errorf("blocked Write returned %v", err)
+					}
+					if i == 0 {
+						t.Error("no data was written before the deadline")
+					}
+					return
+				}
+			}
+		})
+	})
+}
+
+// Closing a stream unblocks its reads and writes,
+// including writes waiting for the flow control window.
+// A handler's Close still sends the data already written,
+// once the other end reads it.
+func TestStreamCloseUnblocks(t *testing.T) {
+	forEachEnd(t, func(t *testing.T, version uint16, a, b Stream) {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := a.Read(make([]byte, 1)); err == nil {
+				t.Error("Read succeeded after Close")
+			}
+		}()
+
+		// b does not read, so writes wait for the
+		// window, except with SPDY/2.
+		if version >= 3 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				chunk := make([]byte, 16<<10)
+				for {
+					if _, err := a.Write(chunk); err != nil {
+						return
+					}
+				}
+			}()
+		}
+		time.Sleep(100 * time.Millisecond)
+
+		closed := make(chan struct{})
+		go func() {
+			a.Close()
+			close(closed)
+		}()
+		within(t, 5*time.Second, "the blocked calls", wg.Wait)
+
+		go io.Copy(ioutil.Discard, b)
+		within(t, 5*time.Second, "Close", func() { <-closed })
+	})
+}
@@ -0,0 +1,85 @@
+package spdy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connVersion returns the SPDY version of conn.
+func connVersion(conn Conn) uint16 {
+	switch conn.(type) {
+	case *connV3:
+		return 3
+	case *connV2:
+		return 2
+	}
+	return 0
+}
+
+// DialTLS negotiates each SPDY version with a server set up
+// by AddSPDY, and reports ErrNotSPDY when the server picks
+// HTTP/1.1.
+func TestDialTLS(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "SPDY/%d", SPDYversion(w))
+	}))
+	AddSPDY(server.Config)
+	server.TLS = &tls.Config{NextProtos: NPNStrings()}
+	server.StartTLS()
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "https://")
+	config := server.Client().Transport.(*http.Transport).TLSClientConfig
+
+	for _, proto := range []string{"spdy/3", "spdy/2"} {
+		if server.Config.TLSNextProto[proto] == nil {
+			t.Errorf("AddSPDY did not register %s", proto)
+		}
+	}
+
+	tests := []struct {
+		protos  []string
+		version uint16
+	}{
+		{nil, 3},
+		{[]string{"spdy/3", "http/1.1"}, 3},
+		{[]string{"spdy/2", "http/1.1"}, 2},
+	}
+	for _, test := range tests {
+		config := config.Clone()
+		config.NextProtos = test.protos
+		conn, err := DialTLS("tcp", addr, config, nil)
+		if err != nil {
+			t.Errorf("offering %v: %v", test.protos, err)
+			continue
+		}
+		if v := connVersion(conn); v != test.version {
+			t.Errorf("offering %v negotiated SPDY/%d, want SPDY/%d", test.protos, v, test.version)
+		}
+
+		go conn.Run()
+		within(t, 5*time.Second, "the request", func() {
+			req, _ := http.NewRequest("GET", server.URL+"/", nil)
+			res, err := request(conn, req)
+			want := fmt.Sprintf("SPDY/%d", test.version)
+			if err != nil {
+				t.Errorf("offering %v: %v", test.protos, err)
+			} else if body := res.Data.String(); body != want {
+				t.Errorf("offering %v: got %q, want %q", test.protos, body, want)
+			}
+		})
+		conn.Close()
+	}
+
+	// A server without SPDY gives ErrNotSPDY.
+	plain := httptest.NewTLSServer(http.NotFoundHandler())
+	defer plain.Close()
+	config = plain.Client().Transport.(*http.Transport).TLSClientConfig
+	if conn, err := DialTLS("tcp", strings.TrimPrefix(plain.URL, "https://"), config, nil); err != ErrNotSPDY {
+		t.Errorf("dialling an HTTP/1.1 server gave %v, %v, want ErrNotSPDY", conn, err)
+	}
+}
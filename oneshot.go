@@ -0,0 +1,180 @@
+package spdy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+)
+
+// RoundTripOnce makes a single request without a Transport.
+// A new connection is dialled, negotiating SPDY if possible,
+// the request is made and the whole response is read, then
+// the connection is closed, with a GOAWAY if SPDY was used.
+// No goroutines remain once RoundTripOnce returns. config
+// may be nil, and is copied before the SPDY versions are
+// added to it. If ctx is done before the response has been
+// received, the connection is closed and ctx's error is
+// returned.
+//
+// RoundTripOnce is intended for programs which only make
+// the occasional request. Others should use a Transport,
+// which keeps connections for reuse.
+func RoundTripOnce(ctx context.Context, req *http.Request, config *tls.Config) (*http.Response, error) {
+	u := req.URL
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New(fmt.Sprintf("Error: URL has invalid scheme %q.", u.Scheme))
+	}
+
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host = u.Host
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+
+	var dialer net.Dialer
+	tcpConn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+	if err := tuneSocket(tcpConn, true, nil); err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+
+	if u.Scheme == "http" {
+		return roundTripOnceHTTP(ctx, tcpConn, req)
+	}
+
+	if config == nil {
+		config = new(tls.Config)
+	} else {
+		config = config.Clone()
+	}
+	if config.NextProtos == nil {
+		config.NextProtos = NPNStrings()
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+
+	tlsConn := tls.Client(tcpConn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+
+	conn, err := NewClientTLSConn(tlsConn, nil)
+	if err == ErrNotSPDY {
+		return roundTripOnceHTTP(ctx, tlsConn, req)
+	}
+	if err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+
+	return roundTripOnceSPDY(ctx, conn, req)
+}
+
+// roundTripOnceSPDY makes the request over the SPDY
+// connection, then closes it, waiting for its
+// goroutines to finish.
+func roundTripOnceSPDY(ctx context.Context, conn Conn, req *http.Request) (*http.Response, error) {
+	running := make(chan struct{})
+	go func() {
+		defer close(running)
+		conn.Run()
+	}()
+
+	// Close the connection if ctx is done first.
+	finished := make(chan struct{})
+	watching := make(chan struct{})
+	go func() {
+		defer close(watching)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-finished:
+		}
+	}()
+
+	debug.Printf("Requesting %q over SPDY.\n", req.URL.String())
+
+	res := new(response)
+	res.Request = req
+	res.Data = new(bytes.Buffer)
+
+	stream, err := conn.Request(req, res, DefaultPriority(req.URL))
+	if err == nil {
+		err = stream.Run()
+	}
+
+	close(finished)
+	<-watching
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+
+	// Say goodbye, and wait for the connection to finish.
+	shutdown(ctx, conn)
+	<-running
+
+	if err != nil && !(err == ErrResponseTooLarge && res.truncated) {
+		return nil, err
+	}
+	if res.err != nil && !res.truncated {
+		return nil, res.err
+	}
+
+	return res.Response(), nil
+}
+
+// roundTripOnceHTTP makes the request over the
+// HTTP connection, reading the whole response
+// before closing it.
+func roundTripOnceHTTP(ctx context.Context, conn net.Conn, req *http.Request) (*http.Response, error) {
+	debug.Printf("Requesting %q over HTTP.\n", req.URL.String())
+
+	// Close the connection if ctx is done first.
+	finished := make(chan struct{})
+	watching := make(chan struct{})
+	go func() {
+		defer close(watching)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-finished:
+		}
+	}()
+
+	httpConn := httputil.NewClientConn(conn, nil)
+	res, err := httpConn.Do(req)
+	var body []byte
+	if err == nil {
+		body, err = ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+
+	close(finished)
+	<-watching
+	conn.Close()
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	return res, nil
+}
@@ -0,0 +1,107 @@
+package spdy
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// checkGoroutines fails the test if the number of
+// goroutines does not fall back to n.
+func checkGoroutines(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines are left, want %d:\n%s", runtime.NumGoroutine(), n, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// RoundTripOnce makes a request over SPDY, HTTPS or HTTP,
+// as the server allows, and leaves no goroutines behind.
+func TestRoundTripOnce(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if UsingSPDY(w) {
+			w.Write([]byte("spdy"))
+		} else {
+			w.Write([]byte("http"))
+		}
+	})
+	spdyServer := httptest.NewUnstartedServer(handler)
+	AddSPDY(spdyServer.Config)
+	spdyServer.TLS = &tls.Config{NextProtos: NPNStrings()}
+	spdyServer.StartTLS()
+	defer spdyServer.Close()
+	httpsServer := httptest.NewTLSServer(handler)
+	defer httpsServer.Close()
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+
+	tests := []struct {
+		name   string
+		server *httptest.Server
+		want   string
+	}{
+		{"SPDY", spdyServer, "spdy"},
+		{"HTTPS", httpsServer, "http"},
+		{"HTTP", httpServer, "http"},
+	}
+
+	for _, test := range tests {
+		before := runtime.NumGoroutine()
+		within(t, 5*time.Second, "the request", func() {
+			req, _ := http.NewRequest("GET", test.server.URL+"/", nil)
+			config := test.server.Client().Transport.(*http.Transport).TLSClientConfig
+			res, err := RoundTripOnce(context.Background(), req, config)
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+				return
+			}
+			body, err := ioutil.ReadAll(res.Body)
+			if err != nil || string(body) != test.want {
+				t.Errorf("%s: got body %q, error %v, want %q", test.name, body, err, test.want)
+			}
+		})
+		checkGoroutines(t, before)
+	}
+
+	// The SPDY connection was closed with a GOAWAY.
+	if n := Stats(spdyServer.Config).Conns; n != 0 {
+		t.Errorf("the server has %d SPDY connections, want 0", n)
+	}
+}
+
+// If the context is done before the response, the request
+// fails with its error, and no goroutines are left.
+func TestRoundTripOnceCancelled(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	AddSPDY(server.Config)
+	server.TLS = &tls.Config{NextProtos: NPNStrings()}
+	server.StartTLS()
+	defer server.Close()
+
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	within(t, 5*time.Second, "the request", func() {
+		req, _ := http.NewRequest("GET", server.URL+"/", nil)
+		config := server.Client().Transport.(*http.Transport).TLSClientConfig
+		if _, err := RoundTripOnce(ctx, req, config); err != context.DeadlineExceeded {
+			t.Errorf("got %v, want context.DeadlineExceeded", err)
+		}
+	})
+
+	close(release)
+	checkGoroutines(t, before)
+}
@@ -0,0 +1,89 @@
+package spdy
+
+import (
+	"sync"
+)
+
+// SettingsStore holds the SETTINGS which servers have asked clients
+// to persist, with FLAG_SETTINGS_PERSIST_VALUE, keyed by origin as
+// host:port. Persisted settings are sent back to the server, with
+// FLAG_SETTINGS_PERSISTED, on the next connection to the origin,
+// and are removed when the server sends FLAG_SETTINGS_CLEAR_SETTINGS.
+//
+// The default store, from NewSettingsStore, is held in memory.
+// Applications can provide their own to keep settings on disk.
+// A SettingsStore must be safe for concurrent use.
+type SettingsStore interface {
+	// Get returns the settings persisted for the origin,
+	// or nil if there are none.
+	Get(origin string) Settings
+
+	// Set replaces the settings persisted for the origin.
+	Set(origin string, settings Settings)
+
+	// Clear removes any settings persisted for the origin.
+	Clear(origin string)
+}
+
+// NewSettingsStore returns a SettingsStore held in memory.
+func NewSettingsStore() SettingsStore {
+	return &memorySettingsStore{settings: make(map[string]Settings)}
+}
+
+// memorySettingsStore is the default SettingsStore.
+type memorySettingsStore struct {
+	sync.Mutex
+	settings map[string]Settings
+}
+
+func (m *memorySettingsStore) Get(origin string) Settings {
+	m.Lock()
+	defer m.Unlock()
+	return copySettings(m.settings[origin])
+}
+
+func (m *memorySettingsStore) Set(origin string, settings Settings) {
+	m.Lock()
+	defer m.Unlock()
+	m.settings[origin] = copySettings(settings)
+}
+
+func (m *memorySettingsStore) Clear(origin string) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.settings, origin)
+}
+
+// copySettings returns a deep copy of settings, or
+// nil if there are none.
+func copySettings(settings Settings) Settings {
+	if len(settings) == 0 {
+		return nil
+	}
+	out := make(Settings, len(settings))
+	for id, setting := range settings {
+		s := *setting
+		out[id] = &s
+	}
+	return out
+}
+
+// persistSettings adds the settings to those persisted
+// for origin in store, marking them as persisted so that
+// they can be returned to the server.
+func persistSettings(store SettingsStore, origin string, settings Settings) {
+	merged := store.Get(origin)
+	if merged == nil {
+		merged = make(Settings)
+	}
+	for id, setting := range settings {
+		merged[id] = &Setting{Flags: FLAG_SETTINGS_PERSISTED, ID: id, Value: setting.Value}
+	}
+	store.Set(origin, merged)
+}
+
+// settingsPersister is implemented by client connections
+// which can persist SETTINGS for their origin.
+type settingsPersister interface {
+	setSettingsStore(store SettingsStore, origin string, unrecognised bool)
+}
@@ -0,0 +1,123 @@
+package spdy
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// pingsLeft returns the number of PINGs
+// awaiting a reply on conn.
+func pingsLeft(conn Conn) int {
+	switch conn := conn.(type) {
+	case *connV3:
+		conn.Lock()
+		defer conn.Unlock()
+		return len(conn.pings)
+	case *connV2:
+		conn.Lock()
+		defer conn.Unlock()
+		return len(conn.pings)
+	}
+	return 0
+}
+
+// PingWithTimeout gives up on a PING whose reply does not
+// arrive in time, forgetting it so that a late reply is
+// ignored. PINGs outstanding when the connection closes
+// are failed rather than left to block.
+func TestPingWithTimeout(t *testing.T) {
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			clock := newFakeClock()
+			client, conn := rawClientConnWith(t, version, func(c Conn) { setClock(c, clock) })
+
+			// The peer swallows each PING, passing its ID on.
+			pings := make(chan uint32, 10)
+			go func() {
+				for {
+					frame, err := readRawFrame(conn, version)
+					if err != nil {
+						return
+					}
+					switch frame := frame.(type) {
+					case *pingFrameV3:
+						pings <- frame.PingID
+					case *pingFrameV2:
+						pings <- frame.PingID
+					}
+				}
+			}()
+			reply := func(id uint32) {
+				conn.Write([]byte{0x80, byte(version), 0, 6, 0, 0, 0, 4, byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)})
+			}
+			next := func() uint32 {
+				select {
+				case id := <-pings:
+					return id
+				case <-time.After(5 * time.Second):
+					t.Fatal("no PING was sent")
+					return 0
+				}
+			}
+			result := func(errs chan error) error {
+				select {
+				case err := <-errs:
+					return err
+				case <-time.After(5 * time.Second):
+					t.Fatal("PingWithTimeout did not return")
+					return nil
+				}
+			}
+
+			// No reply.
+			timers := clock.Pending()
+			errs := make(chan error, 1)
+			go func() { errs <- PingWithTimeout(client, time.Second) }()
+			id := next()
+			clock.waitPending(t, timers+1)
+			clock.Advance(time.Second)
+			if err := result(errs); err != ErrPingTimeout {
+				t.Fatalf("got %v, want ErrPingTimeout", err)
+			}
+			if n := pingsLeft(client); n != 0 {
+				t.Errorf("%d PINGs are left after the timeout", n)
+			}
+
+			// A reply in time.
+			go func() { errs <- PingWithTimeout(client, time.Second) }()
+			reply(next())
+			if err := result(errs); err != nil {
+				t.Fatalf("got %v, want no error", err)
+			}
+
+			// A late reply is ignored.
+			reply(id)
+			go func() { errs <- PingWithTimeout(client, time.Second) }()
+			reply(next())
+			if err := result(errs); err != nil {
+				t.Fatalf("after a late reply, got %v, want no error", err)
+			}
+			if n := benignErrors(client); n != 1 {
+				t.Errorf("counted %d benign errors, want 1", n)
+			}
+
+			// Closing fails the PINGs outstanding.
+			c, err := client.Ping()
+			if err != nil {
+				t.Fatal(err)
+			}
+			next()
+			client.Close()
+			select {
+			case ping, ok := <-c:
+				if ok && ping.Err == nil {
+					t.Error("the PING succeeded after the connection closed")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the PING was left outstanding")
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package spdy
+
+import (
+	"net"
+	"net/http"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeConns serves srv over a net.Pipe, using the given SPDY
+// version, and returns the running server and client
+// connections. Both are closed, and have stopped, when the
+// test ends. A net.Pipe
+// has no buffering, so a connection which waits for itself
+// to send a frame while the other does the same hangs.
+func pipeConns(t testing.TB, srv *http.Server, version uint16) (server, client Conn) {
+	return pipeConnsWith(t, srv, version, nil)
+}
+
+// pipeConnsWith is pipeConns, but calls setup on the
+// server and client connections before they are run.
+func pipeConnsWith(t testing.TB, srv *http.Server, version uint16, setup func(server, client Conn)) (server, client Conn) {
+	t.Helper()
+	local, remote := net.Pipe()
+
+	server, err := NewServerConn(remote, srv, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err = NewClientConn(local, nil, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setup != nil {
+		setup(server, client)
+	}
+
+	// The connections have stopped once both Run calls
+	// return, so tests which follow do not overlap them.
+	var running sync.WaitGroup
+	running.Add(2)
+	go func() { defer running.Done(); server.Run() }()
+	go func() { defer running.Done(); client.Run() }()
+	t.Cleanup(func() {
+		within(t, 10*time.Second, "closing the connections", func() {
+			client.Close()
+			server.Close()
+			running.Wait()
+		})
+	})
+
+	return server, client
+}
+
+// rawServerConn serves srv over a net.Pipe, using the given
+// SPDY version, and returns the other end of the pipe, so
+// that the test can act as a client which sends any frames
+// it likes. Both ends are closed when the test ends.
+func rawServerConn(t testing.TB, srv *http.Server, version uint16) net.Conn {
+	return rawServerConnWith(t, srv, version, nil)
+}
+
+// rawServerConnWith is rawServerConn, but calls setup
+// on the server connection before it is run.
+func rawServerConnWith(t testing.TB, srv *http.Server, version uint16, setup func(server Conn)) net.Conn {
+	t.Helper()
+	local, remote := net.Pipe()
+	server, err := NewServerConn(remote, srv, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setup != nil {
+		setup(server)
+	}
+
+	running := make(chan struct{})
+	go func() { defer close(running); server.Run() }()
+	t.Cleanup(func() {
+		within(t, 10*time.Second, "closing the connection", func() {
+			local.Close()
+			server.Close()
+			<-running
+		})
+	})
+
+	return local
+}
+
+// rawClientConn runs a client connection over a net.Pipe,
+// using the given SPDY version, and returns it with the
+// other end of the pipe, so that the test can act as a
+// server which sends any frames it likes. Both ends are
+// closed when the test ends.
+func rawClientConn(t testing.TB, version uint16) (Conn, net.Conn) {
+	return rawClientConnWith(t, version, nil)
+}
+
+// rawClientConnWith is rawClientConn, but calls setup
+// on the client connection before it is run.
+func rawClientConnWith(t testing.TB, version uint16, setup func(client Conn)) (Conn, net.Conn) {
+	t.Helper()
+	local, remote := net.Pipe()
+	client, err := NewClientConn(local, nil, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setup != nil {
+		setup(client)
+	}
+
+	running := make(chan struct{})
+	go func() { defer close(running); client.Run() }()
+	t.Cleanup(func() {
+		within(t, 10*time.Second, "closing the connection", func() {
+			remote.Close()
+			client.Close()
+			<-running
+		})
+	})
+
+	return client, remote
+}
+
+// pipeTransport returns a Transport whose pool holds a client
+// connection to srv, served over a net.Pipe, using the given
+// SPDY version, so that requests to https://example.com/ are
+// made to srv.
+func pipeTransport(t testing.TB, srv *http.Server, version uint16) *Transport {
+	t.Helper()
+	_, client := pipeConns(t, srv, version)
+
+	var netConn net.Conn
+	switch client := client.(type) {
+	case *connV3:
+		netConn = client.conn
+	case *connV2:
+		netConn = client.conn
+	}
+
+	const host = "example.com:443"
+	tr := new(Transport)
+	tr.m.Lock()
+	tr.prepare(host)
+	tr.addSPDYConn(host, client, netConn)
+	tr.m.Unlock()
+	return tr
+}
+
+// request makes req over conn, returning the response
+// once it has been received in full.
+func request(conn Conn, req *http.Request) (*response, error) {
+	res, _, err := new(Transport).requestSPDY(conn, req)
+	return res, err
+}
+
+// within fails the test, with a dump of every goroutine's
+// stack, if f does not return in time. The test ends at
+// once, as f is left running.
+func within(t testing.TB, d time.Duration, what string, f func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(d):
+		buf := make([]byte, 1<<20)
+		buf = buf[:runtime.Stack(buf, true)]
+		t.Fatalf("%s did not finish within %v:\n%s", what, d, buf)
+	}
+}
+
+// versions are the SPDY versions which tests cover.
+var versions = []uint16{3, 2}
@@ -0,0 +1,70 @@
+package spdy
+
+import "sync"
+
+// headerQueueSize is the number of frames which can
+// wait for a connection's header loop before its read
+// loop blocks.
+const headerQueueSize = 64
+
+// headerQueue carries frames from a connection's read loop
+// to its header loop. Header blocks share a compression
+// context, so must be decompressed in order, and frames
+// with headers are all handled by the header loop. So are
+// the frames which must be handled after them: those for
+// streams with frames still queued, and frames for the
+// whole connection while any frames are queued. Other
+// frames, such as DATA for unrelated streams, are handled
+// by the read loop at once, rather than waiting behind the
+// decompression of a large header block.
+type headerQueue struct {
+	frames  chan Frame
+	mu      sync.Mutex
+	pending map[StreamID]int // number of frames queued for each stream.
+	total   int              // number of frames queued in total.
+}
+
+func newHeaderQueue() *headerQueue {
+	q := new(headerQueue)
+	q.frames = make(chan Frame, headerQueueSize)
+	q.pending = make(map[StreamID]int)
+	return q
+}
+
+// add gives the frame to the header loop, if it has headers
+// or must be ordered after the frames already queued, and
+// returns whether it did so. If not, the caller handles the
+// frame itself. sid and scoped are the frame's stream ID and
+// whether it is scoped to that stream.
+func (q *headerQueue) add(frame Frame, sid StreamID, scoped, headers bool, stop <-chan struct{}) bool {
+	q.mu.Lock()
+	if !headers && ((scoped && q.pending[sid] == 0) || (!scoped && q.total == 0)) {
+		q.mu.Unlock()
+		return false
+	}
+	if scoped {
+		q.pending[sid]++
+	}
+	q.total++
+	q.mu.Unlock()
+
+	select {
+	case q.frames <- frame:
+	case <-stop:
+	}
+	return true
+}
+
+// done records that the header loop has
+// handled a frame given to it by add.
+func (q *headerQueue) done(sid StreamID, scoped bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if scoped {
+		if q.pending[sid]--; q.pending[sid] <= 0 {
+			delete(q.pending, sid)
+		}
+	}
+	q.total--
+}
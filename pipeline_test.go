@@ -0,0 +1,243 @@
+package spdy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// largeHeaders returns n header values of size bytes
+// each, which compress poorly, so that inflating them
+// takes a while.
+func largeHeaders(n, size int) []string {
+	r := rand.New(rand.NewSource(1))
+	values := make([]string, n)
+	for i := range values {
+		b := make([]byte, size/2)
+		r.Read(b)
+		values[i] = hex.EncodeToString(b)
+	}
+	return values
+}
+
+// Frames for streams with frames waiting for the header
+// loop are queued behind them, as are connection-level
+// frames while anything is waiting. Other frames are
+// handled at once.
+func TestHeaderQueue(t *testing.T) {
+	stop := make(chan struct{})
+	q := newHeaderQueue()
+	data := &dataFrameV3{StreamID: 1}
+	ping := &pingFrameV3{PingID: 1}
+
+	if q.add(data, 1, true, false, stop) {
+		t.Fatal("DATA was queued with nothing waiting")
+	}
+	if q.add(ping, 0, false, false, stop) {
+		t.Fatal("PING was queued with nothing waiting")
+	}
+	if !q.add(&headersFrameV3{StreamID: 1}, 1, true, true, stop) {
+		t.Fatal("HEADERS was not queued")
+	}
+	if !q.add(data, 1, true, false, stop) {
+		t.Fatal("DATA was not queued behind its stream's HEADERS")
+	}
+	if q.add(&dataFrameV3{StreamID: 3}, 3, true, false, stop) {
+		t.Fatal("DATA for another stream was queued")
+	}
+	if !q.add(ping, 0, false, false, stop) {
+		t.Fatal("PING was not queued behind HEADERS")
+	}
+
+	// The frames are given to the header loop in order.
+	for _, want := range []Frame{&headersFrameV3{StreamID: 1}, data, ping} {
+		got := <-q.frames
+		if fmt.Sprintf("%T", got) != fmt.Sprintf("%T", want) {
+			t.Fatalf("header loop got %T, want %T", got, want)
+		}
+		sid, scoped := streamIDV3(got)
+		q.done(sid, scoped)
+	}
+	if q.add(data, 1, true, false, stop) || q.add(ping, 0, false, false, stop) {
+		t.Fatal("frames were queued once the header loop had caught up")
+	}
+
+	// Adding a frame gives up once the connection stops.
+	for i := 0; i < headerQueueSize; i++ {
+		q.add(&headersFrameV3{StreamID: 1}, 1, true, true, stop)
+	}
+	close(stop)
+	within(t, 5*time.Second, "adding to a full queue", func() {
+		q.add(&headersFrameV3{StreamID: 1}, 1, true, true, stop)
+	})
+}
+
+// Large header blocks, which are handled by the header loop,
+// are interleaved with DATA and RST_STREAMs, which the read
+// loop handles itself, on both connections at once. Each
+// stream's frames are still handled in order. This is most
+// useful with the race detector.
+func TestHeaderLoopRace(t *testing.T) {
+	// SPDY/2 limits header values to 64 KiB.
+	values := largeHeaders(8, 32<<10)
+	const upload = 8 << 20
+	for _, version := range versions {
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/upload" {
+					n, err := io.CopyN(ioutil.Discard, r.Body, upload)
+					if err != nil {
+						t.Errorf("server read %d bytes of the upload, error %v", n, err)
+					}
+					fmt.Fprint(w, n)
+					return
+				}
+				i, _ := strconv.Atoi(r.Header.Get("X-Index"))
+				if r.Header.Get("X-Large") != values[i] {
+					t.Errorf("request %d has the wrong header", i)
+				}
+				w.Header().Set("X-Large", values[i])
+				io.Copy(w, r.Body)
+			})}
+			_, client := pipeConns(t, srv, version)
+
+			within(t, 60*time.Second, "the requests", func() {
+				var wg sync.WaitGroup
+
+				// A bulk upload keeps DATA flowing
+				// to the server's read loop.
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					req, _ := http.NewRequest("POST", "http://example.com/upload", nil)
+					stream, err := client.Request(req, nil, 0)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					go stream.Run()
+					defer stream.Close()
+					chunk := make([]byte, 16<<10)
+					for n := 0; n < upload; n += len(chunk) {
+						if _, err := stream.Write(chunk); err != nil {
+							t.Error(err)
+							return
+						}
+					}
+					body, err := ioutil.ReadAll(stream)
+					if err != nil || string(body) != fmt.Sprint(upload) {
+						t.Errorf("upload got %q, error %v", body, err)
+					}
+				}()
+
+				for i := 0; i < 8; i++ {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						for j := 0; j < 8; j++ {
+							index := (i + j) % len(values)
+							body := bytes.Repeat([]byte{byte(i), byte(j)}, 8<<10)
+							req, _ := http.NewRequest("POST", "http://example.com/", bytes.NewReader(body))
+							req.Header.Set("X-Index", strconv.Itoa(index))
+							req.Header.Set("X-Large", values[index])
+
+							// Some streams are reset while
+							// their headers may be queued.
+							if j%3 == 0 {
+								req.Body = nil
+								stream, err := client.Request(req, nil, 0)
+								if err != nil {
+									t.Error(err)
+									return
+								}
+								go stream.Run()
+								stream.Reset(RST_STREAM_CANCEL)
+								stream.Close()
+								continue
+							}
+
+							res, err := request(client, req)
+							if err != nil {
+								t.Error(err)
+								return
+							}
+							if res.Header.Get("X-Large") != values[index] {
+								t.Errorf("response %d has the wrong header", index)
+							}
+							if !bytes.Equal(res.Data.Bytes(), body) {
+								t.Errorf("response %d has the wrong body", index)
+							}
+						}
+					}(i)
+				}
+				wg.Wait()
+			})
+		})
+	}
+}
+
+// A client uploads a large body. With headers=true, it sends
+// a request with a large header block after each MiB of the
+// upload, without waiting for the responses. The server's
+// DATA is handled by its read loop while the header loop
+// inflates the header blocks, so the upload need not wait
+// behind each one.
+func BenchmarkInterleavedHeaders(b *testing.B) {
+	values := largeHeaders(16, 128<<10)
+	const upload = 64 << 20
+	for _, headers := range []bool{false, true} {
+		b.Run(fmt.Sprintf("headers=%v", headers), func(b *testing.B) {
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/upload" {
+					n, _ := io.CopyN(ioutil.Discard, r.Body, upload)
+					fmt.Fprint(w, n)
+				}
+			})}
+			_, client := pipeConns(b, srv, 3)
+			chunk := make([]byte, benchFrameSize)
+
+			b.SetBytes(upload)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				req, _ := http.NewRequest("POST", "http://example.com/upload", nil)
+				stream, err := client.Request(req, nil, 0)
+				if err != nil {
+					b.Fatal(err)
+				}
+				go stream.Run()
+
+				var wg sync.WaitGroup
+				for n := 0; n < upload; n += len(chunk) {
+					if headers && n%(1<<20) == 0 {
+						wg.Add(1)
+						go func(value string) {
+							defer wg.Done()
+							req, _ := http.NewRequest("GET", "http://example.com/", nil)
+							req.Header.Set("X-Large", value)
+							if _, err := request(client, req); err != nil {
+								b.Error(err)
+							}
+						}(values[(n>>20)%len(values)])
+					}
+					if _, err := stream.Write(chunk); err != nil {
+						b.Fatal(err)
+					}
+				}
+				body, err := ioutil.ReadAll(stream)
+				if err != nil || string(body) != fmt.Sprint(upload) {
+					b.Fatalf("upload got %q, error %v", body, err)
+				}
+				stream.Close()
+				wg.Wait()
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package spdy
+
+import (
+	"context"
+)
+
+// requestCapacitor is implemented by connections which
+// can report how many more requests they can send without
+// exceeding the server's limit on concurrent streams. ok
+// is false once the connection has closed, or is going
+// away, so cannot send any more requests.
+type requestCapacitor interface {
+	requestCapacity() (n uint32, ok bool)
+}
+
+// pooledConns returns each of the SPDY connections
+// in the pool. This must be called with the
+// Transport's lock held.
+func (t *Transport) pooledConns() []Conn {
+	conns := make([]Conn, 0, len(t.spdyConns))
+	for _, conn := range t.spdyConns {
+		conns = append(conns, conn)
+	}
+	for _, extra := range t.extraConns {
+		conns = append(conns, extra...)
+	}
+	return conns
+}
+
+// spdyConn returns the pooled SPDY connection to host
+// which should be used for a new request. ok indicates
+// whether any connection to host is pooled, and free
+// whether the one returned can take the request. The
+// host's first connection is preferred, followed by any
+// extra connections, in the order they were dialled. If
+// none can take the request, the first is returned.
+// Connections which have closed, or received a GOAWAY,
+// are removed from the pool. This must be called with
+// the Transport's lock held.
+func (t *Transport) spdyConn(host string) (conn Conn, ok, free bool) {
+	conns := make([]Conn, 0, 1+len(t.extraConns[host]))
+	if conn, ok := t.spdyConns[host]; ok {
+		conns = append(conns, conn)
+	}
+	conns = append(conns, t.extraConns[host]...)
+
+	var first Conn
+	for _, conn := range conns {
+		if t.MaxStreamsPerConn > 0 && uint32(t.inflight[conn]) >= t.MaxStreamsPerConn {
+			if first == nil {
+				first = conn
+			}
+			continue
+		}
+		c, ok := conn.(requestCapacitor)
+		if !ok {
+			return conn, true, true
+		}
+		switch n, ok := c.requestCapacity(); {
+		case !ok:
+			debug.Printf("Removing closed SPDY connection to %q from the pool.\n", host)
+			t.unpool(host, conn)
+		case n > 0:
+			return conn, true, true
+		case first == nil:
+			first = conn
+		}
+	}
+	return first, first != nil, false
+}
+
+// acquire records that a request is being sent
+// on conn. This must be called with the Transport's
+// lock held.
+func (t *Transport) acquire(conn Conn) {
+	if t.inflight == nil {
+		t.inflight = make(map[Conn]int)
+	}
+	t.inflight[conn]++
+}
+
+// release records that a request sent on conn has
+// finished, returning the number still in progress.
+// This must be called with the Transport's lock held.
+func (t *Transport) release(conn Conn) int {
+	t.inflight[conn]--
+	remaining := t.inflight[conn]
+	if remaining <= 0 {
+		delete(t.inflight, conn)
+		if _, ok := t.lastUsed[conn]; ok {
+			t.lastUsed[conn] = t.getClock().Now()
+		}
+	}
+	return remaining
+}
+
+// unpool removes conn from the pool, if it is still
+// pooled for host, freeing its connection slot, and
+// reports whether it was. This must be called with
+// the Transport's lock held.
+func (t *Transport) unpool(host string, conn Conn) bool {
+	pooled := false
+	if t.spdyConns[host] == conn {
+		delete(t.spdyConns, host)
+		delete(t.connAddrs, host)
+		pooled = true
+	} else {
+		extra := t.extraConns[host]
+		for i, c := range extra {
+			if c == conn {
+				t.extraConns[host] = append(extra[:i:i], extra[i+1:]...)
+				pooled = true
+				break
+			}
+		}
+		if len(t.extraConns[host]) == 0 {
+			delete(t.extraConns, host)
+		}
+	}
+	if !pooled {
+		return false
+	}
+	delete(t.lastUsed, conn)
+	delete(t.connIPs, conn)
+
+	// The connection's slot can be used by another dial.
+	select {
+	case t.connLimit[host] <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// closeIdle closes conn gracefully once it has been
+// idle for the Transport's IdleConnTimeout, removing
+// it from the pool. closeIdle returns once the
+// connection has left the pool.
+func (t *Transport) closeIdle(host string, conn Conn) {
+	for {
+		t.m.Lock()
+		if !t.isPooled(host, conn) {
+			t.m.Unlock()
+			return
+		}
+		wait := t.IdleConnTimeout
+		if t.inflight[conn] == 0 {
+			idle := t.getClock().Now().Sub(t.lastUsed[conn])
+			if idle >= t.IdleConnTimeout {
+				t.unpool(host, conn)
+				t.m.Unlock()
+
+				debug.Printf("SPDY connection to %q has been idle for %s. Closing it.\n", host, idle)
+				go shutdown(context.Background(), conn)
+				return
+			}
+			wait = t.IdleConnTimeout - idle
+		}
+		t.m.Unlock()
+
+		<-t.getClock().After(wait)
+	}
+}
+
+// isPooled indicates whether conn is pooled for
+// host. This must be called with the Transport's
+// lock held.
+func (t *Transport) isPooled(host string, conn Conn) bool {
+	if t.spdyConns[host] == conn {
+		return true
+	}
+	for _, c := range t.extraConns[host] {
+		if c == conn {
+			return true
+		}
+	}
+	return false
+}
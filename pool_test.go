@@ -0,0 +1,506 @@
+package spdy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a bytes.Buffer which is
+// safe for use by several goroutines.
+type lockedBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Len() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Len()
+}
+
+// Pooled control frames are only reused once they have been
+// handled, or sent, including being formatted for the debug
+// output. PINGs, RST_STREAMs and WINDOW_UPDATEs are sent in
+// both directions at once, so this is most useful with the
+// race detector.
+func TestFramePoolRace(t *testing.T) {
+	for _, version := range versions {
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			// The debug output is restored once the
+			// connections have stopped, so this cleanup
+			// is registered first.
+			output := new(lockedBuffer)
+			SetDebugOutput(output)
+			t.Cleanup(func() { SetDebugOutput(ioutil.Discard) })
+
+			chunk := make([]byte, 16<<10)
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for i := 0; i < 16; i++ {
+					if _, err := w.Write(chunk); err != nil {
+						return
+					}
+				}
+			})}
+			server, client := pipeConns(t, srv, version)
+
+			within(t, 60*time.Second, "the flood", func() {
+				var wg sync.WaitGroup
+				for _, conn := range []Conn{server, client} {
+					for i := 0; i < 4; i++ {
+						wg.Add(1)
+						go func(conn Conn) {
+							defer wg.Done()
+							for j := 0; j < 100; j++ {
+								c, err := conn.Ping()
+								if err != nil {
+									t.Error(err)
+									return
+								}
+								if ping := <-c; ping.Err != nil {
+									t.Error(ping.Err)
+									return
+								}
+							}
+						}(conn)
+					}
+				}
+				for i := 0; i < 4; i++ {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						for j := 0; j < 10; j++ {
+							req, _ := http.NewRequest("GET", "http://example.com/", nil)
+							stream, err := client.Request(req, nil, 0)
+							if err != nil {
+								t.Error(err)
+								return
+							}
+							go stream.Run()
+							if (i+j)%2 == 0 {
+								stream.Reset(RST_STREAM_CANCEL)
+							} else {
+								io.Copy(ioutil.Discard, stream)
+							}
+							stream.Close()
+						}
+					}(i)
+				}
+				wg.Wait()
+			})
+
+			if output.Len() == 0 {
+				t.Fatal("no debug output was written")
+			}
+		})
+	}
+}
+
+// A client sends PINGs as fast as the server replies. With
+// pooling, the server makes no allocations for each PING.
+func BenchmarkPingFlood(b *testing.B) {
+	for _, pooled := range []bool{true, false} {
+		b.Run(fmt.Sprintf("pooled=%v", pooled), func(b *testing.B) {
+			local, remote := net.Pipe()
+			server, err := NewServerConn(remote, &http.Server{Handler: http.NotFoundHandler()}, 3)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if !pooled {
+				server.(*connV3).frames = nil
+			}
+			go server.Run()
+			defer server.Close()
+			defer local.Close()
+
+			// Count the replies, recycling them so that
+			// the client does not add to the allocations.
+			// Fewer PINGs are in flight than the server
+			// will queue replies for, so the server does
+			// not close the connection as flooded.
+			inflight := make(chan struct{}, 1000)
+			replies := make(chan error, 1)
+			go func() {
+				r := bufio.NewReader(local)
+				pool := new(framePoolV3)
+				for n := 0; n < b.N; {
+					frame, err := readFrameV3(r, pool, MAX_FRAME_SIZE)
+					if err != nil {
+						replies <- err
+						return
+					}
+					if _, ok := frame.(*pingFrameV3); ok {
+						<-inflight
+						n++
+					}
+					pool.recycle(frame)
+				}
+				replies <- nil
+			}()
+
+			ping, err := MarshalFrame(&pingFrameV3{PingID: 1})
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				select {
+				case inflight <- struct{}{}:
+				case err := <-replies:
+					b.Fatal(err)
+				}
+				if _, err := local.Write(ping); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := <-replies; err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+// countingTransport returns a Transport for requests to
+// server, which counts the connections it dials.
+func countingTransport(t *testing.T, server *httptest.Server) (tr *Transport, dials func() int) {
+	var m sync.Mutex
+	n := 0
+	tr = NewTransport(server.Client().Transport.(*http.Transport).TLSClientConfig)
+	t.Cleanup(tr.CloseIdleConnections)
+	tr.Dial = func(network, addr string) (net.Conn, error) {
+		m.Lock()
+		n++
+		m.Unlock()
+		return net.Dial(network, addr)
+	}
+	return tr, func() int {
+		m.Lock()
+		defer m.Unlock()
+		return n
+	}
+}
+
+// Once each pooled connection has MaxStreamsPerConn
+// requests in flight, another is dialled, within the
+// MaxIdleConnsPerHost limit, and added to the pool as an
+// extra connection. New requests prefer the first.
+func TestMaxStreamsPerConn(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 5)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+		fmt.Fprint(w, r.RemoteAddr)
+	}))
+	AddSPDY(server.Config)
+	server.TLS = &tls.Config{NextProtos: NPNStrings()}
+	server.StartTLS()
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	tr, dials := countingTransport(t, server)
+	tr.MaxStreamsPerConn = 2
+	tr.MaxIdleConnsPerHost = 2
+	client := &http.Client{Transport: tr}
+	get := func(path string) string {
+		res, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Error(err)
+			return ""
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return string(body)
+	}
+
+	// Each request is started before the next, so the
+	// first two share the first connection.
+	addrs := make(chan string, 4)
+	for i := 0; i < 4; i++ {
+		go func() { addrs <- get("/slow") }()
+		within(t, 5*time.Second, "the request starting", func() { <-started })
+	}
+	if n := dials(); n != 2 {
+		t.Fatalf("dialled %d connections for 4 requests, want 2", n)
+	}
+	tr.m.Lock()
+	extra := len(tr.extraConns[host])
+	tr.m.Unlock()
+	if extra != 1 {
+		t.Fatalf("pooled %d extra connections, want 1", extra)
+	}
+
+	close(release)
+	seen := make(map[string]int)
+	within(t, 5*time.Second, "the responses", func() {
+		for i := 0; i < 4; i++ {
+			seen[<-addrs]++
+		}
+	})
+	if len(seen) != 2 {
+		t.Fatalf("the requests used connections %v, want 2 each on 2", seen)
+	}
+	for addr, n := range seen {
+		if n != 2 {
+			t.Errorf("%d requests used the connection from %s, want 2", n, addr)
+		}
+	}
+
+	// Once they are free, the first connection is used.
+	first := get("/")
+	if again := get("/"); again != first || seen[first] != 2 {
+		t.Errorf("requests used connections from %s and %s", first, again)
+	}
+	if n := dials(); n != 2 {
+		t.Errorf("dialled %d connections, want 2", n)
+	}
+}
+
+// A connection which has had no requests for the
+// IdleConnTimeout is removed from the pool and closed,
+// and the next request dials again. Requests restart
+// the timeout.
+func TestIdleConnTimeout(t *testing.T) {
+	server := newSPDYServer(t, "idle")
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	clock := newFakeClock()
+	tr, dials := countingTransport(t, server)
+	tr.clock = clock
+	tr.IdleConnTimeout = time.Minute
+	client := &http.Client{Transport: tr}
+	get := func() {
+		t.Helper()
+		res, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	pooled := func() Conn {
+		tr.m.Lock()
+		defer tr.m.Unlock()
+		return tr.spdyConns[host]
+	}
+
+	get()
+	conn := pooled()
+	if conn == nil {
+		t.Fatal("the connection was not pooled")
+	}
+	clock.waitPending(t, 1)
+	clock.Advance(30 * time.Second)
+	get()
+
+	// The timer set when the connection was pooled finds
+	// it used 30 seconds ago, and waits the remainder.
+	clock.Advance(45 * time.Second)
+	clock.waitPending(t, 1)
+	if pooled() != conn {
+		t.Fatal("the connection was removed 45 seconds after it was used")
+	}
+
+	clock.Advance(15 * time.Second)
+	within(t, 5*time.Second, "removing the idle connection", func() {
+		for pooled() != nil {
+			time.Sleep(time.Millisecond)
+		}
+	})
+	within(t, 5*time.Second, "closing the idle connection", func() {
+		for {
+			if _, ok := conn.(requestCapacitor).requestCapacity(); !ok {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	get()
+	if n := dials(); n != 2 {
+		t.Errorf("dialled %d connections, want 2", n)
+	}
+}
+
+// unpool removes a connection from wherever it is in the
+// pool, freeing its connection slot. Closed connections
+// are evicted when they are next considered for a request.
+func TestUnpool(t *testing.T) {
+	const host = "example.com:443"
+	tr := new(Transport)
+	tr.MaxIdleConnsPerHost = 3
+	tr.m.Lock()
+	defer tr.m.Unlock()
+	tr.prepare(host)
+
+	conns := make([]Conn, 4)
+	for i := range conns {
+		_, conns[i] = pipeConns(t, &http.Server{}, 3)
+		local, remote := net.Pipe()
+		defer local.Close()
+		defer remote.Close()
+		tr.addSPDYConn(host, conns[i], local)
+	}
+	first, second, third, fourth := conns[0], conns[1], conns[2], conns[3]
+	if tr.spdyConns[host] != first || len(tr.extraConns[host]) != 3 {
+		t.Fatalf("pooled %v and extras %v", tr.spdyConns[host], tr.extraConns[host])
+	}
+
+	// Each connection took a slot when it was dialled.
+	for len(tr.connLimit[host]) > 0 {
+		<-tr.connLimit[host]
+	}
+
+	if !tr.unpool(host, third) || tr.unpool(host, third) {
+		t.Fatal("unpool did not remove an extra connection exactly once")
+	}
+	if len(tr.connLimit[host]) != 1 {
+		t.Fatalf("%d connection slots are free, want 1", len(tr.connLimit[host]))
+	}
+	if extra := tr.extraConns[host]; len(extra) != 2 || extra[0] != second || extra[1] != fourth {
+		t.Fatalf("left extras %v, want %v", extra, []Conn{second, fourth})
+	}
+
+	// The first connection is preferred while it is open,
+	// and evicted once it has closed.
+	if conn, ok, free := tr.spdyConn(host); conn != first || !ok || !free {
+		t.Fatalf("spdyConn gave %v, %v, %v, want the first connection", conn, ok, free)
+	}
+	first.Close()
+	if conn, ok, free := tr.spdyConn(host); conn != second || !ok || !free {
+		t.Fatalf("spdyConn gave %v, %v, %v, want the second connection", conn, ok, free)
+	}
+	if tr.isPooled(host, first) || tr.connIPs[first] != nil || tr.connAddrs[host] != nil {
+		t.Fatal("the closed connection is still pooled")
+	}
+	if len(tr.connLimit[host]) != 2 {
+		t.Fatalf("%d connection slots are free, want 2", len(tr.connLimit[host]))
+	}
+
+	if !tr.unpool(host, second) || !tr.unpool(host, fourth) {
+		t.Fatal("unpool did not remove the remaining connections")
+	}
+	if _, ok := tr.extraConns[host]; ok {
+		t.Fatal("an empty list of extra connections was kept")
+	}
+	if _, ok, _ := tr.spdyConn(host); ok {
+		t.Fatal("spdyConn gave a connection from an empty pool")
+	}
+}
+
+// CloseConnections removes the pooled connections at once,
+// so the next request dials again, and closes each once its
+// requests in progress have finished, or at once when the
+// context is done.
+func TestCloseConnections(t *testing.T) {
+	server, started, release := drainServer(t, nil)
+	tr, dials := countingTransport(t, server)
+	get := func(path string) error {
+		res, err := tr.RoundTrip(mustRequest(t, server.URL+path))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if body, _ := ioutil.ReadAll(res.Body); string(body) != "ok" {
+			return fmt.Errorf("got body %q", body)
+		}
+		return nil
+	}
+	slow := func() <-chan error {
+		errs := make(chan error, 1)
+		go func() { errs <- get("/slow") }()
+		within(t, 5*time.Second, "the request starting", func() { <-started })
+		return errs
+	}
+	pooled := func() []Conn {
+		tr.m.Lock()
+		defer tr.m.Unlock()
+		return tr.pooledConns()
+	}
+
+	// Requests in progress finish before the connection
+	// is closed.
+	errs := slow()
+	conns := pooled()
+	if len(conns) != 1 {
+		t.Fatalf("pooled %d connections, want 1", len(conns))
+	}
+	closed := make(chan error, 1)
+	go func() { closed <- tr.CloseConnections(context.Background()) }()
+	within(t, 5*time.Second, "unpooling the connection", func() {
+		for len(pooled()) != 0 {
+			time.Sleep(time.Millisecond)
+		}
+	})
+	if err := ConnError(conns[0]); err != nil {
+		t.Fatalf("the connection closed with a request in progress: %v", err)
+	}
+	if err := get("/"); err != nil {
+		t.Fatal(err)
+	}
+	if n := dials(); n != 2 {
+		t.Errorf("dialled %d connections, want 2", n)
+	}
+
+	release <- struct{}{}
+	within(t, 5*time.Second, "the request in progress", func() {
+		if err := <-errs; err != nil {
+			t.Errorf("the request in progress failed: %v", err)
+		}
+	})
+	within(t, 5*time.Second, "CloseConnections", func() {
+		if err := <-closed; err != nil {
+			t.Errorf("CloseConnections gave %v", err)
+		}
+	})
+	if ConnError(conns[0]) == nil {
+		t.Error("the connection is still open")
+	}
+
+	// Once the context is done, they are cut off.
+	errs = slow()
+	conns = pooled()
+	if len(conns) != 1 {
+		t.Fatalf("pooled %d connections, want 1", len(conns))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := tr.CloseConnections(ctx); err != context.Canceled {
+		t.Errorf("CloseConnections gave %v, want context.Canceled", err)
+	}
+	within(t, 5*time.Second, "the request in progress", func() {
+		if err := <-errs; err == nil {
+			t.Error("the request in progress succeeded")
+		}
+	})
+	if ConnError(conns[0]) == nil {
+		t.Error("the connection is still open")
+	}
+	if err := get("/"); err != nil {
+		t.Fatal(err)
+	}
+	if n := dials(); n != 3 {
+		t.Errorf("dialled %d connections, want 3", n)
+	}
+	close(release)
+}
@@ -0,0 +1,88 @@
+package spdy_test
+
+import (
+	"testing"
+
+	"github.com/SlyMarbo/spdy"
+)
+
+func TestEncodePriority(t *testing.T) {
+	tests := []struct {
+		version uint16
+		max     spdy.Priority
+		shift   uint
+	}{
+		{3, 7, 5},
+		{2, 3, 6},
+	}
+
+	for _, test := range tests {
+		for p := spdy.Priority(0); p <= test.max; p++ {
+			b, err := spdy.EncodePriority(test.version, p)
+			if err != nil {
+				t.Errorf("SPDY/%d: priority %d gave %v", test.version, p, err)
+				continue
+			}
+			if want := byte(p) << test.shift; b != want {
+				t.Errorf("SPDY/%d: priority %d encoded as %08b, want %08b", test.version, p, b, want)
+			}
+			if got := spdy.DecodePriority(test.version, b); got != p {
+				t.Errorf("SPDY/%d: priority %d decoded as %d", test.version, p, got)
+			}
+		}
+
+		for _, p := range []spdy.Priority{test.max + 1, 255} {
+			if b, err := spdy.EncodePriority(test.version, p); err == nil {
+				t.Errorf("SPDY/%d: priority %d encoded as %08b", test.version, p, b)
+			}
+		}
+
+		// Unused bits are ignored.
+		for b := 0; b < 256; b++ {
+			if got, want := spdy.DecodePriority(test.version, byte(b)), spdy.Priority(b>>test.shift); got != want {
+				t.Errorf("SPDY/%d: %08b decoded as %d, want %d", test.version, b, got, want)
+			}
+		}
+	}
+
+	if _, err := spdy.EncodePriority(4, 0); err == nil {
+		t.Error("encoded a priority for SPDY/4")
+	}
+}
+
+// SYN_STREAM frames carry the priority in the top bits
+// of the priority byte, and the rest must be clear.
+func TestSynStreamPriority(t *testing.T) {
+	tests := []struct {
+		version uint16
+		wire    string
+		mask    byte
+	}{
+		{3, "8003 0001 00 00000a 00000001 00000000 0000", 0xe0},
+		{2, "8002 0001 00 00000c 00000001 00000000 0000 0000", 0xc0},
+	}
+
+	for _, test := range tests {
+		for b := 0; b < 256; b++ {
+			data := wire(test.wire)
+			data[16] = byte(b)
+			frame, err := spdy.ParseFrame(data, test.version)
+			if byte(b)&^test.mask != 0 {
+				if err == nil {
+					t.Errorf("SPDY/%d: accepted priority byte %08b", test.version, b)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("SPDY/%d: priority byte %08b: %v", test.version, b, err)
+			}
+			out, err := spdy.MarshalFrame(frame)
+			if err != nil {
+				t.Fatalf("SPDY/%d: priority byte %08b: %v", test.version, b, err)
+			}
+			if out[16] != byte(b) {
+				t.Errorf("SPDY/%d: priority byte %08b marshalled as %08b", test.version, b, out[16])
+			}
+		}
+	}
+}
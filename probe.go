@@ -0,0 +1,101 @@
+package spdy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// probeTimeout is the time allowed for the rest of an
+// HTTP/1.x request, and its rejection, once the start
+// of one has been seen on a SPDY connection.
+const probeTimeout = 5 * time.Second
+
+// maxProbeSize is the maximum number of bytes read
+// from an HTTP/1.x request sent on a SPDY connection.
+const maxProbeSize = 64 << 10
+
+// rejectHTTPProbe checks whether a new server connection
+// has been sent an HTTP/1.x request, such as an old
+// client's attempt to upgrade to SPDY with the Upgrade
+// header, in place of SPDY frames. If so, the request is
+// answered with a plain HTTP error, and rejectHTTPProbe
+// returns true, after which the connection should be
+// closed without sending any frames.
+//
+// Only the first HTTPProbeTimeout of the connection is
+// waited for, so clients which expect the server to
+// speak first are not held up for long.
+func rejectHTTPProbe(conn net.Conn, buf *bufio.Reader, clock clock, version uint16) bool {
+	if HTTPProbeTimeout <= 0 {
+		return false
+	}
+
+	conn.SetReadDeadline(clock.Now().Add(HTTPProbeTimeout))
+	start, err := buf.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+
+	// SPDY control frames start with 0x80, and no data frame
+	// can be valid before a stream is opened, so a request
+	// line is the only sensible reading of an ASCII letter.
+	if err != nil || start[0] < 'A' || start[0] > 'Z' {
+		return false
+	}
+
+	conn.SetReadDeadline(clock.Now().Add(probeTimeout))
+	req, err := http.ReadRequest(bufio.NewReader(io.LimitReader(buf, maxProbeSize)))
+
+	status := http.StatusHTTPVersionNotSupported
+	msg := fmt.Sprintf("This server only accepts SPDY/%d, negotiated with TLS NPN or ALPN.", version)
+	switch {
+	case err != nil:
+		status = http.StatusBadRequest
+		log.Printf("Warning: Received malformed data from %s in place of SPDY/%d.\n", conn.RemoteAddr(), version)
+	case upgradesToSPDY(req):
+		status = http.StatusBadRequest
+		msg = "SPDY cannot be started with the HTTP Upgrade header. " + msg
+		log.Printf("Warning: Rejected HTTP Upgrade to %q from %s (%s).\n", req.Header.Get("Upgrade"), conn.RemoteAddr(), req.UserAgent())
+	default:
+		log.Printf("Warning: Rejected %s request from %s in place of SPDY/%d (%s).\n", req.Proto, conn.RemoteAddr(), version, req.UserAgent())
+	}
+	if HTTPProbeDocs != "" {
+		msg += " See " + HTTPProbeDocs
+	}
+
+	body := msg + "\n"
+	res := &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+	}
+	res.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	conn.SetWriteDeadline(clock.Now().Add(probeTimeout))
+	if err := res.Write(conn); err != nil {
+		debug.Printf("Error: Failed to reject HTTP request: %v\n", err)
+	}
+
+	return true
+}
+
+// upgradesToSPDY indicates whether the request asks
+// to upgrade the connection to a version of SPDY.
+func upgradesToSPDY(req *http.Request) bool {
+	for _, value := range req.Header["Upgrade"] {
+		for _, proto := range strings.Split(value, ",") {
+			if strings.HasPrefix(strings.ToLower(strings.TrimSpace(proto)), "spdy/") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+package spdy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpgradesToSPDY(t *testing.T) {
+	tests := []struct {
+		upgrade []string
+		want    bool
+	}{
+		{nil, false},
+		{[]string{"websocket"}, false},
+		{[]string{"spdy/3"}, true},
+		{[]string{"SPDY/2"}, true},
+		{[]string{"h2c, spdy/3.1"}, true},
+		{[]string{"websocket", "spdy/3"}, true},
+		{[]string{"notspdy/3"}, false},
+	}
+	for _, test := range tests {
+		req := &http.Request{Header: http.Header{"Upgrade": test.upgrade}}
+		if got := upgradesToSPDY(req); got != test.want {
+			t.Errorf("Upgrade %q: got %v, want %v", test.upgrade, got, test.want)
+		}
+	}
+}
+
+// HTTP/1.x requests sent in place of SPDY frames, captured
+// from old clients and tools, get a plain HTTP error, and
+// the connection is closed without sending any frames.
+func TestHTTPProbe(t *testing.T) {
+	tests := []struct {
+		name   string
+		probe  string
+		status int
+		want   string // in the body.
+	}{
+		{
+			"Upgrade",
+			"GET / HTTP/1.1\r\nHost: www.example.com\r\nConnection: Upgrade\r\nUpgrade: spdy/3\r\n" +
+				"User-Agent: Mozilla/5.0 (compatible; legacy-spdy/0.9)\r\n\r\n",
+			http.StatusBadRequest,
+			"SPDY cannot be started with the HTTP Upgrade header.",
+		},
+		{
+			"HTTP/1.1",
+			"GET /index.html HTTP/1.1\r\nHost: www.example.com\r\nUser-Agent: curl/7.29.0\r\nAccept: */*\r\n\r\n",
+			http.StatusHTTPVersionNotSupported,
+			"negotiated with TLS NPN or ALPN",
+		},
+		{
+			"HTTP/1.0",
+			"HEAD / HTTP/1.0\r\n\r\n",
+			http.StatusHTTPVersionNotSupported,
+			"",
+		},
+		{
+			"malformed",
+			"GARBAGE\r\n\r\n",
+			http.StatusBadRequest,
+			"negotiated with TLS NPN or ALPN",
+		},
+	}
+
+	for _, test := range tests {
+		for _, version := range versions {
+			test, version := test, version
+			t.Run(fmt.Sprintf("SPDY/%d %s", version, test.name), func(t *testing.T) {
+				srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					t.Error("the probe was served")
+				})}
+				reasons := make(chan error, 1)
+				conn := rawServerConnWith(t, srv, version, func(server Conn) {
+					server.(hooker).setHooks(&ConnHooks{OnClose: func(conn Conn, reason error) { reasons <- reason }})
+				})
+				go io.WriteString(conn, test.probe)
+
+				within(t, 5*time.Second, "the reply", func() {
+					r := bufio.NewReader(conn)
+					res, err := http.ReadResponse(r, nil)
+					if err != nil {
+						t.Errorf("the reply was not HTTP: %v", err)
+						return
+					}
+					body, _ := ioutil.ReadAll(res.Body)
+					if res.StatusCode != test.status {
+						t.Errorf("got status %d, want %d", res.StatusCode, test.status)
+					}
+					if !strings.Contains(string(body), test.want) || !strings.Contains(string(body), HTTPProbeDocs) {
+						t.Errorf("got body %q, want %q and the docs", body, test.want)
+					}
+					if rest, _ := ioutil.ReadAll(r); len(rest) != 0 {
+						t.Errorf("%d bytes were sent after the reply", len(rest))
+					}
+				})
+
+				select {
+				case reason := <-reasons:
+					if !errors.Is(reason, ErrNotSPDY) {
+						t.Errorf("the connection closed with %v, want ErrNotSPDY", reason)
+					}
+				case <-time.After(5 * time.Second):
+					t.Error("OnClose was not called")
+				}
+			})
+		}
+	}
+}
+
+// With HTTPProbeTimeout zero, a new connection sends its
+// SETTINGS at once, and an HTTP/1.x request is read as
+// SPDY frames.
+func TestHTTPProbeDisabled(t *testing.T) {
+	timeout := HTTPProbeTimeout
+	HTTPProbeTimeout = 0
+	defer func() { HTTPProbeTimeout = timeout }()
+
+	for _, version := range versions {
+		conn := rawServerConn(t, &http.Server{}, version)
+		go io.WriteString(conn, "GET / HTTP/1.1\r\nUpgrade: spdy/3\r\n\r\n")
+		within(t, 5*time.Second, "the first frame", func() {
+			frame, err := readRawFrame(conn, version)
+			if err != nil {
+				t.Errorf("SPDY/%d: %v", version, err)
+				return
+			}
+			switch frame.(type) {
+			case *settingsFrameV3, *settingsFrameV2:
+			default:
+				t.Errorf("SPDY/%d: the first frame was %v, want SETTINGS", version, frame)
+			}
+		})
+	}
+}
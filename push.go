@@ -0,0 +1,106 @@
+package spdy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+)
+
+// pusherKey is the context key for the Pusher
+// of the stream serving a request.
+type pusherKey struct{}
+
+// pushLabelKey is the context key for the
+// label given with WithPushLabel.
+type pushLabelKey struct{}
+
+// PusherFromContext returns the Pusher of the SPDY stream
+// serving the request whose context is ctx, so that code
+// without the ResponseWriter, such as template helpers,
+// can push resources. Pushes made this way are subject to
+// the same limits as those made with the ResponseWriter.
+// If ctx did not come from a SPDY request, ok is false.
+//
+//	func renderImage(ctx context.Context, src string) template.HTML {
+//		if pusher, ok := spdy.PusherFromContext(ctx); ok {
+//			pusher.Push(src, nil)
+//		}
+//		// ...
+//	}
+func PusherFromContext(ctx context.Context) (pusher Pusher, ok bool) {
+	s, ok := ctx.Value(pusherKey{}).(labelPusher)
+	if !ok {
+		return nil, false
+	}
+	if label, ok := ctx.Value(pushLabelKey{}).(string); ok {
+		return &labelledPusher{s, label}, true
+	}
+	return s, true
+}
+
+// WithPushLabel returns a copy of ctx in which pushes made
+// with the Pusher from PusherFromContext are labelled with
+// label, as given to ConnHooks.OnPush. Without a label,
+// pushes are labelled with the function which called Push.
+func WithPushLabel(ctx context.Context, label string) context.Context {
+	return context.WithValue(ctx, pushLabelKey{}, label)
+}
+
+// PushInfo describes a server push, for auditing what
+// was pushed, and why. It is given to ConnHooks.OnPush.
+type PushInfo struct {
+	Origin   StreamID // stream of the request the push accompanies.
+	StreamID StreamID // stream carrying the push.
+	URL      string   // URL of the pushed resource.
+	Label    string   // label from WithPushLabel, or the function which called Push.
+}
+
+// labelPusher is implemented by server streams,
+// which can push with a given label.
+type labelPusher interface {
+	Pusher
+	pushLabelled(path string, header http.Header, label string) (io.WriteCloser, error)
+}
+
+// labelledPusher pushes with a fixed label.
+type labelledPusher struct {
+	stream labelPusher
+	label  string
+}
+
+func (p *labelledPusher) Push(path string, header http.Header) (io.WriteCloser, error) {
+	return p.stream.pushLabelled(path, header, p.label)
+}
+
+// pushCaller returns a label describing the function
+// which called Push, skip frames above pushCaller's
+// caller.
+func pushCaller(skip int) string {
+	pc, file, line, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return ""
+	}
+	if fn := runtime.FuncForPC(pc); fn != nil {
+		return fmt.Sprintf("%s (%s:%d)", fn.Name(), file, line)
+	}
+	return fmt.Sprintf("%s:%d", file, line)
+}
+
+// PushErrorReceiver is implemented by Receivers which should
+// be told when a push they accepted will not be completed,
+// such as when the server sends a GOAWAY before processing
+// the request the push accompanies. The push is reset, and
+// no more of it is given to the Receiver.
+type PushErrorReceiver interface {
+	ReceivePushError(request *http.Request, err error)
+}
+
+// receivePushError tells receiver that the push of request
+// failed with err, if receiver is a PushErrorReceiver.
+func receivePushError(receiver Receiver, request *http.Request, err error) {
+	if r, ok := receiver.(PushErrorReceiver); ok {
+		r.ReceivePushError(request, err)
+	}
+}
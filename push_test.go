@@ -0,0 +1,165 @@
+package spdy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// pushCollector is a Receiver which accepts every push,
+// and reports when the first data of one arrives.
+type pushCollector struct {
+	data chan struct{}
+}
+
+func (p *pushCollector) ReceiveData(request *http.Request, data []byte, final bool) {
+	if len(data) > 0 {
+		select {
+		case p.data <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (p *pushCollector) ReceiveHeader(request *http.Request, header http.Header) {}
+func (p *pushCollector) ReceiveRequest(request *http.Request) bool               { return true }
+
+// setPushReceiver sets the Receiver for a client
+// connection's pushes, before the connection is run.
+func setPushReceiver(conn Conn, push Receiver) {
+	switch conn := conn.(type) {
+	case *connV3:
+		conn.pushReceiver = push
+	case *connV2:
+		conn.pushReceiver = push
+	}
+}
+
+// pushesLeft returns the number of push streams which
+// a server connection still holds, and the number of
+// slots taken in its push stream limit.
+func pushesLeft(conn Conn) (streams int, slots uint32) {
+	switch conn := conn.(type) {
+	case *connV3:
+		conn.Lock()
+		for _, stream := range conn.streams {
+			if _, ok := stream.(*pushStreamV3); ok {
+				streams++
+			}
+		}
+		conn.Unlock()
+		conn.pushStreamLimit.Lock()
+		slots = conn.pushStreamLimit.current
+		conn.pushStreamLimit.Unlock()
+	case *connV2:
+		conn.Lock()
+		for _, stream := range conn.streams {
+			if _, ok := stream.(*pushStreamV2); ok {
+				streams++
+			}
+		}
+		conn.Unlock()
+		conn.pushStreamLimit.Lock()
+		slots = conn.pushStreamLimit.current
+		conn.pushStreamLimit.Unlock()
+	}
+	return streams, slots
+}
+
+// Cancelling a request part-way through a push it caused
+// ends the push as well. The push stream is forgotten and
+// its slot in the stream limit freed, and the data it had
+// in flight does not use up the session window, so a large
+// response can still be sent afterwards.
+func TestCancelOriginMidPush(t *testing.T) {
+	const large = 1 << 20
+	for _, version := range versions {
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			pushErr := make(chan error, 1)
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/large" {
+					io.Copy(w, io.LimitReader(zeroReader{}, large))
+					return
+				}
+
+				push, err := Push(w, "http://example.com/pushed")
+				if err != nil {
+					pushErr <- err
+					return
+				}
+				w.(http.Flusher).Flush()
+
+				// The push never ends by itself.
+				chunk := make([]byte, 16<<10)
+				for {
+					if _, err := push.Write(chunk); err != nil {
+						pushErr <- err
+						return
+					}
+				}
+			})}
+			collector := &pushCollector{data: make(chan struct{}, 1)}
+			server, client := pipeConnsWith(t, srv, version, func(server, client Conn) {
+				if version >= 3 {
+					server.(sessionFlowController).enableSessionFlowControl()
+					client.(sessionFlowController).enableSessionFlowControl()
+				}
+				setPushReceiver(client, collector)
+			})
+
+			req, _ := http.NewRequest("GET", "http://example.com/", nil)
+			stream, err := client.Request(req, nil, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go stream.Run()
+			select {
+			case <-collector.data:
+			case err := <-pushErr:
+				t.Fatalf("pushing: %v", err)
+			case <-time.After(5 * time.Second):
+				t.Fatal("no pushed data was received")
+			}
+
+			if err := stream.Reset(RST_STREAM_CANCEL); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case err := <-pushErr:
+				if err == nil {
+					t.Fatal("the push ended without an error")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the push was not cancelled")
+			}
+
+			within(t, 5*time.Second, "releasing the push", func() {
+				for {
+					streams, slots := pushesLeft(server)
+					if streams == 0 && slots == 0 {
+						return
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			})
+
+			within(t, 10*time.Second, "the large response", func() {
+				req, _ := http.NewRequest("GET", "http://example.com/large", nil)
+				stream, err := client.Request(req, nil, 0)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				go stream.Run()
+				defer stream.Close()
+				n, err := io.Copy(ioutil.Discard, stream)
+				if err != nil || n != large {
+					t.Errorf("read %d bytes, error %v, want %d", n, err, large)
+				}
+			})
+		})
+	}
+}
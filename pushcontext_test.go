@@ -0,0 +1,162 @@
+package spdy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setPushLimit limits the concurrent pushes of a
+// server connection.
+func setPushLimit(conn Conn, n uint32) {
+	switch conn := conn.(type) {
+	case *connV3:
+		conn.pushStreamLimit.SetLimit(n)
+	case *connV2:
+		conn.pushStreamLimit.SetLimit(n)
+	}
+}
+
+// pushFromTemplate pushes src from code which
+// has only the request's context.
+func pushFromTemplate(ctx context.Context, src string) (io.WriteCloser, error) {
+	pusher, ok := PusherFromContext(ctx)
+	if !ok {
+		return nil, fmt.Errorf("no Pusher for %s", src)
+	}
+	return pusher.Push(src, nil)
+}
+
+// Code with only the request's context can push, within
+// the connection's push limit, and each push is reported
+// with its origin stream and the function which made it,
+// or the label given, both as it is made, and once the
+// origin request is complete.
+func TestPusherFromContext(t *testing.T) {
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			var m sync.Mutex
+			var pushes []PushInfo
+			var complete *RequestInfo
+			var server Conn
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				setPushLimit(server, 1)
+				ctx := r.Context()
+
+				first, err := pushFromTemplate(ctx, "/style.css")
+				if err != nil {
+					t.Errorf("the first push failed: %v", err)
+					return
+				}
+				if _, err := pushFromTemplate(ctx, "/over-limit.css"); err != ErrTooManyStreams {
+					t.Errorf("a push over the limit gave %v, want ErrTooManyStreams", err)
+				}
+				first.Write([]byte("style"))
+				first.Close()
+
+				// The closed push's slot is free again.
+				second, err := pushFromTemplate(WithPushLabel(ctx, "hero image"), "https://example.com/hero.png")
+				if err != nil {
+					t.Errorf("the second push failed: %v", err)
+					return
+				}
+				second.Write([]byte("image"))
+				second.Close()
+				w.Write([]byte("page"))
+			})}
+
+			collector := &pushCollector{data: make(chan struct{}, 1)}
+			server, client := pipeConnsWith(t, srv, version, func(server, client Conn) {
+				server.(hooker).setHooks(&ConnHooks{
+					OnPush: func(conn Conn, push PushInfo) {
+						m.Lock()
+						pushes = append(pushes, push)
+						m.Unlock()
+					},
+					OnRequestComplete: func(conn Conn, info RequestInfo) {
+						m.Lock()
+						complete = &info
+						m.Unlock()
+					},
+				})
+				setPushReceiver(client, collector)
+			})
+
+			within(t, 5*time.Second, "the request", func() {
+				req, _ := http.NewRequest("GET", "https://example.com/page", nil)
+				res, err := request(client, req)
+				if err != nil {
+					t.Errorf("the request failed: %v", err)
+				} else if body := res.Data.String(); body != "page" {
+					t.Errorf("got body %q, want %q", body, "page")
+				}
+			})
+
+			// Hooks are called asynchronously.
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				m.Lock()
+				n, completed := len(pushes), complete != nil
+				m.Unlock()
+				if n >= 2 && completed || time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			m.Lock()
+			defer m.Unlock()
+			if len(pushes) != 2 {
+				t.Fatalf("%d pushes were reported, want 2: %+v", len(pushes), pushes)
+			}
+			for _, push := range pushes {
+				if push.Origin != 1 {
+					t.Errorf("%s was pushed with origin %d, want 1", push.URL, push.Origin)
+				}
+				if push.StreamID == 0 || push.StreamID&1 != 0 {
+					t.Errorf("%s was pushed on stream %d, want an even stream", push.URL, push.StreamID)
+				}
+			}
+			if url := pushes[0].URL; url != "https://example.com/style.css" {
+				t.Errorf("the first push was of %s, want the path resolved against the request", url)
+			}
+			if label := pushes[0].Label; !strings.Contains(label, "pushFromTemplate") || !strings.Contains(label, "pushcontext_test.go:") {
+				t.Errorf("the first push was labelled %q, want its caller", label)
+			}
+			if label := pushes[1].Label; label != "hero image" {
+				t.Errorf("the second push was labelled %q, want %q", label, "hero image")
+			}
+			if complete == nil || complete.StreamID != 1 || !reflect.DeepEqual(complete.Pushes, pushes) {
+				t.Errorf("the request was completed with %+v, want the pushes %+v", complete, pushes)
+			}
+		})
+	}
+}
+
+// Contexts which did not come from a SPDY request have
+// no Pusher.
+func TestPusherFromContextNotSPDY(t *testing.T) {
+	if _, ok := PusherFromContext(context.Background()); ok {
+		t.Error("the background context had a Pusher")
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := PusherFromContext(r.Context()); ok {
+			t.Error("an HTTP/1.1 request had a Pusher")
+		}
+	}))
+	defer server.Close()
+	res, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+}
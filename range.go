@@ -0,0 +1,228 @@
+package spdy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RangeOptions configures a ranged download with
+// Transport.DownloadRanged.
+type RangeOptions struct {
+	// ChunkSize is the number of bytes requested in
+	// each range request. If zero, DefaultRangeChunkSize
+	// is used.
+	ChunkSize int64
+
+	// Concurrency is the maximum number of range requests
+	// in flight at once. If zero, DefaultRangeConcurrency
+	// is used.
+	Concurrency int
+
+	// Retries is the number of times a segment is retried
+	// after a retryable error, such as the request not
+	// being processed due to a GOAWAY.
+	Retries int
+
+	// Progress, if non-nil, is called each time a segment
+	// has been written, with the total number of bytes
+	// written so far and the size of the resource.
+	Progress func(written, total int64)
+}
+
+// The default number of bytes requested in each segment
+// of a ranged download.
+const DefaultRangeChunkSize = 1 << 20
+
+// The default maximum number of concurrent range requests
+// in a ranged download.
+const DefaultRangeConcurrency = 4
+
+// DownloadRanged fetches the resource at url and writes it to w,
+// splitting it into several range requests, which are made in
+// parallel over the same SPDY connection. The first range request
+// is used to determine the resource's size. If the server does not
+// support range requests, the whole resource is fetched with one
+// request instead.
+//
+// DownloadRanged returns the number of bytes written to w.
+func (t *Transport) DownloadRanged(ctx context.Context, url string, w io.WriterAt, opts RangeOptions) (int64, error) {
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = DefaultRangeChunkSize
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultRangeConcurrency
+	}
+
+	client := &http.Client{Transport: t}
+
+	// Probe with the first segment.
+	body, status, header, err := fetchRange(ctx, client, url, 0, opts.ChunkSize, opts.Retries)
+	if err != nil {
+		return 0, err
+	}
+
+	// Ranges are not supported, so the whole resource
+	// has been received.
+	if status != http.StatusPartialContent {
+		if _, err := w.WriteAt(body, 0); err != nil {
+			return 0, err
+		}
+		total := int64(len(body))
+		if opts.Progress != nil {
+			opts.Progress(total, total)
+		}
+		return total, nil
+	}
+
+	total, err := parseContentRangeSize(header.Get("Content-Range"))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.WriteAt(body, 0); err != nil {
+		return 0, err
+	}
+
+	var m sync.Mutex
+	written := int64(len(body))
+	if opts.Progress != nil {
+		opts.Progress(written, total)
+	}
+
+	// Fetch the remaining segments.
+	var firstErr error
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, opts.Concurrency)
+	for offset := written; offset < total; offset += opts.ChunkSize {
+		length := opts.ChunkSize
+		if offset+length > total {
+			length = total - offset
+		}
+
+		m.Lock()
+		failed := firstErr != nil
+		m.Unlock()
+		if failed || ctx.Err() != nil {
+			break
+		}
+
+		limit <- struct{}{}
+		wg.Add(1)
+		go func(offset, length int64) {
+			defer func() {
+				<-limit
+				wg.Done()
+			}()
+
+			body, status, _, err := fetchRange(ctx, client, url, offset, length, opts.Retries)
+			if err == nil && status != http.StatusPartialContent {
+				err = errors.New(fmt.Sprintf("Error: Range request received status %d.", status))
+			}
+			if err == nil && int64(len(body)) != length {
+				err = &incorrectDataLength{len(body), int(length)}
+			}
+			if err == nil {
+				_, err = w.WriteAt(body, offset)
+			}
+
+			m.Lock()
+			defer m.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			written += length
+			if opts.Progress != nil {
+				opts.Progress(written, total)
+			}
+		}(offset, length)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return written, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return written, err
+	}
+	return written, nil
+}
+
+// fetchRange requests the given range of the resource,
+// retrying after retryable errors.
+func fetchRange(ctx context.Context, client *http.Client, url string, offset, length int64, retries int) ([]byte, int, http.Header, error) {
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, nil, err
+		}
+
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+		res, err := client.Do(req)
+		if err == nil {
+			var body []byte
+			body, err = ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if err == nil {
+				return body, res.StatusCode, res.Header, nil
+			}
+		}
+
+		if attempt >= retries || !retryable(err) {
+			return nil, 0, nil, err
+		}
+		debug.Printf("Retrying range %d-%d of %q: %v\n", offset, offset+length-1, url, err)
+	}
+}
+
+// retryable indicates whether a request which failed
+// with the given error can safely be retried.
+func retryable(err error) bool {
+	for err != nil {
+		if err == ErrNotProcessed {
+			return true
+		}
+		if _, ok := err.(*GoAwayError); ok {
+			// Only returned for requests which were not sent.
+			return true
+		}
+		if closed, ok := err.(*ConnClosedError); ok {
+			return !closed.Acknowledged
+		}
+		unwrapper, ok := err.(interface {
+			Unwrap() error
+		})
+		if !ok {
+			return false
+		}
+		err = unwrapper.Unwrap()
+	}
+	return false
+}
+
+// parseContentRangeSize returns the complete length
+// given in a Content-Range header.
+func parseContentRangeSize(contentRange string) (int64, error) {
+	i := strings.LastIndex(contentRange, "/")
+	if !strings.HasPrefix(contentRange, "bytes ") || i < 0 {
+		return 0, errors.New(fmt.Sprintf("Error: Invalid Content-Range %q.", contentRange))
+	}
+	size, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+	if err != nil || size < 0 {
+		return 0, errors.New(fmt.Sprintf("Error: Invalid Content-Range %q.", contentRange))
+	}
+	return size, nil
+}
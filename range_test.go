@@ -0,0 +1,247 @@
+package spdy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bufferAt is an io.WriterAt which
+// may be written to concurrently.
+type bufferAt struct {
+	sync.Mutex
+	data []byte
+}
+
+func (b *bufferAt) WriteAt(p []byte, off int64) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	if end := int(off) + len(p); end > len(b.data) {
+		b.data = append(b.data, make([]byte, end-len(b.data))...)
+	}
+	return copy(b.data[off:], p), nil
+}
+
+// rangeServer serves content, supporting range requests if
+// ranges is set, and records the requests it receives and
+// the most it handles at once.
+type rangeServer struct {
+	content []byte
+	ranges  bool
+
+	sync.Mutex
+	requests []string // the Range headers received.
+	active   int
+	peak     int
+}
+
+func (s *rangeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	s.requests = append(s.requests, r.Header.Get("Range"))
+	s.active++
+	if s.active > s.peak {
+		s.peak = s.active
+	}
+	s.Unlock()
+	defer func() {
+		s.Lock()
+		s.active--
+		s.Unlock()
+	}()
+
+	// Give other segments the chance to overlap.
+	time.Sleep(5 * time.Millisecond)
+
+	if !s.ranges {
+		r.Header.Del("Range")
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(s.content))
+}
+
+// A resource is fetched in segments of the chunk size, with
+// no more in flight than the concurrency, and written at
+// their offsets. Progress is reported as each arrives.
+func TestDownloadRanged(t *testing.T) {
+	const size = 1000000
+	const chunk = 64 << 10
+	const concurrency = 3
+	content := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	for _, version := range versions {
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			handler := &rangeServer{content: content, ranges: true}
+			tr := pipeTransport(t, &http.Server{Handler: handler}, version)
+
+			var progress []int64
+			var mu sync.Mutex
+			out := new(bufferAt)
+			var n int64
+			var err error
+			within(t, 30*time.Second, "the download", func() {
+				n, err = tr.DownloadRanged(context.Background(), "https://example.com/file", out, RangeOptions{
+					ChunkSize:   chunk,
+					Concurrency: concurrency,
+					Progress: func(written, total int64) {
+						mu.Lock()
+						defer mu.Unlock()
+						if total != size {
+							t.Errorf("progress gave a total of %d, want %d", total, size)
+						}
+						progress = append(progress, written)
+					},
+				})
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != size || !bytes.Equal(out.data, content) {
+				t.Fatalf("wrote %d bytes, which do not match the %d served", n, size)
+			}
+
+			handler.Lock()
+			defer handler.Unlock()
+			segments := (size + chunk - 1) / chunk
+			if len(handler.requests) != segments {
+				t.Errorf("made %d requests, want %d", len(handler.requests), segments)
+			}
+			seen := make(map[string]bool)
+			for _, r := range handler.requests {
+				if !strings.HasPrefix(r, "bytes=") || seen[r] {
+					t.Errorf("unexpected range %q", r)
+				}
+				seen[r] = true
+			}
+			if handler.peak > concurrency {
+				t.Errorf("%d requests were made at once, want at most %d", handler.peak, concurrency)
+			}
+
+			if len(progress) != segments || progress[len(progress)-1] != size {
+				t.Errorf("progress was reported as %v", progress)
+			}
+			for i := 1; i < len(progress); i++ {
+				if progress[i] <= progress[i-1] {
+					t.Errorf("progress went from %d to %d", progress[i-1], progress[i])
+				}
+			}
+		})
+	}
+}
+
+// If the server ignores the Range header, the
+// whole resource is taken from the first response.
+func TestDownloadRangedUnsupported(t *testing.T) {
+	content := bytes.Repeat([]byte("spdy"), 100000)
+	handler := &rangeServer{content: content}
+	tr := pipeTransport(t, &http.Server{Handler: handler}, 3)
+
+	out := new(bufferAt)
+	var progress [][2]int64
+	n, err := tr.DownloadRanged(context.Background(), "https://example.com/file", out, RangeOptions{
+		ChunkSize: 1000,
+		Progress: func(written, total int64) {
+			progress = append(progress, [2]int64{written, total})
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(content)) || !bytes.Equal(out.data, content) {
+		t.Fatalf("wrote %d bytes, which do not match the %d served", n, len(content))
+	}
+	handler.Lock()
+	defer handler.Unlock()
+	if len(handler.requests) != 1 {
+		t.Errorf("made %d requests, want 1", len(handler.requests))
+	}
+	if want := [2]int64{n, n}; len(progress) != 1 || progress[0] != want {
+		t.Errorf("progress was reported as %v, want %v", progress, want)
+	}
+}
+
+// A segment which fails, other than with a retryable error,
+// fails the download, and is not retried.
+func TestDownloadRangedFailure(t *testing.T) {
+	content := make([]byte, 10000)
+	ranges := &rangeServer{content: content, ranges: true}
+	var failed int
+	var mu sync.Mutex
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") == "bytes=5000-5999" {
+			mu.Lock()
+			failed++
+			mu.Unlock()
+			http.Error(w, "failed", http.StatusInternalServerError)
+			return
+		}
+		ranges.ServeHTTP(w, r)
+	})}
+	tr := pipeTransport(t, srv, 3)
+
+	_, err := tr.DownloadRanged(context.Background(), "https://example.com/file", new(bufferAt), RangeOptions{
+		ChunkSize: 1000,
+		Retries:   3,
+	})
+	if err == nil || !strings.Contains(err.Error(), "500") {
+		t.Fatalf("download returned %v, want the failed segment's status", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if failed != 1 {
+		t.Errorf("the failed segment was requested %d times, want 1", failed)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{ErrNotProcessed, true},
+		{fmt.Errorf("Get: %w", ErrNotProcessed), true},
+		{&GoAwayError{Status: GOAWAY_INTERNAL_ERROR}, true},
+		{&ConnClosedError{StreamID: 1, Reason: io.EOF}, true},
+		{&ConnClosedError{StreamID: 1, Reason: io.EOF, Acknowledged: true}, false},
+		{io.EOF, false},
+		{errors.New("Error: Something else."), false},
+		{nil, false},
+	}
+	for _, test := range tests {
+		if got := retryable(test.err); got != test.want {
+			t.Errorf("retryable(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestParseContentRangeSize(t *testing.T) {
+	tests := []struct {
+		header string
+		want   int64 // -1 if the header is invalid.
+	}{
+		{"bytes 0-99/1000", 1000},
+		{"bytes 0-0/1", 1},
+		{"bytes */1000", 1000},
+		{"bytes 0-99/*", -1},
+		{"bytes 0-99/-1", -1},
+		{"items 0-99/1000", -1},
+		{"", -1},
+	}
+	for _, test := range tests {
+		got, err := parseContentRangeSize(test.header)
+		if test.want < 0 {
+			if err == nil {
+				t.Errorf("%q gave %d, want an error", test.header, got)
+			}
+		} else if err != nil || got != test.want {
+			t.Errorf("%q gave %d, error %v, want %d", test.header, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package spdy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// A client connection which reads a malformed frame or a
+// corrupt header block, or whose TCP connection is reset
+// part-way through a frame, closes without panicking. The
+// request in progress fails, and ConnError gives the reason.
+func TestClientReadErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		send   func(conn net.Conn, version uint16) // sends the problem, once the request has arrived.
+		goaway bool                                // whether a GOAWAY is expected.
+		reason func(err error) bool                // checks the reason the connection closed.
+	}{
+		{
+			name: "truncated frame",
+			send: func(conn net.Conn, version uint16) {
+				conn.Write([]byte{0x80, byte(version), 0, 6, 0, 0, 0, 3, 0, 0, 0})
+			},
+			goaway: true,
+			reason: isProtocolError,
+		},
+		{
+			name: "corrupt header block",
+			send: func(conn net.Conn, version uint16) {
+				data := []byte{0, 0, 0, 1}
+				if version == 2 {
+					data = append(data, 0, 0)
+				}
+				data = append(data, 0xde, 0xad, 0xbe, 0xef, 0xde, 0xad, 0xbe, 0xef)
+				n := len(data)
+				conn.Write(append([]byte{0x80, byte(version), 0, 2, 0, byte(n >> 16), byte(n >> 8), byte(n)}, data...))
+			},
+			goaway: true,
+			reason: isProtocolError,
+		},
+		{
+			name: "reset mid-frame",
+			send: func(conn net.Conn, version uint16) {
+				conn.Write([]byte{0x80, byte(version), 0, 6, 0, 0, 0, 4, 0, 0})
+				conn.(*net.TCPConn).SetLinger(0)
+				conn.Close()
+			},
+			reason: func(err error) bool { return err == io.EOF },
+		},
+	}
+
+	for _, version := range versions {
+		for _, test := range tests {
+			version, test := version, test
+			t.Run(fmt.Sprintf("SPDY/%d/%s", version, test.name), func(t *testing.T) {
+				client, remote := tcpClientConn(t, version)
+
+				done := make(chan error, 1)
+				go func() {
+					req, _ := http.NewRequest("GET", "https://example.com/", nil)
+					_, err := request(client, req)
+					done <- err
+				}()
+				within(t, 5*time.Second, "the request", func() {
+					for {
+						frame, err := readRawFrame(remote, version)
+						if err != nil {
+							t.Errorf("reading the request: %v", err)
+							return
+						}
+						switch frame.(type) {
+						case *synStreamFrameV3, *synStreamFrameV2:
+							return
+						}
+					}
+				})
+
+				test.send(remote, version)
+
+				var goaway bool
+				if test.goaway {
+					within(t, 5*time.Second, "the GOAWAY", func() {
+						for !goaway {
+							frame, err := readRawFrame(remote, version)
+							if err != nil {
+								return
+							}
+							switch frame.(type) {
+							case *goawayFrameV3, *goawayFrameV2:
+								goaway = true
+							}
+						}
+					})
+					if !goaway {
+						t.Error("no GOAWAY was sent")
+					}
+				}
+
+				within(t, 5*time.Second, "the request failing", func() {
+					if err := <-done; err == nil {
+						t.Error("the request succeeded")
+					}
+				})
+				within(t, 5*time.Second, "the connection closing", func() {
+					for ConnError(client) == nil {
+						time.Sleep(time.Millisecond)
+					}
+				})
+				if err := ConnError(client); !test.reason(err) {
+					t.Errorf("the connection closed with %v", err)
+				}
+			})
+		}
+	}
+}
+
+// isProtocolError reports whether err is a *ProtocolError.
+func isProtocolError(err error) bool {
+	var perr *ProtocolError
+	return errors.As(err, &perr)
+}
+
+// tcpClientConn runs a client connection over TCP on the
+// loopback interface, using the given SPDY version, and
+// returns it with the server's end of the TCP connection,
+// so that the test can act as a server which sends any
+// frames it likes, or reset the connection. Both ends are
+// closed when the test ends.
+func tcpClientConn(t testing.TB, version uint16) (Conn, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen on the loopback interface: %v", err)
+	}
+	defer l.Close()
+
+	local, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := l.Accept()
+	if err != nil {
+		local.Close()
+		t.Fatal(err)
+	}
+
+	client, err := NewClientConn(local, nil, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	running := make(chan struct{})
+	go func() { defer close(running); client.Run() }()
+	t.Cleanup(func() {
+		within(t, 10*time.Second, "closing the connection", func() {
+			remote.Close()
+			client.Close()
+			<-running
+		})
+	})
+
+	return client, remote
+}
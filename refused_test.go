@@ -0,0 +1,142 @@
+package spdy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// rawData returns a DATA frame, as sent on the wire.
+func rawData(sid StreamID, fin bool, data []byte) []byte {
+	var flags byte
+	if fin {
+		flags = byte(FLAG_FIN)
+	}
+	n := len(data)
+	out := []byte{byte(sid >> 24), byte(sid >> 16), byte(sid >> 8), byte(sid), flags, byte(n >> 16), byte(n >> 8), byte(n)}
+	return append(out, data...)
+}
+
+// DATA which a client sent on a stream before learning that
+// it was refused is discarded, without error, and under
+// session flow control its bytes are credited back to the
+// session window. Otherwise, the session window would be
+// used up, and the upload which follows, which fills the
+// window exactly, would end the connection.
+func TestRefusedStreamData(t *testing.T) {
+	const window = DEFAULT_INITIAL_SESSION_WINDOW_SIZE
+	const frameSize = 16 << 10
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("reading the upload: %v", err)
+		}
+		fmt.Fprint(w, len(body))
+	})}
+	EnableSessionFlowControl(srv)
+	SetMaxConcurrentStreams(srv, 1)
+	conn := rawServerConn(t, srv, 3)
+
+	frames := make(chan Frame, 100)
+	go func() {
+		defer close(frames)
+		for {
+			frame, err := readRawFrame(conn, 3)
+			if err != nil {
+				return
+			}
+			frames <- frame
+		}
+	}()
+
+	// next returns the next frame which is not SETTINGS,
+	// failing the test on a GOAWAY.
+	next := func() Frame {
+		for {
+			select {
+			case frame, ok := <-frames:
+				if !ok {
+					t.Fatal("the connection closed")
+				}
+				switch frame := frame.(type) {
+				case *settingsFrameV3:
+					continue
+				case *goawayFrameV3:
+					t.Fatalf("the connection was ended: %v", frame)
+				}
+				return frame
+			case <-time.After(5 * time.Second):
+				t.Fatal("no frame was received")
+			}
+		}
+	}
+
+	// Stream 1 takes the only stream slot, so stream 3 is
+	// refused. The SYN_STREAMs are sent without FLAG_FIN,
+	// as each has a request body.
+	c := newRawCompressor(3)
+	upload := rawSynStream(3, 1, c.block(":method", "POST", ":scheme", "https", ":host", "example.com", ":path", "/upload", ":version", "HTTP/1.1"))
+	refused := rawSynStream(3, 3, c.block(":method", "POST", ":scheme", "https", ":host", "example.com", ":path", "/refused", ":version", "HTTP/1.1"))
+	upload[4] = 0
+	refused[4] = 0
+	chunk := make([]byte, frameSize)
+	go func() {
+		conn.Write(hexFrame("8003 0004 00 00000c 00000001 00005f10 00000001"))
+		conn.Write(upload)
+		conn.Write(refused)
+		for sent := 0; sent < window; sent += frameSize {
+			conn.Write(rawData(3, false, chunk))
+		}
+	}()
+
+	var reset bool
+	var credited uint32
+	for !reset || credited < window {
+		switch frame := next().(type) {
+		case *rstStreamFrameV3:
+			if frame.StreamID != 3 || frame.Status != RST_STREAM_REFUSED_STREAM {
+				t.Fatalf("received %v", frame)
+			}
+			reset = true
+		case *windowUpdateFrameV3:
+			if frame.StreamID.Zero() {
+				credited += frame.DeltaWindowSize
+			}
+		}
+	}
+	if credited != window {
+		t.Fatalf("session window regrown by %d bytes, want %d", credited, window)
+	}
+
+	go func() {
+		for sent := 0; sent < window; sent += frameSize {
+			conn.Write(rawData(1, sent+frameSize == window, chunk))
+		}
+	}()
+
+	var replied bool
+	var body []byte
+	for {
+		switch frame := next().(type) {
+		case *synReplyFrameV3:
+			replied = frame.StreamID == 1
+		case *dataFrameV3:
+			if frame.StreamID != 1 {
+				t.Fatalf("received %v", frame)
+			}
+			body = append(body, frame.Data...)
+			if !frame.Flags.FIN() {
+				continue
+			}
+			if !replied || string(body) != fmt.Sprint(window) {
+				t.Fatalf("upload gave %q, want %q", body, fmt.Sprint(window))
+			}
+			return
+		case *rstStreamFrameV3:
+			t.Fatalf("received %v", frame)
+		}
+	}
+}
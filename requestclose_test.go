@@ -0,0 +1,170 @@
+package spdy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A request with Close set is sent on a connection of its
+// own, which no concurrent request shares, and which is
+// closed once the response arrives, even if its body is
+// never read.
+func TestRequestClose(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 3)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+		fmt.Fprint(w, r.RemoteAddr)
+	}))
+	AddSPDY(server.Config)
+	server.TLS = &tls.Config{NextProtos: NPNStrings()}
+	server.StartTLS()
+	defer server.Close()
+
+	var m sync.Mutex
+	dials := 0
+	tr := NewTransport(server.Client().Transport.(*http.Transport).TLSClientConfig)
+	defer tr.CloseIdleConnections()
+	tr.Dial = func(network, addr string) (net.Conn, error) {
+		m.Lock()
+		dials++
+		m.Unlock()
+		return net.Dial(network, addr)
+	}
+	client := &http.Client{Transport: tr}
+	get := func(path string, close bool) string {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		req.Close = close
+		res, err := client.Do(req)
+		if err != nil {
+			t.Error(err)
+			return ""
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return string(body)
+	}
+
+	// Three requests are held on the pooled connection.
+	addrs := make(chan string, 3)
+	for i := 0; i < 3; i++ {
+		go func() { addrs <- get("/slow", false) }()
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the requests were not served")
+		}
+	}
+
+	// The Close request is answered on another connection.
+	req, _ := http.NewRequest("GET", server.URL+"/", nil)
+	req.Close = true
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alone, _ := ioutil.ReadAll(res.Body)
+
+	// A second is answered on a third, its body abandoned.
+	req, _ = http.NewRequest("GET", server.URL+"/", nil)
+	req.Close = true
+	if _, err := client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+
+	close(release)
+	var pooled string
+	for i := 0; i < 3; i++ {
+		addr := <-addrs
+		if pooled == "" {
+			pooled = addr
+		} else if addr != pooled {
+			t.Errorf("concurrent requests were sent from %s and %s, want one connection", pooled, addr)
+		}
+	}
+	if string(alone) == pooled {
+		t.Errorf("the Close request shared the pooled connection, %s", pooled)
+	}
+	m.Lock()
+	if dials != 3 {
+		t.Errorf("made %d connections, want 3", dials)
+	}
+	m.Unlock()
+
+	// The dedicated connections are closed, and the
+	// pooled one is still used.
+	within(t, 5*time.Second, "closing the dedicated connections", func() {
+		for Stats(server.Config).Conns != 1 {
+			time.Sleep(time.Millisecond)
+		}
+	})
+	if addr := get("/", false); addr != pooled {
+		t.Errorf("a later request was sent from %s, want the pooled connection %s", addr, pooled)
+	}
+}
+
+// DisableKeepAlives gives every request a connection of
+// its own. Without SPDY, the request is sent over HTTP,
+// and the connection closed with the response body.
+func TestDisableKeepAlives(t *testing.T) {
+	spdyServer := newSPDYServer(t, "spdy")
+	var m sync.Mutex
+	closed := 0
+	httpServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("http"))
+	}))
+	httpServer.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			m.Lock()
+			closed++
+			m.Unlock()
+		}
+	}
+	httpServer.StartTLS()
+	defer httpServer.Close()
+
+	for _, server := range []*httptest.Server{spdyServer, httpServer} {
+		dials := 0
+		tr := NewTransport(server.Client().Transport.(*http.Transport).TLSClientConfig)
+		tr.DisableKeepAlives = true
+		tr.Dial = func(network, addr string) (net.Conn, error) {
+			dials++
+			return net.Dial(network, addr)
+		}
+		for i := 0; i < 2; i++ {
+			res, err := (&http.Client{Transport: tr}).Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ioutil.ReadAll(res.Body)
+			res.Body.Close()
+		}
+		if dials != 2 {
+			t.Errorf("%s: made %d connections, want 2", server.URL, dials)
+		}
+	}
+
+	within(t, 5*time.Second, "closing the connections", func() {
+		for {
+			m.Lock()
+			n := closed
+			m.Unlock()
+			if Stats(spdyServer.Config).Conns == 0 && n == 2 {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+}
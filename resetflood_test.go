@@ -0,0 +1,117 @@
+package spdy
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// rawRstStream returns an RST_STREAM frame,
+// as sent on the wire.
+func rawRstStream(version uint16, sid StreamID, status StatusCode) []byte {
+	return []byte{
+		0x80, byte(version), 0, 3, 0, 0, 0, 8,
+		byte(sid >> 24), byte(sid >> 16), byte(sid >> 8), byte(sid),
+		byte(status >> 24), byte(status >> 16), byte(status >> 8), byte(status),
+	}
+}
+
+func TestResetFloodAllow(t *testing.T) {
+	start := time.Now()
+	f := resetFlood{limit: 3}
+	tests := []struct {
+		at       time.Duration
+		allow    bool
+		flooding bool
+	}{
+		{0, true, false},
+		{0, true, false},
+		{0, true, false},
+		{0, false, true},
+		{0, false, false},
+		{RESET_FLOOD_INTERVAL / 2, false, false},
+		{RESET_FLOOD_INTERVAL, true, false},
+		{RESET_FLOOD_INTERVAL, true, false},
+		{RESET_FLOOD_INTERVAL, true, false},
+		{RESET_FLOOD_INTERVAL, false, true},
+	}
+	for i, test := range tests {
+		allow, flooding := f.Allow(start.Add(test.at))
+		if allow != test.allow || flooding != test.flooding {
+			t.Errorf("%d: got allow %v, flooding %v, want %v, %v", i, allow, flooding, test.allow, test.flooding)
+		}
+	}
+	if f.dropped != 4 {
+		t.Errorf("dropped %d, want 4", f.dropped)
+	}
+
+	// A limit of zero allows everything.
+	f = resetFlood{}
+	for i := 0; i < 1000; i++ {
+		if allow, flooding := f.Allow(start); !allow || flooding {
+			t.Fatalf("with no limit, got allow %v, flooding %v", allow, flooding)
+		}
+	}
+}
+
+// A flood of RST_STREAMs for unknown streams is dropped
+// past the limit, counted as one benign error, and leaves
+// the connection responsive.
+func TestResetFlood(t *testing.T) {
+	const resets = 10000
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			var server Conn
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+			conn := rawServerConnWith(t, srv, version, func(s Conn) {
+				server = s
+				// Hold the clock still, so that the
+				// flood falls within one interval.
+				switch s := s.(type) {
+				case *connV3:
+					s.clock = newFakeClock()
+				case *connV2:
+					s.clock = newFakeClock()
+				}
+			})
+
+			go func() {
+				for i := 0; i < resets; i++ {
+					conn.Write(rawRstStream(version, StreamID(2*i+3), RST_STREAM_INVALID_STREAM))
+				}
+				conn.Write([]byte{0x80, byte(version), 0, 6, 0, 0, 0, 4, 0, 0, 0, 1})
+				conn.Write(rawSynStream(version, 1, newRawCompressor(version).block(rawRequest(version, "/")...)))
+			}()
+
+			var pinged, replied bool
+			within(t, 20*time.Second, "the PING and the reply", func() {
+				for !pinged || !replied {
+					frame, err := readRawFrame(conn, version)
+					if err != nil {
+						t.Errorf("reading frames: %v", err)
+						return
+					}
+					switch frame.(type) {
+					case *pingFrameV3, *pingFrameV2:
+						pinged = true
+					case *synReplyFrameV3, *synReplyFrameV2:
+						replied = true
+					case *goawayFrameV3, *goawayFrameV2:
+						t.Errorf("received %v", frame)
+						return
+					}
+				}
+			})
+
+			if n := benignErrors(server); n != 1 {
+				t.Errorf("counted %d benign errors, want 1", n)
+			}
+			want := uint64(resets - DEFAULT_RESET_FLOOD_LIMIT)
+			if n := server.(snapshotter).snapshot().DroppedResets; n != want {
+				t.Errorf("dropped %d RST_STREAMs, want %d", n, want)
+			}
+		})
+	}
+}
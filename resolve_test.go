@@ -0,0 +1,175 @@
+package spdy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver resolves every host to the addresses it
+// is given, counting the lookups made.
+type fakeResolver struct {
+	sync.Mutex
+	addrs   []net.IP
+	lookups int
+}
+
+func (r *fakeResolver) set(addrs ...string) {
+	r.Lock()
+	defer r.Unlock()
+	r.addrs = nil
+	for _, addr := range addrs {
+		r.addrs = append(r.addrs, net.ParseIP(addr))
+	}
+}
+
+func (r *fakeResolver) LookupIP(host string) ([]net.IP, error) {
+	r.Lock()
+	defer r.Unlock()
+	r.lookups++
+	return r.addrs, nil
+}
+
+func (r *fakeResolver) count() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.lookups
+}
+
+// Each pooled connection to a host, including those
+// dialled once the first was busy, is re-resolved every
+// ReResolveInterval. Once its address is no longer
+// resolved, it is drained: its requests finish, but new
+// requests dial the new address. The address of each
+// connection is given by ConnectedIP and its snapshot.
+func TestReResolve(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	AddSPDY(server.Config)
+	server.TLS = &tls.Config{NextProtos: NPNStrings()}
+	server.StartTLS()
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	resolver := new(fakeResolver)
+	resolver.set("127.0.0.1")
+	clock := newFakeClock()
+	tr, dials := countingTransport(t, server)
+	tr.clock = clock
+	tr.ReResolveInterval = time.Minute
+	tr.LookupIP = resolver.LookupIP
+	tr.MaxStreamsPerConn = 1
+	client := &http.Client{Transport: tr}
+	get := func(path string) {
+		res, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer res.Body.Close()
+		if body, _ := ioutil.ReadAll(res.Body); string(body) != "ok" {
+			t.Errorf("got body %q", body)
+		}
+	}
+	pooled := func() int {
+		tr.m.Lock()
+		defer tr.m.Unlock()
+		return len(tr.pooledConns())
+	}
+
+	// Two requests in flight use two connections.
+	done := make(chan struct{}, 2)
+	for i := 0; i < 2; i++ {
+		go func() { get("/slow"); done <- struct{}{} }()
+		within(t, 5*time.Second, "the request starting", func() { <-started })
+	}
+	if n := pooled(); n != 2 {
+		t.Fatalf("pooled %d connections, want 2", n)
+	}
+	if ip, err := tr.ConnectedIP(host); err != nil || !ip.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("ConnectedIP gave %v, %v, want 127.0.0.1", ip, err)
+	}
+	for _, snap := range tr.Snapshot() {
+		if !snap.RemoteIP.Equal(net.ParseIP("127.0.0.1")) {
+			t.Errorf("connection %d has remote IP %v, want 127.0.0.1", snap.ID, snap.RemoteIP)
+		}
+	}
+
+	// While the address is resolved, both are kept.
+	clock.waitPending(t, 2)
+	clock.Advance(time.Minute)
+	clock.waitPending(t, 2)
+	if n := resolver.count(); n != 2 {
+		t.Fatalf("made %d lookups, want one for each connection", n)
+	}
+	if n := pooled(); n != 2 {
+		t.Fatalf("pooled %d connections, want 2", n)
+	}
+
+	// Once it is not, both leave the pool.
+	resolver.set("192.0.2.1")
+	clock.Advance(time.Minute)
+	within(t, 5*time.Second, "draining the connections", func() {
+		for pooled() != 0 {
+			time.Sleep(time.Millisecond)
+		}
+	})
+	if _, err := tr.ConnectedIP(host); err != ErrNotConnected {
+		t.Errorf("ConnectedIP gave %v, want ErrNotConnected", err)
+	}
+
+	// Their requests finish, and the next dials again.
+	close(release)
+	within(t, 5*time.Second, "the requests in flight", func() {
+		<-done
+		<-done
+	})
+	get("/")
+	if n := dials(); n != 3 {
+		t.Errorf("dialled %d connections, want 3", n)
+	}
+}
+
+// With StrictAffinity, pooled connections are not
+// re-resolved.
+func TestStrictAffinity(t *testing.T) {
+	server := newSPDYServer(t, "ok")
+	resolver := new(fakeResolver)
+	clock := newFakeClock()
+	tr, _ := countingTransport(t, server)
+	tr.clock = clock
+	tr.ReResolveInterval = time.Minute
+	tr.LookupIP = resolver.LookupIP
+	tr.StrictAffinity = true
+
+	res, err := (&http.Client{Transport: tr}).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if n := clock.Pending(); n != 0 {
+		t.Fatalf("%d timers are waiting, want none", n)
+	}
+	clock.Advance(time.Hour)
+	if n := resolver.count(); n != 0 {
+		t.Fatalf("made %d lookups, want none", n)
+	}
+	if _, err := tr.ConnectedIP(strings.TrimPrefix(server.URL, "https://")); err != nil {
+		t.Fatalf("the connection left the pool: %v", err)
+	}
+}
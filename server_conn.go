@@ -2,6 +2,7 @@ package spdy
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
@@ -10,11 +11,14 @@ import (
 	"net/url"
 	"runtime"
 	"strings"
+	"sync"
+	"time"
 )
 
 // NewServerConn is used to create a SPDY connection, using the given
 // net.Conn for the underlying connection, and the given http.Server to
-// configure the request serving.
+// configure the request serving. As with NewClientConn, the connection
+// need not use TLS.
 func NewServerConn(conn net.Conn, server *http.Server, version uint16) (spdyConn Conn, err error) {
 	if conn == nil {
 		return nil, errors.New("Error: Connection initialised with nil net.conn.")
@@ -29,7 +33,8 @@ func NewServerConn(conn net.Conn, server *http.Server, version uint16) (spdyConn
 		out.remoteAddr = conn.RemoteAddr().String()
 		out.server = server
 		out.conn = conn
-		out.buf = bufio.NewReader(conn)
+		out.stats = new(connStats)
+		out.buf = bufio.NewReader(countingReader{conn, &out.stats.bytesReceived})
 		if tlsConn, ok := conn.(*tls.Conn); ok {
 			out.tlsState = new(tls.ConnectionState)
 			*out.tlsState = tlsConn.ConnectionState()
@@ -44,28 +49,54 @@ func NewServerConn(conn net.Conn, server *http.Server, version uint16) (spdyConn
 		out.output[5] = make(chan Frame)
 		out.output[6] = make(chan Frame)
 		out.output[7] = make(chan Frame)
+		out.control = newControlQueue()
 		out.pings = make(map[uint32]chan<- Ping)
 		out.nextPingID = 2
 		out.compressor = NewCompressor(3)
 		out.decompressor = NewDecompressor(3)
+		out.frames = new(framePoolV3)
 		out.receivedSettings = make(Settings)
 		out.lastPushStreamID = 0
 		out.lastRequestStreamID = 0
 		out.oddity = 0
 		out.initialWindowSize = DEFAULT_INITIAL_WINDOW_SIZE
-		out.requestStreamLimit = newStreamLimit(DEFAULT_STREAM_LIMIT)
+		out.requestStreamLimit = newStreamLimit(serverStreamLimit(server))
 		out.pushStreamLimit = newStreamLimit(NO_STREAM_LIMIT)
-		out.vectorIndex = 8
+		out.vectorIndex = DEFAULT_CLIENT_CERTIFICATE_VECTOR_SIZE
 		out.certificates = make(map[uint16][]*x509.Certificate, 8)
+		out.verifiedChains = make(map[uint16][][]*x509.Certificate, 8)
 		if out.tlsState != nil && out.tlsState.PeerCertificates != nil {
 			out.certificates[1] = out.tlsState.PeerCertificates
 		}
+		out.refused = make(refusedStreams)
+		out.resets.limit = DEFAULT_RESET_FLOOD_LIMIT
+		out.maxHeaders = DEFAULT_MAX_HEADERS
+		out.headerCounts = make(map[StreamID]int)
+		out.id = nextConnID()
+		out.restoreHeaders = headerElisionEnabled(server)
+		if sessionFlowControlEnabled(server) {
+			out.session = newSessionWindow()
+		}
+		out.admit = serverAdmission(server)
+		out.hooks = newDispatcher(out, serverHooks(server))
 		out.stop = make(chan struct{})
-		out.init = func() {
+		out.sendStopped = make(chan struct{})
+		out.closing = make(chan struct{})
+		out.clock = defaultClock
+		out.started = out.clock.Now()
+		out.init = func() []Frame {
 			// Initialise the connection by sending the connection settings.
 			settings := new(settingsFrameV3)
-			settings.Settings = defaultSPDYServerSettings(3, DEFAULT_STREAM_LIMIT)
-			out.output[0] <- settings
+			settings.Settings = defaultSPDYServerSettings(3, out.requestStreamLimit.Limit())
+			if out.restoreHeaders {
+				settings.Settings[SETTINGS_EXPERIMENTAL_HEADER_ELISION] = headerElisionSetting()
+				settings.Experimental = true
+			}
+			if out.session != nil {
+				settings.Settings[SETTINGS_EXPERIMENTAL_SESSION_FLOW_CONTROL] = sessionFlowControlSetting()
+				settings.Experimental = true
+			}
+			return []Frame{settings}
 		}
 
 		return out, nil
@@ -75,7 +106,8 @@ func NewServerConn(conn net.Conn, server *http.Server, version uint16) (spdyConn
 		out.remoteAddr = conn.RemoteAddr().String()
 		out.server = server
 		out.conn = conn
-		out.buf = bufio.NewReader(conn)
+		out.stats = new(connStats)
+		out.buf = bufio.NewReader(countingReader{conn, &out.stats.bytesReceived})
 		if tlsConn, ok := conn.(*tls.Conn); ok {
 			out.tlsState = new(tls.ConnectionState)
 			*out.tlsState = tlsConn.ConnectionState()
@@ -90,35 +122,53 @@ func NewServerConn(conn net.Conn, server *http.Server, version uint16) (spdyConn
 		out.output[5] = make(chan Frame)
 		out.output[6] = make(chan Frame)
 		out.output[7] = make(chan Frame)
+		out.control = newControlQueue()
 		out.pings = make(map[uint32]chan<- Ping)
 		out.nextPingID = 2
 		out.compressor = NewCompressor(2)
 		out.decompressor = NewDecompressor(2)
+		out.frames = new(framePoolV2)
 		out.receivedSettings = make(Settings)
 		out.lastPushStreamID = 0
 		out.lastRequestStreamID = 0
 		out.oddity = 0
 		out.initialWindowSize = DEFAULT_INITIAL_WINDOW_SIZE
-		out.requestStreamLimit = newStreamLimit(DEFAULT_STREAM_LIMIT)
+		out.requestStreamLimit = newStreamLimit(serverStreamLimit(server))
 		out.pushStreamLimit = newStreamLimit(NO_STREAM_LIMIT)
+		out.refused = make(refusedStreams)
+		out.resets.limit = DEFAULT_RESET_FLOOD_LIMIT
+		out.maxHeaders = DEFAULT_MAX_HEADERS
+		out.headerCounts = make(map[StreamID]int)
+		out.id = nextConnID()
+		out.restoreHeaders = headerElisionEnabled(server)
+		out.admit = serverAdmission(server)
+		out.hooks = newDispatcher(out, serverHooks(server))
 		out.stop = make(chan struct{})
-		out.init = func() {
+		out.sendStopped = make(chan struct{})
+		out.closing = make(chan struct{})
+		out.clock = defaultClock
+		out.started = out.clock.Now()
+		out.init = func() []Frame {
 			// Initialise the connection by sending the connection settings.
 			settings := new(settingsFrameV2)
-			settings.Settings = defaultSPDYServerSettings(2, DEFAULT_STREAM_LIMIT)
-			out.output[0] <- settings
+			settings.Settings = defaultSPDYServerSettings(2, out.requestStreamLimit.Limit())
+			if out.restoreHeaders {
+				settings.Settings[SETTINGS_EXPERIMENTAL_HEADER_ELISION] = headerElisionSetting()
+				settings.Experimental = true
+			}
+			return []Frame{settings}
 		}
 
 		return out, nil
 
 	default:
-		return nil, errors.New("Error: Unsupported SPDY version.")
+		return nil, ErrUnsupportedVersion
 	}
 }
 
 // AddSPDY adds SPDY support to srv, and must be called before srv begins serving.
 func AddSPDY(srv *http.Server) {
-	npnStrings := npn()
+	npnStrings := NPNStrings()
 	if len(npnStrings) <= 1 {
 		return
 	}
@@ -147,42 +197,385 @@ func AddSPDY(srv *http.Server) {
 	if srv.TLSNextProto == nil {
 		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
 	}
+	servers.Lock()
+	config := servers.config(srv)
+	servers.Unlock()
 	for _, str := range npnStrings {
-		switch str {
-		case "spdy/2":
-			srv.TLSNextProto[str] = func(s *http.Server, tlsConn *tls.Conn, handler http.Handler) {
-				conn, err := NewServerConn(tlsConn, s, 2)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-				conn.Run()
-				conn = nil
-				runtime.GC()
+		version, ok := npnVersion(str)
+		if !ok {
+			continue
+		}
+		srv.TLSNextProto[str] = func(s *http.Server, tlsConn *tls.Conn, handler http.Handler) {
+			serveSPDY(s, config, tlsConn, handler, version)
+		}
+	}
+
+	// Drain the SPDY connections when srv is shut down. While
+	// they are served, net/http counts them as active, so
+	// Shutdown waits for them to finish their streams and
+	// close, or for its context to end. An http.Server cannot
+	// be reused, so its config is then dropped.
+	srv.RegisterOnShutdown(func() {
+		Drain(context.Background(), srv)
+		servers.shutdown(srv)
+	})
+}
+
+// serveSPDY serves a SPDY connection of the given version
+// over tlsConn. Requests are served by handler, if non-nil,
+// as given by net/http, or the server's handler otherwise.
+// The connection is tracked for the duration, so that it
+// can be drained.
+func serveSPDY(s *http.Server, config *serverConfig, tlsConn *tls.Conn, handler http.Handler, version uint16) {
+	// A connection accepted as s shuts down may arrive after
+	// its config has been dropped, so it is restored until
+	// the connection closes, so that the connection is still
+	// told to go away.
+	servers.restore(s, config)
+
+	conn, err := NewServerConn(tlsConn, s, version)
+	if err != nil {
+		servers.remove(s, nil)
+		log.Println(err)
+		return
+	}
+	if h, ok := conn.(handlerSetter); ok && handler != nil {
+		h.setHandler(handler)
+	}
+
+	servers.add(s, conn)
+	defer servers.remove(s, conn)
+
+	conn.Run()
+	conn = nil
+	runtime.GC()
+}
+
+// serverConfig holds the SPDY options of an http.Server,
+// and the SPDY connections it is serving.
+type serverConfig struct {
+	conns       map[Conn]struct{}
+	draining    bool // new connections are told to go away.
+	shutdown    bool // the server has shut down, so the config is dropped once its connections close.
+	elision     bool
+	session     bool
+	hooks       *ConnHooks
+	streamLimit uint32
+	admission   admissionFunc
+	clock       clock // source of time for Drain. If nil, defaultClock is used.
+}
+
+// serverConns tracks the config of each http.Server. A
+// server's config is dropped once it has shut down and its
+// connections have closed, as an http.Server cannot be
+// reused.
+type serverConns struct {
+	sync.Mutex
+	configs map[*http.Server]*serverConfig
+}
+
+var servers = &serverConns{
+	configs: make(map[*http.Server]*serverConfig),
+}
+
+// config returns the config for srv, creating it if
+// necessary. This must be called with the lock held.
+func (s *serverConns) config(srv *http.Server) *serverConfig {
+	config := s.configs[srv]
+	if config == nil {
+		config = &serverConfig{
+			conns:       make(map[Conn]struct{}),
+			streamLimit: DEFAULT_STREAM_LIMIT,
+		}
+		s.configs[srv] = config
+	}
+	return config
+}
+
+// lookup returns a copy of the config for srv, or
+// the defaults if it has none.
+func (s *serverConns) lookup(srv *http.Server) serverConfig {
+	s.Lock()
+	defer s.Unlock()
+
+	if config := s.configs[srv]; config != nil {
+		return *config
+	}
+	return serverConfig{streamLimit: DEFAULT_STREAM_LIMIT}
+}
+
+// restore tracks config as the config for srv again,
+// if it has been dropped.
+func (s *serverConns) restore(srv *http.Server, config *serverConfig) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.configs[srv] == nil {
+		s.configs[srv] = config
+	}
+}
+
+// add starts tracking the connection. If the server is
+// being drained, the connection is told to go away.
+func (s *serverConns) add(srv *http.Server, conn Conn) {
+	s.Lock()
+	defer s.Unlock()
+
+	config := s.config(srv)
+	config.conns[conn] = struct{}{}
+
+	// The connection's send loop has not started yet,
+	// so the GOAWAY is queued in the background.
+	if d, ok := conn.(drainer); ok && config.draining {
+		go d.goAway()
+	}
+}
+
+// remove stops tracking the connection, dropping the
+// server's config if it was the last connection of a
+// server which has shut down.
+func (s *serverConns) remove(srv *http.Server, conn Conn) {
+	s.Lock()
+	defer s.Unlock()
+
+	config := s.configs[srv]
+	if config == nil {
+		return
+	}
+	delete(config.conns, conn)
+	if config.shutdown && len(config.conns) == 0 {
+		delete(s.configs, srv)
+	}
+}
+
+// shutdown records that srv has shut down, dropping its
+// config now if it has no connections, or once they
+// have closed.
+func (s *serverConns) shutdown(srv *http.Server) {
+	s.Lock()
+	defer s.Unlock()
+
+	config := s.configs[srv]
+	if config == nil {
+		return
+	}
+	config.shutdown = true
+	if len(config.conns) == 0 {
+		delete(s.configs, srv)
+	}
+}
+
+// list returns the connections being served by srv.
+func (s *serverConns) list(srv *http.Server) []Conn {
+	s.Lock()
+	defer s.Unlock()
+
+	config := s.configs[srv]
+	if config == nil {
+		return nil
+	}
+	out := make([]Conn, 0, len(config.conns))
+	for conn := range config.conns {
+		out = append(out, conn)
+	}
+	return out
+}
+
+// Drain is used to stop the SPDY connections being served
+// by srv from accepting new streams, such as before removing
+// the server from a load balancer's rotation. Each connection
+// is sent a GOAWAY, after which new streams are refused, but
+// existing streams continue to be served. Connections made
+// after Drain is called are also told to go away.
+//
+// Drain returns once every connection is idle, at which point
+// the connections are closed. If ctx is done first, the
+// remaining connections are closed anyway, new connections
+// are no longer told to go away, and Drain returns the number
+// of streams which were cut off, along with ctx's error.
+func Drain(ctx context.Context, srv *http.Server) (int, error) {
+	servers.Lock()
+	config := servers.config(srv)
+	config.draining = true
+	clock := config.clock
+	servers.Unlock()
+	if clock == nil {
+		clock = defaultClock
+	}
+
+	for _, conn := range servers.list(srv) {
+		if d, ok := conn.(drainer); ok {
+			d.goAway()
+		}
+	}
+
+	for {
+		conns, streams := DrainProgress(srv)
+		if streams == 0 {
+			for _, conn := range servers.list(srv) {
+				conn.Close()
 			}
-		case "spdy/3":
-			srv.TLSNextProto[str] = func(s *http.Server, tlsConn *tls.Conn, handler http.Handler) {
-				conn, err := NewServerConn(tlsConn, s, 3)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-				conn.Run()
-				conn = nil
-				runtime.GC()
+			return 0, nil
+		}
+		debug.Printf("Draining %d streams across %d connections.\n", streams, conns)
+
+		select {
+		case <-ctx.Done():
+			servers.Lock()
+			servers.config(srv).draining = false
+			servers.Unlock()
+
+			for _, conn := range servers.list(srv) {
+				conn.Close()
 			}
+			return streams, ctx.Err()
+
+		case <-clock.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// DrainProgress returns the number of SPDY connections
+// being served by srv, and the total number of streams
+// still active across them. This can be used to monitor
+// the progress of Drain.
+func DrainProgress(srv *http.Server) (conns, streams int) {
+	for _, conn := range servers.list(srv) {
+		conns++
+		if d, ok := conn.(drainer); ok {
+			streams += d.activeStreams()
 		}
 	}
+	return conns, streams
+}
+
+// handlerSetter is implemented by server connections
+// whose handler can be chosen per connection.
+type handlerSetter interface {
+	setHandler(http.Handler)
 }
 
 // ErrNotSPDY indicates that a SPDY-specific feature was attempted
-// with a ResponseWriter using a non-SPDY connection.
+// with a ResponseWriter using a non-SPDY connection, or that the
+// server chose not to use SPDY when connecting with DialTLS.
 var ErrNotSPDY = errors.New("Error: Not a SPDY connection.")
 
 // ErrNotConnected indicates that a SPDY-specific feature was
 // attempted with a Client not connected to the given server.
 var ErrNotConnected = errors.New("Error: Not connected to given server.")
 
+// ErrNotProcessed indicates that a request was not
+// processed by the server, because the connection was
+// going away. The request may safely be retried on a
+// new connection.
+var ErrNotProcessed = errors.New("Error: Request was not processed by the server.")
+
+// ErrConnectionMigrated indicates that a request was in
+// progress when its connection died, and was not replayed
+// on the replacement connection, as it is not idempotent.
+// The server may or may not have processed the request.
+// See Transport.MigrateConnections.
+var ErrConnectionMigrated = errors.New("Error: Connection died while the request was in progress.")
+
+// ErrDraining indicates that a ping or push could not be
+// completed, because the other endpoint has sent a GOAWAY.
+var ErrDraining = errors.New("Error: Connection is draining.")
+
+// ErrResponseTooLarge indicates that a response's headers
+// or body exceeded the limit set in the Transport, so the
+// request was cancelled.
+var ErrResponseTooLarge = errors.New("Error: Response too large.")
+
+// ErrTimeout indicates that a connection was closed
+// because a read or write deadline was exceeded, such
+// as after the server's ReadTimeout.
+var ErrTimeout = errors.New("Error: Connection timed out.")
+
+// ErrPingTimeout indicates that no reply to a PING
+// was received in the time allowed.
+var ErrPingTimeout = errors.New("Error: PING timed out.")
+
+// ErrTooManyStreams indicates that a request could not
+// be sent because the server's limit on concurrent streams
+// has been reached. The request may be sent once another
+// stream has finished, or on a new connection.
+var ErrTooManyStreams = errors.New("Error: Max concurrent streams limit exceeded.")
+
+// ErrInvalidStreamID indicates that the other endpoint
+// sent a frame with an invalid stream ID, such as one
+// exceeding the limit, or zero in a stream-scoped frame.
+var ErrInvalidStreamID = errors.New("Error: Invalid stream ID.")
+
+// ErrInvalidFrame indicates that the other endpoint
+// sent a malformed frame, such as with an invalid
+// priority or status code, or headers which could
+// not be decompressed.
+var ErrInvalidFrame = errors.New("Error: Invalid frame.")
+
+// ErrHeaderBlockTooLarge indicates that the other
+// endpoint sent a header block which decompressed to
+// more than MaxHeaderBlockSize bytes, or contained
+// more than MaxHeaderCount headers.
+var ErrHeaderBlockTooLarge = errors.New("Error: Header block too large.")
+
+// ErrStreamClosed indicates that a stream could not
+// be used because it has already been closed.
+var ErrStreamClosed = errors.New("Error: Stream already closed.")
+
+// ErrStreamCancelled indicates that a request was
+// abandoned with its stream's Cancel method, or because
+// its context was done, before its response had finished.
+var ErrStreamCancelled = errors.New("Error: Stream cancelled.")
+
+// ErrTagLimit indicates that a tag could not be set on
+// a stream, as it would exceed MAX_STREAM_TAGS tags, or
+// MAX_STREAM_TAG_SIZE bytes.
+var ErrTagLimit = errors.New("Error: Stream tag limit exceeded.")
+
+// ErrGoAway indicates that the connection was closed
+// after the other endpoint sent a GOAWAY. Requests
+// which it did not process fail with ErrNotProcessed,
+// and may be retried on a new connection.
+var ErrGoAway = errors.New("Error: Connection going away.")
+
+// ErrInternal indicates that the connection was ended
+// after an internal error, such as a panic while
+// handling a frame.
+var ErrInternal = errors.New("Error: Internal error.")
+
+// ErrUnsupportedVersion indicates that a connection or
+// frame used a SPDY version which is not supported.
+var ErrUnsupportedVersion = errors.New("Error: Unsupported SPDY version.")
+
+// ErrMalformedFrame indicates that the other endpoint
+// sent a frame whose length, or the length of one of its
+// fields, was invalid for the frame's type.
+var ErrMalformedFrame = errors.New("Error: Malformed frame.")
+
+// ErrFrameTooLarge indicates that the other endpoint
+// sent a frame larger than MaxFrameSize bytes.
+var ErrFrameTooLarge = errors.New("Error: Frame too large.")
+
+// ErrFlowControl indicates that the other endpoint
+// broke the flow control rules, such as with an
+// invalid transfer window size.
+var ErrFlowControl = errors.New("Error: Flow control error.")
+
+// ErrTooManyBenignErrors indicates that a connection
+// was ended because the other endpoint made more than
+// MaxBenignErrors minor errors.
+var ErrTooManyBenignErrors = errors.New("Error: Too many benign errors.")
+
+// ErrStreamIDsExhausted indicates that a request or
+// push could not be sent because the connection has
+// used all of its stream IDs. A request may be sent
+// on a new connection.
+var ErrStreamIDsExhausted = errors.New("Error: All stream IDs exhausted.")
+
+// ErrClientClosed indicates that a request could not be
+// made because its Client has been closed.
+var ErrClientClosed = errors.New("Error: Client closed.")
+
 // ListenAndServeTLS listens on the TCP network address addr
 // and then calls Serve with handler to handle requests on
 // incoming connections.  Handler is typically nil, in which
@@ -217,7 +610,7 @@ var ErrNotConnected = errors.New("Error: Not connected to given server.")
 //
 // One can use generate_cert.go in crypto/tls to generate cert.pem and key.pem.
 func ListenAndServeTLS(addr string, certFile string, keyFile string, handler http.Handler) error {
-	npnStrings := npn()
+	npnStrings := NPNStrings()
 	server := &http.Server{
 		Addr:    addr,
 		Handler: handler,
@@ -227,30 +620,18 @@ func ListenAndServeTLS(addr string, certFile string, keyFile string, handler htt
 		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
 	}
 
+	servers.Lock()
+	config := servers.config(server)
+	servers.Unlock()
+	defer servers.shutdown(server)
+
 	for _, str := range npnStrings {
-		switch str {
-		case "spdy/2":
-			server.TLSNextProto[str] = func(s *http.Server, tlsConn *tls.Conn, handler http.Handler) {
-				conn, err := NewServerConn(tlsConn, s, 2)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-				conn.Run()
-				conn = nil
-				runtime.GC()
-			}
-		case "spdy/3":
-			server.TLSNextProto[str] = func(s *http.Server, tlsConn *tls.Conn, handler http.Handler) {
-				conn, err := NewServerConn(tlsConn, s, 3)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-				conn.Run()
-				conn = nil
-				runtime.GC()
-			}
+		version, ok := npnVersion(str)
+		if !ok {
+			continue
+		}
+		server.TLSNextProto[str] = func(s *http.Server, tlsConn *tls.Conn, handler http.Handler) {
+			serveSPDY(s, config, tlsConn, handler, version)
 		}
 	}
 
@@ -364,6 +745,41 @@ func PingServer(c http.Client, server string) (<-chan Ping, error) {
 	}
 }
 
+// pingTimer is implemented by connections which
+// can wait for a PING reply with a timeout.
+type pingTimer interface {
+	pingTimeout(time.Duration) error
+}
+
+// PingWithTimeout sends a PING on conn, and waits up to d for
+// the reply. If no reply is received in time, ErrPingTimeout
+// is returned, and any later reply is ignored. If the
+// connection closes or is draining before the reply, the
+// reason is returned instead.
+func PingWithTimeout(conn Conn, d time.Duration) error {
+	if p, ok := conn.(pingTimer); ok {
+		return p.pingTimeout(d)
+	}
+
+	c, err := conn.Ping()
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case ping, ok := <-c:
+		if !ok {
+			return errConnClosed
+		}
+		return ping.Err
+	case <-timer.C:
+		return ErrPingTimeout
+	}
+}
+
 // Push is used to send server pushes with SPDY servers.
 // Push takes a ResponseWriter and the url of the resource
 // being pushed, and returns a ResponseWriter to which the
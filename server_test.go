@@ -0,0 +1,69 @@
+package spdy
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// A server's config is dropped once it has shut
+// down and its SPDY connections have closed.
+func TestServerConfigDropped(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	srv := server.Config
+	AddSPDY(srv)
+	EnableHeaderElision(srv)
+	SetConnHooks(srv, new(ConnHooks))
+	SetMaxConcurrentStreams(srv, 10)
+	server.TLS = &tls.Config{NextProtos: NPNStrings()}
+	server.StartTLS()
+	defer server.Close()
+
+	transport := NewTransport(server.Client().Transport.(*http.Transport).TLSClientConfig)
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil || string(body) != "hello" {
+		t.Fatalf("got body %q, error %v", body, err)
+	}
+	if n := Stats(srv).Conns; n != 1 {
+		t.Fatalf("serving %d SPDY connections, want 1", n)
+	}
+	if config := servers.lookup(srv); !config.elision || config.hooks == nil || config.streamLimit != 10 {
+		t.Fatalf("config not recorded: %+v", config)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		servers.Lock()
+		_, ok := servers.configs[srv]
+		servers.Unlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("config was not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if limit := serverStreamLimit(srv); limit != DEFAULT_STREAM_LIMIT {
+		t.Fatalf("stream limit is %d once dropped, want the default", limit)
+	}
+}
@@ -0,0 +1,197 @@
+package spdy
+
+import (
+	"net/http"
+	"sync"
+)
+
+// SETTINGS_EXPERIMENTAL_SESSION_FLOW_CONTROL is an experimental
+// setting, sent by endpoints which implement SPDY/3.1-style
+// session flow control over SPDY/3. See EnableSessionFlowControl.
+const SETTINGS_EXPERIMENTAL_SESSION_FLOW_CONTROL = 0x5f10
+
+// sessionFlowController is implemented by connections
+// which can use session flow control.
+type sessionFlowController interface {
+	enableSessionFlowControl()
+}
+
+// EnableSessionFlowControl enables session flow control on
+// srv's SPDY/3 connections, in addition to the flow control
+// of each stream. Every DATA frame is then also limited by a
+// connection-wide transfer window, which is regrown with
+// WINDOW_UPDATE frames on stream 0, as in SPDY/3.1. srv's
+// connections advertise this with the experimental
+// SETTINGS_EXPERIMENTAL_SESSION_FLOW_CONTROL setting, and
+// it is only used with clients which advertise it in return.
+// This must be called before srv begins serving.
+//
+// Session flow control is experimental, and is only used by
+// clients whose Transport has SessionFlowControl set.
+func EnableSessionFlowControl(srv *http.Server) {
+	servers.Lock()
+	servers.config(srv).session = true
+	servers.Unlock()
+}
+
+// sessionFlowControlEnabled indicates whether session
+// flow control has been enabled for srv.
+func sessionFlowControlEnabled(srv *http.Server) bool {
+	return servers.lookup(srv).session
+}
+
+// sessionFlowControlSetting returns the setting used
+// to advertise support for session flow control.
+func sessionFlowControlSetting() *Setting {
+	return &Setting{
+		ID:    SETTINGS_EXPERIMENTAL_SESSION_FLOW_CONTROL,
+		Value: 1,
+	}
+}
+
+// sessionWindow holds the connection-wide transfer windows
+// used by session flow control. Data is counted against the
+// windows from the start of the connection. Data sent is
+// limited by the window until the peer's first frame shows
+// that it does not use session flow control, as the peer may
+// enforce its window before our SETTINGS reach it. Data
+// received is only limited once the peer has advertised
+// support, so that both endpoints agree on the window's size.
+// The methods of a nil *sessionWindow impose no limit, so
+// that connections without session flow control need not
+// check.
+type sessionWindow struct {
+	sync.Mutex
+	active      bool  // the peer uses session flow control.
+	disabled    bool  // the peer does not use session flow control.
+	window      int64 // transfer window for data sent.
+	windowThere int64 // transfer window for data received.
+	consumed    int64 // data consumed since windowThere was last regrown.
+}
+
+func newSessionWindow() *sessionWindow {
+	w := new(sessionWindow)
+	w.window = DEFAULT_INITIAL_SESSION_WINDOW_SIZE
+	w.windowThere = DEFAULT_INITIAL_SESSION_WINDOW_SIZE
+	return w
+}
+
+// activate starts enforcing the windows, once
+// the peer has advertised its support.
+func (w *sessionWindow) activate() {
+	if w == nil {
+		return
+	}
+	w.Lock()
+	w.active = true
+	w.Unlock()
+}
+
+// observe is given the first frame received from the peer.
+// Endpoints which use session flow control advertise it in
+// the SETTINGS they send first, so if the frame does not do
+// so, data sent is no longer limited by the window, and
+// observe reports true.
+func (w *sessionWindow) observe(frame Frame) bool {
+	if w == nil {
+		return false
+	}
+	if settings, ok := frame.(*settingsFrameV3); ok {
+		if setting, ok := settings.Settings[SETTINGS_EXPERIMENTAL_SESSION_FLOW_CONTROL]; ok && setting.Value != 0 {
+			return false
+		}
+	}
+	w.Lock()
+	w.disabled = true
+	w.Unlock()
+	return true
+}
+
+// enforced indicates whether the windows are enforced.
+func (w *sessionWindow) enforced() bool {
+	if w == nil {
+		return false
+	}
+	w.Lock()
+	defer w.Unlock()
+	return w.active
+}
+
+// take removes up to n bytes from the transfer window,
+// returning the number of bytes which may be sent.
+func (w *sessionWindow) take(n int64) int64 {
+	if w == nil || n <= 0 {
+		return n
+	}
+	w.Lock()
+	defer w.Unlock()
+	if !w.disabled && n > w.window {
+		n = w.window
+	}
+	if n < 0 {
+		n = 0
+	}
+	w.window -= n
+	return n
+}
+
+// reserve removes n bytes from the transfer window if the
+// window allows all of them to be sent, and reports whether
+// it did.
+func (w *sessionWindow) reserve(n int64) bool {
+	if w == nil || n <= 0 {
+		return true
+	}
+	w.Lock()
+	defer w.Unlock()
+	if !w.disabled && n > w.window {
+		return false
+	}
+	w.window -= n
+	return true
+}
+
+// credit grows the transfer window after a WINDOW_UPDATE
+// on stream 0, and reports whether the new window is valid.
+func (w *sessionWindow) credit(delta uint32) bool {
+	w.Lock()
+	defer w.Unlock()
+	w.window += int64(delta)
+	return w.window <= MAX_DELTA_WINDOW_SIZE
+}
+
+// receive counts n bytes of received data against the
+// receive window, and reports false if the peer has
+// exceeded the window. The window is regrown as the
+// data is consumed; see consume.
+func (w *sessionWindow) receive(n int) bool {
+	if w == nil {
+		return true
+	}
+	w.Lock()
+	defer w.Unlock()
+	w.windowThere -= int64(n)
+	return !w.active || w.windowThere >= 0
+}
+
+// consume records that n bytes of received data have been
+// read by the application, or discarded. If the receive
+// window should be regrown, the size of the WINDOW_UPDATE
+// to send is returned.
+func (w *sessionWindow) consume(n int) uint32 {
+	if w == nil {
+		return 0
+	}
+	w.Lock()
+	defer w.Unlock()
+	w.consumed += int64(n)
+	if !w.active || w.consumed < DEFAULT_INITIAL_SESSION_WINDOW_SIZE/2 {
+		return 0
+	}
+
+	// The window is regrown once half has been consumed.
+	update := w.consumed
+	w.windowThere += update
+	w.consumed = 0
+	return uint32(update)
+}
@@ -0,0 +1,251 @@
+package spdy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// settingIDs are setting IDs of each class, with whether
+// SPDY defines them.
+var settingIDs = []struct {
+	name       string
+	id         uint32
+	recognised bool
+}{
+	{"zero", 0, false},
+	{"recognised", SETTINGS_ROUND_TRIP_TIME, true},
+	{"above range", SETTINGS_CLIENT_CERTIFICATE_VECTOR_SIZE + 1, false},
+	{"largest", 0xffffff, false},
+}
+
+// rawSettings returns a SETTINGS frame, as sent on the wire,
+// giving each ID the value 100 and FLAG_SETTINGS_PERSIST_VALUE.
+// Unlike a settings frame, it may repeat IDs or use ID 0.
+func rawSettings(version uint16, ids ...uint32) []byte {
+	n := 4 + 8*len(ids)
+	out := []byte{0x80, byte(version), 0, 4, 0, byte(n >> 16), byte(n >> 8), byte(n)}
+	out = append(out, 0, 0, 0, byte(len(ids)))
+	for _, id := range ids {
+		if version == 2 {
+			out = append(out, byte(id), byte(id>>8), byte(id>>16), byte(FLAG_SETTINGS_PERSIST_VALUE))
+		} else {
+			out = append(out, byte(FLAG_SETTINGS_PERSIST_VALUE), byte(id>>16), byte(id>>8), byte(id))
+		}
+		out = append(out, 0, 0, 0, 100)
+	}
+	return out
+}
+
+// benignErrors returns the number of benign
+// errors the connection has counted.
+func benignErrors(conn Conn) int {
+	switch conn := conn.(type) {
+	case *connV3:
+		conn.Lock()
+		defer conn.Unlock()
+		return conn.numBenignErrors
+	case *connV2:
+		conn.Lock()
+		defer conn.Unlock()
+		return conn.numBenignErrors
+	}
+	return 0
+}
+
+// Settings received with ID 0 are dropped as a benign
+// error, leaving the rest of the frame and the connection
+// intact. Unrecognised settings are kept, and can be read
+// with ReceivedSettings, but are only persisted if the
+// Transport allows it, even when the server asks.
+func TestSettingsReceived(t *testing.T) {
+	var ids []uint32
+	for _, class := range settingIDs {
+		ids = append(ids, class.id)
+	}
+
+	for _, version := range versions {
+		for _, unrecognised := range []bool{false, true} {
+			version, unrecognised := version, unrecognised
+			t.Run(fmt.Sprintf("SPDY/%d/unrecognised=%v", version, unrecognised), func(t *testing.T) {
+				const origin = "example.com:443"
+				store := NewSettingsStore()
+				client, remote := rawClientConnWith(t, version, func(client Conn) {
+					client.(settingsPersister).setSettingsStore(store, origin, unrecognised)
+				})
+
+				// The PING reply shows that the SETTINGS
+				// have been handled.
+				go func() {
+					remote.Write(rawSettings(version, ids...))
+					remote.Write([]byte{0x80, byte(version), 0, 6, 0, 0, 0, 4, 0, 0, 0, 2})
+				}()
+				within(t, 5*time.Second, "the PING reply", func() {
+					for {
+						frame, err := readRawFrame(remote, version)
+						if err != nil {
+							t.Errorf("reading the PING reply: %v", err)
+							return
+						}
+						switch frame.(type) {
+						case *pingFrameV3, *pingFrameV2:
+							return
+						case *goawayFrameV3, *goawayFrameV2:
+							t.Errorf("sent %v", frame)
+							return
+						}
+					}
+				})
+
+				if err := ConnError(client); err != nil {
+					t.Fatalf("the connection closed: %v", err)
+				}
+				if n := benignErrors(client); n != 1 {
+					t.Errorf("%d benign errors, want 1", n)
+				}
+
+				received, err := ReceivedSettings(client)
+				if err != nil {
+					t.Fatal(err)
+				}
+				persisted := store.Get(origin)
+				for _, class := range settingIDs {
+					setting, ok := received[class.id]
+					if stored := class.id != 0; ok != stored || ok && setting.Value != 100 {
+						t.Errorf("%s: received %v, %v, want stored %v", class.name, setting, ok, stored)
+					}
+					if ok && setting.Recognised() != class.recognised {
+						t.Errorf("%s: Recognised gave %v", class.name, setting.Recognised())
+					}
+
+					want := class.recognised || class.id != 0 && unrecognised
+					if got := persisted[class.id] != nil; got != want {
+						t.Errorf("%s: persisted %v, want %v", class.name, got, want)
+					}
+				}
+			})
+		}
+	}
+}
+
+// Settings with ID 0 are never sent, and unrecognised
+// settings are only sent from experimental frames.
+// Whatever is sent is read back unchanged.
+func TestSettingsSent(t *testing.T) {
+	for _, version := range versions {
+		for _, class := range settingIDs {
+			for _, experimental := range []bool{false, true} {
+				settings := Settings{class.id: &Setting{ID: class.id, Value: 100}}
+				var frame Frame
+				if version == 3 {
+					frame = &settingsFrameV3{Settings: settings, Experimental: experimental}
+				} else {
+					frame = &settingsFrameV2{Settings: settings, Experimental: experimental}
+				}
+
+				name := fmt.Sprintf("SPDY/%d/%s/experimental=%v", version, class.name, experimental)
+				data, err := MarshalFrame(frame)
+				if allowed := class.recognised || class.id != 0 && experimental; allowed != (err == nil) {
+					t.Errorf("%s: marshalled to %x, error %v, want allowed %v", name, data, err, allowed)
+					continue
+				}
+				if err != nil {
+					continue
+				}
+
+				parsed, err := ParseFrame(data, version)
+				if err != nil {
+					t.Errorf("%s: parsing gave %v", name, err)
+					continue
+				}
+				var got Settings
+				var flagged bool
+				switch parsed := parsed.(type) {
+				case *settingsFrameV3:
+					got, flagged = parsed.Settings, parsed.Experimental
+				case *settingsFrameV2:
+					got, flagged = parsed.Settings, parsed.Experimental
+				}
+				if s := got[class.id]; len(got) != 1 || s == nil || s.Value != 100 {
+					t.Errorf("%s: parsed as %v", name, got)
+				}
+				if flagged == class.recognised {
+					t.Errorf("%s: parsed with Experimental %v", name, flagged)
+				}
+			}
+		}
+	}
+}
+
+// Each SETTINGS frame received is given to OnSettings,
+// once it has been applied, so ReceivedSettings, which
+// the hook may call, gives its settings along with those
+// received before. Both ends of a connection do this.
+func TestOnSettings(t *testing.T) {
+	for _, version := range versions {
+		for _, server := range []bool{false, true} {
+			version, server := version, server
+			t.Run(fmt.Sprintf("SPDY/%d/server=%v", version, server), func(t *testing.T) {
+				type event struct {
+					frame, received map[uint32]Setting
+				}
+				events := make(chan event, 2)
+				hooks := &ConnHooks{OnSettings: func(conn Conn, settings map[uint32]Setting) {
+					received, err := ReceivedSettings(conn)
+					if err != nil {
+						t.Error(err)
+					}
+					events <- event{settings, received}
+				}}
+
+				var remote net.Conn
+				if server {
+					remote = rawServerConnWith(t, new(http.Server), version, func(server Conn) {
+						server.(hooker).setHooks(hooks)
+					})
+				} else {
+					_, remote = rawClientConnWith(t, version, func(client Conn) {
+						client.(hooker).setHooks(hooks)
+					})
+				}
+				go io.Copy(ioutil.Discard, remote)
+
+				frames := [][]uint32{
+					{SETTINGS_MAX_CONCURRENT_STREAMS, SETTINGS_ROUND_TRIP_TIME},
+					{SETTINGS_UPLOAD_BANDWIDTH},
+				}
+				var all []uint32
+				for _, ids := range frames {
+					if _, err := remote.Write(rawSettings(version, ids...)); err != nil {
+						t.Fatal(err)
+					}
+					all = append(all, ids...)
+
+					var got event
+					within(t, 5*time.Second, "OnSettings", func() { got = <-events })
+					for _, check := range []struct {
+						name     string
+						settings map[uint32]Setting
+						ids      []uint32
+					}{
+						{"OnSettings", got.frame, ids},
+						{"ReceivedSettings", got.received, all},
+					} {
+						if len(check.settings) != len(check.ids) {
+							t.Errorf("%s gave %v, want %d settings", check.name, check.settings, len(check.ids))
+						}
+						for _, id := range check.ids {
+							if setting, ok := check.settings[id]; !ok || setting.Value != 100 {
+								t.Errorf("%s gave setting %d as %v, %v, want 100", check.name, id, setting, ok)
+							}
+						}
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package spdy
+
+import "fmt"
+
+// shutdownState records which endpoints have begun to shut
+// a connection down by sending a GOAWAY. Either endpoint
+// may do so independently of the other, and both may do so
+// at once, such as during a rolling restart.
+//
+// Once a GOAWAY has been sent, new streams from the peer are
+// refused. Once one has been received, no new streams are
+// started, and those started after the peer's last-good
+// stream ID fail with ErrNotProcessed, so that they can be
+// retried. When both endpoints are draining, the streams
+// which complete are therefore exactly those at or below
+// both last-good stream IDs.
+type shutdownState uint8
+
+const (
+	shutdownNone   shutdownState = 0
+	shutdownLocal  shutdownState = 1 << 0 // a GOAWAY has been sent.
+	shutdownRemote shutdownState = 1 << 1 // a GOAWAY has been received.
+	shutdownBoth                 = shutdownLocal | shutdownRemote
+)
+
+// sent indicates whether a GOAWAY has been sent.
+func (s shutdownState) sent() bool {
+	return s&shutdownLocal != 0
+}
+
+// received indicates whether a GOAWAY has been received.
+func (s shutdownState) received() bool {
+	return s&shutdownRemote != 0
+}
+
+func (s shutdownState) String() string {
+	switch s {
+	case shutdownNone:
+		return "open"
+	case shutdownLocal:
+		return "local-draining"
+	case shutdownRemote:
+		return "remote-draining"
+	case shutdownBoth:
+		return "both draining"
+	}
+	return fmt.Sprintf("shutdownState(%d)", uint8(s))
+}
@@ -0,0 +1,327 @@
+package spdy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Requests made while a GOAWAY is received either complete,
+// if the server processed them, or fail promptly with
+// ErrNotProcessed, so that they can be retried. None waits
+// for a response which will never come.
+func TestGoawayDuringRequests(t *testing.T) {
+	const requests = 50
+	const processed = 5
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			client, conn := rawClientConn(t, version)
+
+			// The frames are written in turn, as a net.Pipe
+			// has no buffering, and the client may be
+			// writing as well.
+			out := make(chan []byte, requests+1)
+			go func() {
+				for frame := range out {
+					if _, err := conn.Write(frame); err != nil {
+						return
+					}
+				}
+			}()
+
+			// The server replies to the first requests,
+			// then sends a GOAWAY naming the last of them,
+			// and ignores those which follow.
+			goaway := make(chan StreamID, 1)
+			go func() {
+				defer close(out)
+				c := newRawCompressor(version)
+				var seen int
+				for {
+					frame, err := readRawFrame(conn, version)
+					if err != nil {
+						return
+					}
+					var sid StreamID
+					switch frame := frame.(type) {
+					case *synStreamFrameV3:
+						sid = frame.StreamID
+					case *synStreamFrameV2:
+						sid = frame.StreamID
+					default:
+						continue
+					}
+					if seen++; seen > processed {
+						continue
+					}
+					out <- rawSynReply(version, sid, c)
+					if seen == processed {
+						goaway <- sid
+						out <- rawGoaway(version, sid, GOAWAY_OK)
+					}
+				}
+			}()
+
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			var completed []StreamID
+			for i := 0; i < requests; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					req, _ := http.NewRequest("GET", "http://example.com/", nil)
+					stream, err := client.Request(req, nil, 0)
+					if err == nil {
+						err = stream.Run()
+						stream.Close()
+					}
+					if err != nil {
+						if !errors.Is(err, ErrNotProcessed) {
+							t.Errorf("request failed with %v, want ErrNotProcessed", err)
+						}
+						return
+					}
+					mu.Lock()
+					completed = append(completed, stream.StreamID())
+					mu.Unlock()
+				}()
+			}
+			within(t, 10*time.Second, "the requests", wg.Wait)
+			var lastGood StreamID
+			select {
+			case lastGood = <-goaway:
+			default:
+				t.Fatal("the GOAWAY was not sent")
+			}
+
+			if len(completed) != processed {
+				t.Errorf("%d requests completed, want %d", len(completed), processed)
+			}
+			for _, sid := range completed {
+				if sid > lastGood {
+					t.Errorf("stream %d completed, after the last good stream %d", sid, lastGood)
+				}
+			}
+
+			// Requests made afterwards fail at once.
+			req, _ := http.NewRequest("GET", "http://example.com/", nil)
+			if _, err := client.Request(req, nil, 0); err != ErrNotProcessed {
+				t.Errorf("request after the GOAWAY returned %v, want ErrNotProcessed", err)
+			}
+		})
+	}
+}
+
+func TestShutdownState(t *testing.T) {
+	tests := []struct {
+		state          shutdownState
+		sent, received bool
+		name           string
+	}{
+		{shutdownNone, false, false, "open"},
+		{shutdownLocal, true, false, "local-draining"},
+		{shutdownRemote, false, true, "remote-draining"},
+		{shutdownBoth, true, true, "both draining"},
+	}
+	for _, test := range tests {
+		if test.state.sent() != test.sent || test.state.received() != test.received || test.state.String() != test.name {
+			t.Errorf("%d: got sent %v, received %v, %q, want %v, %v, %q", test.state,
+				test.state.sent(), test.state.received(), test.state, test.sent, test.received, test.name)
+		}
+	}
+}
+
+// Closing both ends of a connection at once, with requests
+// in flight, ends every request, and leaves no goroutines
+// behind. A request which completes was served in full.
+func TestSimultaneousClose(t *testing.T) {
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			before := runtime.NumGoroutine()
+			for run := 0; run < 50; run++ {
+				var m sync.Mutex
+				served := make(map[string]bool)
+				srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					for i := 0; i < 10; i++ {
+						w.Write(make([]byte, 1000))
+						w.(http.Flusher).Flush()
+					}
+					m.Lock()
+					served[r.URL.Path] = true
+					m.Unlock()
+				})}
+				server, client := pipeConns(t, srv, version)
+
+				errs := make(chan error, 10)
+				paths := make(chan string, 10)
+				for i := 0; i < 10; i++ {
+					path := fmt.Sprintf("/%d", i)
+					go func() {
+						req, _ := http.NewRequest("GET", "https://example.com"+path, nil)
+						res, err := request(client, req)
+						if err == nil && res.Data.Len() != 10000 {
+							err = fmt.Errorf("got %d bytes", res.Data.Len())
+						}
+						if err == nil {
+							paths <- path
+						}
+						errs <- err
+					}()
+				}
+
+				time.Sleep(time.Duration(run%10) * 100 * time.Microsecond)
+				var closing sync.WaitGroup
+				closing.Add(2)
+				go func() { defer closing.Done(); server.Close() }()
+				go func() { defer closing.Done(); client.Close() }()
+				within(t, 5*time.Second, "closing both ends", closing.Wait)
+
+				within(t, 5*time.Second, "the requests ending", func() {
+					for i := 0; i < 10; i++ {
+						<-errs
+					}
+				})
+				close(paths)
+				m.Lock()
+				for path := range paths {
+					if !served[path] {
+						t.Errorf("run %d: %s completed, but was not served in full", run, path)
+					}
+				}
+				m.Unlock()
+			}
+			checkGoroutines(t, before)
+		})
+	}
+}
+
+// shutdownIDHeader carries the ID of each request made
+// by TestShutdownRace, so that the handler can record
+// which requests it saw.
+const shutdownIDHeader = "X-Shutdown-Id"
+
+// Draining a TLS server while its client closes its
+// connections, within a millisecond of each other, with
+// requests in progress, gives consistent outcomes over
+// each version, and leaks no goroutines. Requests which
+// complete were served in full, and those which fail
+// with ErrNotProcessed never reached the handler.
+func TestShutdownRace(t *testing.T) {
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			if version == 2 {
+				if err := DisableSpdyVersion(3); err != nil {
+					t.Fatal(err)
+				}
+				defer EnableSpdyVersion(3)
+			}
+
+			before := runtime.NumGoroutine()
+			for run := 0; run < 20; run++ {
+				shutdownRace(t, run, 10)
+			}
+			checkGoroutines(t, before)
+		})
+	}
+}
+
+// shutdownRace performs a single run of TestShutdownRace,
+// making the given number of requests.
+func shutdownRace(t *testing.T, run, requests int) {
+	var m sync.Mutex
+	started := make(map[string]bool)
+	served := make(map[string]bool)
+
+	server := startSPDYServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(shutdownIDHeader)
+		if id == "" {
+			return // Connection warm-up.
+		}
+		m.Lock()
+		started[id] = true
+		m.Unlock()
+		io.Copy(w, r.Body)
+		for i := 0; i < 10; i++ {
+			w.Write(make([]byte, 1000))
+			w.(http.Flusher).Flush()
+		}
+		m.Lock()
+		served[id] = true
+		m.Unlock()
+	}))
+	defer server.Close()
+	tr := spdyClient(server)
+	client := &http.Client{Transport: tr}
+
+	// Make sure the connection exists, so that the
+	// requests are in progress when it shuts down.
+	res, err := client.Get(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	outcomes := make([]error, requests)
+	var wg sync.WaitGroup
+	for i := range outcomes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			// The body cannot be replayed, so requests
+			// which were not processed are not retried.
+			body := ioutil.NopCloser(strings.NewReader("shutdown"))
+			req, _ := http.NewRequest("POST", server.URL+"/", body)
+			req.Header.Set(shutdownIDHeader, fmt.Sprint(i))
+			res, err := client.Do(req)
+			if err == nil {
+				_, err = ioutil.ReadAll(res.Body)
+				res.Body.Close()
+			}
+			outcomes[i] = err
+		}(i)
+	}
+
+	// Shut down both ends at once.
+	time.Sleep(time.Duration(rand.Intn(1000)) * time.Microsecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var shutdown sync.WaitGroup
+	shutdown.Add(2)
+	go func() {
+		defer shutdown.Done()
+		Drain(ctx, server.Config)
+	}()
+	go func() {
+		defer shutdown.Done()
+		tr.CloseConnections(ctx)
+	}()
+	within(t, 10*time.Second, "the shutdown", func() {
+		shutdown.Wait()
+		wg.Wait()
+	})
+
+	m.Lock()
+	defer m.Unlock()
+	for i, err := range outcomes {
+		id := fmt.Sprint(i)
+		switch {
+		case err == nil && !served[id]:
+			t.Errorf("run %d: request %s completed, but was not served in full", run, id)
+		case errors.Is(err, ErrNotProcessed) && started[id]:
+			t.Errorf("run %d: request %s was not processed, but reached the handler", run, id)
+		}
+	}
+}
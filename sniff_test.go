@@ -0,0 +1,171 @@
+package spdy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A handler's response is given the Content-Type and
+// Content-Length that net/http would give it. Larger
+// responses are streamed, without a Content-Length.
+func TestResponseBuffering(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(w http.ResponseWriter)
+	}{
+		{"small JSON", func(w http.ResponseWriter) {
+			w.Write([]byte(`{"hello": "world"}`))
+		}},
+		{"small HTML", func(w http.ResponseWriter) {
+			w.Write([]byte("<html><body>hello</body></html>"))
+		}},
+		{"several writes", func(w http.ResponseWriter) {
+			for i := 0; i < 10; i++ {
+				w.Write([]byte("hello, world\n"))
+			}
+		}},
+		{"WriteHeader", func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte("hello, world"))
+		}},
+		{"explicit Content-Type", func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"hello": "world"}`))
+		}},
+		{"large stream", func(w http.ResponseWriter) {
+			for i := 0; i < 100; i++ {
+				w.Write([]byte(strings.Repeat("a", 1000)))
+			}
+		}},
+		{"exactly the buffer", func(w http.ResponseWriter) {
+			w.Write([]byte(strings.Repeat("a", RESPONSE_BUFFER_SIZE)))
+		}},
+		{"flushed", func(w http.ResponseWriter) {
+			w.Write([]byte("hello, world"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("hello again"))
+		}},
+	}
+
+	for _, version := range versions {
+		for _, test := range tests {
+			version, test := version, test
+			t.Run(fmt.Sprintf("SPDY/%d/%s", version, test.name), func(t *testing.T) {
+				handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { test.handler(w) })
+
+				// What net/http does.
+				ts := httptest.NewServer(handler)
+				defer ts.Close()
+				want, err := http.Get(ts.URL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantBody, _ := ioutil.ReadAll(want.Body)
+				want.Body.Close()
+
+				tr := pipeTransport(t, &http.Server{Handler: handler}, version)
+				within(t, 5*time.Second, "the response", func() {
+					req, _ := http.NewRequest("GET", "https://example.com/", nil)
+					got, err := tr.RoundTrip(req)
+					if err != nil {
+						t.Errorf("RoundTrip gave %v", err)
+						return
+					}
+					gotBody, _ := ioutil.ReadAll(got.Body)
+					got.Body.Close()
+
+					if got.StatusCode != want.StatusCode {
+						t.Errorf("got status %d, want %d", got.StatusCode, want.StatusCode)
+					}
+					if string(gotBody) != string(wantBody) {
+						t.Errorf("got body %q, want %q", gotBody, wantBody)
+					}
+					for _, name := range []string{"Content-Type", "Content-Length"} {
+						if g, w := got.Header.Get(name), want.Header.Get(name); g != w {
+							t.Errorf("%s is %q, want %q", name, g, w)
+						}
+					}
+				})
+			})
+		}
+	}
+}
+
+// A small response is sent as a SYN_REPLY with its
+// Content-Length, followed by one DATA frame which ends
+// the stream. Calling Flush sends the reply without waiting
+// for the body, so it has no Content-Length.
+func TestResponseBufferingFrames(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(w http.ResponseWriter)
+		length  string // Content-Length sent in the SYN_REPLY.
+		frames  int    // DATA frames sent.
+	}{
+		{"buffered", func(w http.ResponseWriter) {
+			w.Write([]byte("hello, "))
+			w.Write([]byte("world"))
+		}, "12", 1},
+		{"Flush", func(w http.ResponseWriter) {
+			w.(http.Flusher).Flush()
+			w.Write([]byte("hello, "))
+			w.Write([]byte("world"))
+		}, "", 3},
+	}
+
+	for _, version := range versions {
+		for _, test := range tests {
+			version, test := version, test
+			t.Run(fmt.Sprintf("SPDY/%d/%s", version, test.name), func(t *testing.T) {
+				srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					test.handler(w)
+				})}
+				conn := rawServerConn(t, srv, version)
+				go conn.Write(rawSynStream(version, 1, newRawCompressor(version).block(rawRequest(version, "/")...)))
+
+				d := NewDecompressor(version)
+				var header http.Header
+				var frames int
+				var body []byte
+				within(t, 5*time.Second, "the response", func() {
+					for fin := false; !fin; {
+						frame, err := readRawFrame(conn, version)
+						if err != nil {
+							t.Errorf("reading the response: %v", err)
+							return
+						}
+						switch frame := frame.(type) {
+						case *synReplyFrameV3:
+							err, header, fin = frame.Decompress(d), frame.Header, frame.Flags.FIN()
+						case *synReplyFrameV2:
+							err, header, fin = frame.Decompress(d), frame.Header, frame.Flags.FIN()
+						case *dataFrameV3:
+							frames, body, fin = frames+1, append(body, frame.Data...), frame.Flags.FIN()
+						case *dataFrameV2:
+							frames, body, fin = frames+1, append(body, frame.Data...), frame.Flags.FIN()
+						}
+						if err != nil {
+							t.Errorf("decompressing the reply: %v", err)
+							return
+						}
+					}
+				})
+
+				if string(body) != "hello, world" {
+					t.Errorf("got body %q", body)
+				}
+				if length := header.Get("Content-Length"); length != test.length {
+					t.Errorf("Content-Length is %q, want %q", length, test.length)
+				}
+				if frames != test.frames {
+					t.Errorf("sent %d DATA frames, want %d", frames, test.frames)
+				}
+			})
+		}
+	}
+}
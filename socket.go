@@ -0,0 +1,89 @@
+package spdy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+)
+
+// tuneSocket sets TCP_NODELAY on conn, if it is a TCP
+// connection, and then applies any further options.
+func tuneSocket(conn net.Conn, noDelay bool, options func(net.Conn) error) error {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if err := tcpConn.SetNoDelay(noDelay); err != nil {
+			return err
+		}
+	}
+	if options != nil {
+		return options(conn)
+	}
+	return nil
+}
+
+// tunedListener applies socket options to each
+// accepted connection.
+type tunedListener struct {
+	net.Listener
+	noDelay bool
+	options func(net.Conn) error
+}
+
+func (l *tunedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if err := tuneSocket(conn, l.noDelay, l.options); err != nil {
+			log.Printf("Error: Failed to set socket options for %s: %v\n", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+// TuneListener returns a net.Listener which sets TCP_NODELAY
+// to noDelay on each accepted TCP connection, and then calls
+// options, if non-nil, with the raw connection. options can
+// be used to set keep-alive intervals, buffer sizes, or the
+// TOS field. If options returns an error, the connection is
+// closed. Since TLS is added by the http.Server, options is
+// always given the underlying *net.TCPConn.
+//
+//	func main() {
+//		ln, err := net.Listen("tcp", ":443")
+//		if err != nil {
+//			log.Fatal(err)
+//		}
+//		srv := &http.Server{}
+//		spdy.AddSPDY(srv)
+//		log.Fatal(srv.ServeTLS(spdy.TuneListener(ln, true, nil), "cert.pem", "key.pem"))
+//	}
+func TuneListener(l net.Listener, noDelay bool, options func(net.Conn) error) net.Listener {
+	return &tunedListener{l, noDelay, options}
+}
+
+// closeSocket closes the connection underlying a session.
+// If graceful, the write side is closed first, sending a
+// TLS close_notify, or a FIN for plain TCP, and the other
+// endpoint is given up to CloseLinger to close its side,
+// so that it sees a clean end of stream rather than a
+// reset caused by data arriving at a closed socket. Any
+// data read in the meantime is discarded. An abrupt close,
+// such as after a fatal protocol error, skips the linger.
+func closeSocket(conn net.Conn, graceful bool, clock clock) error {
+	if graceful && CloseLinger > 0 {
+		if cw, ok := conn.(interface {
+			CloseWrite() error
+		}); ok && cw.CloseWrite() == nil {
+			conn.SetReadDeadline(clock.Now().Add(CloseLinger))
+			io.Copy(ioutil.Discard, conn)
+		}
+	}
+
+	// Unblock the read loop, as closing the connection
+	// does not interrupt a blocked read on all platforms.
+	conn.SetReadDeadline(clock.Now())
+	return conn.Close()
+}
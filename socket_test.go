@@ -0,0 +1,126 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package spdy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+)
+
+// noDelay reports whether TCP_NODELAY is set on conn.
+func noDelay(t *testing.T, conn net.Conn) bool {
+	t.Helper()
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		t.Fatalf("socket options were given a %T, not a *net.TCPConn", conn)
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	err = raw.Control(func(fd uintptr) {
+		value, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value != 0
+}
+
+// The Transport sets TCP_NODELAY on the connections it
+// dials, unless DisableNoDelay is set, and then calls
+// SocketOptions with the raw TCP connection. An error
+// from SocketOptions fails the request.
+func TestTransportSocketOptions(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	for _, disable := range []bool{false, true} {
+		var called, set bool
+		tr := &Transport{
+			DisableNoDelay: disable,
+			SocketOptions: func(conn net.Conn) error {
+				called, set = true, noDelay(t, conn)
+				return nil
+			},
+		}
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if !called {
+			t.Errorf("DisableNoDelay %v: SocketOptions was not called", disable)
+		}
+		if set == disable {
+			t.Errorf("DisableNoDelay %v: TCP_NODELAY is %v", disable, set)
+		}
+		tr.CloseIdleConnections()
+	}
+
+	want := errors.New("socket options failed")
+	tr := &Transport{SocketOptions: func(net.Conn) error { return want }}
+	defer tr.CloseIdleConnections()
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	if _, err := tr.RoundTrip(req); err != want {
+		t.Errorf("RoundTrip returned %v, want %v", err, want)
+	}
+}
+
+// TuneListener sets TCP_NODELAY as asked on each accepted
+// connection, and then calls the socket options. Connections
+// for which the options fail are closed and skipped.
+func TestTuneListener(t *testing.T) {
+	for _, set := range []bool{true, false} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Skipf("cannot listen on the loopback interface: %v", err)
+		}
+
+		var calls int
+		var got bool
+		tuned := TuneListener(l, set, func(conn net.Conn) error {
+			calls++
+			if calls == 1 {
+				return errors.New("socket options failed")
+			}
+			got = noDelay(t, conn)
+			return nil
+		})
+
+		// The first connection is closed by the listener.
+		first, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := tuned.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if calls != 2 {
+			t.Errorf("noDelay %v: socket options called %d times, want 2", set, calls)
+		}
+		if got != set {
+			t.Errorf("noDelay %v: TCP_NODELAY is %v", set, got)
+		}
+		if _, err := first.Read(make([]byte, 1)); err == nil {
+			t.Errorf("noDelay %v: the connection whose options failed was not closed", set)
+		}
+
+		conn.Close()
+		first.Close()
+		second.Close()
+		tuned.Close()
+	}
+}
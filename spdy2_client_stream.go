@@ -3,8 +3,11 @@ package spdy
 import (
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // clientStreamV2 is a structure that implements
@@ -16,12 +19,19 @@ type clientStreamV2 struct {
 	streamID     StreamID
 	state        *StreamState
 	output       chan<- Frame
+	priority     Priority
 	request      *http.Request
 	receiver     Receiver
 	header       http.Header
 	responseCode int
 	stop         <-chan struct{}
 	finished     chan struct{}
+	err          error
+	body         *requestBody
+	deadline     writeDeadline
+	shut         uint32 // set to 1 once the stream has been shut; accessed atomically.
+	tags         streamTags
+	gotReply     bool // whether the SYN_REPLY has been received.
 }
 
 /***********************
@@ -35,7 +45,10 @@ func (s *clientStreamV2) Header() http.Header {
 // Write is one method with which request data is sent.
 func (s *clientStreamV2) Write(inputData []byte) (int, error) {
 	if s.closed() || s.state.ClosedHere() {
-		return 0, errors.New("Error: Stream already closed.")
+		return 0, ErrStreamClosed
+	}
+	if err := s.deadline.err(); err != nil {
+		return 0, err
 	}
 
 	// Copy the data locally to avoid any pointer issues.
@@ -43,30 +56,12 @@ func (s *clientStreamV2) Write(inputData []byte) (int, error) {
 	copy(data, inputData)
 
 	// Send any new headers.
-	s.writeHeader()
-
-	// Chunk the response if necessary.
-	written := 0
-	for len(data) > MAX_DATA_SIZE {
-		dataFrame := new(dataFrameV2)
-		dataFrame.StreamID = s.streamID
-		dataFrame.Data = data[:MAX_DATA_SIZE]
-		s.output <- dataFrame
-
-		written += MAX_DATA_SIZE
-	}
-
-	n := len(data)
-	if n == 0 {
-		return written, nil
+	if err := s.writeHeader(); err != nil {
+		return 0, err
 	}
 
-	dataFrame := new(dataFrameV2)
-	dataFrame.StreamID = s.streamID
-	dataFrame.Data = data
-	s.output <- dataFrame
-
-	return written + n, nil
+	// Chunk the data if necessary.
+	return writeDataV2(s.output, s.stop, s.streamID, data)
 }
 
 // WriteHeader is used to set the HTTP status code.
@@ -79,26 +74,102 @@ func (s *clientStreamV2) WriteHeader(int) {
  *****************/
 
 // Cancel is used to cancel a mid-air
-// request.
+// request. If the stream was left open
+// for writing, it is closed with a FIN.
 func (s *clientStreamV2) Close() error {
-	s.Lock()
-	defer s.Unlock()
+	// Frames are sent without the stream's lock, which
+	// the read loop needs to deliver frames, so only the
+	// first call to set shut sends them.
+	open := !s.closed()
+	shut := atomic.SwapUint32(&s.shut, 1) == 1
+
 	s.writeHeader()
-	if s.state != nil {
+	if !shut {
+		// Free the stream's slot in the stream limit.
+		if conn, ok := s.conn.(*connV2); ok {
+			conn.requestStreamLimit.Close()
+		}
+		if open && s.state.OpenHere() {
+			data := newDataFrameV2()
+			data.StreamID = s.streamID
+			data.Flags = FLAG_FIN
+			data.Data = []byte{}
+			sendFrame(s.output, s.stop, data)
+			s.state.CloseHere()
+		}
+		// Cancel the request if the response
+		// has not yet finished.
+		if open && s.state.OpenThere() {
+			s.cancel(false)
+		}
 		s.state.Close()
-		s.state = nil
 	}
-	s.output = nil
-	s.request = nil
-	s.receiver = nil
-	s.header = nil
-	s.stop = nil
+	if s.body != nil {
+		// Reads fail with the reason the stream
+		// ended, if it was reset.
+		s.Lock()
+		err := s.err
+		s.Unlock()
+		if err == nil {
+			err = ErrStreamClosed
+		}
+		s.body.discard(err)
+	}
+	return nil
+}
+
+// CloseWrite half-closes the stream, sending a FIN.
+// The response can still be read.
+func (s *clientStreamV2) CloseWrite() error {
+	if s.closed() || s.state.ClosedHere() {
+		return ErrStreamClosed
+	}
+
+	if err := s.writeHeader(); err != nil {
+		return err
+	}
+	data := newDataFrameV2()
+	data.StreamID = s.streamID
+	data.Flags = FLAG_FIN
+	data.Data = []byte{}
+	if !sendFrame(s.output, s.stop, data) {
+		return errConnClosed
+	}
+	s.state.CloseHere()
+	return nil
+}
+
+// Reset ends the stream abruptly, sending a
+// RST_STREAM with the given status code. Resetting
+// the stream with CANCEL is the same as Cancel.
+func (s *clientStreamV2) Reset(code StatusCode) error {
+	conn, ok := s.conn.(*connV2)
+	if !ok {
+		return errors.New("Error: Stream has no connection.")
+	}
+	return conn.resetStream(s, code)
+}
+
+// Cancel abandons the request, resetting the stream with
+// CANCEL. Run returns ErrStreamCancelled, as do reads of
+// the response body once any data already received has
+// been read. Any response data still arriving is discarded.
+// Cancelling a finished request has no effect.
+func (s *clientStreamV2) Cancel() error {
+	if err := s.Reset(RST_STREAM_CANCEL); err != ErrStreamClosed {
+		return err
+	}
 	return nil
 }
 
+// Read reads the response body of a stream requested
+// without a Receiver. Other streams cannot be read, as
+// their response is given to the Receiver.
 func (s *clientStreamV2) Read(out []byte) (int, error) {
-	// TODO
-	return 0, nil
+	if s.body == nil {
+		return 0, errors.New("Error: Stream has a Receiver.")
+	}
+	return s.body.Read(out)
 }
 
 /**********
@@ -119,9 +190,15 @@ func (s *clientStreamV2) ReceiveFrame(frame Frame) error {
 	// Process the frame depending on its type.
 	switch frame := frame.(type) {
 	case *dataFrameV2:
+		// The response's data follows its SYN_REPLY.
+		if !s.gotReply {
+			return errNoReply
+		}
 
-		// Extract the data.
-		data := frame.Data
+		// Extract the data, which is copied if the
+		// receiver may keep it, as the frame's buffer
+		// is reused once the frame has been handled.
+		data := receivedData(s.receiver, frame.Data, frame.payload != nil)
 		if data == nil {
 			data = []byte{}
 		}
@@ -131,20 +208,26 @@ func (s *clientStreamV2) ReceiveFrame(frame Frame) error {
 
 		if frame.Flags.FIN() {
 			s.state.CloseThere()
-			close(s.finished)
+			s.finish(nil)
 		}
 
 	case *synReplyFrameV2:
-		s.receiver.ReceiveHeader(s.request, frame.Header)
+		s.gotReply = true
+		s.receiver.ReceiveHeader(s.request, replyHeaderV2(frame.Header))
 
 		if frame.Flags.FIN() {
 			s.state.CloseThere()
-			close(s.finished)
+			s.finish(nil)
 		}
 
 	case *headersFrameV2:
 		s.receiver.ReceiveHeader(s.request, frame.Header)
 
+		if frame.Flags.FIN() {
+			s.state.CloseThere()
+			s.finish(nil)
+		}
+
 	case *windowUpdateFrameV2:
 		// Ignore.
 
@@ -152,6 +235,14 @@ func (s *clientStreamV2) ReceiveFrame(frame Frame) error {
 		return errors.New(fmt.Sprintf("Received unknown frame of type %T.", frame))
 	}
 
+	// Cancel the request if the receiver
+	// has rejected the response.
+	if a, ok := s.receiver.(aborter); ok {
+		if err := a.aborted(); err != nil {
+			s.abort(err)
+		}
+	}
+
 	return nil
 }
 
@@ -162,22 +253,97 @@ func (s *clientStreamV2) ReceiveFrame(frame Frame) error {
 func (s *clientStreamV2) Run() error {
 	// Receive and process inbound frames.
 	<-s.finished
+	if s.err != nil {
+		return s.err
+	}
+
+	// A stream requested without a Receiver stays
+	// open for writing until it is closed.
+	if s.body != nil {
+		return nil
+	}
 
 	// Clean up state.
 	s.state.CloseHere()
 	return nil
 }
 
+// abort cancels the request, causing Run to return
+// the given error. abort must be called with the
+// stream's lock held.
+func (s *clientStreamV2) abort(err error) {
+	if s.state.OpenThere() {
+		s.cancel(true)
+	}
+	if conn, ok := s.conn.(*connV2); ok && err == ErrResponseTooLarge {
+		conn.stats.responseTooLarge()
+	}
+	s.state.Close()
+	s.finish(err)
+}
+
+// cancel resets the stream with CANCEL, and discards the
+// rest of the response. The RST_STREAM is queued without
+// waiting. If locked is set, the stream's lock is held, so
+// the connection's lock cannot be taken, and the response
+// is discarded from a new goroutine.
+func (s *clientStreamV2) cancel(locked bool) {
+	rst := new(rstStreamFrameV2)
+	rst.StreamID = s.streamID
+	rst.Status = RST_STREAM_CANCEL
+	if conn, ok := s.conn.(*connV2); ok {
+		conn.queue(rst)
+		if locked {
+			go conn.cancelRequest(s.streamID)
+		} else {
+			conn.cancelRequest(s.streamID)
+		}
+	}
+}
+
+// fail ends the stream locally, causing Run
+// to return the given error.
+func (s *clientStreamV2) fail(err error) {
+	s.Lock()
+	s.finish(err)
+	s.Unlock()
+}
+
+// finish marks the response as complete, waking
+// Run. finish must be called with the stream's
+// lock held, and is safe to call multiple times.
+func (s *clientStreamV2) finish(err error) {
+	select {
+	case <-s.finished:
+		return
+	default:
+	}
+	s.err = err
+	close(s.finished)
+}
+
 func (s *clientStreamV2) State() *StreamState {
 	return s.state
 }
 
+func (s *clientStreamV2) Priority() Priority {
+	return s.priority
+}
+
 func (s *clientStreamV2) StreamID() StreamID {
 	return s.streamID
 }
 
+func (s *clientStreamV2) SetTag(key, value string) error {
+	return s.tags.set(key, value)
+}
+
+func (s *clientStreamV2) Tags() map[string]string {
+	return s.tags.copy()
+}
+
 func (s *clientStreamV2) closed() bool {
-	if s.conn == nil || s.state == nil || s.receiver == nil {
+	if s.conn == nil || atomic.LoadUint32(&s.shut) == 1 {
 		return true
 	}
 	select {
@@ -188,21 +354,86 @@ func (s *clientStreamV2) closed() bool {
 	}
 }
 
-// writeHeader is used to flush HTTP headers.
-func (s *clientStreamV2) writeHeader() {
-	if len(s.header) == 0 {
-		return
+/************
+ * net.Conn *
+ ************/
+
+func (s *clientStreamV2) LocalAddr() net.Addr {
+	return localStreamAddr(s.conn, s.streamID)
+}
+
+func (s *clientStreamV2) RemoteAddr() net.Addr {
+	return remoteStreamAddr(s.conn, s.streamID)
+}
+
+func (s *clientStreamV2) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for reads of a
+// stream requested without a Receiver.
+func (s *clientStreamV2) SetReadDeadline(t time.Time) error {
+	if s.body == nil {
+		return errors.New("Error: Stream has a Receiver.")
+	}
+	s.body.setDeadline(t)
+	return nil
+}
+
+func (s *clientStreamV2) SetWriteDeadline(t time.Time) error {
+	s.deadline.set(t)
+	return nil
+}
+
+// writeHeader is used to flush HTTP headers. Headers
+// which cannot be sent end the stream, as with
+// headersFailed.
+func (s *clientStreamV2) writeHeader() error {
+	if len(s.header) == 0 || s.state.ClosedHere() {
+		return nil
 	}
 
 	// Create the HEADERS frame.
 	header := new(headersFrameV2)
 	header.StreamID = s.streamID
 	header.Header = cloneHeader(s.header)
+	if err := checkHeaders(header.Header); err != nil {
+		return s.headersFailed(err)
+	}
 
 	// Clear the headers that have been sent.
 	for name := range header.Header {
 		s.header.Del(name)
 	}
 
-	s.output <- header
+	sendFrame(s.output, s.stop, header)
+	return nil
+}
+
+// headersFailed ends the stream, as headers set for the
+// request cannot be sent, resetting it with an
+// INTERNAL_ERROR. err is returned, and is given as the
+// reason the stream ended.
+func (s *clientStreamV2) headersFailed(err error) error {
+	s.fail(err)
+	if conn, ok := s.conn.(*connV2); ok {
+		conn.resetStream(s, RST_STREAM_INTERNAL_ERROR)
+	}
+	return err
+}
+
+// replyHeaderV2 returns a copy of the header of a SPDY/2
+// reply, with its status and version moved to the SPDY/3
+// pseudo-headers, so that receivers can treat both
+// versions alike.
+func replyHeaderV2(header http.Header) http.Header {
+	out := cloneHeader(header)
+	for name, pseudo := range map[string]string{"Status": ":status", "Version": ":version"} {
+		if values, ok := out[name]; ok {
+			delete(out, name)
+			out[pseudo] = values
+		}
+	}
+	return out
 }
@@ -2,6 +2,7 @@ package spdy
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -10,7 +11,12 @@ import (
 	"net/http"
 	"net/url"
 	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,13 +25,17 @@ import (
 // or NewClientConn.
 type connV2 struct {
 	sync.Mutex
+	id                  uint64 // unique connection ID, used in profiler labels.
 	remoteAddr          string
 	server              *http.Server
+	handler             http.Handler // if non-nil, used instead of the server's handler.
 	conn                net.Conn
+	netLock             sync.Mutex // guards conn, so that deadlines are set without the connection's lock.
 	buf                 *bufio.Reader
 	tlsState            *tls.ConnectionState
 	streams             map[StreamID]Stream        // map of active streams.
 	output              [8]chan Frame              // one output channel per priority level.
+	control             *controlQueue              // control frames, which are sent ahead of stream frames.
 	pings               map[uint32]chan<- Ping     // response channel for pings.
 	nextPingID          uint32                     // next outbound ping ID.
 	compressor          Compressor                 // outbound compression state.
@@ -34,20 +44,56 @@ type connV2 struct {
 	lastPushStreamID    StreamID                   // last push stream ID. (even)
 	lastRequestStreamID StreamID                   // last request stream ID. (odd)
 	oddity              StreamID                   // whether locally-sent streams are odd or even.
-	initialWindowSize   uint32                     // initial transport window.
-	goaway              bool                       // goaway has been sent/received.
+	initialWindowSize   uint32                     // initial transport window; accessed atomically.
+	shutdown            shutdownState              // GOAWAYs sent and received.
+	lastGoodStreamID    StreamID                   // last good stream ID in the received goaway.
+	fatal               bool                       // a fatal error has occurred, so no more frames are processed.
+	closeReason         error                      // reason for the connection closing.
+	closeLock           sync.Mutex                 // guards closeReason, shutdown and lastGoodStreamID.
 	numBenignErrors     int                        // number of non-serious errors encountered.
+	versionErrors       int                        // number of connection-scoped frames with the wrong version.
+	peerVersion         uint16                     // version of the last frame with the wrong version.
 	requestStreamLimit  *streamLimit               // Limit on streams started by the client.
 	pushStreamLimit     *streamLimit               // Limit on streams started by the server.
 	pushRequests        map[StreamID]*http.Request // map of requests sent in server pushes.
+	pushOrigins         map[StreamID]StreamID      // map of unfinished server pushes to their origin streams.
+	maxHeaders          int                        // maximum HEADERS frames accepted per stream.
+	headerCounts        map[StreamID]int           // number of HEADERS frames received per stream.
+	elideHeaders        bool                       // elide request headers repeated from the previous request.
+	peerElision         bool                       // the server can restore elided request headers.
+	admit               admissionFunc              // decides whether streams are served.
+	restoreHeaders      bool                       // restore request headers elided by the client.
+	lastHeader          http.Header                // headers of the previous request, for header elision.
+	refused             refusedStreams             // recently refused streams.
+	resets              resetFlood                 // rate limit for RST_STREAMs on unknown streams.
 	pushReceiver        Receiver                   // Receiver to call for server Pushes.
+	hooks               *dispatcher                // dispatcher for connection event hooks.
 	stop                chan struct{}              // this channel is closed when the connection closes.
+	closing             chan struct{}              // this channel is closed to wake the send loop when the connection is closing.
+	sendStopped         chan struct{}              // this channel is closed when the send loop exits.
 	sending             chan struct{}              // this channel is used to ensure pending frames are sent.
-	init                func()                     // this function is called before the connection begins.
+	frames              *framePoolV2               // freelists for fixed-size control frames.
+	started             time.Time                  // time at which the connection was created.
+	clock               clock                      // source of time for timeouts.
+	stats               *connStats                 // counters of the connection's activity.
+	events              connEvents                 // recent events and the settings sent, for snapshots.
+	init                func() []Frame             // returns the first frames sent on the connection.
+	settingsStore       SettingsStore              // persisted SETTINGS, for clients.
+	origin              string                     // host:port for settingsStore.
+	persistUnrecognised bool                       // persist unrecognised settings too.
+	persistedSettings   Settings                   // settings persisted by a previous connection.
+	pingInterval        time.Duration              // idle time before a keep-alive PING is sent.
+	pingWait            time.Duration              // time allowed for the reply to a keep-alive PING.
+	readTimeout         time.Duration              // read timeout of a client connection.
+	writeTimeout        time.Duration              // write timeout of a client connection.
+	dead                func()                     // called when a keep-alive PING is missed.
 }
 
 // Close ends the connection, cleaning up relevant resources.
-// Close can be called multiple times safely.
+// Any queued frames are sent first, for a bounded time, and
+// streams still in progress fail with a ConnClosedError.
+// Close returns once the connection has closed, and can be
+// called multiple times safely.
 func (conn *connV2) Close() (err error) {
 	conn.Lock()
 	defer conn.Unlock()
@@ -56,20 +102,43 @@ func (conn *connV2) Close() (err error) {
 		return nil
 	}
 
-	// Inform the other endpoint that the connection is closing.
-	goaway := new(goawayFrameV2)
-	if conn.server != nil {
-		goaway.LastGoodStreamID = conn.lastRequestStreamID
-	} else {
-		goaway.LastGoodStreamID = conn.lastPushStreamID
+	// Another call is waiting for pending frames to be
+	// sent, so wait for it to finish closing the connection.
+	if conn.sending != nil {
+		conn.Unlock()
+		<-conn.stop
+		conn.Lock()
+		return nil
 	}
-	conn.output[0] <- goaway
 
-	// Ensure any pending frames are sent.
-	if conn.sending == nil {
-		conn.sending = make(chan struct{})
-		<-conn.sending
+	// Report the closure once the connection has been cleaned up.
+	defer func() {
+		conn.closeLock.Lock()
+		reason := conn.closeReason
+		conn.closeLock.Unlock()
+		conn.hooks.close(reason)
+	}()
+
+	// Inform the other endpoint that the connection is closing.
+	if !conn.shutdown.sent() {
+		goaway := new(goawayFrameV2)
+		goaway.LastGoodStreamID = conn.lastProcessedStreamID()
+		conn.queue(goaway)
+		conn.setShutdown(shutdownLocal)
+	}
+
+	// Ensure any pending frames are sent. The lock is
+	// released while waiting, so that frames are still
+	// read, as the other endpoint may not read the frames
+	// being sent until its own have been read.
+	conn.sending = make(chan struct{})
+	close(conn.closing)
+	conn.Unlock()
+	select {
+	case <-conn.sending:
+	case <-conn.sendStopped:
 	}
+	conn.Lock()
 
 	select {
 	case _ = <-conn.stop:
@@ -77,56 +146,439 @@ func (conn *connV2) Close() (err error) {
 		close(conn.stop)
 	}
 
-	err = conn.conn.Close()
-	if err != nil {
-		return err
+	// Outstanding pings will not be answered.
+	for pid, c := range conn.pings {
+		c <- Ping{Err: errConnClosed}
+		close(c)
+		delete(conn.pings, pid)
 	}
+
+	// Any pending frames have been sent, so end the
+	// session cleanly, unless the other endpoint has
+	// broken the protocol.
+	err = closeSocket(conn.conn, !conn.fatal, conn.clock)
+	conn.netLock.Lock()
 	conn.conn = nil
+	conn.netLock.Unlock()
 
-	for _, stream := range conn.streams {
-		err = stream.Close()
-		if err != nil {
-			return err
-		}
+	// Fail any streams still in progress.
+	for sid := range conn.streams {
+		conn.terminateStream(sid, conn.closeError(sid), 0)
 	}
 	conn.streams = nil
 
-	err = conn.compressor.Close()
-	if err != nil {
-		return err
+	if e := conn.compressor.Close(); err == nil {
+		err = e
 	}
 	conn.compressor = nil
 	conn.decompressor = nil
 
-	for _, stream := range conn.output {
-		select {
-		case _, ok := <-stream:
-			if ok {
-				close(stream)
-			}
-		default:
-			close(stream)
+	return err
+}
+
+// drain prevents any new streams from being created,
+// informs the other endpoint with a GOAWAY, and then
+// closes the connection once all active streams have
+// finished.
+func (conn *connV2) drain() {
+	conn.goAway()
+
+	// Wait for in-flight streams to finish.
+	for conn.activeStreams() > 0 {
+		if conn.closed() {
+			return
+		}
+		<-conn.clock.After(100 * time.Millisecond)
+	}
+
+	conn.Close()
+}
+
+// goAway prevents any new streams from being created,
+// and informs the other endpoint with a GOAWAY, without
+// affecting any active streams.
+func (conn *connV2) goAway() {
+	conn.Lock()
+	defer conn.Unlock()
+
+	if conn.closed() || conn.shutdown.sent() {
+		return
+	}
+
+	goaway := new(goawayFrameV2)
+	goaway.LastGoodStreamID = conn.lastProcessedStreamID()
+	conn.queue(goaway)
+	conn.setShutdown(shutdownLocal)
+}
+
+// lastProcessedStreamID returns the ID of the last
+// stream started by the other endpoint, as sent in
+// GOAWAY frames.
+func (conn *connV2) lastProcessedStreamID() StreamID {
+	if conn.server != nil {
+		return conn.lastRequestStreamID
+	}
+	return conn.lastPushStreamID
+}
+
+// nextLocalStreamID allocates the ID for a new stream
+// started by this endpoint, which is 1 or 2 for the
+// first stream, then increases by 2. This must be called
+// with the connection's lock held.
+func (conn *connV2) nextLocalStreamID() (StreamID, error) {
+	last := &conn.lastRequestStreamID
+	if conn.server != nil {
+		last = &conn.lastPushStreamID
+	}
+
+	next := *last + 2
+	if *last == 0 {
+		next = 2 - conn.oddity
+	}
+	if next > MAX_STREAM_ID {
+		return 0, ErrStreamIDsExhausted
+	}
+
+	*last = next
+	return next, nil
+}
+
+// validRemoteStreamID indicates whether the other endpoint
+// may start a stream with the given ID, which must not be
+// one of ours, and must be greater than the ID of the last
+// stream it started. IDs beyond MAX_STREAM_ID are checked
+// separately.
+func (conn *connV2) validRemoteStreamID(sid StreamID) bool {
+	if sid.Zero() || sid&1 == conn.oddity {
+		return false
+	}
+	return sid > conn.lastProcessedStreamID()
+}
+
+// activeStreams returns the number of streams
+// which have not yet been closed.
+func (conn *connV2) activeStreams() int {
+	conn.Lock()
+	defer conn.Unlock()
+
+	n := 0
+	for _, stream := range conn.streams {
+		if state := stream.State(); state != nil && !state.Closed() {
+			n++
+		}
+	}
+	return n
+}
+
+// requestCapacity returns the number of further requests
+// which can be sent before the server's limit on concurrent
+// streams is reached, and whether any more can be sent.
+func (conn *connV2) requestCapacity() (uint32, bool) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	if conn.shutdown != shutdownNone || conn.closed() {
+		return 0, false
+	}
+
+	// Finished streams free their slots.
+	conn.pruneStreams()
+	return conn.requestStreamLimit.Available(), true
+}
+
+// peerSettings returns a copy of the
+// settings received from the peer.
+func (conn *connV2) peerSettings() map[uint32]Setting {
+	conn.Lock()
+	defer conn.Unlock()
+
+	out := make(map[uint32]Setting, len(conn.receivedSettings))
+	for id, setting := range conn.receivedSettings {
+		out[id] = *setting
+	}
+	return out
+}
+
+// snapshot returns a copy of the connection's
+// current state.
+func (conn *connV2) snapshot() *ConnSnapshot {
+	snap := new(ConnSnapshot)
+	snap.Events, snap.SentSettings = conn.events.snapshot()
+	snap.Stats = conn.Stats()
+
+	conn.Lock()
+	defer conn.Unlock()
+
+	snap.ID = conn.id
+	snap.Version = 2
+	snap.RemoteAddr = conn.remoteAddr
+	snap.Server = conn.server != nil
+	snap.Uptime = conn.clock.Now().Sub(conn.started)
+	snap.GoawaySent = conn.shutdown.sent()
+	snap.GoawayReceived = conn.shutdown.received()
+	snap.BenignErrors = conn.numBenignErrors
+	snap.DroppedResets = conn.resets.dropped
+	snap.VersionErrors = conn.versionErrors
+	snap.PeerVersion = conn.peerVersion
+	snap.Settings = make([]Setting, 0, len(conn.receivedSettings))
+	for _, setting := range conn.receivedSettings.Settings() {
+		snap.Settings = append(snap.Settings, *setting)
+	}
+	snap.Streams = make([]StreamSnapshot, 0, len(conn.streams))
+	for sid, stream := range conn.streams {
+		state := stream.State()
+		if state == nil || state.Closed() {
+			continue
 		}
+		snap.Streams = append(snap.Streams, StreamSnapshot{ID: sid, State: state.String(), Tags: stream.Tags()})
+	}
+	sort.Sort(streamSnapshots(snap.Streams))
+	return snap
+}
+
+// Stats returns the connection's statistics.
+func (conn *connV2) Stats() *ConnStats {
+	stats := conn.stats.stats(frameNamesV2)
+	stats.ActiveStreams = conn.activeStreams()
+
+	conn.Lock()
+	defer conn.Unlock()
+
+	stats.BenignErrors = conn.numBenignErrors
+	stats.PingsOutstanding = len(conn.pings)
+	stats.Settings = make([]Setting, 0, len(conn.receivedSettings))
+	for _, setting := range conn.receivedSettings.Settings() {
+		stats.Settings = append(stats.Settings, *setting)
+	}
+	return stats
+}
+
+// setMaxConcurrentStreams sets the limit on
+// streams the other endpoint may open, which
+// is advertised when the connection starts.
+func (conn *connV2) setMaxConcurrentStreams(n uint32) {
+	if conn.server == nil {
+		conn.pushStreamLimit.SetLimit(n)
+	} else {
+		conn.requestStreamLimit.SetLimit(n)
+	}
+}
+
+// setHooks registers hooks to be informed
+// of events on the connection.
+func (conn *connV2) setHooks(hooks *ConnHooks) {
+	conn.Lock()
+	conn.hooks = newDispatcher(conn, hooks)
+	conn.Unlock()
+}
+
+// enableHeaderElision allows the connection to elide
+// request headers, once the server has advertised its
+// support.
+func (conn *connV2) enableHeaderElision() {
+	conn.Lock()
+	conn.elideHeaders = true
+	conn.Unlock()
+}
+
+// queue gives the frame to the send loop as a control
+// frame, which is sent ahead of any stream frames. queue
+// does not wait for the frame to be sent, so it may be
+// called from the read loop. If the send loop has exited,
+// the frame is dropped and errConnClosed is returned.
+func (conn *connV2) queue(frame Frame) error {
+	select {
+	case <-conn.sendStopped:
+		return errConnClosed
+	default:
 	}
 
-	runtime.Goexit()
+	if !conn.control.push(frame) {
+		conn.flooded()
+		return errControlFlood
+	}
 	return nil
 }
 
+// flooded closes the connection when its control frames
+// are not being sent, as the other endpoint is not reading
+// them. The socket is closed at once, without waiting for
+// the connection's lock, which may be held by the caller,
+// and the send and read loops then close the connection.
+func (conn *connV2) flooded() {
+	log.Printf("Error: Too many control frames are waiting to be sent to %s. Closing connection.\n", conn.remoteAddr)
+	conn.setCloseReason(errControlFlood)
+	conn.hooks.error(errControlFlood)
+
+	conn.netLock.Lock()
+	if conn.conn != nil {
+		conn.conn.Close()
+	}
+	conn.netLock.Unlock()
+}
+
+// setHandler sets the handler used to serve
+// requests, in place of the server's handler.
+func (conn *connV2) setHandler(handler http.Handler) {
+	conn.Lock()
+	conn.handler = handler
+	conn.Unlock()
+}
+
+// setResetFloodLimit sets the number of RST_STREAMs
+// for unknown streams processed per interval.
+func (conn *connV2) setResetFloodLimit(n int) {
+	conn.Lock()
+	conn.resets.limit = n
+	conn.Unlock()
+}
+
+// setLenientHeaders sets whether received header
+// blocks which break the specification's rules are
+// normalised, rather than rejected.
+func (conn *connV2) setLenientHeaders(lenient bool) {
+	conn.Lock()
+	defer conn.Unlock()
+	if d, ok := conn.decompressor.(*decompressor); ok {
+		d.setLenient(lenient)
+	}
+}
+
+// setMaxHeaders sets the maximum number of
+// HEADERS frames accepted on each stream.
+func (conn *connV2) setMaxHeaders(n int) {
+	conn.Lock()
+	conn.maxHeaders = n
+	conn.Unlock()
+}
+
 // InitialWindowSize gives the most recently-received value for
 // the INITIAL_WINDOW_SIZE setting.
 func (conn *connV2) InitialWindowSize() (uint32, error) {
-	return conn.initialWindowSize, nil
+	return atomic.LoadUint32(&conn.initialWindowSize), nil
+}
+
+// TLSState returns a copy of the state of the
+// connection's TLS session, or nil if the
+// connection is not using TLS.
+func (conn *connV2) TLSState() *tls.ConnectionState {
+	if conn.tlsState == nil {
+		return nil
+	}
+	state := *conn.tlsState
+	return &state
 }
 
 // Ping is used by spdy.PingServer and spdy.PingClient to send
 // SPDY PINGs.
 func (conn *connV2) Ping() (<-chan Ping, error) {
+	c, _, err := conn.ping()
+	return c, err
+}
+
+// setKeepAlive requests that a PING be sent whenever the
+// connection has received no frames for interval, closing
+// the connection if the reply takes longer than timeout.
+// This must be called before the connection is run.
+func (conn *connV2) setKeepAlive(interval, timeout time.Duration, dead func()) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	conn.pingInterval = interval
+	conn.pingWait = timeout
+	conn.dead = dead
+}
+
+// keepAlive sends PINGs while the connection is idle,
+// returning once the connection closes or begins to
+// go away. Any frame received resets the idle time,
+// so busy connections are not pinged.
+func (conn *connV2) keepAlive() {
+	labelGoroutine(connLabels(conn.id, conn.remoteAddr, "keepalive"))
+
+	for {
+		idle := conn.stats.idle(conn.started, conn.clock.Now())
+		if idle < conn.pingInterval {
+			select {
+			case <-conn.clock.After(conn.pingInterval - idle):
+				continue
+			case <-conn.stop:
+				return
+			}
+		}
+
+		switch err := conn.pingTimeout(conn.pingWait); err {
+		case nil:
+			continue
+		case ErrPingTimeout:
+			conn.keepAliveFailed()
+			return
+		default:
+			// The connection is closing.
+			return
+		}
+	}
+}
+
+// keepAliveFailed closes the connection after a missed
+// keep-alive PING. The peer is assumed to be unreachable,
+// so the session is not ended gracefully.
+func (conn *connV2) keepAliveFailed() {
+	conn.Lock()
+	if conn.closed() {
+		conn.Unlock()
+		return
+	}
+	log.Printf("Warning: No reply to keep-alive PING from %s within %s. Closing connection.\n", conn.remoteAddr, conn.pingWait)
+	conn.fatal = true
+	conn.conn.SetWriteDeadline(conn.clock.Now().Add(FATAL_ERROR_FLUSH_TIMEOUT))
+	conn.Unlock()
+
+	conn.setCloseReason(ErrPingTimeout)
+	conn.hooks.error(ErrPingTimeout)
+	if conn.dead != nil {
+		conn.dead()
+	}
+	conn.Close()
+}
+
+// pingTimeout sends a PING, waiting up to d for the reply.
+// If the reply does not arrive in time, the PING is
+// forgotten, so that a late reply is ignored.
+func (conn *connV2) pingTimeout(d time.Duration) error {
+	c, pid, err := conn.ping()
+	if err != nil {
+		return err
+	}
+
+	timer := conn.clock.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case ping, ok := <-c:
+		if !ok {
+			return errConnClosed
+		}
+		return ping.Err
+	case <-timer.C():
+		conn.Lock()
+		delete(conn.pings, pid)
+		conn.Unlock()
+		return ErrPingTimeout
+	}
+}
+
+// ping sends a PING, returning the channel on which
+// the reply will be given and the PING's ID.
+func (conn *connV2) ping() (<-chan Ping, uint32, error) {
 	conn.Lock()
 	defer conn.Unlock()
 
 	if conn.closed() {
-		return nil, errors.New("Error: Conn has been closed.")
+		return nil, 0, errors.New("Error: Conn has been closed.")
+	}
+	if conn.shutdown.received() {
+		return nil, 0, ErrDraining
 	}
 
 	ping := new(pingFrameV2)
@@ -141,29 +593,49 @@ func (conn *connV2) Ping() (<-chan Ping, error) {
 		conn.nextPingID += 2
 	}
 	ping.PingID = pid
-	conn.output[0] <- ping
+	if err := conn.queue(ping); err != nil {
+		return nil, 0, err
+	}
 	c := make(chan Ping, 1)
 	conn.pings[pid] = c
 
-	return c, nil
+	return c, pid, nil
 }
 
 // Push is used to issue a server push to the client. Note that this cannot be performed
 // by clients.
 func (conn *connV2) Push(resource string, origin Stream) (http.ResponseWriter, error) {
-	if conn.goaway {
-		return nil, errors.New("Error: GOAWAY received, so push could not be sent.")
+	if conn.shutdown != shutdownNone {
+		return nil, ErrDraining
 	}
 
 	if conn.server == nil {
 		return nil, errors.New("Error: Only servers can send pushes.")
 	}
 
+	// Pushes must be associated with an open stream.
+	if state := origin.State(); state == nil || state.ClosedHere() {
+		return nil, errors.New("Error: Origin stream is closed.")
+	}
+
+	// Finished streams free their slots.
+	conn.Lock()
+	conn.pruneStreams()
+	conn.Unlock()
+
 	// Check stream limit would allow the new stream.
 	if !conn.pushStreamLimit.Add() {
-		return nil, errors.New("Error: Max concurrent streams limit exceeded.")
+		return nil, ErrTooManyStreams
 	}
 
+	// Free the stream's slot if it is not sent.
+	sent := false
+	defer func() {
+		if !sent {
+			conn.pushStreamLimit.Close()
+		}
+	}()
+
 	// Parse and check URL.
 	url, err := url.Parse(resource)
 	if err != nil {
@@ -181,21 +653,27 @@ func (conn *connV2) Push(resource string, origin Stream) (http.ResponseWriter, e
 	push.Header = make(http.Header)
 	push.Header.Set("scheme", url.Scheme)
 	push.Header.Set("host", url.Host)
-	push.Header.Set("url", url.Path)
+	push.Header.Set("url", url.RequestURI())
 	push.Header.Set("version", "HTTP/1.1")
-	push.Header.Set(":status", "200 OK")
+	push.Header.Set("status", "200 OK")
 
 	// Send.
 	conn.Lock()
-	conn.lastPushStreamID += 2
-	if conn.lastPushStreamID > MAX_STREAM_ID {
-		conn.Unlock()
-		return nil, errors.New("Error: All server streams exhausted.")
+	defer conn.Unlock()
+
+	if conn.shutdown != shutdownNone {
+		return nil, ErrDraining
+	}
+
+	newID, err := conn.nextLocalStreamID()
+	if err != nil {
+		return nil, err
 	}
-	newID := conn.lastPushStreamID
 	push.StreamID = newID
-	conn.output[0] <- push
-	conn.Unlock()
+	if err := conn.queue(push); err != nil {
+		return nil, err
+	}
+	sent = true
 
 	// Create the pushStream.
 	out := new(pushStreamV2)
@@ -204,36 +682,52 @@ func (conn *connV2) Push(resource string, origin Stream) (http.ResponseWriter, e
 	out.origin = origin
 	out.state = new(StreamState)
 	out.output = conn.output[3]
+	out.priority = 3
 	out.header = make(http.Header)
 	out.stop = conn.stop
 
 	// Store in the connection map.
 	conn.streams[newID] = out
+	conn.stats.streamOpened()
 
 	return out, nil
 }
 
-// Request is used to make a client request.
+// Request is used to make a client request. If receiver
+// is nil, the stream is left open once any request body
+// has been sent, so that more data can be written to it,
+// and the response body is read from the stream itself,
+// as with a net.Conn.
 func (conn *connV2) Request(request *http.Request, receiver Receiver, priority Priority) (Stream, error) {
-	if conn.goaway {
-		return nil, errors.New("Error: GOAWAY received, so request could not be sent.")
-	}
-
 	if conn.server != nil {
 		return nil, errors.New("Error: Only clients can send requests.")
 	}
 
+	// Finished streams free their slots.
+	conn.Lock()
+	conn.pruneStreams()
+	conn.Unlock()
+
 	// Check stream limit would allow the new stream.
 	if !conn.requestStreamLimit.Add() {
-		return nil, errors.New("Error: Max concurrent streams limit exceeded.")
+		return nil, ErrTooManyStreams
 	}
 
+	// Free the stream's slot if it is not sent.
+	sent := false
+	defer func() {
+		if !sent {
+			conn.requestStreamLimit.Close()
+		}
+	}()
+
 	if !priority.Valid(2) {
 		return nil, errors.New("Error: Priority must be in the range 0 - 7.")
 	}
 
+	// An empty path is sent as "/", as by net/http.
 	url := request.URL
-	if url == nil || url.Scheme == "" || url.Host == "" || url.Path == "" {
+	if url == nil || url.Scheme == "" || url.Host == "" {
 		return nil, errors.New("Error: Incomplete path provided to resource.")
 	}
 
@@ -242,17 +736,28 @@ func (conn *connV2) Request(request *http.Request, receiver Receiver, priority P
 	syn.Priority = priority
 	syn.Header = request.Header
 	syn.Header.Set("method", request.Method)
-	syn.Header.Set("url", url.Path)
+	syn.Header.Set("url", url.RequestURI())
 	syn.Header.Set("version", "HTTP/1.1")
 	syn.Header.Set("host", url.Host)
 	syn.Header.Set("scheme", url.Scheme)
 
+	// Headers which cannot be sent fail the request now,
+	// rather than once its SYN_STREAM has been queued.
+	if err := checkHeaders(syn.Header); err != nil {
+		return nil, err
+	}
+
 	// Prepare the request body, if any.
 	body := make([]*dataFrameV2, 0, 1)
 	if request.Body != nil {
-		buf := make([]byte, 32*1024)
+		// Each read fills at most one DATA frame.
+		size := dataFrameSize()
+		if size > 32*1024 {
+			size = 32 * 1024
+		}
+		buf := make([]byte, size)
 		n, err := request.Body.Read(buf)
-		if err != nil {
+		if err != nil && err != io.EOF {
 			return nil, err
 		}
 		total := n
@@ -268,45 +773,61 @@ func (conn *connV2) Request(request *http.Request, receiver Receiver, priority P
 			total += n
 		}
 
-		// Half-close the stream.
-		if len(body) == 0 {
-			syn.Flags = FLAG_FIN
-		} else {
-			syn.Header.Set("Content-Length", fmt.Sprint(total))
-			body[len(body)-1].Flags = FLAG_FIN
+		// Half-close the stream, unless the
+		// rest is to be written to the stream.
+		if receiver != nil {
+			if len(body) == 0 {
+				syn.Flags = FLAG_FIN
+			} else {
+				syn.Header.Set("Content-Length", fmt.Sprint(total))
+				body[len(body)-1].Flags = FLAG_FIN
+			}
 		}
 		request.Body.Close()
-	} else {
+	} else if receiver != nil {
 		syn.Flags = FLAG_FIN
 	}
 
-	// Send.
+	// The GOAWAY check, stream ID allocation, and
+	// storing the stream must happen atomically, so
+	// that any GOAWAY received is guaranteed either
+	// to prevent the request or to see the stream.
 	conn.Lock()
-	if conn.lastRequestStreamID == 0 {
-		conn.lastRequestStreamID = 1
-	} else {
-		conn.lastRequestStreamID += 2
+	defer conn.Unlock()
+
+	if conn.shutdown != shutdownNone || conn.closed() {
+		return nil, ErrNotProcessed
 	}
-	if conn.lastRequestStreamID > MAX_STREAM_ID {
-		conn.Unlock()
-		return nil, errors.New("Error: All client streams exhausted.")
+
+	sid, err := conn.nextLocalStreamID()
+	if err != nil {
+		return nil, err
 	}
-	syn.StreamID = conn.lastRequestStreamID
-	conn.output[0] <- syn
-	for _, frame := range body {
-		frame.StreamID = syn.StreamID
-		conn.output[0] <- frame
+	syn.StreamID = sid
+
+	// Elide any headers repeated from the previous request.
+	if conn.elideHeaders && conn.peerElision {
+		syn.Header = cloneHeader(syn.Header)
+		full := cloneHeader(syn.Header)
+		elideHeaders(syn.Header, conn.lastHeader, 2)
+		conn.lastHeader = full
 	}
-	conn.Unlock()
 
-	// // Create the request stream.
+	// Create the request stream.
 	out := new(clientStreamV2)
 	out.conn = conn
 	out.streamID = syn.StreamID
 	out.state = new(StreamState)
-	out.state.CloseHere()
-	out.output = conn.output[0]
+	if receiver != nil {
+		out.state.CloseHere()
+	} else {
+		out.body = newRequestBody()
+		receiver = bodyReceiver{out.body}
+	}
+	out.output = conn.output[priority]
+	out.priority = priority
 	out.request = request
+	requestTags(&out.tags, request)
 	out.receiver = receiver
 	out.header = make(http.Header)
 	out.stop = conn.stop
@@ -314,24 +835,115 @@ func (conn *connV2) Request(request *http.Request, receiver Receiver, priority P
 
 	// Store in the connection map.
 	conn.streams[syn.StreamID] = out
+	conn.stats.streamOpened()
+
+	// Queue the SYN_STREAM before releasing the lock, so
+	// that streams are opened in the order of their IDs.
+	// This does not wait for the frame to be sent.
+	if err := conn.queue(syn); err != nil {
+		// Closing the stream frees its slot.
+		sent = true
+		conn.terminateStream(syn.StreamID, err, 0)
+		return nil, err
+	}
+	for _, frame := range body {
+		frame.StreamID = syn.StreamID
+		conn.queue(frame)
+	}
 
+	// Cancel the request if its context is done first.
+	cancelOnDone(request.Context().Done(), out, out.finished, conn.stop)
+
+	sent = true
 	return out, nil
 }
 
 func (conn *connV2) Run() error {
+	// Label the connection's goroutines for profiling.
+	labelGoroutine(connLabels(conn.id, conn.remoteAddr, "read"))
+
+	// Answer HTTP/1.x requests sent in place of SPDY
+	// before any frames are written.
+	if conn.server != nil {
+		if rejectHTTPProbe(conn.conn, conn.buf, conn.clock, 2) {
+			conn.Lock()
+			conn.init = nil
+			conn.setShutdown(shutdownLocal)
+			conn.Unlock()
+			conn.setCloseReason(ErrNotSPDY)
+			go conn.send()
+			return conn.Close()
+		}
+		conn.refreshReadTimeout()
+	}
+
 	// Start the send loop.
 	go conn.send()
 
-	// Prepare any initialisation frames.
-	if conn.init != nil {
-		conn.init()
+	// Start sending keep-alive PINGs, if requested.
+	if conn.pingInterval > 0 {
+		go conn.keepAlive()
 	}
 
 	// Enter the main loop.
 	conn.readFrames()
 
 	// Cleanup before the connection closes.
-	return conn.Close()
+	err := conn.Close()
+
+	// Report a fatal error, such as a protocol
+	// error, as the reason the connection ended.
+	if conn.isFatal() {
+		conn.closeLock.Lock()
+		err = conn.closeReason
+		conn.closeLock.Unlock()
+	}
+	return err
+}
+
+// closeError returns the error to be given to the
+// stream with the given ID when it is used after the
+// connection has closed. If the connection has not
+// closed, closeError returns nil.
+func (conn *connV2) closeError(sid StreamID) error {
+	if !conn.closed() {
+		return nil
+	}
+
+	conn.closeLock.Lock()
+	defer conn.closeLock.Unlock()
+
+	reason := conn.closeReason
+	if reason == nil {
+		reason = errConnClosed
+	}
+
+	return &ConnClosedError{
+		StreamID:     sid,
+		Reason:       reason,
+		Acknowledged: conn.shutdown.received() && sid <= conn.lastGoodStreamID,
+	}
+}
+
+// setCloseReason records the reason for the connection
+// closing. Only the first reason given is kept. This is
+// safe to call with or without the connection's lock.
+func (conn *connV2) setCloseReason(err error) {
+	conn.closeLock.Lock()
+	if conn.closeReason == nil {
+		conn.closeReason = err
+	}
+	conn.closeLock.Unlock()
+}
+
+// setShutdown records a GOAWAY having been sent or
+// received. This must be called with the connection's
+// lock held.
+func (conn *connV2) setShutdown(s shutdownState) {
+	conn.closeLock.Lock()
+	conn.shutdown |= s
+	debug.Printf("Connection %d is now %v.\n", conn.id, conn.shutdown)
+	conn.closeLock.Unlock()
 }
 
 // closed indicates whether the connection has
@@ -345,8 +957,31 @@ func (conn *connV2) closed() bool {
 	}
 }
 
-// handleClientData performs the processing of DATA frames sent by the client.
-func (conn *connV2) handleClientData(frame *dataFrameV2) {
+// netAddrs returns the local and remote addresses of
+// the underlying connection, which are nil once the
+// connection has closed.
+func (conn *connV2) netAddrs() (local, remote net.Addr) {
+	conn.Lock()
+	defer conn.Unlock()
+	if conn.conn == nil {
+		return nil, nil
+	}
+	return conn.conn.LocalAddr(), conn.conn.RemoteAddr()
+}
+
+// handleClientData performs the processing of DATA frames sent by the client.
+func (conn *connV2) handleClientData(frame *dataFrameV2) {
+	// The stream is given the frame once the connection's
+	// lock has been released, as the stream's lock must
+	// not be waited for with it held.
+	if stream := conn.clientDataStream(frame); stream != nil {
+		stream.ReceiveFrame(frame)
+	}
+}
+
+// clientDataStream checks a DATA frame sent by the client, and
+// returns the stream which should receive it, if any.
+func (conn *connV2) clientDataStream(frame *dataFrameV2) Stream {
 	conn.Lock()
 	defer conn.Unlock()
 
@@ -355,39 +990,52 @@ func (conn *connV2) handleClientData(frame *dataFrameV2) {
 	if conn.server == nil {
 		log.Println("Error: Requests can only be received by the server.")
 		conn.numBenignErrors++
-		return
+		return nil
 	}
 
-	// Handle push data.
-	if sid&1 != 0 {
+	// Check Stream ID is odd.
+	if sid&1 == 0 {
 		log.Printf("Error: Received DATA with Stream ID %d, which should be odd.\n", sid)
 		conn.numBenignErrors++
-		return
+		return nil
 	}
 
 	// Check stream ID is valid.
 	if !sid.Valid() {
-		log.Printf("Error: Received DATA with Stream ID %d, which exceeds the limit.\n", sid)
-		conn.protocolError(sid)
-		return
+		conn.protocolError(sid, ErrInvalidStreamID, "Error: Received DATA with Stream ID %d, which exceeds the limit.\n", sid)
+		return nil
 	}
 
 	// Check stream is open.
 	stream, ok := conn.streams[sid]
-	if !ok || stream == nil || stream.State().ClosedThere() {
-		log.Printf("Error: Received DATA with Stream ID %d, which is closed or unopened.\n", sid)
-		conn.numBenignErrors++
-		return
+	if !ok || closedThere(stream) {
+		// The client may have sent data before
+		// receiving our refusal of the stream.
+		if conn.refused.Discard(sid, len(frame.Data), conn.clock.Now()) {
+			return nil
+		}
+		conn.rejectFrame("DATA", sid)
+		return nil
 	}
 
 	// Stream ID is fine.
 
-	// Send data to stream.
-	stream.ReceiveFrame(frame)
+	return stream
 }
 
 // handleHeaders performs the processing of HEADERS frames.
 func (conn *connV2) handleHeaders(frame *headersFrameV2) {
+	// The stream is given the frame once the connection's
+	// lock has been released, as the stream's lock must
+	// not be waited for with it held.
+	if stream := conn.headersStream(frame); stream != nil {
+		stream.ReceiveFrame(frame)
+	}
+}
+
+// headersStream checks a HEADERS frame, and
+// returns the stream which should receive it, if any.
+func (conn *connV2) headersStream(frame *headersFrameV2) Stream {
 	conn.Lock()
 	defer conn.Unlock()
 
@@ -399,21 +1047,31 @@ func (conn *connV2) handleHeaders(frame *headersFrameV2) {
 		if req := conn.pushRequests[sid]; req != nil && conn.pushReceiver != nil {
 			conn.pushReceiver.ReceiveHeader(req, frame.Header)
 		}
-		return
+		return nil
 	}
 
 	// Check stream is open.
 	stream, ok := conn.streams[sid]
-	if !ok || stream == nil || stream.State().ClosedThere() {
-		log.Printf("Error: Received HEADERS with Stream ID %d, which is closed or unopened.\n", sid)
+	if !ok || closedThere(stream) {
+		conn.rejectFrame("HEADERS", sid)
+		return nil
+	}
+
+	// Check the stream has not sent too many HEADERS. The
+	// frame has already been decompressed, so the compression
+	// state remains valid.
+	conn.headerCounts[sid]++
+	if conn.headerCounts[sid] > conn.maxHeaders {
+		log.Printf("Error: Received more than %d HEADERS frames on stream %d, which exceeds the limit.\n",
+			conn.maxHeaders, sid)
 		conn.numBenignErrors++
-		return
+		conn.terminateStream(sid, &StreamError{sid, RST_STREAM_PROTOCOL_ERROR, false}, RST_STREAM_PROTOCOL_ERROR)
+		return nil
 	}
 
 	// Stream ID is fine.
 
-	// Send headers to stream.
-	stream.ReceiveFrame(frame)
+	return stream
 }
 
 // handlePush performs the processing of SYN_STREAM frames forming a server push.
@@ -422,7 +1080,7 @@ func (conn *connV2) handlePush(frame *synStreamFrameV2) {
 	defer conn.Unlock()
 
 	// Check stream creation is allowed.
-	if conn.goaway || conn.closed() {
+	if conn.shutdown != shutdownNone || conn.closed() {
 		return
 	}
 
@@ -434,42 +1092,68 @@ func (conn *connV2) handlePush(frame *synStreamFrameV2) {
 		return
 	}
 
-	// Check Stream ID is even.
-	if sid&1 != 0 {
-		log.Printf("Error: Received SYN_STREAM with Stream ID %d, which should be even.\n", sid)
+	// Check Stream ID is even and the right number.
+	if !conn.validRemoteStreamID(sid) {
+		log.Printf("Error: Received SYN_STREAM with Stream ID %d, which should be even and greater than %d.\n",
+			sid, conn.lastPushStreamID)
 		conn.numBenignErrors++
 		return
 	}
 
-	// Check Stream ID is the right number.
-	lsid := conn.lastPushStreamID
-	if sid <= lsid {
-		log.Printf("Error: Received SYN_STREAM with Stream ID %d, which should be greater than %d.\n", sid, lsid)
+	// Check Stream ID is not out of bounds.
+	if !sid.Valid() {
+		conn.protocolError(sid, ErrInvalidStreamID, "Error: Received SYN_STREAM with Stream ID %d, which exceeds the limit.\n", sid)
+		return
+	}
+
+	// Stream ID is fine.
+	conn.lastPushStreamID = sid
+
+	// Check the push is unidirectional.
+	if !frame.Flags.UNIDIRECTIONAL() {
+		log.Printf("Error: Received server push with Stream ID %d, which is not unidirectional.\n", sid)
+		rst := new(rstStreamFrameV2)
+		rst.StreamID = sid
+		rst.Status = RST_STREAM_PROTOCOL_ERROR
+		conn.queue(rst)
 		conn.numBenignErrors++
 		return
 	}
 
-	// Check Stream ID is not out of bounds.
-	if !sid.Valid() {
-		log.Printf("Error: Received SYN_STREAM with Stream ID %d, which exceeds the limit.\n", sid)
-		conn.protocolError(sid)
+	// Check the push is associated with an open request.
+	assoc := frame.AssocStreamID
+	origin, ok := conn.streams[assoc]
+	if assoc&1 == 0 || !ok || origin == nil || origin.State() == nil || origin.State().ClosedThere() {
+		log.Printf("Error: Received server push with Stream ID %d, associated with stream %d, which is not open.\n",
+			sid, assoc)
+		rst := new(rstStreamFrameV2)
+		rst.StreamID = sid
+		rst.Status = RST_STREAM_INVALID_STREAM
+		conn.queue(rst)
+		conn.numBenignErrors++
 		return
 	}
 
-	// Stream ID is fine.
+	// Cancel the push if there is nothing to receive it.
+	if conn.pushReceiver == nil {
+		rst := new(rstStreamFrameV2)
+		rst.StreamID = sid
+		rst.Status = RST_STREAM_CANCEL
+		conn.queue(rst)
+		return
+	}
 
 	// Check stream limit would allow the new stream.
 	if !conn.pushStreamLimit.Add() {
 		rst := new(rstStreamFrameV2)
 		rst.StreamID = sid
 		rst.Status = RST_STREAM_REFUSED_STREAM
-		conn.output[0] <- rst
+		conn.queue(rst)
 		return
 	}
 
 	if !frame.Priority.Valid(2) {
-		log.Printf("Error: Received SYN_STREAM with invalid priority %d.\n", frame.Priority)
-		conn.protocolError(sid)
+		conn.protocolError(sid, ErrInvalidFrame, "Error: Received SYN_STREAM with invalid priority %d.\n", frame.Priority)
 		return
 	}
 
@@ -505,20 +1189,23 @@ func (conn *connV2) handlePush(frame *synStreamFrameV2) {
 	}
 
 	// Check whether the receiver wants this resource.
-	if conn.pushReceiver != nil && !conn.pushReceiver.ReceiveRequest(request) {
+	if !conn.pushReceiver.ReceiveRequest(request) {
+		conn.pushStreamLimit.Close()
 		rst := new(rstStreamFrameV2)
 		rst.StreamID = sid
 		rst.Status = RST_STREAM_REFUSED_STREAM
-		conn.output[0] <- rst
+		conn.queue(rst)
 		return
 	}
 
+	// Record the push's origin, so it can be cancelled
+	// if the origin stream is.
+	conn.pushOrigins[sid] = frame.AssocStreamID
+
 	// Create and start new stream.
-	if conn.pushReceiver != nil {
-		conn.pushReceiver.ReceiveHeader(request, frame.Header)
-		conn.pushRequests[sid] = request
-		conn.lastPushStreamID = sid
-	}
+	conn.pushReceiver.ReceiveHeader(request, frame.Header)
+	conn.pushRequests[sid] = request
+	conn.stats.streamOpened()
 }
 
 // handleRequest performs the processing of SYN_STREAM request frames.
@@ -527,54 +1214,86 @@ func (conn *connV2) handleRequest(frame *synStreamFrameV2) {
 	defer conn.Unlock()
 
 	// Check stream creation is allowed.
-	if conn.goaway || conn.closed() {
+	if conn.closed() {
 		return
 	}
 
-	sid := frame.StreamID
+	// Restore any elided headers. This is done for every
+	// request, so that the remembered headers match those
+	// of the client.
+	if conn.restoreHeaders {
+		if err := restoreHeaders(frame.Header, conn.lastHeader); err != nil {
+			log.Println(err)
+			rst := new(rstStreamFrameV2)
+			rst.StreamID = frame.StreamID
+			rst.Status = RST_STREAM_PROTOCOL_ERROR
+			conn.queue(rst)
+			conn.numBenignErrors++
+			return
+		}
+		conn.lastHeader = cloneHeader(frame.Header)
+	}
 
-	if conn.server == nil {
-		log.Println("Error: Only servers can receive requests.")
+	if conn.shutdown != shutdownNone {
+		conn.refuseStream(frame.StreamID)
 		return
 	}
 
-	// Check Stream ID is odd.
-	if sid&1 == 0 {
-		log.Printf("Error: Received SYN_STREAM with Stream ID %d, which should be odd.\n", sid)
-		conn.numBenignErrors++
+	sid := frame.StreamID
+
+	if conn.server == nil {
+		log.Println("Error: Only servers can receive requests.")
 		return
 	}
 
-	// Check Stream ID is the right number.
-	lsid := conn.lastRequestStreamID
-	if sid <= lsid && lsid != 0 {
-		log.Printf("Error: Received SYN_STREAM with Stream ID %d, which should be greater than %d.\n", sid, lsid)
+	// Check Stream ID is odd and the right number.
+	if !conn.validRemoteStreamID(sid) {
+		log.Printf("Error: Received SYN_STREAM with Stream ID %d, which should be odd and greater than %d.\n",
+			sid, conn.lastRequestStreamID)
 		conn.numBenignErrors++
 		return
 	}
 
 	// Check Stream ID is not out of bounds.
 	if !sid.Valid() {
-		log.Printf("Error: Received SYN_STREAM with Stream ID %d, which exceeds the limit.\n", sid)
-		conn.protocolError(sid)
+		conn.protocolError(sid, ErrInvalidStreamID, "Error: Received SYN_STREAM with Stream ID %d, which exceeds the limit.\n", sid)
 		return
 	}
 
-	// Stream ID is fine.
+	// Stream ID is fine. It is used even if the
+	// stream is refused, so cannot be reused.
+	conn.lastRequestStreamID = sid
+
+	// Let the server decide whether to serve the
+	// stream, before it uses any other resources.
+	if conn.admit != nil {
+		if decision := conn.admit(frame.Header, frame.Priority, conn.remoteAddr); decision != AcceptStream {
+			info := refusedRequestInfo(sid, frame.Header, 2, decision)
+			if decision.Refuse {
+				conn.refuseStream(sid)
+			} else {
+				info.Status = rejectedStatus(decision.Status)
+				conn.rejectStream(sid, info.Status)
+			}
+			conn.hooks.refused(sid, decision)
+			conn.hooks.requestComplete(info)
+			return
+		}
+	}
+
+	// Finished streams free their slots.
+	conn.pruneStreams()
 
 	// Check stream limit would allow the new stream.
 	if !conn.requestStreamLimit.Add() {
-		rst := new(rstStreamFrameV2)
-		rst.StreamID = sid
-		rst.Status = RST_STREAM_REFUSED_STREAM
-		conn.output[0] <- rst
+		conn.refuseStream(sid)
 		return
 	}
 
 	// Check request priority.
 	if !frame.Priority.Valid(2) {
-		log.Printf("Error: Received SYN_STREAM with invalid priority %d.\n", frame.Priority)
-		conn.protocolError(sid)
+		conn.requestStreamLimit.Close()
+		conn.protocolError(sid, ErrInvalidFrame, "Error: Received SYN_STREAM with invalid priority %d.\n", frame.Priority)
 		return
 	}
 
@@ -586,17 +1305,156 @@ func (conn *connV2) handleRequest(frame *synStreamFrameV2) {
 	}
 
 	// Determine which handler to use.
-	nextStream.handler = conn.server.Handler
+	nextStream.handler = conn.handler
+	if nextStream.handler == nil {
+		nextStream.handler = conn.server.Handler
+	}
 	if nextStream.handler == nil {
 		nextStream.handler = http.DefaultServeMux
 	}
 
 	// Set and prepare.
 	conn.streams[sid] = nextStream
-	conn.lastRequestStreamID = sid
+	conn.stats.streamOpened()
+
+	// Start the stream, labelled for profiling.
+	labels := streamLabels(conn.id, conn.remoteAddr, sid)
+	ctx := context.WithValue(context.Background(), labelsKey{}, labels)
+	ctx = context.WithValue(ctx, pusherKey{}, labelPusher(nextStream))
+	ctx = context.WithValue(ctx, tagsKey{}, &nextStream.tags)
+	nextStream.request = nextStream.request.WithContext(ctx)
+	go pprof.Do(nextStream.request.Context(), labels, func(context.Context) {
+		nextStream.Run()
+	})
+}
+
+// refuseStream sends a RST_STREAM refusing the given
+// stream, and records the refusal so that any data the
+// peer has already sent on the stream is discarded.
+func (conn *connV2) refuseStream(sid StreamID) {
+	rst := new(rstStreamFrameV2)
+	rst.StreamID = sid
+	rst.Status = RST_STREAM_REFUSED_STREAM
+	conn.queue(rst)
+	conn.refused.Add(sid, conn.clock.Now())
+}
 
-	// Start the stream.
-	go nextStream.Run()
+// rejectStream replies to the stream with the given
+// status, which must be valid, and no body, without
+// running a handler, and records the stream as refused,
+// so that any request body the peer sends is discarded.
+func (conn *connV2) rejectStream(sid StreamID, status int) {
+	reply := new(synReplyFrameV2)
+	reply.StreamID = sid
+	reply.Flags = FLAG_FIN
+	reply.Header = make(http.Header)
+	reply.Header.Set("status", strconv.Itoa(status))
+	reply.Header.Set("version", "HTTP/1.1")
+	conn.queue(reply)
+	conn.refused.Add(sid, conn.clock.Now())
+}
+
+// resetStream sends a RST_STREAM with the given
+// status code, ending the stream locally. This is how
+// requests are cancelled: a request reset with CANCEL
+// fails with ErrStreamCancelled, and any pushes it has
+// caused are cancelled too. Otherwise, the stream's
+// owner is given a *StreamError.
+func (conn *connV2) resetStream(stream Stream, code StatusCode) error {
+	if code < RST_STREAM_PROTOCOL_ERROR || code > RST_STREAM_FLOW_CONTROL_ERROR {
+		return errors.New(fmt.Sprintf("Error: Invalid RST_STREAM status code %d for SPDY/2.", code))
+	}
+
+	conn.Lock()
+	defer conn.Unlock()
+
+	if state := stream.State(); conn.closed() || state == nil || state.Closed() {
+		return ErrStreamClosed
+	}
+
+	sid := stream.StreamID()
+	var err error = &StreamError{sid, code, false}
+	if stream, ok := stream.(*clientStreamV2); ok {
+		if code == RST_STREAM_CANCEL {
+			err = ErrStreamCancelled
+		}
+
+		// Readers of the response body see why it ended.
+		if stream.body != nil {
+			stream.body.discard(err)
+		}
+	}
+	conn.terminateStream(sid, err, code)
+	if code == RST_STREAM_CANCEL {
+		conn.cancelPushes(sid)
+	}
+	return nil
+}
+
+// terminateStream ends the stream with the given ID, and
+// removes it from the connection. It is the only way in
+// which streams are removed, so every stream is ended
+// with the same steps, in the same order:
+//
+//   - If code is not zero, a RST_STREAM is sent with that
+//     status code, and any frames the peer has already
+//     sent on the stream are discarded.
+//   - If err is not nil, it is given to the stream's owner.
+//   - The stream's state is closed, so that closing the
+//     stream sends nothing further.
+//   - The stream is closed, freeing its slot in the
+//     stream limit, and forgotten.
+//
+// A stream which has already been removed is only reset.
+// terminateStream must be called with the connection's
+// lock held.
+func (conn *connV2) terminateStream(sid StreamID, err error, code StatusCode) {
+	if code != 0 {
+		rst := new(rstStreamFrameV2)
+		rst.StreamID = sid
+		rst.Status = code
+		conn.queue(rst)
+		conn.refused.Add(sid, conn.clock.Now())
+	}
+
+	stream, ok := conn.streams[sid]
+	if !ok {
+		return
+	}
+
+	switch stream := stream.(type) {
+	case *clientStreamV2:
+		if err != nil {
+			stream.fail(err)
+		}
+	case *serverStreamV2:
+		stream.Lock()
+		if stream.closeErr == nil {
+			stream.closeErr = err
+		}
+		stream.Unlock()
+	case *pushStreamV2:
+		stream.Lock()
+		if stream.closeErr == nil {
+			stream.closeErr = err
+		}
+		stream.Unlock()
+	}
+	closeState(stream)
+	stream.Close()
+	delete(conn.streams, sid)
+	delete(conn.headerCounts, sid)
+}
+
+// pruneStreams removes the streams which have closed at
+// both ends, freeing their slots in the stream limits.
+// This must be called with the connection's lock held.
+func (conn *connV2) pruneStreams() {
+	for sid, stream := range conn.streams {
+		if state := stream.State(); state != nil && state.Closed() {
+			conn.terminateStream(sid, nil, 0)
+		}
+	}
 }
 
 // handleRstStream performs the processing of RST_STREAM frames.
@@ -606,19 +1464,30 @@ func (conn *connV2) handleRstStream(frame *rstStreamFrameV2) {
 
 	sid := frame.StreamID
 
+	// RST_STREAMs for streams which were never opened are
+	// rate-limited, and only a flood of them counts towards
+	// the benign error budget, as a single error.
+	if _, ok := conn.streams[sid]; !ok {
+		allow, flooding := conn.resets.Allow(conn.clock.Now())
+		if flooding {
+			log.Println("Warning: Flood of RST_STREAM frames for unknown streams. Dropping excess.")
+			conn.numBenignErrors++
+		}
+		if !allow {
+			return
+		}
+		defer func(n int) { conn.numBenignErrors = n }(conn.numBenignErrors)
+	}
+
 	// Determine the status code and react accordingly.
 	switch frame.Status {
 	case RST_STREAM_INVALID_STREAM:
 		log.Printf("Error: Received INVALID_STREAM for stream ID %d.\n", sid)
-		if stream, ok := conn.streams[sid]; ok {
-			stream.Close()
-		}
+		conn.terminateStream(sid, &StreamError{sid, frame.Status, true}, 0)
 		conn.numBenignErrors++
 
 	case RST_STREAM_REFUSED_STREAM:
-		if stream, ok := conn.streams[sid]; ok {
-			stream.Close()
-		}
+		conn.terminateStream(sid, &StreamError{sid, frame.Status, true}, 0)
 
 	case RST_STREAM_CANCEL:
 		if sid&1 == conn.oddity {
@@ -626,9 +1495,8 @@ func (conn *connV2) handleRstStream(frame *rstStreamFrameV2) {
 			conn.numBenignErrors++
 			return
 		}
-		if stream, ok := conn.streams[sid]; ok {
-			stream.Close()
-		}
+		conn.terminateStream(sid, &StreamError{sid, frame.Status, true}, 0)
+		conn.cancelPushes(sid)
 
 	case RST_STREAM_FLOW_CONTROL_ERROR:
 		log.Printf("Error: Received FLOW_CONTROL_ERROR for stream ID %d.\n", sid)
@@ -641,9 +1509,7 @@ func (conn *connV2) handleRstStream(frame *rstStreamFrameV2) {
 
 	case RST_STREAM_STREAM_ALREADY_CLOSED:
 		log.Printf("Error: Received STREAM_ALREADY_CLOSED for stream ID %d.\n", sid)
-		if stream, ok := conn.streams[sid]; ok {
-			stream.Close()
-		}
+		conn.terminateStream(sid, &StreamError{sid, frame.Status, true}, 0)
 		conn.numBenignErrors++
 
 	case RST_STREAM_INVALID_CREDENTIALS:
@@ -651,13 +1517,113 @@ func (conn *connV2) handleRstStream(frame *rstStreamFrameV2) {
 		conn.numBenignErrors++
 
 	default:
-		log.Printf("Error: Received unknown RST_STREAM status code %d.\n", frame.Status)
-		conn.protocolError(sid)
+		conn.protocolError(sid, ErrInvalidFrame, "Error: Received unknown RST_STREAM status code %d.\n", frame.Status)
 	}
 }
 
+// cancelPushes resets any unfinished server pushes
+// associated with the given origin stream. Clients
+// only reset pushes which have not been accepted by
+// the push Receiver. This must be called with the
+// connection's lock held.
+func (conn *connV2) cancelPushes(origin StreamID) {
+	if conn.server == nil {
+		for sid, assoc := range conn.pushOrigins {
+			if assoc != origin || conn.pushRequests[sid] != nil {
+				continue
+			}
+
+			rst := new(rstStreamFrameV2)
+			rst.StreamID = sid
+			rst.Status = RST_STREAM_CANCEL
+			conn.queue(rst)
+			delete(conn.pushOrigins, sid)
+		}
+		return
+	}
+
+	for sid, stream := range conn.streams {
+		push, ok := stream.(*pushStreamV2)
+		if !ok || push.origin == nil || push.origin.StreamID() != origin {
+			continue
+		}
+
+		// Completed pushes are left alone.
+		if state := push.State(); state == nil || state.ClosedHere() {
+			continue
+		}
+
+		debug.Printf("Cancelling push stream %d, as origin stream %d was cancelled.\n", sid, origin)
+		conn.terminateStream(sid, nil, RST_STREAM_CANCEL)
+	}
+}
+
+// failPushes resets the unfinished server pushes whose
+// origin streams are above lastProcessed, which the server
+// will not complete, giving err to the push Receiver. This
+// must be called with the connection's lock held.
+func (conn *connV2) failPushes(lastProcessed StreamID, err error) {
+	for sid, assoc := range conn.pushOrigins {
+		if assoc <= lastProcessed {
+			continue
+		}
+
+		debug.Printf("Cancelling push stream %d, as origin stream %d was not processed.\n", sid, assoc)
+		rst := new(rstStreamFrameV2)
+		rst.StreamID = sid
+		rst.Status = RST_STREAM_CANCEL
+		conn.queue(rst)
+		if req := conn.pushRequests[sid]; req != nil && conn.pushReceiver != nil {
+			receivePushError(conn.pushReceiver, req, err)
+		}
+		delete(conn.pushOrigins, sid)
+		delete(conn.pushRequests, sid)
+	}
+}
+
+// cancelRequest is called when a request is cancelled
+// by the client, resetting any associated pushes which
+// have not been accepted. Any response frames the server
+// sent before receiving the reset are discarded.
+func (conn *connV2) cancelRequest(origin StreamID) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	if conn.closed() {
+		return
+	}
+	conn.refused.Add(origin, conn.clock.Now())
+	conn.cancelPushes(origin)
+}
+
 // handleServerData performs the processing of DATA frames sent by the server.
 func (conn *connV2) handleServerData(frame *dataFrameV2) {
+	// The stream is given the frame once the connection's
+	// lock has been released, as the stream's lock must
+	// not be waited for with it held.
+	if stream := conn.serverDataStream(frame); stream != nil {
+		if err := stream.ReceiveFrame(frame); err == errNoReply {
+			conn.replyMissing(frame.StreamID)
+		}
+	}
+}
+
+// replyMissing resets the request stream with the given ID
+// with a PROTOCOL_ERROR, as the server sent response data
+// before the SYN_REPLY, so the response has no status.
+func (conn *connV2) replyMissing(sid StreamID) {
+	log.Printf("Error: Received DATA with Stream ID %d before its SYN_REPLY.\n", sid)
+
+	conn.Lock()
+	defer conn.Unlock()
+
+	conn.numBenignErrors++
+	conn.terminateStream(sid, &StreamError{sid, RST_STREAM_PROTOCOL_ERROR, false}, RST_STREAM_PROTOCOL_ERROR)
+}
+
+// serverDataStream checks a DATA frame sent by the server, and
+// returns the stream which should receive it, if any.
+func (conn *connV2) serverDataStream(frame *dataFrameV2) Stream {
 	conn.Lock()
 	defer conn.Unlock()
 
@@ -667,27 +1633,45 @@ func (conn *connV2) handleServerData(frame *dataFrameV2) {
 	if sid&1 == 0 {
 		// Ignore refused push data.
 		if req := conn.pushRequests[sid]; req != nil && conn.pushReceiver != nil {
-			conn.pushReceiver.ReceiveData(req, frame.Data, frame.Flags.FIN())
+			data := receivedData(conn.pushReceiver, frame.Data, frame.payload != nil)
+			conn.pushReceiver.ReceiveData(req, data, frame.Flags.FIN())
 		}
-		return
+		if frame.Flags.FIN() {
+			delete(conn.pushOrigins, sid)
+		}
+		return nil
 	}
 
 	// Check stream is open.
 	stream, ok := conn.streams[sid]
-	if !ok || stream == nil || stream.State().ClosedThere() {
-		log.Printf("Error: Received DATA with Stream ID %d, which is closed or unopened.\n", sid)
-		conn.numBenignErrors++
-		return
+	if !ok || closedThere(stream) {
+		// The server may have sent data before
+		// receiving our reset of the stream.
+		if conn.refused.Discard(sid, len(frame.Data), conn.clock.Now()) {
+			return nil
+		}
+		conn.rejectFrame("DATA", sid)
+		return nil
 	}
 
 	// Stream ID is fine.
 
-	// Send data to stream.
-	stream.ReceiveFrame(frame)
+	return stream
 }
 
 // handleSynReply performs the processing of SYN_REPLY frames.
 func (conn *connV2) handleSynReply(frame *synReplyFrameV2) {
+	// The stream is given the frame once the connection's
+	// lock has been released, as the stream's lock must
+	// not be waited for with it held.
+	if stream := conn.synReplyStream(frame); stream != nil {
+		stream.ReceiveFrame(frame)
+	}
+}
+
+// synReplyStream checks a SYN_REPLY frame, and
+// returns the stream which should receive it, if any.
+func (conn *connV2) synReplyStream(frame *synReplyFrameV2) Stream {
 	conn.Lock()
 	defer conn.Unlock()
 
@@ -696,33 +1680,36 @@ func (conn *connV2) handleSynReply(frame *synReplyFrameV2) {
 	if conn.server != nil {
 		log.Println("Error: Only clients can receive SYN_REPLY frames.")
 		conn.numBenignErrors++
-		return
+		return nil
 	}
 
 	// Check Stream ID is odd.
 	if sid&1 == 0 {
 		log.Printf("Error: Received SYN_REPLY with Stream ID %d, which should be odd.\n", sid)
 		conn.numBenignErrors++
-		return
+		return nil
 	}
 
 	if !sid.Valid() {
-		log.Printf("Error: Received SYN_REPLY with Stream ID %d, which exceeds the limit.\n", sid)
-		conn.protocolError(sid)
-		return
+		conn.protocolError(sid, ErrInvalidStreamID, "Error: Received SYN_REPLY with Stream ID %d, which exceeds the limit.\n", sid)
+		return nil
 	}
 
 	// Check stream is open.
-	if stream, ok := conn.streams[sid]; !ok || stream == nil || stream.State().ClosedThere() {
-		log.Printf("Error: Received SYN_REPLY with Stream ID %d, which is closed or unopened.\n", sid)
-		conn.numBenignErrors++
-		return
+	stream, ok := conn.streams[sid]
+	if !ok || closedThere(stream) {
+		// The server may have replied before
+		// receiving our reset of the stream.
+		if conn.refused.Discard(sid, 0, conn.clock.Now()) {
+			return nil
+		}
+		conn.rejectFrame("SYN_REPLY", sid)
+		return nil
 	}
 
 	// Stream ID is fine.
 
-	// Send headers to stream.
-	conn.streams[sid].ReceiveFrame(frame)
+	return stream
 }
 
 // newStream is used to create a new serverStream from a SYN_STREAM frame.
@@ -732,12 +1719,15 @@ func (conn *connV2) newStream(frame *synStreamFrameV2, output chan<- Frame) *ser
 	stream.streamID = frame.StreamID
 	stream.state = new(StreamState)
 	stream.output = output
+	stream.priority = frame.Priority
 	stream.header = make(http.Header)
 	stream.unidirectional = frame.Flags.UNIDIRECTIONAL()
 	stream.stop = conn.stop
+	stream.requestBody = newRequestBody()
 
 	if frame.Flags.FIN() {
 		stream.state.CloseThere()
+		stream.requestBody.finish(nil)
 	}
 
 	header := frame.Header
@@ -770,20 +1760,326 @@ func (conn *connV2) newStream(frame *synStreamFrameV2, output chan<- Frame) *ser
 		Host:       url.Host,
 		RequestURI: url.Path,
 		TLS:        conn.tlsState,
+		Body:       stream.requestBody,
 	}
 
 	return stream
 }
 
 // protocolError informs the other endpoint that a protocol error has
-// occurred, stops all running streams, and ends the connection.
-func (conn *connV2) protocolError(streamID StreamID) {
+// occurred, and marks the connection as fatally errored. The read loop
+// processes no further frames, and ends the connection, stopping any
+// running streams once the queued frames have been sent. Errors
+// on a particular stream are sent in a RST_STREAM, but the connection
+// stream (stream 0) is never reset. Since SPDY/2's GOAWAY has no status
+// code, connection errors are indicated only by the GOAWAY itself.
+//
+// The error is logged, using format and v as in log.Printf, and
+// recorded as the reason for the connection closing, as a
+// ProtocolError of the given kind, such as ErrInvalidStreamID.
+func (conn *connV2) protocolError(streamID StreamID, kind error, format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	log.Output(2, msg)
+	err := &ProtocolError{StreamID: streamID, Err: kind, Msg: strings.TrimSpace(msg)}
+
+	if !streamID.Zero() {
+		reply := new(rstStreamFrameV2)
+		reply.StreamID = streamID
+		reply.Status = RST_STREAM_PROTOCOL_ERROR
+		conn.queue(reply)
+	}
+
+	conn.setCloseReason(err)
+	conn.hooks.error(err)
+	conn.fatal = true
+}
+
+// internalError ends the connection after a panic while
+// handling a frame, informing the other endpoint with a
+// GOAWAY. SPDY/2's GOAWAY has no status code, so cannot
+// give the reason. The panic is logged, and ErrInternal
+// is recorded as the reason for the connection closing.
+// Like protocolError, this marks the connection as fatally
+// errored, so the read loop processes no further frames.
+// This must be called without the connection's lock.
+func (conn *connV2) internalError(v interface{}) {
+	buf := make([]byte, 64<<10)
+	buf = buf[:runtime.Stack(buf, false)]
+	log.Printf("Error: Panic handling frame: %v\n%s", v, buf)
+
+	conn.Lock()
+	defer conn.Unlock()
+
+	if !conn.shutdown.sent() {
+		goaway := new(goawayFrameV2)
+		goaway.LastGoodStreamID = conn.lastProcessedStreamID()
+		conn.queue(goaway)
+		conn.setShutdown(shutdownLocal)
+	}
+
+	conn.setCloseReason(ErrInternal)
+	conn.hooks.error(ErrInternal)
+	conn.fatal = true
+}
+
+// streamOpened indicates whether the stream with
+// the given ID has been opened, by either endpoint.
+// This must be called with the connection's lock held.
+func (conn *connV2) streamOpened(sid StreamID) bool {
+	if sid&1 == 1 {
+		return sid <= conn.lastRequestStreamID
+	}
+	return sid <= conn.lastPushStreamID
+}
+
+// rejectFrame responds to a frame of the given type
+// received on a stream which is closed or unopened,
+// resetting the stream with STREAM_ALREADY_CLOSED or
+// INVALID_STREAM respectively, and counting a benign
+// error. This must be called with the connection's
+// lock held.
+//
+// SPDY/2 has no STREAM_ALREADY_CLOSED status, so
+// INVALID_STREAM is used in each case.
+func (conn *connV2) rejectFrame(name string, sid StreamID) {
 	reply := new(rstStreamFrameV2)
-	reply.StreamID = streamID
-	reply.Status = RST_STREAM_PROTOCOL_ERROR
-	conn.output[0] <- reply
+	reply.StreamID = sid
+	if conn.streamOpened(sid) {
+		log.Printf("Error: Received %s with Stream ID %d, which is closed.\n", name, sid)
+		reply.Status = RST_STREAM_INVALID_STREAM
+	} else {
+		log.Printf("Error: Received %s with Stream ID %d, which is unopened.\n", name, sid)
+		reply.Status = RST_STREAM_INVALID_STREAM
+	}
+	conn.queue(reply)
+	conn.numBenignErrors++
+}
 
-	conn.Close()
+// handleSettings performs the processing of SETTINGS frames.
+func (conn *connV2) handleSettings(frame *settingsFrameV2) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	// Settings the server asked us to persist are
+	// forgotten if it now asks us to clear them.
+	client := conn.server == nil
+	if client && frame.Flags.CLEAR_SETTINGS() && conn.settingsStore != nil {
+		debug.Printf("Clearing persisted settings for %s.\n", conn.origin)
+		conn.settingsStore.Clear(conn.origin)
+	}
+
+	var persist Settings
+	applied := make(map[uint32]Setting, len(frame.Settings))
+	for _, setting := range frame.Settings {
+		if setting.ID == 0 {
+			log.Println("Warning: Ignored setting with ID 0.")
+			conn.numBenignErrors++
+			continue
+		}
+
+		// Persisted settings sent by a client are the values
+		// we advertised on a previous connection, so they do
+		// not describe the client.
+		if !client && setting.Flags.PERSISTED() {
+			debug.Printf("Received persisted setting %d of %d.\n", setting.ID, setting.Value)
+			continue
+		}
+
+		// Unrecognised settings are only persisted
+		// if the Transport allows it.
+		if client && setting.Flags.PERSIST_VALUE() && conn.settingsStore != nil &&
+			(setting.Recognised() || conn.persistUnrecognised) {
+			if persist == nil {
+				persist = make(Settings)
+			}
+			persist[setting.ID] = setting
+		}
+
+		// Header elision is experimental, so is handled
+		// before unrecognised settings are skipped.
+		if setting.ID == SETTINGS_EXPERIMENTAL_HEADER_ELISION && client {
+			conn.peerElision = setting.Value != 0
+		}
+
+		// Unrecognised settings are kept, but not acted upon.
+		conn.receivedSettings[setting.ID] = setting
+		applied[setting.ID] = *setting
+		if !setting.Recognised() {
+			debug.Printf("Received unrecognised setting %d.\n", setting.ID)
+			continue
+		}
+
+		switch setting.ID {
+		case SETTINGS_INITIAL_WINDOW_SIZE:
+			debug.Printf("Initial window size is %d.\n", setting.Value)
+			atomic.StoreUint32(&conn.initialWindowSize, setting.Value)
+
+		case SETTINGS_MAX_CONCURRENT_STREAMS:
+			if client {
+				conn.requestStreamLimit.SetLimit(setting.Value)
+			} else {
+				conn.pushStreamLimit.SetLimit(setting.Value)
+			}
+		}
+	}
+
+	if persist != nil {
+		persistSettings(conn.settingsStore, conn.origin, persist)
+	}
+	conn.hooks.settings(applied)
+}
+
+// setSettingsStore sets the store in which the server's
+// persisted SETTINGS are kept, and applies any already
+// persisted until the server's own arrive. Unrecognised
+// settings are only persisted if unrecognised is set.
+// This must be called before Run.
+func (conn *connV2) setSettingsStore(store SettingsStore, origin string, unrecognised bool) {
+	conn.Lock()
+	conn.settingsStore = store
+	conn.origin = origin
+	conn.persistUnrecognised = unrecognised
+	conn.persistedSettings = store.Get(origin)
+	conn.Unlock()
+
+	if len(conn.persistedSettings) > 0 {
+		frame := new(settingsFrameV2)
+		frame.Settings = conn.persistedSettings
+		conn.handleSettings(frame)
+	}
+}
+
+// handleVersionMismatch responds to a frame with the wrong
+// SPDY version, which has been skipped. If the frame was
+// scoped to a stream, the stream is reset with
+// UNSUPPORTED_VERSION. Otherwise, the connection is ended
+// with a PROTOCOL_ERROR once more than MaxVersionErrors
+// such frames have been received.
+func (conn *connV2) handleVersionMismatch(mismatch *versionMismatch) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	conn.peerVersion = mismatch.Version
+
+	sid := mismatch.StreamID
+	if !sid.Zero() {
+		log.Printf("Error: Received frame on stream %d with unsupported SPDY version %d.\n", sid, mismatch.Version)
+		conn.terminateStream(sid, &StreamError{sid, RST_STREAM_UNSUPPORTED_VERSION, false}, RST_STREAM_UNSUPPORTED_VERSION)
+		return
+	}
+
+	conn.versionErrors++
+	if conn.versionErrors > MaxVersionErrors {
+		conn.protocolError(0, ErrUnsupportedVersion, "Error: Received %d frames with unsupported SPDY version %d. Ending connection.\n",
+			conn.versionErrors, mismatch.Version)
+		return
+	}
+	log.Printf("Error: Received frame with unsupported SPDY version %d.\n", mismatch.Version)
+}
+
+// rejectHeaders is used to reject a frame whose
+// header block is invalid, resetting its stream
+// with a PROTOCOL_ERROR, but leaving the rest of
+// the connection unaffected.
+func (conn *connV2) rejectHeaders(frame Frame) {
+	sid, scoped := streamIDV2(frame)
+	if !scoped || sid.Zero() {
+		return
+	}
+
+	conn.Lock()
+	defer conn.Unlock()
+	conn.terminateStream(sid, &StreamError{sid, RST_STREAM_PROTOCOL_ERROR, false}, RST_STREAM_PROTOCOL_ERROR)
+}
+
+// headerDecompressor returns the connection's decompressor,
+// or nil once the connection has closed.
+func (conn *connV2) headerDecompressor() Decompressor {
+	conn.Lock()
+	defer conn.Unlock()
+	return conn.decompressor
+}
+
+// decompressionError ends the session after a header
+// block in the given frame could not be decompressed.
+func (conn *connV2) decompressionError(frame Frame, err error) {
+	kind := ErrInvalidFrame
+	if err == ErrHeaderBlockTooLarge {
+		kind = err
+	}
+	conn.Lock()
+	defer conn.Unlock()
+	conn.protocolError(0, kind, "Error in decompression: %v (%T).\n", err, frame)
+}
+
+// benignError records an error which only ends the
+// connection once more than MaxBenignErrors occur.
+func (conn *connV2) benignError() {
+	conn.Lock()
+	defer conn.Unlock()
+	conn.numBenignErrors++
+}
+
+// handlePing replies to a PING from the other endpoint, or
+// completes the PING it answers. handlePing reports false
+// if the frame has been queued as a reply, in which case
+// it must not be recycled.
+func (conn *connV2) handlePing(frame *pingFrameV2) bool {
+	// Check whether Ping ID is a response.
+	if frame.PingID&1 != conn.nextPingID&1 {
+		debug.Println("Received PING. Replying...")
+		conn.queue(frame)
+		return false
+	}
+
+	conn.Lock()
+	defer conn.Unlock()
+	c := conn.pings[frame.PingID]
+	if c == nil {
+		log.Printf("Warning: Ignored PING with Ping ID %d, which hasn't been requested.\n",
+			frame.PingID)
+		conn.numBenignErrors++
+		return true
+	}
+	delete(conn.pings, frame.PingID)
+	c <- Ping{}
+	close(c)
+	return true
+}
+
+// handleGoaway ends the streams which the other endpoint
+// has not processed, and prevents new streams, once it
+// has sent a GOAWAY.
+func (conn *connV2) handleGoaway(frame *goawayFrameV2) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	lastProcessed := frame.LastGoodStreamID
+	for streamID := range conn.streams {
+		if streamID&1 == conn.oddity && streamID > lastProcessed {
+			// Stream is locally-sent and has not been processed.
+			// TODO: Inform the server that the push has not been successful.
+			conn.terminateStream(streamID, ErrNotProcessed, 0)
+
+			// Pushes for the request will not be completed.
+			conn.cancelPushes(streamID)
+		}
+	}
+	conn.failPushes(lastProcessed, ErrDraining)
+
+	// Outstanding pings will not be answered.
+	for pid, c := range conn.pings {
+		c <- Ping{Err: ErrDraining}
+		close(c)
+		delete(conn.pings, pid)
+	}
+
+	conn.closeLock.Lock()
+	conn.lastGoodStreamID = lastProcessed
+	conn.closeLock.Unlock()
+	conn.setShutdown(shutdownRemote)
+	conn.setCloseReason(ErrGoAway)
+	conn.hooks.goaway(lastProcessed)
 }
 
 // readFrames is the main processing loop, where frames
@@ -791,199 +2087,352 @@ func (conn *connV2) protocolError(streamID StreamID) {
 // Returning from readFrames begins the cleanup and exit
 // process for this connection.
 func (conn *connV2) readFrames() {
+	// Frames with headers, and those which must be handled
+	// after them, are handled by the header loop, so that
+	// other frames do not wait for the headers' decompression.
+	headers := newHeaderQueue()
+	defer close(headers.frames)
+	go conn.headerLoop(headers)
+
 	// Main loop.
 Loop:
 	for {
 
 		// This is the mechanism for handling too many benign errors.
 		// Default MaxBenignErrors is 10.
+		conn.Lock()
 		if conn.numBenignErrors > MaxBenignErrors {
-			log.Println("Error: Too many invalid stream IDs received. Ending connection.")
-			conn.protocolError(0)
+			conn.protocolError(0, ErrTooManyBenignErrors, "Error: Too many benign errors received. Ending connection.")
 		}
 
+		// Stop once a fatal error has occurred, leaving
+		// a short time for the error to be sent.
+		if conn.fatal {
+			if conn.conn != nil {
+				conn.conn.SetWriteDeadline(conn.clock.Now().Add(FATAL_ERROR_FLUSH_TIMEOUT))
+			}
+			conn.Unlock()
+			return
+		}
+		conn.Unlock()
+
 		// ReadFrame takes care of the frame parsing for us.
-		frame, err := readFrameV2(conn.buf)
-		conn.refreshReadTimeout()
+		frame, err := readFrameV2(conn.buf, conn.frames, frameSizeLimit())
+
+		// The header loop may have hit a fatal error, and
+		// interrupted the read to stop the read loop.
+		if conn.isFatal() {
+			continue Loop
+		}
+
+		// A SETTINGS frame with ID 0 is handled without
+		// that setting, as a benign error.
+		if err == settingIdIsZero {
+			log.Println("Warning: Ignored setting with ID 0.")
+			conn.benignError()
+			err = nil
+		}
+
+		if err == nil {
+			conn.refreshReadTimeout()
+			conn.stats.received(frameTypeV2(frame), conn.clock.Now())
+			conn.stats.sizes(frameSizesV2(frame))
+			conn.events.frameReceived(conn.clock.Now(), frame)
+		}
 		if err != nil {
-			if err == io.EOF {
-				// Client has closed the TCP connection.
-				debug.Println("Note: Endpoint has disconnected.")
+			if reason, ok := teardownError(err); ok {
+				// The TCP connection has been closed or timed out.
+				debug.Printf("Note: Connection closed: %v\n", err)
+				conn.setCloseReason(reason)
 				conn.Close()
 				return
 			}
 
+			// Frames with the wrong version are skipped.
+			if mismatch, ok := err.(*versionMismatch); ok {
+				conn.handleVersionMismatch(mismatch)
+				continue Loop
+			}
+
+			// Control frames of unknown types are ignored.
+			if unknown, ok := err.(*unknownFrame); ok {
+				debug.Printf("Note: Ignored control frame with unknown type %d.\n", unknown.Type)
+				continue Loop
+			}
+
+			// Oversized and malformed frames end the session.
+			switch err.(type) {
+			case *oversizedFrame, *malformedFrame:
+				conn.Lock()
+				conn.protocolError(0, errors.Unwrap(err), "%v\n", err)
+				conn.Unlock()
+				continue Loop
+			}
+
+			// Stream-scoped frames may not use the connection stream.
+			if err == streamIdIsZero {
+				conn.Lock()
+				conn.protocolError(0, ErrInvalidStreamID, "Error: Received stream-scoped frame with Stream ID 0.")
+				conn.Unlock()
+				continue Loop
+			}
+
 			log.Printf("Error: Encountered read error: %q\n", err.Error())
+			conn.setCloseReason(err)
+			conn.hooks.error(err)
 			conn.Close()
 			return
 		}
 
-		// Decompress the frame's headers, if there are any.
-		err = frame.Decompress(conn.decompressor)
-		if err != nil {
-			log.Printf("Error in decompression: %v (%T).\n", err, frame)
-			conn.protocolError(0)
+		// Frames on the connection stream must only be given
+		// to the connection-level handlers.
+		sid, scoped := streamIDV2(frame)
+		if scoped && sid.Zero() {
+			conn.Lock()
+			conn.protocolError(0, ErrInvalidStreamID, "Error: Received %T with Stream ID 0.\n", frame)
+			conn.Unlock()
+			continue Loop
 		}
 
+		_, headerSize := frameSizesV2(frame)
+		if headers.add(frame, sid, scoped, headerSize >= 0, conn.stop) {
+			continue Loop
+		}
+
+		conn.handleFrame(frame)
+	}
+}
+
+// headerLoop handles the frames given to it by the read
+// loop in order, decompressing any headers. Once a fatal
+// error has occurred, the read loop is interrupted, and
+// any remaining frames are discarded.
+func (conn *connV2) headerLoop(headers *headerQueue) {
+	labelGoroutine(connLabels(conn.id, conn.remoteAddr, "headers"))
+
+	for frame := range headers.frames {
+		if conn.isFatal() {
+			continue
+		}
+
+		sid, scoped := streamIDV2(frame)
+		conn.handleFrame(frame)
+		headers.done(sid, scoped)
+
+		conn.Lock()
+		if conn.fatal && conn.conn != nil {
+			conn.conn.SetReadDeadline(conn.clock.Now())
+		}
+		conn.Unlock()
+	}
+}
+
+// isFatal returns whether a fatal error has occurred.
+func (conn *connV2) isFatal() bool {
+	conn.Lock()
+	defer conn.Unlock()
+	return conn.fatal
+}
+
+// handleFrame decompresses the frame's headers, if
+// any, then processes the frame.
+func (conn *connV2) handleFrame(frame Frame) {
+	// A panic ends the connection, rather than the program.
+	// internalError takes the connection's lock, so handlers
+	// must release it with defer, so that it is not left
+	// held by a panic.
+	defer func() {
+		if v := recover(); v != nil {
+			conn.internalError(v)
+		}
+	}()
+
+	// Decompress the frame's headers, if there are any.
+	// The decompressor is released once the connection
+	// has closed, so there is nothing more to do.
+	var err error
+	if _, header := frameSizesV2(frame); header >= 0 {
+		decompressor := conn.headerDecompressor()
+		if decompressor == nil {
+			return
+		}
+
+		start := conn.clock.Now()
+		err = frame.Decompress(decompressor)
+		conn.stats.decompressTimes.observeDuration(conn.clock.Now().Sub(start))
+	}
+	if name, ok := err.(duplicateHeader); ok {
+		log.Printf("Error: Received header block with duplicated header %q. Rejecting stream.\n", string(name))
+		conn.rejectHeaders(frame)
+		return
+	}
+	if invalid, ok := err.(*invalidHeader); ok {
+		log.Printf("Error: Received header block with invalid header %q (%s). Rejecting stream.\n", invalid.name, invalid.reason)
+		conn.rejectHeaders(frame)
+		return
+	}
+	if err != nil {
+		conn.decompressionError(frame, err)
+		return
+	}
+
+	if debugging {
 		debug.Println("Received Frame:")
 		debug.Println(frame)
+	}
 
-		// This is the main frame handling section.
-		switch frame := frame.(type) {
+	// This is the main frame handling section.
+	switch frame := frame.(type) {
 
-		case *synStreamFrameV2:
-			if conn.server == nil {
-				conn.handlePush(frame)
-			} else {
-				conn.handleRequest(frame)
-			}
+	case *synStreamFrameV2:
+		if conn.server == nil {
+			conn.handlePush(frame)
+		} else {
+			conn.handleRequest(frame)
+		}
 
-		case *synReplyFrameV2:
-			conn.handleSynReply(frame)
+	case *synReplyFrameV2:
+		conn.handleSynReply(frame)
 
-		case *rstStreamFrameV2:
-			if statusCodeIsFatal(frame.Status) {
-				code := statusCodeText[frame.Status]
-				log.Printf("Warning: Received %s on stream %d. Closing connection.\n", code, frame.StreamID)
-				conn.Close()
-				return
-			}
-			conn.handleRstStream(frame)
-
-		case *settingsFrameV2:
-			for _, setting := range frame.Settings {
-				conn.receivedSettings[setting.ID] = setting
-				switch setting.ID {
-				case SETTINGS_INITIAL_WINDOW_SIZE:
-					debug.Printf("Initial window size is %d.\n", setting.Value)
-					conn.initialWindowSize = setting.Value
-
-				case SETTINGS_MAX_CONCURRENT_STREAMS:
-					if conn.server == nil {
-						conn.requestStreamLimit.SetLimit(setting.Value)
-					} else {
-						conn.pushStreamLimit.SetLimit(setting.Value)
-					}
-				}
-			}
+	case *rstStreamFrameV2:
+		if statusCodeIsFatal(frame.Status) {
+			code := statusCodeText[frame.Status]
+			log.Printf("Warning: Received %s on stream %d. Closing connection.\n", code, frame.StreamID)
+			conn.setCloseReason(errors.New(fmt.Sprintf("Error: Received %s on stream %d.", code, frame.StreamID)))
+			conn.Close()
+			return
+		}
+		conn.handleRstStream(frame)
 
-		case *noopFrameV2:
-			// Ignore.
-
-		case *pingFrameV2:
-			// Check whether Ping ID is a response.
-			if frame.PingID&1 == conn.nextPingID&1 {
-				if conn.pings[frame.PingID] == nil {
-					log.Printf("Warning: Ignored PING with Ping ID %d, which hasn't been requested.\n",
-						frame.PingID)
-					conn.numBenignErrors++
-					continue Loop
-				}
-				conn.pings[frame.PingID] <- Ping{}
-				close(conn.pings[frame.PingID])
-				delete(conn.pings, frame.PingID)
-			} else {
-				debug.Println("Received PING. Replying...")
-				conn.output[0] <- frame
-			}
+	case *settingsFrameV2:
+		conn.handleSettings(frame)
 
-		case *goawayFrameV2:
-			lastProcessed := frame.LastGoodStreamID
-			for streamID, stream := range conn.streams {
-				if streamID&1 == conn.oddity && streamID > lastProcessed {
-					// Stream is locally-sent and has not been processed.
-					// TODO: Inform the server that the push has not been successful.
-					stream.Close()
-				}
-			}
-			conn.goaway = true
+	case *noopFrameV2:
+		// Ignore.
 
-		case *headersFrameV2:
-			conn.handleHeaders(frame)
+	case *pingFrameV2:
+		if !conn.handlePing(frame) {
+			// The send loop will recycle the frame.
+			return
+		}
 
-		case *windowUpdateFrameV2:
-			// Ignore.
+	case *goawayFrameV2:
+		conn.handleGoaway(frame)
 
-		case *dataFrameV2:
-			if conn.server == nil {
-				conn.handleServerData(frame)
-			} else {
-				conn.handleClientData(frame)
-			}
+	case *headersFrameV2:
+		conn.handleHeaders(frame)
 
-		default:
-			log.Println(fmt.Sprintf("Ignored unexpected frame type %T", frame))
+	case *windowUpdateFrameV2:
+		// Ignore.
+
+	case *dataFrameV2:
+		// The frame's buffer is reused once it has been handled.
+		defer frame.release()
+
+		if conn.server == nil {
+			conn.handleServerData(frame)
+		} else {
+			conn.handleClientData(frame)
 		}
+
+	default:
+		log.Println(fmt.Sprintf("Ignored unexpected frame type %T", frame))
+		conn.benignError()
 	}
+
+	// The frame has been fully processed,
+	// so it can now be reused.
+	conn.frames.recycle(frame)
 }
 
-// Add timeouts if requested by the server.
-func (conn *connV2) refreshTimeouts() {
-	if conn.server == nil {
-		return
-	}
-	if d := conn.server.ReadTimeout; d != 0 {
-		conn.conn.SetReadDeadline(time.Now().Add(d))
-	}
-	if d := conn.server.WriteTimeout; d != 0 {
-		conn.conn.SetWriteDeadline(time.Now().Add(d))
+// setTimeouts sets the read and write timeouts of a
+// client connection. This must be called before Run.
+func (conn *connV2) setTimeouts(read, write time.Duration) {
+	conn.Lock()
+	conn.readTimeout = read
+	conn.writeTimeout = write
+	conn.Unlock()
+}
+
+// timeouts returns the read and write timeouts, which are
+// the server's, or those set with setTimeouts on a client.
+func (conn *connV2) timeouts() (read, write time.Duration) {
+	if conn.server != nil {
+		return conn.server.ReadTimeout, conn.server.WriteTimeout
 	}
+	return conn.readTimeout, conn.writeTimeout
+}
+
+// Add timeouts if requested by the server or client.
+func (conn *connV2) refreshTimeouts() {
+	conn.refreshReadTimeout()
+	conn.refreshWriteTimeout()
 }
 
-// Add timeouts if requested by the server.
+// Add timeouts if requested by the server or client.
 func (conn *connV2) refreshReadTimeout() {
-	if conn.server == nil {
-		return
-	}
-	if d := conn.server.ReadTimeout; d != 0 {
-		conn.conn.SetReadDeadline(time.Now().Add(d))
+	if d, _ := conn.timeouts(); d != 0 {
+		// The connection may be closing. This is called
+		// from the send loop, which Close waits for, so
+		// the connection's lock must not be taken.
+		conn.netLock.Lock()
+		if conn.conn != nil {
+			conn.conn.SetReadDeadline(conn.clock.Now().Add(d))
+		}
+		conn.netLock.Unlock()
 	}
 }
 
-// Add timeouts if requested by the server.
+// Add timeouts if requested by the server or client.
 func (conn *connV2) refreshWriteTimeout() {
-	if conn.server == nil {
-		return
-	}
-	if d := conn.server.WriteTimeout; d != 0 {
-		conn.conn.SetWriteDeadline(time.Now().Add(d))
+	if _, d := conn.timeouts(); d != 0 {
+		// The connection may be closing. This is called
+		// from the send loop, which Close waits for, so
+		// the connection's lock must not be taken.
+		conn.netLock.Lock()
+		if conn.conn != nil {
+			conn.conn.SetWriteDeadline(conn.clock.Now().Add(d))
+		}
+		conn.netLock.Unlock()
 	}
 }
 
 // selectFrameToSend follows the specification's guidance
 // on frame priority, sending frames with higher priority
-// (a smaller number) first.
+// (a smaller number) first. Once the connection is closing
+// and no frames remain, selectFrameToSend returns nil.
 func (conn *connV2) selectFrameToSend() (frame Frame) {
 	if conn.closed() {
 		return nil
 	}
 
-	// Try in priority order first.
-	for i := 0; i < 8; i++ {
-		select {
-		case frame = <-conn.output[i]:
-			return frame
-		default:
-		}
+	if frame = conn.pollFrame(); frame != nil {
+		return frame
 	}
 
 	// No frames are immediately pending, so if the
 	// connection is being closed, cease sending
-	// safely.
-	if conn.sending != nil {
+	// safely. Close sets sending before closing
+	// closing, so sending is only read once closing
+	// has been seen to close.
+	select {
+	case <-conn.closing:
 		close(conn.sending)
-		runtime.Goexit()
+		return nil
+	default:
 	}
 
 	// Wait for any frame.
 	select {
+	case <-conn.control.ready:
+		return conn.control.pop()
 	case frame = <-conn.output[0]:
 		return frame
 	case frame = <-conn.output[1]:
 		return frame
 	case frame = <-conn.output[2]:
 		return frame
-	case frame = <-conn.output[2]:
+	case frame = <-conn.output[3]:
 		return frame
 	case frame = <-conn.output[4]:
 		return frame
@@ -993,50 +2442,173 @@ func (conn *connV2) selectFrameToSend() (frame Frame) {
 		return frame
 	case frame = <-conn.output[7]:
 		return frame
+	case <-conn.closing:
+		// Send any frames which are still pending.
+		return conn.selectFrameToSend()
 	case _ = <-conn.stop:
 		return nil
 	}
 }
 
+// pollFrame returns the frame which should be sent next,
+// or nil if no frames are immediately pending.
+func (conn *connV2) pollFrame() (frame Frame) {
+	// Control frames, such as PING, SETTINGS, RST_STREAM
+	// and GOAWAY, are sent ahead of any stream frames.
+	if frame = conn.control.pop(); frame != nil {
+		return frame
+	}
+
+	// Try in priority order next. Streams of the same
+	// priority share a channel, and senders blocked on
+	// a channel are served in turn, so their frames are
+	// interleaved.
+	for i := 0; i < 8; i++ {
+		select {
+		case frame = <-conn.output[i]:
+			return frame
+		default:
+		}
+	}
+
+	return nil
+}
+
 // send is run in a separate goroutine. It's used
 // to ensure clear interleaving of frames and to
 // provide assurances of priority and structure.
 func (conn *connV2) send() {
+	labelGoroutine(connLabels(conn.id, conn.remoteAddr, "send"))
+	defer close(conn.sendStopped)
+
+	// Our connection settings must be the first frames
+	// on the wire, so they are written before anything
+	// else is accepted, regardless of what the peer
+	// has sent in the meantime.
+	var pending []Frame
+	if conn.init != nil {
+		pending = conn.init()
+	}
+
+	// Frames are collected in a buffer, which is flushed
+	// once no more are ready to be sent, so that frames
+	// sent back-to-back share a write, and a TLS record.
+	w := bufio.NewWriterSize(conn.conn, WRITE_BUFFER_SIZE)
+
+	// Streams whose header blocks could not be sent
+	// have been ended, so their other frames are
+	// dropped, apart from the RST_STREAM ending them.
+	failed := make(map[StreamID]bool)
+
 	// Enter the processing loop.
 	for {
-		frame := conn.selectFrameToSend()
+		var frame Frame
+		if len(pending) > 0 {
+			frame, pending = pending[0], pending[1:]
+		} else if frame = conn.pollFrame(); frame == nil {
+			if err := w.Flush(); err != nil {
+				conn.sendFailed(err)
+				return
+			}
+			frame = conn.selectFrameToSend()
+		}
 
 		if frame == nil {
 			conn.Close()
 			return
 		}
 
+		if sid, ok := streamIDV2(frame); ok && failed[sid] {
+			if _, rst := frame.(*rstStreamFrameV2); !rst {
+				conn.frames.recycle(frame)
+				continue
+			}
+		}
+
 		// Compress any name/value header blocks.
 		err := frame.Compress(conn.compressor)
 		if err != nil {
-			log.Println(err)
+			if sid, ok := streamIDV2(frame); ok {
+				failed[sid] = true
+			}
+			go conn.compressionFailed(frame, err)
 			continue
 		}
 
-		debug.Println("Sending Frame:")
-		debug.Println(frame)
+		if debugging {
+			debug.Println("Sending Frame:")
+			debug.Println(frame)
+		}
 
 		// Leave the specifics of writing to the
 		// connection up to the frame.
-		_, err = frame.WriteTo(conn.conn)
+		n, err := frame.WriteTo(w)
+		if err == nil && flushesV2(frame) {
+			err = w.Flush()
+		}
+		conn.stats.sent(frameTypeV2(frame), n)
+		conn.stats.sizes(frameSizesV2(frame))
+		if data, ok := frame.(*dataFrameV2); ok && !data.queued.IsZero() {
+			conn.stats.queueTimes.observeDuration(time.Since(data.queued))
+		}
 		conn.refreshWriteTimeout()
 		if err != nil {
-			if err == io.EOF {
-				// Server has closed the TCP connection.
-				debug.Println("Note: Endpoint has disconnected.")
-				conn.Close()
-				return
-			}
-
-			// Unexpected error which prevented a write.
-			log.Printf("Error: Encountered write error: %q\n", err.Error())
-			conn.Close()
+			conn.sendFailed(err)
 			return
 		}
+
+		conn.events.frameSent(conn.clock.Now(), frame)
+		conn.frames.recycle(frame)
+	}
+}
+
+// sendFailed handles an error writing to the
+// connection, after which the send loop exits.
+func (conn *connV2) sendFailed(err error) {
+	if reason, ok := teardownError(err); ok {
+		// The TCP connection has been closed or timed out.
+		debug.Printf("Note: Connection closed: %v\n", err)
+		conn.setCloseReason(reason)
+		go conn.Close()
+		return
+	}
+
+	// Unexpected error which prevented a write. The
+	// connection is closed once the send loop has
+	// exited, so that nothing waits for it.
+	log.Printf("Error: Encountered write error: %q\n", err.Error())
+	conn.setCloseReason(err)
+	conn.hooks.error(err)
+	go conn.Close()
+}
+
+// compressionFailed ends the stream of a frame whose header
+// block could not be compressed, so was not sent, rather than
+// leaving the stream waiting for it. A stream the other
+// endpoint has not yet seen, as its SYN_STREAM was not sent,
+// fails with err, and any other stream is also reset with an
+// INTERNAL_ERROR. Compress checks the headers before any are
+// compressed, so the compression context is unaffected.
+//
+// compressionFailed takes the connection's lock, so it
+// is run apart from the send loop, which streams closed
+// with the lock held may be waiting for.
+func (conn *connV2) compressionFailed(frame Frame, err error) {
+	log.Printf("Error: Failed to send header block: %v\n", err)
+	sid, ok := streamIDV2(frame)
+	if !ok {
+		return
+	}
+
+	conn.Lock()
+	defer conn.Unlock()
+
+	if conn.closed() {
+		return
+	}
+	if _, syn := frame.(*synStreamFrameV2); syn {
+		conn.terminateStream(sid, err, 0)
+		return
 	}
+	conn.terminateStream(sid, err, RST_STREAM_INTERNAL_ERROR)
 }
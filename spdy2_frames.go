@@ -8,40 +8,85 @@ import (
 	"io"
 	"net/http"
 	"sort"
+	"sync"
+	"time"
 )
 
-// ReadFrame reads and parses a frame from reader.
-func readFrameV2(reader *bufio.Reader) (frame Frame, err error) {
-	start, err := reader.Peek(4)
+// frameLengthsV2 gives the valid lengths of
+// each type of SPDY/2 control frame.
+var frameLengthsV2 = map[uint16]frameLength{
+	SYN_STREAMv2:    {"SYN_STREAM", 12, MAX_FRAME_SIZE - 8},
+	SYN_REPLYv2:     {"SYN_REPLY", 8, MAX_FRAME_SIZE - 8},
+	RST_STREAMv2:    {"RST_STREAM", 8, 8},
+	SETTINGSv2:      {"SETTINGS", 4, MAX_FRAME_SIZE - 8},
+	NOOPv2:          {"NOOP", 0, 0},
+	PINGv2:          {"PING", 4, 4},
+	GOAWAYv2:        {"GOAWAY", 4, 8},
+	HEADERSv2:       {"HEADERS", 8, MAX_FRAME_SIZE - 8},
+	WINDOW_UPDATEv2: {"WINDOW_UPDATE", 8, 8},
+}
+
+// ReadFrame reads and parses a frame from reader. If
+// pool is non-nil, fixed-size control frames are taken
+// from it, rather than allocated. Frames larger than
+// limit bytes are rejected before they are read, as are
+// control frames whose lengths are invalid for their
+// type. Control frames of unknown types are skipped,
+// giving an *unknownFrame error.
+func readFrameV2(reader *bufio.Reader, pool *framePoolV2, limit int) (frame Frame, err error) {
+	start, err := reader.Peek(8)
 	if err != nil {
 		return nil, err
 	}
 
-	if start[0] != 128 {
+	// Check the frame's size before reading it,
+	// so that no space is allocated for it.
+	length := int(bytesToUint24(start[5:8]))
+	if 8+length > limit {
+		return nil, &oversizedFrame{8 + length, limit}
+	}
+
+	if start[0]&0x80 == 0 {
 		frame = new(dataFrameV2)
 		_, err = frame.ReadFrom(reader)
 		return frame, err
 	}
 
-	switch bytesToUint16(start[2:4]) {
+	// Skip control frames of other versions.
+	if version := (uint16(start[0]&0x7f) << 8) + uint16(start[1]); version != 2 {
+		return nil, skipFrame(reader)
+	}
+
+	// Skip control frames of unknown types, and
+	// check the lengths of the others.
+	frameType := bytesToUint16(start[2:4])
+	lengths, ok := frameLengthsV2[frameType]
+	if !ok {
+		return nil, skipUnknownFrame(reader)
+	}
+	if err := lengths.check(length); err != nil {
+		return nil, err
+	}
+
+	switch frameType {
 	case SYN_STREAMv2:
 		frame = new(synStreamFrameV2)
 	case SYN_REPLYv2:
 		frame = new(synReplyFrameV2)
 	case RST_STREAMv2:
-		frame = new(rstStreamFrameV2)
+		frame = pool.rstStream()
 	case SETTINGSv2:
 		frame = new(settingsFrameV2)
 	case NOOPv2:
 		frame = new(noopFrameV2)
 	case PINGv2:
-		frame = new(pingFrameV2)
+		frame = pool.ping()
 	case GOAWAYv2:
 		frame = new(goawayFrameV2)
 	case HEADERSv2:
 		frame = new(headersFrameV2)
 	case WINDOW_UPDATEv2:
-		frame = new(windowUpdateFrameV2)
+		frame = pool.windowUpdate()
 
 	default:
 		return nil, errors.New("Error Failed to parse frame type.")
@@ -51,6 +96,148 @@ func readFrameV2(reader *bufio.Reader) (frame Frame, err error) {
 	return frame, err
 }
 
+// streamIDV2 returns the stream ID of frames which
+// are scoped to a single stream, and false for frames
+// which apply to the whole connection.
+func streamIDV2(frame Frame) (StreamID, bool) {
+	switch frame := frame.(type) {
+	case *synStreamFrameV2:
+		return frame.StreamID, true
+	case *synReplyFrameV2:
+		return frame.StreamID, true
+	case *rstStreamFrameV2:
+		return frame.StreamID, true
+	case *headersFrameV2:
+		return frame.StreamID, true
+	case *windowUpdateFrameV2:
+		return frame.StreamID, true
+	case *dataFrameV2:
+		return frame.StreamID, true
+	default:
+		return 0, false
+	}
+}
+
+// frameTypeV2 returns the type of a SPDY/2 frame,
+// with DATA frames given type 0, for statistics.
+func frameTypeV2(frame Frame) int {
+	switch frame.(type) {
+	case *dataFrameV2:
+		return 0
+	case *synStreamFrameV2:
+		return SYN_STREAMv2
+	case *synReplyFrameV2:
+		return SYN_REPLYv2
+	case *rstStreamFrameV2:
+		return RST_STREAMv2
+	case *settingsFrameV2:
+		return SETTINGSv2
+	case *noopFrameV2:
+		return NOOPv2
+	case *pingFrameV2:
+		return PINGv2
+	case *goawayFrameV2:
+		return GOAWAYv2
+	case *headersFrameV2:
+		return HEADERSv2
+	case *windowUpdateFrameV2:
+		return WINDOW_UPDATEv2
+	default:
+		return -1
+	}
+}
+
+// frameSizesV2 returns the size of a SPDY/2 frame's
+// data and of its compressed header block, for
+// statistics. Either is -1 if the frame has none.
+func frameSizesV2(frame Frame) (data, header int) {
+	switch frame := frame.(type) {
+	case *dataFrameV2:
+		return len(frame.Data), -1
+	case *synStreamFrameV2:
+		return -1, len(frame.rawHeader)
+	case *synReplyFrameV2:
+		return -1, len(frame.rawHeader)
+	case *headersFrameV2:
+		return -1, len(frame.rawHeader)
+	default:
+		return -1, -1
+	}
+}
+
+// flushesV2 reports whether a SPDY/2 frame should be
+// written to the connection immediately, rather than
+// buffered with any which follow it. This keeps the
+// latency of PINGs and the ends of streams low.
+func flushesV2(frame Frame) bool {
+	switch frame := frame.(type) {
+	case *dataFrameV2:
+		return frame.Flags.FIN()
+	case *pingFrameV2:
+		return true
+	default:
+		return false
+	}
+}
+
+// framePoolV2 holds freelists of the fixed-size
+// control frames, to reduce the allocations made
+// by connections which receive many of them. A
+// nil framePoolV2 simply allocates new frames.
+type framePoolV2 struct {
+	pings         sync.Pool
+	rstStreams    sync.Pool
+	windowUpdates sync.Pool
+}
+
+func (pool *framePoolV2) ping() *pingFrameV2 {
+	if pool != nil {
+		if frame, ok := pool.pings.Get().(*pingFrameV2); ok {
+			return frame
+		}
+	}
+	return new(pingFrameV2)
+}
+
+func (pool *framePoolV2) rstStream() *rstStreamFrameV2 {
+	if pool != nil {
+		if frame, ok := pool.rstStreams.Get().(*rstStreamFrameV2); ok {
+			return frame
+		}
+	}
+	return new(rstStreamFrameV2)
+}
+
+func (pool *framePoolV2) windowUpdate() *windowUpdateFrameV2 {
+	if pool != nil {
+		if frame, ok := pool.windowUpdates.Get().(*windowUpdateFrameV2); ok {
+			return frame
+		}
+	}
+	return new(windowUpdateFrameV2)
+}
+
+// recycle returns the frame to its freelist, if it
+// is one of the pooled types. The frame must not be
+// used by the caller, or anyone else, afterwards.
+func (pool *framePoolV2) recycle(frame Frame) {
+	if pool == nil {
+		return
+	}
+
+	switch frame := frame.(type) {
+	case *pingFrameV2:
+		*frame = pingFrameV2{}
+		pool.pings.Put(frame)
+	case *rstStreamFrameV2:
+		*frame = rstStreamFrameV2{}
+		pool.rstStreams.Put(frame)
+	case *windowUpdateFrameV2:
+		*frame = windowUpdateFrameV2{}
+		pool.windowUpdates.Put(frame)
+	}
+}
+
 /******************
  *** SYN_STREAM ***
  ******************/
@@ -117,8 +304,8 @@ func (frame *synStreamFrameV2) ReadFrom(reader io.Reader) (int64, error) {
 	// Check unused space.
 	if (data[8]>>7) != 0 || (data[12]>>7) != 0 {
 		return 18, &invalidField{"Unused", 1, 0}
-	} else if (data[16] & 0x1f) != 0 {
-		return 18, &invalidField{"Unused", int(data[16] & 0x1f), 0}
+	} else if (data[16] & 0x3f) != 0 {
+		return 18, &invalidField{"Unused", int(data[16] & 0x3f), 0}
 	} else if data[17] != 0 {
 		return 18, &invalidField{"Unused", int(data[17]), 0}
 	}
@@ -126,8 +313,8 @@ func (frame *synStreamFrameV2) ReadFrom(reader io.Reader) (int64, error) {
 	// Get and check length.
 	length := int(bytesToUint24(data[5:8]))
 	if length < 12 {
-		return 18, &incorrectDataLength{length, 12}
-	} else if length > MAX_FRAME_SIZE-18 {
+		return 18, &malformedFrame{"SYN_STREAM", length, 12}
+	} else if length > MAX_FRAME_SIZE-8 {
 		return 18, frameTooLarge
 	}
 
@@ -140,7 +327,7 @@ func (frame *synStreamFrameV2) ReadFrom(reader io.Reader) (int64, error) {
 	frame.Flags = Flags(data[4])
 	frame.StreamID = StreamID(bytesToUint32(data[8:12]))
 	frame.AssocStreamID = StreamID(bytesToUint32(data[12:16]))
-	frame.Priority = Priority(data[16] >> 6)
+	frame.Priority = DecodePriority(2, data[16])
 	frame.rawHeader = header
 
 	if !frame.StreamID.Valid() {
@@ -198,6 +385,9 @@ func (frame *synStreamFrameV2) WriteTo(writer io.Writer) (int64, error) {
 
 	header := frame.rawHeader
 	length := 10 + len(header)
+	if length > MAX_FRAME_SIZE-8 {
+		return 0, frameTooLarge
+	}
 	out := make([]byte, 18)
 
 	out[0] = 128                       // Control bit and Version
@@ -305,7 +495,7 @@ func (frame *synReplyFrameV2) ReadFrom(reader io.Reader) (int64, error) {
 	// Get and check length.
 	length := int(bytesToUint24(data[5:8]))
 	if length < 8 {
-		return 14, &incorrectDataLength{length, 8}
+		return 14, &malformedFrame{"SYN_REPLY", length, 8}
 	} else if length > MAX_FRAME_SIZE-8 {
 		return 14, frameTooLarge
 	}
@@ -320,6 +510,10 @@ func (frame *synReplyFrameV2) ReadFrom(reader io.Reader) (int64, error) {
 	frame.StreamID = StreamID(bytesToUint32(data[8:12]))
 	frame.rawHeader = header
 
+	if frame.StreamID.Zero() {
+		return 14, streamIdIsZero
+	}
+
 	return int64(length + 8), nil
 }
 
@@ -357,6 +551,9 @@ func (frame *synReplyFrameV2) WriteTo(writer io.Writer) (int64, error) {
 
 	header := frame.rawHeader
 	length := 6 + len(header)
+	if length > MAX_FRAME_SIZE-8 {
+		return 0, frameTooLarge
+	}
 	out := make([]byte, 14)
 
 	out[0] = 128                  // Control bit and Version
@@ -428,7 +625,7 @@ func (frame *rstStreamFrameV2) ReadFrom(reader io.Reader) (int64, error) {
 	// Get and check length.
 	length := int(bytesToUint24(data[5:8]))
 	if length != 8 {
-		return 16, &incorrectDataLength{length, 8}
+		return 16, &malformedFrame{"RST_STREAM", length, 8}
 	} else if length > MAX_FRAME_SIZE-8 {
 		return 16, frameTooLarge
 	}
@@ -438,12 +635,20 @@ func (frame *rstStreamFrameV2) ReadFrom(reader io.Reader) (int64, error) {
 		return 16, &invalidField{"Unused", 1, 0}
 	}
 
+	// Check Flags.
+	if (data[4]) != 0 {
+		return 16, &invalidField{"Flags", int(data[4]), 0}
+	}
+
 	frame.StreamID = StreamID(bytesToUint32(data[8:12]))
 	frame.Status = StatusCode(bytesToUint32(data[12:16]))
 
 	if !frame.StreamID.Valid() {
 		return 16, streamIdTooLarge
 	}
+	if frame.StreamID.Zero() {
+		return 16, streamIdIsZero
+	}
 
 	return 16, nil
 }
@@ -463,13 +668,16 @@ func (frame *rstStreamFrameV2) WriteTo(writer io.Writer) (int64, error) {
 	if !frame.StreamID.Valid() {
 		return 0, streamIdTooLarge
 	}
+	if frame.StreamID.Zero() {
+		return 0, streamIdIsZero
+	}
 
 	out := make([]byte, 16)
 
 	out[0] = 128                  // Control bit and Version
 	out[1] = 2                    // Version
 	out[2] = 0                    // Type
-	out[3] = 2                    // Type
+	out[3] = 3                    // Type
 	out[4] = 0                    // Flags
 	out[5] = 0                    // Length
 	out[6] = 0                    // Length
@@ -495,8 +703,9 @@ func (frame *rstStreamFrameV2) WriteTo(writer io.Writer) (int64, error) {
  *** SETTINGS ***
  ****************/
 type settingsFrameV2 struct {
-	Flags    Flags
-	Settings Settings
+	Flags        Flags
+	Settings     Settings
+	Experimental bool // Allow settings with unrecognised IDs.
 }
 
 func (frame *settingsFrameV2) Add(Flags Flags, id uint32, value uint32) {
@@ -536,15 +745,16 @@ func (frame *settingsFrameV2) ReadFrom(reader io.Reader) (int64, error) {
 	// Get and check length.
 	length := int(bytesToUint24(data[5:8]))
 	if length < 4 {
-		return 12, &incorrectDataLength{length, 8}
+		return 12, &malformedFrame{"SETTINGS", length, 8}
 	} else if length > MAX_FRAME_SIZE-8 {
 		return 12, frameTooLarge
 	}
 
-	// Check size.
-	numSettings := int(bytesToUint32(data[8:12]))
-	if length != 4+(8*numSettings) {
-		return 12, &incorrectDataLength{length, 4 + (8 * numSettings)}
+	// Check size. The number of entries is found from the
+	// length, so that a large number cannot overflow.
+	numSettings := (length - 4) / 8
+	if entries := bytesToUint32(data[8:12]); (length-4)%8 != 0 || uint32(numSettings) != entries {
+		return 12, &malformedFrame{"SETTINGS", length, 4 + (8 * int(entries))}
 	}
 
 	// Read in data.
@@ -555,13 +765,32 @@ func (frame *settingsFrameV2) ReadFrom(reader io.Reader) (int64, error) {
 
 	frame.Flags = Flags(data[4])
 	frame.Settings = make(Settings)
+	frame.Experimental = false
+	zero := false
 	for i := 0; i < numSettings; i++ {
 		j := i * 8
 		setting := decodeSettingV2(settings[j:])
 		if setting == nil {
 			return int64(length), errors.New("Error: Failed to parse settings.")
 		}
+		// Settings with ID 0 are dropped, but the rest
+		// of the frame is still returned, so that the
+		// connection can apply it.
+		if setting.ID == 0 {
+			zero = true
+			continue
+		}
 		frame.Settings[setting.ID] = setting
+
+		// Unrecognised settings are kept, so the
+		// frame can be written as it was received.
+		if !settingRecognised(setting.ID) {
+			frame.Experimental = true
+		}
+	}
+
+	if zero {
+		return int64(length), settingIdIsZero
 	}
 
 	return int64(length), nil
@@ -593,9 +822,21 @@ func (frame *settingsFrameV2) String() string {
 }
 
 func (frame *settingsFrameV2) WriteTo(writer io.Writer) (int64, error) {
+	for id := range frame.Settings {
+		if id == 0 {
+			return 0, &invalidField{"Setting ID", 0, 1}
+		}
+		if !settingRecognised(id) && !frame.Experimental {
+			return 0, errors.New(fmt.Sprintf("Error: Setting ID %d is not recognised.", id))
+		}
+	}
+
 	settings := encodeSettingsV2(frame.Settings)
 	numSettings := uint32(len(frame.Settings))
 	length := 4 + len(settings)
+	if length > MAX_FRAME_SIZE-8 {
+		return 0, frameTooLarge
+	}
 	out := make([]byte, 12)
 
 	out[0] = 128                     // Control bit and Version
@@ -692,8 +933,8 @@ func (frame *noopFrameV2) ReadFrom(reader io.Reader) (int64, error) {
 		return 8, &incorrectFrame{DATA_FRAMEv2, NOOPv2, 2}
 	}
 
-	// Check it's a PING.
-	if bytesToUint16(data[2:4]) != PINGv2 {
+	// Check it's a NOOP.
+	if bytesToUint16(data[2:4]) != NOOPv2 {
 		return 8, &incorrectFrame{int(bytesToUint16(data[2:4])), NOOPv2, 2}
 	}
 
@@ -706,7 +947,7 @@ func (frame *noopFrameV2) ReadFrom(reader io.Reader) (int64, error) {
 	// Get and check length.
 	length := int(bytesToUint24(data[5:8]))
 	if length != 0 {
-		return 8, &incorrectDataLength{length, 0}
+		return 8, &malformedFrame{"NOOP", length, 0}
 	}
 
 	// Check Flags.
@@ -722,7 +963,23 @@ func (frame *noopFrameV2) String() string {
 }
 
 func (frame *noopFrameV2) WriteTo(writer io.Writer) (int64, error) {
-	return 0, nil
+	out := make([]byte, 8)
+
+	out[0] = 128 // Control bit and Version
+	out[1] = 2   // Version
+	out[2] = 0   // Type
+	out[3] = 5   // Type
+	out[4] = 0   // Flags
+	out[5] = 0   // Length
+	out[6] = 0   // Length
+	out[7] = 0   // Length
+
+	err := write(writer, out)
+	if err != nil {
+		return 0, err
+	}
+
+	return 8, nil
 }
 
 /************
@@ -730,6 +987,7 @@ func (frame *noopFrameV2) WriteTo(writer io.Writer) (int64, error) {
  ************/
 type pingFrameV2 struct {
 	PingID uint32
+	buf    [12]byte // space to read and write the frame without allocating.
 }
 
 func (frame *pingFrameV2) Compress(comp Compressor) error {
@@ -741,8 +999,8 @@ func (frame *pingFrameV2) Decompress(decomp Decompressor) error {
 }
 
 func (frame *pingFrameV2) ReadFrom(reader io.Reader) (int64, error) {
-	data, err := read(reader, 12)
-	if err != nil {
+	data := frame.buf[:]
+	if err := readInto(reader, data); err != nil {
 		return 0, err
 	}
 
@@ -765,7 +1023,7 @@ func (frame *pingFrameV2) ReadFrom(reader io.Reader) (int64, error) {
 	// Get and check length.
 	length := int(bytesToUint24(data[5:8]))
 	if length != 4 {
-		return 12, &incorrectDataLength{length, 4}
+		return 12, &malformedFrame{"PING", length, 4}
 	}
 
 	// Check Flags.
@@ -789,7 +1047,7 @@ func (frame *pingFrameV2) String() string {
 }
 
 func (frame *pingFrameV2) WriteTo(writer io.Writer) (int64, error) {
-	out := make([]byte, 12)
+	out := frame.buf[:]
 
 	out[0] = 128                      // Control bit and Version
 	out[1] = 2                        // Version
@@ -853,10 +1111,11 @@ func (frame *goawayFrameV2) ReadFrom(reader io.Reader) (int64, error) {
 		return 12, unsupportedVersion(version)
 	}
 
-	// Get and check length.
+	// Get and check length. Some peers send the
+	// SPDY/3 layout, whose status code is ignored.
 	length := int(bytesToUint24(data[5:8]))
-	if length != 4 {
-		return 12, &incorrectDataLength{length, 4}
+	if length != 4 && length != 8 {
+		return 12, &malformedFrame{"GOAWAY", length, 4}
 	}
 
 	// Check unused space.
@@ -871,11 +1130,18 @@ func (frame *goawayFrameV2) ReadFrom(reader io.Reader) (int64, error) {
 
 	frame.LastGoodStreamID = StreamID(bytesToUint32(data[8:12]))
 
+	if length == 8 {
+		if _, err := read(reader, 4); err != nil {
+			return 12, err
+		}
+		debug.Println("Note: Received GOAWAY with a status code. Ignoring it.")
+	}
+
 	if !frame.LastGoodStreamID.Valid() {
-		return 12, streamIdTooLarge
+		return int64(8 + length), streamIdTooLarge
 	}
 
-	return 12, nil
+	return int64(8 + length), nil
 }
 
 func (frame *goawayFrameV2) String() string {
@@ -902,7 +1168,7 @@ func (frame *goawayFrameV2) WriteTo(writer io.Writer) (int64, error) {
 	out[4] = 0                            // Flags
 	out[5] = 0                            // Length
 	out[6] = 0                            // Length
-	out[7] = 8                            // Length
+	out[7] = 4                            // Length
 	out[8] = frame.LastGoodStreamID.b1()  // Last Good Stream ID
 	out[9] = frame.LastGoodStreamID.b2()  // Last Good Stream ID
 	out[10] = frame.LastGoodStreamID.b3() // Last Good Stream ID
@@ -956,44 +1222,44 @@ func (frame *headersFrameV2) Decompress(decom Decompressor) error {
 }
 
 func (frame *headersFrameV2) ReadFrom(reader io.Reader) (int64, error) {
-	data, err := read(reader, 16)
+	data, err := read(reader, 14)
 	if err != nil {
 		return 0, err
 	}
 
 	// Check it's a control frame.
 	if data[0] != 128 {
-		return 16, &incorrectFrame{DATA_FRAMEv2, HEADERSv2, 2}
+		return 14, &incorrectFrame{DATA_FRAMEv2, HEADERSv2, 2}
 	}
 
 	// Check it's a HEADERS.
 	if bytesToUint16(data[2:4]) != HEADERSv2 {
-		return 16, &incorrectFrame{int(bytesToUint16(data[2:4])), HEADERSv2, 2}
+		return 14, &incorrectFrame{int(bytesToUint16(data[2:4])), HEADERSv2, 2}
 	}
 
 	// Check version and adapt accordingly.
 	version := (uint16(data[0]&0x7f) << 8) + uint16(data[1])
 	if version != 2 {
-		return 16, unsupportedVersion(version)
+		return 14, unsupportedVersion(version)
 	}
 
 	// Get and check length.
 	length := int(bytesToUint24(data[5:8]))
-	if length < 6 {
-		return 16, &incorrectDataLength{length, 6}
+	if length < 8 {
+		return 14, &malformedFrame{"HEADERS", length, 8}
 	} else if length > MAX_FRAME_SIZE-8 {
-		return 16, frameTooLarge
+		return 14, frameTooLarge
 	}
 
 	// Check unused space.
 	if (data[8] >> 7) != 0 {
-		return 16, &invalidField{"Unused", 1, 0}
+		return 14, &invalidField{"Unused", 1, 0}
 	}
 
 	// Read in data.
-	header, err := read(reader, length-8)
+	header, err := read(reader, length-6)
 	if err != nil {
-		return 16, err
+		return 14, err
 	}
 
 	frame.Flags = Flags(data[4])
@@ -1044,8 +1310,11 @@ func (frame *headersFrameV2) WriteTo(writer io.Writer) (int64, error) {
 	}
 
 	header := frame.rawHeader
-	length := 4 + len(header)
-	out := make([]byte, 16)
+	length := 6 + len(header)
+	if length > MAX_FRAME_SIZE-8 {
+		return 0, frameTooLarge
+	}
+	out := make([]byte, 14)
 
 	out[0] = 128                  // Control bit and Version
 	out[1] = 2                    // Version
@@ -1059,6 +1328,8 @@ func (frame *headersFrameV2) WriteTo(writer io.Writer) (int64, error) {
 	out[9] = frame.StreamID.b2()  // Stream ID
 	out[10] = frame.StreamID.b3() // Stream ID
 	out[11] = frame.StreamID.b4() // Stream ID
+	out[12] = 0                   // Unused
+	out[13] = 0                   // Unused
 
 	err := write(writer, out)
 	if err != nil {
@@ -1067,7 +1338,7 @@ func (frame *headersFrameV2) WriteTo(writer io.Writer) (int64, error) {
 
 	err = write(writer, header)
 	if err != nil {
-		return 16, err
+		return 14, err
 	}
 
 	return int64(length + 8), nil
@@ -1079,6 +1350,7 @@ func (frame *headersFrameV2) WriteTo(writer io.Writer) (int64, error) {
 type windowUpdateFrameV2 struct {
 	StreamID        StreamID
 	DeltaWindowSize uint32
+	buf             [16]byte // space to read and write the frame without allocating.
 }
 
 func (frame *windowUpdateFrameV2) Compress(comp Compressor) error {
@@ -1090,8 +1362,8 @@ func (frame *windowUpdateFrameV2) Decompress(decomp Decompressor) error {
 }
 
 func (frame *windowUpdateFrameV2) ReadFrom(reader io.Reader) (int64, error) {
-	data, err := read(reader, 16)
-	if err != nil {
+	data := frame.buf[:]
+	if err := readInto(reader, data); err != nil {
 		return 0, err
 	}
 
@@ -1114,7 +1386,7 @@ func (frame *windowUpdateFrameV2) ReadFrom(reader io.Reader) (int64, error) {
 	// Get and check length.
 	length := int(bytesToUint24(data[5:8]))
 	if length != 8 {
-		return 16, &incorrectDataLength{length, 8}
+		return 16, &malformedFrame{"WINDOW_UPDATE", length, 8}
 	}
 
 	// Check unused space.
@@ -1122,6 +1394,11 @@ func (frame *windowUpdateFrameV2) ReadFrom(reader io.Reader) (int64, error) {
 		return 16, &invalidField{"Unused", 1, 0}
 	}
 
+	// Check Flags.
+	if (data[4]) != 0 {
+		return 16, &invalidField{"Flags", int(data[4]), 0}
+	}
+
 	frame.StreamID = StreamID(bytesToUint32(data[8:12]))
 	frame.DeltaWindowSize = bytesToUint32(data[12:16])
 
@@ -1150,7 +1427,35 @@ func (frame *windowUpdateFrameV2) String() string {
 }
 
 func (frame *windowUpdateFrameV2) WriteTo(writer io.Writer) (int64, error) {
-	return 0, nil
+	if frame.StreamID.Zero() {
+		return 0, streamIdIsZero
+	}
+
+	out := frame.buf[:]
+
+	out[0] = 128                                     // Control bit and Version
+	out[1] = 2                                       // Version
+	out[2] = 0                                       // Type
+	out[3] = 9                                       // Type
+	out[4] = 0                                       // Flags
+	out[5] = 0                                       // Length
+	out[6] = 0                                       // Length
+	out[7] = 8                                       // Length
+	out[8] = frame.StreamID.b1()                     // Stream ID
+	out[9] = frame.StreamID.b2()                     // Stream ID
+	out[10] = frame.StreamID.b3()                    // Stream ID
+	out[11] = frame.StreamID.b4()                    // Stream ID
+	out[12] = byte(frame.DeltaWindowSize>>24) & 0x7f // Delta Window Size
+	out[13] = byte(frame.DeltaWindowSize >> 16)      // Delta Window Size
+	out[14] = byte(frame.DeltaWindowSize >> 8)       // Delta Window Size
+	out[15] = byte(frame.DeltaWindowSize)            // Delta Window Size
+
+	err := write(writer, out)
+	if err != nil {
+		return 0, err
+	}
+
+	return 16, nil
 }
 
 /************
@@ -1160,6 +1465,58 @@ type dataFrameV2 struct {
 	StreamID StreamID
 	Flags    Flags
 	Data     []byte
+	queued   time.Time // time at which the frame was queued to be sent.
+	payload  *[]byte   // pooled buffer holding Data, if any.
+	buf      [8]byte   // space to read and write the frame header without allocating.
+}
+
+// newDataFrameV2 returns a DATA frame to be sent,
+// stamped with the time at which it was queued.
+// The stamp uses the wall clock, rather than the
+// connection's clock, as streams do not have
+// access to the latter.
+func newDataFrameV2() *dataFrameV2 {
+	return &dataFrameV2{queued: time.Now()}
+}
+
+// writeDataV2 sends data on the stream, split
+// into frames of at most MaxDataFrameSize. If stop
+// is closed first, the data is not all sent.
+func writeDataV2(output chan<- Frame, stop <-chan struct{}, streamID StreamID, data []byte) (int, error) {
+	written := 0
+	size := dataFrameSize()
+	for len(data) > 0 {
+		n := len(data)
+		if n > size {
+			n = size
+		}
+
+		dataFrame := newDataFrameV2()
+		dataFrame.StreamID = streamID
+		dataFrame.Data = data[:n]
+		if !sendFrame(output, stop, dataFrame) {
+			return written, errConnClosed
+		}
+
+		written += n
+		data = data[n:]
+	}
+
+	return written, nil
+}
+
+// release returns the buffer holding the frame's Data to
+// its pool, if it was read into a pooled buffer. The frame's
+// Data must not be used by the caller, or anyone else, once
+// it has been released, so it must be copied first if it is
+// given to application code which may keep it.
+func (frame *dataFrameV2) release() {
+	if frame.payload == nil {
+		return
+	}
+	putPayload(frame.payload)
+	frame.payload = nil
+	frame.Data = nil
 }
 
 func (frame *dataFrameV2) Compress(comp Compressor) error {
@@ -1171,8 +1528,8 @@ func (frame *dataFrameV2) Decompress(decomp Decompressor) error {
 }
 
 func (frame *dataFrameV2) ReadFrom(reader io.Reader) (int64, error) {
-	data, err := read(reader, 8)
-	if err != nil {
+	data := frame.buf[:]
+	if err := readInto(reader, data); err != nil {
 		return 0, err
 	}
 
@@ -1187,10 +1544,17 @@ func (frame *dataFrameV2) ReadFrom(reader io.Reader) (int64, error) {
 		return 8, frameTooLarge
 	}
 
-	// Read in data.
+	// Read in data, using a pooled buffer if possible.
+	// The buffer is reused once the frame is released.
 	if length != 0 {
-		frame.Data, err = read(reader, length)
-		if err != nil {
+		frame.payload = getPayload(length)
+		if frame.payload != nil {
+			frame.Data = (*frame.payload)[:length]
+		} else {
+			frame.Data = make([]byte, length)
+		}
+		if err := readInto(reader, frame.Data); err != nil {
+			frame.release()
 			return 8, err
 		}
 	}
@@ -1231,11 +1595,11 @@ func (frame *dataFrameV2) WriteTo(writer io.Writer) (int64, error) {
 	if length > MAX_DATA_SIZE {
 		return 0, errors.New("Error: Data size too large.")
 	}
-	if length == 0 && !frame.Flags.FIN() {
-		return 0, errors.New("Error: Data is empty.")
+	if frame.StreamID.Zero() {
+		return 0, streamIdIsZero
 	}
 
-	out := make([]byte, 8)
+	out := frame.buf[:]
 
 	out[0] = frame.StreamID.b1() // Control bit and Stream ID
 	out[1] = frame.StreamID.b2() // Stream ID
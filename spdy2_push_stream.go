@@ -4,8 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // pushStreamV2 is a structure that implements the
@@ -18,8 +21,13 @@ type pushStreamV2 struct {
 	origin   Stream
 	state    *StreamState
 	output   chan<- Frame
+	priority Priority
 	header   http.Header
+	closeErr error
 	stop     <-chan struct{}
+	deadline writeDeadline
+	shut     uint32 // set to 1 once the stream has been shut; accessed atomically.
+	tags     streamTags
 }
 
 /***********************
@@ -33,42 +41,30 @@ func (p *pushStreamV2) Header() http.Header {
 // Write is used for sending data in the push.
 func (p *pushStreamV2) Write(inputData []byte) (int, error) {
 	if p.closed() || p.state.ClosedHere() {
-		return 0, errors.New("Error: Stream already closed.")
+		if err := p.closedErr(); err != nil {
+			return 0, err
+		}
+		return 0, ErrStreamClosed
+	}
+	if err := p.deadline.err(); err != nil {
+		return 0, err
 	}
 
-	state := p.origin.State()
-	if p.origin == nil || state.ClosedHere() {
+	if p.origin == nil || p.origin.State().ClosedHere() {
 		return 0, errors.New("Error: Origin stream is closed.")
 	}
 
-	p.writeHeader()
+	if err := p.writeHeader(); err != nil {
+		return 0, err
+	}
 
 	// Copy the data locally to avoid any pointer issues.
 	data := make([]byte, len(inputData))
 	copy(data, inputData)
 
-	// Chunk the response if necessary.
-	written := 0
-	for len(data) > MAX_DATA_SIZE {
-		dataFrame := new(dataFrameV2)
-		dataFrame.StreamID = p.streamID
-		dataFrame.Data = data[:MAX_DATA_SIZE]
-		p.output <- dataFrame
-
-		written += MAX_DATA_SIZE
-	}
-
-	n := len(data)
-	if n == 0 {
-		return written, nil
-	}
-
-	dataFrame := new(dataFrameV2)
-	dataFrame.StreamID = p.streamID
-	dataFrame.Data = data
-	p.output <- dataFrame
-
-	return written + n, nil
+	// Chunk the data if necessary.
+	n, err := writeDataV2(p.output, p.stop, p.streamID, data)
+	return n, p.writeErr(err)
 }
 
 // WriteHeader is provided to satisfy the Stream
@@ -84,20 +80,61 @@ func (p *pushStreamV2) WriteHeader(int) {
  *****************/
 
 func (p *pushStreamV2) Close() error {
+	p.writeHeader()
+
+	// Frames are sent without the stream's lock, which
+	// the read loop needs to deliver frames.
 	p.Lock()
 	defer p.Unlock()
-	p.writeHeader()
-	if p.state != nil {
+	if c, ok := p.conn.(closeErrorer); ok && p.closeErr == nil {
+		p.closeErr = c.closeError(p.streamID)
+	}
+	if atomic.CompareAndSwapUint32(&p.shut, 0, 1) {
+		// Free the stream's slot in the stream limit.
+		if conn, ok := p.conn.(*connV2); ok {
+			conn.pushStreamLimit.Close()
+		}
 		p.state.Close()
-		p.state = nil
 	}
-	p.origin = nil
-	p.output = nil
-	p.header = nil
-	p.stop = nil
 	return nil
 }
 
+// CloseWrite finishes the push, as
+// does closing the writer from Push.
+func (p *pushStreamV2) CloseWrite() error {
+	return p.finish()
+}
+
+// finish ends the push, sending a FIN once any
+// remaining headers and data have been sent.
+func (p *pushStreamV2) finish() error {
+	if p.closed() || p.state.ClosedHere() {
+		return p.closedErr()
+	}
+
+	if err := p.writeHeader(); err != nil {
+		return err
+	}
+	data := newDataFrameV2()
+	data.StreamID = p.streamID
+	data.Flags = FLAG_FIN
+	data.Data = []byte{}
+	sendFrame(p.output, p.stop, data)
+
+	p.state.CloseHere()
+	return p.Close()
+}
+
+// Reset ends the stream abruptly, sending a
+// RST_STREAM with the given status code.
+func (p *pushStreamV2) Reset(code StatusCode) error {
+	conn, ok := p.conn.(*connV2)
+	if !ok {
+		return errors.New("Error: Stream has no connection.")
+	}
+	return conn.resetStream(p, code)
+}
+
 func (p *pushStreamV2) Read(out []byte) (int, error) {
 	return 0, io.EOF
 }
@@ -138,12 +175,24 @@ func (p *pushStreamV2) State() *StreamState {
 	return p.state
 }
 
+func (p *pushStreamV2) Priority() Priority {
+	return p.priority
+}
+
 func (p *pushStreamV2) StreamID() StreamID {
 	return p.streamID
 }
 
+func (p *pushStreamV2) SetTag(key, value string) error {
+	return p.tags.set(key, value)
+}
+
+func (p *pushStreamV2) Tags() map[string]string {
+	return p.tags.copy()
+}
+
 func (p *pushStreamV2) closed() bool {
-	if p.conn == nil || p.state == nil {
+	if p.conn == nil || atomic.LoadUint32(&p.shut) == 1 {
 		return true
 	}
 	select {
@@ -154,18 +203,93 @@ func (p *pushStreamV2) closed() bool {
 	}
 }
 
-// writeHeader is used to send HTTP headers to
-// the client.
-func (p *pushStreamV2) writeHeader() {
-	if len(p.header) == 0 || p.closed() {
-		return
+// closedErr returns the reason the stream was
+// closed, if it was closed by the connection.
+func (p *pushStreamV2) closedErr() error {
+	p.Lock()
+	defer p.Unlock()
+	return p.closeErr
+}
+
+// writeErr returns the error to be given for a Write which
+// failed with err. If the stream failed because it or its
+// connection was closed, this is the reason it was closed,
+// which may not yet have been recorded when the Write gave
+// up.
+func (p *pushStreamV2) writeErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if closeErr := p.closedErr(); closeErr != nil {
+		return closeErr
+	}
+	if c, ok := p.conn.(closeErrorer); ok {
+		if closeErr := c.closeError(p.streamID); closeErr != nil {
+			return closeErr
+		}
+	}
+	return err
+}
+
+/************
+ * net.Conn *
+ ************/
+
+func (p *pushStreamV2) LocalAddr() net.Addr {
+	return localStreamAddr(p.conn, p.streamID)
+}
+
+func (p *pushStreamV2) RemoteAddr() net.Addr {
+	return remoteStreamAddr(p.conn, p.streamID)
+}
+
+func (p *pushStreamV2) SetDeadline(t time.Time) error {
+	return p.SetWriteDeadline(t)
+}
+
+// SetReadDeadline has no effect, as pushes
+// are unidirectional, so reads never block.
+func (p *pushStreamV2) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (p *pushStreamV2) SetWriteDeadline(t time.Time) error {
+	p.deadline.set(t)
+	return nil
+}
+
+// writeHeader is used to send HTTP headers to the
+// client. Headers which cannot be sent end the
+// stream, as with headersFailed.
+func (p *pushStreamV2) writeHeader() error {
+	if len(p.header) == 0 || p.closed() || p.state.ClosedHere() {
+		return nil
 	}
 
 	header := new(headersFrameV2)
 	header.StreamID = p.streamID
 	header.Header = cloneHeader(p.header)
+	if err := checkHeaders(header.Header); err != nil {
+		return p.headersFailed(err)
+	}
 	for name := range header.Header {
 		p.header.Del(name)
 	}
-	p.output <- header
+	sendFrame(p.output, p.stop, header)
+	return nil
+}
+
+// headersFailed ends the push, as headers set for it
+// cannot be sent, resetting it with an INTERNAL_ERROR.
+// err is returned, and is given by any later writes.
+func (p *pushStreamV2) headersFailed(err error) error {
+	p.Lock()
+	if p.closeErr == nil {
+		p.closeErr = err
+	}
+	p.Unlock()
+	if conn, ok := p.conn.(*connV2); ok {
+		conn.resetStream(p, RST_STREAM_INTERNAL_ERROR)
+	}
+	return err
 }
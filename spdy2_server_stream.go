@@ -5,9 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // serverStreamV2 is a structure that implements the
@@ -17,16 +21,25 @@ type serverStreamV2 struct {
 	sync.Mutex
 	conn           Conn
 	streamID       StreamID
-	requestBody    *bytes.Buffer
+	requestBody    *requestBody
 	state          *StreamState
 	output         chan<- Frame
+	priority       Priority
 	request        *http.Request
 	handler        http.Handler
 	header         http.Header
 	unidirectional bool
 	responseCode   int
+	closeErr       error
 	stop           chan struct{}
 	wroteHeader    bool
+	buffer         *bytes.Buffer
+	deadline       writeDeadline
+	shut           uint32 // set to 1 once the stream has been shut; accessed atomically.
+	tags           streamTags
+	handlerTime    time.Duration
+	trailers       responseTrailers
+	pushes         []PushInfo // pushes made while serving the request.
 }
 
 /***********************
@@ -44,46 +57,66 @@ func (s *serverStreamV2) Write(inputData []byte) (int, error) {
 	}
 
 	if s.closed() || s.state.ClosedHere() {
-		return 0, errors.New("Error: Stream already closed.")
+		if err := s.closedErr(); err != nil {
+			return 0, err
+		}
+		return 0, ErrStreamClosed
+	}
+	if err := s.deadline.err(); err != nil {
+		return 0, err
 	}
 
 	// Copy the data locally to avoid any pointer issues.
 	data := make([]byte, len(inputData))
 	copy(data, inputData)
 
-	// Default to 200 response.
+	// Default to 200 response, buffering the start
+	// of the body so that small responses can be
+	// given a Content-Length and Content-Type.
 	if !s.wroteHeader {
-		s.WriteHeader(http.StatusOK)
+		s.wroteHeader = true
+		s.responseCode = http.StatusOK
+		s.buffer = new(bytes.Buffer)
 	}
 
-	// Send any new headers.
-	s.writeHeader()
-
-	// Chunk the response if necessary.
-	written := 0
-	for len(data) > MAX_DATA_SIZE {
-		dataFrame := new(dataFrameV2)
-		dataFrame.StreamID = s.streamID
-		dataFrame.Data = data[:MAX_DATA_SIZE]
-		s.output <- dataFrame
+	// Data which overflows the buffer is sent with the
+	// rest, so that its start can be used to determine
+	// the Content-Type.
+	if s.buffer != nil {
+		s.buffer.Write(data)
+		if s.buffer.Len() <= RESPONSE_BUFFER_SIZE {
+			return len(data), nil
+		}
+		if err := s.flushBuffer(false); err != nil {
+			return 0, s.writeErr(err)
+		}
+		return len(data), nil
+	}
 
-		written += MAX_DATA_SIZE
+	// Send any new headers.
+	if err := s.writeHeader(); err != nil {
+		return 0, err
 	}
 
-	n := len(data)
-	if n == 0 {
-		return written, nil
+	// Responses to HEAD requests have no body.
+	if s.head() {
+		return len(data), nil
 	}
 
-	dataFrame := new(dataFrameV2)
-	dataFrame.StreamID = s.streamID
-	dataFrame.Data = data
-	s.output <- dataFrame
+	n, err := s.writeData(data)
+	return n, s.writeErr(err)
+}
 
-	return written + n, nil
+// writeData sends data, split into
+// frames of at most MaxDataFrameSize.
+func (s *serverStreamV2) writeData(data []byte) (int, error) {
+	return writeDataV2(s.output, s.stop, s.streamID, data)
 }
 
-// WriteHeader is used to set the HTTP status code.
+// WriteHeader is used to set the HTTP status code. As with
+// net/http, the SYN_REPLY is delayed while the start of the
+// response is buffered, so that the Content-Type and
+// Content-Length can be determined.
 func (s *serverStreamV2) WriteHeader(code int) {
 	if s.unidirectional {
 		log.Println("Error: Stream is unidirectional.")
@@ -97,13 +130,31 @@ func (s *serverStreamV2) WriteHeader(code int) {
 
 	s.wroteHeader = true
 	s.responseCode = code
+	s.buffer = new(bytes.Buffer)
+}
+
+// head indicates whether the stream is
+// responding to a HEAD request.
+func (s *serverStreamV2) head() bool {
+	return s.request != nil && s.request.Method == "HEAD"
+}
+
+// writeReply sends the SYN_REPLY, with the status code and
+// any headers set so far. fin indicates that the response
+// has no body. Headers which cannot be sent end the stream,
+// as with headersFailed.
+func (s *serverStreamV2) writeReply(fin bool) error {
+	code := s.responseCode
 	s.header.Set("status", strconv.Itoa(code))
 	s.header.Set("version", "HTTP/1.1")
 
 	// Create the response SYN_REPLY.
 	synReply := new(synReplyFrameV2)
 	synReply.StreamID = s.streamID
-	synReply.Header = cloneHeader(s.header)
+	synReply.Header = s.trailers.without(s.header)
+	if err := checkHeaders(synReply.Header); err != nil {
+		return s.headersFailed(err)
+	}
 
 	// Clear the headers that have been sent.
 	for name := range synReply.Header {
@@ -111,44 +162,219 @@ func (s *serverStreamV2) WriteHeader(code int) {
 	}
 
 	// These responses have no body, so close the stream now.
-	if code == 204 || code == 304 || code/100 == 1 {
+	if fin || !bodyAllowed(code) {
 		synReply.Flags = FLAG_FIN
 		s.state.CloseHere()
 	}
 
-	s.output <- synReply
+	sendFrame(s.output, s.stop, synReply)
+	return nil
+}
+
+// headersFailed ends the stream, as headers set by the
+// handler cannot be sent, resetting it with an
+// INTERNAL_ERROR. err is returned, and is given by any
+// later writes to the stream.
+func (s *serverStreamV2) headersFailed(err error) error {
+	s.Lock()
+	if s.closeErr == nil {
+		s.closeErr = err
+	}
+	s.Unlock()
+	if conn, ok := s.conn.(*connV2); ok {
+		conn.resetStream(s, RST_STREAM_INTERNAL_ERROR)
+	}
+	return err
+}
+
+// Flush sends any buffered response data to the client
+// immediately, sending the SYN_REPLY first if it has not
+// yet been sent. Flush implements http.Flusher.
+func (s *serverStreamV2) Flush() {
+	if s.unidirectional || s.closed() || s.state.ClosedHere() {
+		return
+	}
+
+	if !s.wroteHeader {
+		s.WriteHeader(http.StatusOK)
+	}
+
+	if err := s.flushBuffer(false); err != nil {
+		log.Println(err)
+		return
+	}
+
+	// Send any new headers.
+	s.writeHeader()
+}
+
+// Push begins a server push of the resource at path, which
+// is resolved relative to the request's URL. Any headers in
+// header are sent with the push. The push is finished by
+// closing the returned writer. Push implements Pusher.
+func (s *serverStreamV2) Push(path string, header http.Header) (io.WriteCloser, error) {
+	return s.pushLabelled(path, header, pushCaller(1))
+}
+
+// pushLabelled makes a push, as with Push, reporting
+// it to the connection's hooks with the given label.
+func (s *serverStreamV2) pushLabelled(path string, header http.Header, label string) (io.WriteCloser, error) {
+	if s.closed() || s.state.ClosedHere() {
+		return nil, errors.New("Error: Origin stream is closed.")
+	}
+
+	u, err := s.request.URL.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := s.conn.Push(u.String(), s)
+	if err != nil {
+		return nil, err
+	}
+
+	push := w.(*pushStreamV2)
+	updateHeader(push.Header(), header)
+	info := PushInfo{Origin: s.streamID, StreamID: push.streamID, URL: u.String(), Label: label}
+	s.Lock()
+	s.pushes = append(s.pushes, info)
+	s.Unlock()
+	if conn, ok := s.conn.(*connV2); ok {
+		conn.hooks.push(info)
+	}
+	return &pushWriter{push, push.finish}, nil
+}
+
+// flushBuffer sends the SYN_REPLY delayed while buffering the
+// start of the response, followed by the buffered data. If
+// final is true, the handler has returned, so the buffer holds
+// the whole body.
+func (s *serverStreamV2) flushBuffer(final bool) error {
+	buf := s.buffer
+	if buf == nil {
+		return nil
+	}
+	s.buffer = nil
+
+	if s.closed() || s.state.ClosedHere() {
+		return nil
+	}
+
+	if _, ok := s.header["Content-Type"]; !ok && buf.Len() > 0 {
+		s.header.Set("Content-Type", http.DetectContentType(buf.Bytes()))
+	}
+	if _, ok := s.header["Content-Length"]; !ok && final && bodyAllowed(s.responseCode) {
+		s.header.Set("Content-Length", strconv.Itoa(buf.Len()))
+	}
+
+	// Any trailers are sent after the body, so
+	// cannot be declared once the reply is sent.
+	s.trailers.declare(s.header)
+	trailing := final && s.trailers.any(s.header)
+
+	if err := s.writeReply(final && !trailing && buf.Len() == 0 || final && s.head()); err != nil {
+		return err
+	}
+	if buf.Len() == 0 || s.head() {
+		return nil
+	}
+
+	// Send a small response in a single frame.
+	if final && !trailing && buf.Len() <= dataFrameSize() {
+		dataFrame := newDataFrameV2()
+		dataFrame.StreamID = s.streamID
+		dataFrame.Flags = FLAG_FIN
+		dataFrame.Data = buf.Bytes()
+		sendFrame(s.output, s.stop, dataFrame)
+		s.state.CloseHere()
+		return nil
+	}
+	_, err := s.writeData(buf.Bytes())
+	return err
 }
 
 /*****************
  * io.ReadCloser *
  *****************/
 
+// Close ends the stream. If the handler closes the
+// stream, the rest of the response is sent first.
 func (s *serverStreamV2) Close() error {
+	// Unblock the handler if it is reading the body. Data
+	// it has not read is discarded, making room for more.
+	s.Lock()
+	if c, ok := s.conn.(closeErrorer); ok && s.closeErr == nil {
+		s.closeErr = c.closeError(s.streamID)
+	}
+	if s.requestBody != nil {
+		if s.closeErr != nil {
+			s.requestBody.discard(s.closeErr)
+		} else {
+			s.requestBody.discard(ErrStreamClosed)
+		}
+	}
+	s.Unlock()
+
+	if !s.closed() && s.state.OpenHere() {
+		// Headers set since the reply was sent go before
+		// the end of the response. A stream closed by the
+		// connection, such as when it is reset, is no longer
+		// open here, and its handler may still be using them.
+		if s.wroteHeader {
+			s.writeHeader()
+		}
+		s.finishResponse()
+	}
+
+	// Frames are sent without the stream's lock, which
+	// the read loop needs to deliver frames.
 	s.Lock()
 	defer s.Unlock()
-	s.writeHeader()
-	if s.state != nil {
+	if atomic.CompareAndSwapUint32(&s.shut, 0, 1) {
+		// Free the stream's slot in the stream limit.
+		if conn, ok := s.conn.(*connV2); ok {
+			conn.requestStreamLimit.Close()
+		}
 		s.state.Close()
-		s.state = nil
 	}
-	if s.requestBody != nil {
-		s.requestBody.Reset()
-		s.requestBody = nil
-	}
-	s.output = nil
-	s.request = nil
-	s.handler = nil
-	s.header = nil
-	s.stop = nil
 	return nil
 }
 
-func (s *serverStreamV2) Read(out []byte) (int, error) {
-	n, err := s.requestBody.Read(out)
-	if err == io.EOF && s.state.OpenThere() {
-		return n, nil
+// CloseWrite ends the response, sending the reply if it
+// has not been sent, and then the FIN. The request body
+// can still be read.
+func (s *serverStreamV2) CloseWrite() error {
+	if s.unidirectional {
+		return errors.New("Error: Stream is unidirectional.")
+	}
+	if s.closed() || s.state.ClosedHere() {
+		if err := s.closedErr(); err != nil {
+			return err
+		}
+		return ErrStreamClosed
+	}
+
+	if s.wroteHeader {
+		if err := s.writeHeader(); err != nil {
+			return err
+		}
+	}
+	s.finishResponse()
+	return nil
+}
+
+// Reset ends the stream abruptly, sending a
+// RST_STREAM with the given status code.
+func (s *serverStreamV2) Reset(code StatusCode) error {
+	conn, ok := s.conn.(*connV2)
+	if !ok {
+		return errors.New("Error: Stream has no connection.")
 	}
-	return n, err
+	return conn.resetStream(s, code)
+}
+
+func (s *serverStreamV2) Read(out []byte) (int, error) {
+	return s.requestBody.Read(out)
 }
 
 /**********
@@ -170,19 +396,25 @@ func (s *serverStreamV2) ReceiveFrame(frame Frame) error {
 	// Process the frame depending on its type.
 	switch frame := frame.(type) {
 	case *dataFrameV2:
-		s.requestBody.Write(frame.Data)
+		s.requestBody.receive(frame.Data)
 		if frame.Flags.FIN() {
 			s.state.CloseThere()
+			s.requestBody.finish(nil)
 		}
 
 	case *synReplyFrameV2:
 		updateHeader(s.header, frame.Header)
 		if frame.Flags.FIN() {
 			s.state.CloseThere()
+			s.requestBody.finish(nil)
 		}
 
 	case *headersFrameV2:
 		updateHeader(s.header, frame.Header)
+		if frame.Flags.FIN() {
+			s.state.CloseThere()
+			s.requestBody.finish(nil)
+		}
 
 	case *windowUpdateFrameV2:
 		// Ignore.
@@ -200,59 +432,145 @@ func (s *serverStreamV2) ReceiveFrame(frame Frame) error {
 // and then the stream is cleaned
 // up and closed.
 func (s *serverStreamV2) Run() error {
-	// Make sure Request is prepared.
-	s.requestBody = new(bytes.Buffer)
-	s.request.Body = &readCloser{s.requestBody}
-
 	/***************
 	 *** HANDLER ***
 	 ***************/
-	s.handler.ServeHTTP(s, s.request)
+	if s.serve() && !s.closed() {
+		s.finishResponse()
+	}
+
+	s.complete()
+	return nil
+}
+
+// finishResponse sends the rest of the response,
+// and closes the stream at this end.
+func (s *serverStreamV2) finishResponse() {
+	// Send any buffered response, or an
+	// empty 200 response if the handler
+	// wrote nothing.
+	if !s.unidirectional && !s.wroteHeader {
+		s.wroteHeader = true
+		s.responseCode = http.StatusOK
+		s.buffer = new(bytes.Buffer)
+	}
+	if err := s.flushBuffer(true); err != nil {
+		log.Println(err)
+	}
 
-	// Close the stream with a SYN_REPLY if
-	// none has been sent, or an empty DATA
-	// frame, if a SYN_REPLY has been sent
-	// already.
-	// If the stream is already closed at
-	// this end, then nothing happens.
-	if !s.unidirectional {
-		if s.state.OpenHere() && !s.wroteHeader {
-			s.header.Set("status", "200")
-			s.header.Set("version", "HTTP/1.1")
-
-			// Create the response SYN_REPLY.
-			synReply := new(synReplyFrameV2)
-			synReply.Flags = FLAG_FIN
-			synReply.StreamID = s.streamID
-			synReply.Header = s.header
-
-			s.output <- synReply
-		} else if s.state.OpenHere() {
-			// Create the DATA.
-			data := new(dataFrameV2)
-			data.StreamID = s.streamID
-			data.Flags = FLAG_FIN
-			data.Data = []byte{}
-
-			s.output <- data
+	// Close the stream with an empty DATA
+	// frame, if the SYN_REPLY did not.
+	// SPDY/2's HEADERS frames cannot end the
+	// stream, so any trailers are sent in a
+	// HEADERS frame first. If the stream is
+	// already closed at this end, then
+	// nothing happens.
+	if !s.unidirectional && s.state.OpenHere() {
+		if trailer := s.trailers.take(s.header); trailer != nil {
+			if err := checkHeaders(trailer); err != nil {
+				log.Println(s.headersFailed(err))
+				return
+			}
+			header := new(headersFrameV2)
+			header.StreamID = s.streamID
+			header.Header = trailer
+
+			sendFrame(s.output, s.stop, header)
 		}
+
+		data := newDataFrameV2()
+		data.StreamID = s.streamID
+		data.Flags = FLAG_FIN
+		data.Data = []byte{}
+
+		sendFrame(s.output, s.stop, data)
 	}
 
 	// Clean up state.
 	s.state.CloseHere()
-	return nil
+}
+
+// serve calls the handler. If the handler panics, the
+// panic is logged and the stream is reset with an
+// INTERNAL_ERROR, leaving the rest of the connection
+// unaffected. serve reports whether the handler
+// returned normally.
+func (s *serverStreamV2) serve() (ok bool) {
+	defer func() {
+		if ok {
+			return
+		}
+		if err := recover(); err != nil && err != http.ErrAbortHandler {
+			buf := make([]byte, 64<<10)
+			buf = buf[:runtime.Stack(buf, false)]
+			log.Printf("Error: Panic serving stream %d%v: %v\n%s", s.streamID, &s.tags, err, buf)
+		}
+		if conn, ok := s.conn.(*connV2); ok {
+			conn.resetStream(s, RST_STREAM_INTERNAL_ERROR)
+		}
+	}()
+
+	if conn, ok := s.conn.(*connV2); ok {
+		start := conn.clock.Now()
+		defer func() {
+			s.handlerTime = conn.clock.Now().Sub(start)
+			conn.stats.handlerTimes.observeDuration(s.handlerTime)
+		}()
+	}
+
+	s.handler.ServeHTTP(s, s.request)
+	return true
+}
+
+// complete reports the request to the
+// connection's OnRequestComplete hook.
+func (s *serverStreamV2) complete() {
+	conn, ok := s.conn.(*connV2)
+	if !ok {
+		return
+	}
+
+	conn.Lock()
+	hooks := conn.hooks
+	conn.Unlock()
+
+	s.Lock()
+	pushes := append([]PushInfo(nil), s.pushes...)
+	s.Unlock()
+
+	hooks.requestComplete(RequestInfo{
+		StreamID: s.streamID,
+		Method:   s.request.Method,
+		URL:      s.request.URL.String(),
+		Status:   s.responseCode,
+		Duration: s.handlerTime,
+		Tags:     s.tags.copy(),
+		Pushes:   pushes,
+	})
 }
 
 func (s *serverStreamV2) State() *StreamState {
 	return s.state
 }
 
+func (s *serverStreamV2) Priority() Priority {
+	return s.priority
+}
+
 func (s *serverStreamV2) StreamID() StreamID {
 	return s.streamID
 }
 
+func (s *serverStreamV2) SetTag(key, value string) error {
+	return s.tags.set(key, value)
+}
+
+func (s *serverStreamV2) Tags() map[string]string {
+	return s.tags.copy()
+}
+
 func (s *serverStreamV2) closed() bool {
-	if s.conn == nil || s.state == nil || s.handler == nil {
+	if s.conn == nil || atomic.LoadUint32(&s.shut) == 1 {
 		return true
 	}
 	select {
@@ -263,21 +581,93 @@ func (s *serverStreamV2) closed() bool {
 	}
 }
 
-// writeHeader is used to flush HTTP headers.
-func (s *serverStreamV2) writeHeader() {
-	if len(s.header) == 0 || s.unidirectional {
-		return
+// closedErr returns the reason the stream was
+// closed, if it was closed by the connection.
+func (s *serverStreamV2) closedErr() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.closeErr
+}
+
+// writeErr returns the error to be given for a Write which
+// failed with err. If the stream failed because it or its
+// connection was closed, this is the reason it was closed,
+// which may not yet have been recorded when the Write gave
+// up.
+func (s *serverStreamV2) writeErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if closeErr := s.closedErr(); closeErr != nil {
+		return closeErr
+	}
+	if c, ok := s.conn.(closeErrorer); ok {
+		if closeErr := c.closeError(s.streamID); closeErr != nil {
+			return closeErr
+		}
+	}
+	return err
+}
+
+/************
+ * net.Conn *
+ ************/
+
+func (s *serverStreamV2) LocalAddr() net.Addr {
+	return localStreamAddr(s.conn, s.streamID)
+}
+
+func (s *serverStreamV2) RemoteAddr() net.Addr {
+	return remoteStreamAddr(s.conn, s.streamID)
+}
+
+func (s *serverStreamV2) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for reads
+// of the request body.
+func (s *serverStreamV2) SetReadDeadline(t time.Time) error {
+	s.requestBody.setDeadline(t)
+	return nil
+}
+
+func (s *serverStreamV2) SetWriteDeadline(t time.Time) error {
+	s.deadline.set(t)
+	return nil
+}
+
+// writeHeader is used to flush HTTP headers. Headers
+// which cannot be sent end the stream, as with
+// headersFailed.
+func (s *serverStreamV2) writeHeader() error {
+	// Headers set while the response is being
+	// buffered are sent in the SYN_REPLY.
+	if len(s.header) == 0 || s.unidirectional || s.buffer != nil {
+		return nil
+	}
+
+	// Trailers are held back until the
+	// end of the response.
+	trailerless := s.trailers.without(s.header)
+	if len(trailerless) == 0 {
+		return nil
+	}
+	if err := checkHeaders(trailerless); err != nil {
+		return s.headersFailed(err)
 	}
 
 	// Create the HEADERS frame.
 	header := new(headersFrameV2)
 	header.StreamID = s.streamID
-	header.Header = cloneHeader(s.header)
+	header.Header = trailerless
 
 	// Clear the headers that have been sent.
 	for name := range header.Header {
 		s.header.Del(name)
 	}
 
-	s.output <- header
+	sendFrame(s.output, s.stop, header)
+	return nil
 }
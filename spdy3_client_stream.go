@@ -3,8 +3,11 @@ package spdy
 import (
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // clientStreamV3 is a structure that implements
@@ -17,12 +20,19 @@ type clientStreamV3 struct {
 	flow         *flowControl
 	state        *StreamState
 	output       chan<- Frame
+	priority     Priority
 	request      *http.Request
 	receiver     Receiver
 	header       http.Header
 	responseCode int
 	stop         <-chan struct{}
 	finished     chan struct{}
+	err          error
+	body         *requestBody
+	deadline     writeDeadline
+	shut         uint32 // set to 1 once the stream has been shut; accessed atomically.
+	tags         streamTags
+	gotReply     bool // whether the SYN_REPLY has been received.
 }
 
 /***********************
@@ -36,7 +46,10 @@ func (s *clientStreamV3) Header() http.Header {
 // Write is one method with which request data is sent.
 func (s *clientStreamV3) Write(inputData []byte) (int, error) {
 	if s.closed() || s.state.ClosedHere() {
-		return 0, errors.New("Error: Stream already closed.")
+		return 0, ErrStreamClosed
+	}
+	if err := s.deadline.err(); err != nil {
+		return 0, err
 	}
 
 	// Copy the data locally to avoid any pointer issues.
@@ -44,19 +57,22 @@ func (s *clientStreamV3) Write(inputData []byte) (int, error) {
 	copy(data, inputData)
 
 	// Send any new headers.
-	s.writeHeader()
+	if err := s.writeHeader(); err != nil {
+		return 0, err
+	}
 
 	// Chunk the response if necessary.
 	// Data is sent to the flow control to
 	// ensure that the protocol is followed.
 	written := 0
-	for len(data) > MAX_DATA_SIZE {
-		n, err := s.flow.Write(data[:MAX_DATA_SIZE])
+	size := dataFrameSize()
+	for len(data) > size {
+		n, err := s.flow.Write(data[:size])
 		if err != nil {
 			return written, err
 		}
 		written += n
-		data = data[MAX_DATA_SIZE:]
+		data = data[size:]
 	}
 
 	n, err := s.flow.Write(data)
@@ -74,30 +90,115 @@ func (s *clientStreamV3) WriteHeader(int) {
  * io.ReadCloser *
  *****************/
 
-// Close is used to stop the stream safely.
+// Close is used to stop the stream safely. If the
+// stream was left open for writing, it is closed
+// with a FIN, or reset if data is still held back
+// by flow control.
 func (s *clientStreamV3) Close() error {
-	s.Lock()
-	defer s.Unlock()
+	// Frames are sent without the stream's lock, which
+	// the read loop needs to deliver frames, so only the
+	// first call to set shut sends them.
+	open := !s.closed()
+	shut := atomic.SwapUint32(&s.shut, 1) == 1
+
+	// Writes waiting for the window give up.
+	s.flow.Stop()
+
 	s.writeHeader()
-	if s.state != nil {
+	if !shut {
+		// Free the stream's slot in the stream limit.
+		if conn, ok := s.conn.(*connV3); ok {
+			conn.requestStreamLimit.Close()
+		}
+		if open && s.state.OpenHere() {
+			if s.flow.Flush(); !s.flow.Paused() {
+				s.flow.Finish()
+				s.state.CloseHere()
+			}
+		}
+		// Cancel the request if the response
+		// has not yet finished.
+		if open && (s.state.OpenThere() || s.state.OpenHere()) {
+			s.cancel(false)
+		}
 		s.state.Close()
-		s.state = nil
 	}
 	if s.flow != nil {
 		s.flow.Close()
-		s.flow = nil
 	}
-	s.output = nil
-	s.request = nil
-	s.receiver = nil
-	s.header = nil
-	s.stop = nil
+	if s.body != nil {
+		// Reads fail with the reason the stream
+		// ended, if it was reset.
+		s.Lock()
+		err := s.err
+		s.Unlock()
+		if err == nil {
+			err = ErrStreamClosed
+		}
+		s.body.discard(err)
+	}
 	return nil
 }
 
+// CloseWrite half-closes the stream, sending a FIN once any
+// data held back by flow control has been sent, which it
+// waits for, as a Write would. The response can still be
+// read.
+func (s *clientStreamV3) CloseWrite() error {
+	if s.closed() || s.state.ClosedHere() {
+		return ErrStreamClosed
+	}
+
+	if err := s.writeHeader(); err != nil {
+		return err
+	}
+	s.flow.Finish()
+
+	// The stream stays open here until the FIN has
+	// been sent, so that updates to the window are
+	// still accepted.
+	s.flow.Wait()
+	if s.flow.Paused() {
+		if err := s.deadline.err(); err != nil {
+			return err
+		}
+		return ErrStreamClosed
+	}
+	s.state.CloseHere()
+	return nil
+}
+
+// Reset ends the stream abruptly, sending a
+// RST_STREAM with the given status code. Resetting
+// the stream with CANCEL is the same as Cancel.
+func (s *clientStreamV3) Reset(code StatusCode) error {
+	conn, ok := s.conn.(*connV3)
+	if !ok {
+		return errors.New("Error: Stream has no connection.")
+	}
+	return conn.resetStream(s, code)
+}
+
+// Cancel abandons the request, resetting the stream with
+// CANCEL. Run returns ErrStreamCancelled, as do reads of
+// the response body once any data already received has
+// been read. Any response data still arriving is discarded.
+// Cancelling a finished request has no effect.
+func (s *clientStreamV3) Cancel() error {
+	if err := s.Reset(RST_STREAM_CANCEL); err != ErrStreamClosed {
+		return err
+	}
+	return nil
+}
+
+// Read reads the response body of a stream requested
+// without a Receiver. Other streams cannot be read, as
+// their response is given to the Receiver.
 func (s *clientStreamV3) Read(out []byte) (int, error) {
-	// TODO
-	return 0, nil
+	if s.body == nil {
+		return 0, errors.New("Error: Stream has a Receiver.")
+	}
+	return s.body.Read(out)
 }
 
 /**********
@@ -119,46 +220,75 @@ func (s *clientStreamV3) ReceiveFrame(frame Frame) error {
 	// Process the frame depending on its type.
 	switch frame := frame.(type) {
 	case *dataFrameV3:
+		// The response's data follows its SYN_REPLY.
+		if !s.gotReply {
+			return errNoReply
+		}
 
-		// Extract the data.
-		data := frame.Data
+		// Extract the data, which is copied if the
+		// receiver may keep it, as the frame's buffer
+		// is reused once the frame has been handled.
+		data := receivedData(s.receiver, frame.Data, frame.payload != nil)
 		if data == nil {
 			data = []byte{}
 		}
 
-		// Give to the client.
+		// Give to the client. A response body read from the
+		// stream regrows the window as it is read, but other
+		// receivers consume the data at once.
+		s.flow.Receive(frame.Data, frame.Flags.FIN())
 		s.receiver.ReceiveData(s.request, data, frame.Flags.FIN())
-		s.flow.Receive(frame.Data)
+		if s.body == nil {
+			s.flow.Consumed(len(frame.Data))
+		}
 
 		if frame.Flags.FIN() {
 			s.state.CloseThere()
-			close(s.finished)
+			s.finish(nil)
 		}
 
 	case *synReplyFrameV3:
+		s.gotReply = true
 		s.receiver.ReceiveHeader(s.request, frame.Header)
 
 		if frame.Flags.FIN() {
 			s.state.CloseThere()
-			close(s.finished)
+			s.finish(nil)
 		}
 
 	case *headersFrameV3:
-		s.receiver.ReceiveHeader(s.request, frame.Header)
+		// A HEADERS frame which ends the response
+		// after the SYN_REPLY holds the trailers.
+		if frame.Flags.FIN() && s.gotReply {
+			receiveTrailer(s.receiver, s.request, frame.Header)
+		} else {
+			s.receiver.ReceiveHeader(s.request, frame.Header)
+		}
+
+		if frame.Flags.FIN() {
+			s.state.CloseThere()
+			s.finish(nil)
+		}
 
 	case *windowUpdateFrameV3:
-		err := s.flow.UpdateWindow(frame.DeltaWindowSize)
-		if err != nil {
-			reply := new(rstStreamFrameV3)
-			reply.StreamID = s.streamID
-			reply.Status = RST_STREAM_FLOW_CONTROL_ERROR
-			s.output <- reply
+		// A window which overflows is reset by the
+		// connection, which ends the stream.
+		if err := s.flow.UpdateWindow(frame.DeltaWindowSize); err != nil {
+			return err
 		}
 
 	default:
 		return errors.New(fmt.Sprintf("Received unknown frame of type %T.", frame))
 	}
 
+	// Cancel the request if the receiver
+	// has rejected the response.
+	if a, ok := s.receiver.(aborter); ok {
+		if err := a.aborted(); err != nil {
+			s.abort(err)
+		}
+	}
+
 	return nil
 }
 
@@ -172,6 +302,16 @@ func (s *clientStreamV3) Run() error {
 
 	// Receive and process inbound frames.
 	<-s.finished
+	if s.err != nil {
+		return s.err
+	}
+
+	// A stream requested without a Receiver stays open
+	// for writing until it is closed, and may still have
+	// data to send.
+	if s.body != nil {
+		return nil
+	}
 
 	// Make sure any queued data has been sent.
 	if s.flow.Paused() {
@@ -183,16 +323,82 @@ func (s *clientStreamV3) Run() error {
 	return nil
 }
 
+// abort cancels the request, causing Run to return
+// the given error. abort must be called with the
+// stream's lock held.
+func (s *clientStreamV3) abort(err error) {
+	if s.state.OpenThere() {
+		s.cancel(true)
+	}
+	if conn, ok := s.conn.(*connV3); ok && err == ErrResponseTooLarge {
+		conn.stats.responseTooLarge()
+	}
+	s.state.Close()
+	s.finish(err)
+}
+
+// cancel resets the stream with CANCEL, and discards the
+// rest of the response. The RST_STREAM is queued without
+// waiting. If locked is set, the stream's lock is held, so
+// the connection's lock cannot be taken, and the response
+// is discarded from a new goroutine.
+func (s *clientStreamV3) cancel(locked bool) {
+	rst := new(rstStreamFrameV3)
+	rst.StreamID = s.streamID
+	rst.Status = RST_STREAM_CANCEL
+	s.flow.sendControl(rst)
+	if conn, ok := s.conn.(*connV3); ok {
+		if locked {
+			go conn.cancelRequest(s.streamID)
+		} else {
+			conn.cancelRequest(s.streamID)
+		}
+	}
+}
+
+// fail ends the stream locally, causing Run
+// to return the given error.
+func (s *clientStreamV3) fail(err error) {
+	s.Lock()
+	s.finish(err)
+	s.Unlock()
+}
+
+// finish marks the response as complete, waking
+// Run. finish must be called with the stream's
+// lock held, and is safe to call multiple times.
+func (s *clientStreamV3) finish(err error) {
+	select {
+	case <-s.finished:
+		return
+	default:
+	}
+	s.err = err
+	close(s.finished)
+}
+
 func (s *clientStreamV3) State() *StreamState {
 	return s.state
 }
 
+func (s *clientStreamV3) Priority() Priority {
+	return s.priority
+}
+
 func (s *clientStreamV3) StreamID() StreamID {
 	return s.streamID
 }
 
+func (s *clientStreamV3) SetTag(key, value string) error {
+	return s.tags.set(key, value)
+}
+
+func (s *clientStreamV3) Tags() map[string]string {
+	return s.tags.copy()
+}
+
 func (s *clientStreamV3) closed() bool {
-	if s.conn == nil || s.state == nil || s.receiver == nil {
+	if s.conn == nil || atomic.LoadUint32(&s.shut) == 1 {
 		return true
 	}
 	select {
@@ -203,21 +409,75 @@ func (s *clientStreamV3) closed() bool {
 	}
 }
 
-// writeHeader is used to flush HTTP headers.
-func (s *clientStreamV3) writeHeader() {
-	if len(s.header) == 0 {
-		return
+/************
+ * net.Conn *
+ ************/
+
+func (s *clientStreamV3) LocalAddr() net.Addr {
+	return localStreamAddr(s.conn, s.streamID)
+}
+
+func (s *clientStreamV3) RemoteAddr() net.Addr {
+	return remoteStreamAddr(s.conn, s.streamID)
+}
+
+func (s *clientStreamV3) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for reads of a
+// stream requested without a Receiver.
+func (s *clientStreamV3) SetReadDeadline(t time.Time) error {
+	if s.body == nil {
+		return errors.New("Error: Stream has a Receiver.")
+	}
+	s.body.setDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for writes. Data
+// written before the deadline but held back by flow
+// control is still sent once the window allows, but a
+// write waiting for the window fails once it passes.
+func (s *clientStreamV3) SetWriteDeadline(t time.Time) error {
+	s.deadline.set(t)
+	return nil
+}
+
+// writeHeader is used to flush HTTP headers. Headers
+// which cannot be sent end the stream, as with
+// headersFailed.
+func (s *clientStreamV3) writeHeader() error {
+	if len(s.header) == 0 || s.state.ClosedHere() {
+		return nil
 	}
 
 	// Create the HEADERS frame.
 	header := new(headersFrameV3)
 	header.StreamID = s.streamID
 	header.Header = cloneHeader(s.header)
+	if err := checkHeaders(header.Header); err != nil {
+		return s.headersFailed(err)
+	}
 
 	// Clear the headers that have been sent.
 	for name := range header.Header {
 		s.header.Del(name)
 	}
 
-	s.output <- header
+	sendFrame(s.output, s.stop, header)
+	return nil
+}
+
+// headersFailed ends the stream, as headers set for the
+// request cannot be sent, resetting it with an
+// INTERNAL_ERROR. err is returned, and is given as the
+// reason the stream ended.
+func (s *clientStreamV3) headersFailed(err error) error {
+	s.fail(err)
+	if conn, ok := s.conn.(*connV3); ok {
+		conn.resetStream(s, RST_STREAM_INTERNAL_ERROR)
+	}
+	return err
 }
@@ -9,38 +9,83 @@ import (
 	"io"
 	"net/http"
 	"sort"
+	"sync"
+	"time"
 )
 
-// ReadFrame reads and parses a frame from reader.
-func readFrameV3(reader *bufio.Reader) (frame Frame, err error) {
-	start, err := reader.Peek(4)
+// frameLengthsV3 gives the valid lengths of
+// each type of SPDY/3 control frame.
+var frameLengthsV3 = map[uint16]frameLength{
+	SYN_STREAMv3:    {"SYN_STREAM", 10, MAX_FRAME_SIZE - 8},
+	SYN_REPLYv3:     {"SYN_REPLY", 4, MAX_FRAME_SIZE - 8},
+	RST_STREAMv3:    {"RST_STREAM", 8, 8},
+	SETTINGSv3:      {"SETTINGS", 4, MAX_FRAME_SIZE - 8},
+	PINGv3:          {"PING", 4, 4},
+	GOAWAYv3:        {"GOAWAY", 4, 8},
+	HEADERSv3:       {"HEADERS", 4, MAX_FRAME_SIZE - 8},
+	WINDOW_UPDATEv3: {"WINDOW_UPDATE", 8, 8},
+	CREDENTIALv3:    {"CREDENTIAL", 6, MAX_FRAME_SIZE - 8},
+}
+
+// ReadFrame reads and parses a frame from reader. If
+// pool is non-nil, fixed-size control frames are taken
+// from it, rather than allocated. Frames larger than
+// limit bytes are rejected before they are read, as are
+// control frames whose lengths are invalid for their
+// type. Control frames of unknown types are skipped,
+// giving an *unknownFrame error.
+func readFrameV3(reader *bufio.Reader, pool *framePoolV3, limit int) (frame Frame, err error) {
+	start, err := reader.Peek(8)
 	if err != nil {
 		return nil, err
 	}
 
-	if start[0] != 128 {
+	// Check the frame's size before reading it,
+	// so that no space is allocated for it.
+	length := int(bytesToUint24(start[5:8]))
+	if 8+length > limit {
+		return nil, &oversizedFrame{8 + length, limit}
+	}
+
+	if start[0]&0x80 == 0 {
 		frame = new(dataFrameV3)
 		_, err = frame.ReadFrom(reader)
 		return frame, err
 	}
 
-	switch bytesToUint16(start[2:4]) {
+	// Skip control frames of other versions.
+	if version := (uint16(start[0]&0x7f) << 8) + uint16(start[1]); version != 3 {
+		return nil, skipFrame(reader)
+	}
+
+	// Skip control frames of unknown types, and
+	// check the lengths of the others.
+	frameType := bytesToUint16(start[2:4])
+	lengths, ok := frameLengthsV3[frameType]
+	if !ok {
+		return nil, skipUnknownFrame(reader)
+	}
+	if err := lengths.check(length); err != nil {
+		return nil, err
+	}
+
+	switch frameType {
 	case SYN_STREAMv3:
 		frame = new(synStreamFrameV3)
 	case SYN_REPLYv3:
 		frame = new(synReplyFrameV3)
 	case RST_STREAMv3:
-		frame = new(rstStreamFrameV3)
+		frame = pool.rstStream()
 	case SETTINGSv3:
 		frame = new(settingsFrameV3)
 	case PINGv3:
-		frame = new(pingFrameV3)
+		frame = pool.ping()
 	case GOAWAYv3:
 		frame = new(goawayFrameV3)
 	case HEADERSv3:
 		frame = new(headersFrameV3)
 	case WINDOW_UPDATEv3:
-		frame = new(windowUpdateFrameV3)
+		frame = pool.windowUpdate()
 	case CREDENTIALv3:
 		frame = new(credentialFrameV3)
 
@@ -52,6 +97,149 @@ func readFrameV3(reader *bufio.Reader) (frame Frame, err error) {
 	return frame, err
 }
 
+// streamIDV3 returns the stream ID of frames which
+// are scoped to a single stream, and false for frames
+// which apply to the whole connection.
+func streamIDV3(frame Frame) (StreamID, bool) {
+	switch frame := frame.(type) {
+	case *synStreamFrameV3:
+		return frame.StreamID, true
+	case *synReplyFrameV3:
+		return frame.StreamID, true
+	case *rstStreamFrameV3:
+		return frame.StreamID, true
+	case *headersFrameV3:
+		return frame.StreamID, true
+	case *windowUpdateFrameV3:
+		// Updates to stream 0 apply to the session window.
+		return frame.StreamID, !frame.StreamID.Zero()
+	case *dataFrameV3:
+		return frame.StreamID, true
+	default:
+		return 0, false
+	}
+}
+
+// frameTypeV3 returns the type of a SPDY/3 frame,
+// with DATA frames given type 0, for statistics.
+func frameTypeV3(frame Frame) int {
+	switch frame.(type) {
+	case *dataFrameV3:
+		return 0
+	case *synStreamFrameV3:
+		return SYN_STREAMv3
+	case *synReplyFrameV3:
+		return SYN_REPLYv3
+	case *rstStreamFrameV3:
+		return RST_STREAMv3
+	case *settingsFrameV3:
+		return SETTINGSv3
+	case *pingFrameV3:
+		return PINGv3
+	case *goawayFrameV3:
+		return GOAWAYv3
+	case *headersFrameV3:
+		return HEADERSv3
+	case *windowUpdateFrameV3:
+		return WINDOW_UPDATEv3
+	case *credentialFrameV3:
+		return CREDENTIALv3
+	default:
+		return -1
+	}
+}
+
+// frameSizesV3 returns the size of a SPDY/3 frame's
+// data and of its compressed header block, for
+// statistics. Either is -1 if the frame has none.
+func frameSizesV3(frame Frame) (data, header int) {
+	switch frame := frame.(type) {
+	case *dataFrameV3:
+		return len(frame.Data), -1
+	case *synStreamFrameV3:
+		return -1, len(frame.rawHeader)
+	case *synReplyFrameV3:
+		return -1, len(frame.rawHeader)
+	case *headersFrameV3:
+		return -1, len(frame.rawHeader)
+	default:
+		return -1, -1
+	}
+}
+
+// flushesV3 reports whether a SPDY/3 frame should be
+// written to the connection immediately, rather than
+// buffered with any which follow it. This keeps the
+// latency of PINGs and the ends of streams low.
+func flushesV3(frame Frame) bool {
+	switch frame := frame.(type) {
+	case *dataFrameV3:
+		return frame.Flags.FIN()
+	case *pingFrameV3:
+		return true
+	default:
+		return false
+	}
+}
+
+// framePoolV3 holds freelists of the fixed-size
+// control frames, to reduce the allocations made
+// by connections which receive many of them. A
+// nil framePoolV3 simply allocates new frames.
+type framePoolV3 struct {
+	pings         sync.Pool
+	rstStreams    sync.Pool
+	windowUpdates sync.Pool
+}
+
+func (pool *framePoolV3) ping() *pingFrameV3 {
+	if pool != nil {
+		if frame, ok := pool.pings.Get().(*pingFrameV3); ok {
+			return frame
+		}
+	}
+	return new(pingFrameV3)
+}
+
+func (pool *framePoolV3) rstStream() *rstStreamFrameV3 {
+	if pool != nil {
+		if frame, ok := pool.rstStreams.Get().(*rstStreamFrameV3); ok {
+			return frame
+		}
+	}
+	return new(rstStreamFrameV3)
+}
+
+func (pool *framePoolV3) windowUpdate() *windowUpdateFrameV3 {
+	if pool != nil {
+		if frame, ok := pool.windowUpdates.Get().(*windowUpdateFrameV3); ok {
+			return frame
+		}
+	}
+	return new(windowUpdateFrameV3)
+}
+
+// recycle returns the frame to its freelist, if it
+// is one of the pooled types. The frame must not be
+// used by the caller, or anyone else, afterwards.
+func (pool *framePoolV3) recycle(frame Frame) {
+	if pool == nil {
+		return
+	}
+
+	switch frame := frame.(type) {
+	case *pingFrameV3:
+		*frame = pingFrameV3{}
+		pool.pings.Put(frame)
+	case *rstStreamFrameV3:
+		*frame = rstStreamFrameV3{}
+		pool.rstStreams.Put(frame)
+	case *windowUpdateFrameV3:
+		*frame = windowUpdateFrameV3{}
+		pool.windowUpdates.Put(frame)
+	}
+}
+
 /******************
  *** SYN_STREAM ***
  ******************/
@@ -126,8 +314,8 @@ func (frame *synStreamFrameV3) ReadFrom(reader io.Reader) (int64, error) {
 	// Get and check length.
 	length := int(bytesToUint24(data[5:8]))
 	if length < 10 {
-		return 18, &incorrectDataLength{length, 10}
-	} else if length > MAX_FRAME_SIZE-18 {
+		return 18, &malformedFrame{"SYN_STREAM", length, 10}
+	} else if length > MAX_FRAME_SIZE-8 {
 		return 18, frameTooLarge
 	}
 
@@ -140,7 +328,7 @@ func (frame *synStreamFrameV3) ReadFrom(reader io.Reader) (int64, error) {
 	frame.Flags = Flags(data[4])
 	frame.StreamID = StreamID(bytesToUint32(data[8:12]))
 	frame.AssocStreamID = StreamID(bytesToUint32(data[12:16]))
-	frame.Priority = Priority(data[16] >> 5)
+	frame.Priority = DecodePriority(3, data[16])
 	frame.Slot = data[17]
 	frame.rawHeader = header
 
@@ -200,6 +388,9 @@ func (frame *synStreamFrameV3) WriteTo(writer io.Writer) (int64, error) {
 
 	header := frame.rawHeader
 	length := 10 + len(header)
+	if length > MAX_FRAME_SIZE-8 {
+		return 0, frameTooLarge
+	}
 	out := make([]byte, 18)
 
 	out[0] = 128                       // Control bit and Version
@@ -303,7 +494,7 @@ func (frame *synReplyFrameV3) ReadFrom(reader io.Reader) (int64, error) {
 	// Get and check length.
 	length := int(bytesToUint24(data[5:8]))
 	if length < 4 {
-		return 12, &incorrectDataLength{length, 4}
+		return 12, &malformedFrame{"SYN_REPLY", length, 4}
 	} else if length > MAX_FRAME_SIZE-8 {
 		return 12, frameTooLarge
 	}
@@ -318,6 +509,10 @@ func (frame *synReplyFrameV3) ReadFrom(reader io.Reader) (int64, error) {
 	frame.StreamID = StreamID(bytesToUint32(data[8:12]))
 	frame.rawHeader = header
 
+	if frame.StreamID.Zero() {
+		return 12, streamIdIsZero
+	}
+
 	return int64(length + 8), nil
 }
 
@@ -355,6 +550,9 @@ func (frame *synReplyFrameV3) WriteTo(writer io.Writer) (int64, error) {
 
 	header := frame.rawHeader
 	length := 4 + len(header)
+	if length > MAX_FRAME_SIZE-8 {
+		return 0, frameTooLarge
+	}
 	out := make([]byte, 12)
 
 	out[0] = 128                  // Control bit and Version
@@ -424,7 +622,7 @@ func (frame *rstStreamFrameV3) ReadFrom(reader io.Reader) (int64, error) {
 	// Get and check length.
 	length := int(bytesToUint24(data[5:8]))
 	if length != 8 {
-		return 16, &incorrectDataLength{length, 8}
+		return 16, &malformedFrame{"RST_STREAM", length, 8}
 	} else if length > MAX_FRAME_SIZE-8 {
 		return 16, frameTooLarge
 	}
@@ -434,12 +632,20 @@ func (frame *rstStreamFrameV3) ReadFrom(reader io.Reader) (int64, error) {
 		return 16, &invalidField{"Unused", 1, 0}
 	}
 
+	// Check Flags.
+	if (data[4]) != 0 {
+		return 16, &invalidField{"Flags", int(data[4]), 0}
+	}
+
 	frame.StreamID = StreamID(bytesToUint32(data[8:12]))
 	frame.Status = StatusCode(bytesToUint32(data[12:16]))
 
 	if !frame.StreamID.Valid() {
 		return 16, streamIdTooLarge
 	}
+	if frame.StreamID.Zero() {
+		return 16, streamIdIsZero
+	}
 
 	return 16, nil
 }
@@ -459,6 +665,9 @@ func (frame *rstStreamFrameV3) WriteTo(writer io.Writer) (int64, error) {
 	if !frame.StreamID.Valid() {
 		return 0, streamIdTooLarge
 	}
+	if frame.StreamID.Zero() {
+		return 0, streamIdIsZero
+	}
 
 	out := make([]byte, 16)
 
@@ -491,8 +700,9 @@ func (frame *rstStreamFrameV3) WriteTo(writer io.Writer) (int64, error) {
  *** SETTINGS ***
  ****************/
 type settingsFrameV3 struct {
-	Flags    Flags
-	Settings Settings
+	Flags        Flags
+	Settings     Settings
+	Experimental bool // Allow settings with unrecognised IDs.
 }
 
 func (frame *settingsFrameV3) Add(Flags Flags, id uint32, value uint32) {
@@ -532,15 +742,16 @@ func (frame *settingsFrameV3) ReadFrom(reader io.Reader) (int64, error) {
 	// Get and check length.
 	length := int(bytesToUint24(data[5:8]))
 	if length < 4 {
-		return 12, &incorrectDataLength{length, 8}
+		return 12, &malformedFrame{"SETTINGS", length, 8}
 	} else if length > MAX_FRAME_SIZE-8 {
 		return 12, frameTooLarge
 	}
 
-	// Check size.
-	numSettings := int(bytesToUint32(data[8:12]))
-	if length != 4+(8*numSettings) {
-		return 12, &incorrectDataLength{length, 4 + (8 * numSettings)}
+	// Check size. The number of entries is found from the
+	// length, so that a large number cannot overflow.
+	numSettings := (length - 4) / 8
+	if entries := bytesToUint32(data[8:12]); (length-4)%8 != 0 || uint32(numSettings) != entries {
+		return 12, &malformedFrame{"SETTINGS", length, 4 + (8 * int(entries))}
 	}
 
 	// Read in data.
@@ -551,13 +762,32 @@ func (frame *settingsFrameV3) ReadFrom(reader io.Reader) (int64, error) {
 
 	frame.Flags = Flags(data[4])
 	frame.Settings = make(Settings)
+	frame.Experimental = false
+	zero := false
 	for i := 0; i < numSettings; i++ {
 		j := i * 8
 		setting := decodeSettingV3(settings[j:])
 		if setting == nil {
 			return int64(length), errors.New("Error: Failed to parse settings.")
 		}
+		// Settings with ID 0 are dropped, but the rest
+		// of the frame is still returned, so that the
+		// connection can apply it.
+		if setting.ID == 0 {
+			zero = true
+			continue
+		}
 		frame.Settings[setting.ID] = setting
+
+		// Unrecognised settings are kept, so the
+		// frame can be written as it was received.
+		if !settingRecognised(setting.ID) {
+			frame.Experimental = true
+		}
+	}
+
+	if zero {
+		return int64(length), settingIdIsZero
 	}
 
 	return int64(length), nil
@@ -589,9 +819,21 @@ func (frame *settingsFrameV3) String() string {
 }
 
 func (frame *settingsFrameV3) WriteTo(writer io.Writer) (int64, error) {
+	for id := range frame.Settings {
+		if id == 0 {
+			return 0, &invalidField{"Setting ID", 0, 1}
+		}
+		if !settingRecognised(id) && !frame.Experimental {
+			return 0, errors.New(fmt.Sprintf("Error: Setting ID %d is not recognised.", id))
+		}
+	}
+
 	settings := encodeSettingsV3(frame.Settings)
 	numSettings := uint32(len(frame.Settings))
 	length := 4 + len(settings)
+	if length > MAX_FRAME_SIZE-8 {
+		return 0, frameTooLarge
+	}
 	out := make([]byte, 12)
 
 	out[0] = 128                     // Control bit and Version
@@ -669,6 +911,7 @@ func encodeSettingsV3(s Settings) []byte {
  ************/
 type pingFrameV3 struct {
 	PingID uint32
+	buf    [12]byte // space to read and write the frame without allocating.
 }
 
 func (frame *pingFrameV3) Compress(comp Compressor) error {
@@ -680,8 +923,8 @@ func (frame *pingFrameV3) Decompress(decomp Decompressor) error {
 }
 
 func (frame *pingFrameV3) ReadFrom(reader io.Reader) (int64, error) {
-	data, err := read(reader, 12)
-	if err != nil {
+	data := frame.buf[:]
+	if err := readInto(reader, data); err != nil {
 		return 0, err
 	}
 
@@ -704,7 +947,7 @@ func (frame *pingFrameV3) ReadFrom(reader io.Reader) (int64, error) {
 	// Get and check length.
 	length := int(bytesToUint24(data[5:8]))
 	if length != 4 {
-		return 12, &incorrectDataLength{length, 4}
+		return 12, &malformedFrame{"PING", length, 4}
 	}
 
 	// Check Flags.
@@ -728,7 +971,7 @@ func (frame *pingFrameV3) String() string {
 }
 
 func (frame *pingFrameV3) WriteTo(writer io.Writer) (int64, error) {
-	out := make([]byte, 12)
+	out := frame.buf[:]
 
 	out[0] = 128                      // Control bit and Version
 	out[1] = 3                        // Version
@@ -768,51 +1011,62 @@ func (frame *goawayFrameV3) Decompress(decomp Decompressor) error {
 }
 
 func (frame *goawayFrameV3) ReadFrom(reader io.Reader) (int64, error) {
-	data, err := read(reader, 16)
+	data, err := read(reader, 12)
 	if err != nil {
 		return 0, err
 	}
 
 	// Check it's a control frame.
 	if data[0] != 128 {
-		return 16, &incorrectFrame{DATA_FRAMEv3, GOAWAYv3, 3}
+		return 12, &incorrectFrame{DATA_FRAMEv3, GOAWAYv3, 3}
 	}
 
 	// Check it's a GOAWAY.
 	if bytesToUint16(data[2:4]) != GOAWAYv3 {
-		return 16, &incorrectFrame{int(bytesToUint16(data[2:4])), GOAWAYv3, 3}
+		return 12, &incorrectFrame{int(bytesToUint16(data[2:4])), GOAWAYv3, 3}
 	}
 
 	// Check version and adapt accordingly.
 	version := (uint16(data[0]&0x7f) << 8) + uint16(data[1])
 	if version != 3 {
-		return 16, unsupportedVersion(version)
+		return 12, unsupportedVersion(version)
 	}
 
-	// Get and check length.
+	// Get and check length. Some peers send the
+	// SPDY/2 layout, which has no status code.
 	length := int(bytesToUint24(data[5:8]))
-	if length != 8 {
-		return 16, &incorrectDataLength{length, 8}
+	if length != 8 && length != 4 {
+		return 12, &malformedFrame{"GOAWAY", length, 8}
 	}
 
 	// Check unused space.
 	if (data[8] >> 7) != 0 {
-		return 16, &invalidField{"Unused", 1, 0}
+		return 12, &invalidField{"Unused", 1, 0}
 	}
 
 	// Check Flags.
 	if (data[4]) != 0 {
-		return 16, &invalidField{"Flags", int(data[4]), 0}
+		return 12, &invalidField{"Flags", int(data[4]), 0}
 	}
 
 	frame.LastGoodStreamID = StreamID(bytesToUint32(data[8:12]))
-	frame.Status = StatusCode(bytesToUint32(data[12:16]))
+	frame.Status = 0 // OK
+
+	if length == 8 {
+		status, err := read(reader, 4)
+		if err != nil {
+			return 12, err
+		}
+		frame.Status = StatusCode(bytesToUint32(status))
+	} else {
+		debug.Println("Note: Received GOAWAY without a status code. Assuming OK.")
+	}
 
 	if !frame.LastGoodStreamID.Valid() {
-		return 16, streamIdTooLarge
+		return int64(8 + length), streamIdTooLarge
 	}
 
-	return 16, nil
+	return int64(8 + length), nil
 }
 
 func (frame *goawayFrameV3) String() string {
@@ -821,7 +1075,7 @@ func (frame *goawayFrameV3) String() string {
 	buf.WriteString("GOAWAY {\n\t")
 	buf.WriteString(fmt.Sprintf("Version:              3\n\t"))
 	buf.WriteString(fmt.Sprintf("Last good stream ID:  %d\n\t", frame.LastGoodStreamID))
-	buf.WriteString(fmt.Sprintf("Status code:          %s (%d)\n}\n", frame.Status, frame.Status))
+	buf.WriteString(fmt.Sprintf("Status code:          %s (%d)\n}\n", frame.Status.goawayString(), frame.Status))
 
 	return buf.String()
 }
@@ -922,7 +1176,7 @@ func (frame *headersFrameV3) ReadFrom(reader io.Reader) (int64, error) {
 	// Get and check length.
 	length := int(bytesToUint24(data[5:8]))
 	if length < 4 {
-		return 12, &incorrectDataLength{length, 4}
+		return 12, &malformedFrame{"HEADERS", length, 4}
 	} else if length > MAX_FRAME_SIZE-8 {
 		return 12, frameTooLarge
 	}
@@ -987,6 +1241,9 @@ func (frame *headersFrameV3) WriteTo(writer io.Writer) (int64, error) {
 
 	header := frame.rawHeader
 	length := 4 + len(header)
+	if length > MAX_FRAME_SIZE-8 {
+		return 0, frameTooLarge
+	}
 	out := make([]byte, 12)
 
 	out[0] = 128                  // Control bit and Version
@@ -1021,6 +1278,7 @@ func (frame *headersFrameV3) WriteTo(writer io.Writer) (int64, error) {
 type windowUpdateFrameV3 struct {
 	StreamID        StreamID
 	DeltaWindowSize uint32
+	buf             [16]byte // space to read and write the frame without allocating.
 }
 
 func (frame *windowUpdateFrameV3) Compress(comp Compressor) error {
@@ -1032,8 +1290,8 @@ func (frame *windowUpdateFrameV3) Decompress(decomp Decompressor) error {
 }
 
 func (frame *windowUpdateFrameV3) ReadFrom(reader io.Reader) (int64, error) {
-	data, err := read(reader, 16)
-	if err != nil {
+	data := frame.buf[:]
+	if err := readInto(reader, data); err != nil {
 		return 0, err
 	}
 
@@ -1056,7 +1314,7 @@ func (frame *windowUpdateFrameV3) ReadFrom(reader io.Reader) (int64, error) {
 	// Get and check length.
 	length := int(bytesToUint24(data[5:8]))
 	if length != 8 {
-		return 16, &incorrectDataLength{length, 8}
+		return 16, &malformedFrame{"WINDOW_UPDATE", length, 8}
 	}
 
 	// Check unused space.
@@ -1064,15 +1322,20 @@ func (frame *windowUpdateFrameV3) ReadFrom(reader io.Reader) (int64, error) {
 		return 16, &invalidField{"Unused", 1, 0}
 	}
 
+	// Check Flags.
+	if (data[4]) != 0 {
+		return 16, &invalidField{"Flags", int(data[4]), 0}
+	}
+
 	frame.StreamID = StreamID(bytesToUint32(data[8:12]))
 	frame.DeltaWindowSize = bytesToUint32(data[12:16])
 
+	// Stream ID 0 is used for the session window, so is
+	// checked by the connection, which knows whether
+	// session flow control is in use.
 	if !frame.StreamID.Valid() {
 		return 16, streamIdTooLarge
 	}
-	if frame.StreamID.Zero() {
-		return 16, streamIdIsZero
-	}
 	if frame.DeltaWindowSize > MAX_DELTA_WINDOW_SIZE {
 		return 16, errors.New("Error: Delta Window Size too large.")
 	}
@@ -1092,12 +1355,12 @@ func (frame *windowUpdateFrameV3) String() string {
 }
 
 func (frame *windowUpdateFrameV3) WriteTo(writer io.Writer) (int64, error) {
-	out := make([]byte, 12)
+	out := frame.buf[:]
 
 	out[0] = 128                                     // Control bit and Version
 	out[1] = 3                                       // Version
 	out[2] = 0                                       // Type
-	out[3] = 8                                       // Type
+	out[3] = 9                                       // Type
 	out[4] = 0                                       // Flags
 	out[5] = 0                                       // Length
 	out[6] = 0                                       // Length
@@ -1137,69 +1400,70 @@ func (frame *credentialFrameV3) Decompress(decomp Decompressor) error {
 }
 
 func (frame *credentialFrameV3) ReadFrom(reader io.Reader) (int64, error) {
-	data, err := read(reader, 18)
+	data, err := read(reader, 14)
 	if err != nil {
 		return 0, err
 	}
 
 	// Check it's a control frame.
 	if data[0] != 128 {
-		return 18, &incorrectFrame{DATA_FRAMEv3, CREDENTIALv3, 3}
+		return 14, &incorrectFrame{DATA_FRAMEv3, CREDENTIALv3, 3}
 	}
 
 	// Check it's a CREDENTIAL.
 	if bytesToUint16(data[2:4]) != CREDENTIALv3 {
-		return 18, &incorrectFrame{int(bytesToUint16(data[2:4])), CREDENTIALv3, 3}
+		return 14, &incorrectFrame{int(bytesToUint16(data[2:4])), CREDENTIALv3, 3}
 	}
 
 	// Check version and adapt accordingly.
 	version := (uint16(data[0]&0x7f) << 8) + uint16(data[1])
 	if version != 3 {
-		return 18, unsupportedVersion(version)
+		return 14, unsupportedVersion(version)
 	}
 
 	// Get and check length.
 	length := int(bytesToUint24(data[5:8]))
 	if length < 6 {
-		return 18, &incorrectDataLength{length, 6}
+		return 14, &malformedFrame{"CREDENTIAL", length, 6}
 	} else if length > MAX_FRAME_SIZE-8 {
-		return 18, frameTooLarge
+		return 14, frameTooLarge
 	}
 
 	// Check Flags.
 	if (data[4]) != 0 {
-		return 18, &invalidField{"Flags", int(data[4]), 0}
-	}
-
-	// Read in data.
-	certs, err := read(reader, length-10)
-	if err != nil {
-		return 18, err
+		return 14, &invalidField{"Flags", int(data[4]), 0}
 	}
 
 	frame.Slot = bytesToUint16(data[8:10])
-	proofLen := int(bytesToUint32(data[10:14]))
-	if proofLen > 0 {
-		frame.Proof = data[14 : 14+proofLen]
-	} else {
-		frame.Proof = []byte{}
+	proofLen := bytesToUint32(data[10:14])
+	if proofLen > uint32(length-6) {
+		return 14, &malformedFrame{"CREDENTIAL", length, int(proofLen) + 6}
 	}
 
-	numCerts := 0
-	for offset := 0; offset < length-10; {
-		offset += int(bytesToUint32(certs[offset:offset+4])) + 4
-		numCerts++
+	// Read in data.
+	rest, err := read(reader, length-6)
+	if err != nil {
+		return 14, err
 	}
 
-	frame.Certificates = make([]*x509.Certificate, numCerts)
-	for i, offset := 0, 0; offset < length-10; i++ {
-		length := int(bytesToUint32(certs[offset : offset+4]))
-		rawCert := certs[offset+4 : offset+4+length]
-		frame.Certificates[i], err = x509.ParseCertificate(rawCert)
+	frame.Proof = rest[:proofLen]
+
+	// Each certificate is prefixed with its length.
+	frame.Certificates = nil
+	for certs := rest[proofLen:]; len(certs) > 0; {
+		if len(certs) < 4 {
+			return int64(length + 8), &malformedFrame{"CREDENTIAL", len(certs), 4}
+		}
+		certLen := bytesToUint32(certs[:4])
+		if certLen > uint32(len(certs)-4) {
+			return int64(length + 8), &malformedFrame{"CREDENTIAL", len(certs) - 4, int(certLen)}
+		}
+		cert, err := x509.ParseCertificate(certs[4 : 4+certLen])
 		if err != nil {
 			return int64(length + 8), err
 		}
-		offset += length + 4
+		frame.Certificates = append(frame.Certificates, cert)
+		certs = certs[4+certLen:]
 	}
 
 	return int64(length + 8), nil
@@ -1221,10 +1485,13 @@ func (frame *credentialFrameV3) WriteTo(writer io.Writer) (int64, error) {
 	proofLength := len(frame.Proof)
 	certsLength := 0
 	for _, cert := range frame.Certificates {
-		certsLength += len(cert.Raw)
+		certsLength += 4 + len(cert.Raw)
 	}
 
 	length := 6 + proofLength + certsLength
+	if length > MAX_FRAME_SIZE-8 {
+		return 0, frameTooLarge
+	}
 	out := make([]byte, 14)
 
 	out[0] = 128                      // Control bit and Version
@@ -1256,6 +1523,18 @@ func (frame *credentialFrameV3) WriteTo(writer io.Writer) (int64, error) {
 
 	written := int64(14 + len(frame.Proof))
 	for _, cert := range frame.Certificates {
+		certLength := len(cert.Raw)
+		err = write(writer, []byte{
+			byte(certLength >> 24), // Certificate Length
+			byte(certLength >> 16), // Certificate Length
+			byte(certLength >> 8),  // Certificate Length
+			byte(certLength),       // Certificate Length
+		})
+		if err != nil {
+			return written, err
+		}
+		written += 4
+
 		err = write(writer, cert.Raw)
 		if err != nil {
 			return written, err
@@ -1270,9 +1549,36 @@ func (frame *credentialFrameV3) WriteTo(writer io.Writer) (int64, error) {
  *** DATA ***
  ************/
 type dataFrameV3 struct {
-	StreamID StreamID
-	Flags    Flags
-	Data     []byte
+	StreamID    StreamID
+	Flags       Flags
+	Data        []byte
+	queued      time.Time // time at which the frame was queued to be sent.
+	interactive bool      // the frame is sent in small TLS records.
+	payload     *[]byte   // pooled buffer holding Data, if any.
+	buf         [8]byte   // space to read and write the frame header without allocating.
+}
+
+// newDataFrameV3 returns a DATA frame to be sent,
+// stamped with the time at which it was queued.
+// The stamp uses the wall clock, rather than the
+// connection's clock, as streams do not have
+// access to the latter.
+func newDataFrameV3() *dataFrameV3 {
+	return &dataFrameV3{queued: time.Now()}
+}
+
+// release returns the buffer holding the frame's Data to
+// its pool, if it was read into a pooled buffer. The frame's
+// Data must not be used by the caller, or anyone else, once
+// it has been released, so it must be copied first if it is
+// given to application code which may keep it.
+func (frame *dataFrameV3) release() {
+	if frame.payload == nil {
+		return
+	}
+	putPayload(frame.payload)
+	frame.payload = nil
+	frame.Data = nil
 }
 
 func (frame *dataFrameV3) Compress(comp Compressor) error {
@@ -1284,8 +1590,8 @@ func (frame *dataFrameV3) Decompress(decomp Decompressor) error {
 }
 
 func (frame *dataFrameV3) ReadFrom(reader io.Reader) (int64, error) {
-	data, err := read(reader, 8)
-	if err != nil {
+	data := frame.buf[:]
+	if err := readInto(reader, data); err != nil {
 		return 0, err
 	}
 
@@ -1296,16 +1602,24 @@ func (frame *dataFrameV3) ReadFrom(reader io.Reader) (int64, error) {
 
 	// Get and check length.
 	length := int(bytesToUint24(data[5:8]))
-	if length == 0 && data[4] == 0 {
-		return 8, &incorrectDataLength{length, 1}
+	// Only the final frame may be empty.
+	if length == 0 && !Flags(data[4]).FIN() {
+		return 8, &malformedFrame{"DATA", length, 1}
 	} else if length > MAX_FRAME_SIZE-8 {
 		return 8, frameTooLarge
 	}
 
-	// Read in data.
+	// Read in data, using a pooled buffer if possible.
+	// The buffer is reused once the frame is released.
 	if length != 0 {
-		frame.Data, err = read(reader, length)
-		if err != nil {
+		frame.payload = getPayload(length)
+		if frame.payload != nil {
+			frame.Data = (*frame.payload)[:length]
+		} else {
+			frame.Data = make([]byte, length)
+		}
+		if err := readInto(reader, frame.Data); err != nil {
+			frame.release()
 			return 8, err
 		}
 	}
@@ -1349,8 +1663,11 @@ func (frame *dataFrameV3) WriteTo(writer io.Writer) (int64, error) {
 	if length == 0 && !frame.Flags.FIN() {
 		return 0, errors.New("Error: Data is empty.")
 	}
+	if frame.StreamID.Zero() {
+		return 0, streamIdIsZero
+	}
 
-	out := make([]byte, 8)
+	out := frame.buf[:]
 
 	out[0] = frame.StreamID.b1() // Control bit and Stream ID
 	out[1] = frame.StreamID.b2() // Stream ID
@@ -4,8 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // pushStreamV3 is a structure that implements the
@@ -19,8 +22,13 @@ type pushStreamV3 struct {
 	origin   Stream
 	state    *StreamState
 	output   chan<- Frame
+	priority Priority
 	header   http.Header
+	closeErr error
 	stop     <-chan struct{}
+	deadline writeDeadline
+	shut     uint32 // set to 1 once the stream has been shut; accessed atomically.
+	tags     streamTags
 }
 
 /***********************
@@ -34,7 +42,13 @@ func (p *pushStreamV3) Header() http.Header {
 // Write is used for sending data in the push.
 func (p *pushStreamV3) Write(inputData []byte) (int, error) {
 	if p.closed() || p.state.ClosedHere() {
-		return 0, errors.New("Error: Stream already closed.")
+		if err := p.closedErr(); err != nil {
+			return 0, err
+		}
+		return 0, ErrStreamClosed
+	}
+	if err := p.deadline.err(); err != nil {
+		return 0, err
 	}
 
 	state := p.origin.State()
@@ -42,7 +56,9 @@ func (p *pushStreamV3) Write(inputData []byte) (int, error) {
 		return 0, errors.New("Error: Origin stream is closed.")
 	}
 
-	p.writeHeader()
+	if err := p.writeHeader(); err != nil {
+		return 0, err
+	}
 
 	// Copy the data locally to avoid any pointer issues.
 	data := make([]byte, len(inputData))
@@ -52,19 +68,20 @@ func (p *pushStreamV3) Write(inputData []byte) (int, error) {
 	// Data is sent to the flow control to
 	// ensure that the protocol is followed.
 	written := 0
-	for len(data) > MAX_DATA_SIZE {
-		n, err := p.flow.Write(data[:MAX_DATA_SIZE])
+	size := dataFrameSize()
+	for len(data) > size {
+		n, err := p.flow.Write(data[:size])
 		if err != nil {
-			return written, err
+			return written, p.writeErr(err)
 		}
 		written += n
-		data = data[MAX_DATA_SIZE:]
+		data = data[size:]
 	}
 
 	n, err := p.flow.Write(data)
 	written += n
 
-	return written, err
+	return written, p.writeErr(err)
 }
 
 // WriteHeader is provided to satisfy the Stream
@@ -80,24 +97,73 @@ func (p *pushStreamV3) WriteHeader(int) {
  *****************/
 
 func (p *pushStreamV3) Close() error {
+	p.writeHeader()
+
+	// Frames are sent without the stream's lock, which
+	// the read loop needs to deliver frames.
 	p.Lock()
 	defer p.Unlock()
-	p.writeHeader()
-	if p.state != nil {
+	if c, ok := p.conn.(closeErrorer); ok && p.closeErr == nil {
+		p.closeErr = c.closeError(p.streamID)
+	}
+	if atomic.CompareAndSwapUint32(&p.shut, 0, 1) {
+		// Free the stream's slot in the stream limit.
+		if conn, ok := p.conn.(*connV3); ok {
+			conn.pushStreamLimit.Close()
+		}
 		p.state.Close()
-		p.state = nil
 	}
 	if p.flow != nil {
 		p.flow.Close()
-		p.flow = nil
 	}
-	p.origin = nil
-	p.output = nil
-	p.header = nil
-	p.stop = nil
 	return nil
 }
 
+// CloseWrite finishes the push, as
+// does closing the writer from Push.
+func (p *pushStreamV3) CloseWrite() error {
+	return p.finish()
+}
+
+// finish ends the push, sending a FIN once any
+// remaining headers and data have been sent.
+func (p *pushStreamV3) finish() error {
+	if p.closed() || p.state.ClosedHere() {
+		return p.closedErr()
+	}
+
+	if err := p.writeHeader(); err != nil {
+		return err
+	}
+
+	// Send any data held back by flow control.
+	if p.flow.Paused() {
+		p.flow.Flush()
+		p.flow.Wait()
+	}
+	if p.flow.Paused() {
+		log.Printf("Error: Push stream %d%v has been finished with data still buffered.\n", p.streamID, &p.tags)
+	}
+	data := newDataFrameV3()
+	data.StreamID = p.streamID
+	data.Flags = FLAG_FIN
+	data.Data = []byte{}
+	sendFrame(p.output, p.stop, data)
+
+	p.state.CloseHere()
+	return p.Close()
+}
+
+// Reset ends the stream abruptly, sending a
+// RST_STREAM with the given status code.
+func (p *pushStreamV3) Reset(code StatusCode) error {
+	conn, ok := p.conn.(*connV3)
+	if !ok {
+		return errors.New("Error: Stream has no connection.")
+	}
+	return conn.resetStream(p, code)
+}
+
 func (p *pushStreamV3) Read(out []byte) (int, error) {
 	return 0, io.EOF
 }
@@ -121,12 +187,9 @@ func (p *pushStreamV3) ReceiveFrame(frame Frame) error {
 	// Process the frame depending on its type.
 	switch frame := frame.(type) {
 	case *windowUpdateFrameV3:
-		err := p.flow.UpdateWindow(frame.DeltaWindowSize)
-		if err != nil {
-			reply := new(rstStreamFrameV3)
-			reply.StreamID = p.streamID
-			reply.Status = RST_STREAM_FLOW_CONTROL_ERROR
-			p.output <- reply
+		// A window which overflows is reset by the
+		// connection, which ends the stream.
+		if err := p.flow.UpdateWindow(frame.DeltaWindowSize); err != nil {
 			return err
 		}
 
@@ -145,12 +208,24 @@ func (p *pushStreamV3) State() *StreamState {
 	return p.state
 }
 
+func (p *pushStreamV3) Priority() Priority {
+	return p.priority
+}
+
 func (p *pushStreamV3) StreamID() StreamID {
 	return p.streamID
 }
 
+func (p *pushStreamV3) SetTag(key, value string) error {
+	return p.tags.set(key, value)
+}
+
+func (p *pushStreamV3) Tags() map[string]string {
+	return p.tags.copy()
+}
+
 func (p *pushStreamV3) closed() bool {
-	if p.conn == nil || p.state == nil {
+	if p.conn == nil || atomic.LoadUint32(&p.shut) == 1 {
 		return true
 	}
 	select {
@@ -161,18 +236,93 @@ func (p *pushStreamV3) closed() bool {
 	}
 }
 
-// writeHeader is used to send HTTP headers to
-// the client.
-func (p *pushStreamV3) writeHeader() {
-	if len(p.header) == 0 || p.closed() {
-		return
+// closedErr returns the reason the stream was
+// closed, if it was closed by the connection.
+func (p *pushStreamV3) closedErr() error {
+	p.Lock()
+	defer p.Unlock()
+	return p.closeErr
+}
+
+// writeErr returns the error to be given for a Write which
+// failed with err. If the stream failed because it or its
+// connection was closed, this is the reason it was closed,
+// which may not yet have been recorded when the Write gave
+// up.
+func (p *pushStreamV3) writeErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if closeErr := p.closedErr(); closeErr != nil {
+		return closeErr
+	}
+	if c, ok := p.conn.(closeErrorer); ok {
+		if closeErr := c.closeError(p.streamID); closeErr != nil {
+			return closeErr
+		}
+	}
+	return err
+}
+
+/************
+ * net.Conn *
+ ************/
+
+func (p *pushStreamV3) LocalAddr() net.Addr {
+	return localStreamAddr(p.conn, p.streamID)
+}
+
+func (p *pushStreamV3) RemoteAddr() net.Addr {
+	return remoteStreamAddr(p.conn, p.streamID)
+}
+
+func (p *pushStreamV3) SetDeadline(t time.Time) error {
+	return p.SetWriteDeadline(t)
+}
+
+// SetReadDeadline has no effect, as pushes
+// are unidirectional, so reads never block.
+func (p *pushStreamV3) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (p *pushStreamV3) SetWriteDeadline(t time.Time) error {
+	p.deadline.set(t)
+	return nil
+}
+
+// writeHeader is used to send HTTP headers to the
+// client. Headers which cannot be sent end the
+// stream, as with headersFailed.
+func (p *pushStreamV3) writeHeader() error {
+	if len(p.header) == 0 || p.closed() || p.state.ClosedHere() {
+		return nil
 	}
 
 	header := new(headersFrameV3)
 	header.StreamID = p.streamID
 	header.Header = cloneHeader(p.header)
+	if err := checkHeaders(header.Header); err != nil {
+		return p.headersFailed(err)
+	}
 	for name := range header.Header {
 		p.header.Del(name)
 	}
-	p.output <- header
+	sendFrame(p.output, p.stop, header)
+	return nil
+}
+
+// headersFailed ends the push, as headers set for it
+// cannot be sent, resetting it with an INTERNAL_ERROR.
+// err is returned, and is given by any later writes.
+func (p *pushStreamV3) headersFailed(err error) error {
+	p.Lock()
+	if p.closeErr == nil {
+		p.closeErr = err
+	}
+	p.Unlock()
+	if conn, ok := p.conn.(*connV3); ok {
+		conn.resetStream(p, RST_STREAM_INTERNAL_ERROR)
+	}
+	return err
 }
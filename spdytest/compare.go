@@ -0,0 +1,208 @@
+// Package spdytest provides utilities for testing handlers
+// served over SPDY.
+package spdytest
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+
+	"github.com/SlyMarbo/spdy"
+)
+
+// Request describes a request to be replayed by Compare.
+// The body is held in full, so that it can be sent to
+// each server.
+type Request struct {
+	Method string      // defaults to GET.
+	Path   string      // path and query, such as "/search?q=spdy".
+	Header http.Header // optional request headers.
+	Body   []byte      // optional request body.
+}
+
+// Difference describes a way in which the responses to
+// a request differed between HTTP/1.1 and SPDY.
+type Difference struct {
+	Request *Request
+	Field   string // "status", "body", or the canonical name of a header.
+	HTTP    string // value over HTTP/1.1.
+	SPDY    string // value over SPDY.
+}
+
+func (d Difference) String() string {
+	method := d.Request.Method
+	if method == "" {
+		method = "GET"
+	}
+	return fmt.Sprintf("%s %s: %s differs: HTTP/1.1 gave %q, SPDY gave %q",
+		method, d.Request.Path, d.Field, d.HTTP, d.SPDY)
+}
+
+// IgnoredHeaders lists the response headers which Compare
+// does not compare. These are the hop-by-hop headers, which
+// SPDY does not carry, and Date, which legitimately differs.
+var IgnoredHeaders = []string{
+	"Connection",
+	"Date",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Compare serves handler over both HTTP/1.1 and SPDY, using
+// test servers with self-signed certificates, then makes
+// each request to both and reports any differences in the
+// responses' status codes, headers and bodies. The servers
+// are closed before Compare returns.
+//
+// An error is returned if a request could not be made, or
+// if SPDY could not be negotiated.
+//
+//	func TestHandler(t *testing.T) {
+//		diffs, err := spdytest.Compare(myHandler, []*spdytest.Request{
+//			{Path: "/"},
+//			{Method: "POST", Path: "/upload", Body: []byte("data")},
+//		})
+//		if err != nil {
+//			t.Fatal(err)
+//		}
+//		for _, diff := range diffs {
+//			t.Error(diff)
+//		}
+//	}
+func Compare(handler http.Handler, requests []*Request) ([]Difference, error) {
+	httpServer := httptest.NewUnstartedServer(handler)
+	httpServer.StartTLS()
+	defer httpServer.Close()
+
+	spdyServer := NewServer(handler)
+	defer spdyServer.Close()
+
+	httpClient := httpServer.Client()
+	spdyClient := spdyServer.Client()
+
+	var diffs []Difference
+	for _, req := range requests {
+		expected, err := do(httpClient, httpServer.URL, req)
+		if err != nil {
+			return diffs, err
+		}
+		got, err := do(spdyClient, spdyServer.URL, req)
+		if err != nil {
+			return diffs, err
+		}
+		if spdy.Stats(spdyServer.Config).Conns == 0 {
+			return diffs, errors.New("Error: SPDY was not negotiated.")
+		}
+
+		diffs = append(diffs, compare(req, expected, got)...)
+	}
+
+	return diffs, nil
+}
+
+// NewServer starts and returns a new test server, serving
+// handler over SPDY with a self-signed certificate. The
+// server's Client is configured to trust the certificate
+// and make its requests over SPDY.
+func NewServer(handler http.Handler) *httptest.Server {
+	server := httptest.NewUnstartedServer(handler)
+	spdy.AddSPDY(server.Config)
+	server.TLS = &tls.Config{NextProtos: spdy.NPNStrings()}
+	server.StartTLS()
+
+	// Make the client use SPDY, trusting the server.
+	client := server.Client()
+	config := new(tls.Config)
+	if t, ok := client.Transport.(*http.Transport); ok && t.TLSClientConfig != nil {
+		config = t.TLSClientConfig
+	}
+	client.Transport = spdy.NewTransport(config)
+
+	return server
+}
+
+// result is a response, read in full.
+type result struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+func do(client *http.Client, base string, r *Request) (*result, error) {
+	method := r.Method
+	if method == "" {
+		method = "GET"
+	}
+
+	req, err := http.NewRequest(method, base+r.Path, bytes.NewReader(r.Body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range r.Header {
+		req.Header[name] = append([]string(nil), values...)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &result{status: res.StatusCode, header: res.Header, body: body}, nil
+}
+
+func compare(req *Request, expected, got *result) []Difference {
+	var diffs []Difference
+	if expected.status != got.status {
+		diffs = append(diffs, Difference{req, "status", fmt.Sprint(expected.status), fmt.Sprint(got.status)})
+	}
+
+	ignored := make(map[string]bool)
+	for _, name := range IgnoredHeaders {
+		ignored[http.CanonicalHeaderKey(name)] = true
+	}
+
+	names := make(map[string]bool)
+	for name := range expected.header {
+		names[http.CanonicalHeaderKey(name)] = true
+	}
+	for name := range got.header {
+		names[http.CanonicalHeaderKey(name)] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		if !ignored[name] {
+			sorted = append(sorted, name)
+		}
+	}
+	sort.Strings(sorted)
+
+	for _, name := range sorted {
+		e := strings.Join(expected.header[name], ", ")
+		g := strings.Join(got.header[name], ", ")
+		if e != g {
+			diffs = append(diffs, Difference{req, name, e, g})
+		}
+	}
+
+	if !bytes.Equal(expected.body, got.body) {
+		diffs = append(diffs, Difference{req, "body", string(expected.body), string(got.body)})
+	}
+
+	return diffs
+}
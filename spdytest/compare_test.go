@@ -0,0 +1,139 @@
+package spdytest
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/SlyMarbo/spdy"
+)
+
+// handlers exercises the ResponseWriter semantics which
+// differed between HTTP/1.1 and SPDY.
+func handlers() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/implicit", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html><body>hello</body></html>"))
+	})
+	mux.HandleFunc("/explicit", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Custom", "yes")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("accepted"))
+	})
+	mux.HandleFunc("/empty", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("large ", 10000)))
+	})
+	mux.HandleFunc("/flush", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first ")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, "second")
+	})
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		// HTTP/1.1 cannot read the body once the response
+		// has begun, so it is read in full first.
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(body)
+	})
+	mux.HandleFunc("/headers", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("X-Request"))
+	})
+	return mux
+}
+
+var requests = []*Request{
+	{Path: "/implicit"},
+	{Path: "/explicit"},
+	{Path: "/empty"},
+	{Path: "/large"},
+	{Path: "/flush"},
+	{Path: "/missing"},
+	{Method: "HEAD", Path: "/implicit"},
+	{Method: "POST", Path: "/echo", Body: []byte(strings.Repeat("upload ", 20000))},
+	{Path: "/headers", Header: http.Header{"X-Request": {"value"}}},
+}
+
+// The same handlers behave identically over HTTP/1.1 and
+// each version of SPDY.
+func TestCompare(t *testing.T) {
+	for _, version := range []uint16{3, 2} {
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			if version == 2 {
+				if err := spdy.DisableSpdyVersion(3); err != nil {
+					t.Fatal(err)
+				}
+				defer spdy.EnableSpdyVersion(3)
+			}
+
+			diffs, err := Compare(handlers(), requests)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, diff := range diffs {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+// Differences in status, headers and body are reported,
+// while ignored headers are not.
+func TestCompareDifferences(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		if spdy.UsingSPDY(w) {
+			w.Header().Set("X-Protocol", "spdy")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("spdy"))
+		} else {
+			w.Write([]byte("http"))
+		}
+	})
+
+	req := &Request{Path: "/"}
+	diffs, err := Compare(handler, []*Request{req})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Difference{
+		{req, "status", "200", "201"},
+		{req, "X-Protocol", "", "spdy"},
+		{req, "body", "http", "spdy"},
+	}
+	if len(diffs) != len(want) {
+		t.Fatalf("got differences %v, want %v", diffs, want)
+	}
+	for i := range want {
+		if diffs[i] != want[i] {
+			t.Errorf("difference %d is %v, want %v", i, diffs[i], want[i])
+		}
+	}
+
+	wantString := `GET /: status differs: HTTP/1.1 gave "200", SPDY gave "201"`
+	if s := diffs[0].String(); s != wantString {
+		t.Errorf("got %q, want %q", s, wantString)
+	}
+}
+
+// NewServer's client makes its requests over SPDY.
+func TestNewServer(t *testing.T) {
+	server := NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, spdy.UsingSPDY(w))
+	}))
+	defer server.Close()
+
+	res, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil || string(body) != "true" {
+		t.Fatalf("got body %q, error %v, want SPDY", body, err)
+	}
+}
@@ -0,0 +1,39 @@
+package spdytest
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/SlyMarbo/spdy"
+)
+
+// Pipe serves handler in-process, over a net.Pipe, and returns
+// a running client connection to it, using the given SPDY
+// version. This exercises the full frame loop without sockets
+// or certificates, so requests have no TLS state.
+//
+// Closing the client connection also closes the server's, once
+// it notices the pipe has closed. Close returns once the client
+// connection has stopped.
+func Pipe(handler http.Handler, version uint16) (spdy.Conn, error) {
+	local, remote := net.Pipe()
+
+	server, err := spdy.NewServerConn(remote, &http.Server{Handler: handler}, version)
+	if err != nil {
+		local.Close()
+		remote.Close()
+		return nil, err
+	}
+
+	client, err := spdy.NewClientConn(local, nil, version)
+	if err != nil {
+		local.Close()
+		remote.Close()
+		return nil, err
+	}
+
+	go server.Run()
+	go client.Run()
+
+	return client, nil
+}
@@ -0,0 +1,48 @@
+package spdytest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Close returns to its caller, so can be deferred.
+func TestPipeClose(t *testing.T) {
+	for _, version := range []uint16{3, 2} {
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			conn, err := Pipe(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("hello"))
+			}), version)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req, _ := http.NewRequest("GET", "http://example.com/", nil)
+			stream, err := conn.Request(req, nil, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go stream.Run()
+			body, err := ioutil.ReadAll(stream)
+			if err != nil || string(body) != "hello" {
+				t.Fatalf("got body %q, error %v", body, err)
+			}
+
+			closed := make(chan error, 1)
+			go func() {
+				err := conn.Close()
+				closed <- err
+			}()
+			select {
+			case err := <-closed:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Close did not return")
+			}
+		})
+	}
+}
@@ -0,0 +1,318 @@
+package spdy
+
+import (
+	"expvar"
+	"io"
+	"math"
+	"math/bits"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ConnStats holds counters of a SPDY connection's activity,
+// as returned by Conn.Stats. Stats and Transport.Stats give
+// the totals across several connections, in which case
+// Settings is nil.
+type ConnStats struct {
+	Conns              int               // number of connections counted.
+	ActiveStreams      int               // streams which have not yet closed.
+	TotalStreamsOpened uint64            // streams opened by either endpoint.
+	FramesSent         map[string]uint64 // frames sent, by type.
+	FramesReceived     map[string]uint64 // frames received, by type.
+	BytesSent          uint64            // bytes written to the connection.
+	BytesReceived      uint64            // bytes read from the connection.
+	BenignErrors       int               // number of non-serious errors encountered.
+	PingsOutstanding   int               // pings awaiting a response.
+	ResponsesTooLarge  uint64            // responses cancelled for exceeding the Transport's size limits.
+	Settings           []Setting         // settings last received from the peer.
+	DataFrameSizes     Histogram         // payload sizes of DATA frames sent and received, in bytes.
+	HeaderBlockSizes   Histogram         // compressed sizes of header blocks sent and received, in bytes.
+	QueueTimes         Histogram         // time from queueing each DATA frame to writing it, in microseconds.
+	HandlerLatency     Histogram         // time taken by the handler of each request served, in microseconds.
+	DecompressTimes    Histogram         // time taken to decompress each header block received, in microseconds.
+}
+
+// HistogramBuckets is the number of buckets in a Histogram.
+const HistogramBuckets = 32
+
+// Histogram is a log-scaled histogram of sizes or durations.
+// Buckets[0] counts values of zero, and Buckets[i] counts
+// values v with 1<<(i-1) <= v < 1<<i, except that the last
+// bucket also counts any larger values.
+type Histogram struct {
+	Count   uint64                   // number of values observed.
+	Sum     uint64                   // total of the values observed.
+	Buckets [HistogramBuckets]uint64 // number of values observed, by bucket.
+}
+
+// Mean returns the mean of the values observed.
+func (h *Histogram) Mean() float64 {
+	if h.Count == 0 {
+		return 0
+	}
+	return float64(h.Sum) / float64(h.Count)
+}
+
+// Quantile returns an upper bound on the q-quantile of the
+// values observed, such as 0.99 for the 99th percentile. The
+// bound is that of the bucket holding the quantile, so is
+// within a factor of two. If the quantile falls in the last
+// bucket, math.MaxUint64 is returned.
+func (h *Histogram) Quantile(q float64) uint64 {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(h.Count)))
+	if rank < 1 {
+		rank = 1
+	}
+	seen := uint64(0)
+	for i, n := range h.Buckets {
+		seen += n
+		if seen >= rank {
+			if i == HistogramBuckets-1 {
+				break
+			}
+			return 1<<uint(i) - 1
+		}
+	}
+	return math.MaxUint64
+}
+
+// add adds the counts in other to h.
+func (h *Histogram) add(other *Histogram) {
+	h.Count += other.Count
+	h.Sum += other.Sum
+	for i, n := range other.Buckets {
+		h.Buckets[i] += n
+	}
+}
+
+// add adds the counters in other to s.
+func (s *ConnStats) add(other *ConnStats) {
+	s.Conns += other.Conns
+	s.ActiveStreams += other.ActiveStreams
+	s.TotalStreamsOpened += other.TotalStreamsOpened
+	for name, n := range other.FramesSent {
+		s.FramesSent[name] += n
+	}
+	for name, n := range other.FramesReceived {
+		s.FramesReceived[name] += n
+	}
+	s.BytesSent += other.BytesSent
+	s.BytesReceived += other.BytesReceived
+	s.BenignErrors += other.BenignErrors
+	s.PingsOutstanding += other.PingsOutstanding
+	s.ResponsesTooLarge += other.ResponsesTooLarge
+	s.DataFrameSizes.add(&other.DataFrameSizes)
+	s.HeaderBlockSizes.add(&other.HeaderBlockSizes)
+	s.QueueTimes.add(&other.QueueTimes)
+	s.HandlerLatency.add(&other.HandlerLatency)
+	s.DecompressTimes.add(&other.DecompressTimes)
+}
+
+// Stats returns the total of the statistics of each
+// of the SPDY connections currently being served by
+// srv.
+func Stats(srv *http.Server) *ConnStats {
+	return totalStats(servers.list(srv))
+}
+
+// Stats returns the total of the statistics of each
+// of the SPDY connections in the Transport's pool.
+func (t *Transport) Stats() *ConnStats {
+	t.m.Lock()
+	conns := t.pooledConns()
+	t.m.Unlock()
+
+	return totalStats(conns)
+}
+
+func totalStats(conns []Conn) *ConnStats {
+	out := new(ConnStats)
+	out.FramesSent = make(map[string]uint64)
+	out.FramesReceived = make(map[string]uint64)
+	for _, conn := range conns {
+		out.add(conn.Stats())
+	}
+	return out
+}
+
+// PublishStats publishes the statistics of the SPDY
+// connections of v, which must be either an *http.Server
+// or a *Transport, with expvar, under the given name.
+// As with expvar.Publish, PublishStats panics if the
+// name is already in use.
+//
+//	func main() {
+//		srv := &http.Server{Addr: ":443"}
+//		spdy.AddSPDY(srv)
+//		spdy.PublishStats("spdy", srv)
+//		go http.ListenAndServe("localhost:6060", nil) // Serves /debug/vars.
+//		srv.ListenAndServeTLS("cert.pem", "key.pem")
+//	}
+func PublishStats(name string, v interface{}) {
+	var stats func() *ConnStats
+	switch v := v.(type) {
+	case *http.Server:
+		stats = func() *ConnStats { return Stats(v) }
+	case *Transport:
+		stats = v.Stats
+	default:
+		panic("spdy: PublishStats requires an *http.Server or a *Transport")
+	}
+
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return stats()
+	}))
+}
+
+// numFrameTypes is the number of frame types
+// counted by connStats, with DATA frames
+// counted as type 0.
+const numFrameTypes = CREDENTIALv3 + 1
+
+// connStats holds the counters of a connection
+// which are updated as frames are sent and
+// received. They are updated atomically, so
+// they can be read without holding the
+// connection's lock.
+type connStats struct {
+	streamsOpened   uint64
+	bytesSent       uint64
+	bytesReceived   uint64
+	framesSent      [numFrameTypes]uint64
+	framesReceived  [numFrameTypes]uint64
+	lastReceived    int64  // time of the last frame received, in Unix nanoseconds.
+	tooLarge        uint64 // responses cancelled for exceeding the size limits.
+	dataSizes       histogram
+	headerSizes     histogram
+	queueTimes      histogram
+	handlerTimes    histogram
+	decompressTimes histogram
+}
+
+func (c *connStats) streamOpened() {
+	atomic.AddUint64(&c.streamsOpened, 1)
+}
+
+func (c *connStats) responseTooLarge() {
+	atomic.AddUint64(&c.tooLarge, 1)
+}
+
+func (c *connStats) sent(frameType int, n int64) {
+	atomic.AddUint64(&c.bytesSent, uint64(n))
+	if frameType >= 0 && frameType < numFrameTypes {
+		atomic.AddUint64(&c.framesSent[frameType], 1)
+	}
+}
+
+func (c *connStats) received(frameType int, now time.Time) {
+	atomic.StoreInt64(&c.lastReceived, now.UnixNano())
+	if frameType >= 0 && frameType < numFrameTypes {
+		atomic.AddUint64(&c.framesReceived[frameType], 1)
+	}
+}
+
+// sizes records the size of a frame's data and of
+// its compressed header block. Sizes which are less
+// than zero are not recorded.
+func (c *connStats) sizes(data, header int) {
+	if data >= 0 {
+		c.dataSizes.observe(uint64(data))
+	}
+	if header >= 0 {
+		c.headerSizes.observe(uint64(header))
+	}
+}
+
+// idle returns the time since the last frame was
+// received, or since start if none has been.
+func (c *connStats) idle(start, now time.Time) time.Duration {
+	if last := atomic.LoadInt64(&c.lastReceived); last != 0 {
+		start = time.Unix(0, last)
+	}
+	return now.Sub(start)
+}
+
+// stats returns the counters as a ConnStats, naming
+// frame types with names.
+func (c *connStats) stats(names map[int]string) *ConnStats {
+	out := new(ConnStats)
+	out.Conns = 1
+	out.TotalStreamsOpened = atomic.LoadUint64(&c.streamsOpened)
+	out.BytesSent = atomic.LoadUint64(&c.bytesSent)
+	out.BytesReceived = atomic.LoadUint64(&c.bytesReceived)
+	out.ResponsesTooLarge = atomic.LoadUint64(&c.tooLarge)
+	out.FramesSent = make(map[string]uint64)
+	out.FramesReceived = make(map[string]uint64)
+	out.DataFrameSizes = c.dataSizes.snapshot()
+	out.HeaderBlockSizes = c.headerSizes.snapshot()
+	out.QueueTimes = c.queueTimes.snapshot()
+	out.HandlerLatency = c.handlerTimes.snapshot()
+	out.DecompressTimes = c.decompressTimes.snapshot()
+	for i := 0; i < numFrameTypes; i++ {
+		name := "DATA"
+		if i > 0 {
+			name = names[i]
+		}
+		if n := atomic.LoadUint64(&c.framesSent[i]); n > 0 {
+			out.FramesSent[name] = n
+		}
+		if n := atomic.LoadUint64(&c.framesReceived[i]); n > 0 {
+			out.FramesReceived[name] = n
+		}
+	}
+	return out
+}
+
+// histogram is the counterpart of Histogram
+// which is updated atomically, with a fixed
+// set of buckets, so that recording a value
+// does not allocate.
+type histogram struct {
+	count   uint64
+	sum     uint64
+	buckets [HistogramBuckets]uint64
+}
+
+func (h *histogram) observe(v uint64) {
+	i := bits.Len64(v)
+	if i >= HistogramBuckets {
+		i = HistogramBuckets - 1
+	}
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sum, v)
+	atomic.AddUint64(&h.buckets[i], 1)
+}
+
+func (h *histogram) observeDuration(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.observe(uint64(d / time.Microsecond))
+}
+
+func (h *histogram) snapshot() Histogram {
+	var out Histogram
+	out.Count = atomic.LoadUint64(&h.count)
+	out.Sum = atomic.LoadUint64(&h.sum)
+	for i := range h.buckets {
+		out.Buckets[i] = atomic.LoadUint64(&h.buckets[i])
+	}
+	return out
+}
+
+// countingReader counts the bytes read
+// from a connection.
+type countingReader struct {
+	r io.Reader
+	n *uint64
+}
+
+func (c countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	atomic.AddUint64(c.n, uint64(n))
+	return n, err
+}
@@ -0,0 +1,175 @@
+package spdy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+)
+
+// streamIDs is implemented by connections
+// which allocate and check stream IDs.
+type streamIDs interface {
+	nextLocalStreamID() (StreamID, error)
+	validRemoteStreamID(sid StreamID) bool
+}
+
+// setLastStreamIDs sets the IDs of the last request
+// and push streams seen by conn.
+func setLastStreamIDs(conn Conn, request, push StreamID) {
+	switch conn := conn.(type) {
+	case *connV3:
+		conn.lastRequestStreamID, conn.lastPushStreamID = request, push
+	case *connV2:
+		conn.lastRequestStreamID, conn.lastPushStreamID = request, push
+	}
+}
+
+// newIdleConn returns a connection which
+// is not run, for testing its state.
+func newIdleConn(t *testing.T, server bool, version uint16) Conn {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	var conn Conn
+	var err error
+	if server {
+		conn, err = NewServerConn(local, &http.Server{}, version)
+	} else {
+		conn, err = NewClientConn(local, nil, version)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestNextLocalStreamID(t *testing.T) {
+	tests := []struct {
+		name   string
+		server bool
+		last   StreamID
+		want   []StreamID // IDs allocated in turn, zero once exhausted.
+	}{
+		{"first client", false, 0, []StreamID{1, 3, 5}},
+		{"first server", true, 0, []StreamID{2, 4, 6}},
+		{"client boundary", false, MAX_STREAM_ID - 2, []StreamID{MAX_STREAM_ID, 0, 0}},
+		{"server boundary", true, MAX_STREAM_ID - 3, []StreamID{MAX_STREAM_ID - 1, 0}},
+	}
+
+	for _, version := range versions {
+		for _, test := range tests {
+			conn := newIdleConn(t, test.server, version)
+			if test.server {
+				setLastStreamIDs(conn, 0, test.last)
+			} else {
+				setLastStreamIDs(conn, test.last, 0)
+			}
+			for _, want := range test.want {
+				sid, err := conn.(streamIDs).nextLocalStreamID()
+				if want == 0 {
+					if err != ErrStreamIDsExhausted {
+						t.Errorf("SPDY/%d %s: got %d, error %v, want ErrStreamIDsExhausted", version, test.name, sid, err)
+					}
+					continue
+				}
+				if sid != want || err != nil {
+					t.Errorf("SPDY/%d %s: got %d, error %v, want %d", version, test.name, sid, err, want)
+				}
+			}
+		}
+	}
+}
+
+func TestValidRemoteStreamID(t *testing.T) {
+	tests := []struct {
+		name   string
+		server bool
+		last   StreamID
+		sid    StreamID
+		valid  bool
+	}{
+		{"first request", true, 0, 1, true},
+		{"first request skipped", true, 0, 3, true},
+		{"zero", true, 0, 0, false},
+		{"server's own ID", true, 0, 2, false},
+		{"next request", true, 5, 7, true},
+		{"skipped request", true, 5, 11, true},
+		{"reused request", true, 5, 5, false},
+		{"older request", true, 5, 3, false},
+		{"last request", true, MAX_STREAM_ID - 2, MAX_STREAM_ID, true},
+		{"first push", false, 0, 2, true},
+		{"client's own ID", false, 0, 1, false},
+		{"reused push", false, 4, 4, false},
+		{"next push", false, 4, 6, true},
+	}
+
+	for _, version := range versions {
+		for _, test := range tests {
+			conn := newIdleConn(t, test.server, version)
+			if test.server {
+				setLastStreamIDs(conn, test.last, 0)
+			} else {
+				setLastStreamIDs(conn, 0, test.last)
+			}
+			if valid := conn.(streamIDs).validRemoteStreamID(test.sid); valid != test.valid {
+				t.Errorf("SPDY/%d %s: stream %d valid is %v, want %v", version, test.name, test.sid, valid, test.valid)
+			}
+		}
+	}
+}
+
+// A server accepts requests whose stream IDs skip some, and
+// ignores requests which reuse an ID, or go back to one
+// skipped, counting them as benign errors.
+func TestRequestStreamIDs(t *testing.T) {
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			var server Conn
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+			conn := rawServerConnWith(t, srv, version, func(s Conn) { server = s })
+
+			c := newRawCompressor(version)
+			go func() {
+				for _, sid := range []StreamID{1, 5, 5, 3} {
+					conn.Write(rawSynStream(version, sid, c.block(rawRequest(version, "/")...)))
+				}
+				conn.Write([]byte{0x80, byte(version), 0, 6, 0, 0, 0, 4, 0, 0, 0, 1})
+			}()
+
+			// Handlers run concurrently, so their replies
+			// may follow the PING's.
+			var replies []StreamID
+			var pinged bool
+			within(t, 5*time.Second, "the replies", func() {
+				for !pinged || len(replies) < 2 {
+					frame, err := readRawFrame(conn, version)
+					if err != nil {
+						t.Errorf("reading the replies: %v", err)
+						return
+					}
+					switch frame := frame.(type) {
+					case *synReplyFrameV3:
+						replies = append(replies, frame.StreamID)
+					case *synReplyFrameV2:
+						replies = append(replies, frame.StreamID)
+					case *pingFrameV3, *pingFrameV2:
+						pinged = true
+					}
+				}
+			})
+			sort.Slice(replies, func(i, j int) bool { return replies[i] < replies[j] })
+			if fmt.Sprint(replies) != "[1 5]" {
+				t.Errorf("replied to streams %v, want [1 5]", replies)
+			}
+			if n := benignErrors(server); n != 2 {
+				t.Errorf("counted %d benign errors, want 2", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package spdy
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hexFrame decodes a frame written in hex, ignoring spaces.
+func hexFrame(s string) []byte {
+	data, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// zeroStreamFrames are stream-scoped frames which use
+// stream 0, the connection stream, for each version.
+var zeroStreamFrames = map[uint16][]struct {
+	name string
+	wire string
+}{
+	3: {
+		{"SYN_STREAM", "8003 0001 00 00000a 00000000 00000000 0000"},
+		{"SYN_REPLY", "8003 0002 00 000004 00000000"},
+		{"RST_STREAM", "8003 0003 00 000008 00000000 00000001"},
+		{"HEADERS", "8003 0008 00 000004 00000000"},
+		{"DATA", "00000000 00 000001 ff"},
+
+		// Updates to the session window are only valid
+		// once session flow control is in use.
+		{"WINDOW_UPDATE", "8003 0009 00 000008 00000000 00000001"},
+	},
+	2: {
+		{"SYN_STREAM", "8002 0001 00 00000a 00000000 00000000 0000"},
+		{"SYN_REPLY", "8002 0002 00 000006 00000000 0000"},
+		{"RST_STREAM", "8002 0003 00 000008 00000000 00000001"},
+		{"HEADERS", "8002 0008 00 000006 00000000 0000"},
+		{"WINDOW_UPDATE", "8002 0009 00 000008 00000000 00000001"},
+		{"DATA", "00000000 00 000001 ff"},
+	},
+}
+
+// connectionFrames are frames which legitimately use
+// stream 0, other than PING, for each version.
+var connectionFrames = map[uint16][]struct {
+	name string
+	wire string
+}{
+	3: {
+		{"SETTINGS", "8003 0004 00 000004 00000000"},
+	},
+	2: {
+		{"SETTINGS", "8002 0004 00 000004 00000000"},
+	},
+}
+
+// rawEnds open the raw end of a server or a client
+// connection, returning it with the ID of a PING which
+// the raw end may send.
+var rawEnds = map[string]func(t *testing.T, version uint16) (net.Conn, uint32){
+	"server": func(t *testing.T, version uint16) (net.Conn, uint32) {
+		return rawServerConn(t, &http.Server{Handler: http.NotFoundHandler()}, version), 1
+	},
+	"client": func(t *testing.T, version uint16) (net.Conn, uint32) {
+		_, conn := rawClientConn(t, version)
+		return conn, 2
+	},
+}
+
+// A stream-scoped frame using stream 0 is a protocol error
+// for the connection as a whole. The connection is ended
+// with a GOAWAY, rather than a RST_STREAM for stream 0.
+func TestStreamZeroRejected(t *testing.T) {
+	for _, version := range versions {
+		for _, test := range zeroStreamFrames[version] {
+			for end, open := range rawEnds {
+				version, wire, open := version, test.wire, open
+				t.Run(fmt.Sprintf("SPDY/%d/%s/%s", version, end, test.name), func(t *testing.T) {
+					conn, _ := open(t, version)
+					go conn.Write(hexFrame(wire))
+
+					var goaway bool
+					within(t, 5*time.Second, "the connection closing", func() {
+						for {
+							frame, err := readRawFrame(conn, version)
+							if err != nil {
+								return
+							}
+							switch frame := frame.(type) {
+							case *goawayFrameV3:
+								goaway = true
+								if frame.Status != GOAWAY_PROTOCOL_ERROR {
+									t.Errorf("GOAWAY with %s, want PROTOCOL_ERROR", frame.Status.goawayString())
+								}
+							case *goawayFrameV2:
+								goaway = true
+							case *rstStreamFrameV3, *rstStreamFrameV2:
+								t.Errorf("sent %v", frame)
+							}
+						}
+					})
+					if !goaway {
+						t.Error("no GOAWAY was sent")
+					}
+				})
+			}
+		}
+	}
+}
+
+// Frames which apply to the connection as a whole are
+// accepted on stream 0, leaving the connection usable.
+func TestStreamZeroAccepted(t *testing.T) {
+	for _, version := range versions {
+		for _, test := range connectionFrames[version] {
+			for end, open := range rawEnds {
+				version, wire, open := version, test.wire, open
+				t.Run(fmt.Sprintf("SPDY/%d/%s/%s", version, end, test.name), func(t *testing.T) {
+					conn, pid := open(t, version)
+					go func() {
+						conn.Write(hexFrame(wire))
+						conn.Write([]byte{0x80, byte(version), 0, 6, 0, 0, 0, 4, byte(pid >> 24), byte(pid >> 16), byte(pid >> 8), byte(pid)})
+					}()
+
+					within(t, 5*time.Second, "the PING reply", func() {
+						for {
+							frame, err := readRawFrame(conn, version)
+							if err != nil {
+								t.Errorf("reading the PING reply: %v", err)
+								return
+							}
+							switch frame := frame.(type) {
+							case *pingFrameV3:
+								if frame.PingID == pid {
+									return
+								}
+							case *pingFrameV2:
+								if frame.PingID == pid {
+									return
+								}
+							case *goawayFrameV3, *goawayFrameV2, *rstStreamFrameV3, *rstStreamFrameV2:
+								t.Errorf("sent %v", frame)
+								return
+							}
+						}
+					})
+				})
+			}
+		}
+	}
+}
+
+// With session flow control, WINDOW_UPDATE frames on
+// stream 0 grow the session window, so responses larger
+// than the initial window can be sent.
+func TestStreamZeroSessionWindowUpdate(t *testing.T) {
+	const large = 1 << 20
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, io.LimitReader(zeroReader{}, large))
+	})}
+	server, client := pipeConnsWith(t, srv, 3, func(server, client Conn) {
+		server.(sessionFlowController).enableSessionFlowControl()
+		client.(sessionFlowController).enableSessionFlowControl()
+	})
+
+	within(t, 10*time.Second, "the response", func() {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		res, err := request(client, req)
+		if err != nil || res.Data.Len() != large {
+			t.Errorf("read %d bytes, error %v, want %d", res.Data.Len(), err, large)
+		}
+	})
+	if err := ConnError(server); err != nil {
+		t.Fatalf("the connection closed: %v", err)
+	}
+}
+
+// Stream-scoped frames using stream 0 are never sent.
+func TestStreamZeroNotSent(t *testing.T) {
+	frames := []Frame{
+		&synStreamFrameV3{Header: http.Header{}},
+		&synReplyFrameV3{Header: http.Header{}},
+		&rstStreamFrameV3{Status: RST_STREAM_PROTOCOL_ERROR},
+		&headersFrameV3{Header: http.Header{}},
+		&dataFrameV3{Data: []byte{1}},
+		&synStreamFrameV2{Header: http.Header{}},
+		&synReplyFrameV2{Header: http.Header{}},
+		&rstStreamFrameV2{Status: RST_STREAM_PROTOCOL_ERROR},
+		&headersFrameV2{Header: http.Header{}},
+		&windowUpdateFrameV2{DeltaWindowSize: 1},
+		&dataFrameV2{Data: []byte{1}},
+	}
+	for _, frame := range frames {
+		if data, err := MarshalFrame(frame); err == nil {
+			t.Errorf("%T with stream 0 marshalled to %x", frame, data)
+		}
+	}
+}
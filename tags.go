@@ -0,0 +1,125 @@
+package spdy
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// streamTags holds the tags set on a stream with
+// Stream.SetTag. The zero value holds no tags, and
+// allocates nothing until one is set.
+type streamTags struct {
+	sync.Mutex
+	m map[string]string
+}
+
+// set sets the tag, replacing any previous value.
+func (t *streamTags) set(key, value string) error {
+	if len(key)+len(value) > MAX_STREAM_TAG_SIZE {
+		return ErrTagLimit
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if _, ok := t.m[key]; !ok && len(t.m) >= MAX_STREAM_TAGS {
+		return ErrTagLimit
+	}
+	if t.m == nil {
+		t.m = make(map[string]string)
+	}
+	t.m[key] = value
+	return nil
+}
+
+// copy returns a copy of the tags, or
+// nil if none have been set.
+func (t *streamTags) copy() map[string]string {
+	t.Lock()
+	defer t.Unlock()
+
+	if len(t.m) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(t.m))
+	for key, value := range t.m {
+		out[key] = value
+	}
+	return out
+}
+
+// String returns the tags in the form " [key=value ...]",
+// sorted by key, for use in log lines. If no tags have
+// been set, the empty string is returned.
+func (t *streamTags) String() string {
+	t.Lock()
+	defer t.Unlock()
+
+	if len(t.m) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(t.m))
+	for key := range t.m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	buf := new(strings.Builder)
+	buf.WriteString(" [")
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		buf.WriteString(t.m[key])
+	}
+	buf.WriteByte(']')
+	return buf.String()
+}
+
+// tagsKey is the context key for the tags of the stream
+// serving a request, or those to be set on the stream
+// carrying a request, as given to WithStreamTags.
+type tagsKey struct{}
+
+// SetStreamTag sets a tag on the SPDY stream serving the
+// request whose context is ctx, as with Stream.SetTag, so
+// that code without the ResponseWriter, such as middleware,
+// can tag the stream. If ctx did not come from a SPDY
+// request, nothing happens.
+//
+//	func withTenant(h http.Handler) http.Handler {
+//		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+//			spdy.SetStreamTag(r.Context(), "tenant", tenantOf(r))
+//			h.ServeHTTP(w, r)
+//		})
+//	}
+func SetStreamTag(ctx context.Context, key, value string) error {
+	if tags, ok := ctx.Value(tagsKey{}).(*streamTags); ok {
+		return tags.set(key, value)
+	}
+	return nil
+}
+
+// WithStreamTags returns a copy of ctx in which requests
+// made over SPDY are tagged with tags, as with
+// Stream.SetTag. Tags beyond the limits are ignored.
+func WithStreamTags(ctx context.Context, tags map[string]string) context.Context {
+	return context.WithValue(ctx, tagsKey{}, tags)
+}
+
+// requestTags sets any tags given to WithStreamTags
+// in the request's context.
+func requestTags(tags *streamTags, request *http.Request) {
+	m, ok := request.Context().Value(tagsKey{}).(map[string]string)
+	if !ok {
+		return
+	}
+	for key, value := range m {
+		tags.set(key, value)
+	}
+}
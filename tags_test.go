@@ -0,0 +1,152 @@
+package spdy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer which can be
+// written and read concurrently.
+type syncBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+func TestStreamTagLimits(t *testing.T) {
+	var tags streamTags
+	if tags.String() != "" || tags.copy() != nil {
+		t.Fatal("an untagged stream has tags")
+	}
+	if n := testing.AllocsPerRun(100, func() { _ = tags.String(); tags.copy() }); n != 0 {
+		t.Errorf("an untagged stream made %v allocations", n)
+	}
+
+	for i := 0; i < MAX_STREAM_TAGS; i++ {
+		if err := tags.set(fmt.Sprintf("k%02d", i), "v"); err != nil {
+			t.Fatalf("tag %d: %v", i, err)
+		}
+	}
+	if err := tags.set("extra", "v"); err != ErrTagLimit {
+		t.Errorf("a tag over MAX_STREAM_TAGS gave %v, want ErrTagLimit", err)
+	}
+	if err := tags.set("k00", "replaced"); err != nil {
+		t.Errorf("replacing a tag at the limit gave %v", err)
+	}
+	if err := tags.set("k01", strings.Repeat("v", MAX_STREAM_TAG_SIZE)); err != ErrTagLimit {
+		t.Errorf("a tag over MAX_STREAM_TAG_SIZE gave %v, want ErrTagLimit", err)
+	}
+
+	got := tags.copy()
+	if len(got) != MAX_STREAM_TAGS || got["k00"] != "replaced" || got["k01"] != "v" {
+		t.Errorf("got tags %v", got)
+	}
+	got["k02"] = "changed"
+	if tags.copy()["k02"] != "v" {
+		t.Error("changing the copy changed the tags")
+	}
+	if s := tags.String(); !strings.HasPrefix(s, " [k00=replaced k01=v k02=v ") || !strings.HasSuffix(s, " k15=v]") {
+		t.Errorf("got %q", s)
+	}
+}
+
+// Tags set by the handler, or by middleware through the
+// request's context, appear in the stream's snapshot, in
+// its log lines, and in the RequestInfo for the request.
+// Tags given to WithStreamTags are set on client streams.
+func TestStreamTags(t *testing.T) {
+	logs := new(syncBuffer)
+	logger := log
+	SetLogOutput(logs)
+	defer SetLogger(logger)
+
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			tagged := make(chan struct{})
+			release := make(chan struct{})
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := SetStreamTag(r.Context(), "tenant", "acme"); err != nil {
+					t.Error(err)
+				}
+				if err := w.(Stream).SetTag("request", r.URL.Query().Get("id")); err != nil {
+					t.Error(err)
+				}
+				tagged <- struct{}{}
+				<-release
+				if r.URL.Path == "/panic" {
+					panic("tagged panic")
+				}
+				w.WriteHeader(http.StatusTeapot)
+			})}
+			infos := make(chan RequestInfo, 2)
+			server, client := pipeConnsWith(t, srv, version, func(server, client Conn) {
+				server.(hooker).setHooks(&ConnHooks{OnRequestComplete: func(conn Conn, info RequestInfo) { infos <- info }})
+			})
+
+			send := func(path string) {
+				ctx := WithStreamTags(context.Background(), map[string]string{"caller": "test"})
+				req, _ := http.NewRequest("GET", "https://example.com"+path, nil)
+				go request(client, req.WithContext(ctx))
+				select {
+				case <-tagged:
+				case <-time.After(5 * time.Second):
+					t.Fatal("the request was not served")
+				}
+			}
+
+			// While the handler runs, the tags on each end
+			// are in its snapshot.
+			send("/?id=1")
+			want := map[string]string{"tenant": "acme", "request": "1"}
+			if streams := server.(snapshotter).snapshot().Streams; len(streams) != 1 || !reflect.DeepEqual(streams[0].Tags, want) {
+				t.Errorf("the server's snapshot has streams %+v, want tags %v", streams, want)
+			}
+			if streams := client.(snapshotter).snapshot().Streams; len(streams) != 1 || !reflect.DeepEqual(streams[0].Tags, map[string]string{"caller": "test"}) {
+				t.Errorf("the client's snapshot has streams %+v, want the WithStreamTags tags", streams)
+			}
+			complete := func(want RequestInfo) {
+				t.Helper()
+				release <- struct{}{}
+				select {
+				case info := <-infos:
+					want.Tags = map[string]string{"tenant": "acme", "request": want.URL[len(want.URL)-1:]}
+					info.Duration = 0
+					if !reflect.DeepEqual(info, want) {
+						t.Errorf("got %+v, want %+v", info, want)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("OnRequestComplete was not called")
+				}
+			}
+			complete(RequestInfo{StreamID: 1, Method: "GET", URL: "https://example.com/?id=1", Status: http.StatusTeapot})
+
+			// A panicking handler's request is still reported.
+			send("/panic?id=2")
+			complete(RequestInfo{StreamID: 3, Method: "GET", URL: "https://example.com/panic?id=2"})
+
+			line := "Error: Panic serving stream 3 [request=2 tenant=acme]: tagged panic"
+			if !strings.Contains(logs.String(), line) {
+				t.Errorf("the logs do not contain %q:\n%s", line, logs)
+			}
+		})
+	}
+}
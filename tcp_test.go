@@ -0,0 +1,118 @@
+package spdy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a TCP connection over
+// the loopback interface.
+func tcpPair(t *testing.T) (local, remote net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen on the loopback interface: %v", err)
+	}
+	defer l.Close()
+
+	local, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err = l.Accept()
+	if err != nil {
+		local.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	return local, remote
+}
+
+// Closing a connection whose read loop is blocked on a TCP
+// read returns promptly, and the loop ends.
+func TestCloseDuringBlockedRead(t *testing.T) {
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			local, _ := tcpPair(t)
+			client, err := NewClientConn(local, nil, version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			running := make(chan struct{})
+			go func() { defer close(running); client.Run() }()
+
+			// Give the read loop time to block.
+			time.Sleep(10 * time.Millisecond)
+			within(t, 2*time.Second, "closing the connection", func() {
+				client.Close()
+				<-running
+			})
+		})
+	}
+}
+
+// A TLS handshake which passes its deadline fails with an
+// error which is treated as teardown, given as ErrTimeout.
+func TestHandshakeDeadline(t *testing.T) {
+	local, _ := tcpPair(t)
+	local.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	conn := tls.Client(local, &tls.Config{InsecureSkipVerify: true, NextProtos: NPNStrings()})
+
+	var err error
+	within(t, 5*time.Second, "the handshake", func() { err = conn.Handshake() })
+	if err == nil {
+		t.Fatal("the handshake succeeded")
+	}
+	if reason, ok := teardownError(err); !ok || reason != ErrTimeout {
+		t.Errorf("teardownError(%v) = %v, %v; want ErrTimeout, true", err, reason, ok)
+	}
+}
+
+// Writing to a TCP connection whose peer has closed it fails
+// with an error which is treated as teardown, given as
+// io.EOF. A connection whose peer closes ends with io.EOF,
+// and later pings fail rather than blocking.
+func TestWriteAfterPeerClose(t *testing.T) {
+	local, remote := tcpPair(t)
+	remote.Close()
+
+	var err error
+	within(t, 5*time.Second, "the write to fail", func() {
+		for err == nil {
+			_, err = local.Write(make([]byte, 1<<10))
+			time.Sleep(time.Millisecond)
+		}
+	})
+	if reason, ok := teardownError(err); !ok || reason != io.EOF {
+		t.Errorf("teardownError(%v) = %v, %v; want io.EOF, true", err, reason, ok)
+	}
+
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			client, remote := tcpClientConn(t, version)
+			remote.Close()
+			within(t, 5*time.Second, "the connection closing", func() {
+				for ConnError(client) == nil {
+					time.Sleep(time.Millisecond)
+				}
+			})
+			if err := ConnError(client); err != io.EOF {
+				t.Errorf("the connection closed with %v, want io.EOF", err)
+			}
+			within(t, time.Second, "the ping", func() {
+				if _, err := client.Ping(); err == nil {
+					t.Error("Ping succeeded after the peer closed")
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package spdy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestTeardownError(t *testing.T) {
+	tests := []struct {
+		err      error
+		want     error
+		teardown bool
+	}{
+		{io.EOF, io.EOF, true},
+		{net.ErrClosed, errConnClosed, true},
+		{&net.OpError{Op: "read", Err: net.ErrClosed}, errConnClosed, true},
+		{io.ErrClosedPipe, errConnClosed, true},
+		{fmt.Errorf("write: %w", io.ErrClosedPipe), errConnClosed, true},
+		{&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, io.EOF, true},
+		{syscall.EPIPE, io.EOF, true},
+		{timeoutError{}, ErrTimeout, true},
+		{io.ErrUnexpectedEOF, io.ErrUnexpectedEOF, false},
+	}
+
+	for _, test := range tests {
+		got, teardown := teardownError(test.err)
+		if got != test.want || teardown != test.teardown {
+			t.Errorf("teardownError(%v) = %v, %v; want %v, %v", test.err, got, teardown, test.want, test.teardown)
+		}
+	}
+
+	// A closed net.Pipe gives io.ErrClosedPipe.
+	local, remote := net.Pipe()
+	local.Close()
+	_, err := local.Read(make([]byte, 1))
+	if _, ok := teardownError(err); !ok {
+		t.Errorf("read from a closed pipe gave %v, which is not teardown", err)
+	}
+	_, err = remote.Write([]byte{1})
+	if _, ok := teardownError(err); !ok {
+		t.Errorf("write to a closed pipe gave %v, which is not teardown", err)
+	}
+}
+
+// rawGoaway returns a GOAWAY frame, as sent on the wire.
+// SPDY/2 has no status, so it is left out.
+func rawGoaway(version uint16, lastGood StreamID, status StatusCode) []byte {
+	data := []byte{0x80, byte(version), 0, 7, 0, 0, 0, 8, byte(lastGood >> 24), byte(lastGood >> 16), byte(lastGood >> 8), byte(lastGood)}
+	if version == 2 {
+		data[7] = 4
+		return data
+	}
+	return append(data, byte(status>>24), byte(status>>16), byte(status>>8), byte(status))
+}
+
+// A handler writing a response when its connection is
+// torn down is given a ConnClosedError, which has the
+// reason the connection closed, and whether the client's
+// GOAWAY said it had processed the stream.
+func TestHandlerSeesCloseReason(t *testing.T) {
+	tests := []struct {
+		name         string
+		version      uint16
+		goaway       []byte // sent before the connection closes, if any.
+		reason       func(error) bool
+		acknowledged bool
+	}{
+		{
+			name:    "closed",
+			version: 3,
+			reason:  func(err error) bool { return err == errConnClosed || err == io.EOF },
+		},
+		{
+			name:    "closed",
+			version: 2,
+			reason:  func(err error) bool { return err == errConnClosed || err == io.EOF },
+		},
+		{
+			name:         "goaway error, processed",
+			version:      3,
+			goaway:       rawGoaway(3, 1, GOAWAY_INTERNAL_ERROR),
+			reason:       func(err error) bool { return errors.Is(err, ErrGoAway) },
+			acknowledged: true,
+		},
+		{
+			name:    "goaway error, not processed",
+			version: 3,
+			goaway:  rawGoaway(3, 0, GOAWAY_PROTOCOL_ERROR),
+			reason: func(err error) bool {
+				goaway, ok := err.(*GoAwayError)
+				return ok && goaway.Status == GOAWAY_PROTOCOL_ERROR && goaway.LastGoodStreamID == 0
+			},
+		},
+		{
+			name:         "goaway then closed",
+			version:      3,
+			goaway:       rawGoaway(3, 1, GOAWAY_OK),
+			reason:       func(err error) bool { return err == ErrGoAway },
+			acknowledged: true,
+		},
+		{
+			name:         "goaway then closed",
+			version:      2,
+			goaway:       rawGoaway(2, 1, GOAWAY_OK),
+			reason:       func(err error) bool { return err == ErrGoAway },
+			acknowledged: true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(fmt.Sprintf("SPDY/%d/%s", test.version, test.name), func(t *testing.T) {
+			writeErr := make(chan error, 1)
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				chunk := make([]byte, 1024)
+				for {
+					if _, err := w.Write(chunk); err != nil {
+						writeErr <- err
+						return
+					}
+					w.(http.Flusher).Flush()
+				}
+			})}
+			conn := rawServerConn(t, srv, test.version)
+
+			// The client reads what it is sent, but sends
+			// no WINDOW_UPDATE, so the handler is left
+			// waiting for the window with SPDY/3.
+			responding := make(chan struct{})
+			go func() {
+				var once sync.Once
+				for {
+					frame, err := readRawFrame(conn, test.version)
+					if err != nil {
+						return
+					}
+					switch frame.(type) {
+					case *dataFrameV3, *dataFrameV2:
+						once.Do(func() { close(responding) })
+					}
+				}
+			}()
+
+			c := newRawCompressor(test.version)
+			conn.Write(rawSynStream(test.version, 1, c.block(rawRequest(test.version, "/")...)))
+			select {
+			case <-responding:
+			case <-time.After(5 * time.Second):
+				t.Fatal("no response was sent")
+			}
+
+			if test.goaway != nil {
+				conn.Write(test.goaway)
+				time.Sleep(50 * time.Millisecond)
+			}
+			conn.Close()
+
+			var err error
+			select {
+			case err = <-writeErr:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the handler's Write did not fail")
+			}
+			closed, ok := err.(*ConnClosedError)
+			if !ok {
+				t.Fatalf("Write returned %v (%T), want a ConnClosedError", err, err)
+			}
+			if closed.StreamID != 1 {
+				t.Errorf("StreamID is %d, want 1", closed.StreamID)
+			}
+			if !test.reason(closed.Reason) {
+				t.Errorf("Reason is %v (%T)", closed.Reason, closed.Reason)
+			}
+			if closed.Acknowledged != test.acknowledged {
+				t.Errorf("Acknowledged is %v, want %v", closed.Acknowledged, test.acknowledged)
+			}
+		})
+	}
+}
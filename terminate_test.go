@@ -0,0 +1,351 @@
+package spdy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// checkTerminated checks that the stream with the given ID
+// has been ended completely: its state is closed, and the
+// connection has forgotten it, and freed its slot in the
+// stream limit, once finished streams have been pruned, as
+// they are before each new stream is counted.
+func checkTerminated(t *testing.T, conn Conn, stream Stream) {
+	t.Helper()
+	if state := stream.State(); !state.Closed() {
+		t.Errorf("stream %d was left %s", stream.StreamID(), state)
+	}
+
+	sid := stream.StreamID()
+	var known bool
+	var slots, limit uint32
+	switch conn := conn.(type) {
+	case *connV3:
+		conn.Lock()
+		if conn.streams != nil {
+			conn.pruneStreams()
+		}
+		_, known = conn.streams[sid]
+		slots, limit = conn.requestStreamLimit.Available(), conn.requestStreamLimit.Limit()
+		conn.Unlock()
+	case *connV2:
+		conn.Lock()
+		if conn.streams != nil {
+			conn.pruneStreams()
+		}
+		_, known = conn.streams[sid]
+		slots, limit = conn.requestStreamLimit.Available(), conn.requestStreamLimit.Limit()
+		conn.Unlock()
+	}
+	if known {
+		t.Errorf("stream %d is still held by the connection", sid)
+	}
+	if slots != limit {
+		t.Errorf("%d of %d stream slots are free", slots, limit)
+	}
+}
+
+// Every way in which a stream can end leaves it in the
+// same state, with its owner told why it ended.
+func TestTerminateStream(t *testing.T) {
+	tests := []struct {
+		name    string
+		trigger func(t *testing.T, version uint16, client Conn, remote *rawPeer, cancel func())
+		closes  bool       // whether the owner must close the stream.
+		reset   StatusCode // sent by the client, if any.
+		check   func(err error) bool
+	}{
+		{
+			"finished",
+			func(t *testing.T, version uint16, client Conn, remote *rawPeer, cancel func()) {
+				remote.write(rawSynReply(version, 1, newRawCompressor(version)))
+			},
+			true,
+			0,
+			func(err error) bool { return err == nil },
+		},
+		{
+			"RST_STREAM received",
+			func(t *testing.T, version uint16, client Conn, remote *rawPeer, cancel func()) {
+				remote.write(rawRstStream(version, 1, RST_STREAM_INVALID_STREAM))
+			},
+			false,
+			0,
+			func(err error) bool {
+				var stream *StreamError
+				return errors.As(err, &stream) && stream.Status == RST_STREAM_INVALID_STREAM
+			},
+		},
+		{
+			"refused",
+			func(t *testing.T, version uint16, client Conn, remote *rawPeer, cancel func()) {
+				remote.write(rawRstStream(version, 1, RST_STREAM_REFUSED_STREAM))
+			},
+			false,
+			0,
+			func(err error) bool {
+				var stream *StreamError
+				return errors.As(err, &stream) && stream.Status == RST_STREAM_REFUSED_STREAM
+			},
+		},
+		{
+			"not processed",
+			func(t *testing.T, version uint16, client Conn, remote *rawPeer, cancel func()) {
+				remote.write(rawGoaway(version, 0, 0))
+			},
+			false,
+			0,
+			func(err error) bool { return err == ErrNotProcessed },
+		},
+		{
+			"cancelled",
+			func(t *testing.T, version uint16, client Conn, remote *rawPeer, cancel func()) {
+				cancel()
+			},
+			false,
+			RST_STREAM_CANCEL,
+			func(err error) bool { return err == ErrStreamCancelled },
+		},
+		{
+			"torn down",
+			func(t *testing.T, version uint16, client Conn, remote *rawPeer, cancel func()) {
+				client.Close()
+			},
+			false,
+			0,
+			func(err error) bool {
+				var closed *ConnClosedError
+				return errors.As(err, &closed)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		for _, version := range versions {
+			test, version := test, version
+			t.Run(fmt.Sprintf("SPDY/%d %s", version, test.name), func(t *testing.T) {
+				client, conn := rawClientConn(t, version)
+				remote := newRawPeer(conn, version)
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				req, _ := http.NewRequest("GET", "https://example.com/", nil)
+				stream, err := client.Request(req.WithContext(ctx), nil, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				errs := make(chan error, 1)
+				go func() { errs <- stream.Run() }()
+				remote.await(t, "the request", func(frame Frame) bool {
+					switch frame.(type) {
+					case *synStreamFrameV3, *synStreamFrameV2:
+						return true
+					}
+					return false
+				})
+
+				test.trigger(t, version, client, remote, cancel)
+				select {
+				case err := <-errs:
+					if !test.check(err) {
+						t.Errorf("the request ended with %v", err)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("the request did not end")
+				}
+				// A stream requested without a Receiver stays open
+				// for writing until its owner closes it, once the
+				// response has ended, as the Transport does.
+				if test.closes {
+					stream.Close()
+				}
+				if test.reset != 0 {
+					remote.await(t, "the RST_STREAM", func(frame Frame) bool {
+						switch frame := frame.(type) {
+						case *rstStreamFrameV3:
+							return frame.StreamID == 1 && frame.Status == test.reset
+						case *rstStreamFrameV2:
+							return frame.StreamID == 1 && frame.Status == test.reset
+						}
+						return false
+					})
+				}
+				within(t, 5*time.Second, "checking the stream", func() {
+					checkTerminated(t, client, stream)
+				})
+			})
+		}
+	}
+}
+
+// rawPeer reads the frames sent to the other end of a
+// raw connection, and writes raw frames to it.
+type rawPeer struct {
+	conn   net.Conn
+	frames chan Frame
+}
+
+func newRawPeer(conn net.Conn, version uint16) *rawPeer {
+	p := &rawPeer{conn: conn, frames: make(chan Frame, 100)}
+	go func() {
+		defer close(p.frames)
+		for {
+			frame, err := readRawFrame(conn, version)
+			if err != nil {
+				return
+			}
+			p.frames <- frame
+		}
+	}()
+	return p
+}
+
+// write writes data without waiting for it to be read.
+func (p *rawPeer) write(data []byte) {
+	go p.conn.Write(data)
+}
+
+// await discards frames until match returns true.
+func (p *rawPeer) await(t *testing.T, what string, match func(Frame) bool) {
+	t.Helper()
+	for {
+		select {
+		case frame, ok := <-p.frames:
+			if !ok {
+				t.Fatalf("the connection closed before %s", what)
+			}
+			if match(frame) {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// Streams which finish free their slots, so a connection
+// serves many more requests than MAX_CONCURRENT_STREAMS,
+// and its header compression contexts stay in step.
+func TestManySequentialRequests(t *testing.T) {
+	const n = 2500
+	for _, version := range versions {
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		})}
+		_, client := pipeConns(t, srv, version)
+		within(t, 30*time.Second, "the requests", func() {
+			for i := 0; i < n; i++ {
+				req, _ := http.NewRequest("GET", fmt.Sprintf("https://example.com/%d", i), nil)
+				res, err := request(client, req)
+				if err != nil {
+					t.Errorf("SPDY/%d: request %d: %v", version, i, err)
+					return
+				}
+				if res.Data.String() != "ok" {
+					t.Errorf("SPDY/%d: request %d got %q", version, i, res.Data.String())
+					return
+				}
+			}
+		})
+	}
+}
+
+// Stream.Reset sends a RST_STREAM with any status code
+// the connection's version defines, and ends the stream
+// as other resets do. The request's owner is given a
+// *StreamError with the status, except for CANCEL, which
+// cancels the request, as Cancel does. Other codes are
+// rejected.
+func TestResetStatus(t *testing.T) {
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			client, conn := rawClientConn(t, version)
+			remote := newRawPeer(conn, version)
+
+			var max StatusCode = RST_STREAM_FRAME_TOO_LARGE
+			if version == 2 {
+				max = RST_STREAM_FLOW_CONTROL_ERROR
+			}
+			sid := StreamID(1)
+			for code := StatusCode(RST_STREAM_PROTOCOL_ERROR); code <= max+1; code++ {
+				req, _ := http.NewRequest("GET", "https://example.com/", nil)
+				stream, err := client.Request(req, nil, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				errs := make(chan error, 1)
+				go func() { errs <- stream.Run() }()
+				remote.await(t, "the request", func(frame Frame) bool {
+					switch frame.(type) {
+					case *synStreamFrameV3, *synStreamFrameV2:
+						return true
+					}
+					return false
+				})
+
+				// Codes the version does not define are
+				// rejected, leaving the stream open.
+				if code > max {
+					if err := stream.Reset(code); err == nil {
+						t.Errorf("Reset(%d) succeeded", code)
+					}
+					if err := stream.Reset(0); err == nil {
+						t.Error("Reset(0) succeeded")
+					}
+					if stream.State().Closed() {
+						t.Error("the stream closed")
+					}
+					break
+				}
+
+				if err := stream.Reset(code); err != nil {
+					t.Fatalf("Reset(%s): %v", code, err)
+				}
+				var sent StatusCode
+				remote.await(t, "the RST_STREAM", func(frame Frame) bool {
+					switch frame := frame.(type) {
+					case *rstStreamFrameV3:
+						sent = frame.Status
+						return frame.StreamID == sid
+					case *rstStreamFrameV2:
+						sent = frame.Status
+						return frame.StreamID == sid
+					}
+					return false
+				})
+				if sent != code {
+					t.Errorf("Reset(%s) sent %s", code, sent)
+				}
+				within(t, 5*time.Second, "the request ending", func() {
+					err := <-errs
+					var reset *StreamError
+					switch {
+					case code == RST_STREAM_CANCEL:
+						if err != ErrStreamCancelled {
+							t.Errorf("Reset(%s): the request ended with %v, want ErrStreamCancelled", code, err)
+						}
+					case !errors.As(err, &reset) || *reset != (StreamError{sid, code, false}):
+						t.Errorf("Reset(%s): the request ended with %v", code, err)
+					}
+				})
+				checkTerminated(t, client, stream)
+
+				// Once reset, the stream cannot be reset
+				// again, and cancelling it has no effect.
+				if err := stream.Reset(code); err != ErrStreamClosed {
+					t.Errorf("Reset(%s) again gave %v, want ErrStreamClosed", code, err)
+				}
+				if err := stream.(Canceler).Cancel(); err != nil {
+					t.Errorf("Cancel after Reset(%s) gave %v", code, err)
+				}
+				sid += 2
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package spdy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Deadlines are refreshed by the send loop after each frame,
+// so must not wait for Close, which waits for the send loop.
+func TestWriteTimeoutClose(t *testing.T) {
+	for _, version := range versions {
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			srv := &http.Server{
+				Handler:      http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("hello")) }),
+				ReadTimeout:  time.Minute,
+				WriteTimeout: time.Minute,
+			}
+			server, client := pipeConns(t, srv, version)
+
+			req, _ := http.NewRequest("GET", "http://example.com/", nil)
+			res, err := request(client, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Data.String() != "hello" {
+				t.Fatalf("got body %q", res.Data)
+			}
+
+			within(t, 5*time.Second, "Close", func() { server.Close() })
+		})
+	}
+}
+
+// Deadlines are refreshed by the send loop while the
+// read loop and requests are using the connection.
+func TestWriteTimeoutConcurrentRequests(t *testing.T) {
+	for _, version := range versions {
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			srv := &http.Server{
+				Handler:      http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(r.URL.Path)) }),
+				WriteTimeout: time.Minute,
+			}
+			_, client := pipeConnsWith(t, srv, version, func(server, client Conn) {
+				client.(timeoutSetter).setTimeouts(time.Minute, time.Minute)
+			})
+
+			within(t, 20*time.Second, "the requests", func() {
+				var wg sync.WaitGroup
+				for i := 0; i < 50; i++ {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						path := fmt.Sprintf("/%d", i)
+						req, _ := http.NewRequest("POST", "http://example.com"+path, bytes.NewReader(make([]byte, 1000)))
+						res, err := request(client, req)
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						if res.Data.String() != path {
+							t.Errorf("got body %q, want %q", res.Data, path)
+						}
+					}(i)
+				}
+				wg.Wait()
+			})
+
+			within(t, 5*time.Second, "Close", func() { client.Close() })
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package spdy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// tlsPipe returns the ends of a net.Pipe running TLS, once
+// the handshake has completed, negotiating the given SPDY
+// version.
+func tlsPipe(t *testing.T, version uint16) (server, client *tls.Conn) {
+	t.Helper()
+	return tlsPipeWith(t, version, new(tls.Config))
+}
+
+// tlsPipeWith is tlsPipe, with the server using the given
+// config, to which its certificate and protocols are added.
+func tlsPipeWith(t *testing.T, version uint16, config *tls.Config) (server, client *tls.Conn) {
+	t.Helper()
+
+	// Borrow httptest's certificate.
+	ts := httptest.NewUnstartedServer(nil)
+	ts.StartTLS()
+	config.Certificates = ts.TLS.Certificates
+	config.NextProtos = NPNStrings()
+	ts.Close()
+
+	proto := fmt.Sprintf("spdy/%d", version)
+	local, remote := net.Pipe()
+	server = tls.Server(remote, config)
+	client = tls.Client(local, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{proto}})
+
+	errs := make(chan error, 1)
+	go func() { errs <- server.Handshake() }()
+	within(t, 5*time.Second, "the handshake", func() {
+		if err := client.Handshake(); err != nil {
+			t.Error(err)
+		}
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	})
+	if t.Failed() {
+		t.FailNow()
+	}
+	return server, client
+}
+
+// A connection over TLS can be created and served. Its
+// TLS state is given by TLSState, and handlers find it in
+// each request's TLS field, as with net/http.
+func TestTLSState(t *testing.T) {
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			serverTLS, clientTLS := tlsPipe(t, version)
+			states := make(chan *tls.ConnectionState, 1)
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				states <- r.TLS
+			})}
+
+			server, err := NewServerConn(serverTLS, srv, version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, err := NewClientConn(clientTLS, nil, version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, conn := range []Conn{server, client} {
+				conn := conn
+				running := make(chan struct{})
+				go func() { defer close(running); conn.Run() }()
+				t.Cleanup(func() {
+					within(t, 10*time.Second, "closing the connection", func() {
+						serverTLS.Close()
+						clientTLS.Close()
+						conn.Close()
+						<-running
+					})
+				})
+			}
+
+			within(t, 5*time.Second, "the request", func() {
+				req, _ := http.NewRequest("GET", "https://example.com/", nil)
+				if _, err := request(client, req); err != nil {
+					t.Errorf("the request failed: %v", err)
+				}
+			})
+			want := fmt.Sprintf("spdy/%d", version)
+			if state := <-states; state == nil || !state.HandshakeComplete || state.NegotiatedProtocol != want {
+				t.Errorf("handler saw TLS state %+v", state)
+			}
+
+			for name, conn := range map[string]Conn{"server": server, "client": client} {
+				state := TLSState(conn)
+				if state == nil || state.NegotiatedProtocol != want {
+					t.Errorf("%s TLS state is %+v", name, state)
+					continue
+				}
+
+				// Each call gives a copy.
+				state.NegotiatedProtocol = "changed"
+				if again := TLSState(conn); again.NegotiatedProtocol != want {
+					t.Errorf("%s TLS state was changed through a copy", name)
+				}
+			}
+		})
+	}
+
+	// Connections without TLS have no TLS state.
+	server, client := pipeConns(t, &http.Server{}, 3)
+	if TLSState(server) != nil || TLSState(client) != nil {
+		t.Error("a connection without TLS has TLS state")
+	}
+}
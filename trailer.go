@@ -0,0 +1,107 @@
+package spdy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// TrailerReceiver is implemented by Receivers which handle
+// a response's trailers separately from its headers.
+//
+// Trailers are sent by the server in a HEADERS frame with
+// FLAG_FIN, after the SYN_REPLY and any response body. HEADERS
+// frames received before then are merged into the response's
+// headers as usual. Receivers which do not implement
+// TrailerReceiver are given trailers with ReceiveHeader.
+//
+// SPDY/2's HEADERS frames cannot end a stream, so on SPDY/2
+// connections trailers are always given with ReceiveHeader.
+//
+// Responses returned by a Transport give any trailers in
+// their Trailer field.
+type TrailerReceiver interface {
+	ReceiveTrailer(request *http.Request, trailer http.Header)
+}
+
+// receiveTrailer gives the trailer to receiver, using
+// ReceiveTrailer if receiver is a TrailerReceiver.
+func receiveTrailer(receiver Receiver, request *http.Request, trailer http.Header) {
+	if t, ok := receiver.(TrailerReceiver); ok {
+		t.ReceiveTrailer(request, trailer)
+		return
+	}
+	receiver.ReceiveHeader(request, trailer)
+}
+
+// responseTrailers tracks the trailers a handler has
+// declared in its response. As with net/http, trailers
+// are declared by naming them in the Trailer header
+// before the response headers are sent, or by setting
+// them with the http.TrailerPrefix at any time before
+// the handler returns.
+type responseTrailers map[string]bool
+
+// declare records the trailers named in
+// header's Trailer header.
+func (t *responseTrailers) declare(header http.Header) {
+	for _, value := range header["Trailer"] {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if *t == nil {
+				*t = make(responseTrailers)
+			}
+			(*t)[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+}
+
+// is indicates whether the header with the
+// given name is a trailer.
+func (t responseTrailers) is(name string) bool {
+	return t[name] || strings.HasPrefix(name, http.TrailerPrefix)
+}
+
+// any indicates whether header holds any trailers.
+func (t responseTrailers) any(header http.Header) bool {
+	for name := range header {
+		if t.is(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// take removes any trailers from header, returning
+// them without the http.TrailerPrefix, if used.
+func (t responseTrailers) take(header http.Header) http.Header {
+	var trailer http.Header
+	for name, values := range header {
+		if !t.is(name) {
+			continue
+		}
+		delete(header, name)
+		if trailer == nil {
+			trailer = make(http.Header)
+		}
+		name = http.CanonicalHeaderKey(strings.TrimPrefix(name, http.TrailerPrefix))
+		trailer[name] = append(trailer[name], values...)
+	}
+	return trailer
+}
+
+// without returns a copy of header without
+// any trailers.
+func (t responseTrailers) without(header http.Header) http.Header {
+	out := make(http.Header, len(header))
+	for name, values := range header {
+		if !t.is(name) {
+			vv := make([]string, len(values))
+			copy(vv, values)
+			out[name] = vv
+		}
+	}
+	return out
+}
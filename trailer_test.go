@@ -0,0 +1,174 @@
+package spdy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestResponseTrailers(t *testing.T) {
+	var trailers responseTrailers
+	trailers.declare(http.Header{"Trailer": {"x-checksum, X-Count", " , "}, "X-Other": {"o"}})
+
+	for name, want := range map[string]bool{
+		"X-Checksum":                  true,
+		"X-Count":                     true,
+		http.TrailerPrefix + "X-Late": true,
+		"X-Other":                     false,
+		"Trailer":                     false,
+	} {
+		if got := trailers.is(name); got != want {
+			t.Errorf("is(%q) is %v, want %v", name, got, want)
+		}
+	}
+
+	header := http.Header{
+		"X-Checksum":                  {"abc"},
+		http.TrailerPrefix + "x-late": {"late"},
+		"X-Other":                     {"o"},
+	}
+	if !trailers.any(header) {
+		t.Error("any found no trailers")
+	}
+	if trailers.any(http.Header{"X-Other": {"o"}}) {
+		t.Error("any found a trailer in headers without any")
+	}
+
+	without := trailers.without(header)
+	if want := (http.Header{"X-Other": {"o"}}); !reflect.DeepEqual(without, want) {
+		t.Errorf("without gave %v, want %v", without, want)
+	}
+	without["X-Other"][0] = "changed"
+	if header.Get("X-Other") != "o" {
+		t.Error("without gave values shared with the header")
+	}
+
+	trailer := trailers.take(header)
+	if want := (http.Header{"X-Checksum": {"abc"}, "X-Late": {"late"}}); !reflect.DeepEqual(trailer, want) {
+		t.Errorf("take gave %v, want %v", trailer, want)
+	}
+	if want := (http.Header{"X-Other": {"o"}}); !reflect.DeepEqual(header, want) {
+		t.Errorf("take left %v, want %v", header, want)
+	}
+	if trailer := trailers.take(header); trailer != nil {
+		t.Errorf("take gave %v from headers without trailers", trailer)
+	}
+}
+
+// headerRecorder is a Receiver which records the headers
+// it is given.
+type headerRecorder struct {
+	sync.Mutex
+	header http.Header
+}
+
+func (r *headerRecorder) ReceiveData(*http.Request, []byte, bool) {}
+func (r *headerRecorder) ReceiveRequest(*http.Request) bool       { return false }
+
+func (r *headerRecorder) ReceiveHeader(req *http.Request, header http.Header) {
+	r.Lock()
+	defer r.Unlock()
+	if r.header == nil {
+		r.header = make(http.Header)
+	}
+	updateHeader(r.header, header)
+}
+
+// trailerRecorder is a headerRecorder which also records
+// the trailers it is given separately.
+type trailerRecorder struct {
+	headerRecorder
+	trailer http.Header
+}
+
+func (r *trailerRecorder) ReceiveTrailer(req *http.Request, trailer http.Header) {
+	r.Lock()
+	defer r.Unlock()
+	if r.trailer == nil {
+		r.trailer = make(http.Header)
+	}
+	updateHeader(r.trailer, trailer)
+}
+
+// Receivers are given trailers with ReceiveTrailer if they
+// are TrailerReceivers, and with ReceiveHeader otherwise.
+func TestReceiveTrailer(t *testing.T) {
+	trailer := http.Header{"X-Checksum": {"abc"}}
+
+	plain := new(headerRecorder)
+	receiveTrailer(plain, nil, trailer)
+	if !reflect.DeepEqual(plain.header, trailer) {
+		t.Errorf("ReceiveHeader was given %v, want %v", plain.header, trailer)
+	}
+
+	trailing := new(trailerRecorder)
+	receiveTrailer(trailing, nil, trailer)
+	if trailing.header != nil || !reflect.DeepEqual(trailing.trailer, trailer) {
+		t.Errorf("ReceiveHeader was given %v, ReceiveTrailer %v, want only ReceiveTrailer %v", trailing.header, trailing.trailer, trailer)
+	}
+}
+
+// Trailers declared in the Trailer header, or set with the
+// http.TrailerPrefix, follow the response body. SPDY/3 gives
+// them in the response's Trailer, and SPDY/2, whose HEADERS
+// cannot end a stream, gives them with the headers.
+func TestTrailers(t *testing.T) {
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Header().Set("X-Checksum", "early")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("body"))
+		w.(http.Flusher).Flush()
+		w.Header().Set("X-Checksum", "abc")
+		w.Header().Set(http.TrailerPrefix+"X-Late", "late")
+	})}
+	trailer := http.Header{"X-Checksum": {"abc"}, "X-Late": {"late"}}
+
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			for _, receiver := range []Receiver{nil, new(headerRecorder), new(trailerRecorder)} {
+				tr := pipeTransport(t, srv, version)
+				tr.Receiver = receiver
+
+				req, _ := http.NewRequest("GET", "https://example.com/", nil)
+				res, err := tr.RoundTrip(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, err := ioutil.ReadAll(res.Body)
+				if err != nil || string(body) != "body" {
+					t.Fatalf("got body %q, error %v", body, err)
+				}
+
+				if version == 2 {
+					if len(res.Trailer) != 0 || res.Header.Get("X-Checksum") != "abc" || res.Header.Get("X-Late") != "late" {
+						t.Errorf("%T: got headers %v and trailers %v, want the trailers in the headers", receiver, res.Header, res.Trailer)
+					}
+					continue
+				}
+
+				if !reflect.DeepEqual(res.Trailer, trailer) {
+					t.Errorf("%T: got trailers %v, want %v", receiver, res.Trailer, trailer)
+				}
+				if res.Header.Get("X-Checksum") != "" || res.Header.Get("X-Late") != "" {
+					t.Errorf("%T: got trailers in the headers %v", receiver, res.Header)
+				}
+
+				switch receiver := receiver.(type) {
+				case *trailerRecorder:
+					if !reflect.DeepEqual(receiver.trailer, trailer) || receiver.header.Get("X-Checksum") != "" {
+						t.Errorf("the TrailerReceiver was given headers %v and trailers %v", receiver.header, receiver.trailer)
+					}
+				case *headerRecorder:
+					if receiver.header.Get("X-Checksum") != "abc" || receiver.header.Get("X-Late") != "late" {
+						t.Errorf("the Receiver was given headers %v, want the trailers", receiver.header)
+					}
+				}
+			}
+		})
+	}
+}
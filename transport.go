@@ -2,9 +2,11 @@ package spdy
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
@@ -29,14 +31,27 @@ type Transport struct {
 	// Dial specifies the dial function for creating TCP
 	// connections.
 	// If Dial is nil, net.Dial is used.
-	Dial func(network, addr string) (net.Conn, error) // TODO: use
+	Dial func(network, addr string) (net.Conn, error)
+
+	// DisableNoDelay, if true, leaves Nagle's algorithm enabled
+	// on new TCP connections. By default, TCP_NODELAY is set, as
+	// SPDY sends many small control frames.
+	DisableNoDelay bool
+
+	// SocketOptions, if non-nil, is called with each new TCP
+	// connection before TLS is added, and can be used to set
+	// further socket options, such as keep-alive intervals,
+	// buffer sizes or the TOS field. If SocketOptions returns
+	// an error, the connection is closed and the error returned.
+	SocketOptions func(net.Conn) error
 
 	// TLSClientConfig specifies the TLS configuration to use with
 	// tls.Client. If nil, the default configuration is used.
 	TLSClientConfig *tls.Config
 
 	// DisableKeepAlives, if true, prevents re-use of TCP connections
-	// between different HTTP requests.
+	// between different HTTP requests. Each request is sent on a
+	// new connection, as if its Close field were set.
 	DisableKeepAlives bool
 
 	// DisableCompression, if true, prevents the Transport from
@@ -60,9 +75,21 @@ type Transport struct {
 	// time does not include the time to read the response body.
 	ResponseHeaderTimeout time.Duration
 
-	spdyConns map[string]Conn          // SPDY connections mapped to host:port.
-	tcpConns  map[string]chan net.Conn // Non-SPDY connections mapped to host:port.
-	connLimit map[string]chan struct{} // Used to enforce the TCP conn limit.
+	// ReadTimeout, if non-zero, is the maximum time a SPDY
+	// connection may go without receiving a frame before it
+	// is closed, as with the http.Server's ReadTimeout. Idle
+	// connections can be kept open by setting a shorter
+	// PingInterval.
+	ReadTimeout time.Duration
+
+	// WriteTimeout, if non-zero, is the maximum time
+	// allowed for each write to a SPDY connection.
+	WriteTimeout time.Duration
+
+	spdyConns  map[string]Conn          // SPDY connections mapped to host:port.
+	extraConns map[string][]Conn        // Further SPDY connections, dialled while those to host:port were busy.
+	tcpConns   map[string]chan net.Conn // Non-SPDY connections mapped to host:port.
+	connLimit  map[string]chan struct{} // Used to enforce the TCP conn limit.
 
 	// Priority is used to determine the request priority of SPDY
 	// requests. If nil, spdy.DefaultPriority is used.
@@ -78,30 +105,579 @@ type Transport struct {
 	// sent with the server push. See Receiver for more detail on
 	// its methods.
 	PushReceiver Receiver
+
+	// ReResolveInterval, if non-zero, controls how often the host
+	// of each pooled SPDY connection is re-resolved. If the address
+	// the connection was made to is no longer in the resolved set,
+	// the connection is drained and removed from the pool, so that
+	// subsequent requests dial the new address.
+	ReResolveInterval time.Duration
+
+	// LookupIP specifies the function used to re-resolve hosts
+	// for ReResolveInterval. If LookupIP is nil, net.LookupIP
+	// is used.
+	LookupIP func(host string) ([]net.IP, error)
+
+	// PingInterval, if non-zero, is how long a SPDY connection
+	// may go without receiving any frames before a PING is sent
+	// to check that it is still alive. If the reply does not
+	// arrive within PingTimeout, the connection is removed from
+	// the pool and closed, failing its requests with a
+	// ConnClosedError whose Reason is ErrPingTimeout.
+	PingInterval time.Duration
+
+	// PingTimeout is how long to wait for the reply to a
+	// keep-alive PING. If zero, PingInterval is used.
+	PingTimeout time.Duration
+
+	// StrictAffinity, if true, disables re-resolution, keeping each
+	// pooled connection pinned to the address it was dialled with
+	// for its whole lifetime.
+	StrictAffinity bool
+
+	// MaxResponseHeaderBytes, if non-zero, limits the total size
+	// of a SPDY response's headers, after decompression. If the
+	// limit is exceeded, the request is cancelled and RoundTrip
+	// returns ErrResponseTooLarge.
+	MaxResponseHeaderBytes int64
+
+	// MaxResponseBodyBytes, if non-zero, limits the size of a
+	// SPDY response's body. If the limit is exceeded, the request
+	// is cancelled, and reading the response body returns
+	// ErrResponseTooLarge once the data within the limit has
+	// been read.
+	MaxResponseBodyBytes int64
+
+	// ElideRepeatedHeaders, if true, omits request headers which
+	// are identical to those in the previous request on the same
+	// SPDY connection, if the server has advertised support for
+	// restoring them. See EnableHeaderElision. This is experimental.
+	ElideRepeatedHeaders bool
+
+	// LenientHeaders, if true, accepts response headers which
+	// break the SPDY specification's rules, such as uppercase
+	// header names, normalising them rather than resetting the
+	// stream. See SetLenientHeaders.
+	LenientHeaders bool
+
+	// SessionFlowControl, if true, limits the data sent and
+	// received on each SPDY/3 connection with a connection-wide
+	// transfer window, as in SPDY/3.1, if the server has advertised
+	// its support. See EnableSessionFlowControl. This is experimental.
+	SessionFlowControl bool
+
+	// WindowUpdateThreshold, if non-zero, is the number of
+	// bytes of a SPDY/3 response body which are consumed before
+	// a WINDOW_UPDATE frame is sent to regrow the stream's
+	// transfer window. By default, the window is regrown once
+	// half of it has been used. SPDY/2 has no flow control, so
+	// this has no effect there.
+	WindowUpdateThreshold uint32
+
+	// InitialWindowSize, if non-zero, is the initial transfer
+	// window advertised to servers for each SPDY/3 stream,
+	// limiting how much of a response can be sent before it is
+	// read. The default is DEFAULT_INITIAL_CLIENT_WINDOW_SIZE.
+	InitialWindowSize uint32
+
+	// InteractiveRecordSize, if non-zero, is the maximum number
+	// of bytes written to each SPDY/3 connection at once for
+	// requests marked with WithInteractive. The default is
+	// DEFAULT_INTERACTIVE_RECORD_SIZE. See SetInteractiveRecordSize.
+	InteractiveRecordSize int
+
+	// MaxStreamsPerConn, if non-zero, limits the number of
+	// requests in progress on each SPDY connection. Once each
+	// pooled connection to a host has this many, or has reached
+	// the server's own limit on concurrent streams, a further
+	// connection is dialled, if MaxIdleConnsPerHost allows.
+	// Otherwise, requests beyond the server's limit fail with
+	// ErrTooManyStreams.
+	MaxStreamsPerConn uint32
+
+	// IdleConnTimeout, if non-zero, is how long a pooled SPDY
+	// connection may go without any requests in progress before
+	// it is closed gracefully and removed from the pool.
+	IdleConnTimeout time.Duration
+
+	// MaxConcurrentStreams, if non-zero, limits the number of
+	// concurrent server pushes on each SPDY connection, and is
+	// advertised to the server. The default is DEFAULT_STREAM_LIMIT.
+	// The server's own limit on requests is always honoured, with
+	// requests beyond it failing with ErrTooManyStreams.
+	MaxConcurrentStreams uint32
+
+	// CoalesceIdenticalGets, if true, allows GET and HEAD requests
+	// identical to a request already in flight to share its response,
+	// rather than making a new request. Each caller receives its own
+	// copy of the response. Requests are identical if they have the
+	// same method, URL and headers.
+	CoalesceIdenticalGets bool
+
+	// CoalesceBufferSize is the maximum size of a response body
+	// which can be shared between coalesced requests. Callers
+	// sharing a larger response make their own requests instead.
+	// If zero, DefaultCoalesceBufferSize is used.
+	CoalesceBufferSize int64
+
+	// Hooks, if non-nil, are informed of events on
+	// each SPDY connection made by the Transport.
+	Hooks *ConnHooks
+
+	// MigrateConnections, if true, replaces a pooled SPDY connection
+	// which dies, such as after a change of network, by dialling a
+	// new one, possibly from a new local address. Requests which
+	// were in progress are replayed on the new connection if they
+	// are idempotent, or have an Idempotency-Key header, or are
+	// accepted by ReplayRequest. Other requests in progress fail
+	// with ErrConnectionMigrated, as the server may have processed
+	// them.
+	MigrateConnections bool
+
+	// ReplayRequest, if non-nil, is called with each request which
+	// was in progress on a dead connection and is not idempotent,
+	// to determine whether it should be replayed, if
+	// MigrateConnections is set. It is also used to decide whether
+	// requests the server did not process before sending a GOAWAY
+	// are retried on a new connection. Idempotent requests are
+	// always retried, and others fail with ErrNotProcessed.
+	ReplayRequest func(*http.Request) bool
+
+	// OnReconnect, if non-nil, is called once each dead connection
+	// has been replaced and all of its requests have been replayed
+	// or failed. It is only used if MigrateConnections is set.
+	OnReconnect func(*ConnMigration)
+
+	// SettingsStore, if non-nil, holds the SETTINGS which
+	// servers ask to be persisted, so that they can be sent
+	// back on later connections. If nil, they are kept in
+	// memory for the lifetime of the Transport.
+	SettingsStore SettingsStore
+
+	// PersistUnrecognisedSettings, if true, allows settings
+	// whose IDs SPDY does not define to be persisted when
+	// the server asks. By default, they are not.
+	PersistUnrecognisedSettings bool
+
+	connIPs      map[Conn]net.IP            // Remote IP of each pooled SPDY connection.
+	connAddrs    map[string]net.Addr        // Local address of each SPDY connection, mapped to host:port.
+	inflight     map[Conn]int               // Number of requests in progress on each SPDY connection.
+	lastUsed     map[Conn]time.Time         // When each idle SPDY connection was last used, if IdleConnTimeout is set.
+	migrations   map[Conn]*migration        // Dead connections whose requests are being migrated.
+	clock        clock                      // Source of time. If nil, defaultClock is used.
+	coalesced    coalescer                  // Requests in flight, for coalescing.
+	settings     SettingsStore              // Default SettingsStore.
+	settingsOnce sync.Once                  // Used to create the default SettingsStore.
+	credentials  map[uint16]tls.Certificate // Client certificates sent in CREDENTIAL frames, mapped to slot.
+	closed       bool                       // Set once the Client owning the Transport has been closed.
 }
 
-// dial makes the connection to an endpoint.
-func (t *Transport) dial(u *url.URL) (net.Conn, error) {
+// NewTransport returns a Transport which uses a copy of
+// the given TLS configuration, if non-nil, advertising
+// the supported SPDY versions with NPN. Requests are
+// made with SPDY if the server negotiates it, and
+// HTTP otherwise. The zero Transport is also ready
+// for use.
+//
+//	client := &http.Client{Transport: spdy.NewTransport(config)}
+func NewTransport(config *tls.Config) *Transport {
+	t := new(Transport)
+	if config != nil {
+		t.TLSClientConfig = config.Clone()
+		if t.TLSClientConfig.NextProtos == nil {
+			t.TLSClientConfig.NextProtos = NPNStrings()
+		}
+	}
+	return t
+}
+
+// ConnectedIP returns the remote IP address of the
+// pooled SPDY connection to the given host:port. If more
+// than one is pooled, that of the first is returned. The
+// address of each pooled connection is given in the
+// RemoteIP field of its ConnSnapshot.
+//
+// If no SPDY connection is pooled for the given host,
+// ConnectedIP will return the ErrNotConnected error.
+func (t *Transport) ConnectedIP(host string) (net.IP, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	conns := t.extraConns[host]
+	if conn, ok := t.spdyConns[host]; ok {
+		conns = append([]Conn{conn}, conns...)
+	}
+	for _, conn := range conns {
+		if ip := t.connIPs[conn]; ip != nil {
+			return ip, nil
+		}
+	}
+	return nil, ErrNotConnected
+}
+
+// CloseConnections gracefully closes the Transport's pooled
+// SPDY connections. Each connection is removed from the pool
+// and sends a GOAWAY, so that no new requests are made on it,
+// then is closed once its requests in progress have finished.
+// If ctx is done first, the remaining connections are closed
+// immediately, failing their requests, and ctx's error is
+// returned. Later requests dial new connections.
+//
+// CloseConnections may be called more than once, and
+// concurrently with requests.
+func (t *Transport) CloseConnections(ctx context.Context) error {
+	t.m.Lock()
+	conns := t.pooledConns()
+	for host, conn := range t.spdyConns {
+		t.unpool(host, conn)
+	}
+	for host, extra := range t.extraConns {
+		for _, conn := range extra {
+			t.unpool(host, conn)
+		}
+	}
+	t.m.Unlock()
+
+	errs := make(chan error, len(conns))
+	for _, conn := range conns {
+		go func(conn Conn) {
+			errs <- shutdown(ctx, conn)
+		}(conn)
+	}
+
+	var err error
+	for range conns {
+		if e := <-errs; e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// CloseIdleConnections closes the Transport's idle connections:
+// HTTP/1.1 connections waiting in the pool, and pooled SPDY
+// connections with no streams in progress. The SPDY connections
+// are closed gracefully, as with CloseConnections, so a request
+// which has only just been sent on one is not lost. Connections
+// in use are unaffected. CloseIdleConnections is called by the
+// http.Client's CloseIdleConnections method.
+func (t *Transport) CloseIdleConnections() {
+	type hostConn struct {
+		host string
+		conn Conn
+	}
+
+	t.m.Lock()
+	pooled := make([]hostConn, 0, len(t.spdyConns))
+	for host, conn := range t.spdyConns {
+		pooled = append(pooled, hostConn{host, conn})
+	}
+	for host, extra := range t.extraConns {
+		for _, conn := range extra {
+			pooled = append(pooled, hostConn{host, conn})
+		}
+	}
+	for host, conns := range t.tcpConns {
+	Idle:
+		for {
+			select {
+			case conn := <-conns:
+				conn.Close()
+
+				// The connection's slot can be used by another dial.
+				select {
+				case t.connLimit[host] <- struct{}{}:
+				default:
+				}
+			default:
+				break Idle
+			}
+		}
+	}
+	t.m.Unlock()
+
+	for _, p := range pooled {
+		if d, ok := p.conn.(drainer); ok && d.activeStreams() > 0 {
+			continue
+		}
+		t.removeSPDYConn(p.host, p.conn)
+		go shutdown(context.Background(), p.conn)
+	}
+}
+
+// close prevents the Transport from making any more
+// connections, and closes its pooled connections. If
+// ctx is done before their requests in progress have
+// finished, they are closed immediately.
+func (t *Transport) close(ctx context.Context) error {
+	t.m.Lock()
+	t.closed = true
+	t.m.Unlock()
+
+	t.CloseIdleConnections()
+	return t.CloseConnections(ctx)
+}
+
+// getClock returns the clock used by the Transport.
+func (t *Transport) getClock() clock {
+	if t.clock == nil {
+		return defaultClock
+	}
+	return t.clock
+}
+
+// getSettingsStore returns the SettingsStore
+// used by the Transport.
+func (t *Transport) getSettingsStore() SettingsStore {
+	if t.SettingsStore != nil {
+		return t.SettingsStore
+	}
+	t.settingsOnce.Do(func() {
+		t.settings = NewSettingsStore()
+	})
+	return t.settings
+}
+
+// addSPDYConn adds a new SPDY connection to the pool and,
+// if requested, starts its periodic re-resolution. If a
+// connection to host is already pooled, the new one is
+// added as an extra connection, used once the others are
+// busy. This must be called with the Transport's lock held.
+func (t *Transport) addSPDYConn(host string, conn Conn, netConn net.Conn) {
+	if t.IdleConnTimeout > 0 {
+		if t.lastUsed == nil {
+			t.lastUsed = make(map[Conn]time.Time)
+		}
+		t.lastUsed[conn] = t.getClock().Now()
+		go t.closeIdle(host, conn)
+	}
+
+	if addr, ok := netConn.RemoteAddr().(*net.TCPAddr); ok {
+		if t.connIPs == nil {
+			t.connIPs = make(map[Conn]net.IP)
+		}
+		t.connIPs[conn] = addr.IP
+		if t.ReResolveInterval > 0 && !t.StrictAffinity {
+			go t.reResolve(host, conn, addr.IP)
+		}
+	}
+
+	if _, ok := t.spdyConns[host]; ok {
+		if t.extraConns == nil {
+			t.extraConns = make(map[string][]Conn)
+		}
+		t.extraConns[host] = append(t.extraConns[host], conn)
+		return
+	}
+
+	t.spdyConns[host] = conn
+
+	if t.connAddrs == nil {
+		t.connAddrs = make(map[string]net.Addr)
+	}
+	t.connAddrs[host] = netConn.LocalAddr()
+}
+
+// removeSPDYConn removes conn from the pool, if it is
+// still pooled for host.
+func (t *Transport) removeSPDYConn(host string, conn Conn) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	t.unpool(host, conn)
+}
+
+// reResolve periodically resolves the given host,
+// draining the connection once its address is no
+// longer included. reResolve returns once the
+// connection has left the pool.
+func (t *Transport) reResolve(host string, conn Conn, ip net.IP) {
+	name, _, err := net.SplitHostPort(host)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	lookup := t.LookupIP
+	if lookup == nil {
+		lookup = net.LookupIP
+	}
+
+	for {
+		<-t.getClock().After(t.ReResolveInterval)
+
+		t.m.Lock()
+		pooled := t.isPooled(host, conn)
+		t.m.Unlock()
+		if !pooled {
+			return
+		}
+
+		addrs, err := lookup(name)
+		if err != nil {
+			debug.Printf("Failed to re-resolve %q: %v\n", name, err)
+			continue
+		}
+
+		found := false
+		for _, addr := range addrs {
+			if addr.Equal(ip) {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+
+		debug.Printf("Address %s no longer resolved for %q. Draining connection.\n", ip, name)
+
+		// Remove the connection from the pool so that
+		// new requests will dial the new address.
+		t.removeSPDYConn(host, conn)
+
+		if d, ok := conn.(drainer); ok {
+			d.drain()
+		} else {
+			conn.Close()
+		}
+		return
+	}
+}
+
+// prepare initialises the Transport's structures for
+// connections to host. This must be called with the
+// Transport's lock held.
+func (t *Transport) prepare(host string) {
+	if t.spdyConns == nil {
+		t.spdyConns = make(map[string]Conn)
+	}
+	if t.tcpConns == nil {
+		t.tcpConns = make(map[string]chan net.Conn)
+	}
+	if t.connLimit == nil {
+		t.connLimit = make(map[string]chan struct{})
+	}
+	if t.MaxIdleConnsPerHost == 0 {
+		t.MaxIdleConnsPerHost = http.DefaultMaxIdleConnsPerHost
+	}
+	if _, ok := t.connLimit[host]; !ok {
+		limitChan := make(chan struct{}, t.MaxIdleConnsPerHost)
+		t.connLimit[host] = limitChan
+		for i := 0; i < t.MaxIdleConnsPerHost; i++ {
+			limitChan <- struct{}{}
+		}
+	}
+	if _, ok := t.tcpConns[host]; !ok {
+		t.tcpConns[host] = make(chan net.Conn, t.MaxIdleConnsPerHost)
+	}
 
 	if t.TLSClientConfig == nil {
 		t.TLSClientConfig = &tls.Config{
-			NextProtos: npn(),
+			NextProtos: NPNStrings(),
 		}
 	} else if t.TLSClientConfig.NextProtos == nil {
-		t.TLSClientConfig.NextProtos = npn()
+		t.TLSClientConfig.NextProtos = NPNStrings()
 	}
+}
 
-	// Wait for a connection slot to become available.
-	<-t.connLimit[u.Host]
+// newSPDYConn creates a SPDY connection to host over tlsConn,
+// using the negotiated protocol, configured with the Transport's
+// options. The connection must then be started with Run.
+func (t *Transport) newSPDYConn(host string, tlsConn *tls.Conn, proto string) (Conn, error) {
+	version, ok := npnVersion(proto)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Error: Unsupported negotiated protocol %q.", proto))
+	}
 
-	switch u.Scheme {
-	case "http":
-		return net.Dial("tcp", u.Host)
-	case "https":
-		return tls.Dial("tcp", u.Host, t.TLSClientConfig)
-	default:
+	conn, err := NewClientConn(tlsConn, t.PushReceiver, version)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := conn.(headerElider); ok && t.ElideRepeatedHeaders {
+		e.enableHeaderElision()
+	}
+	if l, ok := conn.(headerLenience); ok && t.LenientHeaders {
+		l.setLenientHeaders(true)
+	}
+	if s, ok := conn.(sessionFlowController); ok && t.SessionFlowControl {
+		s.enableSessionFlowControl()
+	}
+	if h, ok := conn.(hooker); ok && t.Hooks != nil {
+		h.setHooks(t.Hooks)
+	}
+	if l, ok := conn.(concurrencyLimiter); ok && t.MaxConcurrentStreams > 0 {
+		l.setMaxConcurrentStreams(t.MaxConcurrentStreams)
+	}
+	if w, ok := conn.(windowUpdater); ok && t.WindowUpdateThreshold > 0 {
+		w.setWindowUpdateThreshold(t.WindowUpdateThreshold)
+	}
+	if w, ok := conn.(receiveWindowSetter); ok && t.InitialWindowSize > 0 {
+		w.setReceiveWindowSize(t.InitialWindowSize)
+	}
+	if s, ok := conn.(timeoutSetter); ok && (t.ReadTimeout > 0 || t.WriteTimeout > 0) {
+		s.setTimeouts(t.ReadTimeout, t.WriteTimeout)
+	}
+	if r, ok := conn.(interactiveRecorder); ok && t.InteractiveRecordSize > 0 {
+		r.setInteractiveRecordSize(t.InteractiveRecordSize)
+	}
+	if p, ok := conn.(settingsPersister); ok {
+		p.setSettingsStore(t.getSettingsStore(), host, t.PersistUnrecognisedSettings)
+	}
+	if k, ok := conn.(keepAliver); ok && t.PingInterval > 0 {
+		timeout := t.PingTimeout
+		if timeout <= 0 {
+			timeout = t.PingInterval
+		}
+		k.setKeepAlive(t.PingInterval, timeout, func() {
+			debug.Printf("SPDY connection to %q missed a keep-alive PING. Removing it from the pool.\n", host)
+			t.removeSPDYConn(host, conn)
+		})
+	}
+	return conn, nil
+}
+
+// dial makes the connection to an endpoint.
+func (t *Transport) dial(u *url.URL) (net.Conn, error) {
+	if u.Scheme != "http" && u.Scheme != "https" {
 		return nil, errors.New(fmt.Sprintf("Error: URL has invalid scheme %q.", u.Scheme))
 	}
+
+	dial := t.Dial
+	if dial == nil {
+		dial = net.Dial
+	}
+	conn, err := dial("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tune the raw connection before adding TLS.
+	if err := tuneSocket(conn, !t.DisableNoDelay, t.SocketOptions); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if u.Scheme == "http" {
+		return conn, nil
+	}
+
+	config := t.TLSClientConfig
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			host = u.Host
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
 }
 
 // doHTTP is used to process an HTTP(S) request, using the TCP connection pool.
@@ -134,6 +710,14 @@ func (t *Transport) doHTTP(conn net.Conn, req *http.Request) (*http.Response, er
 // made, determining which protocol to use, and performing the
 // request.
 func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.CoalesceIdenticalGets && coalescable(req) {
+		return t.coalesce(req)
+	}
+	return t.roundTrip(req)
+}
+
+// roundTrip performs the work of RoundTrip.
+func (t *Transport) roundTrip(req *http.Request) (*http.Response, error) {
 	u := req.URL
 
 	// Make sure the URL host contains the port.
@@ -147,47 +731,68 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 		}
 	}
 
+	// Requests which must not share a connection
+	// are given one of their own.
+	if req.Close || t.DisableKeepAlives {
+		return t.roundTripAlone(req)
+	}
+
 	t.m.Lock()
+	if t.closed {
+		t.m.Unlock()
+		return nil, ErrClientClosed
+	}
 
 	// Initialise structures if necessary.
-	if t.spdyConns == nil {
-		t.spdyConns = make(map[string]Conn)
-	}
-	if t.tcpConns == nil {
-		t.tcpConns = make(map[string]chan net.Conn)
-	}
-	if t.connLimit == nil {
-		t.connLimit = make(map[string]chan struct{})
-	}
-	if t.MaxIdleConnsPerHost == 0 {
-		t.MaxIdleConnsPerHost = http.DefaultMaxIdleConnsPerHost
-	}
-	if _, ok := t.connLimit[u.Host]; !ok {
-		limitChan := make(chan struct{}, t.MaxIdleConnsPerHost)
-		t.connLimit[u.Host] = limitChan
-		for i := 0; i < t.MaxIdleConnsPerHost; i++ {
-			limitChan <- struct{}{}
-		}
-	}
+	t.prepare(u.Host)
 
 	// Check the non-SPDY connection pool.
-	if connChan, ok := t.tcpConns[u.Host]; ok {
+	select {
+	case tcpConn := <-t.tcpConns[u.Host]:
+		t.m.Unlock()
+		// Use a connection from the pool.
+		return t.doHTTP(tcpConn, req)
+	default:
+	}
+
+	// Check the SPDY connection pool. If each pooled
+	// connection is busy, another is dialled, if a
+	// connection slot is available.
+	conn, ok, free := t.spdyConn(u.Host)
+	extra := false
+	if ok && !free && u.Scheme != "http" {
 		select {
-		case tcpConn := <-connChan:
-			t.m.Unlock()
-			// Use a connection from the pool.
-			return t.doHTTP(tcpConn, req)
+		case <-t.connLimit[u.Host]:
+			extra = true
 		default:
 		}
-	} else {
-		t.tcpConns[u.Host] = make(chan net.Conn, t.MaxIdleConnsPerHost)
 	}
+	if !ok || extra || u.Scheme == "http" {
+		// Wait for a connection slot to become available, or
+		// for a connection to be returned to the pool. The
+		// lock is released while waiting, as it is needed to
+		// return connections.
+		if !extra {
+			limit, idle := t.connLimit[u.Host], t.tcpConns[u.Host]
+			t.m.Unlock()
+			select {
+			case <-limit:
+			case tcpConn := <-idle:
+				return t.doHTTP(tcpConn, req)
+			}
+
+			t.m.Lock()
+			if t.closed {
+				limit <- struct{}{}
+				t.m.Unlock()
+				return nil, ErrClientClosed
+			}
+		}
 
-	// Check the SPDY connection pool.
-	conn, ok := t.spdyConns[u.Host]
-	if !ok || u.Scheme == "http" {
 		tcpConn, err := t.dial(req.URL)
 		if err != nil {
+			// The slot can be used by another dial.
+			t.connLimit[u.Host] <- struct{}{}
 			t.m.Unlock()
 			return nil, err
 		}
@@ -207,7 +812,7 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 
 			// Verify hostname, unless requested not to.
 			if !t.TLSClientConfig.InsecureSkipVerify {
-				err = tlsConn.VerifyHostname(req.URL.Host)
+				err = tlsConn.VerifyHostname(req.URL.Hostname())
 				if err != nil {
 					t.m.Unlock()
 					return nil, err
@@ -222,7 +827,7 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 
 			// Scan the list of supported NPN strings.
 			supported := false
-			for _, proto := range npn() {
+			for _, proto := range NPNStrings() {
 				if state.NegotiatedProtocol == proto {
 					supported = true
 					break
@@ -242,22 +847,14 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 				t.m.Unlock()
 				return t.doHTTP(tcpConn, req)
 
-			case "spdy/3":
-				newConn, err := NewClientConn(tlsConn, t.PushReceiver, 3)
-				if err != nil {
-					return nil, err
-				}
-				go newConn.Run()
-				t.spdyConns[u.Host] = newConn
-				conn = newConn
-
-			case "spdy/2":
-				newConn, err := NewClientConn(tlsConn, t.PushReceiver, 2)
+			default:
+				newConn, err := t.newSPDYConn(u.Host, tlsConn, state.NegotiatedProtocol)
 				if err != nil {
+					t.m.Unlock()
 					return nil, err
 				}
 				go newConn.Run()
-				t.spdyConns[u.Host] = newConn
+				t.addSPDYConn(u.Host, newConn, tlsConn)
 				conn = newConn
 			}
 		} else {
@@ -266,17 +863,63 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 			return t.doHTTP(tcpConn, req)
 		}
 	}
+	t.acquire(conn)
 	t.m.Unlock()
 
 	// The connection has now been established.
+	res, stream, err := t.requestSPDY(conn, req)
 
-	debug.Printf("Requesting %q over SPDY.\n", u.String())
+	// Replay the request if its connection died.
+	if !t.MigrateConnections {
+		t.m.Lock()
+		t.release(conn)
+		t.m.Unlock()
+	} else {
+		replay, merr := t.migrate(u.Host, conn, req, stream == nil, err)
+		if replay {
+			req, err = replayRequest(req)
+			if err != nil {
+				return nil, err
+			}
+			return t.roundTrip(req)
+		}
+		err = merr
+	}
+
+	// Requests which the server did not process, as the
+	// connection was going away, can be retried on a new
+	// connection. Requests which could not be sent after
+	// a GOAWAY with an error status fail with the
+	// GoAwayError instead.
+	_, goaway := err.(*GoAwayError)
+	if err == ErrNotProcessed || goaway && stream == nil {
+		t.removeSPDYConn(u.Host, conn)
+		if retryUnprocessed(req, stream == nil, t.ReplayRequest) {
+			debug.Printf("Retrying unprocessed request for %q on a new connection.\n", u.String())
+			req, err = replayRequest(req)
+			if err != nil {
+				return nil, err
+			}
+			return t.roundTrip(req)
+		}
+	}
+
+	return res.result(err)
+}
+
+// requestSPDY sends req on conn, and waits for the
+// response to be received. The stream is nil if the
+// request could not be sent.
+func (t *Transport) requestSPDY(conn Conn, req *http.Request) (*response, Stream, error) {
+	debug.Printf("Requesting %q over SPDY.\n", req.URL.String())
 
 	// Prepare the response.
 	res := new(response)
 	res.Request = req
 	res.Data = new(bytes.Buffer)
 	res.Receiver = t.Receiver
+	res.MaxHeaderBytes = t.MaxResponseHeaderBytes
+	res.MaxBodyBytes = t.MaxResponseBodyBytes
 
 	// Determine the request priority.
 	priority := Priority(0)
@@ -286,16 +929,91 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 		priority = DefaultPriority(req.URL)
 	}
 
-	// Send the request.
+	// Send any client certificate for the host, and
+	// use its slot for the request.
+	if c, ok := conn.(credentialSender); ok {
+		if slot, cert, ok := t.credentialFor(req.URL.Host); ok {
+			if err := c.sendCredential(slot, cert); err != nil {
+				return res, nil, err
+			}
+			req = req.WithContext(context.WithValue(req.Context(), credentialSlotKey{}, slot))
+		}
+	}
+
+	// Send the request, and let it run its course.
 	stream, err := conn.Request(req, res, priority)
+	if err == nil {
+		err = stream.Run()
+	}
+
+	// Requests cancelled by their contexts report why.
+	if err == ErrStreamCancelled && req.Context().Err() != nil {
+		err = req.Context().Err()
+	}
+
+	return res, stream, err
+}
+
+// roundTripAlone sends req on a new connection of its own,
+// which is not pooled, so no other requests share it. The
+// connection is closed once the response has been received.
+func (t *Transport) roundTripAlone(req *http.Request) (*http.Response, error) {
+	t.m.Lock()
+	t.prepare(req.URL.Host)
+	t.m.Unlock()
+
+	netConn, err := t.dial(req.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without SPDY, the request is sent over HTTP, and the
+	// connection is closed with the response body.
+	tlsConn, ok := netConn.(*tls.Conn)
+	proto := ""
+	if ok {
+		proto = tlsConn.ConnectionState().NegotiatedProtocol
+	}
+	if _, ok := npnVersion(proto); !ok {
+		debug.Printf("Requesting %q over HTTP on its own connection.\n", req.URL.String())
+		res, err := httputil.NewClientConn(netConn, nil).Do(req)
+		if err != nil {
+			netConn.Close()
+			return nil, err
+		}
+		res.Body = &connBody{res.Body, netConn}
+		return res, nil
+	}
+
+	conn, err := t.newSPDYConn(req.URL.Host, tlsConn, proto)
 	if err != nil {
+		tlsConn.Close()
 		return nil, err
 	}
+	go conn.Run()
 
-	// Let the request run its course.
-	stream.Run()
+	// SPDY responses are received in full before being
+	// returned, so the connection can be closed at once,
+	// whether or not the body is read.
+	res, _, err := t.requestSPDY(conn, req)
+	go conn.Close()
 
-	return res.Response(), nil
+	return res.result(err)
+}
+
+// connBody is the body of an HTTP response received on
+// a connection of its own, which is closed with the body.
+type connBody struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (b *connBody) Close() error {
+	err := b.ReadCloser.Close()
+	if cerr := b.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
 // response is used in handling responses; storing
@@ -306,14 +1024,30 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 // handling of the response data. This is provided
 // by setting spdy.Transport.Receiver.
 type response struct {
-	StatusCode int
-	Header     http.Header
-	Data       *bytes.Buffer
-	Request    *http.Request
-	Receiver   Receiver
+	StatusCode     int
+	Header         http.Header
+	Trailer        http.Header
+	Data           *bytes.Buffer
+	Request        *http.Request
+	Receiver       Receiver
+	MaxHeaderBytes int64 // If non-zero, the limit on the size of the headers.
+	MaxBodyBytes   int64 // If non-zero, the limit on the size of the body.
+
+	headerBytes int64 // size of the headers received so far.
+	truncated   bool  // whether the body exceeded MaxBodyBytes.
+	err         error // error which caused the response to be rejected.
 }
 
 func (r *response) ReceiveData(req *http.Request, data []byte, finished bool) {
+	if r.err != nil {
+		return
+	}
+	if r.MaxBodyBytes > 0 && int64(r.Data.Len()+len(data)) > r.MaxBodyBytes {
+		r.Data.Write(data[:r.MaxBodyBytes-int64(r.Data.Len())])
+		r.truncated = true
+		r.err = ErrResponseTooLarge
+		return
+	}
 	r.Data.Write(data)
 	if r.Receiver != nil {
 		r.Receiver.ReceiveData(req, data, finished)
@@ -323,6 +1057,20 @@ func (r *response) ReceiveData(req *http.Request, data []byte, finished bool) {
 var statusRegex = regexp.MustCompile(`\A\s*(?P<code>\d+)`)
 
 func (r *response) ReceiveHeader(req *http.Request, header http.Header) {
+	if r.err != nil {
+		return
+	}
+	if r.MaxHeaderBytes > 0 {
+		for name, values := range header {
+			for _, value := range values {
+				r.headerBytes += int64(len(name) + len(value))
+			}
+		}
+		if r.headerBytes > r.MaxHeaderBytes {
+			r.err = ErrResponseTooLarge
+			return
+		}
+	}
 	if r.Header == nil {
 		r.Header = make(http.Header)
 	}
@@ -340,6 +1088,39 @@ func (r *response) ReceiveHeader(req *http.Request, header http.Header) {
 	}
 }
 
+// ReceiveTrailer stores the trailers sent after the
+// response body, which count towards MaxHeaderBytes.
+func (r *response) ReceiveTrailer(req *http.Request, trailer http.Header) {
+	if r.err != nil {
+		return
+	}
+	if r.MaxHeaderBytes > 0 {
+		for name, values := range trailer {
+			for _, value := range values {
+				r.headerBytes += int64(len(name) + len(value))
+			}
+		}
+		if r.headerBytes > r.MaxHeaderBytes {
+			r.err = ErrResponseTooLarge
+			return
+		}
+	}
+	if r.Trailer == nil {
+		r.Trailer = make(http.Header)
+	}
+	updateHeader(r.Trailer, trailer)
+	if r.Receiver != nil {
+		receiveTrailer(r.Receiver, req, trailer)
+	}
+}
+
+// copiesData indicates whether the data is copied into
+// the response, rather than given to a Receiver which may
+// keep it, so can be given pooled buffers.
+func (r *response) copiesData() bool {
+	return r.Receiver == nil
+}
+
 func (r *response) ReceiveRequest(req *http.Request) bool {
 	if r.Receiver != nil {
 		return r.Receiver.ReceiveRequest(req)
@@ -347,6 +1128,25 @@ func (r *response) ReceiveRequest(req *http.Request) bool {
 	return false
 }
 
+// aborted returns the error which caused
+// the response to be rejected, if any.
+func (r *response) aborted() error {
+	return r.err
+}
+
+// result returns the response to a request which
+// finished with the given error.
+func (r *response) result(err error) (*http.Response, error) {
+	if err != nil && !(err == ErrResponseTooLarge && r.truncated) {
+		return nil, err
+	}
+	if r.err != nil && !r.truncated {
+		return nil, r.err
+	}
+
+	return r.Response(), nil
+}
+
 func (r *response) Response() *http.Response {
 	if r.Data == nil {
 		r.Data = new(bytes.Buffer)
@@ -357,12 +1157,22 @@ func (r *response) Response() *http.Response {
 	out.Proto = "HTTP/1.1"
 	out.ProtoMajor = 1
 	out.ProtoMinor = 1
-	out.Header = r.Header
+	out.Header = make(http.Header, len(r.Header))
+	for name, values := range r.Header {
+		// Pseudo-headers, such as :status, are not HTTP headers.
+		if !strings.HasPrefix(name, ":") {
+			out.Header[name] = values
+		}
+	}
 	out.Body = &readCloser{r.Data}
 	out.ContentLength = int64(r.Data.Len())
+	if r.truncated {
+		out.Body = &readCloser{io.MultiReader(r.Data, errReader{r.err})}
+		out.ContentLength = -1
+	}
 	out.TransferEncoding = nil
 	out.Close = true
-	out.Trailer = make(http.Header)
+	out.Trailer = cloneHeader(r.Trailer)
 	out.Request = r.Request
 	return out
 }
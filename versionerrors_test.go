@@ -0,0 +1,105 @@
+package spdy
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Connection-scoped frames with the wrong SPDY version
+// are skipped, until more than MaxVersionErrors have been
+// received, when the connection is ended with a GOAWAY
+// giving PROTOCOL_ERROR. Stream-scoped frames with the
+// wrong version only reset their stream, and are not
+// counted.
+func TestMaxVersionErrors(t *testing.T) {
+	max := MaxVersionErrors
+	defer func() { MaxVersionErrors = max }()
+	MaxVersionErrors = 2
+
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			client, remote := rawClientConn(t, version)
+			other := 5 - version
+			frames := make(chan Frame, 16)
+			go func() {
+				defer close(frames)
+				for {
+					frame, err := readRawFrame(remote, version)
+					if err != nil {
+						return
+					}
+					frames <- frame
+				}
+			}()
+
+			// await returns the first frame accepted by
+			// match, or nil if the connection closes first.
+			await := func(what string, match func(Frame) bool) (found Frame) {
+				t.Helper()
+				within(t, 5*time.Second, what, func() {
+					for frame := range frames {
+						if match(frame) {
+							found = frame
+							return
+						}
+					}
+				})
+				return found
+			}
+			isPing := func(frame Frame) bool {
+				switch frame.(type) {
+				case *pingFrameV3, *pingFrameV2:
+					return true
+				}
+				return false
+			}
+			ping := []byte{0x80, byte(version), 0, 6, 0, 0, 0, 4, 0, 0, 0, 2}
+			wrongPing := []byte{0x80, byte(other), 0, 6, 0, 0, 0, 4, 0, 0, 0, 2}
+
+			// The PING reply shows that each frame
+			// has been handled.
+			remote.Write(rawRstStream(other, 2, RST_STREAM_CANCEL))
+			for i := 1; i <= MaxVersionErrors; i++ {
+				remote.Write(wrongPing)
+				remote.Write(ping)
+				if await("the PING reply", isPing) == nil {
+					t.Fatalf("the connection closed after %d version errors", i)
+				}
+			}
+			if err := ConnError(client); err != nil {
+				t.Fatalf("the connection closed: %v", err)
+			}
+			snap := client.(snapshotter).snapshot()
+			if snap.VersionErrors != MaxVersionErrors || snap.PeerVersion != other {
+				t.Errorf("got %d version errors from SPDY/%d, want %d from SPDY/%d", snap.VersionErrors, snap.PeerVersion, MaxVersionErrors, other)
+			}
+
+			remote.Write(wrongPing)
+			var status StatusCode = GOAWAY_PROTOCOL_ERROR
+			goaway := await("the GOAWAY", func(frame Frame) bool {
+				switch frame := frame.(type) {
+				case *goawayFrameV3:
+					status = frame.Status
+					return true
+				case *goawayFrameV2:
+					return true
+				}
+				return false
+			})
+			if goaway == nil || status != GOAWAY_PROTOCOL_ERROR {
+				t.Fatalf("got %v, want a GOAWAY with PROTOCOL_ERROR", goaway)
+			}
+			within(t, 5*time.Second, "the connection closing", func() {
+				for ConnError(client) == nil {
+					time.Sleep(time.Millisecond)
+				}
+			})
+			if err := ConnError(client); !errors.Is(err, ErrUnsupportedVersion) {
+				t.Errorf("the connection closed with %v, want ErrUnsupportedVersion", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package spdy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The default maximum number of authorities
+// dialled at once by Transport.Warmup.
+const DefaultWarmupConcurrency = 4
+
+// WarmupError is returned by Transport.Warmup, giving
+// the error for each authority which could not be
+// warmed up.
+type WarmupError map[string]error
+
+func (w WarmupError) Error() string {
+	authorities := make([]string, 0, len(w))
+	for authority := range w {
+		authorities = append(authorities, authority)
+	}
+	sort.Strings(authorities)
+
+	errs := make([]string, len(authorities))
+	for i, authority := range authorities {
+		errs[i] = fmt.Sprintf("%s: %v", authority, w[authority])
+	}
+	return fmt.Sprintf("Error: Failed to warm up %d connections: %s", len(w), strings.Join(errs, "; "))
+}
+
+// Warmup establishes SPDY connections to each of the given
+// authorities (host:port, with the port defaulting to 443),
+// and adds them to the Transport's pool, so that later requests
+// do not pay the cost of dialling and the TLS handshake.
+// Warmup returns once each connection has received the server's
+// SETTINGS, or has failed.
+//
+// Authorities which already have a pooled connection are left
+// alone. If any authority fails, Warmup returns a WarmupError,
+// but the other connections are still pooled. A failed warm-up
+// has no effect on later requests, which dial as normal.
+func (t *Transport) Warmup(ctx context.Context, authorities []string) error {
+	var m sync.Mutex
+	failed := make(WarmupError)
+
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, DefaultWarmupConcurrency)
+	for _, authority := range authorities {
+		wg.Add(1)
+		go func(authority string) {
+			defer wg.Done()
+
+			var err error
+			select {
+			case limit <- struct{}{}:
+				err = t.warm(ctx, authority)
+				<-limit
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+
+			if err != nil {
+				m.Lock()
+				failed[authority] = err
+				m.Unlock()
+			}
+		}(authority)
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// warm establishes a SPDY connection to the
+// authority and adds it to the pool.
+func (t *Transport) warm(ctx context.Context, authority string) error {
+	u := &url.URL{Scheme: "https", Host: authority}
+	if !strings.Contains(u.Host, ":") {
+		u.Host += ":443"
+	}
+
+	t.m.Lock()
+	t.prepare(u.Host)
+	_, pooled := t.spdyConns[u.Host]
+	limit := t.connLimit[u.Host]
+	t.m.Unlock()
+
+	if pooled {
+		return nil
+	}
+
+	// Wait for a connection slot to become available.
+	select {
+	case <-limit:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	conn, tlsConn, err := t.warmConn(ctx, u)
+	if err != nil {
+		// The slot can be used by another dial.
+		limit <- struct{}{}
+		return err
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	// Another connection may have been pooled meanwhile.
+	if _, ok := t.spdyConns[u.Host]; ok {
+		limit <- struct{}{}
+		go conn.Close()
+		return nil
+	}
+
+	t.addSPDYConn(u.Host, conn, tlsConn)
+	return nil
+}
+
+// warmConn dials a new SPDY connection, waiting until
+// the server's SETTINGS have been received.
+func (t *Transport) warmConn(ctx context.Context, u *url.URL) (Conn, *tls.Conn, error) {
+	netConn, err := t.dial(u)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tlsConn, ok := netConn.(*tls.Conn)
+	if !ok {
+		netConn.Close()
+		return nil, nil, errors.New("Error: Warm-up connection is not using TLS.")
+	}
+
+	conn, err := t.newSPDYConn(u.Host, tlsConn, tlsConn.ConnectionState().NegotiatedProtocol)
+	if err != nil {
+		tlsConn.Close()
+		return nil, nil, err
+	}
+	go conn.Run()
+
+	// The server sends its SETTINGS as soon as the
+	// connection starts, so they have been received
+	// once a PING has been answered.
+	pong, err := conn.Ping()
+	if err != nil {
+		go conn.Close()
+		return nil, nil, err
+	}
+
+	select {
+	case ping, ok := <-pong:
+		if !ok {
+			err = errConnClosed
+		} else {
+			err = ping.Err
+		}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		go conn.Close()
+		return nil, nil, err
+	}
+
+	return conn, tlsConn, nil
+}
@@ -0,0 +1,109 @@
+package spdy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newSPDYServer starts a TLS server which serves SPDY,
+// writing its name in each response.
+func newSPDYServer(t *testing.T, name string) *httptest.Server {
+	server := startSPDYServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// startSPDYServer starts a TLS server which serves
+// handler over SPDY. The caller must close it.
+func startSPDYServer(handler http.Handler) *httptest.Server {
+	server := httptest.NewUnstartedServer(handler)
+	AddSPDY(server.Config)
+	server.TLS = &tls.Config{NextProtos: NPNStrings()}
+	server.StartTLS()
+	return server
+}
+
+// spdyClient returns a Transport which uses SPDY to
+// make requests to the server, trusting its certificate.
+func spdyClient(server *httptest.Server) *Transport {
+	return NewTransport(server.Client().Transport.(*http.Transport).TLSClientConfig)
+}
+
+// Warmup pools a connection to each authority, which later
+// requests use without dialling. An authority which cannot
+// be warmed up is reported in a WarmupError, and requests to
+// it later dial as normal.
+func TestWarmup(t *testing.T) {
+	a := newSPDYServer(t, "a")
+	b := newSPDYServer(t, "b")
+	authorityA := strings.TrimPrefix(a.URL, "https://")
+	authorityB := strings.TrimPrefix(b.URL, "https://")
+
+	// Dials to b fail until it is first warmed up.
+	var m sync.Mutex
+	dials := make(map[string]int)
+	tr := NewTransport(a.Client().Transport.(*http.Transport).TLSClientConfig)
+	defer tr.CloseIdleConnections()
+	tr.Dial = func(network, addr string) (net.Conn, error) {
+		m.Lock()
+		dials[addr]++
+		first := dials[addr] == 1
+		m.Unlock()
+		if addr == authorityB && first {
+			return nil, errors.New("dial failed")
+		}
+		return net.Dial(network, addr)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := tr.Warmup(ctx, []string{authorityA, authorityB})
+	failed, ok := err.(WarmupError)
+	if !ok || len(failed) != 1 || failed[authorityB] == nil {
+		t.Fatalf("Warmup returned %v, want a WarmupError for %s", err, authorityB)
+	}
+
+	// Warming up again leaves a alone.
+	if err := tr.Warmup(ctx, []string{authorityA}); err != nil {
+		t.Fatalf("Warmup returned %v", err)
+	}
+
+	client := &http.Client{Transport: tr}
+	within(t, 5*time.Second, "the requests", func() {
+		for _, server := range []struct{ url, name string }{{a.URL, "a"}, {b.URL, "b"}, {a.URL, "a"}} {
+			res, err := client.Get(server.url + "/")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body, err := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil || string(body) != server.name {
+				t.Errorf("got body %q, error %v", body, err)
+			}
+		}
+	})
+
+	m.Lock()
+	defer m.Unlock()
+	if dials[authorityA] != 1 {
+		t.Errorf("dialled %s %d times, want once, to warm it up", authorityA, dials[authorityA])
+	}
+	if dials[authorityB] != 2 {
+		t.Errorf("dialled %s %d times, want twice", authorityB, dials[authorityB])
+	}
+	if n := Stats(a.Config).Conns; n != 1 {
+		t.Errorf("%s has %d SPDY connections, want 1", authorityA, n)
+	}
+}
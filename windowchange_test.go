@@ -0,0 +1,111 @@
+package spdy
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// A change to INITIAL_WINDOW_SIZE applies to the streams
+// already open, as well as those which follow, so that a
+// client halfway through an upload sends no more than the
+// server has room for when the window shrinks, and sends
+// more at once when it grows.
+func TestInitialWindowChange(t *testing.T) {
+	const size = 200000
+	client, conn := rawClientConn(t, 3)
+	remote := newRawPeer(conn, 3)
+
+	// The server's window is 64KB from the start.
+	remote.write(rawInitialWindow(DEFAULT_INITIAL_WINDOW_SIZE))
+	within(t, 5*time.Second, "the SETTINGS", func() {
+		for client.(snapshotter).snapshot().InitialWindowSize != DEFAULT_INITIAL_WINDOW_SIZE {
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	body := bytes.Repeat([]byte("u"), size)
+	errs := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest("POST", "https://example.com/upload", bytes.NewReader(body))
+		_, err := request(client, req)
+		errs <- err
+	}()
+
+	// upload returns the amount of the upload received
+	// until want bytes have arrived, and a little longer,
+	// to catch any sent beyond the window.
+	var total int
+	var fin bool
+	upload := func(want int) int {
+		t.Helper()
+		var n int
+		quiet := time.After(5 * time.Second)
+		if want == 0 {
+			quiet = time.After(100 * time.Millisecond)
+		}
+		for {
+			select {
+			case frame, ok := <-remote.frames:
+				if !ok {
+					t.Fatal("the connection closed")
+				}
+				if data, ok := frame.(*dataFrameV3); ok {
+					if fin {
+						t.Fatal("data was sent after the FIN")
+					}
+					n += len(data.Data)
+					fin = data.Flags.FIN()
+					if n >= want {
+						quiet = time.After(100 * time.Millisecond)
+					}
+				}
+			case <-quiet:
+				total += n
+				return n
+			}
+		}
+	}
+
+	// The window is used up.
+	if n := upload(DEFAULT_INITIAL_WINDOW_SIZE); n != DEFAULT_INITIAL_WINDOW_SIZE {
+		t.Fatalf("sent %d bytes, want the %d byte window", n, DEFAULT_INITIAL_WINDOW_SIZE)
+	}
+
+	// The window is halved, leaving the stream 32KB over,
+	// so updating it by 32KB allows nothing to be sent.
+	remote.write(append(rawInitialWindow(DEFAULT_INITIAL_WINDOW_SIZE/2), rawWindowUpdate(1, DEFAULT_INITIAL_WINDOW_SIZE/2)...))
+	if n := upload(0); n != 0 {
+		t.Fatalf("sent %d bytes beyond the halved window", n)
+	}
+
+	// Once the window is above zero, as much is sent.
+	remote.write(rawWindowUpdate(1, 16384))
+	if n := upload(16384); n != 16384 {
+		t.Fatalf("sent %d bytes, want 16384", n)
+	}
+
+	// Growing the window again lets 32KB more be sent.
+	remote.write(rawInitialWindow(DEFAULT_INITIAL_WINDOW_SIZE))
+	if n := upload(DEFAULT_INITIAL_WINDOW_SIZE / 2); n != DEFAULT_INITIAL_WINDOW_SIZE/2 {
+		t.Fatalf("sent %d bytes, want %d", n, DEFAULT_INITIAL_WINDOW_SIZE/2)
+	}
+
+	// The rest follows a large WINDOW_UPDATE.
+	remote.write(rawWindowUpdate(1, size))
+	upload(size - total)
+	if total != size || !fin {
+		t.Fatalf("received %d bytes, FIN %v, want %d bytes and FIN", total, fin, size)
+	}
+
+	remote.write(rawSynReply(3, 1, newRawCompressor(3)))
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request did not finish")
+	}
+}
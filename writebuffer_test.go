@@ -0,0 +1,284 @@
+package spdy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeCounter records each write made to a net.Conn.
+type writeCounter struct {
+	net.Conn
+	m      sync.Mutex
+	writes [][]byte
+}
+
+func (c *writeCounter) Write(b []byte) (int, error) {
+	c.m.Lock()
+	c.writes = append(c.writes, append([]byte(nil), b...))
+	c.m.Unlock()
+	return c.Conn.Write(b)
+}
+
+// count returns the number of writes made.
+func (c *writeCounter) count() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return len(c.writes)
+}
+
+// frames returns the types of the frames in each write,
+// as named by frameName.
+func (c *writeCounter) frames(t *testing.T, version uint16) [][]string {
+	t.Helper()
+	c.m.Lock()
+	defer c.m.Unlock()
+	var out [][]string
+	for _, write := range c.writes {
+		var types []string
+		r := bytes.NewReader(write)
+		for r.Len() > 0 {
+			frame, err := readRawFrame(r, version)
+			if err != nil {
+				t.Fatalf("a write did not hold whole frames: %v", err)
+			}
+			types = append(types, frameName(frame))
+		}
+		out = append(out, types)
+	}
+	return out
+}
+
+// frameName returns a short name for the frame's type.
+func frameName(frame Frame) string {
+	switch frame := frame.(type) {
+	case *settingsFrameV3, *settingsFrameV2:
+		return "SETTINGS"
+	case *pingFrameV3, *pingFrameV2:
+		return "PING"
+	case *rstStreamFrameV3, *rstStreamFrameV2:
+		return "RST_STREAM"
+	case *dataFrameV3:
+		if frame.Flags.FIN() {
+			return "DATA+FIN"
+		}
+		return "DATA"
+	case *dataFrameV2:
+		if frame.Flags.FIN() {
+			return "DATA+FIN"
+		}
+		return "DATA"
+	default:
+		return fmt.Sprintf("%T", frame)
+	}
+}
+
+// Frames sent back-to-back share a write, except that
+// DATA frames ending a stream, and PINGs, are written at
+// once, rather than waiting for any which follow.
+func TestSendCoalescing(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames []string // after the client's SETTINGS.
+		want   [][]string
+	}{
+		{
+			"DATA",
+			[]string{"DATA", "RST_STREAM"},
+			[][]string{{"SETTINGS", "DATA", "RST_STREAM"}},
+		},
+		{
+			"DATA with FIN",
+			[]string{"DATA+FIN", "RST_STREAM"},
+			[][]string{{"SETTINGS", "DATA+FIN"}, {"RST_STREAM"}},
+		},
+		{
+			"PING",
+			[]string{"PING", "DATA", "PING"},
+			[][]string{{"SETTINGS", "PING"}, {"DATA", "PING"}},
+		},
+	}
+
+	for _, test := range tests {
+		for _, version := range versions {
+			test, version := test, version
+			t.Run(fmt.Sprintf("SPDY/%d %s", version, test.name), func(t *testing.T) {
+				local, remote := net.Pipe()
+				counter := &writeCounter{Conn: local}
+				client, err := NewClientConn(counter, nil, version)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// The frames are sent with the connection's
+				// first frames, so they are written one after
+				// another, without waiting.
+				frames := make([]Frame, len(test.frames))
+				for i, name := range test.frames {
+					frames[i] = testFrame(version, name)
+				}
+				switch conn := client.(type) {
+				case *connV3:
+					init := conn.init
+					conn.init = func() []Frame { return append(init(), frames...) }
+				case *connV2:
+					init := conn.init
+					conn.init = func() []Frame { return append(init(), frames...) }
+				}
+
+				running := make(chan struct{})
+				go func() { defer close(running); client.Run() }()
+				defer func() {
+					remote.Close()
+					client.Close()
+					<-running
+				}()
+
+				go io.Copy(ioutil.Discard, remote)
+				var want int
+				for _, frames := range test.want {
+					want += len(frames)
+				}
+				within(t, 5*time.Second, "writing the frames", func() {
+					for {
+						var got int
+						for _, frames := range counter.frames(t, version) {
+							got += len(frames)
+						}
+						if got >= want {
+							return
+						}
+						time.Sleep(time.Millisecond)
+					}
+				})
+
+				if got := counter.frames(t, version); !reflect.DeepEqual(got, test.want) {
+					t.Errorf("got writes %v, want %v", got, test.want)
+				}
+			})
+		}
+	}
+}
+
+// testFrame returns a frame of the named type.
+func testFrame(version uint16, name string) Frame {
+	var flags Flags
+	if name == "DATA+FIN" {
+		flags = FLAG_FIN
+	}
+	switch {
+	case version == 3 && name == "PING":
+		return &pingFrameV3{PingID: 1}
+	case version == 3 && name == "RST_STREAM":
+		return &rstStreamFrameV3{StreamID: 1, Status: RST_STREAM_CANCEL}
+	case version == 3:
+		return &dataFrameV3{StreamID: 1, Flags: flags, Data: []byte("data")}
+	case name == "PING":
+		return &pingFrameV2{PingID: 1}
+	case name == "RST_STREAM":
+		return &rstStreamFrameV2{StreamID: 1, Status: RST_STREAM_CANCEL}
+	default:
+		return &dataFrameV2{StreamID: 1, Flags: flags, Data: []byte("data")}
+	}
+}
+
+// countedPipeConns is pipeConnsWith, but counts the
+// writes made by each connection.
+func countedPipeConns(tb testing.TB, srv *http.Server, version uint16, setup func(server, client Conn)) (client Conn, clientWrites, serverWrites *writeCounter) {
+	tb.Helper()
+	local, remote := net.Pipe()
+	clientWrites = &writeCounter{Conn: local}
+	serverWrites = &writeCounter{Conn: remote}
+
+	server, err := NewServerConn(serverWrites, srv, version)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	client, err = NewClientConn(clientWrites, nil, version)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if setup != nil {
+		setup(server, client)
+	}
+
+	var running sync.WaitGroup
+	running.Add(2)
+	go func() { defer running.Done(); server.Run() }()
+	go func() { defer running.Done(); client.Run() }()
+	tb.Cleanup(func() {
+		within(tb, 10*time.Second, "closing the connections", func() {
+			client.Close()
+			server.Close()
+			running.Wait()
+		})
+	})
+
+	return client, clientWrites, serverWrites
+}
+
+// smallRequests makes n small requests, with inFlight
+// requests at a time, and returns the number of writes
+// made by each end of the connection.
+func smallRequests(tb testing.TB, version uint16, n, inFlight int) (clientWrites, serverWrites int) {
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("small"))
+	})}
+	client, clientCounter, serverCounter := countedPipeConns(tb, srv, version, nil)
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, inFlight)
+	for i := 0; i < n; i++ {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-slots; wg.Done() }()
+			req, _ := http.NewRequest("GET", "https://example.com/", nil)
+			if _, err := request(client, req); err != nil {
+				tb.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return clientCounter.count(), serverCounter.count()
+}
+
+// Frames from concurrent requests share writes. Written
+// one at a time, each response takes at least two writes.
+func TestSmallRequestWrites(t *testing.T) {
+	const n = 200
+	for _, version := range versions {
+		within(t, 10*time.Second, "the requests", func() {
+			_, server := smallRequests(t, version, n, 50)
+			if server >= 2*n {
+				t.Errorf("SPDY/%d: the server made %d writes for %d responses", version, server, n)
+			}
+		})
+	}
+}
+
+// The writes made for 1000 small requests, 50 at a time,
+// are reported per request.
+func BenchmarkSmallRequests(b *testing.B) {
+	const n = 1000
+	for _, version := range versions {
+		b.Run(fmt.Sprintf("SPDY/%d", version), func(b *testing.B) {
+			var client, server int
+			for i := 0; i < b.N; i++ {
+				c, s := smallRequests(b, version, n, 50)
+				client += c
+				server += s
+			}
+			b.ReportMetric(float64(client)/float64(b.N*n), "client-writes/req")
+			b.ReportMetric(float64(server)/float64(b.N*n), "server-writes/req")
+		})
+	}
+}
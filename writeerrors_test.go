@@ -0,0 +1,89 @@
+package spdy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// brokenConn is a net.Conn whose writes fail once broken.
+type brokenConn struct {
+	net.Conn
+	broken int32
+}
+
+func (c *brokenConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&c.broken) != 0 {
+		return 0, errors.New("write: broken")
+	}
+	return c.Conn.Write(b)
+}
+
+// A failed write ends the connection, rather than leaving
+// the send loop dead while the rest of the connection waits
+// on it. The request in progress fails, Run returns, and
+// later pings and requests fail at once.
+func TestWriteError(t *testing.T) {
+	for _, version := range versions {
+		version := version
+		t.Run(fmt.Sprintf("SPDY/%d", version), func(t *testing.T) {
+			local, remote := net.Pipe()
+			defer remote.Close()
+			conn := &brokenConn{Conn: local}
+			client, err := NewClientConn(conn, nil, version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			running := make(chan struct{})
+			go func() { defer close(running); client.Run() }()
+
+			requests := make(chan struct{}, 1)
+			go func() {
+				for {
+					frame, err := readRawFrame(remote, version)
+					if err != nil {
+						return
+					}
+					switch frame.(type) {
+					case *synStreamFrameV3, *synStreamFrameV2:
+						requests <- struct{}{}
+					}
+				}
+			}()
+
+			done := make(chan error, 1)
+			go func() {
+				req, _ := http.NewRequest("GET", "https://example.com/", nil)
+				_, err := request(client, req)
+				done <- err
+			}()
+			within(t, 5*time.Second, "the request", func() { <-requests })
+
+			// The PING cannot be written.
+			atomic.StoreInt32(&conn.broken, 1)
+			if _, err := client.Ping(); err != nil {
+				t.Fatalf("Ping returned %v before the write failed", err)
+			}
+
+			within(t, 5*time.Second, "the connection closing", func() {
+				if err := <-done; err == nil {
+					t.Error("the request succeeded")
+				}
+				<-running
+			})
+			within(t, time.Second, "using the closed connection", func() {
+				if _, err := client.Ping(); err == nil {
+					t.Error("Ping succeeded after the write failed")
+				}
+				req, _ := http.NewRequest("GET", "https://example.com/", nil)
+				if _, err := client.Request(req, nil, 0); err == nil {
+					t.Error("Request succeeded after the write failed")
+				}
+			})
+		})
+	}
+}